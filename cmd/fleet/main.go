@@ -12,6 +12,7 @@ import (
 
 	"go.elastic.co/apm/v2"
 
+	"github.com/elastic/go-ucfg"
 	"github.com/elastic/go-ucfg/yaml"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/build"
@@ -27,6 +28,7 @@ import (
 
 const (
 	kAgentMode = "agent-mode"
+	kBootstrap = "bootstrap"
 )
 
 func init() {
@@ -58,6 +60,32 @@ func initLogger(cfg *config.Config, version, commit string) (*logger.Logger, err
 	return l, err
 }
 
+// loadStandaloneConfig reads the config file, applies the command line overrides and merges the settings of the
+// environment variables according to the config precedence.
+func loadStandaloneConfig(cfgPath string, cliCfg *ucfg.Config) (*config.Config, *config.Merged, error) {
+	cfgData, err := yaml.NewConfigWithFile(cfgPath, config.DefaultOptions...)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = cfgData.Merge(cliCfg, config.DefaultOptions...)
+	if err != nil {
+		return nil, nil, err
+	}
+	envCfg, err := config.EnvSource(os.Environ())
+	if err != nil {
+		return nil, nil, err
+	}
+	merged, err := config.MergeSources(config.Sources{File: cfgData, Env: envCfg})
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg, err := merged.Config()
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, merged, nil
+}
+
 func getRunCommand(bi build.Info) func(cmd *cobra.Command, args []string) error {
 	return func(cmd *cobra.Command, args []string) error {
 		cfgObject := cmd.Flags().Lookup("E").Value.(*config.Flag) //nolint:errcheck // we know the flag exists
@@ -67,6 +95,13 @@ func getRunCommand(bi build.Info) func(cmd *cobra.Command, args []string) error
 		if err != nil {
 			return err
 		}
+		bootstrap, err := cmd.Flags().GetBool(kBootstrap)
+		if err != nil {
+			return err
+		}
+		if agentMode && bootstrap {
+			return errors.New("--bootstrap is only supported by a standalone fleet-server")
+		}
 
 		var l *logger.Logger
 		if agentMode {
@@ -94,15 +129,7 @@ func getRunCommand(bi build.Info) func(cmd *cobra.Command, args []string) error
 			if err != nil {
 				return err
 			}
-			cfgData, err := yaml.NewConfigWithFile(cfgPath, config.DefaultOptions...)
-			if err != nil {
-				return err
-			}
-			err = cfgData.Merge(cliCfg, config.DefaultOptions...)
-			if err != nil {
-				return err
-			}
-			cfg, err := config.FromConfig(cfgData)
+			cfg, merged, err := loadStandaloneConfig(cfgPath, cliCfg)
 			if err != nil {
 				return err
 			}
@@ -111,6 +138,9 @@ func getRunCommand(bi build.Info) func(cmd *cobra.Command, args []string) error
 			if err != nil {
 				return err
 			}
+			if bootstrap {
+				cfg.Fleet.Bootstrap.Enabled = true
+			}
 
 			l, err = initLogger(cfg, bi.Version, bi.Commit)
 			if err != nil {
@@ -122,7 +152,23 @@ func getRunCommand(bi build.Info) func(cmd *cobra.Command, args []string) error
 				return err
 			}
 
-			if err := srv.Run(installSignalHandler(), cfg); err != nil && !errors.Is(err, context.Canceled) {
+			ctx := installSignalHandler()
+			merged.LogDiff(log.Logger.WithContext(ctx), nil)
+			// Re-read the config file on SIGHUP, settings such as the server limits are applied without a restart.
+			signal.HandleReload(ctx, func(ctx context.Context) {
+				newCfg, newMerged, err := loadStandaloneConfig(cfgPath, cliCfg)
+				if err != nil {
+					log.Error().Err(err).Str("path", cfgPath).Msg("Unable to reload configuration, keeping current configuration")
+					return
+				}
+				newMerged.LogDiff(log.Logger.WithContext(ctx), merged)
+				merged = newMerged
+				// Keep the standalone agent metadata stable across reloads.
+				newCfg.Fleet.Agent = cfg.Fleet.Agent
+				_ = srv.Reload(ctx, newCfg)
+			})
+
+			if err := srv.Run(ctx, cfg); err != nil && !errors.Is(err, context.Canceled) {
 				log.Error().Err(err).Msg("Exiting")
 				l.Sync()
 				return err
@@ -142,6 +188,8 @@ func NewCommand(bi build.Info) *cobra.Command {
 	}
 	cmd.Flags().StringP("config", "c", "fleet-server.yml", "Configuration for Fleet Server")
 	cmd.Flags().Bool(kAgentMode, false, "Running under execution of the Elastic Agent")
+	cmd.Flags().Bool(kBootstrap, false, "Create a policy and an enrollment key on the first start against a cluster without Kibana")
 	cmd.Flags().VarP(config.NewFlag(), "E", "E", "Overwrite configuration value")
+	cmd.AddCommand(newVerifyCommand(bi))
 	return cmd
 }
@@ -0,0 +1,85 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package fleet
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/build"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/verify"
+)
+
+const (
+	kVerifyJSON    = "json"
+	kVerifyTimeout = "timeout"
+)
+
+// ErrVerifyFailed is returned by the verify command when a check failed, the report tells which.
+var ErrVerifyFailed = errors.New("verification failed")
+
+func getVerifyCommand(bi build.Info) func(cmd *cobra.Command, args []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		cfgObject := cmd.Flags().Lookup("E").Value.(*config.Flag) //nolint:errcheck // we know the flag exists
+		cliCfg := cfgObject.Config()
+
+		cfgPath, err := cmd.Flags().GetString("config")
+		if err != nil {
+			return err
+		}
+		asJSON, err := cmd.Flags().GetBool(kVerifyJSON)
+		if err != nil {
+			return err
+		}
+		timeout, err := cmd.Flags().GetDuration(kVerifyTimeout)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(installSignalHandler(), timeout)
+		defer cancel()
+
+		report := verify.Run(ctx, bi, func() (*config.Config, error) {
+			cfg, _, err := loadStandaloneConfig(cfgPath, cliCfg)
+			return cfg, err
+		})
+		if asJSON {
+			err = report.WriteJSON(cmd.OutOrStdout())
+		} else {
+			err = report.Write(cmd.OutOrStdout())
+		}
+		if err != nil {
+			return err
+		}
+		if !report.Passed {
+			return ErrVerifyFailed
+		}
+		return nil
+	}
+}
+
+func newVerifyCommand(bi build.Info) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Verify the configuration, the connection to Elasticsearch and the fleet indices",
+		Long: "Verify loads the configuration the same way as a stand-alone Fleet Server, connects to Elasticsearch, " +
+			"checks the privileges of the configured credentials and that Fleet is set up. " +
+			"It exits with a non-zero status if any check fails.",
+		Args: cobra.NoArgs,
+		// The report already describes the failure, main prints the returned error.
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE:          getVerifyCommand(bi),
+	}
+	cmd.Flags().StringP("config", "c", "fleet-server.yml", "Configuration for Fleet Server")
+	cmd.Flags().VarP(config.NewFlag(), "E", "E", "Overwrite configuration value")
+	cmd.Flags().Bool(kVerifyJSON, false, "Print the report as JSON")
+	cmd.Flags().Duration(kVerifyTimeout, 30*time.Second, "Time allowed for all checks")
+	return cmd
+}
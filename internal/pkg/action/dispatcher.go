@@ -7,9 +7,12 @@ package action
 
 import (
 	"context"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
 	"github.com/elastic/fleet-server/v7/internal/pkg/es"
 	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
 	"github.com/elastic/fleet-server/v7/internal/pkg/model"
@@ -22,9 +25,11 @@ import (
 
 // Sub is an action subscription that will give a single agent all of it's actions.
 type Sub struct {
-	agentID string
-	seqNo   sqn.SeqNo
-	ch      chan []model.Action
+	agentID    string
+	tags       []string
+	namespaces []string
+	seqNo      sqn.SeqNo
+	ch         chan []model.Action
 }
 
 // Ch returns the emitter channel for actions.
@@ -39,6 +44,8 @@ type Dispatcher struct {
 
 	mx   sync.RWMutex
 	subs map[string]Sub
+
+	now func() time.Time
 }
 
 // NewDispatcher creates a Dispatcher using the provided monitor.
@@ -51,7 +58,18 @@ func NewDispatcher(am monitor.SimpleMonitor, throttle time.Duration, i int) *Dis
 		am:    am,
 		limit: rate.NewLimiter(r, i),
 		subs:  make(map[string]Sub),
+		now:   time.Now,
+	}
+}
+
+// ReloadLimits applies the action limit to a running Dispatcher.
+func (d *Dispatcher) ReloadLimits(cfg *config.ServerLimits) {
+	r := rate.Inf
+	if cfg.ActionLimit.Interval > 0 {
+		r = rate.Every(cfg.ActionLimit.Interval)
 	}
+	d.limit.SetLimit(r)
+	d.limit.SetBurst(cfg.ActionLimit.Burst)
 }
 
 // Run starts the Dispatcher.
@@ -69,14 +87,18 @@ func (d *Dispatcher) Run(ctx context.Context) error {
 }
 
 // Subscribe generates a new subscription with the Dispatcher using the provided agentID and seqNo.
-// There is no check to ensure that the agentID has not been used; using the same one twice results in undefined behaviour.
-func (d *Dispatcher) Subscribe(agentID string, seqNo sqn.SeqNo) *Sub {
+// The subscription also receives the actions intended for any of the agent tags.
+// When the agent has namespaces, the subscription does not receive the actions of the other namespaces.
+// Subscribing with an agentID that is already subscribed replaces the previous subscription.
+func (d *Dispatcher) Subscribe(agentID string, tags, namespaces []string, seqNo sqn.SeqNo) *Sub {
 	cbCh := make(chan []model.Action, 1)
 
 	sub := Sub{
-		agentID: agentID,
-		seqNo:   seqNo,
-		ch:      cbCh,
+		agentID:    agentID,
+		tags:       tags,
+		namespaces: namespaces,
+		seqNo:      seqNo,
+		ch:         cbCh,
 	}
 
 	d.mx.Lock()
@@ -90,6 +112,7 @@ func (d *Dispatcher) Subscribe(agentID string, seqNo sqn.SeqNo) *Sub {
 }
 
 // Unsubscribe removes the given subscription from the dispatcher.
+// A newer subscription of the same agent is kept.
 // Note that the channel sub.Ch() provides is not closed in this event.
 func (d *Dispatcher) Unsubscribe(sub *Sub) {
 	if sub == nil {
@@ -97,7 +120,9 @@ func (d *Dispatcher) Unsubscribe(sub *Sub) {
 	}
 
 	d.mx.Lock()
-	delete(d.subs, sub.agentID)
+	if cur, ok := d.subs[sub.agentID]; ok && cur.ch == sub.ch {
+		delete(d.subs, sub.agentID)
+	}
 	sz := len(d.subs)
 	d.mx.Unlock()
 
@@ -117,12 +142,14 @@ func (d *Dispatcher) process(ctx context.Context, hits []es.HitT) {
 			zerolog.Ctx(ctx).Error().Err(err).Msg("Failed to unmarshal action document")
 			break
 		}
-		numAgents := len(action.Agents)
-		for i, agentID := range action.Agents {
+		agents := d.targets(action)
+		numAgents := len(agents)
+		for i, agentID := range agents {
 			arr := agentActions[agentID]
 			actionNoAgents := action
 			actionNoAgents.StartTime = offsetStartTime(ctx, action.StartTime, action.RolloutDurationSeconds, i, numAgents)
 			actionNoAgents.Agents = nil
+			actionNoAgents.Tags = nil
 			arr = append(arr, actionNoAgents)
 			agentActions[agentID] = arr
 		}
@@ -137,6 +164,42 @@ func (d *Dispatcher) process(ctx context.Context, hits []es.HitT) {
 	}
 }
 
+// targets returns the IDs of the agents the action is intended for.
+// The tags of an action are expanded to the subscribed agents with any of the tags that can see the action namespaces,
+// they follow the listed agents sorted by ID.
+func (d *Dispatcher) targets(action model.Action) []string {
+	if len(action.Tags) == 0 {
+		return action.Agents
+	}
+
+	listed := make(map[string]struct{}, len(action.Agents))
+	for _, agentID := range action.Agents {
+		listed[agentID] = struct{}{}
+	}
+	var tagged []string
+	d.mx.RLock()
+	for agentID, sub := range d.subs {
+		if _, ok := listed[agentID]; !ok && hasAnyTag(sub.tags, action.Tags) && model.InNamespaces(sub.namespaces, action.Namespaces) {
+			tagged = append(tagged, agentID)
+		}
+	}
+	d.mx.RUnlock()
+	sort.Strings(tagged)
+
+	agents := make([]string, 0, len(action.Agents)+len(tagged))
+	agents = append(agents, action.Agents...)
+	return append(agents, tagged...)
+}
+
+func hasAnyTag(agentTags, actionTags []string) bool {
+	for _, tag := range actionTags {
+		if slices.Contains(agentTags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
 // offsetStartTime will return a new start time between start:start+dur based on index i and the total number of agents
 // As we expect i < total  the latest return time will always be < start+dur
 func offsetStartTime(ctx context.Context, start string, dur int64, i, total int) string {
@@ -164,14 +227,38 @@ func (d *Dispatcher) getSub(agentID string) (Sub, bool) {
 
 // dispatch passes the actions into the subscription channel as a non-blocking operation.
 // It may drop actions that will be re-sent to the agent on its next check in.
+// The actions up to the sequence number of the subscription were already delivered to the agent, they are dropped,
+// which happens when the monitor replays the actions written before a restart.
+// The actions of namespaces the agent is not in are dropped as well.
 func (d *Dispatcher) dispatch(ctx context.Context, agentID string, acdocs []model.Action) {
 	sub, ok := d.getSub(agentID)
 	if !ok {
 		zerolog.Ctx(ctx).Debug().Str(logger.AgentID, agentID).Msg("Agent is not currently connected. Not dispatching actions.")
 		return
 	}
+	if len(sub.namespaces) > 0 {
+		acdocs = slices.DeleteFunc(acdocs, func(a model.Action) bool {
+			if model.InNamespaces(sub.namespaces, a.Namespaces) {
+				return false
+			}
+			zerolog.Ctx(ctx).Warn().Str(logger.AgentID, agentID).Str(logger.ActionID, a.ActionID).Strs("namespaces", a.Namespaces).Msg("Not dispatching action of another namespace")
+			return true
+		})
+		if len(acdocs) == 0 {
+			return
+		}
+	}
+	if sub.seqNo.IsSet() {
+		acdocs = slices.DeleteFunc(acdocs, func(a model.Action) bool {
+			return a.SeqNo <= sub.seqNo.Value()
+		})
+		if len(acdocs) == 0 {
+			return
+		}
+	}
 	select {
 	case sub.Ch() <- acdocs:
+		d.observeLatency(acdocs)
 	default:
 		// This prevents action dispatch blocking when the agent subscription channel is full
 		// in the case when the agent request loop received the actions on long poll but didn't unsubscribe
@@ -179,3 +266,15 @@ func (d *Dispatcher) dispatch(ctx context.Context, agentID string, acdocs []mode
 		// It is safe to drop them since the agent already has actions and will come around on the next check-in to pick up these new actions.
 	}
 }
+
+// observeLatency records the time from the write of the dispatched actions.
+func (d *Dispatcher) observeLatency(acdocs []model.Action) {
+	now := d.now()
+	for _, a := range acdocs {
+		written, err := time.Parse(time.RFC3339Nano, a.Timestamp)
+		if err != nil {
+			continue
+		}
+		dispatchLatency.Observe(now.Sub(written).Seconds())
+	}
+}
@@ -10,11 +10,14 @@ import (
 	"testing"
 	"time"
 
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
 	"github.com/elastic/fleet-server/v7/internal/pkg/es"
 	"github.com/elastic/fleet-server/v7/internal/pkg/model"
 	"github.com/elastic/fleet-server/v7/internal/pkg/sqn"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/time/rate"
 )
 
@@ -37,6 +40,10 @@ func (m *mockMonitor) GetCheckpoint() sqn.SeqNo {
 	return args.Get(0).(sqn.SeqNo)
 }
 
+func (m *mockMonitor) Nudge() {
+	m.Called()
+}
+
 func TestNewDispatcher(t *testing.T) {
 	m := &mockMonitor{}
 	d := NewDispatcher(m, 0, 0)
@@ -45,6 +52,19 @@ func TestNewDispatcher(t *testing.T) {
 	assert.NotNil(t, d.subs)
 }
 
+func TestDispatcher_ReloadLimits(t *testing.T) {
+	d := NewDispatcher(&mockMonitor{}, 0, 5)
+	assert.Equal(t, rate.Inf, d.limit.Limit())
+
+	d.ReloadLimits(&config.ServerLimits{ActionLimit: config.Limit{Interval: time.Millisecond, Burst: 100}})
+	assert.Equal(t, rate.Every(time.Millisecond), d.limit.Limit())
+	assert.Equal(t, 100, d.limit.Burst())
+
+	d.ReloadLimits(&config.ServerLimits{ActionLimit: config.Limit{Burst: 5}})
+	assert.Equal(t, rate.Inf, d.limit.Limit())
+	assert.Equal(t, 5, d.limit.Burst())
+}
+
 func compareActions(t *testing.T, expects, results []model.Action) {
 	t.Helper()
 	assert.Equal(t, len(expects), len(results))
@@ -256,6 +276,7 @@ func Test_Dispatcher_Run(t *testing.T) {
 						ch:      make(chan []model.Action, 1),
 					},
 				},
+				now: time.Now,
 			}
 
 			now := time.Now()
@@ -306,6 +327,146 @@ func Test_Dispatcher_Run(t *testing.T) {
 	}
 }
 
+func TestDispatcher_UnsubscribeReplaced(t *testing.T) {
+	d := NewDispatcher(&mockMonitor{}, 0, 0)
+
+	prev := d.Subscribe("agent1", nil, nil, nil)
+	latest := d.Subscribe("agent1", nil, nil, nil)
+
+	d.Unsubscribe(prev)
+	sub, ok := d.getSub("agent1")
+	assert.True(t, ok, "expected the latest subscription to be kept")
+	assert.Equal(t, latest.Ch(), sub.Ch())
+
+	d.Unsubscribe(latest)
+	_, ok = d.getSub("agent1")
+	assert.False(t, ok)
+}
+
+func TestDispatcher_TagTargeted(t *testing.T) {
+	d := NewDispatcher(&mockMonitor{}, 0, 1)
+	canary := d.Subscribe("agent1", []string{"canary"}, nil, nil)
+	listed := d.Subscribe("agent2", []string{"prod"}, nil, nil)
+	both := d.Subscribe("agent3", []string{"canary", "prod"}, nil, nil)
+	other := d.Subscribe("agent4", nil, nil, nil)
+
+	d.process(context.Background(), []es.HitT{{
+		Source: json.RawMessage(`{"action_id":"test-action","agents":["agent2"],"tags":["canary"],"rollout_duration_seconds":300,"start_time":"2022-01-02T12:00:00Z","type":"upgrade"}`),
+	}})
+
+	// the listed agents come first, then the tagged agents sorted by ID
+	for sub, start := range map[*Sub]string{
+		listed: "2022-01-02T12:00:00Z",
+		canary: "2022-01-02T12:01:40Z",
+		both:   "2022-01-02T12:03:20Z",
+	} {
+		select {
+		case actions := <-sub.Ch():
+			compareActions(t, []model.Action{{
+				ActionID:               "test-action",
+				RolloutDurationSeconds: 300,
+				StartTime:              start,
+				Type:                   "upgrade",
+			}}, actions)
+			assert.Nil(t, actions[0].Tags)
+		default:
+			t.Errorf("expected the action to be dispatched to %s", sub.agentID)
+		}
+	}
+	select {
+	case actions := <-other.Ch():
+		t.Errorf("unexpected actions dispatched to agent4: %v", actions)
+	default:
+	}
+}
+
+func TestDispatcher_Namespaces(t *testing.T) {
+	d := NewDispatcher(&mockMonitor{}, 0, 1)
+	space1 := d.Subscribe("agent1", []string{"canary"}, []string{"space1"}, nil)
+	space2 := d.Subscribe("agent2", []string{"canary"}, []string{"space2"}, nil)
+	global := d.Subscribe("agent3", []string{"canary"}, nil, nil)
+
+	d.process(context.Background(), []es.HitT{{
+		Source: json.RawMessage(`{"action_id":"space1-action","agents":["agent1","agent2","agent3"],"namespaces":["space1"],"type":"upgrade"}`),
+	}, {
+		Source: json.RawMessage(`{"action_id":"space2-tagged-action","tags":["canary"],"namespaces":["space2"],"type":"upgrade"}`),
+	}, {
+		Source: json.RawMessage(`{"action_id":"unscoped-action","agents":["agent1","agent2"],"type":"upgrade"}`),
+	}})
+
+	for sub, expected := range map[*Sub][]string{
+		space1: {"space1-action", "unscoped-action"},
+		space2: {"space2-tagged-action", "unscoped-action"},
+		global: {"space1-action", "space2-tagged-action"},
+	} {
+		select {
+		case actions := <-sub.Ch():
+			var ids []string
+			for _, action := range actions {
+				ids = append(ids, action.ActionID)
+			}
+			assert.Equal(t, expected, ids, "actions dispatched to %s", sub.agentID)
+		default:
+			t.Errorf("expected actions to be dispatched to %s", sub.agentID)
+		}
+	}
+}
+
+func TestDispatcher_DeliveredActions(t *testing.T) {
+	d := NewDispatcher(&mockMonitor{}, 0, 1)
+	sub := d.Subscribe("agent1", nil, nil, sqn.SeqNo{5})
+
+	// replayed actions the agent already received are dropped
+	d.process(context.Background(), []es.HitT{{
+		SeqNo:  4,
+		Source: json.RawMessage(`{"action_id":"old-action","agents":["agent1"],"type":"upgrade"}`),
+	}, {
+		SeqNo:  5,
+		Source: json.RawMessage(`{"action_id":"acked-action","agents":["agent1"],"type":"upgrade"}`),
+	}})
+	select {
+	case actions := <-sub.Ch():
+		t.Fatalf("unexpected actions dispatched: %v", actions)
+	default:
+	}
+
+	d.process(context.Background(), []es.HitT{{
+		SeqNo:  5,
+		Source: json.RawMessage(`{"action_id":"acked-action","agents":["agent1"],"type":"upgrade"}`),
+	}, {
+		SeqNo:  6,
+		Source: json.RawMessage(`{"action_id":"new-action","agents":["agent1"],"type":"upgrade"}`),
+	}})
+	select {
+	case actions := <-sub.Ch():
+		require.Len(t, actions, 1)
+		assert.Equal(t, "new-action", actions[0].ActionID)
+	default:
+		t.Fatal("expected the new action to be dispatched")
+	}
+}
+
+func TestDispatcher_DispatchLatency(t *testing.T) {
+	latency := func() (uint64, float64) {
+		var m dto.Metric
+		require.NoError(t, dispatchLatency.Write(&m))
+		return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+	}
+	written := time.Date(2024, 9, 18, 12, 0, 0, 0, time.UTC)
+
+	d := NewDispatcher(&mockMonitor{}, 0, 1)
+	d.now = func() time.Time { return written.Add(1500 * time.Millisecond) }
+	d.Subscribe("agent1", nil, nil, nil)
+	count, sum := latency()
+
+	d.process(context.Background(), []es.HitT{{
+		Source: json.RawMessage(`{"action_id":"test-action","agents":["agent1","agent2"],"type":"upgrade","@timestamp":"` + written.Format(time.RFC3339Nano) + `"}`),
+	}})
+	newCount, newSum := latency()
+	assert.Equal(t, count+1, newCount, "only the action dispatched to a connected agent is observed")
+	assert.InDelta(t, 1.5, newSum-sum, 1e-9)
+}
+
 func Test_offsetStartTime(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -0,0 +1,21 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package action
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var dispatchLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Namespace: "action",
+	Name:      "dispatch_latency_seconds",
+	Help:      "Time from the write of an action to its dispatch to a checkin of the agent.",
+	Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+})
+
+// MetricsCollectors returns the prometheus collectors of the action dispatch.
+func MetricsCollectors() []prometheus.Collector {
+	return []prometheus.Collector{dispatchLatency}
+}
@@ -0,0 +1,114 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/cache"
+)
+
+const adminShutdownTimeout = 5 * time.Second
+
+// AdminCache is the cache inspected and evicted through the admin endpoint.
+type AdminCache interface {
+	Stats() cache.Stats
+	Evict(kind, key string) error
+}
+
+// AdminServer serves the admin endpoint on a unix socket, it is never bound to TCP.
+//
+//	GET /cache/stats returns the statistics of the cache.
+//	DELETE /cache/{kind}/{key} evicts an apikey, artifact or action entry from the cache.
+type AdminServer struct {
+	path    string
+	cache   AdminCache
+	handler http.Handler
+}
+
+// NewAdminServer returns the admin server listening on the unix socket at path.
+func NewAdminServer(path string, c AdminCache) *AdminServer {
+	s := &AdminServer{
+		path:  path,
+		cache: c,
+	}
+	r := chi.NewRouter()
+	r.Get("/cache/stats", s.handleCacheStats)
+	r.Delete("/cache/{kind}/{key}", s.handleCacheEvict)
+	s.handler = r
+	return s
+}
+
+func (s *AdminServer) handleCacheStats(w http.ResponseWriter, _ *http.Request) {
+	data, err := json.Marshal(s.cache.Stats())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+func (s *AdminServer) handleCacheEvict(w http.ResponseWriter, r *http.Request) {
+	kind, key := chi.URLParam(r, "kind"), chi.URLParam(r, "key")
+	if err := s.cache.Evict(kind, key); err != nil {
+		status, code := http.StatusBadRequest, ErrCodeBadRequest
+		if errors.Is(err, cache.ErrUnknownKind) {
+			status, code = http.StatusNotFound, ErrCodeNotFound
+		}
+		_ = HTTPErrResp{
+			StatusCode: status,
+			Error:      "ErrCacheEvict",
+			Code:       code,
+			Message:    err.Error(),
+		}.Write(w)
+		return
+	}
+	zerolog.Ctx(r.Context()).Info().Str("kind", kind).Str("key", key).Msg("cache entry evicted through the admin endpoint")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Run serves the admin endpoint until the context is cancelled.
+func (s *AdminServer) Run(ctx context.Context) error {
+	ln, err := listenUnixSocket(s.path, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to listen on admin socket %s: %w", s.path, err)
+	}
+
+	srv := http.Server{
+		Handler:           s.handler,
+		ReadHeaderTimeout: adminShutdownTimeout,
+		BaseContext:       func(net.Listener) context.Context { return context.WithoutCancel(ctx) },
+		ErrorLog:          errLogger(ctx),
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		zerolog.Ctx(ctx).Info().Str("path", s.path).Msg("Admin endpoint listening on unix socket")
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errCh <- err
+		}
+	}()
+
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("error while serving admin socket: %w", err)
+	case <-ctx.Done():
+		sCtx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(sCtx); err != nil {
+			return errors.Join(fmt.Errorf("error while shutting down admin socket: %w", err), srv.Close())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/apikey"
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/cache"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+// startAdminServer runs the admin server on a socket in a temporary directory and returns a client connected to it.
+func startAdminServer(ctx context.Context, t *testing.T, c AdminCache) (string, *http.Client) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "admin.sock")
+
+	ctx, cancel := context.WithCancel(ctx)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- NewAdminServer(path, c).Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		assert.NoError(t, <-errCh)
+		assert.NoFileExists(t, path, "the socket is removed on shutdown")
+	})
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+	return path, client
+}
+
+func adminRequest(ctx context.Context, t *testing.T, client *http.Client, method, path string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, method, "http://admin"+path, nil)
+	require.NoError(t, err)
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+func TestAdminSocketPermissions(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	c, err := cache.New(config.Cache{NumCounters: 100, MaxCost: 100000})
+	require.NoError(t, err)
+
+	path, _ := startAdminServer(ctx, t, c)
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.NotZero(t, fi.Mode()&os.ModeSocket)
+	assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+}
+
+func TestAdminSocketReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	ln, err := listenUnixSocket(path, 0o600)
+	require.NoError(t, err)
+	// The socket is left behind, like after a crash.
+	ln.(*unixListener).UnixListener.Close()
+	require.FileExists(t, path)
+
+	ln, err = listenUnixSocket(path, 0o600)
+	require.NoError(t, err)
+	require.NoError(t, ln.Close())
+	assert.NoFileExists(t, path)
+
+	require.NoError(t, os.WriteFile(path, []byte("data"), 0o600))
+	_, err = listenUnixSocket(path, 0o600)
+	assert.ErrorContains(t, err, "is not a socket")
+}
+
+func TestAdminCacheStats(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	c, err := cache.New(config.Cache{NumCounters: 100, MaxCost: 100000, APIKeyTTL: time.Hour})
+	require.NoError(t, err)
+
+	key := apikey.APIKey{ID: "keyID", Key: "key"}
+	c.SetAPIKey(key, true)
+	require.Eventually(t, func() bool { return c.ValidAPIKey(key) }, time.Second, 10*time.Millisecond)
+
+	_, client := startAdminServer(ctx, t, c)
+	res := adminRequest(ctx, t, client, http.MethodGet, "/cache/stats")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+
+	var stats cache.Stats
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&stats))
+	assert.Equal(t, uint64(1), stats.KeysAdded)
+	assert.NotZero(t, stats.Hits)
+	assert.NotZero(t, stats.Cost)
+}
+
+func TestAdminCacheEvict(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	key := apikey.APIKey{ID: "keyID", Key: "key"}
+
+	c, err := cache.New(config.Cache{NumCounters: 100, MaxCost: 100000, APIKeyTTL: time.Hour})
+	require.NoError(t, err)
+
+	bulker := ftesting.NewMockBulk()
+	bulker.On("APIKeyAuth", mock.Anything, key).Return(&bulk.SecurityInfo{Enabled: true}, nil)
+
+	auth := func() {
+		r := httptest.NewRequest(http.MethodPost, "/api/fleet/agents/test/checkin", nil).WithContext(ctx)
+		r.Header.Set(apikey.AuthKey, "ApiKey "+key.Token())
+		_, err := authAPIKey(r, bulker, c)
+		require.NoError(t, err)
+	}
+
+	auth()
+	require.Eventually(t, func() bool { return c.ValidAPIKey(key) }, time.Second, 10*time.Millisecond)
+	auth()
+	bulker.AssertNumberOfCalls(t, "APIKeyAuth", 1)
+
+	_, client := startAdminServer(ctx, t, c)
+	res := adminRequest(ctx, t, client, http.MethodDelete, "/cache/apikey/"+key.ID)
+	require.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	auth()
+	bulker.AssertNumberOfCalls(t, "APIKeyAuth", 2)
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		code   ErrorCode
+	}{
+		{"unknown kind", "/cache/policy/id", http.StatusNotFound, ErrCodeNotFound},
+		{"artifact key without sha2", "/cache/artifact/endpoint-exceptionlist-linux-v1", http.StatusBadRequest, ErrCodeBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			res := adminRequest(ctx, t, client, http.MethodDelete, tc.path)
+			require.Equal(t, tc.status, res.StatusCode)
+			var body HTTPErrResp
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+			assert.Equal(t, tc.code, body.Code)
+		})
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/go-version"
+	"github.com/rs/zerolog"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+)
+
+// ErrAgentVersionUnsupported is returned when the version of an agent is outside of the range accepted by
+// server.compatibility.
+var ErrAgentVersionUnsupported = errors.New("agent version is not supported")
+
+// agentVersionGate rejects the agents whose version is outside of the accepted range.
+type agentVersionGate struct {
+	min              *version.Version
+	max              *version.Version
+	accepted         string
+	rejectUnparsable bool
+}
+
+// newAgentVersionGate returns the gate of the configuration, or nil when the agent versions are not restricted.
+func newAgentVersionGate(cfg *config.Compatibility) *agentVersionGate {
+	// The versions are validated with the configuration.
+	minVer, maxVer, err := cfg.AgentVersionRange()
+	if err != nil || (minVer == nil && maxVer == nil) {
+		return nil
+	}
+	var accepted []string
+	if minVer != nil {
+		accepted = append(accepted, ">= "+cfg.MinAgentVersion)
+	}
+	if maxVer != nil {
+		accepted = append(accepted, "<= "+cfg.MaxAgentVersion)
+	}
+	return &agentVersionGate{
+		min:              minVer,
+		max:              maxVer,
+		accepted:         strings.Join(accepted, ", "),
+		rejectUnparsable: cfg.RejectUnparsableVersion,
+	}
+}
+
+// check returns an error when the agent version is not accepted. The version is read from the local metadata sent by
+// the agent, or from its user agent when the local metadata does not have it.
+func (g *agentVersionGate) check(zlog zerolog.Logger, localMeta []byte, userAgent string) error {
+	if g == nil {
+		return nil
+	}
+	verStr := localMetadataAgentVersion(localMeta)
+	if verStr == "" {
+		verStr = userAgent
+	}
+	ver, err := parseAgentVersion(verStr)
+	if err != nil {
+		if g.rejectUnparsable {
+			return fmt.Errorf("%w: unable to parse agent version %q, accepted versions are %s", ErrAgentVersionUnsupported, verStr, g.accepted)
+		}
+		zlog.Warn().Err(err).Str("agent.version", verStr).Msg("Unable to parse the agent version, the agent is accepted")
+		return nil
+	}
+	if (g.min != nil && ver.LessThan(g.min)) || (g.max != nil && ver.GreaterThan(g.max)) {
+		return fmt.Errorf("%w: agent version %s, accepted versions are %s", ErrAgentVersionUnsupported, ver, g.accepted)
+	}
+	return nil
+}
+
+// parseAgentVersion parses the version of an agent, or the version of its user agent. The suffixes of the snapshots,
+// the pre-releases and the builds, such as 8.16.0-SNAPSHOT or 8.16.0+build202410081200, are ignored.
+func parseAgentVersion(s string) (*version.Version, error) {
+	s = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), userAgentPrefix)
+	s = strings.TrimPrefix(s, "v")
+	if i := strings.IndexAny(s, "-+ ("); i >= 0 {
+		s = s[:i]
+	}
+	ver, err := version.NewVersion(s)
+	if err != nil {
+		return nil, err
+	}
+	return ver.Core(), nil
+}
+
+// localMetadataAgentVersion returns the elastic.agent.version of the local metadata, or an empty string when it's
+// not set.
+func localMetadataAgentVersion(data []byte) string {
+	var meta struct {
+		Elastic struct {
+			Agent struct {
+				Version string `json:"version"`
+			} `json:"agent"`
+		} `json:"elastic"`
+	}
+	if len(data) == 0 || json.Unmarshal(data, &meta) != nil {
+		return ""
+	}
+	return meta.Elastic.Agent.Version
+}
@@ -0,0 +1,128 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+)
+
+func TestParseAgentVersion(t *testing.T) {
+	tests := map[string]string{
+		"8.16.0":                         "8.16.0",
+		"v8.16.0":                        "8.16.0",
+		"8.16.0-SNAPSHOT":                "8.16.0",
+		"8.16.0+build202410081200":       "8.16.0",
+		"8.16.0-SNAPSHOT+a1b2c3d":        "8.16.0",
+		"elastic agent v8.16.0-SNAPSHOT": "8.16.0",
+		"Elastic Agent v7.16.3":          "7.16.3",
+		"8.16.0 (build: a1b2c3d at 2024-10-08 12:00:00 +0000 UTC)": "8.16.0",
+		"7.16": "7.16.0",
+	}
+	for s, expected := range tests {
+		t.Run(s, func(t *testing.T) {
+			ver, err := parseAgentVersion(s)
+			require.NoError(t, err)
+			assert.Equal(t, expected, ver.String())
+		})
+	}
+
+	for _, s := range []string{"", "latest", "elastic agent", "eight.sixteen"} {
+		t.Run("unparsable "+s, func(t *testing.T) {
+			_, err := parseAgentVersion(s)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestAgentVersionGate(t *testing.T) {
+	localMeta := func(ver string) []byte {
+		return []byte(`{"elastic":{"agent":{"id":"agent-1","version":"` + ver + `"}}}`)
+	}
+	gate := newAgentVersionGate(&config.Compatibility{MinAgentVersion: "7.16", MaxAgentVersion: "8.15"})
+	require.NotNil(t, gate)
+
+	tests := []struct {
+		name      string
+		localMeta []byte
+		userAgent string
+		err       bool
+	}{{
+		name:      "min version",
+		localMeta: localMeta("7.16.0"),
+		userAgent: "elastic agent v7.16.0",
+	}, {
+		name:      "below min version",
+		localMeta: localMeta("7.15.2"),
+		userAgent: "elastic agent v7.15.2",
+		err:       true,
+	}, {
+		name:      "min version snapshot",
+		localMeta: localMeta("7.16.0-SNAPSHOT"),
+		userAgent: "elastic agent v7.16.0-snapshot",
+	}, {
+		name:      "last patch of max minor",
+		localMeta: localMeta("8.15.99"),
+		userAgent: "elastic agent v8.15.99",
+	}, {
+		name:      "above max version",
+		localMeta: localMeta("8.16.0"),
+		userAgent: "elastic agent v8.16.0",
+		err:       true,
+	}, {
+		name:      "local metadata wins over user agent",
+		localMeta: localMeta("7.10.0"),
+		userAgent: "elastic agent v8.0.0",
+		err:       true,
+	}, {
+		name:      "user agent without local metadata",
+		userAgent: "elastic agent v7.15.0",
+		err:       true,
+	}, {
+		name:      "user agent when local metadata has no version",
+		localMeta: []byte(`{"host":{"name":"host-1"}}`),
+		userAgent: "elastic agent v8.0.0",
+	}, {
+		name:      "unparsable version accepted",
+		localMeta: localMeta("latest"),
+		userAgent: "elastic agent v7.10.0",
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := gate.check(zerolog.Nop(), tc.localMeta, tc.userAgent)
+			if !tc.err {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, ErrAgentVersionUnsupported)
+			assert.ErrorContains(t, err, "accepted versions are >= 7.16, <= 8.15")
+			resp := NewHTTPErrResp(err)
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+			assert.Equal(t, ErrCodeAgentVersionUnsupported, resp.Code)
+			assert.Contains(t, resp.Message, ">= 7.16, <= 8.15")
+		})
+	}
+
+	t.Run("unparsable version rejected", func(t *testing.T) {
+		gate := newAgentVersionGate(&config.Compatibility{MinAgentVersion: "7.16", RejectUnparsableVersion: true})
+		err := gate.check(zerolog.Nop(), localMeta("latest"), "elastic agent v8.0.0")
+		assert.ErrorIs(t, err, ErrAgentVersionUnsupported)
+		assert.ErrorContains(t, err, `unable to parse agent version "latest", accepted versions are >= 7.16`)
+	})
+
+	t.Run("not restricted", func(t *testing.T) {
+		gate := newAgentVersionGate(&config.Compatibility{RejectUnparsableVersion: true})
+		assert.Nil(t, gate)
+		assert.NoError(t, gate.check(zerolog.Nop(), localMeta("latest"), ""))
+	})
+}
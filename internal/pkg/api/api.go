@@ -5,10 +5,12 @@
 package api
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/build"
 	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
 	"github.com/elastic/fleet-server/v7/internal/pkg/policy"
 	"github.com/elastic/fleet-server/v7/internal/pkg/rollback"
 
@@ -28,7 +30,12 @@ type apiServer struct {
 	ut     *UploadT
 	ft     *FileDeliveryT
 	pt     *PGPRetrieverT
+	aat    *AgentActionsT
+	art    *ActionResultT
+	ppt    *PolicyPreviewT
 	bulker bulk.Bulk
+
+	timeouts config.ServerTimeouts
 }
 
 // ensure api implements the ServerInterface
@@ -38,6 +45,16 @@ func (a *apiServer) AgentEnroll(w http.ResponseWriter, r *http.Request, params A
 	zlog := hlog.FromRequest(r).With().Str("mod", kEnrollMod).Logger()
 	w.Header().Set("Content-Type", "application/json")
 
+	// Agents enrolled before the policy of the fleet-server is ready would get an incomplete policy.
+	if !a.sm.PolicyReady() {
+		cntEnroll.IncError(ErrServerStarting)
+		ErrorResp(w, r, ErrServerStarting)
+		return
+	}
+
+	r, cancel := withTimeout(r, a.timeouts.Enroll)
+	defer cancel()
+
 	// Error in the scope for deferred rolback function check
 	var err error
 	// Initialize rollback/cleanup for enrollment
@@ -46,14 +63,15 @@ func (a *apiServer) AgentEnroll(w http.ResponseWriter, r *http.Request, params A
 	defer func() {
 		if err != nil {
 			zlog.Info().Err(err).Msg("perform rollback on enrollment failure")
-			err = rb.Rollback(r.Context())
+			// The rollback runs even if the enrollment failed because it exceeded its timeout.
+			err = rb.Rollback(context.WithoutCancel(r.Context()))
 			if err != nil {
 				zlog.Error().Err(err).Msg("rollback error on enrollment failure")
 			}
 		}
 	}()
 
-	err = a.et.handleEnroll(zlog, w, r, rb, params.UserAgent)
+	err = timeoutErr(r, a.et.handleEnroll(zlog, w, r, rb, params.UserAgent))
 
 	if err != nil {
 		cntEnroll.IncError(err)
@@ -64,12 +82,42 @@ func (a *apiServer) AgentEnroll(w http.ResponseWriter, r *http.Request, params A
 func (a *apiServer) AgentAcks(w http.ResponseWriter, r *http.Request, id string, params AgentAcksParams) {
 	zlog := hlog.FromRequest(r).With().Str(LogAgentID, id).Logger()
 	w.Header().Set("Content-Type", "application/json")
-	if err := a.ack.handleAcks(zlog, w, r, id); err != nil {
+	r, cancel := withTimeout(r, a.timeouts.Ack)
+	defer cancel()
+	if err := timeoutErr(r, a.ack.handleAcks(zlog, w, r, id)); err != nil {
 		cntAcks.IncError(err)
 		ErrorResp(w, r, err)
 	}
 }
 
+func (a *apiServer) AgentActions(w http.ResponseWriter, r *http.Request, id string, params AgentActionsParams) {
+	zlog := hlog.FromRequest(r).With().Str(LogAgentID, id).Logger()
+	w.Header().Set("Content-Type", "application/json")
+	if err := a.aat.handleAgentActions(zlog, w, r, id); err != nil {
+		cntAgentActions.IncError(err)
+		ErrorResp(w, r, err)
+	}
+}
+
+func (a *apiServer) AgentActionResult(w http.ResponseWriter, r *http.Request, id string, actionId string, params AgentActionResultParams) {
+	zlog := hlog.FromRequest(r).With().Str(LogAgentID, id).Logger()
+	w.Header().Set("Content-Type", "application/json")
+	if err := a.art.handleActionResult(zlog, w, r, id, actionId); err != nil {
+		cntActionResult.IncError(err)
+		ErrorResp(w, r, err)
+	}
+}
+
+func (a *apiServer) AgentPolicyPreview(w http.ResponseWriter, r *http.Request, id string, params AgentPolicyPreviewParams) {
+	zlog := hlog.FromRequest(r).With().Str(LogAgentID, id).Logger()
+	w.Header().Set("Content-Type", "application/json")
+	reveal := params.Reveal != nil && *params.Reveal
+	if err := a.ppt.handlePolicyPreview(zlog, w, r, id, reveal); err != nil {
+		cntPolicyPreview.IncError(err)
+		ErrorResp(w, r, err)
+	}
+}
+
 func (a *apiServer) AgentCheckin(w http.ResponseWriter, r *http.Request, id string, params AgentCheckinParams) {
 	zlog := hlog.FromRequest(r).With().Str(LogAgentID, id).Logger()
 	w.Header().Set("Content-Type", "application/json")
@@ -87,7 +135,9 @@ func (a *apiServer) Artifact(w http.ResponseWriter, r *http.Request, id string,
 		Str("remoteAddr", r.RemoteAddr).
 		Logger()
 
-	err := a.at.handleArtifacts(zlog, w, r, id, sha2)
+	r, cancel := withTimeout(r, a.timeouts.Artifact)
+	defer cancel()
+	err := timeoutErr(r, a.at.handleArtifacts(zlog, w, r, id, sha2))
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		cntArtifacts.IncError(err)
@@ -118,13 +168,16 @@ func (a *apiServer) UploadComplete(w http.ResponseWriter, r *http.Request, id st
 func (a *apiServer) UploadChunk(w http.ResponseWriter, r *http.Request, id string, chunkNum int, params UploadChunkParams) {
 	zlog := hlog.FromRequest(r).With().Str(LogAgentID, id).Logger()
 	w.Header().Set("Content-Type", "application/json")
+	r, cancel := withTimeout(r, a.timeouts.UploadChunk)
+	defer cancel()
 
 	if _, err := a.ut.authAPIKey(r, a.bulker, a.ut.cache); err != nil {
+		err = timeoutErr(r, err)
 		cntUploadChunk.IncError(err)
 		ErrorResp(w, r, err)
 		return
 	}
-	if err := a.ut.handleUploadChunk(zlog, w, r, id, chunkNum, params.XChunkSHA2); err != nil {
+	if err := timeoutErr(r, a.ut.handleUploadChunk(zlog, w, r, id, chunkNum, params.XChunkSHA2)); err != nil {
 		cntUploadChunk.IncError(err)
 		ErrorResp(w, r, err)
 	}
@@ -7,12 +7,14 @@ package api
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/apikey"
 	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
 	"github.com/elastic/fleet-server/v7/internal/pkg/cache"
+	"github.com/elastic/fleet-server/v7/internal/pkg/limit"
 	"github.com/elastic/fleet-server/v7/internal/pkg/model"
 
 	"github.com/rs/zerolog/hlog"
@@ -23,10 +25,16 @@ var (
 	ErrAPIKeyNotEnabled = errors.New("APIKey not enabled")
 	ErrAgentCorrupted   = errors.New("agent record corrupted")
 	ErrAgentInactive    = errors.New("agent inactive")
+	ErrAgentDeleted     = errors.New("agent document deleted")
 	ErrAgentIdentity    = errors.New("agent header contains wrong identifier")
+	ErrServiceAccount   = errors.New("service token is not for the fleet-server service account")
 )
 
+// fleetServerServiceAccount is the service account of the service tokens allowed to use the admin endpoints.
+const fleetServerServiceAccount = "elastic/fleet-server"
+
 // authAPIKey authenticates the provided API key, it checks that the key exists and is enabled.
+// Authenticated keys are checked against the endpoint's per key rate limit.
 // WARNING: This does not validate that the api key is valid for the Fleet Domain.
 // An additional check must be executed to validate it is not a random api key.
 func authAPIKey(r *http.Request, bulker bulk.Bulk, c cache.Cache) (*apikey.APIKey, error) {
@@ -46,14 +54,30 @@ func authAPIKey(r *http.Request, bulker bulk.Bulk, c cache.Cache) (*apikey.APIKe
 			Int64(ECSEventDuration, time.Since(start).Nanoseconds()).
 			Bool("fleet.apikey.cache_hit", true).
 			Msg("ApiKey authenticated")
+		if err = limit.CheckKey(ctx, key.ID); err != nil {
+			return nil, err
+		}
 		return key, nil
 	} else {
 		span.Context.SetLabel("api_key_cache_hit", false)
 	}
 
+	// Keys that recently failed authentication are rejected without asking Elasticsearch again.
+	if c.UnauthorizedAPIKey(*key) {
+		hlog.FromRequest(r).Info().
+			Str(LogAPIKeyID, key.ID).
+			Int64(ECSEventDuration, time.Since(start).Nanoseconds()).
+			Bool("fleet.apikey.cache_hit", true).
+			Msg("ApiKey fail authentication")
+		return nil, fmt.Errorf("%w: apikey %s failed authentication recently", apikey.ErrUnauthorized, key.ID)
+	}
+
 	info, err := bulker.APIKeyAuth(ctx, *key)
 
 	if err != nil {
+		if errors.Is(err, apikey.ErrUnauthorized) {
+			c.SetUnauthorizedAPIKey(*key)
+		}
 		hlog.FromRequest(r).Info().
 			Err(err).
 			Str(LogAPIKeyID, key.ID).
@@ -80,9 +104,48 @@ func authAPIKey(r *http.Request, bulker bulk.Bulk, c cache.Cache) (*apikey.APIKe
 			Str("id", key.ID).
 			Int64(ECSEventDuration, time.Since(start).Nanoseconds()).
 			Msg("ApiKey not enabled")
+		return key, err
 	}
 
-	return key, err
+	if err = limit.CheckKey(ctx, key.ID); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// authServiceToken authenticates the provided service token, it checks that the token is valid
+// and belongs to the fleet-server service account.
+func authServiceToken(r *http.Request, bulker bulk.Bulk) (*apikey.SecurityInfo, error) {
+	span, ctx := apm.StartSpan(r.Context(), "authServiceToken", "auth")
+	defer span.End()
+	start := time.Now()
+
+	token, err := apikey.ExtractServiceToken(r)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := bulker.ServiceTokenAuth(ctx, token)
+	if err != nil {
+		hlog.FromRequest(r).Info().
+			Err(err).
+			Int64(ECSEventDuration, time.Since(start).Nanoseconds()).
+			Msg("Service token fail authentication")
+		return nil, err
+	}
+	if info.UserName != fleetServerServiceAccount {
+		hlog.FromRequest(r).Info().
+			Str("userName", info.UserName).
+			Int64(ECSEventDuration, time.Since(start).Nanoseconds()).
+			Msg("Service token is not for the fleet-server service account")
+		return nil, ErrServiceAccount
+	}
+
+	hlog.FromRequest(r).Debug().
+		Str("userName", info.UserName).
+		Int64(ECSEventDuration, time.Since(start).Nanoseconds()).
+		Msg("Service token authenticated")
+	return info, nil
 }
 
 // authAgent ensures that the requested API-Key is associated with the correct agent.
@@ -123,6 +186,17 @@ func authAgent(r *http.Request, id *string, bulker bulk.Bulk, c cache.Cache) (*m
 	} else {
 		agent, err = findAgentByAPIKeyID(ctx, bulker, key.ID)
 	}
+	if errors.Is(err, ErrAgentNotFound) {
+		// The key is valid but the agent document was deleted, the agent can only recover by enrolling again.
+		// The orphaned key is invalidated so that it stops authenticating.
+		zlog.Warn().
+			Err(ErrAgentDeleted).
+			Msg("agent record missing for a valid ApiKey, invalidating the ApiKey")
+		c.SetAPIKey(*key, false)
+		bulker.APIKeyInvalidateAsync(key.ID)
+		cntAgentDeleted.Inc()
+		return nil, ErrAgentDeleted
+	}
 	if err != nil {
 		return nil, err
 	}
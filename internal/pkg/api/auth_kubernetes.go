@@ -0,0 +1,194 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"go.elastic.co/apm/v2"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/apikey"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+)
+
+var (
+	ErrKubernetesTokenDenied  = errors.New("kubernetes service account token denied")
+	ErrKubernetesNoPolicy     = errors.New("no policy for the kubernetes service account")
+	ErrKubernetesReviewFailed = errors.New("kubernetes token review failed")
+)
+
+const (
+	tokenReviewPath = "/apis/authentication.k8s.io/v1/tokenreviews"
+
+	// serviceAccountPrefix prefixes the subject of the service account tokens, and the user name they are reviewed as.
+	serviceAccountPrefix = "system:serviceaccount:"
+)
+
+// tokenReview is the TokenReview resource of the Kubernetes authentication API.
+type tokenReview struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Spec       tokenReviewSpec   `json:"spec"`
+	Status     tokenReviewStatus `json:"status"`
+}
+
+type tokenReviewSpec struct {
+	Token     string   `json:"token"`
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+type tokenReviewStatus struct {
+	Authenticated bool     `json:"authenticated"`
+	Audiences     []string `json:"audiences"`
+	Error         string   `json:"error"`
+	User          struct {
+		Username string `json:"username"`
+	} `json:"user"`
+}
+
+// kubernetesAuth validates Kubernetes service account tokens with the TokenReview API of the cluster.
+type kubernetesAuth struct {
+	client    *http.Client
+	url       string
+	tokenFile string
+	audience  string
+}
+
+func newKubernetesAuth(cfg *config.KubernetesEnroll) (*kubernetesAuth, error) {
+	roots, err := cfg.CertPool()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone() //nolint:errcheck // the default transport is an *http.Transport
+	transport.TLSClientConfig = &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+	return &kubernetesAuth{
+		client:    &http.Client{Transport: transport, Timeout: cfg.Timeout},
+		url:       strings.TrimSuffix(cfg.APIServer, "/") + tokenReviewPath,
+		tokenFile: cfg.TokenFile,
+		audience:  cfg.Audience,
+	}, nil
+}
+
+// serviceAccountToken returns the bearer token of the request if it has the form of a Kubernetes service account
+// token: a JWT issued to a service account. The signature is not checked, the token is validated by the review.
+func serviceAccountToken(r *http.Request) (string, bool) {
+	token, err := apikey.ExtractServiceToken(r)
+	if err != nil {
+		return "", false
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", false
+	}
+	var claims struct {
+		Subject string `json:"sub"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", false
+	}
+	return token, strings.HasPrefix(claims.Subject, serviceAccountPrefix)
+}
+
+// review validates the token with the TokenReview API, it returns the namespace and the name of the service account
+// the token was issued to.
+func (k *kubernetesAuth) review(ctx context.Context, token string) (string, string, error) {
+	span, ctx := apm.StartSpan(ctx, "kubernetesTokenReview", "auth")
+	defer span.End()
+
+	// The token is read on each review as projected tokens are rotated.
+	credentials, err := os.ReadFile(k.tokenFile)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %w", ErrKubernetesReviewFailed, err)
+	}
+	body, err := json.Marshal(tokenReview{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenReview",
+		Spec: tokenReviewSpec{
+			Token:     token,
+			Audiences: []string{k.audience},
+		},
+	})
+	if err != nil {
+		return "", "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.url, bytes.NewReader(body))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(credentials)))
+
+	res, err := k.client.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %w", ErrKubernetesReviewFailed, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("%w: %s", ErrKubernetesReviewFailed, res.Status)
+	}
+	var review tokenReview
+	if err := json.NewDecoder(res.Body).Decode(&review); err != nil {
+		return "", "", fmt.Errorf("%w: %w", ErrKubernetesReviewFailed, err)
+	}
+
+	status := review.Status
+	if !status.Authenticated {
+		return "", "", fmt.Errorf("%w: %s", ErrKubernetesTokenDenied, status.Error)
+	}
+	if !slices.Contains(status.Audiences, k.audience) {
+		return "", "", fmt.Errorf("%w: token is not issued for audience %s", ErrKubernetesTokenDenied, k.audience)
+	}
+	namespace, name, ok := strings.Cut(strings.TrimPrefix(status.User.Username, serviceAccountPrefix), ":")
+	if !strings.HasPrefix(status.User.Username, serviceAccountPrefix) || !ok || namespace == "" || name == "" {
+		return "", "", fmt.Errorf("%w: %s is not a service account", ErrKubernetesTokenDenied, status.User.Username)
+	}
+	return namespace, name, nil
+}
+
+// authServiceAccount validates the service account token and returns the enrollment key record of the policy
+// mapped to the service account.
+func (et *EnrollerT) authServiceAccount(ctx context.Context, zlog zerolog.Logger, token string) (*model.EnrollmentAPIKey, error) {
+	span, ctx := apm.StartSpan(ctx, "authServiceAccount", "auth")
+	defer span.End()
+
+	namespace, name, err := et.k8s.review(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	policyID, ok := et.cfg.Enroll.Kubernetes.PolicyID(namespace, name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s/%s", ErrKubernetesNoPolicy, namespace, name)
+	}
+	p, err := et.fetchPolicy(ctx, policyID)
+	if err != nil {
+		return nil, err
+	}
+
+	zlog.Debug().
+		Str("kubernetes.namespace", namespace).
+		Str("kubernetes.service_account", name).
+		Str(LogPolicyID, p.PolicyID).
+		Msg("Kubernetes service account authenticated")
+	return &model.EnrollmentAPIKey{
+		PolicyID: p.PolicyID,
+		Active:   true,
+	}, nil
+}
@@ -0,0 +1,242 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/apikey"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	"github.com/elastic/fleet-server/v7/internal/pkg/rollback"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+	testcache "github.com/elastic/fleet-server/v7/internal/pkg/testing/cache"
+)
+
+const testAudience = "fleet-server"
+
+// serviceAccountJWT returns an unsigned token with the subject of the service account.
+func serviceAccountJWT(namespace, name string) string {
+	claims := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"system:serviceaccount:` + namespace + `:` + name + `"}`))
+	return "eyJhbGciOiJSUzI1NiJ9." + claims + ".c2lnbmF0dXJl"
+}
+
+// newTokenReviewServer starts a fake TokenReview API, the tokens are authenticated as the user they map to.
+func newTokenReviewServer(t *testing.T, users map[string]string) *config.KubernetesEnroll {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != tokenReviewPath {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer fleet-server-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var review tokenReview
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if review.Spec.Token == "unavailable" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if user, ok := users[review.Spec.Token]; ok {
+			review.Status.Authenticated = true
+			review.Status.User.Username = user
+			review.Status.Audiences = review.Spec.Audiences
+		} else {
+			review.Status.Error = "token has expired"
+		}
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(review)
+	}))
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600))
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("fleet-server-token\n"), 0o600))
+
+	var cfg config.KubernetesEnroll
+	cfg.InitDefaults()
+	cfg.Enabled = true
+	cfg.APIServer = srv.URL
+	cfg.CertificateAuthorities = []string{caFile}
+	cfg.TokenFile = tokenFile
+	cfg.Audience = testAudience
+	cfg.Timeout = 5 * time.Second
+	cfg.Policies = []config.KubernetesPolicy{
+		{Namespace: "monitoring", ServiceAccount: "elastic-agent", PolicyID: "policy-k8s"},
+	}
+	require.NoError(t, cfg.Validate())
+	return &cfg
+}
+
+func TestServiceAccountToken(t *testing.T) {
+	tests := map[string]struct {
+		header string
+		ok     bool
+	}{
+		"service account token":  {header: "Bearer " + serviceAccountJWT("monitoring", "elastic-agent"), ok: true},
+		"api key":                {header: "ApiKey " + serviceAccountJWT("monitoring", "elastic-agent")},
+		"elasticsearch token":    {header: "Bearer AAEAAWVsYXN0aWMvZmxlZXQtc2VydmVyL3Rva2VuMTpzZWNyZXQ"},
+		"user token":             {header: "Bearer eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"jane"}`)) + ".c2ln"},
+		"payload is not encoded": {header: "Bearer a.%%%.c"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/fleet/agents/enroll", nil)
+			r.Header.Set("Authorization", tc.header)
+			token, ok := serviceAccountToken(r)
+			assert.Equal(t, tc.ok, ok)
+			if tc.ok {
+				assert.Equal(t, strings.TrimPrefix(tc.header, "Bearer "), token)
+			}
+		})
+	}
+}
+
+func TestKubernetesAuthReview(t *testing.T) {
+	allowed := serviceAccountJWT("monitoring", "elastic-agent")
+	cfg := newTokenReviewServer(t, map[string]string{
+		allowed: "system:serviceaccount:monitoring:elastic-agent",
+		"user":  "jane",
+	})
+	k8s, err := newKubernetesAuth(cfg)
+	require.NoError(t, err)
+
+	t.Run("allowed", func(t *testing.T) {
+		namespace, name, err := k8s.review(context.Background(), allowed)
+		require.NoError(t, err)
+		assert.Equal(t, "monitoring", namespace)
+		assert.Equal(t, "elastic-agent", name)
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		_, _, err := k8s.review(context.Background(), serviceAccountJWT("monitoring", "expired"))
+		assert.ErrorIs(t, err, ErrKubernetesTokenDenied)
+		assert.ErrorContains(t, err, "token has expired")
+	})
+
+	t.Run("not a service account", func(t *testing.T) {
+		_, _, err := k8s.review(context.Background(), "user")
+		assert.ErrorIs(t, err, ErrKubernetesTokenDenied)
+	})
+
+	t.Run("review unavailable", func(t *testing.T) {
+		_, _, err := k8s.review(context.Background(), "unavailable")
+		assert.ErrorIs(t, err, ErrKubernetesReviewFailed)
+		assert.Equal(t, http.StatusServiceUnavailable, NewHTTPErrResp(err).StatusCode)
+	})
+
+	t.Run("fleet-server token is missing", func(t *testing.T) {
+		missing := *k8s
+		missing.tokenFile = filepath.Join(t.TempDir(), "token")
+		_, _, err := missing.review(context.Background(), allowed)
+		assert.ErrorIs(t, err, ErrKubernetesReviewFailed)
+	})
+}
+
+func TestEnrollServiceAccount(t *testing.T) {
+	allowed := serviceAccountJWT("monitoring", "elastic-agent")
+	unmapped := serviceAccountJWT("default", "elastic-agent")
+	kubernetes := newTokenReviewServer(t, map[string]string{
+		allowed:  "system:serviceaccount:monitoring:elastic-agent",
+		unmapped: "system:serviceaccount:default:elastic-agent",
+	})
+
+	policies, err := json.Marshal(model.Policy{PolicyID: "policy-k8s"})
+	require.NoError(t, err)
+	newEnroller := func(t *testing.T, fallback bool) (*EnrollerT, *ftesting.MockBulk) {
+		t.Helper()
+		bulker := ftesting.NewMockBulk()
+		bulker.On("Search", mock.Anything, dl.FleetPolicies, mock.Anything, mock.Anything).Return(&es.ResultT{
+			Aggregations: map[string]es.Aggregation{
+				"policy_id": {
+					Buckets: []es.Bucket{{
+						Aggregations: map[string]es.HitsT{
+							"revision_idx": {Hits: []es.HitT{{Source: policies}}},
+						},
+					}},
+				},
+			},
+		}, nil)
+		bulker.On("APIKeyCreate", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(
+			&apikey.APIKey{ID: "access-key", Key: "secret"}, nil)
+		bulker.On("Create", mock.Anything, dl.FleetAgents, mock.Anything, mock.Anything, mock.Anything).Return("", nil)
+		c := testcache.NewMockCache()
+		c.On("SetAPIKey", mock.Anything, true)
+
+		cfg := &config.Server{}
+		cfg.Enroll.Kubernetes = *kubernetes
+		cfg.Enroll.Kubernetes.FallbackToToken = fallback
+		et, err := NewEnrollerT(mustBuildConstraints("8.9.0"), cfg, bulker, c)
+		require.NoError(t, err)
+		return et, bulker
+	}
+	enroll := func(et *EnrollerT, token string) (*httptest.ResponseRecorder, error) {
+		r := httptest.NewRequest(http.MethodPost, "/api/fleet/agents/enroll", strings.NewReader(`{"type":"PERMANENT","metadata":{"user_provided":{},"local":{}}}`))
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		return w, et.handleEnroll(zerolog.Nop(), w, r, &rollback.Rollback{}, "elastic agent v8.9.0")
+	}
+
+	t.Run("allowed", func(t *testing.T) {
+		et, bulker := newEnroller(t, false)
+		w, err := enroll(et, allowed)
+		require.NoError(t, err)
+
+		var resp EnrollResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "policy-k8s", resp.Item.PolicyId)
+		assert.Equal(t, "access-key", resp.Item.AccessApiKeyId)
+		bulker.AssertCalled(t, "APIKeyCreate", mock.Anything, resp.Item.Id, mock.Anything, mock.Anything, mock.Anything)
+		bulker.AssertCalled(t, "Create", mock.Anything, dl.FleetAgents, resp.Item.Id, mock.Anything, mock.Anything)
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		et, bulker := newEnroller(t, false)
+		_, err := enroll(et, serviceAccountJWT("monitoring", "expired"))
+		require.ErrorIs(t, err, ErrKubernetesTokenDenied)
+		assert.Equal(t, http.StatusUnauthorized, NewHTTPErrResp(err).StatusCode)
+		bulker.AssertNotCalled(t, "APIKeyCreate", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("no policy for the service account", func(t *testing.T) {
+		et, _ := newEnroller(t, false)
+		_, err := enroll(et, unmapped)
+		require.ErrorIs(t, err, ErrKubernetesNoPolicy)
+		assert.Equal(t, http.StatusForbidden, NewHTTPErrResp(err).StatusCode)
+	})
+
+	t.Run("denied falls back to the enrollment token", func(t *testing.T) {
+		et, bulker := newEnroller(t, true)
+		_, err := enroll(et, serviceAccountJWT("monitoring", "expired"))
+		require.ErrorIs(t, err, apikey.ErrMalformedHeader, "the bearer token is not an enrollment token")
+		bulker.AssertNotCalled(t, "APIKeyCreate", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+}
@@ -0,0 +1,292 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+	"go.elastic.co/apm/v2"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/cache"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/limit"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger/audit"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+)
+
+var ErrInvalidClientCert = errors.New("invalid client certificate")
+
+type authAgentFunc func(*http.Request, *string, bulk.Bulk, cache.Cache) (*model.Agent, error)
+
+// agentAuthenticator returns the function that authenticates agents for the configured auth mode.
+func agentAuthenticator(cfg *config.Server) authAgentFunc {
+	if cfg.Auth.Mode != config.AuthModePKI {
+		return authAgent
+	}
+	pki, err := newPKIAuth(cfg)
+	if err != nil {
+		// The configuration is validated when it is loaded; fail closed if it can no longer be used.
+		return func(*http.Request, *string, bulk.Bulk, cache.Cache) (*model.Agent, error) {
+			return nil, err
+		}
+	}
+	return pki.authAgent
+}
+
+// pkiAuth authenticates agents with the client certificate of the TLS connection.
+// The certificate is verified here instead of during the TLS handshake, so that failures can be answered with a 401.
+type pkiAuth struct {
+	roots   *x509.CertPool
+	pattern *regexp.Regexp
+	crls    *revocationLists
+	trusted config.TrustedProxies
+}
+
+func newPKIAuth(cfg *config.Server) (*pkiAuth, error) {
+	roots, err := cfg.Auth.PKI.CertPool()
+	if err != nil {
+		return nil, err
+	}
+	pattern, err := cfg.Auth.PKI.AgentIDRegexp()
+	if err != nil {
+		return nil, err
+	}
+	crls, err := newRevocationLists(&cfg.Auth.PKI)
+	if err != nil {
+		return nil, err
+	}
+	return &pkiAuth{
+		roots:   roots,
+		pattern: pattern,
+		crls:    crls,
+		trusted: cfg.TrustedProxies,
+	}, nil
+}
+
+// authAgent ensures that the client certificate is valid and issued to an enrolled agent.
+// If all succeeds, it returns the agent associated with the certificate.
+func (p *pkiAuth) authAgent(r *http.Request, id *string, bulker bulk.Bulk, _ cache.Cache) (*model.Agent, error) {
+	span, ctx := apm.StartSpan(r.Context(), "authAgentPKI", "auth")
+	defer span.End()
+
+	agentID, err := p.agentID(r)
+	if err != nil {
+		p.auditFailure(r, "", err.Error())
+		return nil, ErrInvalidClientCert
+	}
+
+	// validate that the id in the path is the agent the certificate was issued to
+	if id != nil && *id != agentID {
+		p.auditFailure(r, agentID, "client certificate issued to another agent")
+		return nil, ErrAgentIdentity
+	}
+
+	if err := limit.CheckKey(ctx, agentID); err != nil {
+		return nil, err
+	}
+
+	agent, err := dl.GetAgent(ctx, bulker, agentID)
+	if err != nil {
+		if errors.Is(err, dl.ErrNotFound) {
+			p.auditFailure(r, agentID, "agent is not enrolled")
+			return nil, ErrInvalidClientCert
+		}
+		return nil, fmt.Errorf("GetAgent: %w", err)
+	}
+
+	tx := apm.TransactionFromContext(ctx)
+	if tx != nil {
+		tx.Context.SetLabel("agent_id", agent.Id)
+	}
+
+	if agent.Agent == nil {
+		hlog.FromRequest(r).Warn().
+			Err(ErrAgentCorrupted).
+			Str(LogAgentID, agentID).
+			Msg("agent record does not contain required metadata section")
+		return nil, ErrAgentCorrupted
+	}
+
+	if !agent.Active {
+		p.auditFailure(r, agentID, "agent is inactive")
+		return &agent, ErrAgentInactive
+	}
+
+	return &agent, nil
+}
+
+// agentID verifies the client certificate chain and returns the agent ID found in its SANs or CN.
+func (p *pkiAuth) agentID(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", errors.New("no client certificate")
+	}
+	leaf := r.TLS.PeerCertificates[0]
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	chains, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         p.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return "", err
+	}
+	if p.crls.revoked(r.Context(), chains) {
+		return "", errors.New("client certificate is revoked")
+	}
+
+	names := make([]string, 0, len(leaf.DNSNames)+len(leaf.URIs)+len(leaf.EmailAddresses)+1)
+	names = append(names, leaf.DNSNames...)
+	for _, u := range leaf.URIs {
+		names = append(names, u.String())
+	}
+	names = append(names, leaf.EmailAddresses...)
+	names = append(names, leaf.Subject.CommonName)
+
+	for _, name := range names {
+		m := p.pattern.FindStringSubmatch(name)
+		switch {
+		case m == nil:
+			continue
+		case len(m) > 1 && m[1] != "":
+			return m[1], nil
+		case m[0] != "":
+			return m[0], nil
+		}
+	}
+	return "", errors.New("no agent ID in client certificate")
+}
+
+// auditFailure writes the audit log entry of a rejected client certificate.
+func (p *pkiAuth) auditFailure(r *http.Request, agentID, reason string) {
+	e := audit.Event{
+		Action:   audit.ActionAgentPKIAuth,
+		Outcome:  audit.OutcomeFailure,
+		Reason:   reason,
+		AgentID:  agentID,
+		ClientIP: clientIP(r, p.trusted),
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		leaf := r.TLS.PeerCertificates[0]
+		e.ClientCert = &audit.ClientCert{
+			Issuer:   leaf.Issuer.String(),
+			Subject:  leaf.Subject.String(),
+			NotAfter: leaf.NotAfter,
+		}
+		if leaf.SerialNumber != nil {
+			e.ClientCert.SerialNumber = leaf.SerialNumber.String()
+		}
+	}
+	audit.Log(r.Context(), e)
+}
+
+// crlReloadInterval is how often the revocation list files are read again, so an updated list is used without
+// restarting the server.
+const crlReloadInterval = time.Minute
+
+// revocationLists holds the certificate revocation lists of the pki auth.
+type revocationLists struct {
+	cfg *config.PKIAuth
+	now func() time.Time
+
+	mu     sync.Mutex
+	lists  []*revocationList
+	loaded time.Time
+}
+
+// revocationList is a loaded revocation list with the serial numbers of the certificates it revokes.
+type revocationList struct {
+	list    *x509.RevocationList
+	serials map[string]struct{}
+	// signers caches whether the list is signed by an issuer, by the raw issuer certificate.
+	signers sync.Map
+}
+
+func newRevocationLists(cfg *config.PKIAuth) (*revocationLists, error) {
+	rl := &revocationLists{cfg: cfg, now: time.Now}
+	if err := rl.load(); err != nil {
+		return nil, err
+	}
+	return rl, nil
+}
+
+func (rl *revocationLists) load() error {
+	lists, err := rl.cfg.RevocationLists()
+	if err != nil {
+		return err
+	}
+	loaded := make([]*revocationList, 0, len(lists))
+	for _, list := range lists {
+		serials := make(map[string]struct{}, len(list.RevokedCertificateEntries))
+		for _, entry := range list.RevokedCertificateEntries {
+			serials[entry.SerialNumber.String()] = struct{}{}
+		}
+		loaded = append(loaded, &revocationList{list: list, serials: serials})
+	}
+	rl.lists = loaded
+	rl.loaded = rl.now()
+	return nil
+}
+
+// current returns the revocation lists, they are read again from their files once crlReloadInterval elapsed.
+// The previous lists are kept if the files can't be read.
+func (rl *revocationLists) current(ctx context.Context) []*revocationList {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if len(rl.cfg.CRLs) > 0 && rl.now().Sub(rl.loaded) >= crlReloadInterval {
+		if err := rl.load(); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("unable to reload the pki auth revocation lists, the previous lists are used")
+			rl.loaded = rl.now()
+		}
+	}
+	return rl.lists
+}
+
+// revoked returns true if the leaf certificate of the chains is revoked by a list signed by its issuer.
+func (rl *revocationLists) revoked(ctx context.Context, chains [][]*x509.Certificate) bool {
+	lists := rl.current(ctx)
+	if len(lists) == 0 {
+		return false
+	}
+	for _, chain := range chains {
+		if len(chain) < 2 {
+			continue
+		}
+		leaf, issuer := chain[0], chain[1]
+		for _, l := range lists {
+			if _, ok := l.serials[leaf.SerialNumber.String()]; ok && l.signedBy(issuer) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (l *revocationList) signedBy(issuer *x509.Certificate) bool {
+	if !bytes.Equal(l.list.RawIssuer, issuer.RawSubject) {
+		return false
+	}
+	if ok, found := l.signers.Load(string(issuer.Raw)); found {
+		return ok.(bool)
+	}
+	ok := l.list.CheckSignatureFrom(issuer) == nil
+	l.signers.Store(string(issuer.Raw), ok)
+	return ok
+}
@@ -0,0 +1,255 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger/audit"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Agent CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key}
+}
+
+// writePEM writes the CA certificate to a file and returns its path.
+func (ca *testCA) writePEM(t *testing.T) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(p, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600)
+	require.NoError(t, err)
+	return p
+}
+
+// issue creates a client certificate signed by the CA.
+func (ca *testCA) issue(t *testing.T, cn string, dnsNames []string, notAfter time.Time) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    notAfter.Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+// writeCRL writes a revocation list of the CA that revokes the certificates and returns its path.
+func (ca *testCA) writeCRL(t *testing.T, revoked ...*x509.Certificate) string {
+	t.Helper()
+	entries := make([]x509.RevocationListEntry, 0, len(revoked))
+	for _, cert := range revoked {
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: cert.SerialNumber, RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now().Add(-time.Hour),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: entries,
+	}, ca.cert, ca.key)
+	require.NoError(t, err)
+	p := filepath.Join(t.TempDir(), "ca.crl")
+	err = os.WriteFile(p, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0o600)
+	require.NoError(t, err)
+	return p
+}
+
+func TestPKIAuthAgent(t *testing.T) {
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+	future := time.Now().Add(time.Hour)
+	agentID := "0e5d1a23"
+	revoked := ca.issue(t, "agent-"+agentID, nil, future)
+
+	cfg := &config.Server{}
+	cfg.InitDefaults()
+	cfg.Auth.Mode = config.AuthModePKI
+	cfg.Auth.PKI.CertificateAuthorities = []string{ca.writePEM(t)}
+	cfg.Auth.PKI.AgentIDPattern = `^agent-(.+)$`
+	// The list of the other CA does not apply to the certificates of the CA, even if their serial numbers match.
+	cfg.Auth.PKI.CRLs = []string{ca.writeCRL(t, revoked), otherCA.writeCRL(t, ca.cert)}
+	require.NoError(t, cfg.Auth.Validate())
+
+	agentDoc, err := json.Marshal(model.Agent{
+		Active: true,
+		Agent:  &model.AgentMetadata{ID: agentID, Version: "8.15.0"},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		certs  []*x509.Certificate
+		id     string
+		status int
+		reason string
+	}{{
+		name:   "valid cn",
+		certs:  []*x509.Certificate{ca.issue(t, "agent-"+agentID, nil, future)},
+		id:     agentID,
+		status: http.StatusOK,
+	}, {
+		name:   "valid san",
+		certs:  []*x509.Certificate{ca.issue(t, "host.example.com", []string{"agent-" + agentID}, future)},
+		id:     agentID,
+		status: http.StatusOK,
+	}, {
+		name:   "no certificate",
+		id:     agentID,
+		status: http.StatusUnauthorized,
+		reason: "no client certificate",
+	}, {
+		name:   "expired",
+		certs:  []*x509.Certificate{ca.issue(t, "agent-"+agentID, nil, time.Now().Add(-time.Hour))},
+		id:     agentID,
+		status: http.StatusUnauthorized,
+	}, {
+		name:   "revoked",
+		certs:  []*x509.Certificate{revoked},
+		id:     agentID,
+		status: http.StatusUnauthorized,
+		reason: "client certificate is revoked",
+	}, {
+		name:   "unknown ca",
+		certs:  []*x509.Certificate{otherCA.issue(t, "agent-"+agentID, nil, future)},
+		id:     agentID,
+		status: http.StatusUnauthorized,
+	}, {
+		name:   "wrong cn",
+		certs:  []*x509.Certificate{ca.issue(t, "host.example.com", nil, future)},
+		id:     agentID,
+		status: http.StatusUnauthorized,
+		reason: "no agent ID in client certificate",
+	}, {
+		name:   "not enrolled",
+		certs:  []*x509.Certificate{ca.issue(t, "agent-unknown", nil, future)},
+		id:     "unknown",
+		status: http.StatusUnauthorized,
+		reason: "agent is not enrolled",
+	}, {
+		name:   "other agent",
+		certs:  []*x509.Certificate{ca.issue(t, "agent-"+agentID, nil, future)},
+		id:     "other",
+		status: http.StatusForbidden,
+		reason: "client certificate issued to another agent",
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			bulker := ftesting.NewMockBulk()
+			bulker.On("ReadRaw", mock.Anything, mock.Anything, agentID, mock.Anything).Return(&bulk.MgetResponseItem{Found: true, Source: agentDoc}, nil)
+			bulker.On("ReadRaw", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(&bulk.MgetResponseItem{}, es.ErrElasticNotFound)
+
+			var logs bytes.Buffer
+			audit.SetOutput(&logs)
+			defer audit.SetOutput(io.Discard)
+			ctx := testlog.SetLogger(t).WithContext(context.Background())
+			r := httptest.NewRequest(http.MethodPost, "/api/fleet/agents/"+tc.id+"/checkin", nil).WithContext(ctx)
+			r.TLS = &tls.ConnectionState{PeerCertificates: tc.certs}
+
+			authfn := agentAuthenticator(cfg)
+			agent, err := authfn(r, &tc.id, bulker, nil)
+			if tc.status == http.StatusOK {
+				require.NoError(t, err)
+				assert.Equal(t, agentID, agent.Id)
+				assert.Empty(t, logs.String())
+				return
+			}
+			require.Error(t, err)
+			assert.Equal(t, tc.status, NewHTTPErrResp(err).StatusCode)
+
+			var entry map[string]interface{}
+			require.NoError(t, json.Unmarshal(logs.Bytes(), &entry), "expected an audit log entry")
+			assert.Equal(t, audit.ActionAgentPKIAuth, entry["event.action"])
+			assert.Equal(t, "failure", entry["event.outcome"])
+			assert.Equal(t, "192.0.2.1", entry["client.ip"])
+			if tc.reason != "" {
+				assert.Equal(t, tc.reason, entry["event.reason"])
+			}
+			if len(tc.certs) > 0 {
+				assert.Equal(t, tc.certs[0].Subject.String(), entry["tls.client.subject"])
+			}
+		})
+	}
+}
+
+func TestPKIAuthConfig(t *testing.T) {
+	cfg := config.ServerAuth{}
+	cfg.InitDefaults()
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Mode = config.AuthModePKI
+	assert.Error(t, cfg.Validate(), "certificate authorities are required")
+
+	cfg.PKI.CertificateAuthorities = []string{newTestCA(t).writePEM(t)}
+	assert.NoError(t, cfg.Validate())
+
+	cfg.PKI.CRLs = []string{filepath.Join(t.TempDir(), "missing.crl")}
+	assert.Error(t, cfg.Validate(), "revocation lists must be readable")
+
+	cfg.PKI.CRLs = nil
+	cfg.PKI.AgentIDPattern = "("
+	assert.Error(t, cfg.Validate())
+
+	cfg.Mode = "token"
+	assert.Error(t, cfg.Validate())
+}
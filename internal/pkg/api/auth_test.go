@@ -0,0 +1,239 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/apikey"
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/cache"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+func TestAuthAPIKeyNegativeCache(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	key := apikey.APIKey{ID: "bogusID", Key: "bogus"}
+
+	c, err := cache.New(config.Cache{NumCounters: 100, MaxCost: 100000, APIKeyNegTTL: time.Hour})
+	require.NoError(t, err)
+
+	bulker := ftesting.NewMockBulk()
+	bulker.On("APIKeyAuth", mock.Anything, key).Return((*bulk.SecurityInfo)(nil), fmt.Errorf("%w: apikey auth response", apikey.ErrUnauthorized))
+
+	newRequest := func() *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/api/fleet/agents/test/checkin", nil).WithContext(ctx)
+		r.Header.Set(apikey.AuthKey, "ApiKey "+key.Token())
+		return r
+	}
+
+	_, err = authAPIKey(newRequest(), bulker, c)
+	require.ErrorIs(t, err, apikey.ErrUnauthorized)
+
+	// the negative cache entry is written asynchronously
+	require.Eventually(t, func() bool {
+		return c.UnauthorizedAPIKey(key)
+	}, time.Second, 10*time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		_, err = authAPIKey(newRequest(), bulker, c)
+		assert.ErrorIs(t, err, apikey.ErrUnauthorized)
+		assert.Equal(t, http.StatusUnauthorized, NewHTTPErrResp(err).StatusCode)
+	}
+	bulker.AssertNumberOfCalls(t, "APIKeyAuth", 1)
+}
+
+func TestAuthAgentReEnroll(t *testing.T) {
+	key := apikey.APIKey{ID: "keyID", Key: "key"}
+	agentID := "agent-1"
+
+	tests := []struct {
+		name       string
+		doc        *bulk.MgetResponseItem
+		readErr    error
+		err        error
+		invalidate bool
+	}{{
+		name:       "agent deleted",
+		doc:        (*bulk.MgetResponseItem)(nil),
+		readErr:    es.ErrElasticNotFound,
+		err:        ErrAgentDeleted,
+		invalidate: true,
+	}, {
+		name: "agent inactive",
+		doc: &bulk.MgetResponseItem{
+			DocumentID: agentID,
+			Source:     json.RawMessage(`{"active":false,"access_api_key_id":"keyID","agent":{"id":"agent-1"}}`),
+		},
+		err: ErrAgentInactive,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := testlog.SetLogger(t).WithContext(context.Background())
+			c, err := cache.New(config.Cache{NumCounters: 100, MaxCost: 100000})
+			require.NoError(t, err)
+
+			bulker := ftesting.NewMockBulk()
+			bulker.On("APIKeyAuth", mock.Anything, key).Return(&bulk.SecurityInfo{Enabled: true}, nil)
+			bulker.On("ReadRaw", mock.Anything, dl.FleetAgents, agentID, mock.Anything).Return(tc.doc, tc.readErr).Once()
+			if tc.invalidate {
+				bulker.On("APIKeyInvalidateAsync", []string{key.ID}).Return().Once()
+			}
+			deleted := cntAgentDeleted.metric.Get()
+
+			r := httptest.NewRequest(http.MethodPost, "/api/fleet/agents/agent-1/checkin", nil).WithContext(ctx)
+			r.Header.Set(apikey.AuthKey, "ApiKey "+key.Token())
+			_, err = authAgent(r, &agentID, bulker, c)
+			require.ErrorIs(t, err, tc.err)
+			bulker.AssertExpectations(t)
+			if tc.invalidate {
+				assert.Equal(t, deleted+1, cntAgentDeleted.metric.Get())
+			} else {
+				assert.Equal(t, deleted, cntAgentDeleted.metric.Get())
+			}
+
+			w := httptest.NewRecorder()
+			ErrorResp(w, r, err)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+			var body Error
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			require.NotNil(t, body.Code)
+			assert.Equal(t, string(ErrCodeAgentInactive), *body.Code)
+			require.NotNil(t, body.Hint)
+			assert.Equal(t, HintReEnroll, *body.Hint)
+		})
+	}
+}
+
+func TestAuthServiceToken(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+
+	tests := []struct {
+		name   string
+		header string
+		info   *bulk.SecurityInfo
+		err    error
+		status int
+	}{{
+		name:   "fleet-server service account",
+		header: "Bearer fleet-server-token",
+		info:   &bulk.SecurityInfo{UserName: "elastic/fleet-server", Enabled: true},
+	}, {
+		name:   "other service account",
+		header: "Bearer kibana-token",
+		info:   &bulk.SecurityInfo{UserName: "elastic/kibana", Enabled: true},
+		err:    ErrServiceAccount,
+		status: http.StatusForbidden,
+	}, {
+		name:   "invalid token",
+		header: "Bearer invalid-token",
+		err:    apikey.ErrUnauthorized,
+		status: http.StatusUnauthorized,
+	}, {
+		name:   "api key header",
+		header: "ApiKey " + apikey.APIKey{ID: "id", Key: "key"}.Token(),
+		err:    apikey.ErrMalformedHeader,
+		status: http.StatusBadRequest,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			bulker := ftesting.NewMockBulk()
+			if tc.info != nil {
+				bulker.On("ServiceTokenAuth", mock.Anything, mock.Anything).Return(tc.info, nil)
+			} else {
+				bulker.On("ServiceTokenAuth", mock.Anything, mock.Anything).Return((*bulk.SecurityInfo)(nil), fmt.Errorf("%w: service token auth response", apikey.ErrUnauthorized))
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/api/fleet/agents/test/actions", nil).WithContext(ctx)
+			r.Header.Set(apikey.AuthKey, tc.header)
+
+			info, err := authServiceToken(r, bulker)
+			if tc.err != nil {
+				require.ErrorIs(t, err, tc.err)
+				assert.Equal(t, tc.status, NewHTTPErrResp(err).StatusCode)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.info, info)
+			bulker.AssertCalled(t, "ServiceTokenAuth", mock.Anything, "fleet-server-token")
+		})
+	}
+}
+
+func TestAuthAgentSearchMiss(t *testing.T) {
+	key := apikey.APIKey{ID: "keyID", Key: "key"}
+	agentID := "agent-1"
+
+	tests := []struct {
+		name     string
+		metadata *bulk.APIKeyMetadata
+		readErr  error
+		err      error
+	}{{
+		name:     "agent read by the id of the key metadata",
+		metadata: &bulk.APIKeyMetadata{ID: key.ID, Metadata: apikey.NewMetadata(agentID, "", apikey.TypeAccess)},
+	}, {
+		name:     "output key",
+		metadata: &bulk.APIKeyMetadata{ID: key.ID, Metadata: apikey.NewMetadata(agentID, "default", apikey.TypeOutput)},
+		err:      ErrAgentDeleted,
+	}, {
+		name:     "key not found",
+		metadata: (*bulk.APIKeyMetadata)(nil),
+		readErr:  apikey.ErrAPIKeyNotFound,
+		err:      ErrAgentDeleted,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := testlog.SetLogger(t).WithContext(context.Background())
+			c, err := cache.New(config.Cache{NumCounters: 100, MaxCost: 100000})
+			require.NoError(t, err)
+
+			bulker := ftesting.NewMockBulk()
+			bulker.On("APIKeyAuth", mock.Anything, key).Return(&bulk.SecurityInfo{Enabled: true}, nil)
+			// The agent document is not refreshed yet, the search misses it.
+			bulker.On("Search", mock.Anything, dl.FleetAgents, mock.Anything, mock.Anything).Return(&es.ResultT{}, nil).Once()
+			bulker.On("APIKeyRead", mock.Anything, key.ID).Return(tc.metadata, tc.readErr).Once()
+			if tc.err == nil {
+				bulker.On("ReadRaw", mock.Anything, dl.FleetAgents, agentID, mock.Anything).Return(&bulk.MgetResponseItem{
+					DocumentID: agentID,
+					Found:      true,
+					Source:     json.RawMessage(`{"active":true,"access_api_key_id":"keyID","agent":{"id":"agent-1"}}`),
+				}, nil).Once()
+			} else {
+				bulker.On("APIKeyInvalidateAsync", []string{key.ID}).Return().Once()
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/api/fleet/artifacts/endpoint-exceptionlist-macos-v1/abc", nil).WithContext(ctx)
+			r.Header.Set(apikey.AuthKey, "ApiKey "+key.Token())
+			agent, err := authAgent(r, nil, bulker, c)
+			bulker.AssertExpectations(t)
+			if tc.err != nil {
+				require.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, agentID, agent.Id)
+		})
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package api
+
+import (
+	"bytes"
+	"sync"
+)
+
+// maxPooledBufferSize is the capacity above which a buffer is not returned to the pool, so that the pool does not
+// keep the memory of the few large bodies.
+const maxPooledBufferSize = 1 << 20
+
+// bufferPool holds the buffers the request bodies are read into, and the beginning of the responses is held in.
+var bufferPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+// getBuffer returns an empty buffer, it must be returned with putBuffer once its bytes are not referenced anymore.
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer) //nolint:errcheck // we control what is placed in the pool
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
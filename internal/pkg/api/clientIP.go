@@ -0,0 +1,75 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package api
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+)
+
+// clientIP returns the address of the client of the request, or an empty string if it can't be parsed.
+// The Forwarded, or X-Forwarded-For, header is only honored when the direct peer is a trusted proxy. The hops
+// are walked from the closest one and the first address that isn't a trusted proxy is the client, so the
+// addresses a client puts in the header itself are ignored.
+func clientIP(r *http.Request, trusted config.TrustedProxies) string {
+	addr, ok := parseHop(r.RemoteAddr)
+	if !ok {
+		return ""
+	}
+	if len(trusted) > 0 && trusted.Contains(addr) {
+		hops := forwardedFor(r.Header)
+		for i := len(hops) - 1; i >= 0 && trusted.Contains(addr); i-- {
+			hop, ok := parseHop(hops[i])
+			if !ok {
+				// An obfuscated or unknown hop ends the chain at the last known proxy.
+				break
+			}
+			addr = hop
+		}
+	}
+	return addr.String()
+}
+
+// forwardedFor returns the client addresses of the Forwarded header, or of the X-Forwarded-For header if there is
+// no Forwarded header, from the farthest hop to the closest one.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	if values := h.Values("Forwarded"); len(values) > 0 {
+		for _, v := range values {
+			for _, elem := range strings.Split(v, ",") {
+				hop := "unknown"
+				for _, pair := range strings.Split(elem, ";") {
+					key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if ok && strings.EqualFold(key, "for") {
+						hop = strings.Trim(val, `"`)
+					}
+				}
+				hops = append(hops, hop)
+			}
+		}
+		return hops
+	}
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// parseHop parses an address with an optional port, IPv6 addresses may be in brackets.
+func parseHop(s string) (netip.Addr, bool) {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
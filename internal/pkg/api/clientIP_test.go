@@ -0,0 +1,114 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted := config.TrustedProxies{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("fd00::/8"),
+	}
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		trusted config.TrustedProxies
+		ip      string
+	}{{
+		name:   "no proxy",
+		remote: "192.0.2.10:51234",
+		ip:     "192.0.2.10",
+	}, {
+		name:    "ipv6 peer",
+		remote:  "[2001:db8::17]:51234",
+		trusted: trusted,
+		ip:      "2001:db8::17",
+	}, {
+		name:    "ipv4 mapped peer",
+		remote:  "[::ffff:192.0.2.10]:51234",
+		trusted: trusted,
+		ip:      "192.0.2.10",
+	}, {
+		name:    "untrusted peer spoofs X-Forwarded-For",
+		remote:  "192.0.2.10:51234",
+		headers: map[string]string{"X-Forwarded-For": "198.51.100.1"},
+		trusted: trusted,
+		ip:      "192.0.2.10",
+	}, {
+		name:    "untrusted peer spoofs Forwarded",
+		remote:  "[2001:db8::17]:51234",
+		headers: map[string]string{"Forwarded": "for=198.51.100.1"},
+		trusted: trusted,
+		ip:      "2001:db8::17",
+	}, {
+		name:    "no trusted proxies configured",
+		remote:  "10.0.0.1:51234",
+		headers: map[string]string{"X-Forwarded-For": "198.51.100.1"},
+		ip:      "10.0.0.1",
+	}, {
+		name:    "trusted proxy X-Forwarded-For",
+		remote:  "10.0.0.1:51234",
+		headers: map[string]string{"X-Forwarded-For": "198.51.100.1"},
+		trusted: trusted,
+		ip:      "198.51.100.1",
+	}, {
+		name:    "trusted proxies chain ignores the client supplied hops",
+		remote:  "10.0.0.1:51234",
+		headers: map[string]string{"X-Forwarded-For": "203.0.113.5, 198.51.100.1, 10.0.0.2"},
+		trusted: trusted,
+		ip:      "198.51.100.1",
+	}, {
+		name:    "trusted proxy Forwarded ipv6",
+		remote:  "[fd00::1]:51234",
+		headers: map[string]string{"Forwarded": `for="[2001:db8:cafe::17]:4711";proto=https;by=10.0.0.1`},
+		trusted: trusted,
+		ip:      "2001:db8:cafe::17",
+	}, {
+		name:   "Forwarded takes precedence over X-Forwarded-For",
+		remote: "10.0.0.1:51234",
+		headers: map[string]string{
+			"Forwarded":       "for=198.51.100.1, for=10.0.0.2",
+			"X-Forwarded-For": "203.0.113.5",
+		},
+		trusted: trusted,
+		ip:      "198.51.100.1",
+	}, {
+		name:    "obfuscated hop",
+		remote:  "10.0.0.1:51234",
+		headers: map[string]string{"Forwarded": "for=_hidden, for=10.0.0.2"},
+		trusted: trusted,
+		ip:      "10.0.0.2",
+	}, {
+		name:    "invalid X-Forwarded-For",
+		remote:  "10.0.0.1:51234",
+		headers: map[string]string{"X-Forwarded-For": "not an ip"},
+		trusted: trusted,
+		ip:      "10.0.0.1",
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/fleet/agents/test/checkin", nil)
+			r.RemoteAddr = tc.remote
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+			assert.Equal(t, tc.ip, clientIP(r, tc.trusted))
+		})
+	}
+}
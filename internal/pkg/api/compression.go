@@ -0,0 +1,237 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miolini/datacounter"
+)
+
+const kEncodingDeflate = "deflate"
+
+// ErrUnsupportedEncoding is the error of a request body encoded with a content encoding that is not supported.
+var ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// encoder is a compression writer that can be reused.
+type encoder interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+// encoderPool is a pool of gzip and deflate writers used to compress responses.
+// Compression writer allocations are expensive (~1.2MB each) and can exhaust an instance's memory if a lot of concurrent
+// responses are sent (this occurs when a mass-action such as an upgrade is detected).
+type encoderPool struct {
+	gzip    sync.Pool
+	deflate sync.Pool
+}
+
+func newEncoderPool(level int) *encoderPool {
+	p := &encoderPool{}
+	p.gzip.New = func() any {
+		zw, err := gzip.NewWriterLevel(io.Discard, level)
+		if err != nil {
+			panic(err)
+		}
+		return zw
+	}
+	p.deflate.New = func() any {
+		zw, err := zlib.NewWriterLevel(io.Discard, level)
+		if err != nil {
+			panic(err)
+		}
+		return zw
+	}
+	return p
+}
+
+// get returns an encoder for the content encoding that writes to w.
+// The encoder must be returned with put once it is closed.
+func (p *encoderPool) get(encoding string, w io.Writer) encoder {
+	var e encoder
+	switch encoding {
+	case kEncodingGzip:
+		e, _ = p.gzip.Get().(*gzip.Writer)
+	case kEncodingDeflate:
+		e, _ = p.deflate.Get().(*zlib.Writer)
+	default:
+		return nil
+	}
+	e.Reset(w)
+	return e
+}
+
+func (p *encoderPool) put(encoding string, e encoder) {
+	switch encoding {
+	case kEncodingGzip:
+		p.gzip.Put(e)
+	case kEncodingDeflate:
+		p.deflate.Put(e)
+	}
+}
+
+// thresholdWriter streams a response to the ResponseWriter, compressed with the content encoding once it is larger than
+// the threshold. The bytes written until the threshold is reached are held in a pooled buffer, a response that stays
+// under the threshold is written uncompressed by close. A response without encoding is written as it is.
+type thresholdWriter struct {
+	w         http.ResponseWriter
+	pool      *encoderPool
+	encoding  string
+	threshold int
+
+	counter     *datacounter.WriterCounter
+	buf         *bytes.Buffer
+	zipper      encoder
+	compressing bool
+	srcSz       int
+}
+
+func newThresholdWriter(w http.ResponseWriter, pool *encoderPool, encoding string, threshold int) *thresholdWriter {
+	return &thresholdWriter{
+		w:         w,
+		pool:      pool,
+		encoding:  encoding,
+		threshold: threshold,
+		counter:   datacounter.NewWriterCounter(w),
+	}
+}
+
+func (tw *thresholdWriter) Write(p []byte) (int, error) {
+	tw.srcSz += len(p)
+	switch {
+	case tw.zipper != nil:
+		return tw.zipper.Write(p)
+	case tw.encoding == "":
+		return tw.counter.Write(p)
+	case tw.buf == nil && len(p) > tw.threshold:
+		// The response is known to be over the threshold without copying it.
+		tw.compress()
+		return tw.zipper.Write(p)
+	}
+
+	if tw.buf == nil {
+		tw.buf = getBuffer()
+	}
+	tw.buf.Write(p)
+	if tw.buf.Len() <= tw.threshold {
+		return len(p), nil
+	}
+	tw.compress()
+	_, err := tw.zipper.Write(tw.buf.Bytes())
+	putBuffer(tw.buf)
+	tw.buf = nil
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// compress starts writing the compressed response.
+func (tw *thresholdWriter) compress() {
+	tw.w.Header().Set("Content-Encoding", tw.encoding)
+	tw.zipper = tw.pool.get(tw.encoding, tw.counter)
+	tw.compressing = true
+}
+
+// close writes the end of the response, and returns the pooled buffer and encoder.
+func (tw *thresholdWriter) close() error {
+	if tw.zipper != nil {
+		err := tw.zipper.Close()
+		tw.pool.put(tw.encoding, tw.zipper)
+		tw.zipper = nil
+		return err
+	}
+	if tw.buf != nil {
+		_, err := tw.counter.Write(tw.buf.Bytes())
+		putBuffer(tw.buf)
+		tw.buf = nil
+		return err
+	}
+	return nil
+}
+
+// negotiateEncoding returns the content encoding to use for the response, gzip is preferred over deflate.
+// An empty string is returned if the request accepts neither.
+func negotiateEncoding(r *http.Request) string {
+	gzipQ, deflateQ, anyQ := -1.0, -1.0, -1.0
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(v, ",") {
+			coding, q := parseCoding(part)
+			switch coding {
+			case kEncodingGzip, "x-gzip":
+				gzipQ = q
+			case kEncodingDeflate:
+				deflateQ = q
+			case "*":
+				anyQ = q
+			}
+		}
+	}
+	if gzipQ < 0 {
+		gzipQ = anyQ
+	}
+	if deflateQ < 0 {
+		deflateQ = anyQ
+	}
+
+	switch {
+	case gzipQ > 0 && gzipQ >= deflateQ:
+		return kEncodingGzip
+	case deflateQ > 0:
+		return kEncodingDeflate
+	default:
+		return ""
+	}
+}
+
+// parseCoding parses a single Accept-Encoding entry such as "gzip;q=0.8".
+func parseCoding(s string) (string, float64) {
+	coding, params, _ := strings.Cut(s, ";")
+	q := 1.0
+	for _, param := range strings.Split(params, ";") {
+		k, v, ok := strings.Cut(param, "=")
+		if !ok || strings.TrimSpace(k) != "q" {
+			continue
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			f = 0
+		}
+		q = f
+	}
+	return strings.ToLower(strings.TrimSpace(coding)), q
+}
+
+// decodeBody returns the body of the request decoded according to its Content-Encoding, gzip is the only supported
+// encoding. The decoded body is limited to maxBody bytes when maxBody is positive, so that the max body size applies
+// to the decompressed bytes and a small compressed body can not expand without bounds.
+func decodeBody(w http.ResponseWriter, r *http.Request, maxBody int64) (io.ReadCloser, error) {
+	body := r.Body
+	switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+	case kEncodingGzip, "x-gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, &BadRequestErr{msg: "unable to decompress gzip request body", nextErr: err}
+		}
+		body = zr
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, encoding)
+	}
+	if maxBody > 0 {
+		body = http.MaxBytesReader(w, body, maxBody)
+	}
+	return body, nil
+}
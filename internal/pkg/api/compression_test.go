@@ -0,0 +1,204 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   []string
+		expected string
+	}{
+		{"no header", nil, ""},
+		{"gzip", []string{"gzip"}, "gzip"},
+		{"deflate", []string{"deflate"}, "deflate"},
+		{"list prefers gzip", []string{"deflate, gzip"}, "gzip"},
+		{"multiple headers", []string{"br", "deflate"}, "deflate"},
+		{"q values", []string{"gzip;q=0.2, deflate;q=0.8"}, "deflate"},
+		{"gzip refused", []string{"gzip;q=0"}, ""},
+		{"wildcard", []string{"*"}, "gzip"},
+		{"wildcard with refused gzip", []string{"gzip;q=0, *;q=0.5"}, "deflate"},
+		{"identity only", []string{"identity"}, ""},
+		{"case and spaces", []string{" GZIP ; q=1.0 "}, "gzip"},
+		{"invalid q", []string{"gzip;q=abc"}, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &http.Request{Header: http.Header{}}
+			for _, v := range tc.header {
+				r.Header.Add("Accept-Encoding", v)
+			}
+			assert.Equal(t, tc.expected, negotiateEncoding(r))
+		})
+	}
+}
+
+func gzipData(t *testing.T, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestDecodeBody(t *testing.T) {
+	payload := `{"status":"online","message":"` + strings.Repeat("a", 4096) + `"}`
+	compressed := gzipData(t, payload)
+	// the compressed payload is under the max body, it is only over it once decompressed
+	require.Less(t, len(compressed), 1024)
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		maxBody  int64
+		status   int // the status of the error response, 0 if the body is read
+	}{
+		{"plain", "", []byte(payload), 8192, 0},
+		{"identity", "identity", []byte(payload), 8192, 0},
+		{"gzip", "gzip", compressed, 8192, 0},
+		{"x-gzip", "x-gzip", compressed, 8192, 0},
+		{"gzip without max body", "gzip", compressed, 0, 0},
+		{"plain over max body", "", []byte(payload), 1024, http.StatusRequestEntityTooLarge},
+		{"gzip over max body once decompressed", "gzip", compressed, 1024, http.StatusRequestEntityTooLarge},
+		{"unknown encoding", "br", compressed, 8192, http.StatusUnsupportedMediaType},
+		{"corrupt gzip", "gzip", []byte(payload), 8192, http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/fleet/agents/foo/checkin", bytes.NewReader(tc.body))
+			if tc.encoding != "" {
+				r.Header.Set("Content-Encoding", tc.encoding)
+			}
+			w := httptest.NewRecorder()
+
+			body, err := decodeBody(w, r, tc.maxBody)
+			var data []byte
+			if err == nil {
+				data, err = io.ReadAll(body)
+			}
+			if tc.status == 0 {
+				require.NoError(t, err)
+				assert.Equal(t, payload, string(data))
+				return
+			}
+			require.Error(t, err)
+			ErrorResp(w, r, err)
+			assert.Equal(t, tc.status, w.Code)
+		})
+	}
+}
+
+func TestValidateRequestGzip(t *testing.T) {
+	cfg := &config.Server{
+		Limits: config.ServerLimits{
+			CheckinLimit: config.Limit{MaxBody: 1024},
+			AckLimit:     config.Limit{MaxBody: 1024},
+		},
+	}
+	logger := testlog.SetLogger(t)
+	request := func(data string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(gzipData(t, data)))
+		r.Header.Set("Content-Encoding", "gzip")
+		return r
+	}
+	large := `{"status":"online","message":"` + strings.Repeat("a", 4096) + `"}`
+
+	t.Run("checkin", func(t *testing.T) {
+		checkin := NewCheckinT(mustBuildConstraints("8.0.0"), cfg, nil, nil, nil, nil, nil, nil, nil)
+		// the tags are validated once the body is decompressed and decoded
+		_, err := checkin.validateRequest(logger, httptest.NewRecorder(), request(`{"status":"online","tags":["`+strings.Repeat("a", 257)+`"]}`), time.Time{}, nil)
+		assert.ErrorIs(t, err, ErrInvalidTags)
+
+		_, err = checkin.validateRequest(logger, httptest.NewRecorder(), request(large), time.Time{}, nil)
+		assert.True(t, isBodyTooLarge(err), "expected a body too large error, got %v", err)
+	})
+
+	t.Run("ack", func(t *testing.T) {
+		ack := NewAckT(cfg, nil, nil)
+		req, err := ack.validateRequest(logger, httptest.NewRecorder(), request(`{"events":[]}`))
+		require.NoError(t, err)
+		assert.Empty(t, req.Events)
+
+		_, err = ack.validateRequest(logger, httptest.NewRecorder(), request(`{"events":[{"message":"`+strings.Repeat("a", 4096)+`"}]}`))
+		assert.True(t, isBodyTooLarge(err), "expected a body too large error, got %v", err)
+	})
+}
+
+func TestThresholdWriter(t *testing.T) {
+	pool := newEncoderPool(gzip.BestSpeed)
+	tests := []struct {
+		name       string
+		encoding   string
+		writes     []string
+		compressed bool
+	}{{
+		name:     "no encoding",
+		encoding: "",
+		writes:   []string{strings.Repeat("a", 64), strings.Repeat("b", 64)},
+	}, {
+		name:     "under the threshold",
+		encoding: kEncodingGzip,
+		writes:   []string{"abc", "def"},
+	}, {
+		name:       "first write over the threshold",
+		encoding:   kEncodingGzip,
+		writes:     []string{strings.Repeat("a", 64), "def"},
+		compressed: true,
+	}, {
+		name:       "writes over the threshold",
+		encoding:   kEncodingGzip,
+		writes:     []string{"abc", strings.Repeat("b", 30), strings.Repeat("c", 30), "def"},
+		compressed: true,
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tw := newThresholdWriter(w, pool, tc.encoding, 32)
+			for _, s := range tc.writes {
+				n, err := tw.Write([]byte(s))
+				require.NoError(t, err)
+				assert.Equal(t, len(s), n)
+			}
+			require.NoError(t, tw.close())
+
+			expected := strings.Join(tc.writes, "")
+			assert.Equal(t, tc.compressed, tw.compressing)
+			assert.Equal(t, uint64(w.Body.Len()), tw.counter.Count())
+			assert.Equal(t, len(expected), tw.srcSz)
+			if !tc.compressed {
+				assert.Empty(t, w.Header().Get("Content-Encoding"))
+				assert.Equal(t, expected, w.Body.String())
+				return
+			}
+			assert.Equal(t, kEncodingGzip, w.Header().Get("Content-Encoding"))
+			zr, err := gzip.NewReader(w.Body)
+			require.NoError(t, err)
+			p, err := io.ReadAll(zr)
+			require.NoError(t, err)
+			assert.Equal(t, expected, string(p))
+		})
+	}
+}
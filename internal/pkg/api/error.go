@@ -11,10 +11,12 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/apikey"
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
 	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
 	"github.com/elastic/fleet-server/v7/internal/pkg/es"
 	"github.com/elastic/fleet-server/v7/internal/pkg/file"
@@ -22,6 +24,7 @@ import (
 	"github.com/elastic/fleet-server/v7/internal/pkg/file/uploader"
 	"github.com/elastic/fleet-server/v7/internal/pkg/limit"
 	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger/errlog"
 	"go.elastic.co/apm/v2"
 
 	"github.com/rs/zerolog"
@@ -58,10 +61,37 @@ func (e *BadRequestErr) Unwrap() error {
 	return e.nextErr
 }
 
+// ErrorCode is the machine-readable code of an error response.
+// The codes are part of the API, an error keeps its code across releases while its error and message may change.
+type ErrorCode string
+
+const (
+	ErrCodeBadRequest               = ErrorCode("ErrBadRequest")
+	ErrCodeUnauthorized             = ErrorCode("ErrUnauthorized")
+	ErrCodeInvalidToken             = ErrorCode("ErrInvalidToken")
+	ErrCodeForbidden                = ErrorCode("ErrForbidden")
+	ErrCodeAgentNotFound            = ErrorCode("ErrAgentNotFound")
+	ErrCodeAgentInactive            = ErrorCode("ErrAgentInactive")
+	ErrCodeNotFound                 = ErrorCode("ErrNotFound")
+	ErrCodeEnrollmentTokenExpired   = ErrorCode("ErrEnrollmentTokenExpired")
+	ErrCodeEnrollmentTokenExhausted = ErrorCode("ErrEnrollmentTokenExhausted")
+	ErrCodeTooManyRequests          = ErrorCode("ErrTooManyRequests")
+	ErrCodeBodyTooLarge             = ErrorCode("ErrBodyTooLarge")
+	ErrCodeRequestTimeout           = ErrorCode("ErrRequestTimeout")
+	ErrCodeRequestCanceled          = ErrorCode("ErrRequestCanceled")
+	ErrCodeUnsupportedVersion       = ErrorCode("ErrUnsupportedVersion")
+	ErrCodeAgentVersionUnsupported  = ErrorCode("ErrAgentVersionUnsupported")
+	ErrCodeUploadRejected           = ErrorCode("ErrUploadRejected")
+	ErrCodeTLSRequired              = ErrorCode("ErrTLSRequired")
+	ErrCodeServiceUnavailable       = ErrorCode("ErrServiceUnavailable")
+	ErrCodeInternal                 = ErrorCode("ErrInternal")
+)
+
 // HTTPErrResp is an HTTP error response
 type HTTPErrResp struct {
 	StatusCode int           `json:"statusCode"`
 	Error      string        `json:"error"`
+	Code       ErrorCode     `json:"code"`
 	Message    string        `json:"message,omitempty"`
 	Level      zerolog.Level `json:"-"`
 }
@@ -72,11 +102,23 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 		target error
 		meta   HTTPErrResp
 	}{
+		{
+			// First, the error of the call interrupted by the endpoint timeout is wrapped.
+			ErrEndpointTimeout,
+			HTTPErrResp{
+				http.StatusServiceUnavailable,
+				"EndpointTimeout",
+				ErrCodeServiceUnavailable,
+				"request exceeded the endpoint timeout",
+				zerolog.WarnLevel,
+			},
+		},
 		{
 			ErrAgentNotFound,
 			HTTPErrResp{
 				http.StatusNotFound,
 				"AgentNotFound",
+				ErrCodeAgentNotFound,
 				"agent could not be found",
 				zerolog.WarnLevel,
 			},
@@ -86,15 +128,27 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusUnauthorized,
 				"Unauthorized",
+				ErrCodeInvalidToken,
 				"ApiKey not enabled",
 				zerolog.InfoLevel,
 			},
 		},
+		{
+			limit.ErrKeyRateLimit,
+			HTTPErrResp{
+				http.StatusTooManyRequests,
+				"KeyRateLimit",
+				ErrCodeTooManyRequests,
+				"exceeded the per key rate limit",
+				zerolog.DebugLevel,
+			},
+		},
 		{
 			context.Canceled,
 			HTTPErrResp{
 				499,
 				"StatusClientClosedRequest",
+				ErrCodeRequestCanceled,
 				"server is stopping",
 				zerolog.InfoLevel,
 			},
@@ -104,6 +158,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusBadRequest,
 				"InvalidUserAgent",
+				ErrCodeBadRequest,
 				"user-agent is invalid",
 				zerolog.InfoLevel,
 			},
@@ -113,24 +168,67 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusBadRequest,
 				"UnsupportedVersion",
+				ErrCodeUnsupportedVersion,
 				"version is not supported",
 				zerolog.InfoLevel,
 			},
 		},
+		{
+			ErrAgentVersionUnsupported,
+			HTTPErrResp{
+				http.StatusBadRequest,
+				"AgentVersionUnsupported",
+				ErrCodeAgentVersionUnsupported,
+				"",
+				zerolog.InfoLevel,
+			},
+		},
+		{
+			ErrUnsupportedEncoding,
+			HTTPErrResp{
+				http.StatusUnsupportedMediaType,
+				"UnsupportedEncoding",
+				ErrCodeBadRequest,
+				"content encoding is not supported, only gzip is",
+				zerolog.InfoLevel,
+			},
+		},
 		{
 			dl.ErrNotFound,
 			HTTPErrResp{
 				http.StatusNotFound,
 				"NotFound",
+				ErrCodeNotFound,
 				"not found",
 				zerolog.WarnLevel,
 			},
 		},
+		{
+			ErrorBadArtifact,
+			HTTPErrResp{
+				http.StatusBadRequest,
+				"BadArtifact",
+				ErrCodeBadRequest,
+				"malformed artifact identifier",
+				zerolog.InfoLevel,
+			},
+		},
+		{
+			ErrorBadSha2,
+			HTTPErrResp{
+				http.StatusBadRequest,
+				"BadSha2",
+				ErrCodeBadRequest,
+				"malformed sha256",
+				zerolog.InfoLevel,
+			},
+		},
 		{
 			ErrorThrottle,
 			HTTPErrResp{
 				http.StatusTooManyRequests,
 				"TooManyRequests",
+				ErrCodeTooManyRequests,
 				"too many requests",
 				zerolog.DebugLevel,
 			},
@@ -140,6 +238,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusTooManyRequests,
 				"RateLimit",
+				ErrCodeTooManyRequests,
 				"exceeded the rate limit",
 				zerolog.WarnLevel,
 			},
@@ -149,15 +248,77 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusTooManyRequests,
 				"MaxLimit",
+				ErrCodeTooManyRequests,
 				"exceeded the max limit",
 				zerolog.WarnLevel,
 			},
 		},
+		{
+			limit.ErrMaxConns,
+			HTTPErrResp{
+				http.StatusServiceUnavailable,
+				"MaxConnections",
+				ErrCodeServiceUnavailable,
+				"",
+				zerolog.WarnLevel,
+			},
+		},
+		{
+			limit.ErrBodyTooLarge,
+			HTTPErrResp{
+				http.StatusRequestEntityTooLarge,
+				"BodyTooLarge",
+				ErrCodeBodyTooLarge,
+				"",
+				zerolog.InfoLevel,
+			},
+		},
+		{
+			bulk.ErrSecretNotFound,
+			HTTPErrResp{
+				http.StatusServiceUnavailable,
+				"SecretNotFound",
+				ErrCodeServiceUnavailable,
+				"policy secret not found",
+				zerolog.WarnLevel,
+			},
+		},
+		{
+			bulk.ErrPendingBytes,
+			HTTPErrResp{
+				http.StatusServiceUnavailable,
+				"ElasticsearchBackpressure",
+				ErrCodeServiceUnavailable,
+				"too many bytes pending to elasticsearch",
+				zerolog.WarnLevel,
+			},
+		},
+		{
+			ErrServerStarting,
+			HTTPErrResp{
+				http.StatusServiceUnavailable,
+				"ServerStarting",
+				ErrCodeServiceUnavailable,
+				"fleet-server is starting, its policy is not ready yet",
+				zerolog.InfoLevel,
+			},
+		},
+		{
+			ErrEnrollConcurrency,
+			HTTPErrResp{
+				http.StatusServiceUnavailable,
+				"EnrollMaxConcurrency",
+				ErrCodeServiceUnavailable,
+				"exceeded the max concurrent enrollments",
+				zerolog.WarnLevel,
+			},
+		},
 		{
 			apikey.ErrElasticsearchAuthLimit,
 			HTTPErrResp{
 				http.StatusTooManyRequests,
 				"ElasticsearchAPIKeyAuthLimit",
+				ErrCodeTooManyRequests,
 				"exceeded the elasticsearch api key auth limit",
 				zerolog.WarnLevel,
 			},
@@ -167,6 +328,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusRequestTimeout,
 				"RequestTimeout",
+				ErrCodeRequestTimeout,
 				"timeout on request",
 				zerolog.InfoLevel,
 			},
@@ -176,6 +338,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusUnauthorized,
 				"Unauthorized",
+				ErrCodeAgentInactive,
 				"Agent not active",
 				zerolog.InfoLevel,
 			},
@@ -185,6 +348,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusBadRequest,
 				"TransitHashRequired",
+				ErrCodeBadRequest,
 				"Transit hash required",
 				zerolog.InfoLevel,
 			},
@@ -194,15 +358,127 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusForbidden,
 				"ErrAgentIdentity",
+				ErrCodeForbidden,
 				"Agent header contains wrong identifier",
 				zerolog.InfoLevel,
 			},
 		},
+		{
+			ErrServiceAccount,
+			HTTPErrResp{
+				http.StatusForbidden,
+				"ErrServiceAccount",
+				ErrCodeForbidden,
+				"Service token is not for the fleet-server service account",
+				zerolog.InfoLevel,
+			},
+		},
+		{
+			ErrInvalidClientCert,
+			HTTPErrResp{
+				http.StatusUnauthorized,
+				"Unauthorized",
+				ErrCodeUnauthorized,
+				"invalid client certificate",
+				zerolog.InfoLevel,
+			},
+		},
+		{
+			ErrKubernetesTokenDenied,
+			HTTPErrResp{
+				http.StatusUnauthorized,
+				"KubernetesTokenDenied",
+				ErrCodeInvalidToken,
+				"kubernetes service account token denied",
+				zerolog.InfoLevel,
+			},
+		},
+		{
+			ErrKubernetesNoPolicy,
+			HTTPErrResp{
+				http.StatusForbidden,
+				"KubernetesNoPolicy",
+				ErrCodeForbidden,
+				"",
+				zerolog.InfoLevel,
+			},
+		},
+		{
+			ErrKubernetesReviewFailed,
+			HTTPErrResp{
+				http.StatusServiceUnavailable,
+				"KubernetesReviewFailed",
+				ErrCodeServiceUnavailable,
+				"kubernetes token review failed",
+				zerolog.WarnLevel,
+			},
+		},
+		{
+			ErrAgentReplaceToken,
+			HTTPErrResp{
+				http.StatusForbidden,
+				"AgentReplaceTokenMismatch",
+				ErrCodeForbidden,
+				"replace token does not match the existing agent",
+				zerolog.InfoLevel,
+			},
+		},
+		{
+			dl.ErrEnrollmentAPIKeyExhausted,
+			HTTPErrResp{
+				http.StatusForbidden,
+				"EnrollmentKeyExhausted",
+				ErrCodeEnrollmentTokenExhausted,
+				"enrollment key usage limit reached",
+				zerolog.InfoLevel,
+			},
+		},
+		{
+			ErrEnrollmentKeyExpired,
+			HTTPErrResp{
+				http.StatusForbidden,
+				"EnrollmentKeyExpired",
+				ErrCodeEnrollmentTokenExpired,
+				"enrollment key is expired",
+				zerolog.InfoLevel,
+			},
+		},
+		{
+			ErrInvalidUpgradeMetadata,
+			HTTPErrResp{
+				http.StatusBadRequest,
+				"InvalidUpgradeMetadata",
+				ErrCodeBadRequest,
+				"invalid upgrade details",
+				zerolog.InfoLevel,
+			},
+		},
+		{
+			ErrInvalidTags,
+			HTTPErrResp{
+				http.StatusBadRequest,
+				"InvalidTags",
+				ErrCodeBadRequest,
+				"",
+				zerolog.InfoLevel,
+			},
+		},
+		{
+			ErrPolicyNamespace,
+			HTTPErrResp{
+				http.StatusForbidden,
+				"PolicyNamespace",
+				ErrCodeForbidden,
+				"policy is not in the agent namespaces",
+				zerolog.WarnLevel,
+			},
+		},
 		{
 			ErrAgentCorrupted,
 			HTTPErrResp{
 				http.StatusBadRequest,
 				"ErrAgentCorrupted",
+				ErrCodeBadRequest,
 				"Agent record corrupted",
 				zerolog.InfoLevel,
 			},
@@ -212,15 +488,27 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusUnauthorized,
 				"ErrAgentInactive",
+				ErrCodeAgentInactive,
 				"Agent inactive",
 				zerolog.InfoLevel,
 			},
 		},
+		{
+			ErrAgentDeleted,
+			HTTPErrResp{
+				http.StatusUnauthorized,
+				"ErrAgentInactive",
+				ErrCodeAgentInactive,
+				"Agent record deleted",
+				zerolog.InfoLevel,
+			},
+		},
 		{
 			ErrAPIKeyNotEnabled,
 			HTTPErrResp{
 				http.StatusUnauthorized,
 				"ErrAPIKeyNotEnabled",
+				ErrCodeInvalidToken,
 				"APIKey not enabled",
 				zerolog.InfoLevel,
 			},
@@ -230,6 +518,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusBadRequest,
 				"ErrFileInfoBodyRequired",
+				ErrCodeBadRequest,
 				"file info body is required",
 				zerolog.InfoLevel,
 			},
@@ -239,6 +528,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusBadRequest,
 				"ErrAgentIDMissing",
+				ErrCodeBadRequest,
 				"equired field agent_id is missing",
 				zerolog.InfoLevel,
 			},
@@ -248,6 +538,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusNotImplemented,
 				"ErrTLSRequired",
+				ErrCodeTLSRequired,
 				"server must run with tls to use this endpoint",
 				zerolog.InfoLevel,
 			},
@@ -257,6 +548,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusInternalServerError,
 				"ErrPGPPermissions",
+				ErrCodeInternal,
 				"fleet-server PGP key has incorrect permissions",
 				zerolog.ErrorLevel,
 			},
@@ -267,6 +559,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusUnauthorized,
 				"ErrNoAuthHeader",
+				ErrCodeUnauthorized,
 				"no authorization header",
 				zerolog.InfoLevel,
 			},
@@ -276,6 +569,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusBadRequest,
 				"ErrMalformedHeader",
+				ErrCodeInvalidToken,
 				"malformed authorization header",
 				zerolog.InfoLevel,
 			},
@@ -285,6 +579,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusUnauthorized,
 				"ErrUnauthorized",
+				ErrCodeInvalidToken,
 				"unauthorized",
 				zerolog.InfoLevel,
 			},
@@ -294,6 +589,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusBadRequest,
 				"ErrMalformedToken",
+				ErrCodeInvalidToken,
 				"malformed token",
 				zerolog.InfoLevel,
 			},
@@ -303,6 +599,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusUnauthorized,
 				"ErrInvalidToken",
+				ErrCodeInvalidToken,
 				"token not valid utf8",
 				zerolog.InfoLevel,
 			},
@@ -312,6 +609,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusUnauthorized,
 				"ErrAPIKeyNotFound",
+				ErrCodeInvalidToken,
 				"api key not found",
 				zerolog.InfoLevel,
 			},
@@ -322,6 +620,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusBadRequest,
 				"ErrAPIKeyNotFound",
+				ErrCodeUploadRejected,
 				"active upload not found with this ID, it may be expired",
 				zerolog.InfoLevel,
 			},
@@ -331,6 +630,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusBadRequest,
 				"ErrFileSizeTooLarge",
+				ErrCodeUploadRejected,
 				"this file exceeds the maximum allowed file size",
 				zerolog.InfoLevel,
 			},
@@ -340,6 +640,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusBadRequest,
 				"ErrMissingChunks",
+				ErrCodeUploadRejected,
 				"file data incomplete, not all chunks were uploaded",
 				zerolog.InfoLevel,
 			},
@@ -347,8 +648,9 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 		{
 			uploader.ErrHashMismatch,
 			HTTPErrResp{
-				http.StatusBadRequest,
+				http.StatusUnprocessableEntity,
 				"ErrHashMismatch",
+				ErrCodeUploadRejected,
 				"hash does not match",
 				zerolog.InfoLevel,
 			},
@@ -358,6 +660,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusBadRequest,
 				"ErrUploadExpired",
+				ErrCodeUploadRejected,
 				"upload has expired",
 				zerolog.InfoLevel,
 			},
@@ -367,6 +670,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusBadRequest,
 				"ErrUploadStopped",
+				ErrCodeUploadRejected,
 				"upload has stopped",
 				zerolog.InfoLevel,
 			},
@@ -376,6 +680,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusBadRequest,
 				"ErrInvalidChunkNum",
+				ErrCodeUploadRejected,
 				"invalid chunk number",
 				zerolog.InfoLevel,
 			},
@@ -385,6 +690,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusBadRequest,
 				"ErrFailValidation",
+				ErrCodeUploadRejected,
 				"file contents failed validation",
 				zerolog.InfoLevel,
 			},
@@ -394,6 +700,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusBadRequest,
 				"ErrStatusNoUploads",
+				ErrCodeUploadRejected,
 				"file closed, not accepting uploads",
 				zerolog.InfoLevel,
 			},
@@ -403,6 +710,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusBadRequest,
 				"ErrPayloadRequired",
+				ErrCodeUploadRejected,
 				"upload start payload required",
 				zerolog.InfoLevel,
 			},
@@ -412,6 +720,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusBadRequest,
 				"ErrFileSizeRequired",
+				ErrCodeUploadRejected,
 				"file.size is required",
 				zerolog.InfoLevel,
 			},
@@ -421,6 +730,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusBadRequest,
 				"ErrInvalidFileSize",
+				ErrCodeUploadRejected,
 				"",
 				zerolog.InfoLevel,
 			},
@@ -430,6 +740,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusBadRequest,
 				"ErrFieldRequired",
+				ErrCodeUploadRejected,
 				"",
 				zerolog.InfoLevel,
 			},
@@ -440,6 +751,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusBadRequest,
 				"ErrInvalidAPIVersionFormat",
+				ErrCodeBadRequest,
 				"",
 				zerolog.InfoLevel,
 			},
@@ -449,6 +761,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusBadRequest,
 				"ErrUnsupportedAPIVersion",
+				ErrCodeUnsupportedVersion,
 				"",
 				zerolog.InfoLevel,
 			},
@@ -459,6 +772,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusNotFound,
 				"ErrNoFile",
+				ErrCodeNotFound,
 				"file not found",
 				zerolog.InfoLevel,
 			},
@@ -468,6 +782,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusBadRequest,
 				"ErrInvalidFileID",
+				ErrCodeBadRequest,
 				"ErrInvalidID",
 				zerolog.InfoLevel,
 			},
@@ -477,6 +792,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 			HTTPErrResp{
 				http.StatusBadRequest,
 				"ErrPolicyNotFound",
+				ErrCodeBadRequest,
 				"ErrPolicyNotFound",
 				zerolog.InfoLevel,
 			},
@@ -489,6 +805,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 				return HTTPErrResp{
 					e.meta.StatusCode,
 					e.meta.Error,
+					e.meta.Code,
 					err.Error(),
 					e.meta.Level,
 				}
@@ -503,6 +820,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 		return HTTPErrResp{
 			http.StatusBadRequest,
 			"BadRequest",
+			ErrCodeBadRequest,
 			err.Error(),
 			zerolog.ErrorLevel,
 		}
@@ -514,6 +832,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 		return HTTPErrResp{
 			http.StatusInternalServerError,
 			err.Error(),
+			ErrCodeInternal,
 			"Fleet server unable to marshall JSON",
 			zerolog.ErrorLevel,
 		}
@@ -524,6 +843,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 		return HTTPErrResp{
 			http.StatusServiceUnavailable,
 			esErr.Error(),
+			ErrCodeServiceUnavailable,
 			"elasticsearch error",
 			zerolog.ErrorLevel,
 		}
@@ -535,6 +855,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 		return HTTPErrResp{
 			http.StatusServiceUnavailable,
 			"ServiceUnavailable",
+			ErrCodeServiceUnavailable,
 			"Fleet server unable to communicate with Elasticsearch",
 			zerolog.InfoLevel,
 		}
@@ -544,6 +865,7 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 	return HTTPErrResp{
 		StatusCode: http.StatusInternalServerError,
 		Error:      "BadRequest",
+		Code:       ErrCodeInternal,
 		Message:    err.Error(),
 		Level:      zerolog.InfoLevel,
 	}
@@ -551,19 +873,50 @@ func NewHTTPErrResp(err error) HTTPErrResp {
 
 // Write will serialize the ErrResp to an http response and include the proper headers.
 func (er HTTPErrResp) Write(w http.ResponseWriter) error {
-	data, err := json.Marshal(&er)
+	return writeErrResp(w, er.StatusCode, &er)
+}
+
+func writeErrResp(w http.ResponseWriter, statusCode int, v interface{}) error {
+	data, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
-	w.WriteHeader(er.StatusCode)
+	w.WriteHeader(statusCode)
 	_, err = w.Write(data)
 	return err
 }
 
+// isBodyTooLarge returns true if err is caused by a request body over the max body size.
+func isBodyTooLarge(err error) bool {
+	var mbErr *http.MaxBytesError
+	return errors.Is(err, limit.ErrBodyTooLarge) || errors.As(err, &mbErr)
+}
+
+// HintReEnroll is the hint of the error responses that the agent only recovers from by enrolling again.
+const HintReEnroll = "reenroll"
+
+// hintResp is an error response with a hint that tells the agent how to recover.
+type hintResp struct {
+	HTTPErrResp
+	Hint string `json:"hint"`
+}
+
+// bodyTooLargeResp is the response to a request whose body exceeds the max body size of the endpoint.
+type bodyTooLargeResp struct {
+	HTTPErrResp
+	Endpoint string `json:"endpoint"`
+	Limit    int64  `json:"limit"`
+}
+
 func ErrorResp(w http.ResponseWriter, r *http.Request, err error) {
 	zlog := hlog.FromRequest(r)
+	// The body was read past the limit by the handler, the error tells the endpoint and the limit.
+	var mbErr *http.MaxBytesError
+	if errors.As(err, &mbErr) {
+		err = &limit.BodyTooLargeError{Endpoint: pathToOperation(r.URL.Path), Limit: mbErr.Limit}
+	}
 	resp := NewHTTPErrResp(err)
 	e := zlog.WithLevel(resp.Level).Err(err).Int(ECSHTTPResponseCode, resp.StatusCode).Str("error.type", fmt.Sprintf("%T", err))
 	if ts, ok := logger.CtxStartTime(r.Context()); ok {
@@ -571,6 +924,14 @@ func ErrorResp(w http.ResponseWriter, r *http.Request, err error) {
 	}
 	e.Msg("HTTP request error")
 
+	// The failures and the saturated limiters are kept for the diagnostics bundle, not the rejected requests.
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		errlog.Report(errlog.SubsystemHandler, pathToOperation(r.URL.Path), err, map[string]string{
+			ECSHTTPResponseCode: strconv.Itoa(resp.StatusCode),
+			"error.type":        fmt.Sprintf("%T", err),
+		})
+	}
+
 	if resp.StatusCode >= 500 {
 		if trans := apm.TransactionFromContext(r.Context()); trans != nil {
 			esErr := &es.ErrElastic{}
@@ -588,7 +949,22 @@ func ErrorResp(w http.ResponseWriter, r *http.Request, err error) {
 		apm.CaptureError(r.Context(), err).Send()
 	}
 
-	if rerr := resp.Write(w); rerr != nil {
+	var rlErr *limit.RateLimitError
+	if errors.As(err, &rlErr) {
+		w.Header().Set("Retry-After", rlErr.RetryAfterSeconds())
+	}
+
+	var rerr error
+	var btlErr *limit.BodyTooLargeError
+	switch {
+	case errors.As(err, &btlErr):
+		rerr = writeErrResp(w, resp.StatusCode, bodyTooLargeResp{resp, btlErr.Endpoint, btlErr.Limit})
+	case errors.Is(err, ErrAgentInactive), errors.Is(err, ErrAgentDeleted):
+		rerr = writeErrResp(w, resp.StatusCode, hintResp{resp, HintReEnroll})
+	default:
+		rerr = resp.Write(w)
+	}
+	if rerr != nil {
 		zlog.Error().Err(rerr).Msg("fail writing error response")
 	}
 }
@@ -6,12 +6,21 @@ package api
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/elastic/fleet-server/v7/internal/pkg/apikey"
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
 	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/file/delivery"
+	"github.com/elastic/fleet-server/v7/internal/pkg/file/uploader"
+	"github.com/elastic/fleet-server/v7/internal/pkg/limit"
 	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
 	"github.com/stretchr/testify/require"
 	"go.elastic.co/apm/v2"
@@ -119,6 +128,22 @@ func Test_ErrResp_Status(t *testing.T) {
 			nextErr: fmt.Errorf("testError"),
 		},
 		status: 400,
+	}, {
+		name:   "key rate limit",
+		err:    &limit.RateLimitError{Err: limit.ErrKeyRateLimit, RetryAfter: time.Second},
+		status: 429,
+	}, {
+		name:   "body too large",
+		err:    &limit.BodyTooLargeError{Endpoint: "checkin", Limit: 1024},
+		status: 413,
+	}, {
+		name:   "bulk pending bytes",
+		err:    fmt.Errorf("checkin: %w", bulk.ErrPendingBytes),
+		status: 503,
+	}, {
+		name:   "policy secret not found",
+		err:    fmt.Errorf("failed to process output secrets %q: %w", "default", bulk.ErrSecretNotFound),
+		status: 503,
 	}}
 
 	for _, tc := range tests {
@@ -128,3 +153,148 @@ func Test_ErrResp_Status(t *testing.T) {
 		})
 	}
 }
+
+func Test_ErrResp_Code(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code ErrorCode
+	}{{
+		name: "agent not found",
+		err:  fmt.Errorf("checkin: %w", ErrAgentNotFound),
+		code: ErrCodeAgentNotFound,
+	}, {
+		name: "agent inactive",
+		err:  ErrAgentInactive,
+		code: ErrCodeAgentInactive,
+	}, {
+		name: "agent deleted",
+		err:  ErrAgentDeleted,
+		code: ErrCodeAgentInactive,
+	}, {
+		name: "no auth header",
+		err:  apikey.ErrNoAuthHeader,
+		code: ErrCodeUnauthorized,
+	}, {
+		name: "unauthorized api key",
+		err:  apikey.ErrUnauthorized,
+		code: ErrCodeInvalidToken,
+	}, {
+		name: "malformed token",
+		err:  apikey.ErrMalformedToken,
+		code: ErrCodeInvalidToken,
+	}, {
+		name: "enrollment key expired",
+		err:  ErrEnrollmentKeyExpired,
+		code: ErrCodeEnrollmentTokenExpired,
+	}, {
+		name: "enrollment key exhausted",
+		err:  dl.ErrEnrollmentAPIKeyExhausted,
+		code: ErrCodeEnrollmentTokenExhausted,
+	}, {
+		name: "key rate limit",
+		err:  &limit.RateLimitError{Err: limit.ErrKeyRateLimit, RetryAfter: time.Second},
+		code: ErrCodeTooManyRequests,
+	}, {
+		name: "max conns",
+		err:  &limit.MaxConnsError{Max: 1},
+		code: ErrCodeServiceUnavailable,
+	}, {
+		name: "body too large",
+		err:  &limit.BodyTooLargeError{Endpoint: "checkin", Limit: 1024},
+		code: ErrCodeBodyTooLarge,
+	}, {
+		name: "server starting",
+		err:  ErrServerStarting,
+		code: ErrCodeServiceUnavailable,
+	}, {
+		name: "es error",
+		err:  &es.ErrElastic{Status: 500},
+		code: ErrCodeServiceUnavailable,
+	}, {
+		name: "connection refused",
+		err:  fmt.Errorf("dial tcp 127.0.0.1:9200: connect: connection refused"),
+		code: ErrCodeServiceUnavailable,
+	}, {
+		name: "artifact not found",
+		err:  dl.ErrNotFound,
+		code: ErrCodeNotFound,
+	}, {
+		name: "file not found",
+		err:  delivery.ErrNoFile,
+		code: ErrCodeNotFound,
+	}, {
+		name: "upload hash mismatch",
+		err:  uploader.ErrHashMismatch,
+		code: ErrCodeUploadRejected,
+	}, {
+		name: "unsupported api version",
+		err:  ErrUnsupportedAPIVersion,
+		code: ErrCodeUnsupportedVersion,
+	}, {
+		name: "unsupported agent version",
+		err:  fmt.Errorf("%w: agent version 7.15.0, accepted versions are >= 7.16", ErrAgentVersionUnsupported),
+		code: ErrCodeAgentVersionUnsupported,
+	}, {
+		name: "tls required",
+		err:  ErrTLSRequired,
+		code: ErrCodeTLSRequired,
+	}, {
+		name: "context canceled",
+		err:  context.Canceled,
+		code: ErrCodeRequestCanceled,
+	}, {
+		name: "deadline exceeded",
+		err:  os.ErrDeadlineExceeded,
+		code: ErrCodeRequestTimeout,
+	}, {
+		name: "decode req error",
+		err:  &BadRequestErr{msg: "testMessage", nextErr: fmt.Errorf("testError")},
+		code: ErrCodeBadRequest,
+	}, {
+		name: "generic error",
+		err:  fmt.Errorf("some error"),
+		code: ErrCodeInternal,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := NewHTTPErrResp(tc.err)
+			require.Equal(t, tc.code, r.Code)
+		})
+	}
+}
+
+func Test_ErrorResp_Body(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	wr := httptest.NewRecorder()
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://localhost", nil)
+	require.NoError(t, err)
+
+	ErrorResp(wr, req, ErrAgentNotFound)
+	resp := wr.Result()
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	var body map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	require.Equal(t, map[string]interface{}{
+		"statusCode": float64(http.StatusNotFound),
+		"error":      "AgentNotFound",
+		"code":       string(ErrCodeAgentNotFound),
+		"message":    "agent could not be found",
+	}, body)
+}
+
+func Test_ErrorResp_RetryAfter(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	wr := httptest.NewRecorder()
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://localhost", nil)
+	require.NoError(t, err)
+
+	ErrorResp(wr, req, &limit.RateLimitError{Err: limit.ErrKeyRateLimit, RetryAfter: 1500 * time.Millisecond})
+	resp := wr.Result()
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "2", resp.Header.Get("Retry-After"))
+}
@@ -10,10 +10,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"mime"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/miolini/datacounter"
 	"github.com/rs/zerolog"
@@ -26,6 +28,7 @@ import (
 	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
 	"github.com/elastic/fleet-server/v7/internal/pkg/es"
 	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger/audit"
 	"github.com/elastic/fleet-server/v7/internal/pkg/model"
 	"github.com/elastic/fleet-server/v7/internal/pkg/policy"
 	"github.com/elastic/fleet-server/v7/internal/pkg/smap"
@@ -77,27 +80,62 @@ func (a *AckResponse) SetError(pos int, err error) {
 	}
 }
 
+// succeeded returns true if at least one event was processed successfully.
+func (a *AckResponse) succeeded() bool {
+	for _, item := range a.Items {
+		if item.Status == http.StatusOK {
+			return true
+		}
+	}
+	return false
+}
+
+// ackPartialLevel is the level of the application/json media type in the Accept header of the agents that
+// handle partially successful acks. The acks of these agents are answered with a 200 if at least one event
+// succeeded, the agent retries the events whose item has an error status. Other agents get the largest
+// error status of the events and retry all of them.
+const ackPartialLevel = 2
+
+// acceptsPartialAcks returns true if the Accept header of r has the application/json media type with a level
+// that handles partially successful acks.
+func acceptsPartialAcks(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(mediaRange)
+			if err != nil || mediaType != "application/json" {
+				continue
+			}
+			if level, err := strconv.Atoi(params["level"]); err == nil && level >= ackPartialLevel {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 type AckT struct {
-	cfg   *config.Server
-	bulk  bulk.Bulk
-	cache cache.Cache
+	cfg       *config.Server
+	bulk      bulk.Bulk
+	cache     cache.Cache
+	authAgent authAgentFunc
 }
 
 func NewAckT(cfg *config.Server, bulker bulk.Bulk, cache cache.Cache) *AckT {
 	return &AckT{
-		cfg:   cfg,
-		bulk:  bulker,
-		cache: cache,
+		cfg:       cfg,
+		bulk:      bulker,
+		cache:     cache,
+		authAgent: agentAuthenticator(cfg),
 	}
 }
 
 func (ack *AckT) handleAcks(zlog zerolog.Logger, w http.ResponseWriter, r *http.Request, id string) error {
-	agent, err := authAgent(r, &id, ack.bulk, ack.cache)
+	agent, err := ack.authAgent(r, &id, ack.bulk, ack.cache)
 	if err != nil {
 		return err
 	}
 	zlog = zlog.With().Str(LogAccessAPIKeyID, agent.AccessAPIKeyID).Logger()
-	ctx := zlog.WithContext(r.Context())
+	ctx := audit.WithClientIP(zlog.WithContext(r.Context()), clientIP(r, ack.cfg.TrustedProxies))
 	r = r.WithContext(ctx)
 
 	return ack.processRequest(zlog, w, r, agent)
@@ -117,7 +155,12 @@ func (ack *AckT) processRequest(zlog zerolog.Logger, w http.ResponseWriter, r *h
 	if err != nil {
 		var herr *HTTPError
 		if errors.As(err, &herr) {
-			w.WriteHeader(herr.Status)
+			if acceptsPartialAcks(r) && resp.succeeded() {
+				// The agent retries only the items that failed.
+				zlog.Debug().Int("status", herr.Status).Msg("acks partially succeeded")
+			} else {
+				w.WriteHeader(herr.Status)
+			}
 		} else {
 			// Non-HTTP error will be handled at higher level
 			return err
@@ -144,18 +187,16 @@ func (ack *AckT) validateRequest(zlog zerolog.Logger, w http.ResponseWriter, r *
 	span, _ := apm.StartSpan(r.Context(), "validateRequest", "validate")
 	defer span.End()
 
-	body := r.Body
-
-	// Limit the size of the body to prevent malicious agent from exhausting RAM in server
-	if ack.cfg.Limits.AckLimit.MaxBody > 0 {
-		body = http.MaxBytesReader(w, body, ack.cfg.Limits.AckLimit.MaxBody)
+	// Limit the size of the decompressed body to prevent malicious agent from exhausting RAM in server
+	body, err := decodeBody(w, r, ack.cfg.Limits.AckLimit.MaxBody)
+	if err != nil {
+		return nil, err
 	}
 	readCounter := datacounter.NewReaderCounter(body)
 
 	var req AckRequest
-	dec := json.NewDecoder(readCounter)
-	if err := dec.Decode(&req); err != nil {
-		return nil, &BadRequestErr{msg: "unable to decode ack request", nextErr: err}
+	if err := decodeRequest(zlog, readCounter, &req, ack.cfg.StrictSchema, "ack"); err != nil {
+		return nil, err
 	}
 
 	cntAcks.bodyIn.Add(readCounter.Count())
@@ -169,12 +210,13 @@ func eventToActionResult(agentID, aType string, namespaces []string, ev AckReque
 		event, _ := ev.AsDiagnosticsEvent()
 		p, _ := json.Marshal(event.Data)
 		return model.ActionResult{
-			ActionID:   event.ActionId,
-			AgentID:    agentID,
-			Namespaces: namespaces,
-			Data:       p,
-			Error:      fromPtr(event.Error),
-			Timestamp:  event.Timestamp.Format(time.RFC3339Nano),
+			ActionID:       event.ActionId,
+			AgentID:        agentID,
+			Namespaces:     namespaces,
+			Data:           p,
+			ActionResponse: event.ActionResponse,
+			Error:          fromPtr(event.Error),
+			Timestamp:      event.Timestamp.Format(time.RFC3339Nano),
 		}
 	case string(INPUTACTION):
 		event, _ := ev.AsInputEvent()
@@ -193,15 +235,40 @@ func eventToActionResult(agentID, aType string, namespaces []string, ev AckReque
 	default: // UPGRADE action acks are also handled by handelUpgrade (deprecated func)
 		event, _ := ev.AsGenericEvent()
 		return model.ActionResult{
-			ActionID:   event.ActionId,
-			Namespaces: namespaces,
-			AgentID:    agentID,
-			Error:      fromPtr(event.Error),
-			Timestamp:  event.Timestamp.Format(time.RFC3339Nano),
+			ActionID:       event.ActionId,
+			Namespaces:     namespaces,
+			AgentID:        agentID,
+			ActionResponse: event.ActionResponse,
+			Error:          fromPtr(event.Error),
+			Timestamp:      event.Timestamp.Format(time.RFC3339Nano),
 		}
 	}
 }
 
+// truncatedResponse replaces an action_response larger than the max response size.
+type truncatedResponse struct {
+	Truncated string `json:"truncated"` // the start of the payload
+	Size      int    `json:"size"`      // the size of the payload
+}
+
+// truncateActionResponse returns the action_response to store and if it was truncated.
+// A payload larger than max bytes is replaced by its first max bytes, cut on a rune boundary, and its size.
+// A max of 0 keeps the payloads whatever their size.
+func truncateActionResponse(raw json.RawMessage, max int) (json.RawMessage, bool) {
+	if max <= 0 || len(raw) <= max {
+		return raw, false
+	}
+	n := max
+	for n > 0 && !utf8.RuneStart(raw[n]) {
+		n--
+	}
+	p, err := json.Marshal(truncatedResponse{Truncated: string(raw[:n]), Size: len(raw)})
+	if err != nil {
+		return nil, true
+	}
+	return p, true
+}
+
 // handleAckEvents can return:
 // 1. AckResponse and nil error, when the whole request is successful
 // 2. AckResponse and non-nil error, when the request items had errors
@@ -299,6 +366,14 @@ func (ack *AckT) handleAckEvents(ctx context.Context, zlog zerolog.Logger, agent
 		}
 		vSpan.End()
 
+		// An agent can not ack the actions of a namespace it is not in.
+		if !model.InNamespaces(agent.Namespaces, action.Namespaces) {
+			log.Warn().Strs("namespaces", action.Namespaces).Msg("action is not in the agent namespaces")
+			setResult(n, http.StatusForbidden)
+			span.End()
+			continue
+		}
+
 		if err := ack.handleActionResult(ctx, zlog, agent, action, ev); err != nil {
 			setError(n, err)
 		} else {
@@ -362,16 +437,28 @@ func (ack *AckT) handleActionResult(ctx context.Context, zlog zerolog.Logger, ag
 
 	// Convert ack event to action result document
 	acr := eventToActionResult(agent.Id, action.Type, action.Namespaces, ev)
+	if acr.ActionResponse != nil {
+		var truncated bool
+		acr.ActionResponse, truncated = truncateActionResponse(acr.ActionResponse, ack.cfg.ActionResults.MaxResponseSize)
+		if truncated {
+			acr.ActionResponseTruncated = true
+			zlog.Debug().Str(logger.ActionID, acr.ActionID).Msg("action_response is larger than max_response_size, truncated")
+		}
+	}
 
-	// Save action result document
-	if err := dl.CreateActionResult(ctx, ack.bulk, acr); err != nil {
+	// Save action result document, a failed upgrade reports its error after the upgrade was acked.
+	save := dl.CreateActionResult
+	if action.Type == TypeUpgrade {
+		save = dl.UpsertActionResult
+	}
+	if err := save(ctx, ack.bulk, acr); err != nil {
 		zlog.Error().Err(err).Msg("create action result")
 		return err
 	}
 
 	if action.Type == TypeUpgrade {
 		event, _ := ev.AsUpgradeEvent()
-		if err := ack.handleUpgrade(ctx, zlog, agent, event); err != nil {
+		if err := ack.handleUpgrade(ctx, zlog, agent, action, event); err != nil {
 			zlog.Error().Err(err).Msg("handle upgrade event")
 			return err
 		}
@@ -560,6 +647,12 @@ func cleanRoles(roles json.RawMessage) (json.RawMessage, int, error) {
 }
 
 func (ack *AckT) invalidateAPIKeys(ctx context.Context, zlog zerolog.Logger, toRetireAPIKeyIDs []model.ToRetireAPIKeyIdsItems, skip string) {
+	// Remove the keys from the cache so they stop authenticating before their cache entries expire.
+	for _, k := range toRetireAPIKeyIDs {
+		if k.ID != skip && k.ID != "" {
+			ack.cache.DeleteAPIKey(k.ID)
+		}
+	}
 	invalidateAPIKeys(ctx, zlog, ack.bulk, toRetireAPIKeyIDs, skip)
 }
 
@@ -583,15 +676,24 @@ func (ack *AckT) handleUnenroll(ctx context.Context, zlog zerolog.Logger, agent
 		return fmt.Errorf("handleUnenroll marshal: %w", err)
 	}
 
+	event := audit.Event{
+		Action:   audit.ActionUnenroll,
+		Outcome:  audit.OutcomeSuccess,
+		AgentID:  agent.Id,
+		PolicyID: agent.PolicyID,
+	}
 	if err = ack.bulk.Update(ctx, dl.FleetAgents, agent.Id, body, bulk.WithRefresh(), bulk.WithRetryOnConflict(3)); err != nil {
+		event.Outcome = audit.OutcomeFailure
+		audit.Log(ctx, event)
 		return fmt.Errorf("handleUnenroll update: %w", err)
 	}
+	audit.Log(ctx, event)
 
 	zlog.Info().Msg("ack unenroll")
 	return nil
 }
 
-func (ack *AckT) handleUpgrade(ctx context.Context, zlog zerolog.Logger, agent *model.Agent, event UpgradeEvent) error {
+func (ack *AckT) handleUpgrade(ctx context.Context, zlog zerolog.Logger, agent *model.Agent, action model.Action, event UpgradeEvent) error {
 	span, ctx := apm.StartSpan(ctx, "ackUpgrade", "process")
 	defer span.End()
 	now := time.Now().UTC().Format(time.RFC3339)
@@ -614,6 +716,11 @@ func (ack *AckT) handleUpgrade(ctx context.Context, zlog zerolog.Logger, agent *
 				dl.FieldUpgradeStatus:    "failed",
 			}
 		}
+		// The agent is only marked as failed once the retries of the action are exhausted.
+		if doc[dl.FieldUpgradeStatus] == "failed" && upgradeRetryLeft(zlog, action) {
+			zlog.Info().Str(logger.ActionID, action.ActionID).Msg("marking agent upgrade as retry scheduled")
+			doc[dl.FieldUpgradeStatus] = dl.UpgradeStatusRetryScheduled
+		}
 	} else {
 		doc = bulk.UpdateFields{
 			dl.FieldUpgradeStartedAt: nil,
@@ -639,6 +746,17 @@ func (ack *AckT) handleUpgrade(ctx context.Context, zlog zerolog.Logger, agent *
 	return nil
 }
 
+// upgradeRetryLeft returns true if the failed upgrade action has a retry left, the retry is written by the
+// fleet-server that runs the upgrade retries schedule.
+func upgradeRetryLeft(zlog zerolog.Logger, action model.Action) bool {
+	retry, ok, err := dl.ParseUpgradeRetry(action)
+	if err != nil {
+		zlog.Warn().Err(err).Str(logger.ActionID, action.ActionID).Msg("upgrade action is not retried")
+		return false
+	}
+	return ok && !retry.Exhausted()
+}
+
 func isAgentActive(ctx context.Context, zlog zerolog.Logger, bulk bulk.Bulk, agentID string) bool {
 	agent, err := dl.FindAgent(ctx, bulk, dl.QueryAgentByID, dl.FieldID, agentID)
 	if err != nil {
@@ -684,6 +802,11 @@ func makeUpdatePolicyBody(policyID string, newRev int64) []byte {
 	return buf.Bytes()
 }
 
+// InvalidateAPIKeys invalidates the passed output API keys, the keys of remote outputs are invalidated through the bulker of their output.
+func InvalidateAPIKeys(ctx context.Context, bulk bulk.Bulk, toRetireAPIKeyIDs []model.ToRetireAPIKeyIdsItems) {
+	invalidateAPIKeys(ctx, *zerolog.Ctx(ctx), bulk, toRetireAPIKeyIDs, "")
+}
+
 func invalidateAPIKeys(ctx context.Context, zlog zerolog.Logger, bulk bulk.Bulk, toRetireAPIKeyIDs []model.ToRetireAPIKeyIdsItems, skip string) {
 	ids := make([]string, 0, len(toRetireAPIKeyIDs))
 	remoteIds := make(map[string][]string)
@@ -702,9 +825,7 @@ func invalidateAPIKeys(ctx context.Context, zlog zerolog.Logger, bulk bulk.Bulk,
 	}
 	if len(ids) > 0 {
 		zlog.Info().Strs("fleet.policy.apiKeyIDsToRetire", ids).Msg("Invalidate old API keys")
-		if err := bulk.APIKeyInvalidate(ctx, ids...); err != nil {
-			zlog.Info().Err(err).Strs("ids", ids).Msg("Failed to invalidate API keys")
-		}
+		bulk.APIKeyInvalidateAsync(ids...)
 	}
 	// using remote es bulker to invalidate api key
 	for outputName, outputIds := range remoteIds {
@@ -723,9 +844,7 @@ func invalidateAPIKeys(ctx context.Context, zlog zerolog.Logger, bulk bulk.Bulk,
 			}
 		}
 		if outputBulk != nil {
-			if err := outputBulk.APIKeyInvalidate(ctx, outputIds...); err != nil {
-				zlog.Info().Err(err).Strs("ids", outputIds).Str(logger.PolicyOutputName, outputName).Msg("Failed to invalidate API keys")
-			}
+			outputBulk.APIKeyInvalidateAsync(outputIds...)
 		}
 	}
 }
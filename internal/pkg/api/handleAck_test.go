@@ -14,20 +14,26 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
 
+	"github.com/elastic/fleet-server/v7/internal/pkg/apikey"
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
 	"github.com/elastic/fleet-server/v7/internal/pkg/cache"
 	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
 	"github.com/elastic/fleet-server/v7/internal/pkg/es"
 	"github.com/elastic/fleet-server/v7/internal/pkg/model"
 	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+	testcache "github.com/elastic/fleet-server/v7/internal/pkg/testing/cache"
 	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 func BenchmarkMakeUpdatePolicyBody(b *testing.B) {
@@ -81,6 +87,15 @@ func TestEventToActionResult(t *testing.T) {
 		assert.Equal(t, "2022-02-23T18:26:08.506128Z", r.Timestamp)
 		assert.Equal(t, "error message", r.Error)
 	})
+	t.Run("with action response", func(t *testing.T) {
+		r := eventToActionResult(agentID, "SETTINGS", []string{}, AckRequest_Events_Item{json.RawMessage(`{
+		"action_id": "test-action-id",
+		"timestamp": "2022-02-23T18:26:08.506128Z",
+		"action_response": {"output": ["a", "b"]}
+	    }`)})
+		assert.Equal(t, "test-action-id", r.ActionID)
+		assert.JSONEq(t, `{"output":["a","b"]}`, string(r.ActionResponse))
+	})
 	t.Run("request diagnostics", func(t *testing.T) {
 		r := eventToActionResult(agentID, "REQUEST_DIAGNOSTICS", []string{}, AckRequest_Events_Item{json.RawMessage(`{
 		"action_id": "test-action-id",
@@ -519,6 +534,50 @@ func TestHandleAckEvents(t *testing.T) {
 	}
 }
 
+func TestAckActionNamespaces(t *testing.T) {
+	agent := &model.Agent{
+		ESDocument: model.ESDocument{Id: "ab12dcd8-bde0-4045-92dc-c4b27668d735"},
+		Agent:      &model.AgentMetadata{Version: "8.0.0"},
+		Namespaces: []string{"space1"},
+	}
+	c, err := cache.New(config.Cache{NumCounters: 100, MaxCost: 100000})
+	require.NoError(t, err)
+
+	m := ftesting.NewMockBulk()
+	for id, source := range map[string]string{
+		"space1-action":   `{"action_id":"space1-action","type":"SETTINGS","namespaces":["space1"]}`,
+		"space2-action":   `{"action_id":"space2-action","type":"SETTINGS","namespaces":["space2"]}`,
+		"unscoped-action": `{"action_id":"unscoped-action","type":"SETTINGS"}`,
+	} {
+		m.On("Search", mock.Anything, dl.FleetActions, mock.MatchedBy(matchAction(t, id)), mock.Anything).Return(&es.ResultT{HitsT: es.HitsT{
+			Hits: []es.HitT{{Source: []byte(source)}},
+		}}, nil)
+	}
+	var results []model.ActionResult
+	m.On("Create", mock.Anything, dl.FleetActionsResults, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		var acr model.ActionResult
+		require.NoError(t, json.Unmarshal(args.Get(3).([]byte), &acr))
+		results = append(results, acr)
+	}).Return("", nil)
+
+	ack := NewAckT(&config.Server{}, m, c)
+	res, err := ack.handleAckEvents(context.Background(), testlog.SetLogger(t), agent, []AckRequest_Events_Item{
+		{json.RawMessage(`{"action_id":"space1-action"}`)},
+		{json.RawMessage(`{"action_id":"space2-action"}`)},
+		{json.RawMessage(`{"action_id":"unscoped-action"}`)},
+	})
+	assert.Equal(t, &HTTPError{Status: http.StatusForbidden}, err)
+	require.Len(t, res.Items, 3)
+	assert.Equal(t, http.StatusOK, res.Items[0].Status)
+	assert.Equal(t, http.StatusForbidden, res.Items[1].Status, "the action of another namespace is refused")
+	assert.Equal(t, http.StatusOK, res.Items[2].Status)
+
+	require.Len(t, results, 2)
+	assert.Equal(t, "space1-action", results[0].ActionID)
+	assert.Equal(t, []string{"space1"}, results[0].Namespaces)
+	assert.Equal(t, "unscoped-action", results[1].ActionID)
+}
+
 func TestInvalidateAPIKeys(t *testing.T) {
 	toRetire1 := []model.ToRetireAPIKeyIdsItems{{
 		ID: "toRetire1",
@@ -555,20 +614,25 @@ func TestInvalidateAPIKeys(t *testing.T) {
 
 		bulker := ftesting.NewMockBulk()
 		if len(want) > 0 {
-			bulker.On("APIKeyInvalidate",
-				context.Background(), mock.MatchedBy(func(ids []string) bool {
+			bulker.On("APIKeyInvalidateAsync",
+				mock.MatchedBy(func(ids []string) bool {
 					// if A contains B and B contains A => A = B
 					return assert.Subset(t, ids, want) &&
 						assert.Subset(t, want, ids)
-				})).
-				Return(nil)
+				}))
+		}
+
+		c := testcache.NewMockCache()
+		for _, id := range want {
+			c.On("DeleteAPIKey", id).Once()
 		}
 
 		logger := testlog.SetLogger(t)
-		ack := &AckT{bulk: bulker}
+		ack := &AckT{bulk: bulker, cache: c}
 		ack.invalidateAPIKeys(context.Background(), logger, out.ToRetireAPIKeyIds, skip)
 
 		bulker.AssertExpectations(t)
+		c.AssertExpectations(t)
 	}
 }
 
@@ -590,15 +654,13 @@ func TestInvalidateAPIKeysRemoteOutput(t *testing.T) {
 	bulker.On("GetBulker", "remote1").Return(remoteBulker)
 	bulker.On("GetBulker", "remote2").Return(remoteBulker2)
 
-	remoteBulker.On("APIKeyInvalidate",
-		context.Background(), []string{"toRetire1", "toRetire11"}).
-		Return(nil)
-	remoteBulker2.On("APIKeyInvalidate",
-		context.Background(), []string{"toRetire2"}).
-		Return(nil)
+	remoteBulker.On("APIKeyInvalidateAsync", []string{"toRetire1", "toRetire11"})
+	remoteBulker2.On("APIKeyInvalidateAsync", []string{"toRetire2"})
 
 	logger := testlog.SetLogger(t)
-	ack := &AckT{bulk: bulker}
+	c := testcache.NewMockCache()
+	c.On("DeleteAPIKey", mock.Anything)
+	ack := &AckT{bulk: bulker, cache: c}
 	ack.invalidateAPIKeys(context.Background(), logger, toRetire, "")
 
 	bulker.AssertExpectations(t)
@@ -613,9 +675,7 @@ func TestInvalidateAPIKeysRemoteOutputReadFromPolicies(t *testing.T) {
 	}}
 
 	remoteBulker := ftesting.NewMockBulk()
-	remoteBulker.On("APIKeyInvalidate",
-		context.Background(), []string{"toRetire1"}).
-		Return(nil)
+	remoteBulker.On("APIKeyInvalidateAsync", []string{"toRetire1"})
 
 	bulkerFn := func(t *testing.T) *ftesting.MockBulk {
 		m := ftesting.NewMockBulk()
@@ -633,7 +693,9 @@ func TestInvalidateAPIKeysRemoteOutputReadFromPolicies(t *testing.T) {
 	bulker := bulkerFn(t)
 
 	logger := testlog.SetLogger(t)
-	ack := &AckT{bulk: bulker}
+	c := testcache.NewMockCache()
+	c.On("DeleteAPIKey", mock.Anything)
+	ack := &AckT{bulk: bulker, cache: c}
 	ack.invalidateAPIKeys(context.Background(), logger, toRetire, "")
 
 	bulker.AssertExpectations(t)
@@ -661,7 +723,9 @@ func TestInvalidateAPIKeysRemoteOutputReadFromPoliciesNotFound(t *testing.T) {
 	bulker := bulkerFn(t)
 
 	logger := testlog.SetLogger(t)
-	ack := &AckT{bulk: bulker}
+	c := testcache.NewMockCache()
+	c.On("DeleteAPIKey", mock.Anything)
+	ack := &AckT{bulk: bulker, cache: c}
 	ack.invalidateAPIKeys(context.Background(), logger, toRetire, "")
 
 	bulker.AssertExpectations(t)
@@ -669,8 +733,22 @@ func TestInvalidateAPIKeysRemoteOutputReadFromPoliciesNotFound(t *testing.T) {
 }
 
 func TestAckHandleUpgrade(t *testing.T) {
+	upgradeStatus := func(t *testing.T, status string) interface{} {
+		return mock.MatchedBy(func(p []byte) bool {
+			var body struct {
+				Doc struct {
+					Status string `json:"upgrade_status"`
+				} `json:"doc"`
+			}
+			if err := json.Unmarshal(p, &body); err != nil {
+				t.Fatal(err)
+			}
+			return body.Doc.Status == status
+		})
+	}
 	tests := []struct {
 		name   string
+		action model.Action
 		event  UpgradeEvent
 		bulker func(t *testing.T) *ftesting.MockBulk
 	}{{
@@ -734,6 +812,32 @@ func TestAckHandleUpgrade(t *testing.T) {
 			}), mock.Anything).Return(nil).Once()
 			return m
 		},
+	}, {
+		name: "failed with a retry left",
+		action: model.Action{
+			ActionID: "upgrade-1",
+			Type:     TypeUpgrade,
+			Data:     json.RawMessage(`{"version":"8.1.0","retry_delay":["5m","30m"],"retry_count":1,"retry_of":"upgrade-0"}`),
+		},
+		event: UpgradeEvent{Error: ptr("upgrade error")},
+		bulker: func(t *testing.T) *ftesting.MockBulk {
+			m := ftesting.NewMockBulk()
+			m.On("Update", mock.Anything, mock.Anything, mock.Anything, upgradeStatus(t, "retry_scheduled"), mock.Anything).Return(nil).Once()
+			return m
+		},
+	}, {
+		name: "failed after the last retry",
+		action: model.Action{
+			ActionID: "upgrade-2",
+			Type:     TypeUpgrade,
+			Data:     json.RawMessage(`{"version":"8.1.0","retry_delay":["5m","30m"],"retry_count":2,"retry_of":"upgrade-0"}`),
+		},
+		event: UpgradeEvent{Error: ptr("upgrade error")},
+		bulker: func(t *testing.T) *ftesting.MockBulk {
+			m := ftesting.NewMockBulk()
+			m.On("Update", mock.Anything, mock.Anything, mock.Anything, upgradeStatus(t, "failed"), mock.Anything).Return(nil).Once()
+			return m
+		},
 	}}
 	cfg := &config.Server{
 		Limits: config.ServerLimits{},
@@ -753,13 +857,255 @@ func TestAckHandleUpgrade(t *testing.T) {
 			bulker := tc.bulker(t)
 			ack := NewAckT(cfg, bulker, cache)
 
-			err := ack.handleUpgrade(ctx, logger, agent, tc.event)
+			err := ack.handleUpgrade(ctx, logger, agent, tc.action, tc.event)
 			assert.NoError(t, err)
 			bulker.AssertExpectations(t)
 		})
 	}
 }
 
+func TestAckSameEventTwice(t *testing.T) {
+	const actionID = "ab12dcd8-bde0-4045-92dc-c4b27668d73a"
+	cfg := &config.Server{
+		Limits: config.ServerLimits{},
+	}
+	agent := &model.Agent{
+		ESDocument: model.ESDocument{Id: "ab12dcd8-bde0-4045-92dc-c4b27668d735"},
+		Agent:      &model.AgentMetadata{Version: "8.0.0"},
+	}
+	resultID := dl.ActionResultID(actionID, agent.Id)
+	ok := AckResponseItem{Status: http.StatusOK, Message: ptr(http.StatusText(http.StatusOK))}
+
+	// newBulker returns a bulker that holds the result documents by ID, creating an existing one is a version conflict.
+	newBulker := func(t *testing.T, actionType string) (*ftesting.MockBulk, map[string][]byte) {
+		docs := make(map[string][]byte)
+		m := ftesting.NewMockBulk()
+		m.On("Search", mock.Anything, mock.Anything, mock.MatchedBy(matchAction(t, actionID)), mock.Anything).Return(&es.ResultT{HitsT: es.HitsT{
+			Hits: []es.HitT{{
+				Source: []byte(`{"action_id":"` + actionID + `","type":"` + actionType + `"}`),
+			}},
+		}}, nil)
+		m.On("Create", mock.Anything, dl.FleetActionsResults, mock.Anything, mock.Anything, mock.Anything).Return("", nil).Once().Run(func(args mock.Arguments) {
+			docs[args.String(2)] = args.Get(3).([]byte)
+		})
+		m.On("Create", mock.Anything, dl.FleetActionsResults, mock.Anything, mock.Anything, mock.Anything).Return("", es.ErrElasticVersionConflict).Run(func(args mock.Arguments) {
+			require.Contains(t, docs, args.String(2), "a retried ack must target the existing result document")
+		})
+		m.On("Update", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+		return m, docs
+	}
+	ack := func(t *testing.T, bulker *ftesting.MockBulk, event string) {
+		c, err := cache.New(config.Cache{NumCounters: 100, MaxCost: 100000})
+		require.NoError(t, err)
+		res, err := NewAckT(cfg, bulker, c).handleAckEvents(context.Background(), testlog.SetLogger(t), agent, []AckRequest_Events_Item{{json.RawMessage(event)}})
+		require.NoError(t, err)
+		assert.Equal(t, []AckResponseItem{ok}, res.Items)
+	}
+
+	t.Run("action result", func(t *testing.T) {
+		bulker, docs := newBulker(t, "INPUT_ACTION")
+		event := `{"action_id":"` + actionID + `","agent_id":"` + agent.Id + `"}`
+		ack(t, bulker, event)
+		ack(t, bulker, event)
+
+		assert.Len(t, docs, 1)
+		assert.Contains(t, docs, resultID)
+		bulker.AssertNumberOfCalls(t, "Create", 2)
+		bulker.AssertNotCalled(t, "Update", mock.Anything, dl.FleetActionsResults, mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("upgrade error updates the result", func(t *testing.T) {
+		bulker, docs := newBulker(t, TypeUpgrade)
+		ack(t, bulker, `{"action_id":"`+actionID+`","agent_id":"`+agent.Id+`"}`)
+		ack(t, bulker, `{"action_id":"`+actionID+`","agent_id":"`+agent.Id+`","error":"upgrade failed"}`)
+
+		assert.Len(t, docs, 1)
+		bulker.AssertCalled(t, "Update", mock.Anything, dl.FleetActionsResults, resultID, mock.MatchedBy(func(p []byte) bool {
+			var body struct {
+				Doc struct {
+					Error string `json:"error"`
+				} `json:"doc"`
+			}
+			return json.Unmarshal(p, &body) == nil && body.Doc.Error == "upgrade failed"
+		}), mock.Anything)
+	})
+}
+
+func TestAckActionResponse(t *testing.T) {
+	const (
+		actionID = "ab12dcd8-bde0-4045-92dc-c4b27668d73a"
+		maxSize  = 32
+	)
+	cfg := &config.Server{ActionResults: config.ActionResults{MaxResponseSize: maxSize}}
+	agent := &model.Agent{
+		ESDocument: model.ESDocument{Id: "ab12dcd8-bde0-4045-92dc-c4b27668d735"},
+		Agent:      &model.AgentMetadata{Version: "8.0.0"},
+	}
+	// payload returns an action_response of size bytes.
+	payload := func(size int) string {
+		return `{"output":"` + strings.Repeat("a", size-13) + `"}`
+	}
+
+	tests := []struct {
+		name      string
+		response  string
+		stored    string
+		truncated bool
+	}{{
+		name:     "max size",
+		response: payload(maxSize),
+		stored:   payload(maxSize),
+	}, {
+		name:      "over max size",
+		response:  payload(maxSize + 1),
+		stored:    `{"truncated":` + strconv.Quote(payload(maxSize + 1)[:maxSize]) + `,"size":33}`,
+		truncated: true,
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var doc []byte
+			bulker := ftesting.NewMockBulk()
+			bulker.On("Search", mock.Anything, dl.FleetActions, mock.MatchedBy(matchAction(t, actionID)), mock.Anything).Return(&es.ResultT{HitsT: es.HitsT{
+				Hits: []es.HitT{{
+					Source: []byte(`{"action_id":"` + actionID + `","type":"SETTINGS"}`),
+				}},
+			}}, nil).Once()
+			bulker.On("Create", mock.Anything, dl.FleetActionsResults, dl.ActionResultID(actionID, agent.Id), mock.Anything, mock.Anything).Return("", nil).Once().Run(func(args mock.Arguments) {
+				doc = args.Get(3).([]byte) //nolint:errcheck // test
+			})
+			c, err := cache.New(config.Cache{NumCounters: 100, MaxCost: 100000})
+			require.NoError(t, err)
+
+			event := `{"action_id":"` + actionID + `","agent_id":"` + agent.Id + `","action_response":` + tc.response + `}`
+			_, err = NewAckT(cfg, bulker, c).handleAckEvents(context.Background(), testlog.SetLogger(t), agent, []AckRequest_Events_Item{{json.RawMessage(event)}})
+			require.NoError(t, err)
+			require.NotNil(t, doc)
+
+			var acr model.ActionResult
+			require.NoError(t, json.Unmarshal(doc, &acr))
+			assert.JSONEq(t, tc.stored, string(acr.ActionResponse))
+			assert.Equal(t, tc.truncated, acr.ActionResponseTruncated)
+
+			// The stored result is returned by the action result endpoint.
+			bulker.On("Search", mock.Anything, dl.FleetActionsResults, mock.Anything, mock.Anything).Return(&es.ResultT{HitsT: es.HitsT{
+				Hits: []es.HitT{{Source: doc}},
+			}}, nil).Once()
+			art := NewActionResultT(cfg, bulker)
+			art.authServiceToken = func(*http.Request, bulk.Bulk) (*apikey.SecurityInfo, error) {
+				return &apikey.SecurityInfo{UserName: fleetServerServiceAccount}, nil
+			}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/api/fleet/agents/"+agent.Id+"/actions/"+actionID+"/result", nil)
+			require.NoError(t, art.handleActionResult(testlog.SetLogger(t), w, r, agent.Id, actionID))
+			bulker.AssertExpectations(t)
+
+			var resp ActionResultResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.JSONEq(t, tc.stored, string(resp.ActionResponse))
+			assert.Equal(t, tc.truncated, resp.Truncated)
+		})
+	}
+}
+
+func TestTruncateActionResponse(t *testing.T) {
+	raw := json.RawMessage(`{"msg":"héllo"}`) // é is 2 bytes
+
+	p, truncated := truncateActionResponse(raw, len(raw))
+	assert.False(t, truncated)
+	assert.Equal(t, raw, p)
+
+	p, truncated = truncateActionResponse(raw, 0)
+	assert.False(t, truncated)
+	assert.Equal(t, raw, p)
+
+	// The payload is not cut in the middle of a rune.
+	p, truncated = truncateActionResponse(raw, 10)
+	assert.True(t, truncated)
+	assert.JSONEq(t, `{"truncated":"{\"msg\":\"h","size":16}`, string(p))
+	p, truncated = truncateActionResponse(raw, 11)
+	assert.True(t, truncated)
+	assert.JSONEq(t, `{"truncated":"{\"msg\":\"hé","size":16}`, string(p))
+}
+
+func TestProcessRequestPartialAcks(t *testing.T) {
+	const (
+		policyAck     = `{"action_id":"policy:2b12dcd8-bde0-4045-92dc-c4b27668d733"}`
+		missingAction = `{"action_id":"2b12dcd8-bde0-4045-92dc-c4b27668d733"}`
+	)
+	agent := &model.Agent{
+		ESDocument: model.ESDocument{Id: "ab12dcd8-bde0-4045-92dc-c4b27668d735"},
+		Agent:      &model.AgentMetadata{Version: "8.0.0"},
+	}
+
+	tests := []struct {
+		name     string
+		events   []string
+		accept   string
+		status   int
+		statuses []int
+	}{{
+		name:     "mixed results",
+		events:   []string{policyAck, missingAction},
+		status:   http.StatusNotFound,
+		statuses: []int{http.StatusOK, http.StatusNotFound},
+	}, {
+		name:     "mixed results with partial acks",
+		events:   []string{policyAck, missingAction},
+		accept:   "application/json; level=2",
+		status:   http.StatusOK,
+		statuses: []int{http.StatusOK, http.StatusNotFound},
+	}, {
+		name:     "mixed results with an older level",
+		events:   []string{policyAck, missingAction},
+		accept:   "application/json; level=1",
+		status:   http.StatusNotFound,
+		statuses: []int{http.StatusOK, http.StatusNotFound},
+	}, {
+		name:     "full failure",
+		events:   []string{missingAction, missingAction},
+		status:   http.StatusNotFound,
+		statuses: []int{http.StatusNotFound, http.StatusNotFound},
+	}, {
+		name:     "full failure with partial acks",
+		events:   []string{missingAction, missingAction},
+		accept:   "text/plain, application/json;level=2",
+		status:   http.StatusNotFound,
+		statuses: []int{http.StatusNotFound, http.StatusNotFound},
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			logger := testlog.SetLogger(t)
+			bulker := ftesting.NewMockBulk()
+			bulker.On("Search", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(&es.ResultT{}, nil)
+			c, err := cache.New(config.Cache{NumCounters: 100, MaxCost: 100000})
+			require.NoError(t, err)
+			ack := NewAckT(&config.Server{}, bulker, c)
+
+			body := `{"events":[` + strings.Join(tc.events, ",") + `]}`
+			req := httptest.NewRequest(http.MethodPost, "/api/fleet/agents/"+agent.Id+"/acks", strings.NewReader(body))
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			wr := httptest.NewRecorder()
+
+			err = ack.processRequest(logger, wr, req, agent)
+			require.NoError(t, err)
+			resp := wr.Result()
+			defer resp.Body.Close()
+			assert.Equal(t, tc.status, resp.StatusCode)
+
+			var ackResp AckResponse
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&ackResp))
+			assert.True(t, ackResp.Errors)
+			statuses := make([]int, 0, len(ackResp.Items))
+			for _, item := range ackResp.Items {
+				statuses = append(statuses, item.Status)
+			}
+			assert.Equal(t, tc.statuses, statuses)
+		})
+	}
+}
+
 func TestValidateAckRequest(t *testing.T) {
 	tests := []struct {
 		name   string
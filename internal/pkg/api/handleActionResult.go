@@ -0,0 +1,74 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/rs/zerolog"
+	"go.elastic.co/apm/v2"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/apikey"
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
+)
+
+// ActionResultT returns the result of an action for an agent on requests authenticated with a fleet-server service token.
+type ActionResultT struct {
+	cfg    *config.Server
+	bulker bulk.Bulk
+
+	authServiceToken func(*http.Request, bulk.Bulk) (*apikey.SecurityInfo, error)
+}
+
+func NewActionResultT(cfg *config.Server, bulker bulk.Bulk) *ActionResultT {
+	return &ActionResultT{
+		cfg:              cfg,
+		bulker:           bulker,
+		authServiceToken: authServiceToken,
+	}
+}
+
+func (art *ActionResultT) handleActionResult(zlog zerolog.Logger, w http.ResponseWriter, r *http.Request, agentID, actionID string) error {
+	info, err := art.authServiceToken(r, art.bulker)
+	if err != nil {
+		return err
+	}
+	zlog = zlog.With().Str("userName", info.UserName).Str(logger.ActionID, actionID).Logger()
+	ctx := zlog.WithContext(r.Context())
+
+	acr, err := dl.FindActionResult(ctx, art.bulker, actionID, agentID)
+	if err != nil {
+		return fmt.Errorf("find action result: %w", err)
+	}
+
+	span, _ := apm.StartSpan(ctx, "response", "write")
+	defer span.End()
+	resp := ActionResultResponse{
+		ActionId:       acr.ActionID,
+		ActionResponse: acr.ActionResponse,
+		AgentId:        acr.AgentID,
+		Timestamp:      acr.Timestamp,
+		Truncated:      acr.ActionResponseTruncated,
+	}
+	if acr.Error != "" {
+		resp.Error = &acr.Error
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("marshal actionResultResponse: %w", err)
+	}
+	nWritten, err := w.Write(data)
+	cntActionResult.bodyOut.Add(uint64(nWritten))
+	if err != nil {
+		return fmt.Errorf("fail send action result response: %w", err)
+	}
+	zlog.Debug().Bool("truncated", acr.ActionResponseTruncated).Msg("Action result sent")
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/apikey"
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+func TestHandleActionResult(t *testing.T) {
+	fleetServer := func(*http.Request, bulk.Bulk) (*apikey.SecurityInfo, error) {
+		return &apikey.SecurityInfo{UserName: fleetServerServiceAccount}, nil
+	}
+	resultHits := func(sources ...string) *es.ResultT {
+		res := &es.ResultT{}
+		for _, src := range sources {
+			res.Hits = append(res.Hits, es.HitT{ID: "action-1:agent-1", Source: json.RawMessage(src)})
+		}
+		return res
+	}
+	errMsg := "failed"
+
+	tests := []struct {
+		name   string
+		auth   func(*http.Request, bulk.Bulk) (*apikey.SecurityInfo, error)
+		setup  func(*ftesting.MockBulk)
+		err    error
+		status int
+		resp   ActionResultResponse
+	}{{
+		name: "not authenticated",
+		auth: func(*http.Request, bulk.Bulk) (*apikey.SecurityInfo, error) {
+			return nil, apikey.ErrNoAuthHeader
+		},
+		err:    apikey.ErrNoAuthHeader,
+		status: http.StatusUnauthorized,
+	}, {
+		name: "not acked",
+		setup: func(m *ftesting.MockBulk) {
+			m.On("Search", mock.Anything, dl.FleetActionsResults, mock.Anything, mock.Anything).Return(resultHits(), nil).Once()
+		},
+		err:    dl.ErrNotFound,
+		status: http.StatusNotFound,
+	}, {
+		name: "no results index",
+		setup: func(m *ftesting.MockBulk) {
+			m.On("Search", mock.Anything, dl.FleetActionsResults, mock.Anything, mock.Anything).Return((*es.ResultT)(nil), es.ErrIndexNotFound).Once()
+		},
+		err:    dl.ErrNotFound,
+		status: http.StatusNotFound,
+	}, {
+		name: "result",
+		setup: func(m *ftesting.MockBulk) {
+			m.On("Search", mock.Anything, dl.FleetActionsResults, mock.Anything, mock.Anything).Return(resultHits(
+				`{"action_id":"action-1","agent_id":"agent-1","@timestamp":"2024-07-01T12:00:00Z","action_response":{"output":["a","b"],"code":0}}`,
+			), nil).Once()
+		},
+		resp: ActionResultResponse{
+			ActionId:       "action-1",
+			AgentId:        "agent-1",
+			ActionResponse: json.RawMessage(`{"output":["a","b"],"code":0}`),
+			Timestamp:      "2024-07-01T12:00:00Z",
+		},
+	}, {
+		name: "truncated result with error",
+		setup: func(m *ftesting.MockBulk) {
+			m.On("Search", mock.Anything, dl.FleetActionsResults, mock.Anything, mock.Anything).Return(resultHits(
+				`{"action_id":"action-1","agent_id":"agent-1","@timestamp":"2024-07-01T12:00:00Z","error":"failed","action_response":{"truncated":"{\"out","size":100},"action_response_truncated":true}`,
+			), nil).Once()
+		},
+		resp: ActionResultResponse{
+			ActionId:       "action-1",
+			AgentId:        "agent-1",
+			ActionResponse: json.RawMessage(`{"truncated":"{\"out","size":100}`),
+			Error:          &errMsg,
+			Timestamp:      "2024-07-01T12:00:00Z",
+			Truncated:      true,
+		},
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := testlog.SetLogger(t).WithContext(context.Background())
+			bulker := ftesting.NewMockBulk()
+			if tc.setup != nil {
+				tc.setup(bulker)
+			}
+			art := NewActionResultT(&config.Server{}, bulker)
+			art.authServiceToken = fleetServer
+			if tc.auth != nil {
+				art.authServiceToken = tc.auth
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/api/fleet/agents/agent-1/actions/action-1/result", nil).WithContext(ctx)
+			w := httptest.NewRecorder()
+			err := art.handleActionResult(testlog.SetLogger(t), w, r, "agent-1", "action-1")
+			bulker.AssertExpectations(t)
+
+			if tc.status != 0 {
+				require.Error(t, err)
+				assert.ErrorIs(t, err, tc.err)
+				assert.Equal(t, tc.status, NewHTTPErrResp(err).StatusCode)
+				return
+			}
+			require.NoError(t, err)
+
+			var resp ActionResultResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.JSONEq(t, string(tc.resp.ActionResponse), string(resp.ActionResponse))
+			resp.ActionResponse, tc.resp.ActionResponse = nil, nil
+			assert.Equal(t, tc.resp, resp)
+		})
+	}
+}
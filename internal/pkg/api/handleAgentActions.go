@@ -0,0 +1,201 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/miolini/datacounter"
+	"github.com/rs/zerolog"
+	"go.elastic.co/apm/v2"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/apikey"
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	"github.com/elastic/fleet-server/v7/internal/pkg/monitor"
+)
+
+// AgentActionsT adds actions for agents on requests authenticated with a fleet-server service token.
+type AgentActionsT struct {
+	cfg    *config.Server
+	bulker bulk.Bulk
+
+	authServiceToken func(*http.Request, bulk.Bulk) (*apikey.SecurityInfo, error)
+	now              func() time.Time
+
+	am         monitor.SimpleMonitor
+	nudgeTypes []string
+}
+
+type AgentActionsOpt func(*AgentActionsT)
+
+// WithActionMonitorNudge nudges the action monitor when an action of one of the types is added, so that it is
+// dispatched without waiting for the monitor to see it. All the types nudge the monitor when types is empty.
+func WithActionMonitorNudge(am monitor.SimpleMonitor, types []string) AgentActionsOpt {
+	return func(aat *AgentActionsT) {
+		aat.am = am
+		aat.nudgeTypes = types
+	}
+}
+
+func NewAgentActionsT(cfg *config.Server, bulker bulk.Bulk, opts ...AgentActionsOpt) *AgentActionsT {
+	aat := &AgentActionsT{
+		cfg:              cfg,
+		bulker:           bulker,
+		authServiceToken: authServiceToken,
+		now:              time.Now,
+	}
+	for _, opt := range opts {
+		opt(aat)
+	}
+	return aat
+}
+
+func (aat *AgentActionsT) handleAgentActions(zlog zerolog.Logger, w http.ResponseWriter, r *http.Request, id string) error {
+	start := time.Now()
+	info, err := aat.authServiceToken(r, aat.bulker)
+	if err != nil {
+		return err
+	}
+	zlog = zlog.With().Str("userName", info.UserName).Logger()
+	ctx := zlog.WithContext(r.Context())
+	r = r.WithContext(ctx)
+
+	req, err := aat.validateRequest(zlog, w, r)
+	if err != nil {
+		return err
+	}
+
+	agents := actionAgents(id, req.Agents)
+	found, err := dl.FindAgentIDs(ctx, aat.bulker, agents)
+	if err != nil {
+		return fmt.Errorf("find agents: %w", err)
+	}
+	var unknown []string
+	for _, agentID := range agents {
+		if _, ok := found[agentID]; !ok {
+			unknown = append(unknown, agentID)
+		}
+	}
+	if len(unknown) > 0 {
+		return &BadRequestErr{msg: fmt.Sprintf("unknown agent ids: %s", strings.Join(unknown, ", "))}
+	}
+
+	u, err := uuid.NewV4()
+	if err != nil {
+		return err
+	}
+	now := aat.now().UTC()
+	action := model.Action{
+		ActionID:  u.String(),
+		Agents:    agents,
+		Type:      req.Type,
+		Timestamp: now.Format(time.RFC3339Nano),
+	}
+	if req.Data != nil {
+		action.Data = *req.Data
+	}
+	// The pending actions are looked up by their expiration, an action without one would never be dispatched.
+	expiration := now.Add(aat.cfg.AgentActions.DefaultExpiration)
+	if req.Expiration != nil {
+		expiration = req.Expiration.UTC()
+	}
+	action.Expiration = expiration.Format(time.RFC3339)
+	if req.InputType != nil {
+		action.InputType = *req.InputType
+	}
+	if err := dl.CreateAction(ctx, aat.bulker, action); err != nil {
+		return fmt.Errorf("create action: %w", err)
+	}
+	if aat.am != nil && (len(aat.nudgeTypes) == 0 || slices.Contains(aat.nudgeTypes, action.Type)) {
+		aat.am.Nudge()
+	}
+
+	span, _ := apm.StartSpan(ctx, "response", "write")
+	defer span.End()
+	data, err := json.Marshal(ActionResponse{
+		ActionId: action.ActionID,
+		Agents:   agents,
+	})
+	if err != nil {
+		return fmt.Errorf("marshal actionResponse: %w", err)
+	}
+	nWritten, err := w.Write(data)
+	cntAgentActions.bodyOut.Add(uint64(nWritten))
+	if err != nil {
+		return fmt.Errorf("fail send action response: %w", err)
+	}
+
+	zlog.Info().
+		Str(logger.ActionID, action.ActionID).
+		Str(logger.ActionType, action.Type).
+		Int("nAgents", len(agents)).
+		Int64(ECSEventDuration, time.Since(start).Nanoseconds()).
+		Msg("Action added")
+	return nil
+}
+
+func (aat *AgentActionsT) validateRequest(zlog zerolog.Logger, w http.ResponseWriter, r *http.Request) (*ActionRequest, error) {
+	span, _ := apm.StartSpan(r.Context(), "validateRequest", "validate")
+	defer span.End()
+
+	body := r.Body
+	if aat.cfg.Limits.AgentActions.MaxBody > 0 {
+		body = http.MaxBytesReader(w, body, aat.cfg.Limits.AgentActions.MaxBody)
+	}
+	readCounter := datacounter.NewReaderCounter(body)
+
+	var req ActionRequest
+	dec := json.NewDecoder(readCounter)
+	if err := dec.Decode(&req); err != nil {
+		return nil, &BadRequestErr{msg: "unable to decode action request", nextErr: err}
+	}
+	cntAgentActions.bodyIn.Add(readCounter.Count())
+
+	if !validActionTypes[req.Type] {
+		return nil, &BadRequestErr{msg: fmt.Sprintf("unknown action type %q", req.Type)}
+	}
+	if req.Data != nil {
+		if data := bytes.TrimSpace(*req.Data); len(data) == 0 || data[0] != '{' {
+			return nil, &BadRequestErr{msg: "action data must be an object"}
+		}
+	}
+	if req.Expiration != nil && !req.Expiration.After(aat.now()) {
+		return nil, &BadRequestErr{msg: fmt.Sprintf("action expiration %s is in the past", req.Expiration.Format(time.RFC3339))}
+	}
+	if req.Agents != nil && slices.Contains(*req.Agents, "") {
+		return nil, &BadRequestErr{msg: "agent ids must not be empty"}
+	}
+
+	zlog.Trace().Str(logger.ActionType, req.Type).Msg("Action request")
+	return &req, nil
+}
+
+// actionAgents returns the agent in the path followed by the additional agents, without duplicates.
+func actionAgents(id string, additional *[]string) []string {
+	agents := []string{id}
+	if additional == nil {
+		return agents
+	}
+	seen := map[string]struct{}{id: {}}
+	for _, agentID := range *additional {
+		if _, ok := seen[agentID]; ok {
+			continue
+		}
+		seen[agentID] = struct{}{}
+		agents = append(agents, agentID)
+	}
+	return agents
+}
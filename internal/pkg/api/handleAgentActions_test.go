@@ -0,0 +1,177 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/apikey"
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	mmock "github.com/elastic/fleet-server/v7/internal/pkg/monitor/mock"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+func TestHandleAgentActions(t *testing.T) {
+	now := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	fleetServer := func(*http.Request, bulk.Bulk) (*apikey.SecurityInfo, error) {
+		return &apikey.SecurityInfo{UserName: fleetServerServiceAccount}, nil
+	}
+	agentHits := func(ids ...string) *es.ResultT {
+		res := &es.ResultT{}
+		for _, id := range ids {
+			res.Hits = append(res.Hits, es.HitT{ID: id})
+		}
+		return res
+	}
+
+	tests := []struct {
+		name   string
+		auth   func(*http.Request, bulk.Bulk) (*apikey.SecurityInfo, error)
+		body   string
+		setup  func(*ftesting.MockBulk)
+		err    error
+		status int
+		msg    string
+		agents []string
+		nudge  bool
+	}{{
+		name: "not authenticated",
+		auth: func(*http.Request, bulk.Bulk) (*apikey.SecurityInfo, error) {
+			return nil, apikey.ErrNoAuthHeader
+		},
+		body:   `{"type":"SETTINGS"}`,
+		err:    apikey.ErrNoAuthHeader,
+		status: http.StatusUnauthorized,
+	}, {
+		name:   "invalid json",
+		body:   `{"type":`,
+		status: http.StatusBadRequest,
+		msg:    "unable to decode action request",
+	}, {
+		name:   "unknown action type",
+		body:   `{"type":"POLICY_CHANGE"}`,
+		status: http.StatusBadRequest,
+		msg:    `unknown action type "POLICY_CHANGE"`,
+	}, {
+		name:   "data not an object",
+		body:   `{"type":"SETTINGS","data":"debug"}`,
+		status: http.StatusBadRequest,
+		msg:    "action data must be an object",
+	}, {
+		name:   "expired",
+		body:   `{"type":"SETTINGS","expiration":"2024-07-01T11:00:00Z"}`,
+		status: http.StatusBadRequest,
+		msg:    "action expiration 2024-07-01T11:00:00Z is in the past",
+	}, {
+		name:   "empty agent id",
+		body:   `{"type":"SETTINGS","agents":[""]}`,
+		status: http.StatusBadRequest,
+		msg:    "agent ids must not be empty",
+	}, {
+		name: "unknown agents",
+		body: `{"type":"SETTINGS","agents":["agent-2","agent-3","agent-4"]}`,
+		setup: func(m *ftesting.MockBulk) {
+			m.On("Search", mock.Anything, dl.FleetAgents, mock.Anything, mock.Anything).Return(agentHits("agent-1", "agent-3"), nil).Once()
+		},
+		status: http.StatusBadRequest,
+		msg:    "unknown agent ids: agent-2, agent-4",
+	}, {
+		name: "action added",
+		body: `{"type":"SETTINGS","agents":["agent-2","agent-1"],"data":{"log_level":"debug"},"expiration":"2024-07-02T12:00:00Z"}`,
+		setup: func(m *ftesting.MockBulk) {
+			m.On("Search", mock.Anything, dl.FleetAgents, mock.Anything, mock.Anything).Return(agentHits("agent-1", "agent-2"), nil).Once()
+			m.On("Create", mock.Anything, dl.FleetActions, mock.Anything, mock.MatchedBy(func(body []byte) bool {
+				var action model.Action
+				if err := json.Unmarshal(body, &action); err != nil {
+					return false
+				}
+				return action.Type == "SETTINGS" &&
+					assert.ObjectsAreEqual([]string{"agent-1", "agent-2"}, action.Agents) &&
+					string(action.Data) == `{"log_level":"debug"}` &&
+					action.Expiration == "2024-07-02T12:00:00Z" &&
+					action.Timestamp == now.Format(time.RFC3339Nano)
+			}), mock.Anything).Return("", nil).Once()
+		},
+		agents: []string{"agent-1", "agent-2"},
+		nudge:  true,
+	}, {
+		name: "action added without nudge",
+		body: `{"type":"UNENROLL"}`,
+		setup: func(m *ftesting.MockBulk) {
+			m.On("Search", mock.Anything, dl.FleetAgents, mock.Anything, mock.Anything).Return(agentHits("agent-1"), nil).Once()
+			// The action without an expiration expires after the default expiration.
+			m.On("Create", mock.Anything, dl.FleetActions, mock.Anything, mock.MatchedBy(func(body []byte) bool {
+				var action model.Action
+				if err := json.Unmarshal(body, &action); err != nil {
+					return false
+				}
+				return action.Type == "UNENROLL" && action.Expiration == "2024-07-01T18:00:00Z"
+			}), mock.Anything).Return("", nil).Once()
+		},
+		agents: []string{"agent-1"},
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := testlog.SetLogger(t).WithContext(context.Background())
+			bulker := ftesting.NewMockBulk()
+			if tc.setup != nil {
+				tc.setup(bulker)
+			}
+			am := mmock.NewMockMonitor()
+			if tc.nudge {
+				am.On("Nudge").Once()
+			}
+			cfg := &config.Server{AgentActions: config.AgentActions{DefaultExpiration: 6 * time.Hour}}
+			aat := NewAgentActionsT(cfg, bulker, WithActionMonitorNudge(am, []string{"SETTINGS"}))
+			aat.authServiceToken = fleetServer
+			if tc.auth != nil {
+				aat.authServiceToken = tc.auth
+			}
+			aat.now = func() time.Time { return now }
+
+			r := httptest.NewRequest(http.MethodPost, "/api/fleet/agents/agent-1/actions", strings.NewReader(tc.body)).WithContext(ctx)
+			w := httptest.NewRecorder()
+			err := aat.handleAgentActions(testlog.SetLogger(t), w, r, "agent-1")
+			bulker.AssertExpectations(t)
+			am.AssertExpectations(t)
+
+			if tc.status != 0 {
+				require.Error(t, err)
+				if tc.err != nil {
+					assert.ErrorIs(t, err, tc.err)
+				}
+				resp := NewHTTPErrResp(err)
+				assert.Equal(t, tc.status, resp.StatusCode)
+				assert.Contains(t, resp.Message, tc.msg)
+				return
+			}
+			require.NoError(t, err)
+
+			var resp ActionResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.NotEmpty(t, resp.ActionId)
+			assert.Equal(t, tc.agents, resp.Agents)
+			bulker.AssertCalled(t, "Create", mock.Anything, dl.FleetActions, resp.ActionId, mock.Anything, mock.Anything)
+		})
+	}
+}
@@ -6,6 +6,8 @@ package api
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/zlib"
 	"context"
 	"crypto/sha256"
 	"encoding/base64"
@@ -13,8 +15,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
@@ -26,7 +32,9 @@ import (
 	"github.com/elastic/fleet-server/v7/internal/pkg/throttle"
 	"go.elastic.co/apm/v2"
 
+	"github.com/miolini/datacounter"
 	"github.com/rs/zerolog"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
@@ -34,32 +42,76 @@ const (
 	defaultThrottleTTL = time.Minute // TODO: configurable
 )
 
+// artifactIdentRe is the naming pattern of the artifacts: lowercase alphanumeric words separated by a dash or an
+// underscore, such as endpoint-exceptionlist-windows-v1.
+var artifactIdentRe = regexp.MustCompile(`^[a-z0-9]+(?:[-_][a-z0-9]+)*$`)
+
+const maxArtifactIdentLen = 128
+
 var (
 	ErrorThrottle     = errors.New("cannot acquire throttle token")
 	ErrorBadSha2      = errors.New("malformed sha256")
+	ErrorBadArtifact  = errors.New("malformed artifact identifier")
 	ErrorRecord       = errors.New("artifact record mismatch")
 	ErrorMismatchSha2 = errors.New("mismatched sha256")
+	ErrorArtifactSize = errors.New("artifact exceeds the max size")
 )
 
 type ArtifactT struct {
-	bulker     bulk.Bulk
-	cache      cache.Cache
-	esThrottle *throttle.Throttle
+	bulker            bulk.Bulk
+	cache             cache.Cache
+	esThrottle        *throttle.Throttle
+	compressionLevel  int
+	compressionThresh int
+	encPool           *encoderPool
+	fetchGroup        *singleflight.Group
+	upstream          *artifactUpstream                                                          // nil unless the artifact upstream is enabled
+	authAgent         func(*http.Request, *string, bulk.Bulk, cache.Cache) (*model.Agent, error) // injectable for testing purposes
+}
+
+// artifactUpstream fetches the artifacts that are not found in Elastic from the configured artifact service.
+type artifactUpstream struct {
+	client  *http.Client
+	baseURL string
+	maxSize int64
 }
 
 func NewArtifactT(cfg *config.Server, bulker bulk.Bulk, cache cache.Cache) *ArtifactT {
-	return &ArtifactT{
-		bulker:     bulker,
-		cache:      cache,
-		esThrottle: throttle.NewThrottle(defaultMaxParallel),
+	at := &ArtifactT{
+		bulker:            bulker,
+		cache:             cache,
+		esThrottle:        throttle.NewThrottle(defaultMaxParallel),
+		compressionLevel:  cfg.CompressionLevel,
+		compressionThresh: cfg.CompressionThresh,
+		encPool:           newEncoderPool(cfg.CompressionLevel),
+		fetchGroup:        &singleflight.Group{},
+		authAgent:         authAgent,
 	}
+	if cfg.ArtifactUpstream.Enabled {
+		client, err := cfg.ArtifactUpstream.Client()
+		if err != nil {
+			zerolog.Ctx(context.TODO()).Error().Err(err).Msg("Unable to create the artifact upstream client, artifacts are only fetched from Elastic")
+			return at
+		}
+		at.upstream = &artifactUpstream{
+			client:  client,
+			baseURL: cfg.ArtifactUpstream.BaseURL,
+			maxSize: cfg.ArtifactUpstream.MaxSize,
+		}
+	}
+	return at
 }
 
 func (at ArtifactT) handleArtifacts(zlog zerolog.Logger, w http.ResponseWriter, r *http.Request, id, sha2 string) error {
+	// The path is validated before the cache or Elastic are looked up with it.
+	if err := at.validateRequest(r.Context(), id, sha2); err != nil {
+		return err
+	}
+
 	// Authenticate the APIKey; retrieve agent record.
 	// Note: This is going to be a bit slow even if we hit the cache on the api key.
 	// In order to validate that the agent still has that api key, we fetch the agent record from elastic.
-	agent, err := authAgent(r, nil, at.bulker, at.cache)
+	agent, err := at.authAgent(r, nil, at.bulker, at.cache)
 	if err != nil {
 		return err
 	}
@@ -68,73 +120,124 @@ func (at ArtifactT) handleArtifacts(zlog zerolog.Logger, w http.ResponseWriter,
 	ctx := zlog.WithContext(r.Context())
 	r = r.WithContext(ctx)
 
-	if err := at.validateRequest(r.Context(), sha2); err != nil {
-		return err
-	}
-
-	rdr, err := at.processRequest(r.Context(), zlog, agent, id, sha2)
+	artifact, err := at.processRequest(r.Context(), zlog, agent, id, sha2)
 	if err != nil {
 		return err
 	}
+	defer artifact.Release()
 	span, ctx := apm.StartSpan(r.Context(), "response", "write")
 	defer span.End()
-	n, err := io.Copy(w, rdr)
+	r = r.WithContext(ctx)
+
+	n, err := at.writeArtifact(w, r, artifact)
 	if err != nil {
 		return err
 	}
+
 	ts, ok := logger.CtxStartTime(ctx)
-	e := zlog.Trace().Int64(ECSHTTPResponseBodyBytes, n)
+	e := zlog.Trace().Uint64(ECSHTTPResponseBodyBytes, n).Str("range", r.Header.Get("Range"))
 	if ok {
 		e = e.Int64(ECSEventDuration, time.Since(ts).Nanoseconds())
 	}
 	e.Msg("artifact response sent")
-	cntArtifacts.bodyOut.Add(uint64(n))
+	cntArtifacts.bodyOut.Add(n)
 	return nil
 }
 
-func (at ArtifactT) validateRequest(ctx context.Context, sha2 string) error {
+// writeArtifact writes the artifact body and returns the number of bytes sent.
+// Full responses are compressed if the agent accepts it, range requests are always served from the uncompressed body.
+// The body is streamed from memory or from the file it was spilled to.
+func (at ArtifactT) writeArtifact(w http.ResponseWriter, r *http.Request, artifact cache.Artifact) (uint64, error) {
+	body, err := artifact.Open()
+	if err != nil {
+		return 0, fmt.Errorf("writeArtifact open: %w", err)
+	}
+	defer body.Close()
+
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	var encoding string
+	if r.Header.Get("Range") == "" && artifact.Size() > int64(at.compressionThresh) && at.compressionLevel != flate.NoCompression {
+		encoding = negotiateEncoding(r)
+	}
+
+	if encoding == "" {
+		// The ETag lets agents resume a download with If-Range, a changed artifact is sent in full.
+		// http.ServeContent handles the Range, If-Range and conditional request headers.
+		w.Header().Set("ETag", artifactETag(&artifact.Artifact, ""))
+		rc := logger.NewResponseCounter(w)
+		http.ServeContent(rc, r, "", time.Time{}, body)
+		return rc.Count(), nil
+	}
+
+	// The length of the compressed body is not known upfront so Content-Length is not set.
+	w.Header().Set("ETag", artifactETag(&artifact.Artifact, encoding))
+	w.Header().Set("Content-Encoding", encoding)
+	wrCounter := datacounter.NewWriterCounter(w)
+	zipper := at.encPool.get(encoding, wrCounter)
+	defer at.encPool.put(encoding, zipper)
+
+	if _, err := io.Copy(zipper, body); err != nil {
+		return wrCounter.Count(), fmt.Errorf("writeArtifact %s write: %w", encoding, err)
+	}
+	if err := zipper.Close(); err != nil {
+		return wrCounter.Count(), fmt.Errorf("writeArtifact %s close: %w", encoding, err)
+	}
+	return wrCounter.Count(), nil
+}
+
+// artifactETag returns a strong ETag for the artifact body served to agents with the content encoding.
+func artifactETag(artifact *model.Artifact, encoding string) string {
+	if encoding != "" {
+		return `"` + artifact.EncodedSha256 + "-" + encoding + `"`
+	}
+	return `"` + artifact.EncodedSha256 + `"`
+}
+
+func (at ArtifactT) validateRequest(ctx context.Context, ident, sha2 string) error {
 	span, _ := apm.StartSpan(ctx, "validateRequest", "validate")
 	defer span.End()
 
 	// Input validation
-	return validateSha2String(sha2)
+	return validateArtifactPath(ident, sha2)
 }
 
-func (at ArtifactT) processRequest(ctx context.Context, zlog zerolog.Logger, agent *model.Agent, id, sha2 string) (io.Reader, error) {
+// processRequest returns the requested artifact, it must be released once it was served.
+func (at ArtifactT) processRequest(ctx context.Context, zlog zerolog.Logger, agent *model.Agent, id, sha2 string) (cache.Artifact, error) {
 	// Determine whether the agent should have access to this artifact
 	if err := at.authorizeArtifact(ctx, agent, id, sha2); err != nil {
 		zlog.Warn().Err(err).Msg("Unauthorized GET on artifact")
-		return nil, err
+		return cache.Artifact{}, err
 	}
 
 	// Grab artifact, whether from cache or elastic.
 	artifact, err := at.getArtifact(ctx, zlog, id, sha2)
 	if err != nil {
-		return nil, err
+		return cache.Artifact{}, err
 	}
 
 	// Sanity check; just in case something underneath is misbehaving
 	if artifact.Identifier != id || artifact.DecodedSha256 != sha2 {
+		artifact.Release()
 		err = ErrorRecord
 		zlog.Info().
 			Err(err).
 			Str("artifact_id", artifact.Identifier).
 			Str("artifact_sha2", artifact.DecodedSha256).
 			Msg("Identifier mismatch on url")
-		return nil, err
+		return cache.Artifact{}, err
 	}
 
 	zlog.Debug().
-		Int("sz", len(artifact.Body)).
+		Int64("sz", artifact.Size()).
+		Bool("spilled", artifact.Spilled()).
 		Int64("decodedSz", artifact.DecodedSize).
 		Str("compression", artifact.CompressionAlgorithm).
 		Str("encryption", artifact.EncryptionAlgorithm).
 		Str("created", artifact.Created).
 		Msg("Artifact GET")
 
-	// Write the payload
-	rdr := bytes.NewReader(artifact.Body)
-	return rdr, nil
+	return artifact, nil
 }
 
 // TODO: Pull the policy record for this agent and validate that the
@@ -154,54 +257,138 @@ func (at ArtifactT) authorizeArtifact(ctx context.Context, _ *model.Agent, _, _
 
 // Return artifact from cache by sha2 or fetch directly from Elastic.
 // Update cache on successful retrieval from Elastic.
-func (at ArtifactT) getArtifact(ctx context.Context, zlog zerolog.Logger, ident, sha2 string) (*model.Artifact, error) {
+//
+// Concurrent misses of the same artifact share a single fetch. A stale artifact is returned from the
+// cache and fetched again in the background, so agents do not wait for it once the cache entry expires.
+// The returned artifact must be released once it was served.
+func (at ArtifactT) getArtifact(ctx context.Context, zlog zerolog.Logger, ident, sha2 string) (cache.Artifact, error) {
 	span, ctx := apm.StartSpan(ctx, "getArtifact", "process")
 	defer span.End()
 
 	// Check the cache; return immediately if found.
-	if artifact, ok := at.cache.GetArtifact(ident, sha2); ok {
-		return &artifact, nil
+	if artifact, stale, ok := at.cache.GetArtifact(ident, sha2); ok {
+		if stale {
+			cntArtifacts.cacheStaleHit.Inc()
+			at.refreshArtifact(ctx, zlog, ident, sha2)
+		} else {
+			cntArtifacts.cacheHit.Inc()
+		}
+		return artifact, nil
+	}
+	cntArtifacts.cacheMiss.Inc()
+
+	// The fetch is shared, so it is not cancelled when the request that started it is.
+	loaded := false
+	v, err, _ := at.fetchGroup.Do(makeArtifactFetchKey(ident, sha2), func() (interface{}, error) {
+		loaded = true
+		return at.loadArtifact(context.WithoutCancel(ctx), zlog, ident, sha2)
+	})
+	if err != nil {
+		return cache.Artifact{}, err
+	}
+	// The caller that loaded the artifact holds it, the callers sharing the fetch hold it too. A spilled body
+	// that was not cached may already be released, it is loaded again.
+	art := v.(cache.Artifact)
+	if !loaded && !art.Acquire() {
+		return at.loadArtifact(context.WithoutCancel(ctx), zlog, ident, sha2)
 	}
+	return art, nil
+}
+
+// refreshArtifact fetches the artifact again in the background, unless a fetch of it is already in flight.
+func (at ArtifactT) refreshArtifact(ctx context.Context, zlog zerolog.Logger, ident, sha2 string) {
+	ctx = context.WithoutCancel(ctx)
+	// The result is not waited for, the channel is buffered so the fetch does not block on it.
+	at.fetchGroup.DoChan(makeArtifactFetchKey(ident, sha2), func() (interface{}, error) {
+		zlog.Debug().Str("artifact_id", ident).Msg("Refresh stale artifact")
+		art, err := at.loadArtifact(ctx, zlog, ident, sha2)
+		// Nothing serves the refreshed artifact, the callers sharing the fetch hold it on their own.
+		art.Release()
+		return art, err
+	})
+}
 
+func makeArtifactFetchKey(ident, sha2 string) string {
+	return ident + ":" + sha2
+}
+
+// loadArtifact fetches the artifact from Elastic, decodes and validates it, and adds it to the cache.
+// The returned artifact is held by the caller.
+func (at ArtifactT) loadArtifact(ctx context.Context, zlog zerolog.Logger, ident, sha2 string) (cache.Artifact, error) {
 	// Fetch the artifact from elastic
 	art, err := at.fetchArtifact(ctx, zlog, ident, sha2)
+	if errors.Is(err, dl.ErrNotFound) && at.upstream != nil {
+		return at.loadUpstreamArtifact(ctx, zlog, ident, sha2)
+	}
 	if err != nil {
 		zlog.Info().Err(err).Msg("Fail retrieve artifact")
-		return nil, err
-	}
-
-	// The 'Body' field type is Raw; extract to string.
-	var srcPayload string
-	if err = json.Unmarshal(art.Body, &srcPayload); err != nil {
-		zlog.Error().Err(err).Msg("Cannot unmarshal artifact payload")
-		return nil, err
+		return cache.Artifact{}, err
 	}
 
 	// Artifact is stored base64 encoded in ElasticSearch.
-	// Base64 decode the payload before putting in cache
+	// Base64 decode the payload as it is read into the cache
 	// to avoid having to decode on each cache hit.
-	dstPayload, err := base64.StdEncoding.DecodeString(srcPayload)
+	payload, err := artifactPayload(art.Body)
 	if err != nil {
-		zlog.Error().Err(err).Msg("Fail base64 decode artifact")
-		return nil, err
+		zlog.Error().Err(err).Msg("Cannot unmarshal artifact payload")
+		return cache.Artifact{}, err
 	}
 
-	// Validate the sha256 hash; this is just good hygiene.
-	vSpan, _ := apm.StartSpan(ctx, "validateArtifact", "validate")
-	if err = validateSha2Data(dstPayload, art.EncodedSha256); err != nil {
-		vSpan.End()
+	// Validate the sha256 hash as the payload is decoded; this is just good hygiene.
+	body, err := newSha2Reader(base64.NewDecoder(base64.StdEncoding, payload), art.EncodedSha256)
+	if err != nil {
 		zlog.Error().Err(err).Msg("Fail sha2 hash validation")
-		return nil, err
+		return cache.Artifact{}, err
 	}
+	art.Body = nil
+
+	// Update the cache, a large body is spilled to disk instead of being held in memory.
+	vSpan, _ := apm.StartSpan(ctx, "decodeArtifact", "validate")
+	cached, err := at.cache.LoadArtifact(*art, body)
 	vSpan.End()
+	if err != nil {
+		zlog.Error().Err(err).Msg("Fail decode artifact")
+		return cache.Artifact{}, err
+	}
+	return cached, nil
+}
+
+// artifactPayload returns a reader of the base64 payload of the raw 'Body' field of an artifact, a JSON string.
+// The payload is read in place unless it has escaped characters, which base64 does not need.
+func artifactPayload(raw json.RawMessage) (io.Reader, error) {
+	if len(raw) >= 2 && raw[0] == '"' && raw[len(raw)-1] == '"' && bytes.IndexByte(raw, '\\') < 0 {
+		return bytes.NewReader(raw[1 : len(raw)-1]), nil
+	}
+	var payload string
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return nil, err
+	}
+	return strings.NewReader(payload), nil
+}
 
-	// Reassign decoded payload before adding to cache, avoid base64 decode on cache hit.
-	art.Body = dstPayload
+// sha2Reader hashes the bytes read from r, it fails with ErrorMismatchSha2 instead of io.EOF if they do not match
+// the expected sha256.
+type sha2Reader struct {
+	r    io.Reader
+	h    hash.Hash
+	sha2 []byte
+}
 
-	// Update the cache.
-	at.cache.SetArtifact(*art)
+func newSha2Reader(r io.Reader, sha2 string) (*sha2Reader, error) {
+	src, err := hex.DecodeString(sha2)
+	if err != nil {
+		return nil, fmt.Errorf("sha2 hex decode: %w", err)
+	}
+	return &sha2Reader{r: r, h: sha256.New(), sha2: src}, nil
+}
 
-	return art, nil
+func (s *sha2Reader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.h.Write(p[:n])
+	if errors.Is(err, io.EOF) && !bytes.Equal(s.h.Sum(nil), s.sha2) {
+		return n, ErrorMismatchSha2
+	}
+	return n, err
 }
 
 // Attempt to fetch the artifact from Elastic
@@ -232,28 +419,137 @@ func (at ArtifactT) fetchArtifact(ctx context.Context, zlog zerolog.Logger, iden
 	return artifact, nil
 }
 
-func validateSha2String(sha2 string) error {
+// loadUpstreamArtifact fetches the artifact from the upstream and adds it to the cache.
+// The artifact is indexed in the background so that the next fetches find it in Elastic.
+func (at ArtifactT) loadUpstreamArtifact(ctx context.Context, zlog zerolog.Logger, ident, sha2 string) (cache.Artifact, error) {
+	start := time.Now()
+	art, err := at.upstream.fetch(ctx, ident, sha2)
 
-	if len(sha2) != 64 {
-		return ErrorBadSha2
-	}
+	zlog.Info().
+		Err(err).
+		Int64(ECSEventDuration, time.Since(start).Nanoseconds()).
+		Msg("fetch artifact from upstream")
 
-	if _, err := hex.DecodeString(sha2); err != nil {
-		return ErrorBadSha2
+	if err != nil {
+		return cache.Artifact{}, fmt.Errorf("fetch upstream artifact: %w", err)
 	}
+	cntArtifacts.upstreamFetch.Inc()
+	cached, err := at.cache.LoadArtifact(*art, bytes.NewReader(art.Body))
+	if err != nil {
+		return cache.Artifact{}, err
+	}
+	go at.indexArtifact(context.WithoutCancel(ctx), zlog, *art)
+	return cached, nil
+}
 
-	return nil
+// indexArtifact writes an artifact fetched from the upstream to Elastic.
+// On failure the artifact is fetched from the upstream again on the next cache miss.
+func (at ArtifactT) indexArtifact(ctx context.Context, zlog zerolog.Logger, art model.Artifact) {
+	// Artifacts are stored base64 encoded in Elastic.
+	body, err := json.Marshal(base64.StdEncoding.EncodeToString(art.Body))
+	if err != nil {
+		zlog.Error().Err(err).Msg("Fail encode upstream artifact")
+		return
+	}
+	art.Body = body
+	doc, err := json.Marshal(art)
+	if err != nil {
+		zlog.Error().Err(err).Msg("Fail marshal upstream artifact")
+		return
+	}
+	if _, err := at.bulker.Create(ctx, dl.FleetArtifacts, art.Identifier+"-"+art.DecodedSha256, doc); err != nil {
+		zlog.Warn().Err(err).Str("artifact_id", art.Identifier).Msg("Unable to index upstream artifact")
+	}
 }
 
-func validateSha2Data(data []byte, sha2 string) error {
-	src, err := hex.DecodeString(sha2)
+// fetch retrieves the artifact from <base_url>/<ident>/<sha2>.
+// The body is only accepted if its sha256, or the sha256 of its zlib decompressed content, is sha2.
+func (u *artifactUpstream) fetch(ctx context.Context, ident, sha2 string) (*model.Artifact, error) {
+	if ident == "." || ident == ".." {
+		return nil, dl.ErrNotFound
+	}
+	target := strings.TrimSuffix(u.baseURL, "/") + "/" + url.PathEscape(ident) + "/" + sha2
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
 	if err != nil {
-		return fmt.Errorf("sha2 hex decode: %w", err)
+		return nil, err
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, dl.ErrNotFound
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUpstreamStatus, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, u.maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > u.maxSize {
+		return nil, ErrorArtifactSize
+	}
+
+	sum := sha256.Sum256(body)
+	art := &model.Artifact{
+		Identifier:          ident,
+		DecodedSha256:       sha2,
+		EncodedSha256:       hex.EncodeToString(sum[:]),
+		EncodedSize:         int64(len(body)),
+		EncryptionAlgorithm: "none",
+		Created:             time.Now().UTC().Format(time.RFC3339),
+		Body:                body,
+	}
+	if art.EncodedSha256 == sha2 {
+		art.CompressionAlgorithm = "none"
+		art.DecodedSize = art.EncodedSize
+		return art, nil
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, ErrorMismatchSha2
+	}
+	defer zr.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, io.LimitReader(zr, u.maxSize+1))
+	if err != nil {
+		return nil, ErrorMismatchSha2
+	}
+	if n > u.maxSize {
+		return nil, ErrorArtifactSize
+	}
+	if hex.EncodeToString(h.Sum(nil)) != sha2 {
+		return nil, ErrorMismatchSha2
+	}
+	art.CompressionAlgorithm = "zlib"
+	art.DecodedSize = n
+	return art, nil
+}
+
+// validateArtifactPath checks the identifier and sha256 of an artifact request path.
+// Only identifiers that follow the artifact naming pattern and lowercase hex encoded sha256 are accepted.
+func validateArtifactPath(ident, sha2 string) error {
+	if len(ident) > maxArtifactIdentLen || !artifactIdentRe.MatchString(ident) {
+		return ErrorBadArtifact
+	}
+	return validateSha2String(sha2)
+}
+
+func validateSha2String(sha2 string) error {
+	if len(sha2) != 64 {
+		return ErrorBadSha2
 	}
 
-	sum := sha256.Sum256(data)
-	if !bytes.Equal(sum[:], src) {
-		return ErrorMismatchSha2
+	// hex.DecodeString accepts uppercase digits, the sha256 of the artifacts are lowercase.
+	for i := 0; i < len(sha2); i++ {
+		c := sha2[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return ErrorBadSha2
+		}
 	}
 
 	return nil
@@ -0,0 +1,646 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package api
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/cache"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+	testcache "github.com/elastic/fleet-server/v7/internal/pkg/testing/cache"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+	"github.com/elastic/fleet-server/v7/internal/pkg/throttle"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/singleflight"
+)
+
+func prepareArtifactMock(t *testing.T, body []byte, compressionLevel int) (http.Handler, string) {
+	sum := sha256.Sum256(body)
+	sha2 := hex.EncodeToString(sum[:])
+
+	c := testcache.NewMockCache()
+	c.On("GetArtifact", "endpoint-exceptionlist", sha2).Return(cache.Artifact{Artifact: model.Artifact{
+		Identifier:    "endpoint-exceptionlist",
+		DecodedSha256: sha2,
+		EncodedSha256: sha2,
+		Body:          body,
+	}}, false, true)
+
+	si := apiServer{
+		at: &ArtifactT{
+			cache:             c,
+			compressionLevel:  compressionLevel,
+			compressionThresh: 10,
+			encPool:           newEncoderPool(compressionLevel),
+			authAgent: func(r *http.Request, id *string, bulker bulk.Bulk, c cache.Cache) (*model.Agent, error) {
+				return &model.Agent{
+					ESDocument: model.ESDocument{
+						Id: "foo",
+					},
+					Agent: &model.AgentMetadata{
+						ID: "foo",
+					},
+				}, nil
+			},
+		},
+	}
+	return Handler(&si), sha2
+}
+
+func TestHandleArtifactsRange(t *testing.T) {
+	body := []byte(strings.Repeat("0123456789", 10))
+	hr, sha2 := prepareArtifactMock(t, body, flate.NoCompression)
+	etag := `"` + sha2 + `"`
+
+	tests := []struct {
+		name         string
+		headers      map[string]string
+		status       int
+		body         string
+		contentRange string
+	}{{
+		name:   "full body",
+		status: http.StatusOK,
+		body:   string(body),
+	}, {
+		name:         "mid file range",
+		headers:      map[string]string{"Range": "bytes=10-19"},
+		status:       http.StatusPartialContent,
+		body:         "0123456789",
+		contentRange: "bytes 10-19/100",
+	}, {
+		name:         "open ended range",
+		headers:      map[string]string{"Range": "bytes=95-"},
+		status:       http.StatusPartialContent,
+		body:         "56789",
+		contentRange: "bytes 95-99/100",
+	}, {
+		name:         "suffix range",
+		headers:      map[string]string{"Range": "bytes=-3"},
+		status:       http.StatusPartialContent,
+		body:         "789",
+		contentRange: "bytes 97-99/100",
+	}, {
+		name:         "unsatisfiable range",
+		headers:      map[string]string{"Range": "bytes=200-300"},
+		status:       http.StatusRequestedRangeNotSatisfiable,
+		contentRange: "bytes */100",
+	}, {
+		name:         "if-range match",
+		headers:      map[string]string{"Range": "bytes=0-4", "If-Range": etag},
+		status:       http.StatusPartialContent,
+		body:         "01234",
+		contentRange: "bytes 0-4/100",
+	}, {
+		name:    "if-range mismatch",
+		headers: map[string]string{"Range": "bytes=0-4", "If-Range": `"changed"`},
+		status:  http.StatusOK,
+		body:    string(body),
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := testlog.SetLogger(t).WithContext(context.Background())
+			req := httptest.NewRequest(http.MethodGet, "/api/fleet/artifacts/endpoint-exceptionlist/"+sha2, nil).WithContext(ctx)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			hr.ServeHTTP(rec, req)
+
+			require.Equal(t, tc.status, rec.Code)
+			assert.Equal(t, etag, rec.Header().Get("ETag"))
+			assert.Equal(t, tc.contentRange, rec.Header().Get("Content-Range"))
+			if tc.body != "" {
+				assert.Equal(t, tc.body, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandleArtifactsCompression(t *testing.T) {
+	body := []byte(strings.Repeat("0123456789", 10))
+	hr, sha2 := prepareArtifactMock(t, body, flate.BestSpeed)
+
+	tests := []struct {
+		name           string
+		headers        map[string]string
+		status         int
+		encoding       string
+		decode         func(io.Reader) (io.Reader, error)
+		expectedLength bool
+	}{{
+		name:           "identity",
+		status:         http.StatusOK,
+		expectedLength: true,
+	}, {
+		name:     "gzip",
+		headers:  map[string]string{"Accept-Encoding": "gzip, deflate"},
+		status:   http.StatusOK,
+		encoding: "gzip",
+		decode: func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		},
+	}, {
+		name:     "deflate",
+		headers:  map[string]string{"Accept-Encoding": "gzip;q=0.5, deflate"},
+		status:   http.StatusOK,
+		encoding: "deflate",
+		decode: func(r io.Reader) (io.Reader, error) {
+			return zlib.NewReader(r)
+		},
+	}, {
+		name:           "range is not compressed",
+		headers:        map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-9"},
+		status:         http.StatusPartialContent,
+		expectedLength: true,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := testlog.SetLogger(t).WithContext(context.Background())
+			req := httptest.NewRequest(http.MethodGet, "/api/fleet/artifacts/endpoint-exceptionlist/"+sha2, nil).WithContext(ctx)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			hr.ServeHTTP(rec, req)
+
+			require.Equal(t, tc.status, rec.Code)
+			assert.Equal(t, tc.encoding, rec.Header().Get("Content-Encoding"))
+			assert.Contains(t, rec.Header().Values("Vary"), "Accept-Encoding")
+			if !tc.expectedLength {
+				assert.Empty(t, rec.Header().Get("Content-Length"), "the compressed length is not known upfront")
+			}
+			if tc.decode == nil {
+				return
+			}
+			assert.Equal(t, `"`+sha2+"-"+tc.encoding+`"`, rec.Header().Get("ETag"))
+			rdr, err := tc.decode(rec.Body)
+			require.NoError(t, err)
+			p, err := io.ReadAll(rdr)
+			require.NoError(t, err)
+			assert.Equal(t, body, p)
+		})
+	}
+}
+
+func Benchmark_ArtifactT_writeArtifact(b *testing.B) {
+	at := ArtifactT{
+		compressionLevel:  flate.BestSpeed,
+		compressionThresh: 1,
+		encPool:           newEncoderPool(flate.BestSpeed),
+	}
+	artifact := cache.Artifact{Artifact: model.Artifact{
+		EncodedSha256: "abc",
+		Body:          []byte(strings.Repeat("0123456789", 10000)),
+	}}
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		b.Run(encoding, func(b *testing.B) {
+			req := &http.Request{
+				Header: http.Header{
+					"Accept-Encoding": []string{encoding},
+				},
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := at.writeArtifact(httptest.NewRecorder(), req, artifact); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// artifactSearchResult returns the search result of an artifact document holding body.
+func artifactSearchResult(t *testing.T, ident string, body []byte) *es.ResultT {
+	t.Helper()
+	sum := sha256.Sum256(body)
+	return artifactDocResult(t, ident, hex.EncodeToString(sum[:]), body)
+}
+
+// artifactDocResult returns the search result of an artifact document holding body with the sha256 sha2.
+func artifactDocResult(t *testing.T, ident, sha2 string, body []byte) *es.ResultT {
+	t.Helper()
+	src, err := json.Marshal(map[string]interface{}{
+		"identifier":     ident,
+		"decoded_sha256": sha2,
+		"encoded_sha256": sha2,
+		"body":           base64.StdEncoding.EncodeToString(body),
+	})
+	require.NoError(t, err)
+	return &es.ResultT{HitsT: es.HitsT{Hits: []es.HitT{{ID: "artifact", Source: src}}}}
+}
+
+func newTestArtifactT(bulker bulk.Bulk, c cache.Cache) *ArtifactT {
+	return &ArtifactT{
+		bulker:     bulker,
+		cache:      c,
+		esThrottle: throttle.NewThrottle(defaultMaxParallel),
+		fetchGroup: &singleflight.Group{},
+	}
+}
+
+func TestGetArtifactSharedFetch(t *testing.T) {
+	const callers = 50
+	ident := "endpoint-exceptionlist"
+	body := []byte("artifact body")
+	sum := sha256.Sum256(body)
+	sha2 := hex.EncodeToString(sum[:])
+	zlog := testlog.SetLogger(t)
+	ctx := zlog.WithContext(context.Background())
+
+	var lookups sync.WaitGroup
+	lookups.Add(callers)
+	c := testcache.NewMockCache()
+	c.On("GetArtifact", ident, sha2).Return(cache.Artifact{}, false, false).Run(func(mock.Arguments) {
+		lookups.Done()
+	})
+	c.On("LoadArtifact", mock.Anything).Return()
+
+	release := make(chan struct{})
+	bulker := ftesting.NewMockBulk()
+	bulker.On("Search", mock.Anything, dl.FleetArtifacts, mock.Anything, mock.Anything).Run(func(mock.Arguments) {
+		<-release
+	}).Return(artifactSearchResult(t, ident, body), nil)
+
+	at := newTestArtifactT(bulker, c)
+	results := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			artifact, err := at.getArtifact(ctx, zlog, ident, sha2)
+			if err == nil && !bytes.Equal(body, artifact.Body) {
+				err = errors.New("unexpected artifact body")
+			}
+			results <- err
+		}()
+	}
+
+	// All callers missed the cache, give them time to join the fetch before it completes.
+	lookups.Wait()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < callers; i++ {
+		require.NoError(t, <-results)
+	}
+	bulker.AssertNumberOfCalls(t, "Search", 1)
+	c.AssertNumberOfCalls(t, "LoadArtifact", 1)
+}
+
+func TestGetArtifactStaleRefresh(t *testing.T) {
+	ident := "endpoint-exceptionlist"
+	body := []byte("artifact body")
+	sum := sha256.Sum256(body)
+	sha2 := hex.EncodeToString(sum[:])
+	zlog := testlog.SetLogger(t)
+	ctx, cancel := context.WithCancel(zlog.WithContext(context.Background()))
+
+	cached := model.Artifact{Identifier: ident, DecodedSha256: sha2, EncodedSha256: sha2, Body: body}
+	refreshed := make(chan model.Artifact, 1)
+	c := testcache.NewMockCache()
+	c.On("GetArtifact", ident, sha2).Return(cache.Artifact{Artifact: cached}, true, true)
+	c.On("LoadArtifact", mock.Anything).Run(func(args mock.Arguments) {
+		refreshed <- args.Get(0).(model.Artifact)
+	}).Return()
+
+	release := make(chan struct{})
+	bulker := ftesting.NewMockBulk()
+	bulker.On("Search", mock.Anything, dl.FleetArtifacts, mock.Anything, mock.Anything).Run(func(mock.Arguments) {
+		<-release
+	}).Return(artifactSearchResult(t, ident, body), nil).Once()
+
+	at := newTestArtifactT(bulker, c)
+
+	// The stale artifact is served while it is fetched again.
+	artifact, err := at.getArtifact(ctx, zlog, ident, sha2)
+	require.NoError(t, err)
+	assert.Equal(t, cached, artifact.Artifact)
+
+	// The refresh outlives the request that started it.
+	cancel()
+	close(release)
+	select {
+	case artifact := <-refreshed:
+		assert.Equal(t, body, []byte(artifact.Body))
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the artifact to be refreshed")
+	}
+	bulker.AssertNumberOfCalls(t, "Search", 1)
+}
+
+func TestGetArtifactSpilled(t *testing.T) {
+	ident := "endpoint-exceptionlist"
+	body := []byte(strings.Repeat("artifact body ", 100))
+	sum := sha256.Sum256(body)
+	sha2 := hex.EncodeToString(sum[:])
+
+	newSpillCache := func(t *testing.T, dir string) *cache.CacheT {
+		c, err := cache.New(config.Cache{NumCounters: 100, MaxCost: 1 << 20, ArtifactTTL: time.Hour, ArtifactSpillSize: 64, ArtifactSpillDir: dir})
+		require.NoError(t, err)
+		return c
+	}
+	spilled := func(t *testing.T, dir string) []string {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		names := make([]string, 0, len(entries))
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		return names
+	}
+
+	t.Run("served from disk", func(t *testing.T) {
+		zlog := testlog.SetLogger(t)
+		ctx := zlog.WithContext(context.Background())
+		dir := t.TempDir()
+		c := newSpillCache(t, dir)
+		bulker := ftesting.NewMockBulk()
+		bulker.On("Search", mock.Anything, dl.FleetArtifacts, mock.Anything, mock.Anything).Return(artifactSearchResult(t, ident, body), nil).Once()
+
+		at := newTestArtifactT(bulker, c)
+		artifact, err := at.getArtifact(ctx, zlog, ident, sha2)
+		require.NoError(t, err)
+		require.True(t, artifact.Spilled())
+		assert.Empty(t, artifact.Body)
+		assert.Len(t, spilled(t, dir), 1)
+
+		rec := httptest.NewRecorder()
+		_, err = at.writeArtifact(rec, httptest.NewRequest(http.MethodGet, "/", nil), artifact)
+		require.NoError(t, err)
+		assert.Equal(t, body, rec.Body.Bytes())
+		artifact.Release()
+
+		// The spilled body is removed with the cache.
+		require.NoError(t, c.Reconfigure(config.Cache{NumCounters: 100, MaxCost: 1 << 20, ArtifactTTL: time.Hour}))
+		assert.Empty(t, spilled(t, dir))
+	})
+
+	t.Run("mismatched sha256", func(t *testing.T) {
+		zlog := testlog.SetLogger(t)
+		ctx := zlog.WithContext(context.Background())
+		dir := t.TempDir()
+		c := newSpillCache(t, dir)
+		// The body is tampered past the spill size, the mismatch is found once it is mostly written to disk.
+		tampered := append(append([]byte{}, body...), "tampered"...)
+		bulker := ftesting.NewMockBulk()
+		bulker.On("Search", mock.Anything, dl.FleetArtifacts, mock.Anything, mock.Anything).Return(artifactDocResult(t, ident, sha2, tampered), nil)
+
+		_, err := newTestArtifactT(bulker, c).getArtifact(ctx, zlog, ident, sha2)
+		require.ErrorIs(t, err, ErrorMismatchSha2)
+		assert.Empty(t, spilled(t, dir))
+		_, _, ok := c.GetArtifact(ident, sha2)
+		assert.False(t, ok)
+	})
+}
+
+func TestGetArtifactUpstream(t *testing.T) {
+	ident := "endpoint-exceptionlist"
+	content := []byte(strings.Repeat("artifact content ", 10))
+	sum := sha256.Sum256(content)
+	sha2 := hex.EncodeToString(sum[:])
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	_, err := zw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	tests := []struct {
+		name        string
+		status      int
+		body        []byte
+		maxSize     int64
+		compression string
+		err         error
+	}{{
+		name:        "uncompressed",
+		status:      http.StatusOK,
+		body:        content,
+		compression: "none",
+	}, {
+		name:        "zlib",
+		status:      http.StatusOK,
+		body:        compressed.Bytes(),
+		compression: "zlib",
+	}, {
+		name:   "tampered",
+		status: http.StatusOK,
+		body:   append([]byte("tampered "), content...),
+		err:    ErrorMismatchSha2,
+	}, {
+		name:    "too large",
+		status:  http.StatusOK,
+		body:    content,
+		maxSize: 10,
+		err:     ErrorArtifactSize,
+	}, {
+		name:   "not found",
+		status: http.StatusNotFound,
+		err:    dl.ErrNotFound,
+	}, {
+		name:   "upstream error",
+		status: http.StatusBadGateway,
+		err:    ErrUpstreamStatus,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			zlog := testlog.SetLogger(t)
+			ctx := zlog.WithContext(context.Background())
+
+			paths := make(chan string, 1)
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				paths <- r.URL.Path
+				w.WriteHeader(tc.status)
+				_, _ = w.Write(tc.body)
+			}))
+			defer upstream.Close()
+
+			c := testcache.NewMockCache()
+			c.On("GetArtifact", ident, sha2).Return(cache.Artifact{}, false, false)
+			c.On("LoadArtifact", mock.Anything).Return()
+			indexed := make(chan model.Artifact, 1)
+			bulker := ftesting.NewMockBulk()
+			bulker.On("Search", mock.Anything, dl.FleetArtifacts, mock.Anything, mock.Anything).Return(&es.ResultT{}, nil)
+			bulker.On("Create", mock.Anything, dl.FleetArtifacts, ident+"-"+sha2, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				var art model.Artifact
+				if err := json.Unmarshal(args.Get(3).([]byte), &art); err == nil {
+					indexed <- art
+				}
+			}).Return(ident+"-"+sha2, nil)
+
+			maxSize := tc.maxSize
+			if maxSize == 0 {
+				maxSize = 1024
+			}
+			at := newTestArtifactT(bulker, c)
+			at.upstream = &artifactUpstream{client: upstream.Client(), baseURL: upstream.URL + "/downloads/", maxSize: maxSize}
+
+			artifact, err := at.getArtifact(ctx, zlog, ident, sha2)
+			assert.Equal(t, "/downloads/"+ident+"/"+sha2, <-paths)
+			if tc.err != nil {
+				require.ErrorIs(t, err, tc.err)
+				c.AssertNotCalled(t, "LoadArtifact", mock.Anything)
+				bulker.AssertNotCalled(t, "Create", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.body, []byte(artifact.Body))
+			assert.Equal(t, tc.compression, artifact.CompressionAlgorithm)
+			assert.Equal(t, int64(len(content)), artifact.DecodedSize)
+			c.AssertCalled(t, "LoadArtifact", artifact.Artifact)
+
+			// The artifact is indexed the way it is read back from Elastic.
+			select {
+			case art := <-indexed:
+				var payload string
+				require.NoError(t, json.Unmarshal(art.Body, &payload))
+				assert.Equal(t, base64.StdEncoding.EncodeToString(tc.body), payload)
+				assert.Equal(t, artifact.EncodedSha256, art.EncodedSha256)
+				assert.Equal(t, sha2, art.DecodedSha256)
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the artifact to be indexed")
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		zlog := testlog.SetLogger(t)
+		ctx := zlog.WithContext(context.Background())
+		c := testcache.NewMockCache()
+		c.On("GetArtifact", ident, sha2).Return(cache.Artifact{}, false, false)
+		bulker := ftesting.NewMockBulk()
+		bulker.On("Search", mock.Anything, dl.FleetArtifacts, mock.Anything, mock.Anything).Return(&es.ResultT{}, nil)
+
+		_, err := newTestArtifactT(bulker, c).getArtifact(ctx, zlog, ident, sha2)
+		require.ErrorIs(t, err, dl.ErrNotFound)
+	})
+}
+
+// artifactPathHandler returns a handler that serves the artifact of any identifier and sha256 found in the cache c,
+// authenticated counts the requests that reached the agent authentication.
+func artifactPathHandler(c cache.Cache, authenticated *int) http.Handler {
+	return Handler(&apiServer{
+		at: &ArtifactT{
+			cache:            c,
+			compressionLevel: flate.NoCompression,
+			encPool:          newEncoderPool(flate.NoCompression),
+			authAgent: func(*http.Request, *string, bulk.Bulk, cache.Cache) (*model.Agent, error) {
+				*authenticated++
+				return &model.Agent{ESDocument: model.ESDocument{Id: "foo"}, Agent: &model.AgentMetadata{ID: "foo"}}, nil
+			},
+		},
+	})
+}
+
+func TestHandleArtifactsRejectsPath(t *testing.T) {
+	sha2 := strings.Repeat("0123456789abcdef", 4)
+	tests := []struct {
+		name  string
+		ident string
+		sha2  string
+	}{
+		{name: "parent directory", ident: "..", sha2: sha2},
+		{name: "escaped traversal", ident: "..%2F..%2Fetc%2Fpasswd", sha2: sha2},
+		{name: "escaped slash", ident: "endpoint-exceptionlist%2Fother", sha2: sha2},
+		{name: "uppercase identifier", ident: "Endpoint-ExceptionList", sha2: sha2},
+		{name: "leading dash", ident: "-endpoint-exceptionlist", sha2: sha2},
+		{name: "empty word", ident: "endpoint--exceptionlist", sha2: sha2},
+		{name: "cache namespace", ident: "api:key", sha2: sha2},
+		{name: "wildcard", ident: "endpoint-*", sha2: sha2},
+		{name: "long identifier", ident: strings.Repeat("a", maxArtifactIdentLen+1), sha2: sha2},
+		{name: "short sha256", ident: "endpoint-exceptionlist", sha2: sha2[1:]},
+		{name: "long sha256", ident: "endpoint-exceptionlist", sha2: sha2 + "0"},
+		{name: "uppercase sha256", ident: "endpoint-exceptionlist", sha2: strings.ToUpper(sha2)},
+		{name: "non hex sha256", ident: "endpoint-exceptionlist", sha2: "g" + sha2[1:]},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := testlog.SetLogger(t).WithContext(context.Background())
+			c := testcache.NewMockCache()
+			authenticated := 0
+			req := httptest.NewRequest(http.MethodGet, "/api/fleet/artifacts/"+tc.ident+"/"+tc.sha2, nil).WithContext(ctx)
+			rec := httptest.NewRecorder()
+			artifactPathHandler(c, &authenticated).ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+			assert.Zero(t, authenticated)
+			c.AssertNotCalled(t, "GetArtifact", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func FuzzArtifactPath(f *testing.F) {
+	sha2 := strings.Repeat("0123456789abcdef", 4)
+	f.Add("endpoint-exceptionlist-windows-v1", sha2)
+	f.Add("endpoint_trusted_apps", sha2)
+	f.Add("..", sha2)
+	f.Add("a/../b", sha2)
+	f.Add("api:key", sha2)
+	f.Add("endpoint-exceptionlist", strings.ToUpper(sha2))
+	f.Add("endpoint-exceptionlist", sha2+"/..")
+
+	f.Fuzz(func(t *testing.T, ident, sha2 string) {
+		if ident == "" || sha2 == "" {
+			t.Skip("empty path segments are not routed to the artifact handler")
+		}
+		body := []byte("artifact")
+		c := testcache.NewMockCache()
+		c.On("GetArtifact", ident, sha2).Return(cache.Artifact{Artifact: model.Artifact{
+			Identifier:    ident,
+			DecodedSha256: sha2,
+			EncodedSha256: sha2,
+			Body:          body,
+		}}, false, true)
+		authenticated := 0
+
+		req := httptest.NewRequest(http.MethodGet, "/api/fleet/artifacts/"+url.PathEscape(ident)+"/"+url.PathEscape(sha2), nil)
+		rec := httptest.NewRecorder()
+		artifactPathHandler(c, &authenticated).ServeHTTP(rec, req)
+
+		if err := validateArtifactPath(ident, sha2); err != nil {
+			// Malformed paths are rejected before the cache and Elastic are looked up.
+			require.Equal(t, http.StatusBadRequest, rec.Code)
+			require.Zero(t, authenticated)
+			c.AssertNotCalled(t, "GetArtifact", mock.Anything, mock.Anything)
+			return
+		}
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, body, rec.Body.Bytes())
+		require.Regexp(t, `^[a-z0-9_-]+$`, ident)
+		require.Regexp(t, `^[0-9a-f]{64}$`, sha2)
+	})
+}
@@ -7,19 +7,21 @@ package api
 import (
 	"bytes"
 	"compress/flate"
-	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
+	"maps"
 	"math/rand"
 	"net/http"
 	"reflect"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/action"
+	"github.com/elastic/fleet-server/v7/internal/pkg/apikey"
 	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
 	"github.com/elastic/fleet-server/v7/internal/pkg/cache"
 	"github.com/elastic/fleet-server/v7/internal/pkg/checkin"
@@ -29,6 +31,7 @@ import (
 	"github.com/elastic/fleet-server/v7/internal/pkg/model"
 	"github.com/elastic/fleet-server/v7/internal/pkg/monitor"
 	"github.com/elastic/fleet-server/v7/internal/pkg/policy"
+	"github.com/elastic/fleet-server/v7/internal/pkg/signing"
 	"github.com/elastic/fleet-server/v7/internal/pkg/sqn"
 
 	"github.com/hashicorp/go-version"
@@ -44,14 +47,51 @@ var (
 	ErrNoPolicyOutput         = errors.New("output section not found")
 	ErrFailInjectAPIKey       = errors.New("failure to inject api key")
 	ErrInvalidUpgradeMetadata = errors.New("invalid upgrade metadata")
+	ErrUpgradeDetailsOrder    = errors.New("upgrade details state out of order")
+	ErrPolicyNamespace        = errors.New("policy is not in the agent namespaces")
 )
 
+// maxUpgradeDetailsSize is the largest serialized upgrade_details that is persisted on the agent document.
+const maxUpgradeDetailsSize = 4096
+
+// upgradeStateOrder is the position of each upgrade state in the progress of an upgrade.
+// UPG_ROLLBACK and UPG_FAILED can be reached from any state.
+var upgradeStateOrder = map[UpgradeDetailsState]int{
+	UpgradeDetailsStateUPGREQUESTED:   0,
+	UpgradeDetailsStateUPGSCHEDULED:   1,
+	UpgradeDetailsStateUPGDOWNLOADING: 2,
+	UpgradeDetailsStateUPGEXTRACTING:  3,
+	UpgradeDetailsStateUPGREPLACING:   4,
+	UpgradeDetailsStateUPGRESTARTING:  5,
+	UpgradeDetailsStateUPGWATCHING:    6,
+	UpgradeDetailsStateUPGROLLBACK:    7,
+	UpgradeDetailsStateUPGFAILED:      8,
+}
+
+// minJitteredPoll is the shortest long poll that jitter may reduce the poll duration to.
+const minJitteredPoll = 30 * time.Second
+
 const (
 	kEncodingGzip  = "gzip"
 	FailedStatus   = "FAILED"
 	DegradedStatus = "DEGRADED"
 )
 
+// maxComponentsSize is the largest components array accepted in a checkin body.
+const maxComponentsSize = 512 * 1024
+
+// knownComponentStates are the states a component or unit is expected to report.
+// Other states are stored as reported, so newer agents are not rejected by older servers.
+var knownComponentStates = map[string]bool{
+	"STARTING":     true,
+	"CONFIGURING":  true,
+	"HEALTHY":      true,
+	DegradedStatus: true,
+	FailedStatus:   true,
+	"STOPPING":     true,
+	"STOPPED":      true,
+}
+
 // validActionTypes is a map of action.type and if they are valid
 // unlisted or invalid types are removed with filterActions().
 // action types should have a corresponding case in convertActionData.
@@ -75,11 +115,63 @@ type CheckinT struct {
 	ad     *action.Dispatcher
 	tr     *action.TokenResolver
 
-	// gwPool is a gzip.Writer pool intended to lower the amount of writers created when responding to checkin requests.
-	// gzip.Writer allocations are expensive (~1.2MB each) and can exhaust an instance's memory if a lot of concurrent responses are sent (this occurs when a mass-action such as an upgrade is detected).
+	// encPool is a compression writer pool intended to lower the amount of writers created when responding to checkin requests.
 	// effectiveness of the pool is controlled by rate limiter configured through the limit.action_limit attribute.
-	gwPool sync.Pool
-	bulker bulk.Bulk
+	encPool   *encoderPool
+	bulker    bulk.Bulk
+	authAgent authAgentFunc
+
+	// drainCh is closed when the server starts draining to release the parked long polls.
+	drainCh   chan struct{}
+	drainOnce sync.Once
+
+	polls *longPolls
+
+	// verifier verifies the signature of the actions before they are dispatched, nil when it's disabled.
+	verifier *signing.Verifier
+	// versionGate rejects the agents outside of the accepted versions, nil when they are not restricted.
+	versionGate *agentVersionGate
+}
+
+// longPolls tracks the parked long polls by agent ID.
+// An agent has at most one parked long poll, a new long poll of the agent supersedes the parked one.
+type longPolls struct {
+	mu    sync.Mutex
+	polls map[string]chan struct{}
+}
+
+func newLongPolls() *longPolls {
+	return &longPolls{polls: make(map[string]chan struct{})}
+}
+
+// park registers a long poll of the agent and supersedes the long poll the agent already has parked.
+// The returned channel is closed when the long poll is superseded by a newer one, release must be called when the long poll ends.
+func (lp *longPolls) park(agentID string) (<-chan struct{}, func()) {
+	ch := make(chan struct{})
+	lp.mu.Lock()
+	if prev, ok := lp.polls[agentID]; ok {
+		close(prev)
+	}
+	lp.polls[agentID] = ch
+	lp.mu.Unlock()
+
+	return ch, func() {
+		lp.mu.Lock()
+		if lp.polls[agentID] == ch {
+			delete(lp.polls, agentID)
+		}
+		lp.mu.Unlock()
+	}
+}
+
+// isSuperseded returns true if the long poll has been superseded.
+func isSuperseded(superseded <-chan struct{}) bool {
+	select {
+	case <-superseded:
+		return true
+	default:
+		return false
+	}
 }
 
 func NewCheckinT(
@@ -94,33 +186,38 @@ func NewCheckinT(
 	bulker bulk.Bulk,
 ) *CheckinT {
 	ct := &CheckinT{
-		verCon: verCon,
-		cfg:    cfg,
-		cache:  c,
-		bc:     bc,
-		pm:     pm,
-		gcp:    gcp,
-		ad:     ad,
-		tr:     tr,
-		gwPool: sync.Pool{
-			New: func() any {
-				zipper, err := gzip.NewWriterLevel(io.Discard, cfg.CompressionLevel)
-				if err != nil {
-					panic(err)
-				}
-				return zipper
-			},
-		},
-		bulker: bulker,
+		verCon:    verCon,
+		cfg:       cfg,
+		cache:     c,
+		bc:        bc,
+		pm:        pm,
+		gcp:       gcp,
+		ad:        ad,
+		tr:        tr,
+		encPool:   newEncoderPool(cfg.CompressionLevel),
+		bulker:    bulker,
+		authAgent: agentAuthenticator(cfg),
+		drainCh:   make(chan struct{}),
+		polls:     newLongPolls(),
+		verifier:  signing.NewVerifier(&cfg.Signing),
+
+		versionGate: newAgentVersionGate(&cfg.Compatibility),
 	}
 
 	return ct
 }
 
+// drain makes the parked long polls, and the ones that start afterwards, return right away.
+func (ct *CheckinT) drain() {
+	ct.drainOnce.Do(func() {
+		close(ct.drainCh)
+	})
+}
+
 func (ct *CheckinT) handleCheckin(zlog zerolog.Logger, w http.ResponseWriter, r *http.Request, id, userAgent string) error {
 	start := time.Now()
 
-	agent, err := authAgent(r, &id, ct.bulker, ct.cache)
+	agent, err := ct.authAgent(r, &id, ct.bulker, ct.cache)
 	if err != nil {
 		// invalidate remote API keys of force unenrolled agents
 		if errors.Is(err, ErrAgentInactive) && agent != nil {
@@ -164,24 +261,25 @@ type validatedCheckin struct {
 	rawComp         []byte
 	seqno           sqn.SeqNo
 	unhealthyReason *[]string
+	tags            *[]string // set if the agent reported tags that differ from the agent record
+	ip              string    // set if the client address differs from the agent record
 }
 
 func (ct *CheckinT) validateRequest(zlog zerolog.Logger, w http.ResponseWriter, r *http.Request, start time.Time, agent *model.Agent) (validatedCheckin, error) {
 	span, ctx := apm.StartSpan(r.Context(), "validateRequest", "validate")
 	defer span.End()
 
-	body := r.Body
-	// Limit the size of the body to prevent malicious agent from exhausting RAM in server
-	if ct.cfg.Limits.CheckinLimit.MaxBody > 0 {
-		body = http.MaxBytesReader(w, body, ct.cfg.Limits.CheckinLimit.MaxBody)
+	// Limit the size of the decompressed body to prevent malicious agent from exhausting RAM in server
+	body, err := decodeBody(w, r, ct.cfg.Limits.CheckinLimit.MaxBody)
+	if err != nil {
+		return validatedCheckin{}, err
 	}
 	readCounter := datacounter.NewReaderCounter(body)
 
 	var val validatedCheckin
 	var req CheckinRequest
-	decoder := json.NewDecoder(readCounter)
-	if err := decoder.Decode(&req); err != nil {
-		return val, &BadRequestErr{msg: "unable to decode checkin request", nextErr: err}
+	if err := decodeRequest(zlog, readCounter, &req, ct.cfg.StrictSchema, "checkin"); err != nil {
+		return val, err
 	}
 	cntCheckin.bodyIn.Add(readCounter.Count())
 
@@ -191,9 +289,20 @@ func (ct *CheckinT) validateRequest(zlog zerolog.Logger, w http.ResponseWriter,
 	if len(req.Message) == 0 {
 		zlog.Warn().Msg("checkin request method is empty.")
 	}
+	if req.Tags != nil {
+		if err := validateTags(*req.Tags); err != nil {
+			return val, err
+		}
+	}
+	var localMeta []byte
+	if req.LocalMetadata != nil {
+		localMeta = *req.LocalMetadata
+	}
+	if err := ct.versionGate.check(zlog, localMeta, r.UserAgent()); err != nil {
+		return val, err
+	}
 
 	var pDur time.Duration
-	var err error
 	if req.PollTimeout != nil {
 		pDur, err = time.ParseDuration(*req.PollTimeout)
 		if err != nil {
@@ -236,6 +345,20 @@ func (ct *CheckinT) validateRequest(zlog zerolog.Logger, w http.ResponseWriter,
 		return val, err
 	}
 
+	// Compare tags content and update if different
+	var tags *[]string
+	if req.Tags != nil {
+		if t := removeDuplicateStr(*req.Tags); !slices.Equal(t, agent.Tags) {
+			tags = &t
+		}
+	}
+
+	// Compare the client address and update if different
+	var ip string
+	if addr := clientIP(r, ct.cfg.TrustedProxies); addr != agent.LastCheckinIP {
+		ip = addr
+	}
+
 	// Resolve AckToken from request, fallback on the agent record
 	seqno, err := ct.resolveSeqNo(ctx, zlog, req, agent)
 	if err != nil {
@@ -249,6 +372,8 @@ func (ct *CheckinT) validateRequest(zlog zerolog.Logger, w http.ResponseWriter,
 		rawComp:         rawComponents,
 		seqno:           seqno,
 		unhealthyReason: unhealthyReason,
+		tags:            tags,
+		ip:              ip,
 	}, nil
 }
 
@@ -270,8 +395,20 @@ func (ct *CheckinT) ProcessRequest(zlog zerolog.Logger, w http.ResponseWriter, r
 		return fmt.Errorf("failed to update upgrade_details: %w", err)
 	}
 
+	// The tags are updated before subscribing so the actions intended for the new tags are delivered on this checkin.
+	if validated.tags != nil {
+		if err := ct.updateTags(r.Context(), agent, *validated.tags); err != nil {
+			return fmt.Errorf("failed to update tags: %w", err)
+		}
+	}
+
+	// Supersede the long poll the agent may still have parked, for example when the agent retried the checkin behind a flaky NAT.
+	// The superseded long poll returns without actions so the actions and policy changes are only delivered to the latest one.
+	superseded, release := ct.polls.park(agent.Id)
+	defer release()
+
 	// Subscribe to actions dispatcher
-	aSub := ct.ad.Subscribe(agent.Id, seqno)
+	aSub := ct.ad.Subscribe(agent.Id, agent.Tags, agent.Namespaces, seqno)
 	defer ct.ad.Unsubscribe(aSub)
 	actCh := aSub.Ch()
 
@@ -312,12 +449,15 @@ func (ct *CheckinT) ProcessRequest(zlog zerolog.Logger, w http.ResponseWriter, r
 		Dur("pollDuration", pollDuration).
 		Msg("checkin start long poll")
 
+	cntLongPoll.Inc()
+	defer cntLongPoll.Dec()
+
 	// Chill out for a bit. Long poll.
 	longPoll := time.NewTicker(pollDuration)
 	defer longPoll.Stop()
 
 	// Initial update on checkin, and any user fields that might have changed
-	err = ct.bc.CheckIn(agent.Id, string(req.Status), req.Message, rawMeta, rawComponents, seqno, ver, unhealthyReason)
+	err = ct.bc.CheckIn(agent.Id, string(req.Status), req.Message, rawMeta, rawComponents, seqno, ver, unhealthyReason, validated.ip)
 	if err != nil {
 		zlog.Error().Err(err).Str(logger.AgentID, agent.Id).Msg("checkin failed")
 	}
@@ -329,12 +469,27 @@ func (ct *CheckinT) ProcessRequest(zlog zerolog.Logger, w http.ResponseWriter, r
 	)
 
 	// Check agent pending actions first
-	pendingActions, err := ct.fetchAgentPendingActions(r.Context(), seqno, agent.Id)
+	pendingActions, err := ct.fetchAgentPendingActions(r.Context(), seqno, agent)
 	if err != nil {
 		return err
 	}
 	pendingActions = filterActions(zlog, agent.Id, pendingActions)
-	actions, ackToken = convertActions(zlog, agent.Id, pendingActions)
+	pendingActions = filterExpiredActions(zlog, agent.Id, pendingActions, time.Now())
+	pendingActions, batchToken := batchActions(pendingActions, ct.cfg.Checkin.MaxActionsPerResponse)
+	actions, ackToken = convertActions(zlog, ct.verifier, agent.Id, pendingActions)
+	if batchToken != "" {
+		ackToken = batchToken
+	}
+	// The ackToken is kept from the unfiltered list so the agent moves past the actions it already acked.
+	actions = ct.filterAckedActions(r.Context(), zlog, agent.Id, actions, pollDuration)
+
+	// The long poll is not counted in the duration of slow requests, the Elasticsearch time spent in it still is.
+	timing := logger.RequestTimingFromContext(r.Context())
+	pollStart, pollES := time.Now(), timing.ES()
+	endPoll := sync.OnceFunc(func() {
+		timing.AddWait(time.Since(pollStart) - (timing.ES() - pollES))
+	})
+	defer endPoll()
 
 	span, ctx := apm.StartSpan(r.Context(), "longPoll", "process")
 	if len(actions) == 0 {
@@ -343,7 +498,7 @@ func (ct *CheckinT) ProcessRequest(zlog zerolog.Logger, w http.ResponseWriter, r
 			select {
 			case <-ctx.Done():
 				defer span.End()
-				// If the request context is canceled, the API server is shutting down.
+				// If the request context is canceled, the client went away or the API server was closed after the drain timeout.
 				// We want to immediately stop the long-poll and return a 200 with the ackToken and no actions.
 				if errors.Is(ctx.Err(), context.Canceled) {
 					resp := CheckinResponse{
@@ -354,12 +509,27 @@ func (ct *CheckinT) ProcessRequest(zlog zerolog.Logger, w http.ResponseWriter, r
 				}
 				return ctx.Err()
 			case acdocs := <-actCh:
+				if isSuperseded(superseded) {
+					cntLongPollSuperseded.Inc()
+					zlog.Debug().Msg("superseded by a newer long poll, drop dispatched actions")
+					break LOOP
+				}
 				var acs []Action
 				acdocs = filterActions(zlog, agent.Id, acdocs)
-				acs, ackToken = convertActions(zlog, agent.Id, acdocs)
+				acdocs = filterExpiredActions(zlog, agent.Id, acdocs, time.Now())
+				acdocs, batchToken := batchActions(acdocs, ct.cfg.Checkin.MaxActionsPerResponse)
+				acs, ackToken = convertActions(zlog, ct.verifier, agent.Id, acdocs)
+				if batchToken != "" {
+					ackToken = batchToken
+				}
 				actions = append(actions, acs...)
 				break LOOP
 			case policy := <-sub.Output():
+				if isSuperseded(superseded) {
+					cntLongPollSuperseded.Inc()
+					zlog.Debug().Msg("superseded by a newer long poll, drop policy change")
+					break LOOP
+				}
 				actionResp, err := processPolicy(ctx, zlog, ct.bulker, agent.Id, policy)
 				if err != nil {
 					span.End()
@@ -370,8 +540,15 @@ func (ct *CheckinT) ProcessRequest(zlog zerolog.Logger, w http.ResponseWriter, r
 			case <-longPoll.C:
 				zlog.Trace().Msg("fire long poll")
 				break LOOP
+			case <-ct.drainCh:
+				zlog.Debug().Msg("server is draining, end long poll")
+				break LOOP
+			case <-superseded:
+				cntLongPollSuperseded.Inc()
+				zlog.Debug().Msg("superseded by a newer long poll, end long poll")
+				break LOOP
 			case <-tick.C:
-				err := ct.bc.CheckIn(agent.Id, string(req.Status), req.Message, nil, rawComponents, nil, ver, unhealthyReason)
+				err := ct.bc.CheckIn(agent.Id, string(req.Status), req.Message, nil, rawComponents, nil, ver, unhealthyReason, "")
 				if err != nil {
 					zlog.Error().Err(err).Str(logger.AgentID, agent.Id).Msg("checkin failed")
 				}
@@ -379,6 +556,7 @@ func (ct *CheckinT) ProcessRequest(zlog zerolog.Logger, w http.ResponseWriter, r
 		}
 	}
 	span.End()
+	endPoll()
 
 	resp := CheckinResponse{
 		AckToken: &ackToken,
@@ -402,6 +580,19 @@ func (ct *CheckinT) processUpgradeDetails(ctx context.Context, agent *model.Agen
 		return nil
 	}
 	// update docs with in progress details
+	if err := validateUpgradeDetails(agent.UpgradeDetails, details); err != nil {
+		if !errors.Is(err, ErrUpgradeDetailsOrder) {
+			return err
+		}
+		// The details of an earlier checkin can arrive after newer ones, they are dropped and the checkin goes on.
+		cntUpgradeDetailsStale.Inc()
+		zerolog.Ctx(ctx).Warn().Err(err).
+			Str(logger.ActionID, details.ActionId).
+			Str("upgrade_details.state", string(details.State)).
+			Str("upgrade_details.stored_state", agent.UpgradeDetails.State).
+			Msg("Dropping stale upgrade_details")
+		return nil
+	}
 
 	// verify action exists
 	vSpan, vCtx := apm.StartSpan(ctx, "Check update action", "validate")
@@ -449,11 +640,19 @@ func (ct *CheckinT) processUpgradeDetails(ctx context.Context, agent *model.Agen
 			vSpan.End()
 			break // no validation
 		}
-		_, err := details.Metadata.AsUpgradeMetadataDownloading()
+		meta, err := details.Metadata.AsUpgradeMetadataDownloading()
 		if err != nil {
 			vSpan.End()
 			return fmt.Errorf("%w %s: %w", ErrInvalidUpgradeMetadata, UpgradeDetailsStateUPGDOWNLOADING, err)
 		}
+		if meta.DownloadPercent < 0 || meta.DownloadPercent > 100 {
+			vSpan.End()
+			return fmt.Errorf("%w: %s metadata download_percent %v is not between 0 and 100", ErrInvalidUpgradeMetadata, UpgradeDetailsStateUPGDOWNLOADING, meta.DownloadPercent)
+		}
+		if meta.DownloadRate != nil && *meta.DownloadRate < 0 {
+			vSpan.End()
+			return fmt.Errorf("%w: %s metadata contains negative download_rate", ErrInvalidUpgradeMetadata, UpgradeDetailsStateUPGDOWNLOADING)
+		}
 	case UpgradeDetailsStateUPGFAILED:
 		if details.Metadata == nil {
 			vSpan.End()
@@ -497,6 +696,36 @@ func (ct *CheckinT) processUpgradeDetails(ctx context.Context, agent *model.Agen
 	return ct.bulker.Update(ctx, dl.FleetAgents, agent.Id, body, bulk.WithRefresh(), bulk.WithRetryOnConflict(3))
 }
 
+// validateUpgradeDetails checks the state and size of the upgrade details sent by the agent,
+// and that the state does not go back from the state of the details stored for the same action.
+func validateUpgradeDetails(prev *model.UpgradeDetails, details *UpgradeDetails) error {
+	order, ok := upgradeStateOrder[details.State]
+	if !ok {
+		return fmt.Errorf("%w: unknown state %q", ErrInvalidUpgradeMetadata, details.State)
+	}
+	p, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+	if len(p) > maxUpgradeDetailsSize {
+		return fmt.Errorf("%w: upgrade_details size %d exceeds %d bytes", ErrInvalidUpgradeMetadata, len(p), maxUpgradeDetailsSize)
+	}
+
+	// details for another action start a new upgrade
+	if prev == nil || prev.ActionID != details.ActionId {
+		return nil
+	}
+	prevOrder, ok := upgradeStateOrder[UpgradeDetailsState(prev.State)]
+	if !ok || order >= prevOrder {
+		return nil
+	}
+	// an in progress upgrade can always fail or roll back
+	if details.State == UpgradeDetailsStateUPGFAILED || (details.State == UpgradeDetailsStateUPGROLLBACK && prev.State != string(UpgradeDetailsStateUPGFAILED)) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s after %s", ErrUpgradeDetailsOrder, details.State, prev.State)
+}
+
 func (ct *CheckinT) markUpgradeComplete(ctx context.Context, agent *model.Agent) error {
 	// nop if there are no checkin details, and the agent has no details
 	if agent.UpgradeDetails == nil {
@@ -505,18 +734,45 @@ func (ct *CheckinT) markUpgradeComplete(ctx context.Context, agent *model.Agent)
 	span, ctx := apm.StartSpan(ctx, "Mark update complete", "update")
 	span.Context.SetLabel("agent_id", agent.Agent.ID)
 	defer span.End()
-	// if the checkin had no details, but agent has details treat like a successful upgrade
-	doc := bulk.UpdateFields{
-		dl.FieldUpgradeDetails:   nil,
-		dl.FieldUpgradeStartedAt: nil,
-		dl.FieldUpgradeStatus:    nil,
-		dl.FieldUpgradedAt:       time.Now().UTC().Format(time.RFC3339),
+	// The fields depend on the details of the agent document, they are only written if no other writer
+	// changed the details since the document was read.
+	return dl.UpdateAgentIfUnchanged(ctx, ct.bulker, agent.Id, func(current *model.Agent) (bulk.UpdateFields, error) {
+		if current.UpgradeDetails == nil {
+			return nil, nil
+		}
+		doc := bulk.UpdateFields{
+			dl.FieldUpgradeDetails:   nil,
+			dl.FieldUpgradeStartedAt: nil,
+			dl.FieldUpgradeStatus:    nil,
+		}
+		// if the checkin had no details, but agent has details treat like a successful upgrade
+		// unless the last details reported a failure, the failed upgrade is only cleared.
+		if current.UpgradeDetails.State != string(UpgradeDetailsStateUPGFAILED) {
+			doc[dl.FieldUpgradedAt] = time.Now().UTC().Format(time.RFC3339)
+		}
+		return doc, nil
+	}, bulk.WithRefresh())
+}
+
+// updateTags replaces the tags of the agent record with the tags reported on checkin.
+func (ct *CheckinT) updateTags(ctx context.Context, agent *model.Agent, tags []string) error {
+	span, ctx := apm.StartSpan(ctx, "updateTags", "update")
+	defer span.End()
+	if tags == nil {
+		tags = []string{}
 	}
-	body, err := doc.Marshal()
+	body, err := bulk.UpdateFields{
+		dl.FieldTags:      tags,
+		dl.FieldUpdatedAt: time.Now().UTC().Format(time.RFC3339),
+	}.Marshal()
 	if err != nil {
 		return err
 	}
-	return ct.bulker.Update(ctx, dl.FleetAgents, agent.Id, body, bulk.WithRefresh(), bulk.WithRetryOnConflict(3))
+	if err := ct.bulker.Update(ctx, dl.FleetAgents, agent.Id, body, bulk.WithRefresh(), bulk.WithRetryOnConflict(3)); err != nil {
+		return err
+	}
+	agent.Tags = tags
+	return nil
 }
 
 func (ct *CheckinT) writeResponse(zlog zerolog.Logger, w http.ResponseWriter, r *http.Request, agent *model.Agent, resp CheckinResponse) error {
@@ -564,61 +820,37 @@ func (ct *CheckinT) writeResponse(zlog zerolog.Logger, w http.ResponseWriter, r
 	rSpan, _ := apm.StartSpan(ctx, "response", "write")
 	defer rSpan.End()
 
-	payload, err := json.Marshal(&resp)
-	if err != nil {
-		return fmt.Errorf("writeResponse marshal: %w", err)
-	}
-
 	compressionLevel := ct.cfg.CompressionLevel
-	compressThreshold := ct.cfg.CompressionThresh
-
-	if len(payload) > compressThreshold && compressionLevel != flate.NoCompression && acceptsEncoding(r, kEncodingGzip) {
-		wrCounter := datacounter.NewWriterCounter(w)
 
-		zipper, _ := ct.gwPool.Get().(*gzip.Writer)
-
-		defer ct.gwPool.Put(zipper)
-		zipper.Reset(wrCounter)
-
-		w.Header().Set("Content-Encoding", kEncodingGzip)
-		if _, err = zipper.Write(payload); err != nil {
-			return fmt.Errorf("writeResponse gzip write: %w", err)
-		}
-
-		if err = zipper.Close(); err != nil {
-			err = fmt.Errorf("writeResponse gzip close: %w", err)
-		}
+	w.Header().Add("Vary", "Accept-Encoding")
+	encoding := negotiateEncoding(r)
+	if compressionLevel == flate.NoCompression {
+		encoding = ""
+	}
 
-		cntCheckin.bodyOut.Add(wrCounter.Count())
+	// The response is encoded straight to the writer, it is compressed once it is over the threshold.
+	tw := newThresholdWriter(w, ct.encPool, encoding, ct.cfg.CompressionThresh)
+	err := json.NewEncoder(tw).Encode(&resp)
+	if cErr := tw.close(); err == nil && cErr != nil {
+		err = fmt.Errorf("writeResponse %s close: %w", encoding, cErr)
+	} else if err != nil {
+		err = fmt.Errorf("writeResponse encode: %w", err)
+	}
+	cntCheckin.bodyOut.Add(tw.counter.Count())
 
+	if tw.compressing {
 		zlog.Trace().
 			Err(err).
+			Str("encoding", encoding).
 			Int("lvl", compressionLevel).
-			Int("srcSz", len(payload)).
-			Uint64("dstSz", wrCounter.Count()).
+			Int("srcSz", tw.srcSz).
+			Uint64("dstSz", tw.counter.Count()).
 			Msg("compressing checkin response")
-	} else {
-		var nWritten int
-		nWritten, err = w.Write(payload)
-		cntCheckin.bodyOut.Add(uint64(nWritten))
-
-		if err != nil {
-			err = fmt.Errorf("writeResponse payload: %w", err)
-		}
 	}
 
 	return err
 }
 
-func acceptsEncoding(r *http.Request, encoding string) bool {
-	for _, v := range r.Header.Values("Accept-Encoding") {
-		if v == encoding {
-			return true
-		}
-	}
-	return false
-}
-
 // Resolve AckToken from request, fallback on the agent record
 func (ct *CheckinT) resolveSeqNo(ctx context.Context, zlog zerolog.Logger, req CheckinRequest, agent *model.Agent) (sqn.SeqNo, error) {
 	span, ctx := apm.StartSpan(ctx, "resolveSeqNo", "validate")
@@ -646,8 +878,8 @@ func (ct *CheckinT) resolveSeqNo(ctx context.Context, zlog zerolog.Logger, req C
 	return seqno, err
 }
 
-func (ct *CheckinT) fetchAgentPendingActions(ctx context.Context, seqno sqn.SeqNo, agentID string) ([]model.Action, error) {
-	actions, err := dl.FindAgentActions(ctx, ct.bulker, seqno, ct.gcp.GetCheckpoint(), agentID)
+func (ct *CheckinT) fetchAgentPendingActions(ctx context.Context, seqno sqn.SeqNo, agent *model.Agent) ([]model.Action, error) {
+	actions, err := dl.FindAgentActions(ctx, ct.bulker, seqno, ct.gcp.GetCheckpoint(), agent.Id, agent.Tags, agent.Namespaces)
 	if err != nil {
 		return nil, fmt.Errorf("fetchAgentPendingActions: %w", err)
 	}
@@ -655,6 +887,52 @@ func (ct *CheckinT) fetchAgentPendingActions(ctx context.Context, seqno sqn.SeqN
 	return actions, err
 }
 
+// filterAckedActions removes the actions the agent already has a result for from the passed list.
+// This happens when the agent acked the actions but checks in with a stale ack token, for example after a restart.
+// The acked state of the actions is cached per agent for the poll duration, and no lookup is done if the list is empty.
+func (ct *CheckinT) filterAckedActions(ctx context.Context, zlog zerolog.Logger, agentID string, actions []Action, ttl time.Duration) []Action {
+	if len(actions) == 0 {
+		return actions
+	}
+
+	cached, _ := ct.cache.GetActionResults(agentID)
+	var missing []string
+	for _, action := range actions {
+		if _, ok := cached[action.Id]; !ok {
+			missing = append(missing, action.Id)
+		}
+	}
+
+	acked := cached
+	if len(missing) > 0 {
+		found, err := dl.FindAckedActionIDs(ctx, ct.bulker, agentID, missing)
+		if err != nil {
+			// Delivering an action twice is preferred over failing the checkin, agents ignore actions they already executed.
+			zlog.Warn().Err(err).Str(logger.AgentID, agentID).Msg("unable to lookup action results, pending actions are not deduplicated")
+			return actions
+		}
+		acked = make(map[string]bool, len(cached)+len(missing))
+		for id, v := range cached {
+			acked[id] = v
+		}
+		for _, id := range missing {
+			_, ok := found[id]
+			acked[id] = ok
+		}
+		ct.cache.SetActionResults(agentID, acked, ttl)
+	}
+
+	resp := make([]Action, 0, len(actions))
+	for _, action := range actions {
+		if acked[action.Id] {
+			zlog.Debug().Str(logger.AgentID, agentID).Str(logger.ActionID, action.Id).Msg("Removing action already acked by the agent from check in response")
+			continue
+		}
+		resp = append(resp, action)
+	}
+	return resp
+}
+
 // filterActions removes the POLICY_CHANGE, UPDATE_TAGS, FORCE_UNENROLL action from the passed list as well as any unknown action types.
 // The source of this list are documents from the fleet actions index.
 // The POLICY_CHANGE action that the agent receives are generated by the fleet-server when it detects a different policy in processRequest()
@@ -671,6 +949,83 @@ func filterActions(zlog zerolog.Logger, agentID string, actions []model.Action)
 	return resp
 }
 
+// filterExpiredActions removes the actions that expired at or before now from the passed list.
+// The actions index query only returns actions that are not expired, but an action can expire
+// while it is waiting to be delivered on a long poll.
+// Actions with an expiration that can not be parsed are kept.
+func filterExpiredActions(zlog zerolog.Logger, agentID string, actions []model.Action, now time.Time) []model.Action {
+	resp := make([]model.Action, 0, len(actions))
+	for _, action := range actions {
+		if action.Expiration != "" {
+			expiration, err := time.Parse(time.RFC3339, action.Expiration)
+			if err != nil {
+				zlog.Warn().Err(err).Str(logger.AgentID, agentID).Str(logger.ActionID, action.ActionID).Msg("Unable to parse action expiration")
+			} else if !expiration.After(now) {
+				zlog.Info().Str(logger.AgentID, agentID).Str(logger.ActionID, action.ActionID).Str(logger.ActionType, action.Type).Str("expiration", action.Expiration).Msg("Removing expired action from check in response")
+				continue
+			}
+		}
+		resp = append(resp, action)
+	}
+	return resp
+}
+
+// priorityActionTypes are the types of the actions that are always returned in the first batch of a checkin response.
+var priorityActionTypes = map[string]bool{
+	string(UPGRADE):  true,
+	string(UNENROLL): true,
+}
+
+// batchActions returns the batch of at most maxActions actions returned in a checkin response, 0 returns all the actions.
+// The upgrade and unenroll actions are always in the batch, the other actions fill it in creation order and the
+// actions of the batch keep their order.
+// If the actions do not all fit, the ack token of the batch is the ID of the last action that all the actions created
+// before it are in the batch, the agent gets the remaining actions from it on its next checkins. A priority action
+// created after it may then be returned again until the agent acks it.
+func batchActions(actions []model.Action, maxActions int) ([]model.Action, string) {
+	if maxActions <= 0 || len(actions) <= maxActions {
+		return actions, ""
+	}
+
+	inBatch := make([]bool, len(actions))
+	n := 0
+	maxPriority := maxActions
+	if !priorityActionTypes[actions[0].Type] {
+		// The first action is always in the batch so that the ack token moves forward.
+		maxPriority--
+	}
+	for i, action := range actions {
+		if n == maxPriority {
+			break
+		}
+		if priorityActionTypes[action.Type] {
+			inBatch[i] = true
+			n++
+		}
+	}
+	for i := range actions {
+		if n == maxActions {
+			break
+		}
+		if !inBatch[i] {
+			inBatch[i] = true
+			n++
+		}
+	}
+
+	batch := make([]model.Action, 0, maxActions)
+	for i, action := range actions {
+		if inBatch[i] {
+			batch = append(batch, action)
+		}
+	}
+	var ackToken string
+	for i := 0; i < len(actions) && inBatch[i]; i++ {
+		ackToken = actions[i].Id
+	}
+	return batch, ackToken
+}
+
 // convertActionData converts the passed raw message data to Action_Data using aType as a discriminator.
 //
 // raw is first parsed into the action-specific data struct then passed into Action_Data in order to remove any undefined keys.
@@ -740,13 +1095,20 @@ func convertActionData(aType ActionType, raw json.RawMessage) (ad Action_Data, e
 	}
 }
 
+// convertActions converts the actions to the checkin response actions.
+// The actions that v does not accept are not dispatched, the ack token still moves past them.
+//
 //nolint:gosec // memory aliasing is used to convert from pointers to values and the other way
-func convertActions(zlog zerolog.Logger, agentID string, actions []model.Action) ([]Action, string) {
+func convertActions(zlog zerolog.Logger, v *signing.Verifier, agentID string, actions []model.Action) ([]Action, string) {
 	var ackToken string
 	sz := len(actions)
 
 	respList := make([]Action, 0, sz)
 	for _, action := range actions {
+		if err := v.VerifyAction(&action); err != nil {
+			zlog.Error().Err(err).Str(logger.ActionID, action.ActionID).Str(logger.ActionType, action.Type).Msg("Action signature verification failed, action not dispatched")
+			continue
+		}
 		ad, err := convertActionData(ActionType(action.Type), action.Data)
 		if err != nil {
 			zlog.Error().Err(err).Str(logger.ActionID, action.ActionID).Str(logger.ActionType, action.Type).Msg("Failed to convert action.Data")
@@ -813,41 +1175,44 @@ func processPolicy(ctx context.Context, zlog zerolog.Logger, bulker bulk.Bulk, a
 		return nil, err
 	}
 
+	return renderAgentPolicy(zlog, &agent, pp, func(output *policy.Output, outputs map[string]map[string]interface{}) error {
+		return output.Prepare(ctx, zlog, bulker, &agent, outputs)
+	})
+}
+
+// prepareOutputFunc prepares an output of the policy for the agent, outputs are the outputs rendered for the agent.
+type prepareOutputFunc func(output *policy.Output, outputs map[string]map[string]interface{}) error
+
+// renderAgentPolicy renders the POLICY_CHANGE action of the policy for the agent, its outputs are prepared with prepare.
+func renderAgentPolicy(zlog zerolog.Logger, agent *model.Agent, pp *policy.ParsedPolicy, prepare prepareOutputFunc) (*Action, error) {
+	// The agent is not sent a policy of a namespace it is not in, for example after the policy moved to another space.
+	if !model.InNamespaces(agent.Namespaces, pp.Policy.Namespaces) {
+		zlog.Warn().
+			Strs("agent.namespaces", agent.Namespaces).
+			Strs("policy.namespaces", pp.Policy.Namespaces).
+			Msg("policy is not in the agent namespaces")
+		return nil, ErrPolicyNamespace
+	}
+
 	if len(pp.Policy.Data.Outputs) == 0 {
 		return nil, ErrNoPolicyOutput
 	}
 
-	data := model.ClonePolicyData(pp.Policy.Data)
-	for policyName, policyOutput := range data.Outputs {
-		err := policy.ProcessOutputSecret(ctx, policyOutput, bulker)
-		if err != nil {
-			return nil, fmt.Errorf("failed to process output secrets %q: %w",
-				policyName, err)
-		}
+	// The parsed policy is shared by all the agents subscribed to it, its output secrets are resolved when it's parsed.
+	// The outputs are prepared for the agent on a shallow copy, preparing an output only sets its top level keys.
+	outputs := make(map[string]map[string]interface{}, len(pp.Policy.Data.Outputs))
+	for name, output := range pp.Policy.Data.Outputs {
+		outputs[name] = maps.Clone(output)
 	}
 	// Iterate through the policy outputs and prepare them
 	for _, policyOutput := range pp.Outputs {
-		err = policyOutput.Prepare(ctx, zlog, bulker, &agent, data.Outputs)
-		if err != nil {
+		if err := prepare(&policyOutput, outputs); err != nil {
 			return nil, fmt.Errorf("failed to prepare output %q: %w",
 				policyOutput.Name, err)
 		}
 	}
-	// Add replace inputs with agent prepared version.
-	data.Inputs = pp.Inputs
 
-	// JSON transformations to turn a model.PolicyData into an Action.data
-	p, err := json.Marshal(data)
-	if err != nil {
-		return nil, err
-	}
-	d := PolicyData{}
-	err = json.Unmarshal(p, &d)
-	if err != nil {
-		return nil, err
-	}
-	ad := Action_Data{}
-	err = ad.FromActionPolicyChange(ActionPolicyChange{d})
+	ad, err := renderPolicyChange(pp, outputs)
 	if err != nil {
 		return nil, err
 	}
@@ -870,33 +1235,49 @@ func getAgentAndVerifyAPIKeyID(ctx context.Context, bulker bulk.Bulk, agentID st
 	agent, err := dl.GetAgent(ctx, bulker, agentID)
 	if err != nil {
 		if errors.Is(err, dl.ErrNotFound) {
-			err = ErrAgentNotFound
-		} else {
-			err = fmt.Errorf("GetAgent: %w", err)
+			return nil, ErrAgentNotFound
 		}
+		return nil, fmt.Errorf("GetAgent: %w", err)
 	}
 
 	if agent.AccessAPIKeyID != apiKeyID {
-		err = fmt.Errorf("invalid API Key ID %w", ErrAgentIdentity)
+		return &agent, fmt.Errorf("invalid API Key ID %w", ErrAgentIdentity)
 	}
 
-	return &agent, err
+	return &agent, nil
 }
 
+// findAgentByAPIKeyID searches the agent of the access API key. When the search misses, the agent document may have
+// been written by an enrollment that did not wait for a refresh, it is then read with a realtime get by the agent ID
+// recorded in the metadata of the API key.
 func findAgentByAPIKeyID(ctx context.Context, bulker bulk.Bulk, id string) (*model.Agent, error) {
 	span, ctx := apm.StartSpan(ctx, "findAgentByID", "search")
 	defer span.End()
 	agent, err := dl.FindAgent(ctx, bulker, dl.QueryAgentByAssessAPIKeyID, dl.FieldAccessAPIKeyID, id)
 	if err != nil {
 		if errors.Is(err, dl.ErrNotFound) {
-			err = ErrAgentNotFound
-		} else {
-			err = fmt.Errorf("findAgentByApiKeyId: %w", err)
+			return getAgentByAPIKeyMetadata(ctx, bulker, id)
 		}
+		err = fmt.Errorf("findAgentByApiKeyId: %w", err)
 	}
 	return &agent, err
 }
 
+// getAgentByAPIKeyMetadata reads the agent recorded in the metadata of the access API key with a realtime get.
+func getAgentByAPIKeyMetadata(ctx context.Context, bulker bulk.Bulk, id string) (*model.Agent, error) {
+	key, err := bulker.APIKeyRead(ctx, id, false)
+	if err != nil {
+		if errors.Is(err, apikey.ErrAPIKeyNotFound) {
+			return &model.Agent{}, ErrAgentNotFound
+		}
+		return &model.Agent{}, fmt.Errorf("findAgentByApiKeyId: %w", err)
+	}
+	if key.Metadata.AgentID == "" || key.Metadata.Type != apikey.TypeAccess.String() {
+		return &model.Agent{}, ErrAgentNotFound
+	}
+	return getAgentAndVerifyAPIKeyID(ctx, bulker, key.Metadata.AgentID, id)
+}
+
 // parseMeta compares the agent and the request local_metadata content
 // and returns fields to update the agent record or nil
 func parseMeta(zlog zerolog.Logger, agent *model.Agent, req *CheckinRequest) ([]byte, error) {
@@ -911,20 +1292,34 @@ func parseMeta(zlog zerolog.Logger, agent *model.Agent, req *CheckinRequest) ([]
 		return nil, nil
 	}
 
-	// Deserialize the request metadata
-	var reqLocalMeta interface{}
-	if err := json.Unmarshal(*req.LocalMetadata, &reqLocalMeta); err != nil {
+	// Compare the compacted payloads next, the metadata structures are only deserialized when the payloads differ by
+	// more than their whitespace, such as by the order of their keys.
+	reqBuf, agentBuf := getBuffer(), getBuffer()
+	defer putBuffer(reqBuf)
+	defer putBuffer(agentBuf)
+	if err := json.Compact(reqBuf, *req.LocalMetadata); err != nil {
 		return nil, fmt.Errorf("parseMeta request: %w", err)
 	}
 
 	// If empty, don't step on existing data
-	if reqLocalMeta == nil {
+	if bytes.Equal(reqBuf.Bytes(), []byte("null")) {
 		return nil, nil
 	}
 
-	// Deserialize the agent's metadata copy
-	var agentLocalMeta interface{}
-	if err := json.Unmarshal(agent.LocalMetadata, &agentLocalMeta); err != nil {
+	if err := json.Compact(agentBuf, agent.LocalMetadata); err != nil {
+		return nil, fmt.Errorf("parseMeta local: %w", err)
+	}
+	if bytes.Equal(reqBuf.Bytes(), agentBuf.Bytes()) {
+		zlog.Trace().Msg("compacted local metadata is equal")
+		return nil, nil
+	}
+
+	// Deserialize the meta structures
+	var reqLocalMeta, agentLocalMeta interface{}
+	if err := json.Unmarshal(reqBuf.Bytes(), &reqLocalMeta); err != nil {
+		return nil, fmt.Errorf("parseMeta request: %w", err)
+	}
+	if err := json.Unmarshal(agentBuf.Bytes(), &agentLocalMeta); err != nil {
 		return nil, fmt.Errorf("parseMeta local: %w", err)
 	}
 
@@ -974,11 +1369,15 @@ func parseComponents(zlog zerolog.Logger, agent *model.Agent, req *CheckinReques
 		return nil, &unhealthyReason, nil
 	}
 
+	if len(*req.Components) > maxComponentsSize {
+		return nil, &unhealthyReason, &BadRequestErr{msg: fmt.Sprintf("components size %d exceeds %d bytes", len(*req.Components), maxComponentsSize)}
+	}
+
 	// Deserialize the request components data
 	var reqComponents []model.ComponentsItems
 	if len(*req.Components) > 0 {
 		if err := json.Unmarshal(*req.Components, &reqComponents); err != nil {
-			return nil, &unhealthyReason, fmt.Errorf("parseComponents request: %w", err)
+			return nil, &unhealthyReason, &BadRequestErr{msg: "unable to parse components", nextErr: err}
 		}
 	}
 
@@ -987,10 +1386,22 @@ func parseComponents(zlog zerolog.Logger, agent *model.Agent, req *CheckinReques
 		return nil, &unhealthyReason, nil
 	}
 
+	if err := validateComponents(reqComponents); err != nil {
+		return nil, &unhealthyReason, &BadRequestErr{msg: "invalid components", nextErr: err}
+	}
+
 	var outComponents []byte
 
-	// Compare the deserialized meta structures and return the bytes to update if different
-	if !reflect.DeepEqual(reqComponents, agent.Components) {
+	// Compare the hashes of the normalized components and return the bytes to update if different
+	reqHash, err := componentsHash(reqComponents)
+	if err != nil {
+		return nil, &unhealthyReason, err
+	}
+	agentHash, err := componentsHash(agent.Components)
+	if err != nil {
+		return nil, &unhealthyReason, err
+	}
+	if reqHash != agentHash {
 
 		zlog.Trace().
 			RawJSON("oldComponents", agentComponentsJSON).
@@ -1002,6 +1413,7 @@ func parseComponents(zlog zerolog.Logger, agent *model.Agent, req *CheckinReques
 			Msg("applying new components data")
 
 		outComponents = *req.Components
+		logUnknownComponentStates(zlog, reqComponents)
 		compUnhealthyReason := calcUnhealthyReason(reqComponents)
 		if len(compUnhealthyReason) > 0 {
 			unhealthyReason = compUnhealthyReason
@@ -1013,6 +1425,44 @@ func parseComponents(zlog zerolog.Logger, agent *model.Agent, req *CheckinReques
 	return outComponents, &unhealthyReason, nil
 }
 
+// validateComponents checks the types of the units of the components.
+func validateComponents(components []model.ComponentsItems) error {
+	for _, component := range components {
+		for _, unit := range component.Units {
+			if unit.Type != "input" && unit.Type != "output" {
+				return fmt.Errorf("unit %q of component %q has invalid type %q", unit.ID, component.ID, unit.Type)
+			}
+		}
+	}
+	return nil
+}
+
+// logUnknownComponentStates logs and counts the components and units reporting a state that is not known.
+func logUnknownComponentStates(zlog zerolog.Logger, components []model.ComponentsItems) {
+	for _, component := range components {
+		if !knownComponentStates[component.Status] {
+			cntComponentStateUnknown.Inc()
+			zlog.Warn().Str("component.id", component.ID).Str("component.status", component.Status).Msg("Component reports an unknown state")
+		}
+		for _, unit := range component.Units {
+			if !knownComponentStates[unit.Status] {
+				cntComponentStateUnknown.Inc()
+				zlog.Warn().Str("component.id", component.ID).Str("unit.id", unit.ID).Str("unit.status", unit.Status).Msg("Component unit reports an unknown state")
+			}
+		}
+	}
+}
+
+// componentsHash returns the hash of the components serialized in their model form,
+// so the key order and formatting of the checkin body do not change the hash.
+func componentsHash(components []model.ComponentsItems) ([sha256.Size]byte, error) {
+	p, err := json.Marshal(components)
+	if err != nil {
+		return [sha256.Size]byte{}, fmt.Errorf("components marshal: %w", err)
+	}
+	return sha256.Sum256(p), nil
+}
+
 func calcUnhealthyReason(reqComponents []model.ComponentsItems) []string {
 	var unhealthyReason []string
 	hasUnhealthyInput := false
@@ -1070,10 +1520,12 @@ func calcPollDuration(zlog zerolog.Logger, pollDuration, setupDuration, jitterDu
 	var jitter time.Duration
 	if jitterDuration != 0 {
 		jitter = time.Duration(rand.Int63n(int64(jitterDuration))) //nolint:gosec // jitter time does not need to by generated from a crypto secure source
-		if jitter < pollDuration {
-			pollDuration = pollDuration - jitter
-			zlog.Trace().Dur("poll", pollDuration).Msg("Long poll with jitter")
+		// Jitter never shortens the long poll below minJitteredPoll.
+		if maxJitter := max(pollDuration-minJitteredPoll, 0); jitter > maxJitter {
+			jitter = maxJitter
 		}
+		pollDuration -= jitter
+		zlog.Trace().Dur("poll", pollDuration).Msg("Long poll with jitter")
 	}
 
 	return pollDuration, jitter
@@ -7,16 +7,25 @@
 package api
 
 import (
+	"bytes"
 	"compress/flate"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/elastic/fleet-server/v7/internal/pkg/action"
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
 	"github.com/elastic/fleet-server/v7/internal/pkg/cache"
 	"github.com/elastic/fleet-server/v7/internal/pkg/checkin"
 	"github.com/elastic/fleet-server/v7/internal/pkg/config"
@@ -25,6 +34,7 @@ import (
 	"github.com/elastic/fleet-server/v7/internal/pkg/model"
 	mockmonitor "github.com/elastic/fleet-server/v7/internal/pkg/monitor/mock"
 	"github.com/elastic/fleet-server/v7/internal/pkg/policy"
+	"github.com/elastic/fleet-server/v7/internal/pkg/signing"
 	"github.com/elastic/fleet-server/v7/internal/pkg/sqn"
 	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
 	testcache "github.com/elastic/fleet-server/v7/internal/pkg/testing/cache"
@@ -196,13 +206,38 @@ func TestConvertActions(t *testing.T) {
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
 			logger := testlog.SetLogger(t)
-			resp, token := convertActions(logger, "agent-id", tc.actions)
+			resp, token := convertActions(logger, nil, "agent-id", tc.actions)
 			assert.Equal(t, tc.resp, resp)
 			assert.Equal(t, tc.token, token)
 		})
 	}
 }
 
+func TestConvertActionsVerifySignature(t *testing.T) {
+	tampered := ftesting.SignedAction()
+	tampered.Data = base64.StdEncoding.EncodeToString([]byte(`{"action_id":"action-1","type":"UNENROLL","agents":["*"]}`))
+	actions := []model.Action{
+		{ESDocument: model.ESDocument{Id: "1"}, ActionID: "action-1", Type: "UNENROLL", Agents: []string{"agent-1"}, Signed: ftesting.SignedAction()},
+		{ESDocument: model.ESDocument{Id: "2"}, ActionID: "action-2", Type: "UNENROLL", Signed: tampered},
+		{ESDocument: model.ESDocument{Id: "3"}, ActionID: "action-3", Type: "UNENROLL"},
+		// The valid signed block of action-1 is copied onto another action.
+		{ESDocument: model.ESDocument{Id: "4"}, ActionID: "action-4", Type: "UNENROLL", Agents: []string{"agent-1"}, Signed: ftesting.SignedAction()},
+	}
+
+	v := signing.NewVerifier(&config.Signing{Verify: true, PublicKey: ftesting.SigningPublicKey})
+	resp, token := convertActions(testlog.SetLogger(t), v, "agent-1", actions)
+	require.Len(t, resp, 1)
+	assert.Equal(t, "action-1", resp[0].Id)
+	assert.Equal(t, &ActionSignature{Data: ftesting.SignedAction().Data, Signature: ftesting.SignedAction().Signature}, resp[0].Signed)
+	assert.Equal(t, "4", token, "the ack token moves past the rejected actions")
+
+	// Without verification the signed block is passed through as it is.
+	resp, _ = convertActions(testlog.SetLogger(t), nil, "agent-1", actions)
+	require.Len(t, resp, 4)
+	assert.Equal(t, tampered.Data, resp[1].Signed.Data)
+	assert.Nil(t, resp[2].Signed)
+}
+
 func TestFilterActions(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -271,6 +306,235 @@ func TestFilterActions(t *testing.T) {
 	}
 }
 
+func TestFilterExpiredActions(t *testing.T) {
+	now := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		actions []model.Action
+		resp    []model.Action
+	}{{
+		name:    "empty list",
+		actions: []model.Action{},
+		resp:    []model.Action{},
+	}, {
+		name:    "no expiration",
+		actions: []model.Action{{ActionID: "1234"}},
+		resp:    []model.Action{{ActionID: "1234"}},
+	}, {
+		name:    "expires after now",
+		actions: []model.Action{{ActionID: "1234", Expiration: "2024-01-02T12:00:01Z"}},
+		resp:    []model.Action{{ActionID: "1234", Expiration: "2024-01-02T12:00:01Z"}},
+	}, {
+		name:    "expires at now",
+		actions: []model.Action{{ActionID: "1234", Expiration: "2024-01-02T12:00:00Z"}},
+		resp:    []model.Action{},
+	}, {
+		name:    "expires at now with fractional seconds",
+		actions: []model.Action{{ActionID: "1234", Expiration: "2024-01-02T12:00:00.001Z"}},
+		resp:    []model.Action{{ActionID: "1234", Expiration: "2024-01-02T12:00:00.001Z"}},
+	}, {
+		name:    "expired",
+		actions: []model.Action{{ActionID: "1234", Expiration: "2024-01-01T12:00:00Z"}, {ActionID: "5678"}},
+		resp:    []model.Action{{ActionID: "5678"}},
+	}, {
+		name:    "invalid expiration",
+		actions: []model.Action{{ActionID: "1234", Expiration: "tomorrow"}},
+		resp:    []model.Action{{ActionID: "1234", Expiration: "tomorrow"}},
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			logger := testlog.SetLogger(t)
+			resp := filterExpiredActions(logger, "agent-id", tc.actions, now)
+			assert.Equal(t, tc.resp, resp)
+		})
+	}
+}
+
+func TestBatchActions(t *testing.T) {
+	const maxActions = 100
+	actions := make([]model.Action, 250)
+	for i := range actions {
+		actions[i] = model.Action{
+			ESDocument: model.ESDocument{Id: fmt.Sprintf("doc-%03d", i)},
+			ActionID:   fmt.Sprintf("action-%03d", i),
+			Type:       string(INPUTACTION),
+		}
+	}
+	actions[180].Type = string(UPGRADE)
+	actions[230].Type = string(UNENROLL)
+
+	// The agent checks in with the ack token of each response until all the actions are returned.
+	var batches [][]model.Action
+	pending := actions
+	for {
+		batch, ackToken := batchActions(pending, maxActions)
+		require.LessOrEqual(t, len(batch), maxActions)
+		batches = append(batches, batch)
+		if ackToken == "" {
+			break
+		}
+		i := slices.IndexFunc(pending, func(a model.Action) bool { return a.Id == ackToken })
+		require.GreaterOrEqual(t, i, 0, "ack token is one of the pending actions")
+		assert.Equal(t, batch[i].Id, ackToken, "the actions up to the ack token are returned in order")
+		pending = pending[i+1:]
+	}
+	require.Len(t, batches, 3)
+
+	ids := func(batch []model.Action) []string {
+		r := make([]string, 0, len(batch))
+		for _, a := range batch {
+			r = append(r, a.ActionID)
+		}
+		return r
+	}
+	first := ids(batches[0])
+	assert.Len(t, first, maxActions)
+	assert.Equal(t, ids(actions[:98]), first[:98], "the other actions fill the batch in creation order")
+	assert.Equal(t, []string{"action-180", "action-230"}, first[98:], "the upgrade and unenroll actions are in the first batch")
+
+	// Each action is returned in creation order, the priority actions may be returned again until the ack token passes them.
+	var delivered []string
+	for _, batch := range batches {
+		assert.True(t, slices.IsSortedFunc(batch, func(a, b model.Action) int { return strings.Compare(a.Id, b.Id) }))
+		for _, a := range batch {
+			if a.Type == string(INPUTACTION) {
+				delivered = append(delivered, a.ActionID)
+			}
+		}
+	}
+	var expected []string
+	for _, a := range actions {
+		if a.Type == string(INPUTACTION) {
+			expected = append(expected, a.ActionID)
+		}
+	}
+	assert.Equal(t, expected, delivered)
+
+	t.Run("all actions fit", func(t *testing.T) {
+		batch, ackToken := batchActions(actions[:maxActions], maxActions)
+		assert.Equal(t, actions[:maxActions], batch)
+		assert.Empty(t, ackToken)
+	})
+	t.Run("unlimited", func(t *testing.T) {
+		batch, ackToken := batchActions(actions, 0)
+		assert.Equal(t, actions, batch)
+		assert.Empty(t, ackToken)
+	})
+	t.Run("priority actions do not block the first action", func(t *testing.T) {
+		pending := []model.Action{
+			{ESDocument: model.ESDocument{Id: "doc-0"}, Type: string(INPUTACTION)},
+			{ESDocument: model.ESDocument{Id: "doc-1"}, Type: string(UPGRADE)},
+			{ESDocument: model.ESDocument{Id: "doc-2"}, Type: string(UNENROLL)},
+		}
+		batch, ackToken := batchActions(pending, 2)
+		assert.Equal(t, []model.Action{pending[0], pending[1]}, batch)
+		assert.Equal(t, "doc-1", ackToken)
+	})
+}
+
+func TestFilterAckedActions(t *testing.T) {
+	const ttl = 5 * time.Minute
+	pending := []Action{{Id: "acked-action"}, {Id: "new-action"}}
+	tests := []struct {
+		name    string
+		actions []Action
+		bulk    func() *ftesting.MockBulk
+		cache   func() *testcache.MockCache
+		resp    []Action
+	}{{
+		name:    "no pending actions",
+		actions: []Action{},
+		bulk: func() *ftesting.MockBulk {
+			return ftesting.NewMockBulk()
+		},
+		cache: func() *testcache.MockCache {
+			return testcache.NewMockCache()
+		},
+		resp: []Action{},
+	}, {
+		name:    "acked action is removed",
+		actions: pending,
+		bulk: func() *ftesting.MockBulk {
+			mBulk := ftesting.NewMockBulk()
+			mBulk.On("Search", mock.Anything, dl.FleetActionsResults, mock.Anything, mock.Anything).Return(
+				&es.ResultT{
+					HitsT: es.HitsT{
+						Hits: []es.HitT{
+							{Source: []byte(`{"action_id": "acked-action"}`)},
+						},
+					},
+				}, nil)
+			return mBulk
+		},
+		cache: func() *testcache.MockCache {
+			mCache := testcache.NewMockCache()
+			mCache.On("GetActionResults", "agent-id").Return(nil, false)
+			mCache.On("SetActionResults", "agent-id", map[string]bool{"acked-action": true, "new-action": false}, ttl)
+			return mCache
+		},
+		resp: []Action{{Id: "new-action"}},
+	}, {
+		name:    "acked action is removed from cache",
+		actions: pending,
+		bulk: func() *ftesting.MockBulk {
+			return ftesting.NewMockBulk()
+		},
+		cache: func() *testcache.MockCache {
+			mCache := testcache.NewMockCache()
+			mCache.On("GetActionResults", "agent-id").Return(map[string]bool{"acked-action": true, "new-action": false}, true)
+			return mCache
+		},
+		resp: []Action{{Id: "new-action"}},
+	}, {
+		name:    "only actions missing from cache are looked up",
+		actions: pending,
+		bulk: func() *ftesting.MockBulk {
+			mBulk := ftesting.NewMockBulk()
+			mBulk.On("Search", mock.Anything, dl.FleetActionsResults, mock.Anything, mock.Anything).Return(&es.ResultT{}, nil)
+			return mBulk
+		},
+		cache: func() *testcache.MockCache {
+			mCache := testcache.NewMockCache()
+			mCache.On("GetActionResults", "agent-id").Return(map[string]bool{"acked-action": true}, true)
+			mCache.On("SetActionResults", "agent-id", map[string]bool{"acked-action": true, "new-action": false}, ttl)
+			return mCache
+		},
+		resp: []Action{{Id: "new-action"}},
+	}, {
+		name:    "lookup failure returns all actions",
+		actions: pending,
+		bulk: func() *ftesting.MockBulk {
+			mBulk := ftesting.NewMockBulk()
+			mBulk.On("Search", mock.Anything, dl.FleetActionsResults, mock.Anything, mock.Anything).Return(&es.ResultT{}, errors.New("network error"))
+			return mBulk
+		},
+		cache: func() *testcache.MockCache {
+			mCache := testcache.NewMockCache()
+			mCache.On("GetActionResults", "agent-id").Return(nil, false)
+			return mCache
+		},
+		resp: pending,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			logger := testlog.SetLogger(t)
+			mBulk := tc.bulk()
+			mCache := tc.cache()
+
+			ct := &CheckinT{
+				cache:  mCache,
+				bulker: mBulk,
+			}
+
+			resp := ct.filterAckedActions(context.Background(), logger, "agent-id", tc.actions, ttl)
+			assert.Equal(t, tc.resp, resp)
+			mBulk.AssertExpectations(t)
+			mCache.AssertExpectations(t)
+		})
+	}
+}
+
 func TestResolveSeqNo(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -309,6 +573,26 @@ func TestResolveSeqNo(t *testing.T) {
 
 }
 
+// upgradeCompleteFields returns the fields of the update that marks an upgrade complete.
+func upgradeCompleteFields(t *testing.T, p []byte) (map[string]interface{}, bool) {
+	var body struct {
+		Doc    map[string]interface{} `json:"doc"`
+		Script struct {
+			Params struct {
+				Fields map[string]interface{} `json:"fields"`
+			} `json:"params"`
+		} `json:"script"`
+	}
+	if err := json.Unmarshal(p, &body); err != nil {
+		t.Logf("bulk match unmarshal error: %v", err)
+		return nil, false
+	}
+	if body.Doc != nil {
+		return body.Doc, true
+	}
+	return body.Script.Params.Fields, body.Script.Params.Fields != nil
+}
+
 func TestProcessUpgradeDetails(t *testing.T) {
 	esd := model.ESDocument{Id: "doc-ID"}
 	tests := []struct {
@@ -335,16 +619,13 @@ func TestProcessUpgradeDetails(t *testing.T) {
 		details: nil,
 		bulk: func() *ftesting.MockBulk {
 			mBulk := ftesting.NewMockBulk()
+			mBulk.On("ReadRaw", mock.Anything, dl.FleetAgents, "doc-ID", mock.Anything).Return(&bulk.MgetResponseItem{
+				Found: true, SeqNo: 5, PrimaryTerm: 1, Source: json.RawMessage(`{"upgrade_details":{}}`),
+			}, nil)
 			mBulk.On("Update", mock.Anything, dl.FleetAgents, "doc-ID", mock.MatchedBy(func(p []byte) bool {
-				doc := struct {
-					Doc map[string]interface{} `json:"doc"`
-				}{}
-				if err := json.Unmarshal(p, &doc); err != nil {
-					t.Logf("bulk match unmarshal error: %v", err)
-					return false
-				}
-				return doc.Doc[dl.FieldUpgradeDetails] == nil && doc.Doc[dl.FieldUpgradeStartedAt] == nil && doc.Doc[dl.FieldUpgradeStatus] == nil && doc.Doc[dl.FieldUpgradedAt] != ""
-			}), mock.Anything, mock.Anything).Return(nil)
+				fields, ok := upgradeCompleteFields(t, p)
+				return ok && fields[dl.FieldUpgradeDetails] == nil && fields[dl.FieldUpgradeStartedAt] == nil && fields[dl.FieldUpgradeStatus] == nil && fields[dl.FieldUpgradedAt] != nil
+			}), mock.Anything).Return(nil)
 			return mBulk
 		},
 		cache: func() *testcache.MockCache {
@@ -624,6 +905,126 @@ func TestProcessUpgradeDetails(t *testing.T) {
 				return mCache
 			},
 			err: ErrInvalidUpgradeMetadata,
+		}, {
+			name:  "upgrade downloading action in cache download_percent out of range",
+			agent: &model.Agent{ESDocument: esd, Agent: &model.AgentMetadata{ID: "test-agent"}},
+			details: &UpgradeDetails{
+				ActionId: "test-action",
+				State:    UpgradeDetailsStateUPGDOWNLOADING,
+				Metadata: &UpgradeDetails_Metadata{json.RawMessage(`{"download_percent":120}`)},
+			},
+			bulk: func() *ftesting.MockBulk {
+				return ftesting.NewMockBulk()
+			},
+			cache: func() *testcache.MockCache {
+				mCache := testcache.NewMockCache()
+				mCache.On("GetAction", "test-action").Return(model.Action{}, true)
+				return mCache
+			},
+			err: ErrInvalidUpgradeMetadata,
+		}, {
+			name:    "unknown state",
+			agent:   &model.Agent{ESDocument: esd, Agent: &model.AgentMetadata{ID: "test-agent"}},
+			details: &UpgradeDetails{ActionId: "test-action", State: "UPG_UNKNOWN"},
+			bulk: func() *ftesting.MockBulk {
+				return ftesting.NewMockBulk()
+			},
+			cache: func() *testcache.MockCache {
+				return testcache.NewMockCache()
+			},
+			err: ErrInvalidUpgradeMetadata,
+		}, {
+			name:  "details too large",
+			agent: &model.Agent{ESDocument: esd, Agent: &model.AgentMetadata{ID: "test-agent"}},
+			details: &UpgradeDetails{
+				ActionId: "test-action",
+				State:    UpgradeDetailsStateUPGFAILED,
+				Metadata: &UpgradeDetails_Metadata{json.RawMessage(`{"error_msg":"` + strings.Repeat("a", maxUpgradeDetailsSize) + `"}`)},
+			},
+			bulk: func() *ftesting.MockBulk {
+				return ftesting.NewMockBulk()
+			},
+			cache: func() *testcache.MockCache {
+				return testcache.NewMockCache()
+			},
+			err: ErrInvalidUpgradeMetadata,
+		}, {
+			name: "stale upgrade state is dropped",
+			agent: &model.Agent{
+				ESDocument:     esd,
+				Agent:          &model.AgentMetadata{ID: "test-agent"},
+				UpgradeDetails: &model.UpgradeDetails{ActionID: "test-action", State: string(UpgradeDetailsStateUPGEXTRACTING)},
+			},
+			details: &UpgradeDetails{ActionId: "test-action", State: UpgradeDetailsStateUPGDOWNLOADING},
+			bulk: func() *ftesting.MockBulk {
+				return ftesting.NewMockBulk()
+			},
+			cache: func() *testcache.MockCache {
+				return testcache.NewMockCache()
+			},
+			err: nil,
+		}, {
+			name: "upgrade state goes forward",
+			agent: &model.Agent{
+				ESDocument:     esd,
+				Agent:          &model.AgentMetadata{ID: "test-agent"},
+				UpgradeDetails: &model.UpgradeDetails{ActionID: "test-action", State: string(UpgradeDetailsStateUPGDOWNLOADING)},
+			},
+			details: &UpgradeDetails{ActionId: "test-action", State: UpgradeDetailsStateUPGEXTRACTING},
+			bulk: func() *ftesting.MockBulk {
+				mBulk := ftesting.NewMockBulk()
+				mBulk.On("Update", mock.Anything, dl.FleetAgents, "doc-ID", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+				return mBulk
+			},
+			cache: func() *testcache.MockCache {
+				mCache := testcache.NewMockCache()
+				mCache.On("GetAction", "test-action").Return(model.Action{}, true)
+				return mCache
+			},
+			err: nil,
+		}, {
+			name: "agent has failed details checkin details are nil",
+			agent: &model.Agent{
+				ESDocument:     esd,
+				Agent:          &model.AgentMetadata{ID: "test-agent"},
+				UpgradeDetails: &model.UpgradeDetails{ActionID: "test-action", State: string(UpgradeDetailsStateUPGFAILED)},
+			},
+			details: nil,
+			bulk: func() *ftesting.MockBulk {
+				mBulk := ftesting.NewMockBulk()
+				mBulk.On("ReadRaw", mock.Anything, dl.FleetAgents, "doc-ID", mock.Anything).Return(&bulk.MgetResponseItem{
+					Found: true, SeqNo: 5, PrimaryTerm: 1, Source: json.RawMessage(`{"upgrade_details":{"action_id":"test-action","state":"UPG_FAILED"}}`),
+				}, nil)
+				mBulk.On("Update", mock.Anything, dl.FleetAgents, "doc-ID", mock.MatchedBy(func(p []byte) bool {
+					fields, ok := upgradeCompleteFields(t, p)
+					_, upgraded := fields[dl.FieldUpgradedAt]
+					return ok && fields[dl.FieldUpgradeDetails] == nil && !upgraded
+				}), mock.Anything).Return(nil)
+				return mBulk
+			},
+			cache: func() *testcache.MockCache {
+				return testcache.NewMockCache()
+			},
+			err: nil,
+		}, {
+			name: "agent details cleared by another writer checkin details are nil",
+			agent: &model.Agent{
+				ESDocument:     esd,
+				Agent:          &model.AgentMetadata{ID: "test-agent"},
+				UpgradeDetails: &model.UpgradeDetails{ActionID: "test-action", State: string(UpgradeDetailsStateUPGWATCHING)},
+			},
+			details: nil,
+			bulk: func() *ftesting.MockBulk {
+				mBulk := ftesting.NewMockBulk()
+				mBulk.On("ReadRaw", mock.Anything, dl.FleetAgents, "doc-ID", mock.Anything).Return(&bulk.MgetResponseItem{
+					Found: true, SeqNo: 6, PrimaryTerm: 1, Source: json.RawMessage(`{"upgraded_at":"2024-10-01T12:00:00Z"}`),
+				}, nil)
+				return mBulk
+			},
+			cache: func() *testcache.MockCache {
+				return testcache.NewMockCache()
+			},
+			err: nil,
 		}}
 
 	for _, tc := range tests {
@@ -648,6 +1049,95 @@ func TestProcessUpgradeDetails(t *testing.T) {
 	}
 }
 
+func TestProcessUpgradeDetailsStale(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	mBulk := ftesting.NewMockBulk()
+	ct := &CheckinT{cache: testcache.NewMockCache(), bulker: mBulk}
+	agent := &model.Agent{
+		ESDocument:     model.ESDocument{Id: "doc-ID"},
+		Agent:          &model.AgentMetadata{ID: "test-agent"},
+		UpgradeDetails: &model.UpgradeDetails{ActionID: "test-action", State: string(UpgradeDetailsStateUPGWATCHING)},
+	}
+
+	stale := cntUpgradeDetailsStale.metric.Get()
+	err := ct.processUpgradeDetails(ctx, agent, &UpgradeDetails{ActionId: "test-action", State: UpgradeDetailsStateUPGDOWNLOADING})
+	require.NoError(t, err, "the checkin goes on without the stale details")
+	assert.Equal(t, stale+1, cntUpgradeDetailsStale.metric.Get())
+	mBulk.AssertNotCalled(t, "Update", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+	// The other invalid details still fail the checkin.
+	err = ct.processUpgradeDetails(ctx, agent, &UpgradeDetails{ActionId: "test-action", State: "UPG_UNKNOWN"})
+	assert.ErrorIs(t, err, ErrInvalidUpgradeMetadata)
+	assert.Equal(t, stale+1, cntUpgradeDetailsStale.metric.Get())
+}
+
+func TestValidateUpgradeDetails(t *testing.T) {
+	tests := []struct {
+		name  string
+		prev  *model.UpgradeDetails
+		state UpgradeDetailsState
+		err   error
+	}{{
+		name:  "no previous details",
+		state: UpgradeDetailsStateUPGWATCHING,
+	}, {
+		name:  "same state",
+		prev:  &model.UpgradeDetails{ActionID: "test-action", State: string(UpgradeDetailsStateUPGDOWNLOADING)},
+		state: UpgradeDetailsStateUPGDOWNLOADING,
+	}, {
+		name:  "skip a state",
+		prev:  &model.UpgradeDetails{ActionID: "test-action", State: string(UpgradeDetailsStateUPGREQUESTED)},
+		state: UpgradeDetailsStateUPGDOWNLOADING,
+	}, {
+		name:  "back to requested",
+		prev:  &model.UpgradeDetails{ActionID: "test-action", State: string(UpgradeDetailsStateUPGWATCHING)},
+		state: UpgradeDetailsStateUPGREQUESTED,
+		err:   ErrUpgradeDetailsOrder,
+	}, {
+		name:  "new action",
+		prev:  &model.UpgradeDetails{ActionID: "old-action", State: string(UpgradeDetailsStateUPGWATCHING)},
+		state: UpgradeDetailsStateUPGREQUESTED,
+	}, {
+		name:  "rollback while watching",
+		prev:  &model.UpgradeDetails{ActionID: "test-action", State: string(UpgradeDetailsStateUPGWATCHING)},
+		state: UpgradeDetailsStateUPGROLLBACK,
+	}, {
+		name:  "fail while downloading",
+		prev:  &model.UpgradeDetails{ActionID: "test-action", State: string(UpgradeDetailsStateUPGDOWNLOADING)},
+		state: UpgradeDetailsStateUPGFAILED,
+	}, {
+		name:  "fail after rollback",
+		prev:  &model.UpgradeDetails{ActionID: "test-action", State: string(UpgradeDetailsStateUPGROLLBACK)},
+		state: UpgradeDetailsStateUPGFAILED,
+	}, {
+		name:  "progress after rollback",
+		prev:  &model.UpgradeDetails{ActionID: "test-action", State: string(UpgradeDetailsStateUPGROLLBACK)},
+		state: UpgradeDetailsStateUPGRESTARTING,
+		err:   ErrUpgradeDetailsOrder,
+	}, {
+		name:  "rollback after failure",
+		prev:  &model.UpgradeDetails{ActionID: "test-action", State: string(UpgradeDetailsStateUPGFAILED)},
+		state: UpgradeDetailsStateUPGROLLBACK,
+		err:   ErrUpgradeDetailsOrder,
+	}, {
+		name:  "progress after failure",
+		prev:  &model.UpgradeDetails{ActionID: "test-action", State: string(UpgradeDetailsStateUPGFAILED)},
+		state: UpgradeDetailsStateUPGDOWNLOADING,
+		err:   ErrUpgradeDetailsOrder,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateUpgradeDetails(tc.prev, &UpgradeDetails{ActionId: "test-action", State: tc.state})
+			if tc.err == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tc.err)
+			}
+		})
+	}
+}
+
 func Test_CheckinT_writeResponse(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -665,6 +1155,14 @@ func Test_CheckinT_writeResponse(t *testing.T) {
 			},
 		},
 		respHeader: "gzip",
+	}, {
+		name: "with deflate compression",
+		req: &http.Request{
+			Header: http.Header{
+				"Accept-Encoding": []string{"gzip;q=0.1, deflate"},
+			},
+		},
+		respHeader: "deflate",
 	}}
 
 	verCon := mustBuildConstraints("8.0.0")
@@ -689,6 +1187,52 @@ func Test_CheckinT_writeResponse(t *testing.T) {
 	}
 }
 
+func Test_CheckinT_writeResponse_concurrent(t *testing.T) {
+	verCon := mustBuildConstraints("8.0.0")
+	cfg := &config.Server{
+		CompressionLevel:  flate.BestSpeed,
+		CompressionThresh: 256,
+	}
+	ct := NewCheckinT(verCon, cfg, nil, nil, nil, nil, nil, nil, ftesting.NewMockBulk())
+	logger := testlog.SetLogger(t)
+
+	// The responses share the pooled buffers and encoders, each one must hold its own body.
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ackToken := fmt.Sprintf("ack-%d-%s", i, strings.Repeat("a", i*10))
+			req := &http.Request{Header: http.Header{}}
+			if i%2 == 0 {
+				req.Header.Set("Accept-Encoding", "gzip")
+			}
+			wr := httptest.NewRecorder()
+			err := ct.writeResponse(logger, wr, req, &model.Agent{}, CheckinResponse{
+				Action:   "checkin",
+				AckToken: &ackToken,
+			})
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			var body io.Reader = wr.Body
+			if wr.Header().Get("Content-Encoding") == "gzip" {
+				zr, err := gzip.NewReader(wr.Body)
+				if !assert.NoError(t, err) {
+					return
+				}
+				body = zr
+			}
+			var resp CheckinResponse
+			if assert.NoError(t, decodeRequest(logger, body, &resp, false, "checkin response")) {
+				assert.Equal(t, ackToken, fromPtr(resp.AckToken))
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
 func Benchmark_CheckinT_writeResponse(b *testing.B) {
 	verCon := mustBuildConstraints("8.0.0")
 	cfg := &config.Server{
@@ -744,6 +1288,37 @@ func BenchmarkParallel_CheckinT_writeResponse(b *testing.B) {
 	})
 }
 
+func Benchmark_decodeRequest(b *testing.B) {
+	body := []byte(`{"status":"online","message":"Running","ack_token":"ack-1","local_metadata":` + benchLocalMeta + `,"components":[{"id":"log-default","type":"log","status":"HEALTHY","message":"Healthy"}]}`)
+	logger := zerolog.Nop()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var req CheckinRequest
+		err := decodeRequest(logger, bytes.NewReader(body), &req, false, "checkin")
+		require.NoError(b, err)
+	}
+}
+
+func Benchmark_parseMeta(b *testing.B) {
+	agent := &model.Agent{LocalMetadata: json.RawMessage(benchLocalMeta)}
+	// The agent sends the same metadata with a different layout
+	reqMeta := json.RawMessage(strings.ReplaceAll(benchLocalMeta, ",", ", "))
+	req := &CheckinRequest{LocalMetadata: &reqMeta}
+	logger := zerolog.Nop()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data, err := parseMeta(logger, agent, req)
+		require.NoError(b, err)
+		require.Nil(b, data)
+	}
+}
+
+const benchLocalMeta = `{"elastic":{"agent":{"build.original":"8.16.0 (build: a1b2c3d at 2024-10-08 12:00:00 +0000 UTC)","complete":false,"id":"agent-1","log_level":"info","snapshot":false,"upgradeable":true,"version":"8.16.0"}},"host":{"arch":"x86_64","hostname":"host-1","id":"host-id-1","ip":["10.0.0.1/24","fe80::1/64"],"mac":["00:00:00:00:00:01"],"name":"host-1"},"os":{"family":"debian","full":"Ubuntu jammy(22.04.4 LTS (Jammy Jellyfish))","kernel":"6.5.0","name":"Ubuntu","platform":"ubuntu","version":"22.04.4 LTS (Jammy Jellyfish)"}}`
+
 func mustBuildConstraints(verStr string) version.Constraints {
 	con, err := BuildVersionConstraint(verStr)
 	if err != nil {
@@ -836,9 +1411,56 @@ func TestCalcUnhealthyReason(t *testing.T) {
 	}
 }
 
+func TestParseMeta(t *testing.T) {
+	agentMeta := json.RawMessage(`{"elastic":{"agent":{"id":"agent-1","version":"8.16.0"}},"host":{"name":"host-1"}}`)
+	tests := []struct {
+		name     string
+		reqMeta  string
+		expected bool
+	}{{
+		name:    "equal",
+		reqMeta: string(agentMeta),
+	}, {
+		name:    "equal with whitespace",
+		reqMeta: `{ "elastic": { "agent": { "id": "agent-1", "version": "8.16.0" } },` + "\n" + `"host": { "name": "host-1" } }`,
+	}, {
+		name:    "equal with reordered keys",
+		reqMeta: `{"host":{"name":"host-1"},"elastic":{"agent":{"version":"8.16.0","id":"agent-1"}}}`,
+	}, {
+		name:    "null",
+		reqMeta: ` null `,
+	}, {
+		name:     "different",
+		reqMeta:  `{"elastic":{"agent":{"id":"agent-1","version":"8.16.1"}},"host":{"name":"host-1"}}`,
+		expected: true,
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			reqMeta := json.RawMessage(tc.reqMeta)
+			data, err := parseMeta(testlog.SetLogger(t), &model.Agent{LocalMetadata: agentMeta}, &CheckinRequest{LocalMetadata: &reqMeta})
+			require.NoError(t, err)
+			if tc.expected {
+				assert.Equal(t, tc.reqMeta, string(data))
+			} else {
+				assert.Nil(t, data)
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		reqMeta := json.RawMessage(`{"host":`)
+		_, err := parseMeta(testlog.SetLogger(t), &model.Agent{LocalMetadata: agentMeta}, &CheckinRequest{LocalMetadata: &reqMeta})
+		assert.ErrorContains(t, err, "parseMeta request")
+	})
+}
+
 func TestParseComponents(t *testing.T) {
 	var unhealthyReasonNil []string
 	degradedInputReqComponents := json.RawMessage(`[{"status":"DEGRADED","units":[{"status":"DEGRADED","type":"input"}]}]`)
+	reformattedReqComponents := json.RawMessage(`[{"units": [{"type": "input", "status": "DEGRADED"}], "status": "DEGRADED"}]`)
+	invalidReqComponents := json.RawMessage(`[{"id":"component-1","status":"HEALTHY","units":[{"id":"unit-1","status":"HEALTHY","type":"filter"}]}]`)
+	unknownStateReqComponents := json.RawMessage(`[{"id":"component-1","status":"PAUSED","units":[{"id":"unit-1","status":"PAUSED","type":"input"}]}]`)
+	oversizedReqComponents := json.RawMessage(`[{"status":"HEALTHY","message":"` + strings.Repeat("a", maxComponentsSize) + `"}]`)
 	tests := []struct {
 		name            string
 		agent           *model.Agent
@@ -902,6 +1524,55 @@ func TestParseComponents(t *testing.T) {
 			outComponents:   degradedInputReqComponents,
 			unhealthyReason: &[]string{"input"},
 			err:             nil,
+		},
+		{
+			name: "unchanged components reformatted",
+			agent: &model.Agent{
+				LastCheckinStatus: FailedStatus,
+				UnhealthyReason:   []string{"input"},
+				Components: []model.ComponentsItems{{
+					Status: "DEGRADED",
+					Units: []model.UnitsItems{{
+						Status: "DEGRADED", Type: "input",
+					}},
+				}},
+			},
+			req: &CheckinRequest{
+				Components: &reformattedReqComponents,
+			},
+			outComponents:   nil,
+			unhealthyReason: &[]string{"input"},
+			err:             nil,
+		},
+		{
+			name:  "unknown component state",
+			agent: &model.Agent{},
+			req: &CheckinRequest{
+				Components: &unknownStateReqComponents,
+			},
+			outComponents:   unknownStateReqComponents,
+			unhealthyReason: &unhealthyReasonNil,
+			err:             nil,
+		},
+		{
+			name:  "oversized components",
+			agent: &model.Agent{},
+			req: &CheckinRequest{
+				Components: &oversizedReqComponents,
+			},
+			outComponents:   nil,
+			unhealthyReason: &unhealthyReasonNil,
+			err:             &BadRequestErr{msg: fmt.Sprintf("components size %d exceeds %d bytes", len(oversizedReqComponents), maxComponentsSize)},
+		},
+		{
+			name:  "invalid unit type",
+			agent: &model.Agent{},
+			req: &CheckinRequest{
+				Components: &invalidReqComponents,
+			},
+			outComponents:   nil,
+			unhealthyReason: &unhealthyReasonNil,
+			err:             &BadRequestErr{msg: "invalid components", nextErr: errors.New(`unit "unit-1" of component "component-1" has invalid type "filter"`)},
 		}}
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
@@ -910,6 +1581,9 @@ func TestParseComponents(t *testing.T) {
 			assert.Equal(t, tc.outComponents, outComponents)
 			assert.Equal(t, tc.unhealthyReason, unhealthyReason)
 			assert.Equal(t, tc.err, err)
+			if tc.err != nil {
+				assert.Equal(t, http.StatusBadRequest, NewHTTPErrResp(err).StatusCode)
+			}
 		})
 	}
 }
@@ -969,6 +1643,21 @@ func TestValidateCheckinRequest(t *testing.T) {
 			},
 			expValid: validatedCheckin{},
 		},
+		{
+			name: "Tag too long",
+			req: &http.Request{
+				Body: io.NopCloser(strings.NewReader(`{"status": "online", "message": "test message", "tags": ["` + strings.Repeat("a", 257) + `"]}`)),
+			},
+			expErr: fmt.Errorf("%w: a tag is longer than 256 characters", ErrInvalidTags),
+			cfg: &config.Server{
+				Limits: config.ServerLimits{
+					CheckinLimit: config.Limit{
+						MaxBody: 0,
+					},
+				},
+			},
+			expValid: validatedCheckin{},
+		},
 	}
 
 	for _, tc := range tests {
@@ -990,3 +1679,312 @@ func TestValidateCheckinRequest(t *testing.T) {
 		})
 	}
 }
+
+func TestCalcPollDuration(t *testing.T) {
+	zlog := zerolog.Nop()
+
+	t.Run("jitter band", func(t *testing.T) {
+		for i := 0; i < 1000; i++ {
+			poll, jitter := calcPollDuration(zlog, 5*time.Minute, 0, 30*time.Second)
+			assert.GreaterOrEqual(t, poll, 4*time.Minute+30*time.Second)
+			assert.LessOrEqual(t, poll, 5*time.Minute)
+			assert.Equal(t, 5*time.Minute, poll+jitter)
+		}
+	})
+
+	t.Run("jitter does not go below the floor", func(t *testing.T) {
+		for i := 0; i < 1000; i++ {
+			poll, _ := calcPollDuration(zlog, time.Minute, 0, 5*time.Minute)
+			assert.GreaterOrEqual(t, poll, minJitteredPoll)
+			assert.LessOrEqual(t, poll, time.Minute)
+		}
+	})
+
+	t.Run("poll shorter than the floor is not jittered", func(t *testing.T) {
+		poll, jitter := calcPollDuration(zlog, 10*time.Second, 0, 30*time.Second)
+		assert.Equal(t, 10*time.Second, poll)
+		assert.Zero(t, jitter)
+	})
+
+	t.Run("zero jitter", func(t *testing.T) {
+		poll, jitter := calcPollDuration(zlog, 5*time.Minute, time.Second, 0)
+		assert.Equal(t, 5*time.Minute-time.Second, poll)
+		assert.Zero(t, jitter)
+	})
+}
+
+func TestProcessRequestSupersededLongPoll(t *testing.T) {
+	zlog := testlog.SetLogger(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bulker := ftesting.NewMockBulk()
+	bulker.On("Search", mock.Anything, dl.FleetActions, mock.Anything, mock.Anything).Return(&es.ResultT{}, nil)
+
+	hitsCh := make(chan []es.HitT, 1)
+	am := mockmonitor.NewMockMonitor()
+	am.On("Output").Return((<-chan []es.HitT)(hitsCh))
+	am.On("GetCheckpoint").Return(sqn.SeqNo{1})
+	ad := action.NewDispatcher(am, 0, 0)
+	go ad.Run(ctx) //nolint:errcheck // test dispatcher
+
+	pim := mockmonitor.NewMockMonitor()
+	pm := policy.NewMonitor(bulker, pim, config.ServerLimits{PolicyLimit: config.Limit{Interval: 5 * time.Millisecond, Burst: 1}})
+	c, err := cache.New(config.Cache{NumCounters: 100, MaxCost: 100000})
+	require.NoError(t, err)
+
+	cfg := &config.Server{}
+	cfg.InitDefaults()
+	cfg.Timeouts.CheckinJitter = 0
+	ct := NewCheckinT(mustBuildConstraints("8.0.0"), cfg, c, checkin.NewBulk(bulker), pm, am, ad, nil, bulker)
+
+	poll := func() (*httptest.ResponseRecorder, <-chan error) {
+		agent := &model.Agent{
+			ESDocument:  model.ESDocument{Id: "agent-1"},
+			PolicyID:    "policy-1",
+			ActionSeqNo: []int64{sqn.UndefinedSeqNo},
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/fleet/agents/agent-1/checkin", strings.NewReader(`{"status":"online","message":""}`)).WithContext(ctx)
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- ct.ProcessRequest(zlog, w, r, time.Now(), agent, "8.0.0")
+		}()
+		return w, errCh
+	}
+	parked := func() bool {
+		ct.polls.mu.Lock()
+		defer ct.polls.mu.Unlock()
+		_, ok := ct.polls.polls["agent-1"]
+		return ok
+	}
+	superseded := cntLongPollSuperseded.metric.Get()
+
+	firstW, firstErr := poll()
+	require.Eventually(t, parked, 5*time.Second, 10*time.Millisecond)
+	secondW, secondErr := poll()
+
+	select {
+	case err := <-firstErr:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("first long poll was not superseded")
+	}
+	assert.Equal(t, http.StatusOK, firstW.Code)
+	var resp CheckinResponse
+	require.NoError(t, json.Unmarshal(firstW.Body.Bytes(), &resp))
+	require.NotNil(t, resp.Actions)
+	assert.Empty(t, *resp.Actions)
+	assert.Equal(t, superseded+1, cntLongPollSuperseded.metric.Get())
+
+	// The second long poll may not be subscribed to the dispatcher yet, so keep dispatching until it returns.
+	hit := es.HitT{
+		ID:     "action-1",
+		Source: json.RawMessage(`{"action_id":"action-1","agents":["agent-1"],"type":"SETTINGS","data":{"log_level":"debug"},"expiration":"` + time.Now().Add(time.Hour).UTC().Format(time.RFC3339) + `"}`),
+	}
+	var secondRes error
+	require.Eventually(t, func() bool {
+		select {
+		case hitsCh <- []es.HitT{hit}:
+		default:
+		}
+		select {
+		case secondRes = <-secondErr:
+			return true
+		default:
+			return false
+		}
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, secondRes)
+	assert.Equal(t, http.StatusOK, secondW.Code)
+	resp = CheckinResponse{}
+	require.NoError(t, json.Unmarshal(secondW.Body.Bytes(), &resp))
+	require.NotNil(t, resp.Actions)
+	require.Len(t, *resp.Actions, 1)
+	assert.Equal(t, "action-1", (*resp.Actions)[0].Id)
+	assert.Equal(t, SETTINGS, (*resp.Actions)[0].Type)
+	assert.False(t, parked(), "released long poll must not stay parked")
+}
+
+func TestProcessRequestTags(t *testing.T) {
+	zlog := testlog.SetLogger(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bulker := ftesting.NewMockBulk()
+	bulker.On("Search", mock.Anything, dl.FleetActions, mock.Anything, mock.Anything).Return(&es.ResultT{}, nil)
+	var tagsUpdate []byte
+	bulker.On("Update", mock.Anything, dl.FleetAgents, "agent-1", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		tagsUpdate = args.Get(3).([]byte) //nolint:errcheck // test case
+	}).Return(nil).Once()
+
+	hitsCh := make(chan []es.HitT, 1)
+	am := mockmonitor.NewMockMonitor()
+	am.On("Output").Return((<-chan []es.HitT)(hitsCh))
+	am.On("GetCheckpoint").Return(sqn.SeqNo{1})
+	ad := action.NewDispatcher(am, 0, 0)
+	go ad.Run(ctx) //nolint:errcheck // test dispatcher
+
+	pim := mockmonitor.NewMockMonitor()
+	pm := policy.NewMonitor(bulker, pim, config.ServerLimits{PolicyLimit: config.Limit{Interval: 5 * time.Millisecond, Burst: 1}})
+	c, err := cache.New(config.Cache{NumCounters: 100, MaxCost: 100000})
+	require.NoError(t, err)
+
+	cfg := &config.Server{}
+	cfg.InitDefaults()
+	cfg.Timeouts.CheckinJitter = 0
+	ct := NewCheckinT(mustBuildConstraints("8.0.0"), cfg, c, checkin.NewBulk(bulker), pm, am, ad, nil, bulker)
+
+	agent := &model.Agent{
+		ESDocument:  model.ESDocument{Id: "agent-1"},
+		PolicyID:    "policy-1",
+		ActionSeqNo: []int64{sqn.UndefinedSeqNo},
+		Tags:        []string{"staging"},
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/fleet/agents/agent-1/checkin", strings.NewReader(`{"status":"online","message":"","tags":["canary","prod","canary"]}`)).WithContext(ctx)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- ct.ProcessRequest(zlog, w, r, time.Now(), agent, "8.0.0")
+	}()
+
+	// The long poll may not be subscribed to the dispatcher yet, so keep dispatching until it returns.
+	hit := es.HitT{
+		ID:     "action-1",
+		Source: json.RawMessage(`{"action_id":"action-1","tags":["canary"],"type":"SETTINGS","data":{"log_level":"debug"},"expiration":"` + time.Now().Add(time.Hour).UTC().Format(time.RFC3339) + `"}`),
+	}
+	var res error
+	require.Eventually(t, func() bool {
+		select {
+		case hitsCh <- []es.HitT{hit}:
+		default:
+		}
+		select {
+		case res = <-errCh:
+			return true
+		default:
+			return false
+		}
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, res)
+	bulker.AssertExpectations(t)
+
+	var update struct {
+		Doc map[string]interface{} `json:"doc"`
+	}
+	require.NoError(t, json.Unmarshal(tagsUpdate, &update))
+	assert.Equal(t, []interface{}{"canary", "prod"}, update.Doc[dl.FieldTags])
+	assert.Equal(t, []string{"canary", "prod"}, agent.Tags)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp CheckinResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.NotNil(t, resp.Actions)
+	require.Len(t, *resp.Actions, 1)
+	assert.Equal(t, "action-1", (*resp.Actions)[0].Id)
+	assert.Equal(t, "agent-1", (*resp.Actions)[0].AgentId)
+}
+
+func TestProcessRequestNamespaces(t *testing.T) {
+	zlog := testlog.SetLogger(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The pending actions are only searched in the namespace of the agent.
+	bulker := ftesting.NewMockBulk()
+	for _, ns := range []string{"space1", "space2"} {
+		bulker.On("Search", mock.Anything, dl.FleetActions, mock.MatchedBy(func(body []byte) bool {
+			return bytes.Contains(body, []byte(`{"terms":{"namespaces":["`+ns+`"]}}`))
+		}), mock.Anything).Return(&es.ResultT{}, nil).Once()
+	}
+
+	hitsCh := make(chan []es.HitT, 1)
+	am := mockmonitor.NewMockMonitor()
+	am.On("Output").Return((<-chan []es.HitT)(hitsCh))
+	am.On("GetCheckpoint").Return(sqn.SeqNo{1})
+	ad := action.NewDispatcher(am, 0, 0)
+	go ad.Run(ctx) //nolint:errcheck // test dispatcher
+
+	pim := mockmonitor.NewMockMonitor()
+	pm := policy.NewMonitor(bulker, pim, config.ServerLimits{PolicyLimit: config.Limit{Interval: 5 * time.Millisecond, Burst: 1}})
+	c, err := cache.New(config.Cache{NumCounters: 100, MaxCost: 100000})
+	require.NoError(t, err)
+
+	cfg := &config.Server{}
+	cfg.InitDefaults()
+	cfg.Timeouts.CheckinJitter = 0
+	ct := NewCheckinT(mustBuildConstraints("8.0.0"), cfg, c, checkin.NewBulk(bulker), pm, am, ad, nil, bulker)
+
+	poll := func(agentID, ns string) (*httptest.ResponseRecorder, <-chan error) {
+		agent := &model.Agent{
+			ESDocument:  model.ESDocument{Id: agentID},
+			PolicyID:    "policy-1",
+			ActionSeqNo: []int64{sqn.UndefinedSeqNo},
+			Namespaces:  []string{ns},
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/fleet/agents/"+agentID+"/checkin", strings.NewReader(`{"status":"online","message":""}`)).WithContext(ctx)
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- ct.ProcessRequest(zlog, w, r, time.Now(), agent, "8.0.0")
+		}()
+		return w, errCh
+	}
+	w1, errCh1 := poll("agent-1", "space1")
+	w2, errCh2 := poll("agent-2", "space2")
+
+	// Both actions target both agents, each agent only gets the action of its namespace.
+	expiration := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	hits := []es.HitT{{
+		ID:     "space1-action",
+		Source: json.RawMessage(`{"action_id":"space1-action","agents":["agent-1","agent-2"],"namespaces":["space1"],"type":"SETTINGS","data":{"log_level":"debug"},"expiration":"` + expiration + `"}`),
+	}, {
+		ID:     "space2-action",
+		Source: json.RawMessage(`{"action_id":"space2-action","agents":["agent-1","agent-2"],"namespaces":["space2"],"type":"SETTINGS","data":{"log_level":"info"},"expiration":"` + expiration + `"}`),
+	}}
+	var res1, res2 error
+	done1, done2 := false, false
+	require.Eventually(t, func() bool {
+		select {
+		case hitsCh <- hits:
+		default:
+		}
+		select {
+		case res1 = <-errCh1:
+			done1 = true
+		case res2 = <-errCh2:
+			done2 = true
+		default:
+		}
+		return done1 && done2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, res1)
+	require.NoError(t, res2)
+	bulker.AssertExpectations(t)
+
+	for w, expected := range map[*httptest.ResponseRecorder]string{w1: "space1-action", w2: "space2-action"} {
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp CheckinResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.NotNil(t, resp.Actions)
+		require.Len(t, *resp.Actions, 1)
+		assert.Equal(t, expected, (*resp.Actions)[0].Id)
+	}
+}
+
+func TestProcessPolicyNamespaces(t *testing.T) {
+	zlog := testlog.SetLogger(t)
+	bulker := ftesting.NewMockBulk()
+	bulker.On("Search", mock.Anything, dl.FleetAgents, mock.Anything, mock.Anything).Return(&es.ResultT{HitsT: es.HitsT{
+		Hits: []es.HitT{{ID: "agent-1", Source: json.RawMessage(`{"agent":{"id":"agent-1"},"policy_id":"policy-1","namespaces":["space1"]}`)}},
+	}}, nil)
+	pp := &policy.ParsedPolicy{Policy: model.Policy{
+		PolicyID:   "policy-1",
+		Namespaces: []string{"space2"},
+		Data:       &model.PolicyData{},
+	}}
+
+	_, err := processPolicy(context.Background(), zlog, bulker, "agent-1", pp)
+	require.ErrorIs(t, err, ErrPolicyNamespace)
+	assert.Equal(t, http.StatusForbidden, NewHTTPErrResp(err).StatusCode)
+}
@@ -6,13 +6,18 @@ package api
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/elastic/elastic-agent-libs/str"
 	"github.com/elastic/fleet-server/v7/internal/pkg/apikey"
@@ -20,7 +25,9 @@ import (
 	"github.com/elastic/fleet-server/v7/internal/pkg/cache"
 	"github.com/elastic/fleet-server/v7/internal/pkg/config"
 	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/limit"
 	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger/audit"
 	"github.com/elastic/fleet-server/v7/internal/pkg/model"
 	"github.com/elastic/fleet-server/v7/internal/pkg/rollback"
 	"github.com/elastic/fleet-server/v7/internal/pkg/sqn"
@@ -30,6 +37,7 @@ import (
 	"github.com/hashicorp/go-version"
 	"github.com/miolini/datacounter"
 	"github.com/rs/zerolog"
+	"golang.org/x/sync/semaphore"
 )
 
 const (
@@ -57,6 +65,17 @@ var (
 	ErrUnknownEnrollType     = errors.New("unknown enroll request type")
 	ErrInactiveEnrollmentKey = errors.New("inactive enrollment key")
 	ErrPolicyNotFound        = errors.New("policy not found")
+	ErrAgentReplaceToken     = errors.New("replace token does not match the existing agent")
+	ErrEnrollmentKeyExpired  = errors.New("enrollment key is expired")
+	ErrServerStarting        = errors.New("fleet-server policy is not ready")
+	ErrInvalidTags           = errors.New("invalid tags")
+	ErrEnrollConcurrency     = errors.New("enroll max concurrency")
+)
+
+const (
+	// maxAgentTags and maxTagLength bound the tags set by an agent on enroll or checkin.
+	maxAgentTags = 32
+	maxTagLength = 256
 )
 
 type EnrollerT struct {
@@ -64,24 +83,58 @@ type EnrollerT struct {
 	cfg    *config.Server
 	bulker bulk.Bulk
 	cache  cache.Cache
+	// k8s is set when the agents can enroll with a Kubernetes service account token.
+	k8s *kubernetesAuth
+	// versionGate rejects the agents outside of the accepted versions, nil when they are not restricted.
+	versionGate *agentVersionGate
+	// inFlight bounds the authenticated enrollments to enroll.max_concurrency, it holds nil when they are not bounded.
+	inFlight atomic.Pointer[semaphore.Weighted]
 }
 
 func NewEnrollerT(verCon version.Constraints, cfg *config.Server, bulker bulk.Bulk, c cache.Cache) (*EnrollerT, error) {
-	return &EnrollerT{
+	et := &EnrollerT{
 		verCon: verCon,
 		cfg:    cfg,
 		bulker: bulker,
 		cache:  c,
-	}, nil
+
+		versionGate: newAgentVersionGate(&cfg.Compatibility),
+	}
+	et.ReloadEnroll(&cfg.Enroll)
+	if cfg.Enroll.Kubernetes.Enabled {
+		k8s, err := newKubernetesAuth(&cfg.Enroll.Kubernetes)
+		if err != nil {
+			return nil, err
+		}
+		et.k8s = k8s
+	}
+	return et, nil
 }
 
 func (et *EnrollerT) handleEnroll(zlog zerolog.Logger, w http.ResponseWriter, r *http.Request, rb *rollback.Rollback, userAgent string) error {
-	key, err := authAPIKey(r, et.bulker, et.cache)
-	if err != nil {
-		return err
+	// An agent presenting a Kubernetes service account token is enrolled in the policy mapped to its service account.
+	var saEnrollAPI *model.EnrollmentAPIKey
+	if token, ok := serviceAccountToken(r); ok && et.k8s != nil {
+		var err error
+		saEnrollAPI, err = et.authServiceAccount(r.Context(), zlog, token)
+		if err != nil {
+			if !et.cfg.Enroll.Kubernetes.FallbackToToken {
+				return err
+			}
+			zlog.Info().Err(err).Msg("Kubernetes service account not authenticated, falling back to the enrollment token")
+		}
 	}
-	zlog = zlog.With().Str(LogEnrollAPIKeyID, key.ID).Logger()
-	ctx := zlog.WithContext(r.Context())
+
+	var key *apikey.APIKey
+	if saEnrollAPI == nil {
+		var err error
+		key, err = authAPIKey(r, et.bulker, et.cache)
+		if err != nil {
+			return err
+		}
+		zlog = zlog.With().Str(LogEnrollAPIKeyID, key.ID).Logger()
+	}
+	ctx := audit.WithClientIP(zlog.WithContext(r.Context()), clientIP(r, et.cfg.TrustedProxies))
 	r = r.WithContext(ctx)
 
 	ver, err := validateUserAgent(r.Context(), zlog, userAgent, et.verCon)
@@ -89,7 +142,18 @@ func (et *EnrollerT) handleEnroll(zlog zerolog.Logger, w http.ResponseWriter, r
 		return err
 	}
 
-	resp, err := et.processRequest(zlog, w, r, rb, key, ver)
+	release, err := et.acquire(r.Context())
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	var resp *EnrollResponse
+	if saEnrollAPI != nil {
+		resp, err = et.enroll(zlog, w, r, rb, saEnrollAPI, "", ver)
+	} else {
+		resp, err = et.processRequest(zlog, w, r, rb, key, ver)
+	}
 	if err != nil {
 		return err
 	}
@@ -98,6 +162,43 @@ func (et *EnrollerT) handleEnroll(zlog zerolog.Logger, w http.ResponseWriter, r
 	return writeResponse(r.Context(), zlog, w, resp, ts)
 }
 
+// ReloadEnroll applies enroll.max_concurrency to a running enroller.
+// The enrollments in flight release their slot to the previous bound, the new bound only applies to the next ones.
+func (et *EnrollerT) ReloadEnroll(cfg *config.Enroll) {
+	if cfg.MaxConcurrency > 0 {
+		et.inFlight.Store(semaphore.NewWeighted(int64(cfg.MaxConcurrency)))
+	} else {
+		et.inFlight.Store(nil)
+	}
+}
+
+// acquire waits up to enroll.max_concurrency_wait for a slot of the concurrent enrollments, the rate limiter only
+// bounds how fast they are admitted. The returned function releases the slot.
+func (et *EnrollerT) acquire(ctx context.Context) (func(), error) {
+	inFlight := et.inFlight.Load()
+	if inFlight == nil {
+		return func() {}, nil
+	}
+	if !inFlight.TryAcquire(1) {
+		wait := et.cfg.Enroll.MaxConcurrencyWait
+		waitCtx, cancel := context.WithTimeout(ctx, wait)
+		err := inFlight.Acquire(waitCtx, 1)
+		cancel()
+		switch {
+		case err == nil:
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		default:
+			return nil, &limit.RateLimitError{Err: ErrEnrollConcurrency, RetryAfter: max(wait, time.Second)}
+		}
+	}
+	cntEnrollInFlight.Inc()
+	return func() {
+		cntEnrollInFlight.Dec()
+		inFlight.Release(1)
+	}, nil
+}
+
 func (et *EnrollerT) processRequest(zlog zerolog.Logger, w http.ResponseWriter, r *http.Request, rb *rollback.Rollback, enrollmentAPIKey *apikey.APIKey, ver string) (*EnrollResponse, error) {
 	// Validate that an enrollment record exists for a key with this id.
 	var enrollAPI *model.EnrollmentAPIKey
@@ -113,8 +214,17 @@ func (et *EnrollerT) processRequest(zlog zerolog.Logger, w http.ResponseWriter,
 			return nil, err
 		}
 		zlog.Debug().Msgf("Found enrollment key %s", key.APIKeyID)
+		if err := et.claimEnrollmentKey(r.Context(), zlog, rb, key); err != nil {
+			return nil, err
+		}
 		enrollAPI = key
 	}
+	return et.enroll(zlog, w, r, rb, enrollAPI, enrollmentAPIKey.ID, ver)
+}
+
+// enroll parses the enroll request and enrolls the agent in the policy of the enrollment key record.
+// The enrollment API key ID is empty when the agent did not authenticate with an enrollment token.
+func (et *EnrollerT) enroll(zlog zerolog.Logger, w http.ResponseWriter, r *http.Request, rb *rollback.Rollback, enrollAPI *model.EnrollmentAPIKey, enrollmentAPIKeyID string, ver string) (*EnrollResponse, error) {
 	body := r.Body
 
 	// Limit the size of the body to prevent malicious agent from exhausting RAM in server
@@ -125,14 +235,30 @@ func (et *EnrollerT) processRequest(zlog zerolog.Logger, w http.ResponseWriter,
 	readCounter := datacounter.NewReaderCounter(body)
 
 	// Parse the request body
-	req, err := validateRequest(r.Context(), readCounter)
+	req, err := validateRequest(r.Context(), zlog, readCounter, et.cfg.StrictSchema)
 	if err != nil {
 		return nil, err
 	}
+	if err := et.versionGate.check(zlog, req.Metadata.Local, r.UserAgent()); err != nil {
+		return nil, err
+	}
 
 	cntEnroll.bodyIn.Add(readCounter.Count())
 
-	return et._enroll(r.Context(), rb, zlog, req, enrollAPI.PolicyID, enrollAPI.Namespaces, ver)
+	resp, err := et._enroll(r.Context(), rb, zlog, req, enrollAPI.PolicyID, enrollAPI.Namespaces, ver)
+	event := audit.Event{
+		Action:   audit.ActionEnroll,
+		Outcome:  audit.OutcomeSuccess,
+		PolicyID: enrollAPI.PolicyID,
+		APIKeyID: enrollmentAPIKeyID,
+	}
+	if err != nil {
+		event.Outcome = audit.OutcomeFailure
+	} else {
+		event.AgentID = resp.Item.Id
+	}
+	audit.Log(r.Context(), event)
+	return resp, err
 }
 
 // retrieveStaticTokenEnrollmentToken fetches the enrollment key record from the config static tokens.
@@ -225,8 +351,19 @@ func (et *EnrollerT) _enroll(
 	}
 
 	agentID := u.String()
+
+	// An agent enrolling with the id of an existing agent replaces it if the replace token matches.
+	var replaced *model.Agent
+	if req.Id != nil && *req.Id != "" {
+		agentID = *req.Id
+		replaced, err = et.findReplacedAgent(ctx, zlog, agentID, req.ReplaceToken)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// only delete existing agent if it never checked in
-	if agent.Id != "" && agent.LastCheckin == "" {
+	if agent.Id != "" && agent.Id != agentID && agent.LastCheckin == "" {
 		zlog.Debug().
 			Str("EnrollmentId", enrollmentID).
 			Str("AgentId", agent.Id).
@@ -253,6 +390,19 @@ func (et *EnrollerT) _enroll(
 		}
 	}
 
+	tags := removeDuplicateStr(req.Metadata.Tags)
+	if replaced != nil {
+		// carry over the assignment of the replaced agent
+		policyID = replaced.PolicyID
+		namespaces = replaced.Namespaces
+		tags = removeDuplicateStr(append(replaced.Tags, req.Metadata.Tags...))
+	}
+
+	var replaceToken string
+	if req.ReplaceToken != nil && *req.ReplaceToken != "" {
+		replaceToken = hashReplaceToken(*req.ReplaceToken)
+	}
+
 	// Update the local metadata agent id
 	localMeta, err := updateLocalMetaAgentID(req.Metadata.Local, agentID)
 	if err != nil {
@@ -283,19 +433,30 @@ func (et *EnrollerT) _enroll(
 			ID:      agentID,
 			Version: ver,
 		},
-		Tags:         removeDuplicateStr(req.Metadata.Tags),
+		Tags:         tags,
 		EnrollmentID: enrollmentID,
+		ReplaceToken: replaceToken,
 	}
 
-	err = createFleetAgent(ctx, et.bulker, agentID, agentData)
-	if err != nil {
-		return nil, err
-	}
+	if replaced != nil {
+		err = replaceFleetAgent(ctx, et.bulker, agentID, agentData, et.agentWriteOpts()...)
+		if err != nil {
+			return nil, err
+		}
+		// The keys of the replaced agent are only invalidated once its replacement is written,
+		// so the replaced agent keeps working if the enrollment fails before.
+		et.invalidateReplacedAPIKeys(ctx, zlog, replaced)
+	} else {
+		err = createFleetAgent(ctx, et.bulker, agentID, agentData, et.agentWriteOpts()...)
+		if err != nil {
+			return nil, err
+		}
 
-	// Register delete fleet agent for enrollment error rollback
-	rb.Register("delete agent", func(ctx context.Context) error {
-		return deleteAgent(ctx, zlog, et.bulker, agentID)
-	})
+		// Register delete fleet agent for enrollment error rollback
+		rb.Register("delete agent", func(ctx context.Context) error {
+			return deleteAgent(ctx, zlog, et.bulker, agentID)
+		})
+	}
 
 	resp := EnrollResponse{
 		Action: "created",
@@ -320,12 +481,83 @@ func (et *EnrollerT) _enroll(
 	return &resp, nil
 }
 
+// invalidateReplacedAPIKeys invalidates the API keys of the replaced agent and removes them from the cache, so they
+// stop authenticating before their cache entries expire.
+// The replacement is already written, an invalidation that fails is queued to be retried instead of failing the enrollment.
+func (et *EnrollerT) invalidateReplacedAPIKeys(ctx context.Context, zlog zerolog.Logger, replaced *model.Agent) {
+	var ids []string
+	for _, key := range replaced.APIKeyIDs() {
+		if key.ID == "" {
+			continue
+		}
+		et.cache.DeleteAPIKey(key.ID)
+		ids = append(ids, key.ID)
+	}
+	if len(ids) == 0 {
+		return
+	}
+	zlog.Debug().
+		Str(LogAgentID, replaced.Id).
+		Strs("APIKeyIDs", ids).
+		Msg("Invalidate api keys of replaced agent")
+	if err := et.bulker.APIKeyInvalidate(ctx, ids...); err != nil {
+		zlog.Error().Err(err).
+			Str(LogAgentID, replaced.Id).
+			Strs("APIKeyIDs", ids).
+			Msg("Error when trying to invalidate API keys of replaced agent, queued to be retried")
+		et.bulker.APIKeyInvalidateAsync(ids...)
+	}
+}
+
+// findReplacedAgent returns the agent with agentID if it exists.
+// ErrAgentReplaceToken is returned if replaceToken does not match the token the agent was enrolled with.
+func (et *EnrollerT) findReplacedAgent(ctx context.Context, zlog zerolog.Logger, agentID string, replaceToken *string) (*model.Agent, error) {
+	span, ctx := apm.StartSpan(ctx, "checkReplaceToken", "validate")
+	defer span.End()
+
+	agent, err := dl.FindAgent(ctx, et.bulker, dl.QueryAgentByID, dl.FieldID, agentID)
+	if err != nil {
+		if errors.Is(err, dl.ErrNotFound) || strings.Contains(err.Error(), "no such index") {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if agent.ReplaceToken == "" || replaceToken == nil ||
+		subtle.ConstantTimeCompare([]byte(agent.ReplaceToken), []byte(hashReplaceToken(*replaceToken))) != 1 {
+		zlog.Info().
+			Str(LogAgentID, agentID).
+			Msg("Replace token does not match, existing agent is not replaced")
+		return nil, ErrAgentReplaceToken
+	}
+	return &agent, nil
+}
+
+// hashReplaceToken returns the hash of the replace token that is stored in the agent document.
+func hashReplaceToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
 // Helper function to remove duplicate agent tags.
 // Note that this implementation will also sort the tags alphabetically.
 func removeDuplicateStr(strSlice []string) []string {
 	return str.MakeSet(strSlice...).ToSlice()
 }
 
+// validateTags returns ErrInvalidTags if there are more than maxAgentTags distinct tags or a tag is longer than maxTagLength characters.
+func validateTags(tags []string) error {
+	if n := len(removeDuplicateStr(tags)); n > maxAgentTags {
+		return fmt.Errorf("%w: %d tags exceed the limit of %d", ErrInvalidTags, n, maxAgentTags)
+	}
+	for _, tag := range tags {
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			return fmt.Errorf("%w: a tag is longer than %d characters", ErrInvalidTags, maxTagLength)
+		}
+	}
+	return nil
+}
+
 func deleteAgent(ctx context.Context, zlog zerolog.Logger, bulker bulk.Bulk, agentID string) error {
 	span, ctx := apm.StartSpan(ctx, "deleteAgent", "delete")
 	span.Context.SetLabel("agent_id", agentID)
@@ -469,7 +701,16 @@ func updateLocalMetaAgentID(data []byte, agentID string) ([]byte, error) {
 	return data, nil
 }
 
-func createFleetAgent(ctx context.Context, bulker bulk.Bulk, id string, agent model.Agent) error {
+// agentWriteOpts returns the options of the agent document writes of the enrollments. The document is visible to
+// searches when the enrollment returns, unless the agents that searches miss are looked up with realtime gets.
+func (et *EnrollerT) agentWriteOpts() []bulk.Opt {
+	if et.cfg.Enroll.Consistency == config.EnrollConsistencyRealtimeGet {
+		return nil
+	}
+	return []bulk.Opt{bulk.WithRefreshWaitFor()}
+}
+
+func createFleetAgent(ctx context.Context, bulker bulk.Bulk, id string, agent model.Agent, opts ...bulk.Opt) error {
 	span, ctx := apm.StartSpan(ctx, "createAgent", "create")
 	defer span.End()
 
@@ -478,13 +719,27 @@ func createFleetAgent(ctx context.Context, bulker bulk.Bulk, id string, agent mo
 		return err
 	}
 
-	_, err = bulker.Create(ctx, dl.FleetAgents, id, data, bulk.WithRefresh())
+	_, err = bulker.Create(ctx, dl.FleetAgents, id, data, opts...)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// replaceFleetAgent overwrites the document of an existing agent so the state of the replaced agent is not kept.
+func replaceFleetAgent(ctx context.Context, bulker bulk.Bulk, id string, agent model.Agent, opts ...bulk.Opt) error {
+	span, ctx := apm.StartSpan(ctx, "replaceAgent", "index")
+	defer span.End()
+
+	data, err := json.Marshal(agent)
+	if err != nil {
+		return err
+	}
+
+	_, err = bulker.Index(ctx, dl.FleetAgents, id, data, opts...)
+	return err
+}
+
 func generateAccessAPIKey(ctx context.Context, bulk bulk.Bulk, agentID string) (*apikey.APIKey, error) {
 	return bulk.APIKeyCreate(
 		ctx,
@@ -512,20 +767,57 @@ func (et *EnrollerT) fetchEnrollmentKeyRecord(ctx context.Context, id string) (*
 		return nil, ErrInactiveEnrollmentKey
 	}
 
-	cost := int64(len(rec.APIKey))
-	et.cache.SetEnrollmentAPIKey(id, rec, cost)
+	et.cache.SetEnrollmentAPIKey(id, rec)
 
 	return &rec, nil
 }
 
-func validateRequest(ctx context.Context, data io.Reader) (*EnrollRequest, error) {
+// claimEnrollmentKey enforces the expiry and the usage limit of the enrollment key.
+// The usage counter of a limited key is incremented atomically in Elasticsearch, the cached record is never
+// trusted for it, so concurrent enrollments can not exceed max_agents. The usage is given back if the enrollment fails.
+func (et *EnrollerT) claimEnrollmentKey(ctx context.Context, zlog zerolog.Logger, rb *rollback.Rollback, key *model.EnrollmentAPIKey) error {
+	if key.ExpiresAt != "" {
+		expiresAt, err := time.Parse(time.RFC3339, key.ExpiresAt)
+		if err != nil {
+			return fmt.Errorf("enrollment key expires_at is invalid: %w", err)
+		}
+		if !time.Now().Before(expiresAt) {
+			et.cache.DeleteEnrollmentAPIKey(key.APIKeyID)
+			return ErrEnrollmentKeyExpired
+		}
+	}
+
+	if key.MaxAgents <= 0 {
+		return nil
+	}
+
+	span, ctx := apm.StartSpan(ctx, "claimEnrollmentKey", "update")
+	defer span.End()
+	if err := dl.ClaimEnrollmentAPIKey(ctx, et.bulker, key.Id); err != nil {
+		if errors.Is(err, dl.ErrEnrollmentAPIKeyExhausted) {
+			et.cache.DeleteEnrollmentAPIKey(key.APIKeyID)
+		}
+		return err
+	}
+
+	docID := key.Id
+	rb.Register("release enrollment key", func(ctx context.Context) error {
+		if err := dl.ReleaseEnrollmentAPIKey(ctx, et.bulker, docID); err != nil {
+			zlog.Error().Err(err).Str("id", docID).Msg("fail to release enrollment key usage")
+			return err
+		}
+		return nil
+	})
+	return nil
+}
+
+func validateRequest(ctx context.Context, zlog zerolog.Logger, data io.Reader, strict bool) (*EnrollRequest, error) {
 	span, _ := apm.StartSpan(ctx, "validateRequest", "validate")
 	defer span.End()
 
 	var req EnrollRequest
-	decoder := json.NewDecoder(data)
-	if err := decoder.Decode(&req); err != nil {
-		return nil, &BadRequestErr{msg: "unable to decode enroll request", nextErr: err}
+	if err := decodeRequest(zlog, data, &req, strict, "enroll"); err != nil {
+		return nil, err
 	}
 
 	// Validate
@@ -534,6 +826,9 @@ func validateRequest(ctx context.Context, data io.Reader) (*EnrollRequest, error
 	default:
 		return nil, ErrUnknownEnrollType
 	}
+	if err := validateTags(req.Metadata.Tags); err != nil {
+		return nil, err
+	}
 
 	return &req, nil
 }
@@ -7,23 +7,39 @@
 package api
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/apikey"
 	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
 	"github.com/elastic/fleet-server/v7/internal/pkg/cache"
 	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
 	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger/audit"
 	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	mockmonitor "github.com/elastic/fleet-server/v7/internal/pkg/monitor/mock"
 	"github.com/elastic/fleet-server/v7/internal/pkg/rollback"
 	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+	testcache "github.com/elastic/fleet-server/v7/internal/pkg/testing/cache"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 func TestRemoveDuplicateStr(t *testing.T) {
@@ -97,6 +113,137 @@ func TestEnroll(t *testing.T) {
 	}
 }
 
+func TestEnrollReplace(t *testing.T) {
+	existing := model.Agent{
+		ESDocument:     model.ESDocument{Id: "agent-1"},
+		Active:         true,
+		PolicyID:       "existing-policy",
+		AccessAPIKeyID: "old-access-key",
+		Outputs: map[string]*model.PolicyOutput{
+			"default": {APIKeyID: "old-output-key"},
+		},
+		Tags:         []string{"existing"},
+		ReplaceToken: hashReplaceToken("secret"),
+	}
+	source, err := json.Marshal(existing)
+	require.NoError(t, err)
+
+	newEnroller := func(t *testing.T) (*EnrollerT, *ftesting.MockBulk, *testcache.MockCache) {
+		verCon := mustBuildConstraints("8.9.0")
+		cfg := &config.Server{}
+		c := testcache.NewMockCache()
+		bulker := ftesting.NewMockBulk()
+		bulker.On("Search", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(&es.ResultT{
+			HitsT: es.HitsT{
+				Hits: []es.HitT{{ID: existing.Id, Source: source}},
+			},
+		}, nil)
+		et, err := NewEnrollerT(verCon, cfg, bulker, c)
+		require.NoError(t, err)
+		return et, bulker, c
+	}
+	newRequest := func(token string) *EnrollRequest {
+		id := existing.Id
+		return &EnrollRequest{
+			Type:         "PERMANENT",
+			Id:           &id,
+			ReplaceToken: &token,
+			Metadata: EnrollMetadata{
+				UserProvided: []byte("{}"),
+				Local:        []byte("{}"),
+				Tags:         []string{"new"},
+			},
+		}
+	}
+
+	oldKeys := mock.MatchedBy(func(ids []string) bool {
+		return assert.ElementsMatch(t, []string{"old-access-key", "old-output-key"}, ids)
+	})
+	expectNewKey := func(bulker *ftesting.MockBulk) {
+		bulker.On("APIKeyCreate", mock.Anything, existing.Id, mock.Anything, mock.Anything, mock.Anything).Return(
+			&apikey.APIKey{
+				ID:  "new-access-key",
+				Key: "1234",
+			}, nil)
+	}
+
+	t.Run("matching token", func(t *testing.T) {
+		et, bulker, c := newEnroller(t)
+		expectNewKey(bulker)
+		var indexed model.Agent
+		bulker.On("Index", mock.Anything, dl.FleetAgents, existing.Id, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			require.NoError(t, json.Unmarshal(args.Get(3).([]byte), &indexed))
+		}).Return(existing.Id, nil).Once()
+		// The old keys are invalidated and evicted from the cache once the replacement is written.
+		bulker.On("APIKeyInvalidate", mock.Anything, oldKeys).Run(func(mock.Arguments) {
+			assert.Equal(t, "new-access-key", indexed.AccessAPIKeyID)
+		}).Return(nil).Once()
+		c.On("DeleteAPIKey", "old-access-key").Once()
+		c.On("DeleteAPIKey", "old-output-key").Once()
+		c.On("SetAPIKey", mock.Anything, true).Once()
+
+		resp, err := et._enroll(context.Background(), &rollback.Rollback{}, zerolog.Nop(), newRequest("secret"), "token-policy", nil, "8.9.0")
+		require.NoError(t, err)
+		assert.Equal(t, existing.Id, resp.Item.Id)
+		assert.Equal(t, "existing-policy", resp.Item.PolicyId)
+		assert.Equal(t, []string{"existing", "new"}, resp.Item.Tags)
+		assert.Equal(t, "new-access-key", indexed.AccessAPIKeyID)
+		assert.Equal(t, existing.ReplaceToken, indexed.ReplaceToken)
+		assert.Empty(t, indexed.Outputs)
+		bulker.AssertNotCalled(t, "Create", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+		bulker.AssertNotCalled(t, "APIKeyInvalidateAsync", mock.Anything)
+		bulker.AssertExpectations(t)
+		c.AssertExpectations(t)
+	})
+
+	t.Run("failed replacement keeps the old keys", func(t *testing.T) {
+		et, bulker, c := newEnroller(t)
+		expectNewKey(bulker)
+		bulker.On("Index", mock.Anything, dl.FleetAgents, existing.Id, mock.Anything, mock.Anything).Return("", errors.New("index failed")).Once()
+
+		_, err := et._enroll(context.Background(), &rollback.Rollback{}, zerolog.Nop(), newRequest("secret"), "token-policy", nil, "8.9.0")
+		require.Error(t, err)
+		bulker.AssertNotCalled(t, "APIKeyInvalidate", mock.Anything, mock.Anything)
+		c.AssertNotCalled(t, "DeleteAPIKey", mock.Anything)
+	})
+
+	t.Run("failed invalidation is queued", func(t *testing.T) {
+		et, bulker, c := newEnroller(t)
+		expectNewKey(bulker)
+		bulker.On("Index", mock.Anything, dl.FleetAgents, existing.Id, mock.Anything, mock.Anything).Return(existing.Id, nil).Once()
+		bulker.On("APIKeyInvalidate", mock.Anything, oldKeys).Return(errors.New("invalidate failed")).Once()
+		bulker.On("APIKeyInvalidateAsync", oldKeys).Once()
+		c.On("DeleteAPIKey", mock.Anything).Twice()
+		c.On("SetAPIKey", mock.Anything, true).Once()
+
+		resp, err := et._enroll(context.Background(), &rollback.Rollback{}, zerolog.Nop(), newRequest("secret"), "token-policy", nil, "8.9.0")
+		require.NoError(t, err)
+		assert.Equal(t, existing.Id, resp.Item.Id)
+		bulker.AssertExpectations(t)
+		c.AssertExpectations(t)
+	})
+
+	t.Run("token mismatch", func(t *testing.T) {
+		et, bulker, _ := newEnroller(t)
+
+		_, err := et._enroll(context.Background(), &rollback.Rollback{}, zerolog.Nop(), newRequest("wrong"), "token-policy", nil, "8.9.0")
+		require.ErrorIs(t, err, ErrAgentReplaceToken)
+		assert.Equal(t, http.StatusForbidden, NewHTTPErrResp(err).StatusCode)
+		bulker.AssertNotCalled(t, "APIKeyInvalidate", mock.Anything, mock.Anything)
+		bulker.AssertNotCalled(t, "APIKeyCreate", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+		bulker.AssertNotCalled(t, "Index", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("missing token", func(t *testing.T) {
+		et, _, _ := newEnroller(t)
+		req := newRequest("")
+		req.ReplaceToken = nil
+
+		_, err := et._enroll(context.Background(), &rollback.Rollback{}, zerolog.Nop(), req, "token-policy", nil, "8.9.0")
+		require.ErrorIs(t, err, ErrAgentReplaceToken)
+	})
+}
+
 func TestEnrollerT_retrieveStaticTokenEnrollmentToken(t *testing.T) {
 	bulkerBuilder := func(policies ...model.Policy) func() bulk.Bulk {
 		return func() bulk.Bulk {
@@ -250,7 +397,389 @@ func TestEnrollerT_retrieveStaticTokenEnrollmentToken(t *testing.T) {
 }
 
 func TestValidateEnrollRequest(t *testing.T) {
-	req, err := validateRequest(context.Background(), strings.NewReader("not a json"))
+	req, err := validateRequest(context.Background(), zerolog.Nop(), strings.NewReader("not a json"), false)
 	assert.Equal(t, "Bad request: unable to decode enroll request", err.Error())
 	assert.Nil(t, req)
+
+	tags := make([]string, 0, maxAgentTags+1)
+	for i := 0; i <= maxAgentTags; i++ {
+		tags = append(tags, fmt.Sprintf("tag-%d", i))
+	}
+	tests := map[string]struct {
+		tags []string
+		err  string
+	}{
+		"at the limits":         {tags: append(append([]string{}, tags[:maxAgentTags-1]...), strings.Repeat("é", maxTagLength))},
+		"duplicates count once": {tags: append(append([]string{}, tags[:maxAgentTags]...), tags[0])},
+		"too many tags":         {tags: tags, err: "invalid tags: 33 tags exceed the limit of 32"},
+		"tag too long":          {tags: []string{"ok", strings.Repeat("a", maxTagLength+1)}, err: "invalid tags: a tag is longer than 256 characters"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			body, err := json.Marshal(map[string]interface{}{
+				"type":     EnrollPermanent,
+				"metadata": map[string]interface{}{"tags": tc.tags},
+			})
+			require.NoError(t, err)
+			req, err := validateRequest(context.Background(), zerolog.Nop(), bytes.NewReader(body), false)
+			if tc.err == "" {
+				require.NoError(t, err)
+				assert.NotNil(t, req)
+				return
+			}
+			assert.EqualError(t, err, tc.err)
+			assert.ErrorIs(t, err, ErrInvalidTags)
+			assert.Equal(t, http.StatusBadRequest, NewHTTPErrResp(err).StatusCode)
+		})
+	}
+}
+
+func TestEnrollUnenrollAudit(t *testing.T) {
+	var buf bytes.Buffer
+	audit.SetOutput(&buf)
+	defer audit.SetOutput(io.Discard)
+
+	bulker := ftesting.NewMockBulk()
+	bulker.On("APIKeyCreate", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(
+		&apikey.APIKey{
+			ID:  "access-key",
+			Key: "secret",
+		}, nil)
+	bulker.On("Create", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return("", nil)
+	bulker.On("Update", mock.Anything, dl.FleetAgents, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	bulker.On("APIKeyInvalidateAsync", []string{"access-key"})
+	c := testcache.NewMockCache()
+	c.On("GetEnrollmentAPIKey", "enroll-key").Return(model.EnrollmentAPIKey{PolicyID: "policy-1", Active: true}, true)
+	c.On("SetAPIKey", mock.Anything, true)
+	c.On("DeleteAPIKey", "access-key")
+
+	r := httptest.NewRequest(http.MethodPost, "/api/fleet/agents/enroll", strings.NewReader(`{"type":"PERMANENT","metadata":{"user_provided":{},"local":{}}}`))
+	// The request comes through a trusted proxy, the client address is taken from the forwarded header.
+	r.RemoteAddr = "10.0.0.1:51234"
+	r.Header.Set("X-Forwarded-For", "192.0.2.1")
+	cfg := &config.Server{TrustedProxies: config.TrustedProxies{netip.MustParsePrefix("10.0.0.0/8")}}
+	r = r.WithContext(audit.WithClientIP(r.Context(), clientIP(r, cfg.TrustedProxies)))
+
+	et, _ := NewEnrollerT(mustBuildConstraints("8.9.0"), cfg, bulker, c)
+	resp, err := et.processRequest(zerolog.Nop(), httptest.NewRecorder(), r, &rollback.Rollback{}, &apikey.APIKey{ID: "enroll-key"}, "8.9.0")
+	require.NoError(t, err)
+
+	agent := &model.Agent{
+		ESDocument:     model.ESDocument{Id: resp.Item.Id},
+		PolicyID:       "policy-1",
+		AccessAPIKeyID: resp.Item.AccessApiKeyId,
+	}
+	ack := NewAckT(cfg, bulker, c)
+	err = ack.handleUnenroll(r.Context(), zerolog.Nop(), agent)
+	require.NoError(t, err)
+
+	fields := map[string]struct{}{
+		audit.FieldTimestamp: {},
+		audit.FieldAction:    {},
+		audit.FieldOutcome:   {},
+		audit.FieldAgentID:   {},
+		audit.FieldPolicyID:  {},
+		audit.FieldAPIKeyID:  {},
+		audit.FieldClientIP:  {},
+	}
+	var events []map[string]string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var event map[string]string
+		require.NoError(t, json.Unmarshal([]byte(line), &event), "audit event is not a JSON object of strings: %s", line)
+		for k := range event {
+			assert.Contains(t, fields, k, "unexpected audit field")
+		}
+		_, err := time.Parse(time.RFC3339Nano, event[audit.FieldTimestamp])
+		assert.NoError(t, err)
+		delete(event, audit.FieldTimestamp)
+		events = append(events, event)
+	}
+
+	hash := sha256.Sum256([]byte("enroll-key"))
+	assert.Equal(t, []map[string]string{{
+		audit.FieldAction:   audit.ActionEnroll,
+		audit.FieldOutcome:  audit.OutcomeSuccess,
+		audit.FieldAgentID:  resp.Item.Id,
+		audit.FieldPolicyID: "policy-1",
+		audit.FieldAPIKeyID: hex.EncodeToString(hash[:]),
+		audit.FieldClientIP: "192.0.2.1",
+	}, {
+		audit.FieldAction:   audit.ActionUnenroll,
+		audit.FieldOutcome:  audit.OutcomeSuccess,
+		audit.FieldAgentID:  resp.Item.Id,
+		audit.FieldPolicyID: "policy-1",
+		audit.FieldClientIP: "192.0.2.1",
+	}}, events)
+	bulker.AssertExpectations(t)
+	c.AssertExpectations(t)
+}
+
+// usageBulker applies the enrollment key usage scripts to an in memory counter,
+// the updates are serialized like Elasticsearch does for a single document.
+type usageBulker struct {
+	*ftesting.MockBulk
+
+	mu        sync.Mutex
+	used      int64
+	maxAgents int64
+}
+
+func (b *usageBulker) MUpdate(_ context.Context, ops []bulk.MultiOp, _ ...bulk.Opt) ([]bulk.BulkIndexerResponseItem, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	items := make([]bulk.BulkIndexerResponseItem, len(ops))
+	for i, op := range ops {
+		items[i] = bulk.BulkIndexerResponseItem{DocumentID: op.ID, Status: http.StatusOK, Result: "updated"}
+		switch {
+		case strings.Contains(string(op.Body), "used + 1"):
+			if b.used >= b.maxAgents {
+				items[i].Result = "noop"
+			} else {
+				b.used++
+			}
+		case b.used > 0:
+			b.used--
+		default:
+			items[i].Result = "noop"
+		}
+	}
+	return items, nil
+}
+
+func TestAgentEnrollPolicyReady(t *testing.T) {
+	bulker := ftesting.NewMockBulk()
+	bulker.On("Search", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(&es.ResultT{
+		HitsT: es.HitsT{
+			Hits: make([]es.HitT, 0),
+		},
+	}, nil)
+	bulker.On("APIKeyCreate", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(
+		&apikey.APIKey{
+			ID:  "access-key",
+			Key: "secret",
+		}, nil)
+	bulker.On("Create", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return("", nil)
+	enrollKey := apikey.APIKey{ID: "enroll-key", Key: "secret"}
+	c := testcache.NewMockCache()
+	c.On("ValidAPIKey", enrollKey).Return(true)
+	c.On("GetEnrollmentAPIKey", "enroll-key").Return(model.EnrollmentAPIKey{PolicyID: "policy-1", Active: true}, true)
+	c.On("SetAPIKey", mock.Anything, true)
+
+	// The policy of the fleet-server arrives after the first enrollment attempt.
+	sm := mockmonitor.NewMockMonitor()
+	sm.On("PolicyReady").Return(false).Once()
+	sm.On("PolicyReady").Return(true)
+
+	et, err := NewEnrollerT(mustBuildConstraints("8.9.0"), &config.Server{}, bulker, c)
+	require.NoError(t, err)
+	a := &apiServer{et: et, sm: sm}
+
+	enroll := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/fleet/agents/enroll", strings.NewReader(`{"type":"PERMANENT","metadata":{"user_provided":{},"local":{}}}`))
+		r.Header.Set("Authorization", "ApiKey "+enrollKey.Token())
+		w := httptest.NewRecorder()
+		a.AgentEnroll(w, r, AgentEnrollParams{UserAgent: "elastic agent 8.9.0"})
+		return w
+	}
+
+	w := enroll()
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	var errResp HTTPErrResp
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &errResp))
+	assert.Equal(t, "ServerStarting", errResp.Error)
+	bulker.AssertNotCalled(t, "APIKeyCreate", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+	// The agent retries once the policy is ready.
+	w = enroll()
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp EnrollResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "policy-1", resp.Item.PolicyId)
+	sm.AssertExpectations(t)
+}
+
+func TestClaimEnrollmentKey(t *testing.T) {
+	key := model.EnrollmentAPIKey{
+		ESDocument: model.ESDocument{Id: "enroll-doc"},
+		APIKeyID:   "enroll-key",
+		Active:     true,
+		MaxAgents:  5,
+	}
+
+	t.Run("race for the last slot", func(t *testing.T) {
+		bulker := &usageBulker{MockBulk: ftesting.NewMockBulk(), used: 4, maxAgents: 5}
+		c := testcache.NewMockCache()
+		c.On("DeleteEnrollmentAPIKey", "enroll-key")
+		et, _ := NewEnrollerT(mustBuildConstraints("8.9.0"), &config.Server{}, bulker, c)
+
+		const n = 20
+		errs := make([]error, n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				k := key
+				errs[i] = et.claimEnrollmentKey(context.Background(), zerolog.Nop(), rollback.New(zerolog.Nop()), &k)
+			}(i)
+		}
+		wg.Wait()
+
+		var claimed int
+		for _, err := range errs {
+			if err == nil {
+				claimed++
+				continue
+			}
+			require.ErrorIs(t, err, dl.ErrEnrollmentAPIKeyExhausted)
+			resp := NewHTTPErrResp(err)
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+			assert.Equal(t, "EnrollmentKeyExhausted", resp.Error)
+		}
+		assert.Equal(t, 1, claimed, "expected a single enrollment to get the last slot")
+		assert.Equal(t, int64(5), bulker.used)
+		c.AssertCalled(t, "DeleteEnrollmentAPIKey", "enroll-key")
+	})
+
+	t.Run("released on rollback", func(t *testing.T) {
+		bulker := &usageBulker{MockBulk: ftesting.NewMockBulk(), maxAgents: 5}
+		c := testcache.NewMockCache()
+		et, _ := NewEnrollerT(mustBuildConstraints("8.9.0"), &config.Server{}, bulker, c)
+
+		rb := rollback.New(zerolog.Nop())
+		k := key
+		require.NoError(t, et.claimEnrollmentKey(context.Background(), zerolog.Nop(), rb, &k))
+		assert.Equal(t, int64(1), bulker.used)
+		require.NoError(t, rb.Rollback(context.Background()))
+		assert.Equal(t, int64(0), bulker.used)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		bulker := ftesting.NewMockBulk()
+		c := testcache.NewMockCache()
+		c.On("DeleteEnrollmentAPIKey", "enroll-key")
+		et, _ := NewEnrollerT(mustBuildConstraints("8.9.0"), &config.Server{}, bulker, c)
+
+		k := key
+		k.ExpiresAt = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+		err := et.claimEnrollmentKey(context.Background(), zerolog.Nop(), rollback.New(zerolog.Nop()), &k)
+		require.ErrorIs(t, err, ErrEnrollmentKeyExpired)
+		resp := NewHTTPErrResp(err)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		assert.Equal(t, "EnrollmentKeyExpired", resp.Error)
+		bulker.AssertNotCalled(t, "MUpdate", mock.Anything, mock.Anything, mock.Anything)
+		c.AssertCalled(t, "DeleteEnrollmentAPIKey", "enroll-key")
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		bulker := ftesting.NewMockBulk()
+		et, _ := NewEnrollerT(mustBuildConstraints("8.9.0"), &config.Server{}, bulker, testcache.NewMockCache())
+
+		k := key
+		k.MaxAgents = 0
+		k.ExpiresAt = time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+		require.NoError(t, et.claimEnrollmentKey(context.Background(), zerolog.Nop(), rollback.New(zerolog.Nop()), &k))
+		bulker.AssertNotCalled(t, "MUpdate", mock.Anything, mock.Anything, mock.Anything)
+	})
+}
+
+func TestEnrollMaxConcurrency(t *testing.T) {
+	// Elasticsearch stalls the API key creations of the enrollments until stall is closed.
+	stall := make(chan struct{})
+	started := make(chan struct{}, 2)
+	bulker := ftesting.NewMockBulk()
+	bulker.On("Search", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(&es.ResultT{
+		HitsT: es.HitsT{
+			Hits: make([]es.HitT, 0),
+		},
+	}, nil)
+	bulker.On("APIKeyCreate", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(mock.Arguments) {
+		started <- struct{}{}
+		<-stall
+	}).Return(&apikey.APIKey{ID: "access-key", Key: "secret"}, nil)
+	bulker.On("Create", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return("", nil)
+	enrollKey := apikey.APIKey{ID: "enroll-key", Key: "secret"}
+	c := testcache.NewMockCache()
+	c.On("ValidAPIKey", enrollKey).Return(true)
+	c.On("GetEnrollmentAPIKey", "enroll-key").Return(model.EnrollmentAPIKey{PolicyID: "policy-1", Active: true}, true)
+	c.On("SetAPIKey", mock.Anything, true)
+	sm := mockmonitor.NewMockMonitor()
+	sm.On("PolicyReady").Return(true)
+
+	cfg := &config.Server{Enroll: config.Enroll{MaxConcurrency: 2, MaxConcurrencyWait: 50 * time.Millisecond}}
+	et, err := NewEnrollerT(mustBuildConstraints("8.9.0"), cfg, bulker, c)
+	require.NoError(t, err)
+	a := &apiServer{et: et, sm: sm}
+
+	enroll := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/fleet/agents/enroll", strings.NewReader(`{"type":"PERMANENT","metadata":{"user_provided":{},"local":{}}}`))
+		r.Header.Set("Authorization", "ApiKey "+enrollKey.Token())
+		w := httptest.NewRecorder()
+		a.AgentEnroll(w, r, AgentEnrollParams{UserAgent: "elastic agent 8.9.0"})
+		return w
+	}
+
+	inFlight := cntEnrollInFlight.metric.Get()
+	var wg sync.WaitGroup
+	stalled := make([]*httptest.ResponseRecorder, 2)
+	for i := range stalled {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stalled[i] = enroll()
+		}()
+	}
+	<-started
+	<-started
+	assert.Equal(t, inFlight+2, cntEnrollInFlight.metric.Get())
+
+	// The third enrollment is rejected once it waited max_concurrency_wait, not after the stalled ones.
+	start := time.Now()
+	w := enroll()
+	assert.Less(t, time.Since(start), time.Second)
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	var errResp HTTPErrResp
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &errResp))
+	assert.Equal(t, "EnrollMaxConcurrency", errResp.Error)
+
+	close(stall)
+	wg.Wait()
+	for _, w := range stalled {
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+	assert.Equal(t, inFlight, cntEnrollInFlight.metric.Get())
+
+	// The slots are released with the enrollments.
+	w = enroll()
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	bulker.AssertNumberOfCalls(t, "APIKeyCreate", 3)
+}
+
+func TestEnrollMaxConcurrencyReload(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.Server{Enroll: config.Enroll{MaxConcurrency: 1, MaxConcurrencyWait: time.Millisecond}}
+	et, err := NewEnrollerT(mustBuildConstraints("8.9.0"), cfg, ftesting.NewMockBulk(), testcache.NewMockCache())
+	require.NoError(t, err)
+
+	release, err := et.acquire(ctx)
+	require.NoError(t, err)
+	_, err = et.acquire(ctx)
+	require.ErrorIs(t, err, ErrEnrollConcurrency)
+
+	// The new bound applies to the next enrollments, the one in flight releases its slot to the previous bound.
+	et.ReloadEnroll(&config.Enroll{MaxConcurrency: 2})
+	for i := 0; i < 2; i++ {
+		release, err := et.acquire(ctx)
+		require.NoError(t, err)
+		defer release()
+	}
+	_, err = et.acquire(ctx)
+	require.ErrorIs(t, err, ErrEnrollConcurrency)
+	release()
+
+	et.ReloadEnroll(&config.Enroll{})
+	release, err = et.acquire(ctx)
+	require.NoError(t, err)
+	release()
 }
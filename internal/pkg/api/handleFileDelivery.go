@@ -6,7 +6,6 @@ package api
 
 import (
 	"context"
-	"errors"
 	"net/http"
 	"strconv"
 
@@ -55,10 +54,6 @@ func (ft *FileDeliveryT) handleSendFile(zlog zerolog.Logger, w http.ResponseWrit
 	}
 
 	chunks, err := ft.deliverer.LocateChunks(r.Context(), zlog, fileID)
-	if errors.Is(err, delivery.ErrNoFile) {
-		w.WriteHeader(http.StatusNotFound)
-		return err
-	}
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,158 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/rs/zerolog"
+	"go.elastic.co/apm/v2"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/apikey"
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
+	"github.com/elastic/fleet-server/v7/internal/pkg/policy"
+)
+
+const (
+	// redactedValue replaces the secret values and the API keys of a policy preview.
+	redactedValue = "[redacted]"
+
+	// filteredNamespace is the reason of the inputs filtered because the policy is not in the agent namespaces.
+	filteredNamespace = "namespace"
+)
+
+// PolicyPreviewT renders the policy an agent would receive on requests authenticated with a fleet-server service token.
+type PolicyPreviewT struct {
+	cfg    *config.Server
+	bulker bulk.Bulk
+	pm     policy.Monitor
+
+	authServiceToken func(*http.Request, bulk.Bulk) (*apikey.SecurityInfo, error)
+}
+
+func NewPolicyPreviewT(cfg *config.Server, bulker bulk.Bulk, pm policy.Monitor) *PolicyPreviewT {
+	return &PolicyPreviewT{
+		cfg:              cfg,
+		bulker:           bulker,
+		pm:               pm,
+		authServiceToken: authServiceToken,
+	}
+}
+
+// redactedSecrets reads every secret of a policy as redactedValue, the secret values are never read.
+type redactedSecrets struct {
+	bulk.Bulk
+}
+
+func (redactedSecrets) ReadSecrets(_ context.Context, ids []string) (map[string]string, error) {
+	secrets := make(map[string]string, len(ids))
+	for _, id := range ids {
+		secrets[id] = redactedValue
+	}
+	return secrets, nil
+}
+
+// handlePolicyPreview renders the latest revision of the agent's policy like processPolicy, without writing anything:
+// the outputs are prepared with policy.Output.Preview, so no API key is created, updated or retired.
+func (ppt *PolicyPreviewT) handlePolicyPreview(zlog zerolog.Logger, w http.ResponseWriter, r *http.Request, agentID string, reveal bool) error {
+	info, err := ppt.authServiceToken(r, ppt.bulker)
+	if err != nil {
+		return err
+	}
+	zlog = zlog.With().Str("userName", info.UserName).Bool("reveal", reveal).Logger()
+	ctx := zlog.WithContext(r.Context())
+
+	agent, err := dl.FindAgent(ctx, ppt.bulker, dl.QueryAgentByID, dl.FieldID, agentID)
+	if err != nil {
+		return fmt.Errorf("find agent: %w", err)
+	}
+	if agent.PolicyID == "" {
+		return fmt.Errorf("agent has no policy: %w", dl.ErrNotFound)
+	}
+	p, err := dl.FindLatestPolicy(ctx, ppt.bulker, agent.PolicyID)
+	if err != nil {
+		return fmt.Errorf("find policy: %w", err)
+	}
+
+	secrets := ppt.bulker
+	if !reveal {
+		secrets = redactedSecrets{ppt.bulker}
+	}
+	pp, err := ppt.pm.Parse(ctx, secrets, *p)
+	if err != nil {
+		return fmt.Errorf("parse policy: %w", err)
+	}
+
+	rev := policy.RevisionFromPolicy(pp.Policy)
+	resp := PolicyPreviewResponse{
+		ActionId:       rev.String(),
+		FilteredInputs: []PolicyPreviewFilteredInput{},
+		PreviewKeys:    []string{},
+		Redacted:       !reveal,
+		Revision:       rev.RevisionIdx,
+	}
+	action, err := renderAgentPolicy(zlog, &agent, pp, func(output *policy.Output, outputs map[string]map[string]interface{}) error {
+		minted, err := output.Preview(&agent, outputs)
+		if err != nil {
+			return err
+		}
+		if minted {
+			resp.PreviewKeys = append(resp.PreviewKeys, output.Name)
+		} else if _, ok := outputs[output.Name]["api_key"]; ok && !reveal {
+			outputs[output.Name]["api_key"] = redactedValue
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, ErrPolicyNamespace):
+		// The agent would not receive the policy, none of its inputs.
+		for _, input := range pp.Inputs {
+			id, _ := input["id"].(string)
+			resp.FilteredInputs = append(resp.FilteredInputs, PolicyPreviewFilteredInput{Id: id, Reason: filteredNamespace})
+		}
+	case err != nil:
+		return fmt.Errorf("render policy: %w", err)
+	default:
+		data, err := action.Data.MarshalJSON()
+		if err != nil {
+			return fmt.Errorf("marshal policy change: %w", err)
+		}
+		var change struct {
+			Policy json.RawMessage `json:"policy"`
+		}
+		if err := json.Unmarshal(data, &change); err != nil {
+			return fmt.Errorf("unmarshal policy change: %w", err)
+		}
+		resp.Policy = change.Policy
+	}
+	slices.Sort(resp.PreviewKeys)
+
+	span, _ := apm.StartSpan(ctx, "response", "write")
+	defer span.End()
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("marshal policyPreviewResponse: %w", err)
+	}
+	nWritten, err := w.Write(data)
+	cntPolicyPreview.bodyOut.Add(uint64(nWritten))
+	if err != nil {
+		return fmt.Errorf("fail send policy preview response: %w", err)
+	}
+	zlog.Info().
+		Str(logger.PolicyID, pp.Policy.PolicyID).
+		Int64(logger.RevisionIdx, rev.RevisionIdx).
+		Int("filteredInputs", len(resp.FilteredInputs)).
+		Strs("previewKeys", resp.PreviewKeys).
+		Msg("Policy preview sent")
+	return nil
+}
@@ -0,0 +1,195 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/apikey"
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	mockmonitor "github.com/elastic/fleet-server/v7/internal/pkg/monitor/mock"
+	"github.com/elastic/fleet-server/v7/internal/pkg/policy"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+const previewPolicySource = `{
+	"policy_id": "policy-1",
+	"revision_idx": 3,
+	"namespaces": ["space1"],
+	"data": {
+		"id": "policy-1",
+		"outputs": {
+			"default": {"type": "elasticsearch", "hosts": ["https://es:9200"], "secrets": {"password": {"id": "output-secret"}}}
+		},
+		"output_permissions": {
+			"default": {"_elastic_agent_checks": {"cluster": ["monitor"]}}
+		},
+		"inputs": [
+			{"id": "input-1", "type": "logfile", "use_output": "default", "password": "$co.elastic.secret{input-secret}"},
+			{"id": "input-2", "type": "system/metrics", "use_output": "default"}
+		],
+		"secret_references": [{"id": "input-secret"}]
+	}
+}`
+
+func TestHandlePolicyPreview(t *testing.T) {
+	zlog := testlog.SetLogger(t)
+	fleetServer := func(*http.Request, bulk.Bulk) (*apikey.SecurityInfo, error) {
+		return &apikey.SecurityInfo{UserName: fleetServerServiceAccount}, nil
+	}
+	pm := policy.NewMonitor(ftesting.NewMockBulk(), mockmonitor.NewMockMonitor(), config.ServerLimits{})
+
+	// The policy is parsed from a new document each time, parsing resolves its secrets in place.
+	parse := func(t *testing.T, bulker bulk.Bulk) *policy.ParsedPolicy {
+		t.Helper()
+		var p model.Policy
+		require.NoError(t, json.Unmarshal([]byte(previewPolicySource), &p))
+		pp, err := pm.Parse(context.Background(), bulker, p)
+		require.NoError(t, err)
+		return pp
+	}
+
+	// The permissions hash of the agent output key is the one of the restricted output permissions.
+	parsed := parse(t, ftesting.NewMockBulk())
+	withKey := fmt.Sprintf(`{"agent":{"id":"agent-1"},"policy_id":"policy-1","namespaces":["space1"],"outputs":{"default":{"api_key":"key-1:secret","api_key_id":"key-1","permissions_hash":%q,"type":"elasticsearch"}}}`, parsed.Roles["default"].Sha2)
+
+	setup := func(agent string) *ftesting.MockBulk {
+		bulker := ftesting.NewMockBulk()
+		bulker.On("Search", mock.Anything, dl.FleetAgents, mock.Anything, mock.Anything).Return(&es.ResultT{HitsT: es.HitsT{
+			Hits: []es.HitT{{ID: "agent-1", Source: json.RawMessage(agent)}},
+		}}, nil)
+		bulker.On("Search", mock.Anything, dl.FleetPolicies, mock.Anything, mock.Anything).Return(&es.ResultT{HitsT: es.HitsT{
+			Hits: []es.HitT{{ID: "policy-doc", Source: json.RawMessage(previewPolicySource)}},
+		}}, nil)
+		return bulker
+	}
+	preview := func(t *testing.T, bulker bulk.Bulk, reveal bool) PolicyPreviewResponse {
+		t.Helper()
+		ppt := &PolicyPreviewT{cfg: &config.Server{}, bulker: bulker, pm: pm, authServiceToken: fleetServer}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/api/fleet/agents/agent-1/policy/preview", nil)
+		require.NoError(t, ppt.handlePolicyPreview(zlog, w, r, "agent-1", reveal))
+		require.Equal(t, http.StatusOK, w.Code)
+		var resp PolicyPreviewResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp
+	}
+
+	t.Run("same policy as checkin", func(t *testing.T) {
+		bulker := setup(withKey)
+		resp := preview(t, bulker, true)
+
+		// The policy change the agent receives on checkin.
+		action, err := processPolicy(context.Background(), zlog, bulker, "agent-1", parse(t, bulker))
+		require.NoError(t, err)
+		data, err := action.Data.MarshalJSON()
+		require.NoError(t, err)
+		var change struct {
+			Policy json.RawMessage `json:"policy"`
+		}
+		require.NoError(t, json.Unmarshal(data, &change))
+
+		assert.Equal(t, action.Id, resp.ActionId)
+		assert.Equal(t, int64(3), resp.Revision)
+		assert.False(t, resp.Redacted)
+		assert.Empty(t, resp.PreviewKeys)
+		assert.Empty(t, resp.FilteredInputs)
+		assert.JSONEq(t, string(change.Policy), string(resp.Policy))
+		assert.Contains(t, string(resp.Policy), "input-secret_value")
+		assert.Contains(t, string(resp.Policy), "key-1:secret")
+		bulker.AssertNotCalled(t, "APIKeyCreate", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+		bulker.AssertNotCalled(t, "Update", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("redacted", func(t *testing.T) {
+		resp := preview(t, setup(withKey), false)
+
+		assert.True(t, resp.Redacted)
+		var got struct {
+			Outputs map[string]map[string]interface{} `json:"outputs"`
+			Inputs  []map[string]interface{}          `json:"inputs"`
+		}
+		require.NoError(t, json.Unmarshal(resp.Policy, &got))
+		assert.Equal(t, redactedValue, got.Outputs["default"]["api_key"])
+		assert.Equal(t, redactedValue, got.Outputs["default"]["password"])
+		require.Len(t, got.Inputs, 2)
+		assert.Equal(t, redactedValue, got.Inputs[0]["password"])
+		assert.NotContains(t, string(resp.Policy), "_value")
+		assert.NotContains(t, string(resp.Policy), "key-1:secret")
+	})
+
+	t.Run("new output key", func(t *testing.T) {
+		bulker := setup(`{"agent":{"id":"agent-1"},"policy_id":"policy-1","namespaces":["space1"]}`)
+		resp := preview(t, bulker, true)
+
+		assert.Equal(t, []string{"default"}, resp.PreviewKeys)
+		var got struct {
+			Outputs map[string]map[string]interface{} `json:"outputs"`
+		}
+		require.NoError(t, json.Unmarshal(resp.Policy, &got))
+		assert.Equal(t, policy.PreviewAPIKey, got.Outputs["default"]["api_key"])
+		bulker.AssertNotCalled(t, "APIKeyCreate", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+		bulker.AssertNotCalled(t, "Update", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("filtered by namespace", func(t *testing.T) {
+		resp := preview(t, setup(`{"agent":{"id":"agent-1"},"policy_id":"policy-1","namespaces":["space2"]}`), true)
+
+		assert.Equal(t, []PolicyPreviewFilteredInput{
+			{Id: "input-1", Reason: filteredNamespace},
+			{Id: "input-2", Reason: filteredNamespace},
+		}, resp.FilteredInputs)
+		assert.Empty(t, resp.Policy)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			auth   func(*http.Request, bulk.Bulk) (*apikey.SecurityInfo, error)
+			agent  string
+			err    error
+			status int
+		}{{
+			name: "not authenticated",
+			auth: func(*http.Request, bulk.Bulk) (*apikey.SecurityInfo, error) {
+				return nil, apikey.ErrNoAuthHeader
+			},
+			err:    apikey.ErrNoAuthHeader,
+			status: http.StatusUnauthorized,
+		}, {
+			name:   "agent without policy",
+			auth:   fleetServer,
+			agent:  `{"agent":{"id":"agent-1"}}`,
+			err:    dl.ErrNotFound,
+			status: http.StatusNotFound,
+		}}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				ppt := &PolicyPreviewT{cfg: &config.Server{}, bulker: setup(tc.agent), pm: pm, authServiceToken: tc.auth}
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest(http.MethodGet, "/api/fleet/agents/agent-1/policy/preview", nil)
+				err := ppt.handlePolicyPreview(zlog, w, r, "agent-1", false)
+				require.ErrorIs(t, err, tc.err)
+				assert.Equal(t, tc.status, NewHTTPErrResp(err).StatusCode)
+			})
+		}
+	})
+}
@@ -8,7 +8,12 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"mime"
 	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/elastic/elastic-agent-client/v7/pkg/client"
@@ -19,7 +24,9 @@ import (
 	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
 	"github.com/elastic/fleet-server/v7/internal/pkg/cache"
 	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/limit"
 	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger/errlog"
 	"github.com/elastic/fleet-server/v7/internal/pkg/policy"
 
 	"github.com/rs/zerolog"
@@ -27,25 +34,86 @@ import (
 
 const (
 	kStatusMod = "status"
+
+	// statusV2MediaType is the media type the version 2 status response is requested with.
+	statusV2MediaType = "application/vnd.fleet.status+json"
 )
 
+// statusDraining is the status message of a server that is draining before shutdown.
+var statusDraining = "draining"
+
 type AuthFunc func(*http.Request) (*apikey.APIKey, error)
 
 type StatusT struct {
-	cfg    *config.Server
-	bulk   bulk.Bulk
-	cache  cache.Cache
-	authfn AuthFunc
+	cfg      *config.Server
+	bulk     bulk.Bulk
+	cache    cache.Cache
+	authfn   AuthFunc
+	draining *atomic.Bool
+
+	// listeners are the connection limiters of the API servers, their open connections are reported in the limits.
+	listeners *listenerSet
+	// applied are the limits and cache settings the server is running with, they are replaced when they are reloaded.
+	applied *atomic.Pointer[appliedLimits]
+}
+
+// appliedLimits are the limits reported in an authorized status response.
+type appliedLimits struct {
+	limits config.ServerLimits
+	cache  config.Cache
+}
+
+// listenerSet is the set of the connection limiters of the running API servers.
+type listenerSet struct {
+	mu sync.Mutex
+	ls map[*limit.LimitListener]struct{}
+}
+
+func (s *listenerSet) add(l *limit.LimitListener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ls == nil {
+		s.ls = make(map[*limit.LimitListener]struct{})
+	}
+	s.ls[l] = struct{}{}
+}
+
+func (s *listenerSet) remove(l *limit.LimitListener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.ls, l)
+}
+
+// active returns the number of open connections counted against the limits.
+func (s *listenerSet) active() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for l := range s.ls {
+		n += l.Active()
+	}
+	return n
 }
 
 type OptFunc func(*StatusT)
 
+// WithCacheConfig sets the cache settings reported in the limits of an authorized status response.
+func WithCacheConfig(cfg config.Cache) OptFunc {
+	return func(st *StatusT) {
+		st.ReloadCache(cfg)
+	}
+}
+
 func NewStatusT(cfg *config.Server, bulker bulk.Bulk, cache cache.Cache, opts ...OptFunc) *StatusT {
 	st := &StatusT{
-		cfg:   cfg,
-		bulk:  bulker,
-		cache: cache,
+		cfg:       cfg,
+		bulk:      bulker,
+		cache:     cache,
+		draining:  &atomic.Bool{},
+		listeners: &listenerSet{},
+		applied:   &atomic.Pointer[appliedLimits]{},
 	}
+	st.applied.Store(&appliedLimits{limits: cfg.Limits})
 	st.authfn = st.authenticate
 
 	for _, opt := range opts {
@@ -54,6 +122,29 @@ func NewStatusT(cfg *config.Server, bulker bulk.Bulk, cache cache.Cache, opts ..
 	return st
 }
 
+// ReloadLimits sets the limits reported in the status responses to the limits applied to the running servers.
+func (st StatusT) ReloadLimits(cfg *config.ServerLimits) {
+	applied := *st.applied.Load()
+	applied.limits = *cfg
+	st.applied.Store(&applied)
+}
+
+// ReloadCache sets the cache settings reported in the status responses to the settings the cache was reconfigured with.
+func (st StatusT) ReloadCache(cfg config.Cache) {
+	applied := *st.applied.Load()
+	applied.cache = cfg
+	st.applied.Store(&applied)
+}
+
+// drain makes the status endpoint report the server as degraded, so that load balancers stop sending it requests.
+func (st StatusT) drain() {
+	st.draining.Store(true)
+}
+
+func (st StatusT) isDraining() bool {
+	return st.draining != nil && st.draining.Load()
+}
+
 func (st StatusT) authenticate(r *http.Request) (*apikey.APIKey, error) {
 	// This authenticates that the provided API key exists and is enabled.
 	// WARNING: This does not validate that the api key is valid for the Fleet Domain.
@@ -71,20 +162,17 @@ func (st StatusT) handleStatus(zlog zerolog.Logger, sm policy.SelfMonitor, bi bu
 
 	span, ctx := apm.StartSpan(r.Context(), "getState", "process")
 	state := sm.State()
-	resp := StatusAPIResponse{
-		Name:   build.ServiceName,
-		Status: StatusResponseStatus(state.String()), // TODO try to make the oapi codegen less verbose here
+	var message *string
+	if st.isDraining() {
+		state = client.UnitStateDegraded
+		message = &statusDraining
 	}
-
-	if authed {
-		sSpan, _ := apm.StartSpan(ctx, "getVersion", "process")
-		bt := bi.BuildTime.Format(time.RFC3339)
-		resp.Version = &StatusResponseVersion{
-			Number:    &bi.Version,
-			BuildHash: &bi.Commit,
-			BuildTime: &bt,
-		}
-		sSpan.End()
+	v2 := acceptsStatusV2(r)
+	var resp interface{}
+	if v2 {
+		resp = st.statusV2(ctx, bi, state, message, authed)
+	} else {
+		resp = st.statusV1(ctx, bi, state, message, authed)
 	}
 	span.End()
 
@@ -97,7 +185,7 @@ func (st StatusT) handleStatus(zlog zerolog.Logger, sm policy.SelfMonitor, bi bu
 		state = client.UnitStateStopping
 	}
 
-	data, err := json.Marshal(&resp)
+	data, err := json.Marshal(resp)
 	if err != nil {
 		return err
 	}
@@ -106,6 +194,10 @@ func (st StatusT) handleStatus(zlog zerolog.Logger, sm policy.SelfMonitor, bi bu
 	if state == client.UnitStateHealthy {
 		code = http.StatusOK
 	}
+	w.Header().Add("Vary", "Accept")
+	if v2 {
+		w.Header().Set("Content-Type", statusV2MediaType+"; version=2")
+	}
 	w.WriteHeader(code)
 
 	ts, ok := logger.CtxStartTime(r.Context())
@@ -129,3 +221,137 @@ func (st StatusT) handleStatus(zlog zerolog.Logger, sm policy.SelfMonitor, bi bu
 
 	return nil
 }
+
+// statusV1 returns the original status response, it only includes the version of the server if authenticated.
+func (st StatusT) statusV1(ctx context.Context, bi build.Info, state client.UnitState, message *string, authed bool) *StatusAPIResponse {
+	resp := &StatusAPIResponse{
+		Name:    build.ServiceName,
+		Status:  StatusResponseStatus(state.String()), // TODO try to make the oapi codegen less verbose here
+		Message: message,
+	}
+	if authed {
+		span, _ := apm.StartSpan(ctx, "getVersion", "process")
+		bt := bi.BuildTime.Format(time.RFC3339)
+		resp.Version = &StatusResponseVersion{
+			Number:    &bi.Version,
+			BuildHash: &bi.Commit,
+			BuildTime: &bt,
+		}
+		resp.Limits = st.limits()
+		span.End()
+	}
+	return resp
+}
+
+// statusV2 returns the version 2 status response. The supported API versions are always included so that clients
+// can negotiate before authenticating, the build details only if authenticated.
+func (st StatusT) statusV2(ctx context.Context, bi build.Info, state client.UnitState, message *string, authed bool) *StatusAPIResponseV2 {
+	resp := &StatusAPIResponseV2{
+		Name:    build.ServiceName,
+		Status:  StatusResponseStatus(state.String()),
+		Message: message,
+		ApiVersions: StatusResponseAPIVersions{
+			Min: slices.Min(SupportedVersions),
+			Max: slices.Max(SupportedVersions),
+		},
+	}
+	if authed {
+		span, _ := apm.StartSpan(ctx, "getVersion", "process")
+		resp.Version = &bi.Version
+		resp.Build = &StatusResponseBuild{
+			Commit: bi.Commit,
+			Time:   bi.BuildTime.Format(time.RFC3339),
+		}
+		resp.Limits = st.limits()
+		if zerolog.GlobalLevel() <= zerolog.DebugLevel {
+			resp.RecentErrors = recentErrors()
+		}
+		span.End()
+	}
+	return resp
+}
+
+// recentErrors returns the last errors of each subsystem, they are only included in the status response when debugging.
+func recentErrors() *StatusResponseRecentErrors {
+	snap := errlog.Snapshot()
+	recent := make(StatusResponseRecentErrors, len(snap))
+	for subsystem, records := range snap {
+		list := make([]StatusResponseErrorRecord, 0, len(records))
+		for _, rec := range records {
+			r := StatusResponseErrorRecord{
+				Timestamp: rec.Timestamp,
+				Source:    rec.Source,
+				Error:     rec.Error,
+			}
+			if rec.Fields != nil {
+				fields := rec.Fields
+				r.Fields = &fields
+			}
+			list = append(list, r)
+		}
+		recent[subsystem] = list
+	}
+	return &recent
+}
+
+// acceptsStatusV2 returns true if the request accepts the version 2 status response.
+func acceptsStatusV2(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mt := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(mt)
+			if err != nil {
+				continue
+			}
+			if mediaType == statusV2MediaType && params["version"] == "2" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// limits returns the effective limits the server is running with.
+func (st StatusT) limits() *StatusResponseLimits {
+	applied := st.applied.Load()
+	l := &applied.limits
+	retry := l.EnrollLimit.RetryLimit()
+	active := st.listeners.active()
+	return &StatusResponseLimits{
+		ActiveConnections: &active,
+		Agents: StatusResponseAgentLimits{
+			Min: l.Agents.Min,
+			Max: l.Agents.Max,
+		},
+		Cache: StatusResponseCacheLimits{
+			NumCounters: applied.cache.NumCounters,
+			MaxCost:     applied.cache.MaxCost,
+		},
+		PolicyThrottle: l.PolicyThrottle.String(),
+		MaxConnections: l.MaxConnections,
+		Endpoints: map[string]StatusResponseEndpointLimit{
+			"action_limit":        endpointLimit(&l.ActionLimit),
+			"policy_limit":        endpointLimit(&l.PolicyLimit),
+			"checkin_limit":       endpointLimit(&l.CheckinLimit),
+			"artifact_limit":      endpointLimit(&l.ArtifactLimit),
+			"enroll_limit":        endpointLimit(&l.EnrollLimit.Limit),
+			"enroll_retry_limit":  endpointLimit(&retry),
+			"ack_limit":           endpointLimit(&l.AckLimit),
+			"status_limit":        endpointLimit(&l.StatusLimit),
+			"upload_start_limit":  endpointLimit(&l.UploadStartLimit),
+			"upload_end_limit":    endpointLimit(&l.UploadEndLimit),
+			"upload_chunk_limit":  endpointLimit(&l.UploadChunkLimit),
+			"file_delivery_limit": endpointLimit(&l.DeliverFileLimit),
+			"pgp_retrieval_limit": endpointLimit(&l.GetPGPKey),
+			"agent_actions_limit": endpointLimit(&l.AgentActions),
+		},
+	}
+}
+
+func endpointLimit(l *config.Limit) StatusResponseEndpointLimit {
+	return StatusResponseEndpointLimit{
+		Interval:        l.Interval.String(),
+		Burst:           l.Burst,
+		Max:             l.Max,
+		MaxBodyByteSize: l.MaxBody,
+	}
+}
@@ -9,6 +9,7 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -20,8 +21,10 @@ import (
 	fbuild "github.com/elastic/fleet-server/v7/internal/pkg/build"
 	"github.com/elastic/fleet-server/v7/internal/pkg/cache"
 	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger/errlog"
 	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
 
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -46,6 +49,10 @@ func (pm *mockPolicyMonitor) State() client.UnitState {
 	return pm.state
 }
 
+func (pm *mockPolicyMonitor) PolicyReady() bool {
+	return true
+}
+
 func TestHandleStatus(t *testing.T) {
 	ctx := context.Background()
 
@@ -128,3 +135,271 @@ func TestHandleStatus(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleStatusLimits(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.InitDefaults()
+	cfg.Inputs[0].Server.Limits.MaxAgents = 2500
+	cfg.Inputs[0].Server.Limits.CheckinLimit.Max = 42
+	cfg.Inputs[0].Server.Limits.MaxConnections = 100
+	cfg.Inputs[0].Server.Limits.PolicyThrottle = 7 * time.Millisecond
+	cfg.Inputs[0].Cache.MaxCost = 1024
+	require.NoError(t, cfg.LoadServerLimits())
+
+	c, err := cache.New(config.Cache{NumCounters: 100, MaxCost: 100000})
+	require.NoError(t, err)
+
+	authfnOk := func(r *http.Request) (*apikey.APIKey, error) {
+		return nil, nil
+	}
+	authfnFail := func(r *http.Request) (*apikey.APIKey, error) {
+		return nil, apikey.ErrNoAuthHeader
+	}
+
+	serve := func(t *testing.T, authfn AuthFunc) []byte {
+		logger := testlog.SetLogger(t)
+		ctx := logger.WithContext(context.Background())
+		r := apiServer{
+			st: NewStatusT(&cfg.Inputs[0].Server, nil, c, withAuthFunc(authfn), WithCacheConfig(cfg.Inputs[0].Cache)),
+			sm: &mockPolicyMonitor{client.UnitStateHealthy},
+			bi: fbuild.Info{Version: "8.1.0"},
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "/api/status", nil)
+		Handler(&r).ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		return w.Body.Bytes()
+	}
+
+	t.Run("authenticated", func(t *testing.T) {
+		body := serve(t, authfnOk)
+
+		var raw map[string]json.RawMessage
+		require.NoError(t, json.Unmarshal(body, &raw))
+		require.Contains(t, raw, "limits")
+		var limits map[string]json.RawMessage
+		require.NoError(t, json.Unmarshal(raw["limits"], &limits))
+		for _, key := range []string{"agents", "cache", "policy_throttle", "max_connections", "endpoints"} {
+			assert.Contains(t, limits, key)
+		}
+
+		var res StatusAPIResponse
+		require.NoError(t, json.Unmarshal(body, &res))
+		require.NotNil(t, res.Limits)
+		assert.Equal(t, StatusResponseAgentLimits{Min: 0, Max: 2500}, res.Limits.Agents)
+		assert.Equal(t, StatusResponseCacheLimits{NumCounters: 20000, MaxCost: 1024}, res.Limits.Cache)
+		assert.Equal(t, 100, res.Limits.MaxConnections)
+		require.NotNil(t, res.Limits.ActiveConnections)
+		assert.Equal(t, int64(0), *res.Limits.ActiveConnections)
+		assert.Equal(t, "7ms", res.Limits.PolicyThrottle)
+
+		require.Contains(t, res.Limits.Endpoints, "checkin_limit")
+		checkin := res.Limits.Endpoints["checkin_limit"]
+		assert.Equal(t, "5ms", checkin.Interval)
+		assert.Equal(t, 500, checkin.Burst)
+		assert.Equal(t, int64(42), checkin.Max)
+		assert.Positive(t, checkin.MaxBodyByteSize)
+		require.Contains(t, res.Limits.Endpoints, "enroll_limit")
+		assert.Equal(t, int64(100), res.Limits.Endpoints["enroll_limit"].Max)
+		require.Contains(t, res.Limits.Endpoints, "enroll_retry_limit")
+		assert.Equal(t, int64(400), res.Limits.Endpoints["enroll_retry_limit"].Max)
+		assert.Equal(t, 4*res.Limits.Endpoints["enroll_limit"].Burst, res.Limits.Endpoints["enroll_retry_limit"].Burst)
+	})
+
+	t.Run("non authenticated", func(t *testing.T) {
+		var res StatusAPIResponse
+		require.NoError(t, json.Unmarshal(serve(t, authfnFail), &res))
+		assert.Nil(t, res.Limits)
+	})
+}
+
+func TestHandleStatusLimitsReload(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.InitDefaults()
+	require.NoError(t, cfg.LoadServerLimitsForAgents(100))
+
+	c, err := cache.New(config.Cache{NumCounters: 100, MaxCost: 100000})
+	require.NoError(t, err)
+	authfn := func(r *http.Request) (*apikey.APIKey, error) {
+		return nil, nil
+	}
+	st := NewStatusT(&cfg.Inputs[0].Server, nil, c, withAuthFunc(authfn), WithCacheConfig(cfg.Inputs[0].Cache))
+
+	status := func(t *testing.T) StatusAPIResponse {
+		ctx := testlog.SetLogger(t).WithContext(context.Background())
+		r := apiServer{
+			st: st,
+			sm: &mockPolicyMonitor{client.UnitStateHealthy},
+			bi: fbuild.Info{Version: "8.1.0"},
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "/api/status", nil)
+		Handler(&r).ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		var res StatusAPIResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		require.NotNil(t, res.Limits)
+		return res
+	}
+	assert.Equal(t, StatusResponseAgentLimits{Min: 0, Max: 2500}, status(t).Limits.Agents)
+
+	// The limits of a larger tier are reloaded without restarting the server.
+	newCfg := cfg.Copy()
+	require.NoError(t, newCfg.LoadServerLimitsForAgents(15000))
+	st.ReloadLimits(&newCfg.Inputs[0].Server.Limits)
+	st.ReloadCache(config.CopyCache(newCfg))
+
+	res := status(t)
+	assert.Equal(t, StatusResponseAgentLimits{Min: 10001, Max: 20000}, res.Limits.Agents)
+	assert.Equal(t, 42000, res.Limits.MaxConnections)
+	assert.Equal(t, StatusResponseCacheLimits{NumCounters: newCfg.Inputs[0].Cache.NumCounters, MaxCost: newCfg.Inputs[0].Cache.MaxCost}, res.Limits.Cache)
+	assert.NotEqual(t, cfg.Inputs[0].Cache.NumCounters, res.Limits.Cache.NumCounters)
+}
+
+func TestHandleStatusDraining(t *testing.T) {
+	cfg := &config.Server{}
+	cfg.InitDefaults()
+	c, err := cache.New(config.Cache{NumCounters: 100, MaxCost: 100000})
+	require.NoError(t, err)
+
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	authfn := func(r *http.Request) (*apikey.APIKey, error) {
+		return nil, nil
+	}
+	r := apiServer{
+		st: NewStatusT(cfg, nil, c, withAuthFunc(authfn)),
+		sm: &mockPolicyMonitor{client.UnitStateHealthy},
+		bi: fbuild.Info{Version: "8.1.0"},
+	}
+
+	serve := func() (int, StatusAPIResponse) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "/api/status", nil)
+		Handler(&r).ServeHTTP(w, req)
+		var res StatusAPIResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		return w.Code, res
+	}
+
+	code, res := serve()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Nil(t, res.Message)
+
+	r.st.drain()
+	code, res = serve()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, client.UnitStateDegraded.String(), string(res.Status))
+	require.NotNil(t, res.Message)
+	assert.Equal(t, "draining", *res.Message)
+}
+
+func TestHandleStatusV2(t *testing.T) {
+	cfg := &config.Server{}
+	cfg.InitDefaults()
+	c, err := cache.New(config.Cache{NumCounters: 100, MaxCost: 100000})
+	require.NoError(t, err)
+
+	authfnOk := func(r *http.Request) (*apikey.APIKey, error) {
+		return nil, nil
+	}
+	authfnFail := func(r *http.Request) (*apikey.APIKey, error) {
+		return nil, apikey.ErrNoAuthHeader
+	}
+	bi := fbuild.Info{
+		Version:   "8.1.0",
+		Commit:    "4eff928",
+		BuildTime: time.Date(2022, 12, 1, 1, 2, 3, 0, time.UTC),
+	}
+
+	serve := func(t *testing.T, authfn AuthFunc, accept string) *httptest.ResponseRecorder {
+		ctx := testlog.SetLogger(t).WithContext(context.Background())
+		r := apiServer{
+			st: NewStatusT(cfg, nil, c, withAuthFunc(authfn)),
+			sm: &mockPolicyMonitor{client.UnitStateHealthy},
+			bi: bi,
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "/api/status", nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		Handler(&r).ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		return w
+	}
+	keys := func(t *testing.T, w *httptest.ResponseRecorder) []string {
+		var raw map[string]json.RawMessage
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &raw))
+		keys := make([]string, 0, len(raw))
+		for k := range raw {
+			keys = append(keys, k)
+		}
+		return keys
+	}
+
+	setLevel := func(t *testing.T, level zerolog.Level) {
+		prev := zerolog.GlobalLevel()
+		zerolog.SetGlobalLevel(level)
+		t.Cleanup(func() { zerolog.SetGlobalLevel(prev) })
+	}
+
+	t.Run("authenticated", func(t *testing.T) {
+		// The recent errors are only included when debugging.
+		setLevel(t, zerolog.InfoLevel)
+		w := serve(t, authfnOk, "application/vnd.fleet.status+json; version=2")
+		assert.Equal(t, "application/vnd.fleet.status+json; version=2", w.Header().Get("Content-Type"))
+		assert.ElementsMatch(t, []string{"name", "status", "version", "build", "api_versions", "limits"}, keys(t, w))
+
+		var res StatusAPIResponseV2
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		assert.Equal(t, "fleet-server", res.Name)
+		assert.Equal(t, client.UnitStateHealthy.String(), string(res.Status))
+		require.NotNil(t, res.Version)
+		assert.Equal(t, "8.1.0", *res.Version)
+		require.NotNil(t, res.Build)
+		assert.Equal(t, StatusResponseBuild{Commit: "4eff928", Time: "2022-12-01T01:02:03Z"}, *res.Build)
+		assert.Equal(t, StatusResponseAPIVersions{Min: DefaultVersion, Max: DefaultVersion}, res.ApiVersions)
+	})
+
+	t.Run("authenticated debug", func(t *testing.T) {
+		setLevel(t, zerolog.DebugLevel)
+		errlog.Report(errlog.SubsystemHandler, "checkin", errors.New("failed with ApiKey c2VjcmV0"), map[string]string{"agent.id": "agent-1"})
+		w := serve(t, authfnOk, "application/vnd.fleet.status+json; version=2")
+		assert.Contains(t, keys(t, w), "recent_errors")
+
+		var res StatusAPIResponseV2
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		require.NotNil(t, res.RecentErrors)
+		records := (*res.RecentErrors)[errlog.SubsystemHandler]
+		require.NotEmpty(t, records)
+		last := records[len(records)-1]
+		assert.Equal(t, "checkin", last.Source)
+		assert.Equal(t, "failed with ApiKey [redacted]", last.Error)
+		require.NotNil(t, last.Fields)
+		assert.Equal(t, map[string]string{"agent.id": "agent-1"}, *last.Fields)
+	})
+
+	t.Run("non authenticated", func(t *testing.T) {
+		setLevel(t, zerolog.DebugLevel)
+		w := serve(t, authfnFail, "application/json, application/vnd.fleet.status+json;version=2")
+		assert.ElementsMatch(t, []string{"name", "status", "api_versions"}, keys(t, w))
+
+		var res StatusAPIResponseV2
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		assert.Nil(t, res.Version)
+		assert.Nil(t, res.Build)
+		assert.Equal(t, StatusResponseAPIVersions{Min: DefaultVersion, Max: DefaultVersion}, res.ApiVersions)
+	})
+
+	t.Run("older clients get the original response", func(t *testing.T) {
+		for _, accept := range []string{"", "application/json", "application/vnd.fleet.status+json", "application/vnd.fleet.status+json; version=3"} {
+			w := serve(t, authfnOk, accept)
+			assert.ElementsMatch(t, []string{"name", "status", "version", "limits"}, keys(t, w), accept)
+
+			var res StatusAPIResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			require.NotNil(t, res.Version)
+			assert.Equal(t, "4eff928", *res.Version.BuildHash)
+		}
+	})
+}
@@ -5,6 +5,7 @@
 package api
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
@@ -136,33 +137,31 @@ func (ut *UploadT) handleUploadChunk(zlog zerolog.Logger, w http.ResponseWriter,
 	// prevent over-sized chunks
 	data := http.MaxBytesReader(w, r.Body, file.MaxChunkSize)
 
-	// compute hash as we stream it
-	hash := sha256.New()
-	copier := io.TeeReader(data, hash)
-
-	ce := cbor.NewChunkWriter(copier, chunkInfo.Last, chunkInfo.BID, chunkInfo.SHA2, upinfo.ChunkSize)
-	if err := uploader.IndexChunk(r.Context(), ut.chunkClient, ce, upinfo.Source, chunkInfo.BID, chunkInfo.Pos); err != nil {
+	// verify the hash before the chunk is indexed, so a corrupted chunk is rejected
+	// without being written and the agent can send that chunk again
+	span, _ := apm.StartSpan(r.Context(), "validateChunk", "validate")
+	chunk, err := io.ReadAll(data)
+	if err != nil {
+		span.End()
 		return err
 	}
-
-	span, ctx := apm.StartSpan(r.Context(), "validateIndexChunk", "validate")
-	hashsum := hex.EncodeToString(hash.Sum(nil))
-
-	if !strings.EqualFold(chunkHash, hashsum) {
-		// delete document, since we wrote it, but the hash was invalid
-		// context scoped to allow this operation to finish even if client disconnects
-		if err := uploader.DeleteChunk(ctx, ut.bulker, upinfo.Source, chunkInfo.BID, chunkInfo.Pos); err != nil {
-			zlog.Warn().Err(err).
-				Str("source", upinfo.Source).
-				Str("fileID", chunkInfo.BID).
-				Int("chunkNum", chunkInfo.Pos).
-				Msg("a chunk hash mismatch occurred, and fleet server was unable to remove the invalid chunk")
-		}
+	hashsum := sha256.Sum256(chunk)
+	if !strings.EqualFold(chunkHash, hex.EncodeToString(hashsum[:])) {
+		zlog.Debug().
+			Str("source", upinfo.Source).
+			Str("fileID", chunkInfo.BID).
+			Int("chunkNum", chunkInfo.Pos).
+			Msg("chunk hash mismatch, chunk rejected")
 		span.End()
 		return uploader.ErrHashMismatch
 	}
 	span.End()
 
+	ce := cbor.NewChunkWriter(bytes.NewReader(chunk), chunkInfo.Last, chunkInfo.BID, chunkInfo.SHA2, upinfo.ChunkSize)
+	if err := uploader.IndexChunk(r.Context(), ut.chunkClient, ce, upinfo.Source, chunkInfo.BID, chunkInfo.Pos); err != nil {
+		return err
+	}
+
 	span, _ = apm.StartSpan(r.Context(), "response", "write")
 	defer span.End()
 	w.WriteHeader(http.StatusOK)
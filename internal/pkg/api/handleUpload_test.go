@@ -15,6 +15,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"path"
 	"strconv"
 	"strings"
 	"testing"
@@ -572,6 +573,121 @@ func TestChunkUploadWritesTimestamp(t *testing.T) {
 	hr.ServeHTTP(rec, req)
 }
 
+func TestChunkUploadRejectsCorruptedChunk(t *testing.T) {
+	chunks := [][]byte{[]byte("chunk-00"), []byte("chunk-01"), []byte("last")}
+	mockUploadID := "abc123"
+
+	hr, _, fakebulk, mtx := prepareUploaderMock(t)
+	mockInfo := file.Info{
+		DocID:     "bar.foo",
+		ID:        mockUploadID,
+		ChunkSize: 8,
+		Total:     20,
+		Start:     time.Now(),
+		Status:    file.StatusProgress,
+		Source:    "agent",
+		AgentID:   "foo",
+		ActionID:  "bar",
+	}
+	// one result per request, the upload info may not be cached yet
+	for i := 0; i < 4; i++ {
+		mockUploadInfoResult(fakebulk, mockInfo)
+	}
+
+	var indexed []string
+	mtx.RoundTripFn = func(req *http.Request) (*http.Response, error) {
+		indexed = append(indexed, path.Base(req.URL.Path))
+		return sendBodyString("{}"), nil //nolint:bodyclose // nopcloser is used, linter does not see it
+	}
+
+	putChunk := func(num int, data []byte, hash string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPut, "/api/fleet/uploads/"+mockUploadID+"/"+strconv.Itoa(num), bytes.NewReader(data))
+		req.Header.Set("X-Chunk-SHA2", hash)
+		hr.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := putChunk(0, chunks[0], sha256Hex(chunks[0]))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// the middle chunk is corrupted in transit, it is rejected before being indexed
+	rec = putChunk(1, []byte("chunk-0X"), sha256Hex(chunks[1]))
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Contains(t, rec.Body.String(), "ErrHashMismatch")
+	assert.Equal(t, []string{"bar.foo.0"}, indexed)
+
+	// only the corrupted chunk needs to be sent again
+	rec = putChunk(1, chunks[1], sha256Hex(chunks[1]))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = putChunk(2, chunks[2], sha256Hex(chunks[2]))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{"bar.foo.0", "bar.foo.1", "bar.foo.2"}, indexed)
+}
+
+func TestChunkUploadOutOfOrder(t *testing.T) {
+	chunks := [][]byte{[]byte("chunk-00"), []byte("chunk-01"), []byte("last")}
+	mockUploadID := "abc123"
+
+	hr, _, fakebulk, mtx := prepareUploaderMock(t)
+	mockInfo := file.Info{
+		DocID:     "bar.foo",
+		ID:        mockUploadID,
+		ChunkSize: 8,
+		Total:     20,
+		Count:     3,
+		Start:     time.Now(),
+		Status:    file.StatusProgress,
+		Source:    "agent",
+		AgentID:   "foo",
+		ActionID:  "bar",
+	}
+	// one result per request, the upload info may not be cached yet
+	for i := 0; i < 5; i++ {
+		mockUploadInfoResult(fakebulk, mockInfo)
+	}
+
+	var indexed []string
+	mtx.RoundTripFn = func(req *http.Request) (*http.Response, error) {
+		indexed = append(indexed, path.Base(req.URL.Path))
+		return sendBodyString("{}"), nil //nolint:bodyclose // nopcloser is used, linter does not see it
+	}
+
+	for _, num := range []int{2, 0, 1} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPut, "/api/fleet/uploads/"+mockUploadID+"/"+strconv.Itoa(num), bytes.NewReader(chunks[num]))
+		req.Header.Set("X-Chunk-SHA2", sha256Hex(chunks[num]))
+		hr.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code, "chunk %d", num)
+	}
+	assert.Equal(t, []string{"bar.foo.2", "bar.foo.0", "bar.foo.1"}, indexed)
+
+	// the chunks are returned out of order, the transit hash is computed over the chunks in position order
+	mockChunkResult(fakebulk, []file.ChunkInfo{
+		{Last: true, BID: mockInfo.DocID, Size: len(chunks[2]), Pos: 2, SHA2: sha256Hex(chunks[2])},
+		{Last: false, BID: mockInfo.DocID, Size: len(chunks[0]), Pos: 0, SHA2: sha256Hex(chunks[0])},
+		{Last: false, BID: mockInfo.DocID, Size: len(chunks[1]), Pos: 1, SHA2: sha256Hex(chunks[1])},
+	})
+	hasher := sha256.New()
+	for _, c := range chunks {
+		sum := sha256.Sum256(c)
+		_, _ = hasher.Write(sum[:])
+	}
+	transitHash := hex.EncodeToString(hasher.Sum(nil))
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/fleet/uploads/"+mockUploadID, strings.NewReader(`{"transithash": {"sha256": "`+transitHash+`"}}`))
+	hr.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `{"status":"ok"}`, rec.Body.String())
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
 /*
 	Upload finalization route testing
 */
@@ -989,7 +1105,7 @@ func TestUploadCompleteBadRequests(t *testing.T) {
 	hr.ServeHTTP(rec, req)
 
 	assert.Equal(t, http.StatusBadRequest, rec.Code)
-	assert.Equal(t, rec.Body.String(), "{\"statusCode\":400,\"error\":\"BadRequest\",\"message\":\"Bad request: unable to decode upload complete request\"}")
+	assert.Equal(t, rec.Body.String(), "{\"statusCode\":400,\"error\":\"BadRequest\",\"code\":\"ErrBadRequest\",\"message\":\"Bad request: unable to decode upload complete request\"}")
 }
 
 /*
@@ -0,0 +1,209 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+)
+
+// unixSocketMode are the permissions of the unix sockets of the API, the owner and the group of fleet-server can
+// connect to them.
+const unixSocketMode os.FileMode = 0o660
+
+// multiListener accepts the connections of several listeners so a single http.Server, connection limiter
+// and TLS configuration serve all the addresses the server is bound to.
+type multiListener struct {
+	listeners []net.Listener
+	accepted  chan acceptResult
+	closeOnce sync.Once
+	done      chan struct{} // closed when Close is called
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// listenAll binds all the addresses, it fails if any of the addresses can not be bound. An address with the unix:
+// prefix is the path of a unix socket.
+func listenAll(ctx context.Context, addrs []string) (*multiListener, error) {
+	var listenCfg net.ListenConfig
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		var ln net.Listener
+		var err error
+		if path, ok := strings.CutPrefix(addr, config.UnixSocketPrefix); ok {
+			ln, err = listenUnixSocket(path, unixSocketMode)
+		} else {
+			ln, err = listenCfg.Listen(ctx, "tcp", addr)
+		}
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, fmt.Errorf("unable to bind %s: %w", addr, err)
+		}
+		zerolog.Ctx(ctx).Debug().Str("address", addr).Str("bound", ln.Addr().String()).Msg("API listener bound")
+		listeners = append(listeners, ln)
+	}
+
+	ml := &multiListener{
+		listeners: listeners,
+		accepted:  make(chan acceptResult),
+		done:      make(chan struct{}),
+	}
+	for i, ln := range listeners {
+		go ml.acceptLoop(addrs[i], ln)
+	}
+	return ml, nil
+}
+
+// acceptLoop forwards the connections of ln to Accept, they are labeled with the configured address.
+func (ml *multiListener) acceptLoop(addr string, ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if c != nil {
+			c = &listenerConn{Conn: c, listener: addr}
+		}
+		select {
+		case ml.accepted <- acceptResult{conn: c, err: err}:
+		case <-ml.done:
+			if c != nil {
+				_ = c.Close()
+			}
+			return
+		}
+		// The http.Server retries temporary errors, any other error stops the listener.
+		var tErr interface{ Temporary() bool }
+		if err != nil && !(errors.As(err, &tErr) && tErr.Temporary()) {
+			return
+		}
+	}
+}
+
+func (ml *multiListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-ml.accepted:
+		return r.conn, r.err
+	case <-ml.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ml *multiListener) Close() error {
+	var err error
+	ml.closeOnce.Do(func() {
+		close(ml.done)
+		for _, ln := range ml.listeners {
+			err = errors.Join(err, ln.Close())
+		}
+	})
+	return err
+}
+
+// Addr returns the address of the first listener.
+func (ml *multiListener) Addr() net.Addr {
+	return ml.listeners[0].Addr()
+}
+
+// Addrs returns the addresses of all the listeners.
+func (ml *multiListener) Addrs() []net.Addr {
+	addrs := make([]net.Addr, 0, len(ml.listeners))
+	for _, ln := range ml.listeners {
+		addrs = append(addrs, ln.Addr())
+	}
+	return addrs
+}
+
+// listenerConn is a connection accepted by the listener bound to the listener address.
+type listenerConn struct {
+	net.Conn
+	listener string
+}
+
+func (c *listenerConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// connListener returns the address of the listener that accepted c, the connection may be wrapped by
+// the connection limiter or TLS.
+func connListener(c net.Conn) (string, bool) {
+	for c != nil {
+		if lc, ok := c.(*listenerConn); ok {
+			return lc.listener, true
+		}
+		wrapped, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return "", false
+		}
+		c = wrapped.NetConn()
+	}
+	return "", false
+}
+
+// unixListener removes the socket file when it's closed.
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	if rerr := os.Remove(l.path); rerr != nil && !errors.Is(rerr, os.ErrNotExist) {
+		err = errors.Join(err, rerr)
+	}
+	return err
+}
+
+// listenUnixSocket listens on a unix socket at path with the permissions of mode.
+// The socket is bound to a temporary path and moved to path once its permissions are set, so that it's never
+// reachable at path with broader permissions. A socket left at path by a previous run is replaced, a socket that
+// still accepts connections is in use by another process.
+func listenUnixSocket(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			_ = c.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+"."+hex.EncodeToString(suffix))
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	ln.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, mode); err != nil {
+		return nil, errors.Join(err, ln.Close(), os.Remove(tmp))
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, errors.Join(err, ln.Close(), os.Remove(tmp))
+	}
+	return &unixListener{UnixListener: ln, path: path}, nil
+}
@@ -8,7 +8,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"sync"
+	"time"
 
 	"github.com/elastic/elastic-agent-libs/api"
 	cfglib "github.com/elastic/elastic-agent-libs/config"
@@ -20,31 +22,57 @@ import (
 	apmprometheus "go.elastic.co/apm/module/apmprometheus/v2"
 	"go.elastic.co/apm/v2"
 
+	"github.com/elastic/fleet-server/v7/internal/pkg/action"
 	"github.com/elastic/fleet-server/v7/internal/pkg/build"
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/cache"
+	"github.com/elastic/fleet-server/v7/internal/pkg/checkin"
 	"github.com/elastic/fleet-server/v7/internal/pkg/config"
 	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
 	"github.com/elastic/fleet-server/v7/internal/pkg/limit"
 	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
+	"github.com/elastic/fleet-server/v7/internal/pkg/policy"
+	"github.com/elastic/fleet-server/v7/internal/pkg/signing"
 	"github.com/elastic/fleet-server/v7/version"
 )
 
 var (
 	registry *metricsRegistry
 
-	cntHTTPNew    *statsCounter
-	cntHTTPClose  *statsCounter
-	cntHTTPActive *statsGauge
-
-	cntCheckin     routeStats
-	cntEnroll      routeStats
-	cntAcks        routeStats
-	cntStatus      routeStats
-	cntUploadStart routeStats
-	cntUploadChunk routeStats
-	cntUploadEnd   routeStats
-	cntFileDeliv   routeStats
-	cntGetPGP      routeStats
-	cntArtifacts   artifactStats
+	cntHTTPNew      *statsCounter
+	cntHTTPClose    *statsCounter
+	cntHTTPActive   *statsGauge
+	cntHTTPRejected *statsCounter // requests answered with a 503 over the max connections limit
+
+	cntListenerNew    *prometheus.CounterVec // connections by the address of the listener that accepted them
+	cntListenerClose  *prometheus.CounterVec
+	cntListenerActive *prometheus.GaugeVec
+
+	cntTLSReloads      *statsCounter
+	cntTLSReloadErrors *statsCounter // rotated certificates, keys, or CAs that could not be loaded
+
+	cntCheckin       routeStats
+	cntEnroll        routeStats
+	cntAcks          routeStats
+	cntStatus        routeStats
+	cntUploadStart   routeStats
+	cntUploadChunk   routeStats
+	cntUploadEnd     routeStats
+	cntFileDeliv     routeStats
+	cntGetPGP        routeStats
+	cntAgentActions  routeStats
+	cntActionResult  routeStats
+	cntPolicyPreview routeStats
+	cntArtifacts     artifactStats
+	cntLongPoll      *statsGauge
+
+	cntEnrollInFlight *statsGauge // authenticated enrollments holding a slot of enroll.max_concurrency
+
+	cntLongPollSuperseded    *statsCounter // long polls ended by a newer long poll of the same agent
+	cntAgentDeleted          *statsCounter // requests rejected because the agent document of a valid API key is missing
+	cntUpgradeDetailsStale   *statsCounter // checkin upgrade_details dropped because they are older than the stored ones
+	cntComponentStateUnknown *statsCounter // checkin components and units stored with a state that is not known
 
 	infoReg sync.Once
 )
@@ -62,11 +90,38 @@ func init() {
 	cntHTTPNew = newCounter(registry, "tcp_open")
 	cntHTTPClose = newCounter(registry, "tcp_close")
 	cntHTTPActive = newGauge(registry, "tcp_active")
+	cntHTTPRejected = newCounter(registry, "tcp_rejected")
+	cntListenerNew = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: registry.fullName,
+		Name:      "listener_tcp_open",
+		Help:      "Number of connections opened by listener address.",
+	}, []string{"listener"})
+	cntListenerClose = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: registry.fullName,
+		Name:      "listener_tcp_close",
+		Help:      "Number of connections closed by listener address.",
+	}, []string{"listener"})
+	cntListenerActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: registry.fullName,
+		Name:      "listener_tcp_active",
+		Help:      "Number of open connections by listener address.",
+	}, []string{"listener"})
+	registry.promReg.MustRegister(cntListenerNew, cntListenerClose, cntListenerActive)
+	cntTLSReloads = newCounter(registry, "tls_reloads")
+	cntTLSReloadErrors = newCounter(registry, "tls_reload_errors")
 
 	routesRegistry := registry.newRegistry("routes")
 
-	cntCheckin.Register(routesRegistry.newRegistry("checkin"))
-	cntEnroll.Register(routesRegistry.newRegistry("enroll"))
+	checkinRegistry := routesRegistry.newRegistry("checkin")
+	cntCheckin.Register(checkinRegistry)
+	cntLongPoll = newGauge(checkinRegistry, "long_poll_active")
+	cntLongPollSuperseded = newCounter(checkinRegistry, "long_poll_superseded")
+	cntAgentDeleted = newCounter(checkinRegistry, "agent_deleted")
+	cntUpgradeDetailsStale = newCounter(checkinRegistry, "upgrade_details_stale")
+	cntComponentStateUnknown = newCounter(checkinRegistry, "component_state_unknown")
+	enrollRegistry := routesRegistry.newRegistry("enroll")
+	cntEnroll.Register(enrollRegistry)
+	cntEnrollInFlight = newGauge(enrollRegistry, "in_flight")
 	cntArtifacts.Register(routesRegistry.newRegistry("artifacts"))
 	cntAcks.Register(routesRegistry.newRegistry("acks"))
 	cntStatus.Register(routesRegistry.newRegistry("status"))
@@ -75,7 +130,18 @@ func init() {
 	cntUploadEnd.Register(routesRegistry.newRegistry("uploadEnd"))
 	cntFileDeliv.Register(routesRegistry.newRegistry("deliverFile"))
 	cntGetPGP.Register(routesRegistry.newRegistry("getPGPKey"))
-
+	cntAgentActions.Register(routesRegistry.newRegistry("agentActions"))
+	cntActionResult.Register(routesRegistry.newRegistry("actionResult"))
+	cntPolicyPreview.Register(routesRegistry.newRegistry("policyPreview"))
+
+	registry.promReg.MustRegister(action.MetricsCollectors()...)
+	registry.promReg.MustRegister(bulk.MetricsCollectors()...)
+	registry.promReg.MustRegister(cache.MetricsCollectors()...)
+	registry.promReg.MustRegister(checkin.MetricsCollectors()...)
+	registry.promReg.MustRegister(dl.MetricsCollectors()...)
+	registry.promReg.MustRegister(es.MetricsCollectors()...)
+	registry.promReg.MustRegister(policy.MetricsCollectors()...)
+	registry.promReg.MustRegister(signing.MetricsCollectors()...)
 }
 
 // metricsRegistry wraps libbeat and prometheus registries
@@ -167,16 +233,30 @@ func (g *statsCounter) Inc() {
 	g.counter.Inc()
 }
 
+// newHistogram creates a prometheus only histogram, libbeat metrics have no equivalent.
+func newHistogram(registry *metricsRegistry, name string, buckets []float64) prometheus.Histogram {
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: registry.fullName,
+		Name:      name,
+		Buckets:   buckets,
+	})
+	registry.promReg.MustRegister(h)
+	return h
+}
+
 // routeStats is the generic collection metrics that we collect per API route.
 type routeStats struct {
-	active    *statsGauge
-	total     *statsCounter
-	rateLimit *statsCounter
-	maxLimit  *statsCounter
-	failure   *statsCounter
-	drop      *statsCounter
-	bodyIn    *statsCounter
-	bodyOut   *statsCounter
+	active       *statsGauge
+	total        *statsCounter
+	rateLimit    *statsCounter
+	maxLimit     *statsCounter
+	bodyTooLarge *statsCounter // requests rejected with a 413 over the max body size
+	timeout      *statsCounter // requests that exceeded the timeout of the endpoint
+	failure      *statsCounter
+	drop         *statsCounter
+	bodyIn       *statsCounter
+	bodyOut      *statsCounter
+	duration     prometheus.Histogram
 }
 
 func (rt *routeStats) Register(registry *metricsRegistry) {
@@ -184,18 +264,25 @@ func (rt *routeStats) Register(registry *metricsRegistry) {
 	rt.total = newCounter(registry, "total")
 	rt.rateLimit = newCounter(registry, "limit_rate")
 	rt.maxLimit = newCounter(registry, "limit_max")
+	rt.bodyTooLarge = newCounter(registry, "limit_body_size")
+	rt.timeout = newCounter(registry, "timeout")
 	rt.failure = newCounter(registry, "fail")
 	rt.drop = newCounter(registry, "drop")
 	rt.bodyIn = newCounter(registry, "body_in")
 	rt.bodyOut = newCounter(registry, "body_out")
+	rt.duration = newHistogram(registry, "duration_seconds", prometheus.ExponentialBuckets(0.005, 4, 10))
 }
 
 func (rt *routeStats) IncError(err error) {
 	switch {
 	case errors.Is(err, limit.ErrRateLimit):
 		rt.rateLimit.Inc()
-	case errors.Is(err, limit.ErrMaxLimit):
+	case errors.Is(err, limit.ErrMaxLimit), errors.Is(err, ErrEnrollConcurrency):
 		rt.maxLimit.Inc()
+	case isBodyTooLarge(err):
+		rt.bodyTooLarge.Inc()
+	case errors.Is(err, ErrEndpointTimeout):
+		rt.timeout.Inc()
 	case errors.Is(err, context.Canceled):
 		rt.drop.Inc()
 	default:
@@ -204,22 +291,34 @@ func (rt *routeStats) IncError(err error) {
 }
 
 func (rt *routeStats) IncStart() func() {
+	start := time.Now()
 	rt.total.Inc()
 	rt.active.Inc()
-	return rt.active.Dec
+	return func() {
+		rt.active.Dec()
+		rt.duration.Observe(time.Since(start).Seconds())
+	}
 }
 
 // artifactStats is the collection of metrics we collect for the artifact route.
 type artifactStats struct {
 	routeStats
-	notFound *statsCounter
-	throttle *statsCounter
+	notFound      *statsCounter
+	throttle      *statsCounter
+	cacheHit      *statsCounter
+	cacheStaleHit *statsCounter // served from the cache while being fetched again
+	cacheMiss     *statsCounter
+	upstreamFetch *statsCounter // fetched from the artifact upstream after a miss in Elasticsearch
 }
 
 func (rt *artifactStats) Register(registry *metricsRegistry) {
 	rt.routeStats.Register(registry)
 	rt.notFound = newCounter(registry, "not_found")
 	rt.throttle = newCounter(registry, "throttle")
+	rt.cacheHit = newCounter(registry, "cache_hit")
+	rt.cacheStaleHit = newCounter(registry, "cache_stale_hit")
+	rt.cacheMiss = newCounter(registry, "cache_miss")
+	rt.upstreamFetch = newCounter(registry, "upstream_fetch")
 }
 
 func (rt *artifactStats) IncError(err error) {
@@ -235,8 +334,10 @@ func (rt *artifactStats) IncError(err error) {
 
 // InitMetrics initializes metrics exposure mechanisms.
 // If tracer is not nil, prometheus metrics are shipped through the tracer.
-// If cfg.http.enabled is true a /stats endpoint is created to expose libbeat metrics and a /metrics endpoint is created to expose prometheus metrics on the specified interface.
-func InitMetrics(ctx context.Context, cfg *config.Config, bi build.Info, tracer *apm.Tracer) (*api.Server, error) {
+// If cfg.http.enabled is true a /stats endpoint is created to expose libbeat metrics on the specified interface,
+// and if cfg.http.prometheus.enabled is also true a /metrics endpoint is created to expose prometheus metrics.
+// The endpoints are served over TLS when cfg.http.ssl is enabled.
+func InitMetrics(ctx context.Context, cfg *config.Config, bi build.Info, tracer *apm.Tracer) (MetricsServer, error) {
 	if tracer != nil {
 		tracer.RegisterMetricsGatherer(apmprometheus.Wrap(registry.promReg))
 	}
@@ -254,20 +355,44 @@ func InitMetrics(ctx context.Context, cfg *config.Config, bi build.Info, tracer
 	}
 
 	// Start local api server; largely for metrics.
-	zapStub := logger.NewZapStub("fleet-metrics")
-	cfgStub, err := cfglib.NewConfigFrom(&cfg.HTTP)
-	if err != nil {
-		return nil, err
-	}
-	s, err := api.NewWithDefaultRoutes(zapStub, cfgStub, monitoring.GetNamespace)
+	s, err := newMetricsServer(&cfg.HTTP)
 	if err != nil {
 		return nil, fmt.Errorf("could not start the HTTP server for the API: %w", err)
 	}
 
-	attachPrometheusEndpoint(s, registry.promReg, bi)
+	if cfg.HTTP.Prometheus.Enabled {
+		attachPrometheusEndpoint(s, registry.promReg, bi)
+	}
 
 	s.Start()
-	return s, err
+	return s, nil
+}
+
+// MetricsServer is the local HTTP server that exposes the metrics.
+type MetricsServer interface {
+	Stop() error
+	Addr() net.Addr
+}
+
+type metricsServer interface {
+	MetricsServer
+	metricsRouter
+	Start()
+}
+
+func newMetricsServer(cfg *config.HTTP) (metricsServer, error) {
+	if cfg.TLS.IsEnabled() {
+		return newTLSMetricsServer(cfg)
+	}
+
+	zapStub := logger.NewZapStub("fleet-metrics")
+	httpCfg := *cfg
+	httpCfg.TLS = nil
+	cfgStub, err := cfglib.NewConfigFrom(&httpCfg)
+	if err != nil {
+		return nil, err
+	}
+	return api.NewWithDefaultRoutes(zapStub, cfgStub, monitoring.GetNamespace)
 }
 
 type metricsRouter interface {
@@ -0,0 +1,78 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package api
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/elastic/elastic-agent-libs/api"
+	"github.com/elastic/elastic-agent-libs/monitoring"
+	"github.com/elastic/elastic-agent-libs/transport/tlscommon"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+)
+
+// tlsMetricsServer serves the routes of the local metrics API over TLS.
+// The elastic-agent-libs server can not be given a listener, so the default routes are registered here.
+type tlsMetricsServer struct {
+	mux *http.ServeMux
+	srv *http.Server
+	l   net.Listener
+}
+
+func newTLSMetricsServer(cfg *config.HTTP) (*tlsMetricsServer, error) {
+	if strings.Contains(cfg.Host, "://") {
+		return nil, fmt.Errorf("http.ssl is only supported when the metrics endpoint listens on tcp, not %s", cfg.Host)
+	}
+	commonTLSCfg, err := tlscommon.LoadTLSServerConfig(cfg.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid http.ssl configuration: %w", err)
+	}
+	tlsCfg := commonTLSCfg.BuildServerConfig(cfg.Host)
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)))
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", api.MakeRootAPIHandler(api.MakeAPIHandler(monitoring.GetNamespace("info"))))
+	mux.HandleFunc("/state", api.MakeAPIHandler(monitoring.GetNamespace("state")))
+	mux.HandleFunc("/stats", api.MakeAPIHandler(monitoring.GetNamespace("stats")))
+	mux.HandleFunc("/dataset", api.MakeAPIHandler(monitoring.GetNamespace("dataset")))
+
+	return &tlsMetricsServer{
+		mux: mux,
+		srv: &http.Server{Handler: mux, ReadHeaderTimeout: api.DefaultConfig().Timeout},
+		l:   tls.NewListener(ln, tlsCfg),
+	}, nil
+}
+
+// AddRoute adds a route to the server mux.
+func (s *tlsMetricsServer) AddRoute(path string, handler api.HandlerFunc) {
+	s.mux.HandleFunc(path, handler)
+}
+
+// Start serves the requests in the background.
+func (s *tlsMetricsServer) Start() {
+	go func() {
+		_ = s.srv.Serve(s.l)
+	}()
+}
+
+// Stop closes the listener.
+func (s *tlsMetricsServer) Stop() error {
+	return s.l.Close()
+}
+
+// Addr returns the address the server listens on.
+func (s *tlsMetricsServer) Addr() net.Addr {
+	return s.l.Addr()
+}
@@ -27,6 +27,9 @@ func TestMetricsEndpoints(t *testing.T) {
 			Enabled: true,
 			Host:    "localhost",
 			Port:    8080,
+			Prometheus: config.Prometheus{
+				Enabled: true,
+			},
 		},
 	}
 	ctx, cancel := context.WithCancel(context.Background())
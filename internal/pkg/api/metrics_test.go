@@ -0,0 +1,166 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package api
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elastic/elastic-agent-libs/api"
+	libsconfig "github.com/elastic/elastic-agent-libs/config"
+	"github.com/elastic/elastic-agent-libs/transport/tlscommon"
+	"github.com/elastic/go-ucfg/yaml"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/build"
+	"github.com/elastic/fleet-server/v7/internal/pkg/cache"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/limit"
+	"github.com/elastic/fleet-server/v7/internal/pkg/testing/certs"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+type testMetricsRouter struct {
+	*http.ServeMux
+}
+
+func (r testMetricsRouter) AddRoute(path string, h api.HandlerFunc) {
+	r.HandleFunc(path, h)
+}
+
+func TestPrometheusEndpoint(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+
+	// checkin traffic, the second request is rejected by the rate limiter
+	l := limit.NewLimiter(&config.Limit{Interval: time.Hour, Burst: 1})
+	h := l.Wrap("checkin", &cntCheckin, zerolog.DebugLevel)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		cntLongPoll.Inc()
+		defer cntLongPoll.Dec()
+		w.WriteHeader(http.StatusOK)
+	}))
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/api/fleet/agents/test/checkin", nil).WithContext(ctx)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	// cache traffic
+	c, err := cache.New(config.Cache{NumCounters: 100, MaxCost: 100000})
+	require.NoError(t, err)
+	c.GetAction("missing")
+
+	router := testMetricsRouter{http.NewServeMux()}
+	attachPrometheusEndpoint(router, registry.promReg, build.Info{Version: "test"})
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/metrics", nil)
+	require.NoError(t, err)
+	resp, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	families := make(map[string]string)
+	samples := make(map[string]string)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if fields := strings.Fields(line); strings.HasPrefix(line, "# TYPE ") && len(fields) == 4 {
+			families[fields[2]] = fields[3]
+		} else if !strings.HasPrefix(line, "#") && len(fields) == 2 {
+			samples[fields[0]] = fields[1]
+		}
+	}
+	require.NoError(t, scanner.Err())
+
+	for name, typ := range map[string]string{
+		"service_info":                                "counter",
+		"http_server_routes_checkin_total":            "counter",
+		"http_server_routes_checkin_limit_rate":       "counter",
+		"http_server_routes_checkin_duration_seconds": "histogram",
+		"http_server_routes_checkin_long_poll_active": "gauge",
+		"http_server_routes_enroll_duration_seconds":  "histogram",
+		"bulk_flush_items":                            "histogram",
+		"bulk_flush_bytes":                            "histogram",
+		"bulk_flush_duration_seconds":                 "histogram",
+		"cache_hit_total":                             "counter",
+		"cache_miss_total":                            "counter",
+	} {
+		assert.Equal(t, typ, families[name], "metric family %s", name)
+	}
+
+	assert.NotEqual(t, "0", samples["http_server_routes_checkin_total"])
+	assert.NotEqual(t, "0", samples["http_server_routes_checkin_limit_rate"])
+	assert.NotEqual(t, "0", samples["http_server_routes_checkin_duration_seconds_count"])
+	assert.Equal(t, "0", samples["http_server_routes_checkin_long_poll_active"])
+	assert.NotEqual(t, "0", samples[`cache_miss_total{type="action"}`])
+	assert.Contains(t, samples, `bulk_flush_items_count{queue="bulk"}`)
+}
+
+func TestMetricsServerTLS(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+
+	ca := certs.GenCA(t)
+	cert := certs.GenCert(t, ca)
+	ucfg, err := yaml.NewConfig([]byte(fmt.Sprintf(`
+enabled: true
+certificate: "%s"
+key: "%s"
+supported_protocols: ["TLSv1.3"]
+`, certs.CertToFile(t, cert, "cert"), certs.KeyToFile(t, cert, "key"))))
+	require.NoError(t, err)
+	tlsCFG := &tlscommon.ServerConfig{}
+	require.NoError(t, tlsCFG.Unpack(libsconfig.C(*ucfg)))
+
+	cfg := &config.Config{}
+	cfg.HTTP.InitDefaults()
+	cfg.HTTP.Enabled = true
+	cfg.HTTP.Host = "localhost"
+	cfg.HTTP.Port = 0
+	cfg.HTTP.TLS = tlsCFG
+	srv, err := InitMetrics(ctx, cfg, build.Info{Version: "test"}, nil)
+	require.NoError(t, err)
+	defer srv.Stop() //nolint:errcheck // test server
+
+	certPool := x509.NewCertPool()
+	certPool.AddCert(ca.Leaf)
+	get := func(version uint16) (*http.Response, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:    certPool,
+			MinVersion: version,
+			MaxVersion: version,
+		}}}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+srv.Addr().String()+"/stats", nil)
+		require.NoError(t, err)
+		return client.Do(req)
+	}
+
+	resp, err := get(tls.VersionTLS13)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, err = get(tls.VersionTLS12) //nolint:bodyclose // the handshake fails
+	assert.Error(t, err, "expected a TLS 1.2 client to be rejected")
+
+	t.Run("unix socket", func(t *testing.T) {
+		httpCfg := cfg.HTTP
+		httpCfg.Host = "unix:///tmp/fleet-server-metrics.sock"
+		_, err := newMetricsServer(&httpCfg)
+		assert.ErrorContains(t, err, "only supported when the metrics endpoint listens on tcp")
+	})
+}
@@ -19,8 +19,9 @@ import (
 )
 
 const (
-	AgentApiKeyScopes = "agentApiKey.Scopes"
-	ApiKeyScopes      = "apiKey.Scopes"
+	AgentApiKeyScopes  = "agentApiKey.Scopes"
+	ApiKeyScopes       = "apiKey.Scopes"
+	ServiceTokenScopes = "serviceToken.Scopes"
 )
 
 // Defines values for ActionType.
@@ -223,6 +224,26 @@ type ActionPolicyReassign struct {
 	PolicyId string `json:"policy_id"`
 }
 
+// ActionRequest An action to add for one or more agents.
+type ActionRequest struct {
+	// Agents Additional agent IDs the action is for, the agent in the path is always included.
+	Agents *[]string `json:"agents,omitempty"`
+
+	// Data An embedded JSON object that holds the action-specific payload.
+	// Defined in fleet-server as a `json.RawMessage`.
+	Data *json.RawMessage `json:"data,omitempty"`
+
+	// Expiration The latest start time for the action. Actions that have not started by this time are dropped.
+	// Defaults to the time of the request plus the `agent_actions.default_expiration` setting.
+	Expiration *time.Time `json:"expiration,omitempty"`
+
+	// InputType The input type of the action for actions with type `INPUT_ACTION`.
+	InputType *string `json:"input_type,omitempty"`
+
+	// Type The action type. Must be one of the action types that fleet-server sends to agents.
+	Type string `json:"type"`
+}
+
 // ActionRequestDiagnostics The REQUEST_DIAGNOSTICS action data.
 type ActionRequestDiagnostics struct {
 	// AdditionalMetrics list optional additional metrics.
@@ -232,6 +253,37 @@ type ActionRequestDiagnostics struct {
 // ActionRequestDiagnosticsAdditionalMetrics defines model for ActionRequestDiagnostics.AdditionalMetrics.
 type ActionRequestDiagnosticsAdditionalMetrics string
 
+// ActionResponse The action added by an action request.
+type ActionResponse struct {
+	// ActionId The ID of the action.
+	ActionId string `json:"action_id"`
+
+	// Agents The agent IDs the action is for.
+	Agents []string `json:"agents"`
+}
+
+// ActionResultResponse The result of an action for an agent.
+type ActionResultResponse struct {
+	// ActionId The ID of the action.
+	ActionId string `json:"action_id"`
+
+	// ActionResponse The action_response payload of the ack, absent if the ack had none.
+	ActionResponse json.RawMessage `json:"action_response,omitempty"`
+
+	// AgentId The ID of the agent.
+	AgentId string `json:"agent_id"`
+
+	// Error The error reported by the agent when executing the action.
+	Error *string `json:"error,omitempty"`
+
+	// Timestamp The time of the ack of the action.
+	Timestamp string `json:"timestamp"`
+
+	// Truncated If the action_response was larger than the max response size.
+	// A truncated action_response has a truncated attribute with the start of the payload as a string and a size attribute with the size of the payload.
+	Truncated bool `json:"truncated"`
+}
+
 // ActionSettings The SETTINGS action data.
 type ActionSettings struct {
 	LogLevel *ActionSettingsLogLevel `json:"log_level,omitempty"`
@@ -270,6 +322,7 @@ type CheckinRequest struct {
 	// Components An embedded JSON object that holds component information that the agent is running.
 	// Defined in fleet-server as a `json.RawMessage`, defined as an object in the elastic-agent.
 	// fleet-server will update the components in an agent record if they differ from this object.
+	// The components may be at most 512KiB, a larger or invalid components array is rejected with a 400.
 	Components *json.RawMessage `json:"components,omitempty"`
 
 	// LocalMetadata An embedded JSON object that holds meta-data values.
@@ -290,6 +343,11 @@ type CheckinRequest struct {
 	// Status The agent state, inferred from agent control protocol states.
 	Status CheckinRequestStatus `json:"status"`
 
+	// Tags An optional list of tags that replaces the tags of the agent record if it differs.
+	// The actions intended for any of the tags are delivered to the agent from then on.
+	// More than 32 tags, or a tag longer than 256 characters, is rejected with a 400.
+	Tags *[]string `json:"tags,omitempty"`
+
 	// UpgradeDetails Additional details describing the status of an UPGRADE action delivered by the client (agent) on checkin.
 	UpgradeDetails *UpgradeDetails `json:"upgrade_details,omitempty"`
 }
@@ -314,6 +372,10 @@ type DiagnosticsEvent struct {
 	// ActionId The action ID.
 	ActionId string `json:"action_id"`
 
+	// ActionResponse An optional payload with the output of the action, such as the output of a response action.
+	// It is stored in the action result, a payload larger than server.action_results.max_response_size is truncated.
+	ActionResponse json.RawMessage `json:"action_response,omitempty"`
+
 	// AgentId The ID of the agent that executed the action.
 	AgentId string `json:"agent_id"`
 	Data    *struct {
@@ -362,6 +424,7 @@ type EnrollMetadata struct {
 
 	// Tags User provided tags for the agent.
 	// fleet-server will pass the tags to the agent record on enrollment.
+	// More than 32 tags, or a tag longer than 256 characters, is rejected with a 400.
 	Tags []string `json:"tags"`
 
 	// UserProvided An embedded JSON object that holds user-provided meta-data values.
@@ -380,9 +443,16 @@ type EnrollRequest struct {
 	// The existing agent with a matching enrollment_id will be deleted if it never checked in. The new agent will be enrolled with the enrollment_id.
 	EnrollmentId *string `json:"enrollment_id,omitempty"`
 
+	// Id The ID the agent should be enrolled with.
+	// If an agent with the ID exists, the request must have a matching replace_token. The existing agent is then replaced, its API keys are invalidated and its tags and policy are kept.
+	Id *string `json:"id,omitempty"`
+
 	// Metadata Metadata associated with the agent that is enrolling to fleet.
 	Metadata EnrollMetadata `json:"metadata"`
 
+	// ReplaceToken The token that allows the agent enrolled with the id to be replaced by a later enrollment with the same id.
+	ReplaceToken *string `json:"replace_token,omitempty"`
+
 	// SharedId The shared ID of the agent.
 	// To support pre-existing installs.
 	//
@@ -471,9 +541,20 @@ type EnrollResponseItem struct {
 
 // Error Error processing request.
 type Error struct {
+	// Code Machine-readable error code, the code of an error is stable across releases.
+	// One of ErrBadRequest, ErrUnauthorized, ErrInvalidToken, ErrForbidden, ErrAgentNotFound, ErrAgentInactive,
+	// ErrNotFound, ErrEnrollmentTokenExpired, ErrEnrollmentTokenExhausted, ErrTooManyRequests, ErrBodyTooLarge,
+	// ErrRequestTimeout, ErrRequestCanceled, ErrUnsupportedVersion, ErrAgentVersionUnsupported, ErrUploadRejected,
+	// ErrTLSRequired, ErrServiceUnavailable, ErrInternal.
+	Code *string `json:"code,omitempty"`
+
 	// Error Error type.
 	Error string `json:"error"`
 
+	// Hint (optional) How the agent recovers from the error.
+	// The hint is reenroll when the agent is inactive or its record was deleted, the agent must enroll again.
+	Hint *string `json:"hint,omitempty"`
+
 	// Message (optional) Error message.
 	Message *string `json:"message,omitempty"`
 
@@ -502,6 +583,10 @@ type GenericEvent struct {
 	// ActionId The action ID.
 	ActionId string `json:"action_id"`
 
+	// ActionResponse An optional payload with the output of the action, such as the output of a response action.
+	// It is stored in the action result, a payload larger than server.action_results.max_response_size is truncated.
+	ActionResponse json.RawMessage `json:"action_response,omitempty"`
+
 	// AgentId The ID of the agent that executed the action.
 	AgentId string `json:"agent_id"`
 
@@ -615,8 +700,46 @@ type PolicyData struct {
 	Signed *ActionSignature `json:"signed,omitempty" yaml:"signed"`
 }
 
+// PolicyPreviewFilteredInput An input of the policy that the agent would not receive.
+type PolicyPreviewFilteredInput struct {
+	// Id The ID of the input.
+	Id string `json:"id"`
+
+	// Reason Why the input is filtered, namespace if the policy is not in the namespaces of the agent.
+	Reason string `json:"reason"`
+}
+
+// PolicyPreviewResponse The policy an agent would receive if it was dispatched now.
+type PolicyPreviewResponse struct {
+	// ActionId The ID of the POLICY_CHANGE action the agent would receive.
+	ActionId string `json:"action_id"`
+
+	// FilteredInputs The inputs of the policy that the agent would not receive.
+	FilteredInputs []PolicyPreviewFilteredInput `json:"filtered_inputs"`
+
+	// Policy The policy of the POLICY_CHANGE action data, rendered for the agent like on checkin.
+	// Absent if the agent would not receive the policy.
+	Policy json.RawMessage `json:"policy,omitempty"`
+
+	// PreviewKeys The outputs that would get a new API key for the agent once the policy is dispatched.
+	// The preview does not create the keys, the api_key of these outputs is a placeholder.
+	PreviewKeys []string `json:"preview_keys"`
+
+	// Redacted If the secret values and the API keys of the policy are redacted.
+	Redacted bool `json:"redacted"`
+
+	// Revision The revision_idx of the policy.
+	Revision int64 `json:"revision"`
+}
+
 // StatusAPIResponse Status response information.
 type StatusAPIResponse struct {
+	// Limits Effective runtime limits included in the response to an authorized status request.
+	Limits *StatusResponseLimits `json:"limits,omitempty"`
+
+	// Message Reason of the status, such as "draining" while the server is shutting down.
+	Message *string `json:"message,omitempty"`
+
 	// Name Service name.
 	Name string `json:"name"`
 
@@ -628,6 +751,127 @@ type StatusAPIResponse struct {
 	Version *StatusResponseVersion `json:"version,omitempty"`
 }
 
+// StatusAPIResponseV2 Version 2 of the status response information, returned when it's requested with the
+// application/vnd.fleet.status+json; version=2 media type.
+type StatusAPIResponseV2 struct {
+	// ApiVersions The range of the Elastic-Api-Version values that fleet-server accepts from agents.
+	ApiVersions StatusResponseAPIVersions `json:"api_versions"`
+
+	// Build Build information included in the version 2 response to an authorized status request.
+	Build *StatusResponseBuild `json:"build,omitempty"`
+
+	// Limits Effective runtime limits included in the response to an authorized status request.
+	Limits *StatusResponseLimits `json:"limits,omitempty"`
+
+	// Message Reason of the status, such as "draining" while the server is shutting down.
+	Message *string `json:"message,omitempty"`
+
+	// Name Service name.
+	Name string `json:"name"`
+
+	// RecentErrors The last errors of each fleet-server subsystem keyed by the subsystem name, from the oldest to the newest.
+	// Included in the version 2 response to an authorized status request when the logging level is debug or trace.
+	RecentErrors *StatusResponseRecentErrors `json:"recent_errors,omitempty"`
+
+	// Status A Unit state that fleet-server may report.
+	// Unit state is defined in the elastic-agent-client specification.
+	Status StatusResponseStatus `json:"status"`
+
+	// Version The fleet-server version, included in the response to an authorized request.
+	Version *string `json:"version,omitempty"`
+}
+
+// StatusResponseAPIVersions The range of the Elastic-Api-Version values that fleet-server accepts from agents.
+type StatusResponseAPIVersions struct {
+	// Max Newest supported API version.
+	Max string `json:"max"`
+
+	// Min Oldest supported API version.
+	Min string `json:"min"`
+}
+
+// StatusResponseAgentLimits The agent range of the limits tier that fleet-server selected.
+type StatusResponseAgentLimits struct {
+	// Max Maximum number of agents for the tier.
+	Max int `json:"max"`
+
+	// Min Minimum number of agents for the tier.
+	Min int `json:"min"`
+}
+
+// StatusResponseBuild Build information included in the version 2 response to an authorized status request.
+type StatusResponseBuild struct {
+	// Commit The commit that the fleet-server was built from.
+	Commit string `json:"commit"`
+
+	// Time The date-time that the fleet-server binary was created.
+	Time string `json:"time"`
+}
+
+// StatusResponseCacheLimits The effective cache limits.
+type StatusResponseCacheLimits struct {
+	// MaxCost Maximum cost of the cache in bytes.
+	MaxCost int64 `json:"max_cost"`
+
+	// NumCounters Number of keys to track frequency of.
+	NumCounters int64 `json:"num_counters"`
+}
+
+// StatusResponseEndpointLimit The effective limits of an endpoint.
+type StatusResponseEndpointLimit struct {
+	// Burst Number of requests that may be made in a burst.
+	Burst int `json:"burst"`
+
+	// Interval Interval between requests as a duration, for example "10ms".
+	Interval string `json:"interval"`
+
+	// Max Maximum number of concurrent requests.
+	Max int64 `json:"max"`
+
+	// MaxBodyByteSize Maximum request body size in bytes.
+	MaxBodyByteSize int64 `json:"max_body_byte_size"`
+}
+
+// StatusResponseErrorRecord An error reported by a fleet-server subsystem.
+type StatusResponseErrorRecord struct {
+	// Timestamp The time the error was reported.
+	Timestamp time.Time `json:"@timestamp"`
+
+	// Error The error message, the credentials and secret values are redacted.
+	Error string `json:"error"`
+
+	// Fields The context of the error, the credentials and secret values are redacted.
+	Fields *map[string]string `json:"fields,omitempty"`
+
+	// Source The part of the subsystem that failed, such as the endpoint of a handler or the index of a monitor.
+	Source string `json:"source"`
+}
+
+// StatusResponseLimits Effective runtime limits included in the response to an authorized status request.
+type StatusResponseLimits struct {
+	// ActiveConnections Number of open connections counted against max_connections.
+	ActiveConnections *int64 `json:"active_connections,omitempty"`
+
+	// Agents The agent range of the limits tier that fleet-server selected.
+	Agents StatusResponseAgentLimits `json:"agents"`
+
+	// Cache The effective cache limits.
+	Cache StatusResponseCacheLimits `json:"cache"`
+
+	// Endpoints Endpoint limits keyed by their configuration name.
+	Endpoints map[string]StatusResponseEndpointLimit `json:"endpoints"`
+
+	// MaxConnections Maximum number of connections fleet-server accepts.
+	MaxConnections int `json:"max_connections"`
+
+	// PolicyThrottle Policy throttle as a duration.
+	PolicyThrottle string `json:"policy_throttle"`
+}
+
+// StatusResponseRecentErrors The last errors of each fleet-server subsystem keyed by the subsystem name, from the oldest to the newest.
+// Included in the version 2 response to an authorized status request when the logging level is debug or trace.
+type StatusResponseRecentErrors map[string][]StatusResponseErrorRecord
+
 // StatusResponseStatus A Unit state that fleet-server may report.
 // Unit state is defined in the elastic-agent-client specification.
 type StatusResponseStatus string
@@ -649,6 +893,10 @@ type UpgradeEvent struct {
 	// ActionId The action ID.
 	ActionId string `json:"action_id"`
 
+	// ActionResponse An optional payload with the output of the action, such as the output of a response action.
+	// It is stored in the action result, a payload larger than server.action_results.max_response_size is truncated.
+	ActionResponse json.RawMessage `json:"action_response,omitempty"`
+
 	// AgentId The ID of the agent that executed the action.
 	AgentId string `json:"agent_id"`
 
@@ -821,6 +1069,9 @@ type AgentNotFound = Error
 // BadRequest Error processing request.
 type BadRequest = Error
 
+// BodyTooLarge Error processing request.
+type BodyTooLarge = Error
+
 // Deadline Error processing request.
 type Deadline = Error
 
@@ -871,6 +1122,24 @@ type AgentAcksParams struct {
 	ElasticApiVersion *ApiVersion `json:"elastic-api-version,omitempty"`
 }
 
+// AgentActionResultParams defines parameters for AgentActionResult.
+type AgentActionResultParams struct {
+	// XRequestId The request tracking ID for APM.
+	XRequestId *RequestId `json:"X-Request-Id,omitempty"`
+
+	// ElasticApiVersion The API version to use, format should be "YYYY-MM-DD"
+	ElasticApiVersion *ApiVersion `json:"elastic-api-version,omitempty"`
+}
+
+// AgentActionsParams defines parameters for AgentActions.
+type AgentActionsParams struct {
+	// XRequestId The request tracking ID for APM.
+	XRequestId *RequestId `json:"X-Request-Id,omitempty"`
+
+	// ElasticApiVersion The API version to use, format should be "YYYY-MM-DD"
+	ElasticApiVersion *ApiVersion `json:"elastic-api-version,omitempty"`
+}
+
 // AgentCheckinParams defines parameters for AgentCheckin.
 type AgentCheckinParams struct {
 	// AcceptEncoding If the agent is able to accept encoded responses.
@@ -890,6 +1159,18 @@ type AgentCheckinParams struct {
 	ElasticApiVersion *ApiVersion `json:"elastic-api-version,omitempty"`
 }
 
+// AgentPolicyPreviewParams defines parameters for AgentPolicyPreview.
+type AgentPolicyPreviewParams struct {
+	// Reveal Include the secret values and the API keys in the rendered policy.
+	Reveal *bool `form:"reveal,omitempty" json:"reveal,omitempty"`
+
+	// XRequestId The request tracking ID for APM.
+	XRequestId *RequestId `json:"X-Request-Id,omitempty"`
+
+	// ElasticApiVersion The API version to use, format should be "YYYY-MM-DD"
+	ElasticApiVersion *ApiVersion `json:"elastic-api-version,omitempty"`
+}
+
 // ArtifactParams defines parameters for Artifact.
 type ArtifactParams struct {
 	// XRequestId The request tracking ID for APM.
@@ -953,6 +1234,9 @@ type AgentEnrollJSONRequestBody = EnrollRequest
 // AgentAcksJSONRequestBody defines body for AgentAcks for application/json ContentType.
 type AgentAcksJSONRequestBody = AckRequest
 
+// AgentActionsJSONRequestBody defines body for AgentActions for application/json ContentType.
+type AgentActionsJSONRequestBody = ActionRequest
+
 // AgentCheckinJSONRequestBody defines body for AgentCheckin for application/json ContentType.
 type AgentCheckinJSONRequestBody = CheckinRequest
 
@@ -1621,9 +1905,18 @@ type ServerInterface interface {
 	// (POST /api/fleet/agents/{id}/acks)
 	AgentAcks(w http.ResponseWriter, r *http.Request, id string, params AgentAcksParams)
 
+	// (POST /api/fleet/agents/{id}/actions)
+	AgentActions(w http.ResponseWriter, r *http.Request, id string, params AgentActionsParams)
+
+	// (GET /api/fleet/agents/{id}/actions/{actionId}/result)
+	AgentActionResult(w http.ResponseWriter, r *http.Request, id string, actionId string, params AgentActionResultParams)
+
 	// (POST /api/fleet/agents/{id}/checkin)
 	AgentCheckin(w http.ResponseWriter, r *http.Request, id string, params AgentCheckinParams)
 
+	// (GET /api/fleet/agents/{id}/policy/preview)
+	AgentPolicyPreview(w http.ResponseWriter, r *http.Request, id string, params AgentPolicyPreviewParams)
+
 	// (GET /api/fleet/artifacts/{id}/{sha2})
 	Artifact(w http.ResponseWriter, r *http.Request, id string, sha2 string, params ArtifactParams)
 	// retrieve stored file for integration
@@ -1663,11 +1956,26 @@ func (_ Unimplemented) AgentAcks(w http.ResponseWriter, r *http.Request, id stri
 	w.WriteHeader(http.StatusNotImplemented)
 }
 
+// (POST /api/fleet/agents/{id}/actions)
+func (_ Unimplemented) AgentActions(w http.ResponseWriter, r *http.Request, id string, params AgentActionsParams) {
+	w.WriteHeader(http.StatusNotImplemented)
+}
+
+// (GET /api/fleet/agents/{id}/actions/{actionId}/result)
+func (_ Unimplemented) AgentActionResult(w http.ResponseWriter, r *http.Request, id string, actionId string, params AgentActionResultParams) {
+	w.WriteHeader(http.StatusNotImplemented)
+}
+
 // (POST /api/fleet/agents/{id}/checkin)
 func (_ Unimplemented) AgentCheckin(w http.ResponseWriter, r *http.Request, id string, params AgentCheckinParams) {
 	w.WriteHeader(http.StatusNotImplemented)
 }
 
+// (GET /api/fleet/agents/{id}/policy/preview)
+func (_ Unimplemented) AgentPolicyPreview(w http.ResponseWriter, r *http.Request, id string, params AgentPolicyPreviewParams) {
+	w.WriteHeader(http.StatusNotImplemented)
+}
+
 // (GET /api/fleet/artifacts/{id}/{sha2})
 func (_ Unimplemented) Artifact(w http.ResponseWriter, r *http.Request, id string, sha2 string, params ArtifactParams) {
 	w.WriteHeader(http.StatusNotImplemented)
@@ -1956,6 +2264,157 @@ func (siw *ServerInterfaceWrapper) AgentAcks(w http.ResponseWriter, r *http.Requ
 	handler.ServeHTTP(w, r.WithContext(ctx))
 }
 
+// AgentActions operation middleware
+func (siw *ServerInterfaceWrapper) AgentActions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var err error
+
+	// ------------- Path parameter "id" -------------
+	var id string
+
+	err = runtime.BindStyledParameterWithLocation("simple", false, "id", runtime.ParamLocationPath, chi.URLParam(r, "id"), &id)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
+		return
+	}
+
+	ctx = context.WithValue(ctx, ServiceTokenScopes, []string{})
+
+	// Parameter object where we will unmarshal all parameters from the context
+	var params AgentActionsParams
+
+	headers := r.Header
+
+	// ------------- Optional header parameter "X-Request-Id" -------------
+	if valueList, found := headers[http.CanonicalHeaderKey("X-Request-Id")]; found {
+		var XRequestId RequestId
+		n := len(valueList)
+		if n != 1 {
+			siw.ErrorHandlerFunc(w, r, &TooManyValuesForParamError{ParamName: "X-Request-Id", Count: n})
+			return
+		}
+
+		err = runtime.BindStyledParameterWithLocation("simple", false, "X-Request-Id", runtime.ParamLocationHeader, valueList[0], &XRequestId)
+		if err != nil {
+			siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "X-Request-Id", Err: err})
+			return
+		}
+
+		params.XRequestId = &XRequestId
+
+	}
+
+	// ------------- Optional header parameter "elastic-api-version" -------------
+	if valueList, found := headers[http.CanonicalHeaderKey("elastic-api-version")]; found {
+		var ElasticApiVersion ApiVersion
+		n := len(valueList)
+		if n != 1 {
+			siw.ErrorHandlerFunc(w, r, &TooManyValuesForParamError{ParamName: "elastic-api-version", Count: n})
+			return
+		}
+
+		err = runtime.BindStyledParameterWithLocation("simple", false, "elastic-api-version", runtime.ParamLocationHeader, valueList[0], &ElasticApiVersion)
+		if err != nil {
+			siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "elastic-api-version", Err: err})
+			return
+		}
+
+		params.ElasticApiVersion = &ElasticApiVersion
+
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.AgentActions(w, r, id, params)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// AgentActionResult operation middleware
+func (siw *ServerInterfaceWrapper) AgentActionResult(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var err error
+
+	// ------------- Path parameter "id" -------------
+	var id string
+
+	err = runtime.BindStyledParameterWithLocation("simple", false, "id", runtime.ParamLocationPath, chi.URLParam(r, "id"), &id)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
+		return
+	}
+
+	// ------------- Path parameter "actionId" -------------
+	var actionId string
+
+	err = runtime.BindStyledParameterWithLocation("simple", false, "actionId", runtime.ParamLocationPath, chi.URLParam(r, "actionId"), &actionId)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "actionId", Err: err})
+		return
+	}
+
+	ctx = context.WithValue(ctx, ServiceTokenScopes, []string{})
+
+	// Parameter object where we will unmarshal all parameters from the context
+	var params AgentActionResultParams
+
+	headers := r.Header
+
+	// ------------- Optional header parameter "X-Request-Id" -------------
+	if valueList, found := headers[http.CanonicalHeaderKey("X-Request-Id")]; found {
+		var XRequestId RequestId
+		n := len(valueList)
+		if n != 1 {
+			siw.ErrorHandlerFunc(w, r, &TooManyValuesForParamError{ParamName: "X-Request-Id", Count: n})
+			return
+		}
+
+		err = runtime.BindStyledParameterWithLocation("simple", false, "X-Request-Id", runtime.ParamLocationHeader, valueList[0], &XRequestId)
+		if err != nil {
+			siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "X-Request-Id", Err: err})
+			return
+		}
+
+		params.XRequestId = &XRequestId
+
+	}
+
+	// ------------- Optional header parameter "elastic-api-version" -------------
+	if valueList, found := headers[http.CanonicalHeaderKey("elastic-api-version")]; found {
+		var ElasticApiVersion ApiVersion
+		n := len(valueList)
+		if n != 1 {
+			siw.ErrorHandlerFunc(w, r, &TooManyValuesForParamError{ParamName: "elastic-api-version", Count: n})
+			return
+		}
+
+		err = runtime.BindStyledParameterWithLocation("simple", false, "elastic-api-version", runtime.ParamLocationHeader, valueList[0], &ElasticApiVersion)
+		if err != nil {
+			siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "elastic-api-version", Err: err})
+			return
+		}
+
+		params.ElasticApiVersion = &ElasticApiVersion
+
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.AgentActionResult(w, r, id, actionId, params)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
 // AgentCheckin operation middleware
 func (siw *ServerInterfaceWrapper) AgentCheckin(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
@@ -2069,6 +2528,85 @@ func (siw *ServerInterfaceWrapper) AgentCheckin(w http.ResponseWriter, r *http.R
 	handler.ServeHTTP(w, r.WithContext(ctx))
 }
 
+// AgentPolicyPreview operation middleware
+func (siw *ServerInterfaceWrapper) AgentPolicyPreview(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var err error
+
+	// ------------- Path parameter "id" -------------
+	var id string
+
+	err = runtime.BindStyledParameterWithLocation("simple", false, "id", runtime.ParamLocationPath, chi.URLParam(r, "id"), &id)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "id", Err: err})
+		return
+	}
+
+	ctx = context.WithValue(ctx, ServiceTokenScopes, []string{})
+
+	// Parameter object where we will unmarshal all parameters from the context
+	var params AgentPolicyPreviewParams
+
+	// ------------- Optional query parameter "reveal" -------------
+
+	err = runtime.BindQueryParameter("form", true, false, "reveal", r.URL.Query(), &params.Reveal)
+	if err != nil {
+		siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "reveal", Err: err})
+		return
+	}
+
+	headers := r.Header
+
+	// ------------- Optional header parameter "X-Request-Id" -------------
+	if valueList, found := headers[http.CanonicalHeaderKey("X-Request-Id")]; found {
+		var XRequestId RequestId
+		n := len(valueList)
+		if n != 1 {
+			siw.ErrorHandlerFunc(w, r, &TooManyValuesForParamError{ParamName: "X-Request-Id", Count: n})
+			return
+		}
+
+		err = runtime.BindStyledParameterWithLocation("simple", false, "X-Request-Id", runtime.ParamLocationHeader, valueList[0], &XRequestId)
+		if err != nil {
+			siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "X-Request-Id", Err: err})
+			return
+		}
+
+		params.XRequestId = &XRequestId
+
+	}
+
+	// ------------- Optional header parameter "elastic-api-version" -------------
+	if valueList, found := headers[http.CanonicalHeaderKey("elastic-api-version")]; found {
+		var ElasticApiVersion ApiVersion
+		n := len(valueList)
+		if n != 1 {
+			siw.ErrorHandlerFunc(w, r, &TooManyValuesForParamError{ParamName: "elastic-api-version", Count: n})
+			return
+		}
+
+		err = runtime.BindStyledParameterWithLocation("simple", false, "elastic-api-version", runtime.ParamLocationHeader, valueList[0], &ElasticApiVersion)
+		if err != nil {
+			siw.ErrorHandlerFunc(w, r, &InvalidParamFormatError{ParamName: "elastic-api-version", Err: err})
+			return
+		}
+
+		params.ElasticApiVersion = &ElasticApiVersion
+
+	}
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.AgentPolicyPreview(w, r, id, params)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
 // Artifact operation middleware
 func (siw *ServerInterfaceWrapper) Artifact(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
@@ -2640,9 +3178,18 @@ func HandlerWithOptions(si ServerInterface, options ChiServerOptions) http.Handl
 	r.Group(func(r chi.Router) {
 		r.Post(options.BaseURL+"/api/fleet/agents/{id}/acks", wrapper.AgentAcks)
 	})
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/api/fleet/agents/{id}/actions", wrapper.AgentActions)
+	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/fleet/agents/{id}/actions/{actionId}/result", wrapper.AgentActionResult)
+	})
 	r.Group(func(r chi.Router) {
 		r.Post(options.BaseURL+"/api/fleet/agents/{id}/checkin", wrapper.AgentCheckin)
 	})
+	r.Group(func(r chi.Router) {
+		r.Get(options.BaseURL+"/api/fleet/agents/{id}/policy/preview", wrapper.AgentPolicyPreview)
+	})
 	r.Group(func(r chi.Router) {
 		r.Get(options.BaseURL+"/api/fleet/artifacts/{id}/{sha2}", wrapper.Artifact)
 	})
@@ -0,0 +1,98 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	"github.com/elastic/fleet-server/v7/internal/pkg/policy"
+)
+
+// maxPooledPolicyBuffer is the size above which a policy buffer is not kept in the pool.
+const maxPooledPolicyBuffer = 16 * 1024 * 1024
+
+// policyChangeData serializes like ActionPolicyChange.
+// The policy is written from the parsed policy shared by all the agents subscribed to it, only the outputs are the agent's.
+type policyChangeData struct {
+	Policy renderedPolicy `json:"policy"`
+}
+
+// renderedPolicy serializes like PolicyData.
+type renderedPolicy struct {
+	Agent             json.RawMessage                   `json:"agent,omitempty"`
+	Fleet             json.RawMessage                   `json:"fleet,omitempty"`
+	ID                string                            `json:"id"`
+	Inputs            []map[string]interface{}          `json:"inputs,omitempty"`
+	OutputPermissions json.RawMessage                   `json:"output_permissions,omitempty"`
+	Outputs           map[string]map[string]interface{} `json:"outputs,omitempty"`
+	Revision          int64                             `json:"revision"`
+	Signed            *ActionSignature                  `json:"signed,omitempty"`
+}
+
+// policyEncoder is a JSON encoder that can be reused, the policy of a policy change is rendered for each agent.
+type policyEncoder struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+var policyEncoders = sync.Pool{
+	New: func() any {
+		e := &policyEncoder{}
+		e.enc = json.NewEncoder(&e.buf)
+		return e
+	},
+}
+
+// renderPolicyChange renders the data of the POLICY_CHANGE action of an agent.
+// The outputs are the outputs prepared for the agent, they replace the outputs of the policy. pp is never modified.
+func renderPolicyChange(pp *policy.ParsedPolicy, outputs map[string]map[string]interface{}) (Action_Data, error) {
+	data := pp.Policy.Data
+	v := policyChangeData{
+		Policy: renderedPolicy{
+			Agent:             nonNullRaw(data.Agent),
+			Fleet:             nonNullRaw(data.Fleet),
+			ID:                data.ID,
+			Inputs:            pp.Inputs,
+			OutputPermissions: nonNullRaw(data.OutputPermissions),
+			Outputs:           outputs,
+			Revision:          data.Revision,
+			Signed:            actionSignature(data.Signed),
+		},
+	}
+
+	e, _ := policyEncoders.Get().(*policyEncoder)
+	defer func() {
+		if e.buf.Cap() <= maxPooledPolicyBuffer {
+			e.buf.Reset()
+			policyEncoders.Put(e)
+		}
+	}()
+
+	var ad Action_Data
+	if err := e.enc.Encode(v); err != nil {
+		return ad, err
+	}
+	// The action data keeps a copy of the buffer, the encoder is returned to the pool.
+	err := ad.UnmarshalJSON(bytes.TrimSuffix(e.buf.Bytes(), []byte("\n")))
+	return ad, err
+}
+
+// nonNullRaw returns nil for a JSON null so that it's omitted.
+func nonNullRaw(raw json.RawMessage) json.RawMessage {
+	if bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+		return nil
+	}
+	return raw
+}
+
+func actionSignature(s *model.Signed) *ActionSignature {
+	if s == nil {
+		return nil
+	}
+	return &ActionSignature{Data: s.Data, Signature: s.Signature}
+}
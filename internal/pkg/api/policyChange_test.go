@@ -0,0 +1,173 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	"github.com/elastic/fleet-server/v7/internal/pkg/policy"
+)
+
+// testParsedPolicy returns a parsed policy with n inputs.
+func testParsedPolicy(n int) *policy.ParsedPolicy {
+	inputs := make([]map[string]interface{}, n)
+	for i := range inputs {
+		inputs[i] = map[string]interface{}{
+			"id":       fmt.Sprintf("input-%d", i),
+			"type":     "logfile",
+			"revision": float64(1),
+			"streams": []interface{}{map[string]interface{}{
+				"id":    fmt.Sprintf("stream-%d", i),
+				"paths": []interface{}{"/var/log/*.log"},
+			}},
+		}
+	}
+	data := &model.PolicyData{
+		Agent:             json.RawMessage(`{"monitoring":{"enabled":true,"logs":true}}`),
+		Fleet:             json.RawMessage(`{"hosts":["https://fleet-server:8220"]}`),
+		ID:                "policy",
+		Inputs:            inputs,
+		OutputPermissions: json.RawMessage(`{"default":{"_elastic_agent_checks":{"cluster":["monitor"]}}}`),
+		Outputs: map[string]map[string]interface{}{
+			"default": {
+				"type":  "elasticsearch",
+				"hosts": []interface{}{"https://elasticsearch:9200"},
+				"ssl":   map[string]interface{}{"verification_mode": "full"},
+			},
+		},
+		Revision: 2,
+		Signed:   &model.Signed{Data: "data", Signature: "signature"},
+	}
+	return &policy.ParsedPolicy{
+		Policy: model.Policy{PolicyID: "policy", RevisionIdx: 2, Data: data},
+		Inputs: inputs,
+	}
+}
+
+// agentOutputs returns the outputs of the policy prepared for the agent, like processPolicy.
+func agentOutputs(pp *policy.ParsedPolicy, agentID string) map[string]map[string]interface{} {
+	outputs := make(map[string]map[string]interface{}, len(pp.Policy.Data.Outputs))
+	for name, output := range pp.Policy.Data.Outputs {
+		outputs[name] = maps.Clone(output)
+		outputs[name]["api_key"] = agentID + ":key"
+	}
+	return outputs
+}
+
+// roundTripPolicyChange renders the policy change by cloning the policy data and converting it to PolicyData through JSON.
+func roundTripPolicyChange(pp *policy.ParsedPolicy, outputs map[string]map[string]interface{}) (Action_Data, error) {
+	data := *pp.Policy.Data
+	data.Outputs = outputs
+	data.Inputs = pp.Inputs
+	p, err := json.Marshal(data)
+	if err != nil {
+		return Action_Data{}, err
+	}
+	d := PolicyData{}
+	if err := json.Unmarshal(p, &d); err != nil {
+		return Action_Data{}, err
+	}
+	ad := Action_Data{}
+	err = ad.FromActionPolicyChange(ActionPolicyChange{d})
+	return ad, err
+}
+
+func TestRenderPolicyChange(t *testing.T) {
+	pp := testParsedPolicy(3)
+	outputs := agentOutputs(pp, "agent")
+
+	expected, err := roundTripPolicyChange(pp, outputs)
+	require.NoError(t, err)
+	ad, err := renderPolicyChange(pp, outputs)
+	require.NoError(t, err)
+
+	expectedJSON, err := expected.MarshalJSON()
+	require.NoError(t, err)
+	adJSON, err := ad.MarshalJSON()
+	require.NoError(t, err)
+	assert.JSONEq(t, string(expectedJSON), string(adJSON))
+
+	change, err := ad.AsActionPolicyChange()
+	require.NoError(t, err)
+	assert.Equal(t, "agent:key", (*change.Policy.Outputs)["default"].(map[string]interface{})["api_key"])
+}
+
+func TestRenderPolicyChangeNullFields(t *testing.T) {
+	pp := testParsedPolicy(0)
+	pp.Policy.Data.Agent = json.RawMessage(`null`)
+	pp.Policy.Data.Signed = nil
+
+	ad, err := renderPolicyChange(pp, agentOutputs(pp, "agent"))
+	require.NoError(t, err)
+	change, err := ad.AsActionPolicyChange()
+	require.NoError(t, err)
+	assert.Nil(t, change.Policy.Agent)
+	assert.Nil(t, change.Policy.Inputs)
+	assert.Nil(t, change.Policy.Signed)
+}
+
+// TestRenderPolicyChangeConcurrent renders the policy shared by the agents concurrently, as the checkins of the agents
+// subscribed to a policy do when it's dispatched. Run with the race detector.
+func TestRenderPolicyChangeConcurrent(t *testing.T) {
+	pp := testParsedPolicy(10)
+	before, err := json.Marshal(pp.Policy.Data)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(agentID string) {
+			defer wg.Done()
+			ad, err := renderPolicyChange(pp, agentOutputs(pp, agentID))
+			if !assert.NoError(t, err) {
+				return
+			}
+			change, err := ad.AsActionPolicyChange()
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, agentID+":key", (*change.Policy.Outputs)["default"].(map[string]interface{})["api_key"])
+			assert.Len(t, *change.Policy.Inputs, 10)
+		}(fmt.Sprintf("agent-%d", i))
+	}
+	wg.Wait()
+
+	after, err := json.Marshal(pp.Policy.Data)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(before), string(after), "the shared policy is not modified")
+	assert.NotContains(t, pp.Policy.Data.Outputs["default"], "api_key")
+}
+
+// BenchmarkPolicyChange compares the allocations of rendering the policy change of an agent by converting a copy of the
+// policy (roundtrip) with rendering it from the shared policy (render).
+func BenchmarkPolicyChange(b *testing.B) {
+	pp := testParsedPolicy(5000)
+	for _, bm := range []struct {
+		name   string
+		render func(*policy.ParsedPolicy, map[string]map[string]interface{}) (Action_Data, error)
+	}{
+		{"roundtrip", roundTripPolicyChange},
+		{"render", renderPolicyChange},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := bm.render(pp, agentOutputs(pp, "agent")); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
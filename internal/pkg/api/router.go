@@ -5,9 +5,14 @@
 package api
 
 import (
+	"bytes"
+	"encoding/json"
+	"io"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/config"
 	"github.com/elastic/fleet-server/v7/internal/pkg/limit"
@@ -15,24 +20,75 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
 	"go.elastic.co/apm/module/apmchiv5/v2"
 	"go.elastic.co/apm/v2"
 )
 
-func newRouter(cfg *config.ServerLimits, si ServerInterface, tracer *apm.Tracer) http.Handler {
+func newRouter(l *limiter, si ServerInterface, tracer *apm.Tracer, basePath string) http.Handler {
 	r := chi.NewRouter()
 	if tracer != nil {
 		r.Use(apmchiv5.Middleware(apmchiv5.WithTracer(tracer)))
 	}
 	r.Use(logger.Middleware) // Attach middlewares to router directly so the occur before any request parsing/validation
 	r.Use(middleware.Recoverer)
-	r.Use(Limiter(cfg).middleware)
-	return HandlerWithOptions(si, ChiServerOptions{
+	r.Use(l.middleware)
+	h := HandlerWithOptions(si, ChiServerOptions{
 		BaseRouter:       r,
 		ErrorHandlerFunc: ErrorResp,
 		Middlewares:      []MiddlewareFunc{NewAPIVersion().middleware},
 		// TODO auth as middleware? - here it takes place after chi router adds scope annotations to the request ctx
 	})
+	if basePath == "" {
+		return h
+	}
+	return stripBasePath(basePath, h)
+}
+
+// stripBasePath serves the routes under basePath. The base path is removed from the request path before the request
+// is routed, so that the handlers, the logs and the route labels of the metrics see the same paths as without a base
+// path. The requests outside of basePath are answered with a 404.
+func stripBasePath(basePath string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := trimBasePath(r.URL.Path, basePath)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		rp, _ := trimBasePath(r.URL.RawPath, basePath)
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = p
+		r2.URL.RawPath = rp
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// trimBasePath removes basePath from path, it returns false if path is not basePath or one of its sub paths.
+func trimBasePath(path, basePath string) (string, bool) {
+	p, ok := strings.CutPrefix(path, basePath)
+	if !ok || (p != "" && p[0] != '/') {
+		return "", false
+	}
+	if p == "" {
+		p = "/"
+	}
+	return p, true
+}
+
+// notFoundInternalRoutes answers the routes only served on the internal listener with a 404, like a route that
+// does not exist.
+func notFoundInternalRoutes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch pathToOperation(r.URL.Path) {
+		case "enroll", "agentActions", "actionResult", "policyPreview":
+			http.NotFound(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
 }
 
 // limiter wraps routes with metrics and rate limits.
@@ -42,6 +98,7 @@ type limiter struct {
 	checkin        *limit.Limiter
 	artifact       *limit.Limiter
 	enroll         *limit.Limiter
+	enrollRetry    *limit.Limiter
 	ack            *limit.Limiter
 	status         *limit.Limiter
 	uploadBegin    *limit.Limiter
@@ -49,23 +106,44 @@ type limiter struct {
 	uploadComplete *limit.Limiter
 	deliverFile    *limit.Limiter
 	getPGPKey      *limit.Limiter
+	agentActions   *limit.Limiter
 }
 
 func Limiter(cfg *config.ServerLimits) *limiter {
+	retry := cfg.EnrollLimit.RetryLimit()
 	return &limiter{
 		checkin:        limit.NewLimiter(&cfg.CheckinLimit),
-		artifact:       limit.NewLimiter(&cfg.ArtifactLimit),
-		enroll:         limit.NewLimiter(&cfg.EnrollLimit),
-		ack:            limit.NewLimiter(&cfg.AckLimit),
+		artifact:       limit.NewLimiter(&cfg.ArtifactLimit, limit.WithBudgetHeaders()),
+		enroll:         limit.NewLimiter(&cfg.EnrollLimit.Limit),
+		enrollRetry:    limit.NewLimiter(&retry),
+		ack:            limit.NewLimiter(&cfg.AckLimit, limit.WithBudgetHeaders()),
 		status:         limit.NewLimiter(&cfg.StatusLimit),
 		uploadBegin:    limit.NewLimiter(&cfg.UploadStartLimit),
 		uploadChunk:    limit.NewLimiter(&cfg.UploadChunkLimit),
 		uploadComplete: limit.NewLimiter(&cfg.UploadEndLimit),
 		deliverFile:    limit.NewLimiter(&cfg.DeliverFileLimit),
 		getPGPKey:      limit.NewLimiter(&cfg.GetPGPKey),
+		agentActions:   limit.NewLimiter(&cfg.AgentActions),
 	}
 }
 
+// reload applies new endpoint limits without interrupting in-flight requests.
+func (l *limiter) reload(cfg *config.ServerLimits) {
+	l.checkin.Reload(&cfg.CheckinLimit)
+	l.artifact.Reload(&cfg.ArtifactLimit)
+	l.enroll.Reload(&cfg.EnrollLimit.Limit)
+	retry := cfg.EnrollLimit.RetryLimit()
+	l.enrollRetry.Reload(&retry)
+	l.ack.Reload(&cfg.AckLimit)
+	l.status.Reload(&cfg.StatusLimit)
+	l.uploadBegin.Reload(&cfg.UploadStartLimit)
+	l.uploadChunk.Reload(&cfg.UploadChunkLimit)
+	l.uploadComplete.Reload(&cfg.UploadEndLimit)
+	l.deliverFile.Reload(&cfg.DeliverFileLimit)
+	l.getPGPKey.Reload(&cfg.GetPGPKey)
+	l.agentActions.Reload(&cfg.AgentActions)
+}
+
 var pgpReg = regexp.MustCompile(`\/api\/agents\/upgrades\/[0-9]+\.[0-9]+\.[0-9]+\/pgp-public-key`)
 
 // pathToOperation determines the endpoint passed on the request path.
@@ -98,22 +176,99 @@ func pathToOperation(path string) string {
 			if pp[2] == "agents" {
 				if pp[4] == "acks" || pp[4] == "checkin" {
 					return pp[4]
+				} else if pp[4] == "actions" {
+					return "agentActions"
 				}
 			} else if pp[2] == "uploads" {
 				return "uploadChunk"
 			} else if pp[2] == "artifacts" {
 				return "artifact"
 			}
+		} else if len(pp) == 6 {
+			if pp[2] == "agents" && pp[4] == "policy" && pp[5] == "preview" {
+				return "policyPreview"
+			}
+		} else if len(pp) == 7 {
+			if pp[2] == "agents" && pp[4] == "actions" && pp[6] == "result" {
+				return "actionResult"
+			}
 		}
 	}
 	return ""
 }
 
+// pathAgentID returns the agent ID of the agent routes, or an empty string.
+func pathAgentID(path string) string {
+	pp := strings.Split(strings.TrimPrefix(strings.TrimSuffix(path, "/"), "/"), "/")
+	if len(pp) == 5 && pp[0] == "api" && pp[1] == "fleet" && pp[2] == "agents" {
+		return pp[3]
+	}
+	return ""
+}
+
+// reEnrollPeekSize is how much of the body of an enroll request is read to classify it.
+const reEnrollPeekSize = 64 * 1024
+
+// isReEnroll returns true if the enroll request references an existing agent with its id or enrollment_id, when an
+// agent is enrolled again or replaced. The request is classified from its body before it reaches the handler, without
+// any lookup in Elasticsearch, and the body is put back for the handler. A body larger than reEnrollPeekSize is
+// classified as a new enrollment.
+//
+// The classification only selects the rate limit, the request then goes through the same checks as any enrollment.
+func isReEnroll(r *http.Request) bool {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength > reEnrollPeekSize {
+		return false
+	}
+	peek, err := io.ReadAll(io.LimitReader(r.Body, reEnrollPeekSize+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(peek), r.Body), r.Body}
+	if err != nil || len(peek) > reEnrollPeekSize {
+		return false
+	}
+
+	var refs struct {
+		ID           string `json:"id"`
+		EnrollmentID string `json:"enrollment_id"`
+	}
+	if err := json.Unmarshal(peek, &refs); err != nil {
+		return false
+	}
+	return refs.ID != "" || refs.EnrollmentID != ""
+}
+
+// logSlowRequest logs r if it took longer than the threshold. The time the request spent waiting on purpose is not counted.
+func logSlowRequest(r *http.Request, route string, start time.Time, timing *logger.RequestTiming, threshold time.Duration) {
+	d := time.Since(start) - timing.Wait()
+	if d < threshold {
+		return
+	}
+	e := hlog.FromRequest(r).Warn().
+		Str("route", route).
+		Int64(logger.ECSEventDuration, d.Nanoseconds()).
+		Int64(logger.ESDuration, timing.ES().Nanoseconds())
+	if agentID := pathAgentID(r.URL.Path); agentID != "" {
+		e = e.Str(logger.AgentID, agentID)
+	}
+	e.Msg("slow request")
+}
+
 func (l *limiter) middleware(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		switch pathToOperation(r.URL.Path) {
+		op := pathToOperation(r.URL.Path)
+		if threshold := logger.SlowRequestThreshold(); threshold > 0 && op != "" {
+			timing := &logger.RequestTiming{}
+			r = r.WithContext(logger.ContextWithRequestTiming(r.Context(), timing))
+			defer logSlowRequest(r, op, time.Now(), timing, threshold)
+		}
+		switch op {
 		case "enroll":
-			l.enroll.Wrap("enroll", &cntEnroll, zerolog.DebugLevel)(next).ServeHTTP(w, r)
+			if isReEnroll(r) {
+				l.enrollRetry.Wrap("enroll", &cntEnroll, zerolog.DebugLevel)(next).ServeHTTP(w, r)
+			} else {
+				l.enroll.Wrap("enroll", &cntEnroll, zerolog.DebugLevel)(next).ServeHTTP(w, r)
+			}
 		case "acks":
 			l.ack.Wrap("acks", &cntAcks, zerolog.DebugLevel)(next).ServeHTTP(w, r)
 		case "checkin":
@@ -130,6 +285,13 @@ func (l *limiter) middleware(next http.Handler) http.Handler {
 			l.deliverFile.Wrap("deliverFile", &cntFileDeliv, zerolog.DebugLevel)(next).ServeHTTP(w, r)
 		case "getPGPKey":
 			l.getPGPKey.Wrap("getPGPKey", &cntGetPGP, zerolog.DebugLevel)(next).ServeHTTP(w, r)
+		case "agentActions":
+			l.agentActions.Wrap("agentActions", &cntAgentActions, zerolog.InfoLevel)(next).ServeHTTP(w, r)
+		case "actionResult":
+			// The service token routes share the agent actions limit.
+			l.agentActions.Wrap("actionResult", &cntActionResult, zerolog.InfoLevel)(next).ServeHTTP(w, r)
+		case "policyPreview":
+			l.agentActions.Wrap("policyPreview", &cntPolicyPreview, zerolog.InfoLevel)(next).ServeHTTP(w, r)
 		case "status":
 			l.status.Wrap("status", &cntStatus, zerolog.DebugLevel)(next).ServeHTTP(w, r)
 		default:
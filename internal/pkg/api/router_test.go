@@ -5,15 +5,24 @@
 package api
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
 	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestPathToOperation(t *testing.T) {
@@ -29,6 +38,11 @@ func TestPathToOperation(t *testing.T) {
 		{"/api/fleet/agents/some-id", "enroll"},
 		{"/api/fleet/agents/some-id/acks", "acks"},
 		{"/api/fleet/agents/some-id/checkin", "checkin"},
+		{"/api/fleet/agents/some-id/actions", "agentActions"},
+		{"/api/fleet/agents/some-id/actions/action-id/result", "actionResult"},
+		{"/api/fleet/agents/some-id/actions/action-id/other", ""},
+		{"/api/fleet/agents/some-id/policy/preview", "policyPreview"},
+		{"/api/fleet/agents/some-id/policy/other", ""},
 		{"/api/fleet/uploads/some-id", "uploadComplete"},
 		{"/api/fleet/uploads/some-id/0", "uploadChunk"},
 		{"/api/fleet/file", ""},
@@ -45,6 +59,79 @@ func TestPathToOperation(t *testing.T) {
 	}
 }
 
+func TestRouterBasePath(t *testing.T) {
+	tests := []struct {
+		name     string
+		basePath string
+		method   string
+		path     string
+		routed   bool
+	}{
+		{"no base path", "", http.MethodGet, "/api/status", true},
+		{"no base path with prefix", "", http.MethodGet, "/fleet/api/status", false},
+		{"base path", "/fleet", http.MethodGet, "/fleet/api/status", true},
+		{"base path checkin", "/fleet", http.MethodPost, "/fleet/api/fleet/agents/agent-1/checkin", true},
+		{"base path artifact", "/fleet", http.MethodGet, "/fleet/api/fleet/artifacts/id/sha2", true},
+		{"base path upload", "/fleet", http.MethodPost, "/fleet/api/fleet/uploads", true},
+		{"base path without prefix", "/fleet", http.MethodGet, "/api/status", false},
+		{"base path partial segment", "/fleet", http.MethodGet, "/fleetserver/api/status", false},
+		{"base path root", "/fleet", http.MethodGet, "/fleet/", false},
+		{"nested base path", "/a/b", http.MethodGet, "/a/b/api/status", true},
+		{"nested base path enroll", "/a/b", http.MethodPost, "/a/b/api/fleet/agents/enroll", true},
+		{"nested base path parent", "/a/b", http.MethodGet, "/a/api/status", false},
+		{"nested base path child", "/a/b", http.MethodGet, "/a/b/c/api/status", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newRouter(Limiter(&config.ServerLimits{}), Unimplemented{}, nil, tc.basePath)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, nil))
+			if tc.routed {
+				assert.NotEqual(t, http.StatusNotFound, w.Code)
+			} else {
+				assert.Equal(t, http.StatusNotFound, w.Code)
+			}
+		})
+	}
+}
+
+func TestStripBasePath(t *testing.T) {
+	tests := []struct {
+		basePath string
+		path     string
+		stripped string
+		op       string
+	}{
+		{"/fleet", "/fleet/api/status", "/api/status", "status"},
+		{"/fleet", "/fleet/api/status/", "/api/status/", "status"},
+		{"/fleet", "/fleet", "/", ""},
+		{"/fleet", "/fleet/", "/", ""},
+		{"/fleet", "/fleet/api/fleet/agents/agent-1/acks", "/api/fleet/agents/agent-1/acks", "acks"},
+		{"/a/b", "/a/b/api/fleet/agents/agent-1/checkin", "/api/fleet/agents/agent-1/checkin", "checkin"},
+		{"/a/b", "/a/b/api/fleet/uploads/some-id/0", "/api/fleet/uploads/some-id/0", "uploadChunk"},
+		{"/a/b", "/a/b/api/fleet/agents/some%2Fid/checkin", "/api/fleet/agents/some/id/checkin", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			var path, rawPath string
+			h := stripBasePath(tc.basePath, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				path, rawPath = r.URL.Path, r.URL.EscapedPath()
+			}))
+			r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			h.ServeHTTP(httptest.NewRecorder(), r)
+			assert.Equal(t, tc.stripped, path)
+			assert.Equal(t, tc.op, pathToOperation(path))
+			escaped := strings.TrimPrefix(tc.path, tc.basePath)
+			if escaped == "" {
+				escaped = "/"
+			}
+			assert.Equal(t, escaped, rawPath)
+			// The request of the caller is not modified.
+			assert.Equal(t, tc.path, r.URL.RequestURI())
+		})
+	}
+}
+
 func testStatusServer(t *testing.T, cfg *config.ServerLimits) http.Handler {
 	t.Helper()
 	l := Limiter(cfg)
@@ -101,3 +188,193 @@ func TestLimiter(t *testing.T) {
 		})
 	}
 }
+
+func TestLimiterBodySize(t *testing.T) {
+	cfg := &config.ServerLimits{
+		CheckinLimit:     config.Limit{MaxBody: 100},
+		EnrollLimit:      config.EnrollLimit{Limit: config.Limit{MaxBody: 200}},
+		AckLimit:         config.Limit{MaxBody: 300},
+		AgentActions:     config.Limit{MaxBody: 400},
+		UploadStartLimit: config.Limit{MaxBody: 500},
+		UploadEndLimit:   config.Limit{MaxBody: 600},
+		UploadChunkLimit: config.Limit{MaxBody: 700},
+	}
+	r := chi.NewRouter()
+	r.Use(Limiter(cfg).middleware)
+	// Reads the body like the handlers, errors are reported with ErrorResp.
+	r.HandleFunc("/*", func(w http.ResponseWriter, req *http.Request) {
+		if _, err := io.ReadAll(req.Body); err != nil {
+			ErrorResp(w, req, &BadRequestErr{msg: "unable to read body", nextErr: err})
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	endpoints := []struct {
+		method   string
+		path     string
+		endpoint string
+		maxBody  int
+	}{
+		{http.MethodPost, "/api/fleet/agents/some-id/checkin", "checkin", 100},
+		{http.MethodPost, "/api/fleet/agents/enroll", "enroll", 200},
+		{http.MethodPost, "/api/fleet/agents/some-id/acks", "acks", 300},
+		{http.MethodPost, "/api/fleet/agents/some-id/actions", "agentActions", 400},
+		{http.MethodPost, "/api/fleet/uploads", "uploadBegin", 500},
+		{http.MethodPost, "/api/fleet/uploads/some-id", "uploadComplete", 600},
+		{http.MethodPut, "/api/fleet/uploads/some-id/0", "uploadChunk", 700},
+	}
+	for _, ep := range endpoints {
+		t.Run(ep.endpoint, func(t *testing.T) {
+			send := func(size int, chunked bool) *http.Response {
+				w := httptest.NewRecorder()
+				req := httptest.NewRequest(ep.method, ep.path, strings.NewReader(strings.Repeat("a", size)))
+				if chunked {
+					req.ContentLength = -1
+				}
+				r.ServeHTTP(w, req)
+				return w.Result()
+			}
+
+			resp := send(ep.maxBody-1, false)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+			for _, chunked := range []bool{false, true} {
+				resp = send(ep.maxBody+1, chunked)
+				var body struct {
+					StatusCode int    `json:"statusCode"`
+					Error      string `json:"error"`
+					Endpoint   string `json:"endpoint"`
+					Limit      int    `json:"limit"`
+				}
+				err := json.NewDecoder(resp.Body).Decode(&body)
+				resp.Body.Close()
+				require.NoError(t, err)
+				assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode, "chunked: %v", chunked)
+				assert.Equal(t, "BodyTooLarge", body.Error)
+				assert.Equal(t, ep.endpoint, body.Endpoint)
+				assert.Equal(t, ep.maxBody, body.Limit)
+			}
+		})
+	}
+}
+
+func TestLimiterEnrollRetry(t *testing.T) {
+	cfg := &config.ServerLimits{
+		EnrollLimit: config.EnrollLimit{
+			Limit:      config.Limit{Interval: time.Hour, Burst: 2},
+			RetryBurst: 5,
+		},
+	}
+	r := chi.NewRouter()
+	r.Use(Limiter(cfg).middleware)
+	// Echoes the body, to check that the body read by the limiter is put back.
+	r.HandleFunc("/*", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.Copy(w, req.Body)
+	})
+
+	enroll := func(body string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/fleet/agents/enroll", strings.NewReader(body)))
+		resp := w.Result()
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			echo, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, body, string(echo))
+		}
+		return resp.StatusCode
+	}
+
+	newEnroll := `{"type":"PERMANENT","metadata":{"local":{}}}`
+	assert.Equal(t, http.StatusOK, enroll(newEnroll))
+	assert.Equal(t, http.StatusOK, enroll(newEnroll))
+	assert.Equal(t, http.StatusTooManyRequests, enroll(newEnroll), "new enrollments are capped")
+	assert.Equal(t, http.StatusTooManyRequests, enroll(`not json`), "invalid bodies are new enrollments")
+
+	for _, body := range []string{
+		`{"type":"PERMANENT","metadata":{"local":{}},"id":"agent-id","replace_token":"token"}`,
+		`{"type":"PERMANENT","metadata":{"local":{}},"id":"agent-id","replace_token":"token"}`,
+		`{"enrollment_id":"enrollment-id","type":"PERMANENT","metadata":{"local":{}}}`,
+		`{"enrollment_id":"enrollment-id","type":"PERMANENT","metadata":{"local":{}}}`,
+		`{"id":"agent-id"}`,
+	} {
+		assert.Equal(t, http.StatusOK, enroll(body), "re-enrollments are not limited by the new enrollments")
+	}
+	assert.Equal(t, http.StatusTooManyRequests, enroll(`{"id":"agent-id"}`), "re-enrollments are capped by the retry burst")
+	assert.Equal(t, http.StatusTooManyRequests, enroll(newEnroll))
+
+	large := `{"id":"agent-id","metadata":{"local":{"data":"` + strings.Repeat("a", reEnrollPeekSize) + `"}}}`
+	assert.Equal(t, http.StatusTooManyRequests, enroll(large), "a large body is classified as a new enrollment")
+}
+
+// histogramCounts returns the number of observations of h and the cumulative count of the bucket with the upper bound le.
+func histogramCounts(t *testing.T, h prometheus.Histogram, le float64) (uint64, uint64) {
+	t.Helper()
+	var m dto.Metric
+	require.NoError(t, h.Write(&m))
+	for _, b := range m.GetHistogram().GetBucket() {
+		if b.GetUpperBound() == le {
+			return m.GetHistogram().GetSampleCount(), b.GetCumulativeCount()
+		}
+	}
+	t.Fatalf("no bucket with upper bound %v", le)
+	return 0, 0
+}
+
+func TestSlowRequestLog(t *testing.T) {
+	logger.SetSlowRequestThreshold(50 * time.Millisecond)
+	defer logger.SetSlowRequestThreshold(0)
+
+	r := chi.NewRouter()
+	r.Use(Limiter(&config.ServerLimits{}).middleware)
+	// A synthetic slow handler, it spends 40ms of its 60ms on Elasticsearch, or long polls if asked to.
+	r.HandleFunc("/*", func(w http.ResponseWriter, req *http.Request) {
+		timing := logger.RequestTimingFromContext(req.Context())
+		timing.AddES(40 * time.Millisecond)
+		if req.URL.Query().Has("poll") {
+			timing.AddWait(60 * time.Millisecond)
+		}
+		time.Sleep(60 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	})
+	send := func(path string) string {
+		var logs bytes.Buffer
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req = req.WithContext(zerolog.New(&logs).WithContext(req.Context()))
+		r.ServeHTTP(httptest.NewRecorder(), req)
+		return logs.String()
+	}
+
+	t.Run("slow request", func(t *testing.T) {
+		count, fast := histogramCounts(t, cntCheckin.duration, 0.02)
+
+		logs := send("/api/fleet/agents/some-id/checkin")
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(logs), &entry), "expected a single log entry: %s", logs)
+		assert.Equal(t, "warn", entry["level"])
+		assert.Equal(t, "slow request", entry["message"])
+		assert.Equal(t, "checkin", entry["route"])
+		assert.Equal(t, "some-id", entry[logger.AgentID])
+		assert.GreaterOrEqual(t, entry[logger.ECSEventDuration], float64(60*time.Millisecond))
+		assert.Equal(t, float64(40*time.Millisecond), entry[logger.ESDuration])
+
+		newCount, newFast := histogramCounts(t, cntCheckin.duration, 0.02)
+		assert.Equal(t, count+1, newCount)
+		assert.Equal(t, fast, newFast, "expected the request to be observed over the 20ms bucket")
+	})
+
+	t.Run("long poll", func(t *testing.T) {
+		assert.Empty(t, send("/api/fleet/agents/some-id/checkin?poll"))
+	})
+
+	t.Run("untracked route", func(t *testing.T) {
+		assert.Empty(t, send("/api/fleet/other"))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		logger.SetSlowRequestThreshold(0)
+		assert.Empty(t, send("/api/fleet/agents/some-id/acks"))
+	})
+}
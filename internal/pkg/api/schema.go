@@ -0,0 +1,217 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	jsonNumberType      = reflect.TypeOf(json.Number(""))
+)
+
+// schemaViolation is a field of a request body that does not match the API schema.
+type schemaViolation struct {
+	pointer string // JSON pointer (RFC 6901) of the field
+	reason  string
+}
+
+func (v *schemaViolation) Error() string {
+	return fmt.Sprintf("%s at %q", v.reason, v.pointer)
+}
+
+// decodeRequest decodes the request body into v.
+//
+// The body is also checked against the generated API types: if strict is set a body with unknown fields or
+// mismatched types is rejected with a BadRequestErr that holds the JSON pointer of the field. Otherwise the
+// body is accepted as before, and the first violation is logged at debug level.
+func decodeRequest(zlog zerolog.Logger, r io.Reader, v interface{}, strict bool, name string) error {
+	// The body is read into a pooled buffer, the decoded values do not reference its bytes.
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if _, err := buf.ReadFrom(r); err != nil {
+		return &BadRequestErr{msg: "unable to decode " + name + " request", nextErr: err}
+	}
+	data := buf.Bytes()
+
+	debug := zlog.GetLevel() <= zerolog.DebugLevel && zerolog.GlobalLevel() <= zerolog.DebugLevel
+	if strict || debug {
+		// The body is checked before it is decoded so a type mismatch is reported with the pointer of the field.
+		if vErr := validateSchema(data, reflect.TypeOf(v)); vErr != nil {
+			if strict {
+				return &BadRequestErr{msg: name + " request does not match schema: " + vErr.Error(), nextErr: vErr}
+			}
+			zlog.Debug().Str("pointer", vErr.pointer).Str("reason", vErr.reason).Msgf("%s request does not match schema", name)
+		}
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return &BadRequestErr{msg: "unable to decode " + name + " request", nextErr: err}
+	}
+	return nil
+}
+
+// validateSchema returns the first field of the JSON document that does not match typ, fields are checked in
+// lexical order. A document that is not valid JSON is left to the decoder to report.
+func validateSchema(data []byte, typ reflect.Type) *schemaViolation {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil
+	}
+	return validateValue(doc, typ, "")
+}
+
+func validateValue(val interface{}, typ reflect.Type, pointer string) *schemaViolation {
+	if val == nil {
+		// null is decoded as the zero value of any type.
+		return nil
+	}
+	for typ.Kind() == reflect.Pointer {
+		if typ.Implements(jsonUnmarshalerType) {
+			return nil
+		}
+		typ = typ.Elem()
+	}
+	// Types with a custom unmarshaler (unions, raw messages) validate their own content.
+	if typ.Implements(jsonUnmarshalerType) || reflect.PointerTo(typ).Implements(jsonUnmarshalerType) {
+		return nil
+	}
+	if typ == jsonNumberType {
+		if _, ok := val.(json.Number); !ok {
+			return mismatch(val, "number", pointer)
+		}
+		return nil
+	}
+
+	switch typ.Kind() {
+	case reflect.Interface:
+		return nil
+	case reflect.Bool:
+		if _, ok := val.(bool); !ok {
+			return mismatch(val, "boolean", pointer)
+		}
+	case reflect.String:
+		if _, ok := val.(string); !ok {
+			return mismatch(val, "string", pointer)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := val.(json.Number)
+		if !ok {
+			return mismatch(val, "integer", pointer)
+		}
+		if _, err := strconv.ParseInt(n.String(), 10, 64); err != nil {
+			return mismatch(val, "integer", pointer)
+		}
+	case reflect.Float32, reflect.Float64:
+		if _, ok := val.(json.Number); !ok {
+			return mismatch(val, "number", pointer)
+		}
+	case reflect.Slice, reflect.Array:
+		items, ok := val.([]interface{})
+		if !ok {
+			return mismatch(val, "array", pointer)
+		}
+		for i, item := range items {
+			if v := validateValue(item, typ.Elem(), pointer+"/"+strconv.Itoa(i)); v != nil {
+				return v
+			}
+		}
+	case reflect.Map:
+		obj, ok := val.(map[string]interface{})
+		if !ok {
+			return mismatch(val, "object", pointer)
+		}
+		for _, key := range sortedKeys(obj) {
+			if v := validateValue(obj[key], typ.Elem(), pointer+"/"+escapePointer(key)); v != nil {
+				return v
+			}
+		}
+	case reflect.Struct:
+		obj, ok := val.(map[string]interface{})
+		if !ok {
+			return mismatch(val, "object", pointer)
+		}
+		fields := jsonFields(typ)
+		for _, key := range sortedKeys(obj) {
+			field, ok := fields[key]
+			if !ok {
+				return &schemaViolation{pointer: pointer + "/" + escapePointer(key), reason: "unknown field"}
+			}
+			if v := validateValue(obj[key], field, pointer+"/"+escapePointer(key)); v != nil {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// jsonFields returns the types of the fields of a struct by their JSON name.
+func jsonFields(typ reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type, typ.NumField())
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("json"); ok {
+			if tag == "-" {
+				continue
+			}
+			if n, _, _ := strings.Cut(tag, ","); n != "" {
+				name = n
+			}
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+func sortedKeys(obj map[string]interface{}) []string {
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func mismatch(val interface{}, expected string, pointer string) *schemaViolation {
+	return &schemaViolation{pointer: pointer, reason: fmt.Sprintf("expected %s, found %s", expected, jsonKind(val))}
+}
+
+func jsonKind(val interface{}) string {
+	switch val.(type) {
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return "null"
+	}
+}
+
+// escapePointer escapes a key as a JSON pointer reference token.
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
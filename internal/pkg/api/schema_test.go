@@ -0,0 +1,131 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package api
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDecodeRequestAgentVersions checks that the request bodies sent by different agent versions match the schema.
+func TestDecodeRequestAgentVersions(t *testing.T) {
+	tests := []struct {
+		file   string
+		target func() interface{}
+	}{
+		{"checkin-7.17.json", func() interface{} { return &CheckinRequest{} }},
+		{"checkin-8.6.json", func() interface{} { return &CheckinRequest{} }},
+		{"checkin-8.12.json", func() interface{} { return &CheckinRequest{} }},
+		{"enroll-7.17.json", func() interface{} { return &EnrollRequest{} }},
+		{"enroll-8.12.json", func() interface{} { return &EnrollRequest{} }},
+		{"ack-8.6.json", func() interface{} { return &AckRequest{} }},
+	}
+	for _, tc := range tests {
+		t.Run(tc.file, func(t *testing.T) {
+			p, err := os.ReadFile(filepath.Join("testdata", "schema", tc.file))
+			require.NoError(t, err)
+
+			name, _, _ := strings.Cut(tc.file, "-")
+			err = decodeRequest(zerolog.Nop(), bytes.NewReader(p), tc.target(), true, name)
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestDecodeRequestStrict(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		err  string
+	}{{
+		name: "unknown field",
+		body: `{"status":"HEALTHY","message":"","unknown":true}`,
+		err:  `Bad request: checkin request does not match schema: unknown field at "/unknown"`,
+	}, {
+		name: "field name with a different case",
+		body: `{"Status":"HEALTHY","message":""}`,
+		err:  `Bad request: checkin request does not match schema: unknown field at "/Status"`,
+	}, {
+		name: "unknown nested field",
+		body: `{"status":"HEALTHY","message":"","upgrade_details":{"action_id":"a","state":"UPG_REQUESTED","target_version":"8.13.0","retries":1}}`,
+		err:  `Bad request: checkin request does not match schema: unknown field at "/upgrade_details/retries"`,
+	}, {
+		name: "escaped pointer",
+		body: `{"status":"HEALTHY","message":"","a/b~c":1}`,
+		err:  `Bad request: checkin request does not match schema: unknown field at "/a~1b~0c"`,
+	}, {
+		name: "type mismatch",
+		body: `{"status":1,"message":""}`,
+		err:  `Bad request: checkin request does not match schema: expected string, found number at "/status"`,
+	}, {
+		name: "not an object",
+		body: `["HEALTHY"]`,
+		err:  `Bad request: checkin request does not match schema: expected object, found array at ""`,
+	}, {
+		name: "invalid json",
+		body: `{"status":`,
+		err:  `Bad request: unable to decode checkin request`,
+	}, {
+		name: "null values",
+		body: `{"status":"HEALTHY","message":"","ack_token":null,"upgrade_details":null}`,
+	}, {
+		name: "raw message content",
+		body: `{"status":"HEALTHY","message":"","local_metadata":{"anything":["goes"]}}`,
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var req CheckinRequest
+			err := decodeRequest(zerolog.Nop(), strings.NewReader(tc.body), &req, true, "checkin")
+			if tc.err == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, tc.err)
+			var brErr *BadRequestErr
+			assert.ErrorAs(t, err, &brErr)
+		})
+	}
+}
+
+func TestDecodeRequestLenient(t *testing.T) {
+	body := `{"status":"HEALTHY","message":"","unknown":true,"other":1}`
+
+	t.Run("debug", func(t *testing.T) {
+		var buf bytes.Buffer
+		zlog := zerolog.New(&buf).Level(zerolog.DebugLevel)
+
+		var req CheckinRequest
+		err := decodeRequest(zlog, strings.NewReader(body), &req, false, "checkin")
+		require.NoError(t, err)
+		assert.Equal(t, CheckinRequestStatus("HEALTHY"), req.Status)
+		assert.Equal(t, `{"level":"debug","pointer":"/other","reason":"unknown field","message":"checkin request does not match schema"}`+"\n", buf.String())
+	})
+
+	t.Run("info", func(t *testing.T) {
+		var buf bytes.Buffer
+		zlog := zerolog.New(&buf).Level(zerolog.InfoLevel)
+
+		var req CheckinRequest
+		err := decodeRequest(zlog, strings.NewReader(body), &req, false, "checkin")
+		require.NoError(t, err)
+		assert.Equal(t, CheckinRequestStatus("HEALTHY"), req.Status)
+		assert.Empty(t, buf.String())
+	})
+
+	t.Run("type mismatch", func(t *testing.T) {
+		var req CheckinRequest
+		err := decodeRequest(zerolog.Nop(), strings.NewReader(`{"status":1}`), &req, false, "checkin")
+		require.EqualError(t, err, "Bad request: unable to decode checkin request")
+	})
+}
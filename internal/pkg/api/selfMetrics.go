@@ -0,0 +1,204 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+)
+
+// Names of the collected metrics the usage documents are built from.
+const (
+	metricActiveConnections = "http_server_tcp_active"
+	metricRejectedConns     = "http_server_tcp_rejected"
+	metricRoutesPrefix      = "http_server_routes_"
+	metricCheckinTotal      = "http_server_routes_checkin_total"
+	metricBulkPendingBytes  = "bulk_pending_bytes"
+	metricCacheHitRatio     = "cache_hit_ratio"
+)
+
+// usageDoc is a document of the metrics-fleet_server.usage-default data stream.
+type usageDoc struct {
+	Timestamp   string            `json:"@timestamp"`
+	DataStream  map[string]string `json:"data_stream"`
+	Event       usageEvent        `json:"event"`
+	Agent       *usageAgent       `json:"agent,omitempty"`
+	FleetServer usageFleetServer  `json:"fleet_server"`
+}
+
+type usageEvent struct {
+	Dataset  string `json:"dataset"`
+	Duration int64  `json:"duration"` // nanoseconds since the previous document
+}
+
+type usageAgent struct {
+	ID string `json:"id"`
+}
+
+type usageFleetServer struct {
+	Connections struct {
+		Active int64 `json:"active"`
+	} `json:"connections"`
+	Limiter struct {
+		Rejected int64 `json:"rejected"` // since the previous document
+	} `json:"limiter"`
+	Bulk struct {
+		PendingBytes int64 `json:"pending_bytes"`
+	} `json:"bulk"`
+	Cache struct {
+		HitRatio float64 `json:"hit_ratio"`
+	} `json:"cache"`
+	Checkin struct {
+		Rate float64 `json:"rate"` // checkins per second since the previous document
+	} `json:"checkin"`
+}
+
+// SelfMetricsReporter periodically writes a snapshot of the internal metrics of fleet-server to Elasticsearch.
+// The documents are queued on the low priority bulk queue, a failure to write them is only logged at debug level.
+type SelfMetricsReporter struct {
+	bulker   bulk.Bulk
+	interval time.Duration
+	agentID  string
+	gatherer prometheus.Gatherer
+
+	last         time.Time
+	lastRejected float64
+	lastCheckins float64
+}
+
+// NewSelfMetricsReporter returns the reporter of the metrics of the fleet-server run by the agent with agentID.
+func NewSelfMetricsReporter(cfg *config.SelfMetrics, bulker bulk.Bulk, agentID string) *SelfMetricsReporter {
+	return &SelfMetricsReporter{
+		bulker:   bulker,
+		interval: cfg.Interval,
+		agentID:  agentID,
+		gatherer: registry.promReg,
+	}
+}
+
+// Run writes a document every interval until the context is cancelled.
+func (r *SelfMetricsReporter) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	// The first snapshot is the baseline of the rates and the counts since the previous document.
+	_, _ = r.snapshot(time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			r.report(ctx, now)
+		}
+	}
+}
+
+// report writes the document of the metrics since the previous snapshot.
+func (r *SelfMetricsReporter) report(ctx context.Context, now time.Time) {
+	log := zerolog.Ctx(ctx)
+	doc, err := r.snapshot(now)
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to gather self metrics")
+		return
+	}
+	body, err := json.Marshal(doc)
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to encode self metrics")
+		return
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to write self metrics")
+		return
+	}
+
+	// The write must not outlive the interval, so that a blocked bulker does not pile up documents.
+	wCtx, cancel := context.WithTimeout(ctx, r.interval)
+	defer cancel()
+	if _, err := r.bulker.Create(wCtx, dl.FleetServerUsage, id.String(), body, bulk.WithLowPriority()); err != nil {
+		log.Debug().Err(err).Str("index", dl.FleetServerUsage).Msg("Failed to write self metrics")
+	}
+}
+
+// snapshot gathers the metrics and returns the document of the period since the previous snapshot.
+func (r *SelfMetricsReporter) snapshot(now time.Time) (usageDoc, error) {
+	mfs, err := r.gatherer.Gather()
+	if err != nil {
+		return usageDoc{}, err
+	}
+
+	var active, rejected, pending, hitRatio, checkins float64
+	for _, mf := range mfs {
+		name := mf.GetName()
+		switch {
+		case name == metricActiveConnections:
+			active = sumMetric(mf)
+		case name == metricRejectedConns:
+			rejected += sumMetric(mf)
+		case strings.HasPrefix(name, metricRoutesPrefix) && (strings.HasSuffix(name, "_limit_rate") || strings.HasSuffix(name, "_limit_max")):
+			rejected += sumMetric(mf)
+		case name == metricCheckinTotal:
+			checkins = sumMetric(mf)
+		case name == metricBulkPendingBytes:
+			pending = sumMetric(mf)
+		case name == metricCacheHitRatio:
+			hitRatio = sumMetric(mf)
+		}
+	}
+
+	doc := usageDoc{
+		Timestamp: now.UTC().Format(time.RFC3339),
+		DataStream: map[string]string{
+			"dataset":   "fleet_server.usage",
+			"type":      "metrics",
+			"namespace": "default",
+		},
+		Event: usageEvent{Dataset: "fleet_server.usage"},
+	}
+	if r.agentID != "" {
+		doc.Agent = &usageAgent{ID: r.agentID}
+	}
+	doc.FleetServer.Connections.Active = int64(active)
+	doc.FleetServer.Bulk.PendingBytes = int64(pending)
+	doc.FleetServer.Cache.HitRatio = hitRatio
+	if !r.last.IsZero() {
+		elapsed := now.Sub(r.last)
+		doc.Event.Duration = elapsed.Nanoseconds()
+		doc.FleetServer.Limiter.Rejected = int64(rejected - r.lastRejected)
+		if elapsed > 0 {
+			doc.FleetServer.Checkin.Rate = (checkins - r.lastCheckins) / elapsed.Seconds()
+		}
+	}
+
+	r.last = now
+	r.lastRejected = rejected
+	r.lastCheckins = checkins
+	return doc, nil
+}
+
+// sumMetric returns the sum of the values of the series of a gauge or counter metric family.
+func sumMetric(mf *dto.MetricFamily) float64 {
+	var v float64
+	for _, m := range mf.GetMetric() {
+		switch {
+		case m.GetGauge() != nil:
+			v += m.GetGauge().GetValue()
+		case m.GetCounter() != nil:
+			v += m.GetCounter().GetValue()
+		}
+	}
+	return v
+}
@@ -0,0 +1,159 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+// usageSchema are the fields of the usage documents and their types.
+var usageSchema = map[string]string{
+	"@timestamp":                      "string",
+	"data_stream.dataset":             "string",
+	"data_stream.type":                "string",
+	"data_stream.namespace":           "string",
+	"event.dataset":                   "string",
+	"event.duration":                  "number",
+	"agent.id":                        "string",
+	"fleet_server.connections.active": "number",
+	"fleet_server.limiter.rejected":   "number",
+	"fleet_server.bulk.pending_bytes": "number",
+	"fleet_server.cache.hit_ratio":    "number",
+	"fleet_server.checkin.rate":       "number",
+}
+
+// flattenFields returns the dotted names of the leaf fields of a document with the JSON type of their value.
+func flattenFields(prefix string, doc map[string]interface{}, fields map[string]string) {
+	for k, v := range doc {
+		name := k
+		if prefix != "" {
+			name = prefix + "." + k
+		}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			flattenFields(name, v, fields)
+		case string:
+			fields[name] = "string"
+		case float64:
+			fields[name] = "number"
+		default:
+			fields[name] = "unknown"
+		}
+	}
+}
+
+// selfMetricsRegistry returns a registry with the metrics the usage documents are built from.
+func selfMetricsRegistry() (*prometheus.Registry, prometheus.Gauge, prometheus.Counter, *prometheus.CounterVec) {
+	reg := prometheus.NewRegistry()
+	active := prometheus.NewGauge(prometheus.GaugeOpts{Name: metricActiveConnections})
+	checkins := prometheus.NewCounter(prometheus.CounterOpts{Name: metricCheckinTotal})
+	rejects := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "http_server_routes_enroll_limit_rate"}, []string{"route"})
+	pending := prometheus.NewGauge(prometheus.GaugeOpts{Name: metricBulkPendingBytes})
+	hitRatio := prometheus.NewGauge(prometheus.GaugeOpts{Name: metricCacheHitRatio})
+	reg.MustRegister(active, checkins, rejects, pending, hitRatio)
+	pending.Set(2048)
+	hitRatio.Set(0.75)
+	return reg, active, checkins, rejects
+}
+
+func TestSelfMetricsReport(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	reg, active, checkins, rejects := selfMetricsRegistry()
+
+	var bodies [][]byte
+	bulker := ftesting.NewMockBulk()
+	bulker.On("Create", mock.Anything, dl.FleetServerUsage, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		bodies = append(bodies, args.Get(3).([]byte)) //nolint:errcheck // test
+	}).Return("", nil)
+
+	r := NewSelfMetricsReporter(&config.SelfMetrics{Enabled: true, Interval: 10 * time.Second}, bulker, "agent-1")
+	r.gatherer = reg
+
+	start := time.Now()
+	_, err := r.snapshot(start)
+	require.NoError(t, err)
+
+	active.Set(3)
+	checkins.Add(50)
+	rejects.WithLabelValues("a").Add(4)
+	rejects.WithLabelValues("b").Add(1)
+	r.report(ctx, start.Add(10*time.Second))
+	bulker.AssertExpectations(t)
+	require.Len(t, bodies, 1)
+
+	var doc map[string]interface{}
+	require.NoError(t, json.Unmarshal(bodies[0], &doc))
+	fields := make(map[string]string)
+	flattenFields("", doc, fields)
+	assert.Equal(t, usageSchema, fields)
+
+	var usage usageDoc
+	require.NoError(t, json.Unmarshal(bodies[0], &usage))
+	assert.Equal(t, "metrics", usage.DataStream["type"])
+	assert.Equal(t, "fleet_server.usage", usage.DataStream["dataset"])
+	assert.Equal(t, (10 * time.Second).Nanoseconds(), usage.Event.Duration)
+	assert.Equal(t, "agent-1", usage.Agent.ID)
+	assert.EqualValues(t, 3, usage.FleetServer.Connections.Active)
+	assert.EqualValues(t, 5, usage.FleetServer.Limiter.Rejected)
+	assert.EqualValues(t, 2048, usage.FleetServer.Bulk.PendingBytes)
+	assert.InDelta(t, 0.75, usage.FleetServer.Cache.HitRatio, 0.001)
+	assert.InDelta(t, 5, usage.FleetServer.Checkin.Rate, 0.001)
+
+	// The counts are reset by each document.
+	r.report(ctx, start.Add(20*time.Second))
+	require.Len(t, bodies, 2)
+	require.NoError(t, json.Unmarshal(bodies[1], &usage))
+	assert.Zero(t, usage.FleetServer.Limiter.Rejected)
+	assert.Zero(t, usage.FleetServer.Checkin.Rate)
+}
+
+func TestSelfMetricsUnwritable(t *testing.T) {
+	ctx, cancel := context.WithCancel(testlog.SetLogger(t).WithContext(context.Background()))
+	defer cancel()
+	reg, _, _, _ := selfMetricsRegistry()
+
+	writes := make(chan struct{}, 4)
+	bulker := ftesting.NewMockBulk()
+	bulker.On("Create", mock.Anything, dl.FleetServerUsage, mock.Anything, mock.Anything, mock.Anything).Run(func(mock.Arguments) {
+		select {
+		case writes <- struct{}{}:
+		default:
+		}
+	}).Return("", errors.New("index_not_found_exception"))
+
+	r := NewSelfMetricsReporter(&config.SelfMetrics{Enabled: true, Interval: 10 * time.Millisecond}, bulker, "")
+	r.gatherer = reg
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- r.Run(ctx)
+	}()
+
+	// The reporter keeps writing after a failure.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-writes:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the reporter to keep writing")
+		}
+	}
+	cancel()
+	require.NoError(t, <-errCh)
+}
@@ -12,8 +12,10 @@ import (
 	slog "log"
 	"net"
 	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
 
-	"github.com/elastic/elastic-agent-libs/transport/tlscommon"
 	"github.com/elastic/fleet-server/v7/internal/pkg/build"
 	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
 	"github.com/elastic/fleet-server/v7/internal/pkg/config"
@@ -26,16 +28,45 @@ import (
 )
 
 type server struct {
-	cfg     *config.Server
-	addr    string
-	handler http.Handler
+	cfg      *config.Server
+	addrs    []string
+	handler  http.Handler
+	limiter  *limiter
+	ct       *CheckinT
+	st       *StatusT
+	internal bool // serves the internal listener
+
+	// tlsReloadInterval is how often the TLS files are checked for changes, 0 disables the reload.
+	tlsReloadInterval time.Duration
+
+	maxConns atomic.Int64
+	shedIdle atomic.Bool
+	connLim  atomic.Pointer[limit.LimitListener]
+}
+
+// ServerOpt configures a server created with NewServer.
+type ServerOpt func(*server)
+
+// WithLimiter makes the server use the endpoint limits l, so that they are shared with the other servers using it.
+func WithLimiter(l *limiter) ServerOpt {
+	return func(s *server) {
+		s.limiter = l
+	}
 }
 
-// NewServer creates a new HTTP api for the passed addr.
+// WithInternalListener marks the server as the internal listener. It is served with the internal TLS
+// configuration, and it is the only one serving the enroll, agent actions, action result and policy preview routes with internal_only_routes.
+func WithInternalListener() ServerOpt {
+	return func(s *server) {
+		s.internal = true
+	}
+}
+
+// NewServer creates a new HTTP api for the passed addrs.
 //
-// The server has a listener specific conn limit and endpoint specific rate-limits.
+// The server listens on all the addrs with a single conn limit shared by the listeners and endpoint specific rate-limits.
 // The underlying API structs (such as *CheckinT) may be shared between servers.
-func NewServer(addr string, cfg *config.Server, ct *CheckinT, et *EnrollerT, at *ArtifactT, ack *AckT, st *StatusT, sm policy.SelfMonitor, bi build.Info, ut *UploadT, ft *FileDeliveryT, pt *PGPRetrieverT, bulker bulk.Bulk, tracer *apm.Tracer) *server {
+func NewServer(addrs []string, cfg *config.Server, ct *CheckinT, et *EnrollerT, at *ArtifactT, ack *AckT, st *StatusT, sm policy.SelfMonitor, bi build.Info, ut *UploadT, ft *FileDeliveryT, pt *PGPRetrieverT, aat *AgentActionsT, art *ActionResultT, ppt *PolicyPreviewT, bulker bulk.Bulk, tracer *apm.Tracer, opts ...ServerOpt) *server {
 	a := &apiServer{
 		ct:     ct,
 		et:     et,
@@ -47,40 +78,81 @@ func NewServer(addr string, cfg *config.Server, ct *CheckinT, et *EnrollerT, at
 		ut:     ut,
 		ft:     ft,
 		pt:     pt,
+		aat:    aat,
+		art:    art,
+		ppt:    ppt,
 		bulker: bulker,
+
+		timeouts: cfg.Timeouts,
+	}
+	s := &server{
+		addrs: addrs,
+		cfg:   cfg,
+		ct:    ct,
+		st:    st,
+
+		tlsReloadInterval: defaultTLSReloadInterval,
 	}
-	return &server{
-		addr:    addr,
-		cfg:     cfg,
-		handler: newRouter(&cfg.Limits, a, tracer),
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.limiter == nil {
+		s.limiter = Limiter(&cfg.Limits)
+	}
+	// The internal listener is not exposed through the reverse proxy, it serves the routes at the root.
+	basePath := cfg.RoutesBasePath()
+	if s.internal {
+		basePath = ""
+	}
+	s.handler = newRouter(s.limiter, a, tracer, basePath)
+	if cfg.InternalOnlyRoutes && !s.internal {
+		s.handler = notFoundInternalRoutes(s.handler)
+	}
+	s.maxConns.Store(int64(cfg.Limits.MaxConnections))
+	s.shedIdle.Store(cfg.Limits.ShedIdleConnections)
+	return s
+}
+
+// ReloadLimits applies changed endpoint rate limits and the max connections limit to a running server.
+//
+// Connections and requests that are already in flight, such as long-polling checkins, are not interrupted.
+// The max connections limit is only enforced when new connections are accepted.
+func (s *server) ReloadLimits(cfg *config.ServerLimits) {
+	s.limiter.reload(cfg)
+	s.maxConns.Store(int64(cfg.MaxConnections))
+	s.shedIdle.Store(cfg.ShedIdleConnections)
+	if ln := s.connLim.Load(); ln != nil {
+		ln.SetMax(cfg.MaxConnections)
+		ln.SetShedIdle(cfg.ShedIdleConnections)
 	}
 }
 
 func (s *server) Run(ctx context.Context) error {
 	rdto := s.cfg.Timeouts.Read
-	wrto := s.cfg.Timeouts.Write
+	wrto := s.cfg.Timeouts.WriteTimeout()
 	idle := s.cfg.Timeouts.Idle
 	rdhr := s.cfg.Timeouts.ReadHeader
 	mhbz := s.cfg.Limits.MaxHeaderByteSize
 
+	// Requests are not cancelled when the server stops, in-flight requests are drained instead.
+	baseCtx := context.WithoutCancel(ctx)
+
 	srv := http.Server{
-		Addr:              s.addr,
-		Handler:           s.handler,
+		Handler:           s.rejectOverLimit(s.handler),
 		ReadTimeout:       rdto,
 		ReadHeaderTimeout: rdhr,
 		WriteTimeout:      wrto,
 		IdleTimeout:       idle,
 		MaxHeaderBytes:    mhbz,
-		BaseContext:       func(net.Listener) context.Context { return ctx },
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
 		ErrorLog:          errLogger(ctx),
-		ConnState:         diagConn,
 	}
 
-	var listenCfg net.ListenConfig
-	ln, err := listenCfg.Listen(ctx, "tcp", s.addr)
+	ml, err := listenAll(ctx, s.addrs)
 	if err != nil {
 		return err
 	}
+	var ln net.Listener = ml
 	// Bind the deferred Close() to the stack variable to handle case where 'ln' is wrapped
 	defer func() {
 		err := ln.Close()
@@ -94,29 +166,54 @@ func (s *server) Run(ctx context.Context) error {
 	// is no capacity to service the connection.
 	// Also, it appears the HTTP2 implementation depends on the tls.Listener
 	// being at the top of the stack.
-	ln = wrapConnLimitter(ctx, ln, s.cfg)
+	ln = s.wrapConnLimitter(ctx, ln)
+	connLim := s.connLim.Load()
+	srv.ConnContext = connLim.ConnContext
+	srv.ConnState = func(c net.Conn, state http.ConnState) {
+		diagConn(c, state)
+		connLim.ConnState(c, state)
+	}
+	if s.st != nil {
+		s.st.listeners.add(connLim)
+		defer s.st.listeners.remove(connLim)
+	}
 
-	if s.cfg.TLS != nil && s.cfg.TLS.IsEnabled() {
-		commonTLSCfg, err := tlscommon.LoadTLSServerConfig(s.cfg.TLS)
+	tlsCfg := s.cfg.TLS
+	if s.internal {
+		tlsCfg = s.cfg.InternalTLSConfig()
+	}
+	if tlsCfg != nil && tlsCfg.IsEnabled() {
+		var host string
+		switch {
+		case s.internal && s.cfg.InternalHost != "":
+			host = s.cfg.InternalHost
+		case len(s.cfg.Host) > 0:
+			host = s.cfg.Host[0]
+		}
+		reloader, err := newTLSReloader(tlsCfg, host, s.cfg.Auth.Mode)
 		if err != nil {
 			return err
 		}
-		srv.TLSConfig = commonTLSCfg.BuildServerConfig(s.cfg.Host)
-
-		// Must enable http/2 in the configuration explicitly.
-		// (see https://golang.org/pkg/net/http/#Server.Serve)
-		srv.TLSConfig.NextProtos = []string{"h2", "http/1.1"}
+		if s.tlsReloadInterval > 0 {
+			go reloader.Run(ctx, s.tlsReloadInterval)
+		}
+		srv.TLSConfig = reloader.ServerConfig()
 
 		ln = tls.NewListener(ln, srv.TLSConfig)
 
 	} else {
+		if s.cfg.Auth.Mode == config.AuthModePKI {
+			return errors.New("pki auth mode requires TLS to be enabled")
+		}
 		zerolog.Ctx(ctx).Warn().Msg("Exposed over insecure HTTP; enablement of TLS is strongly recommended")
 	}
 
 	// Start the API server on another goroutine and return any non ErrServerClosed errors through a channel.
 	errCh := make(chan error)
 	go func(ctx context.Context, errCh chan error, ln net.Listener) {
-		zerolog.Ctx(ctx).Info().Msgf("Listening on %s", s.addr)
+		for _, addr := range ml.Addrs() {
+			zerolog.Ctx(ctx).Info().Msgf("Listening on %s", addr)
+		}
 		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			errCh <- err
 		}
@@ -130,6 +227,10 @@ func (s *server) Run(ctx context.Context) error {
 		}
 	// Do a clean shutdown if the context is cancelled
 	case <-ctx.Done():
+		s.drain(ctx)
+		if err := s.drainGrace(ctx, errCh); err != nil {
+			return fmt.Errorf("error while serving API listener: %w", err)
+		}
 		sCtx, cancel := context.WithTimeout(context.Background(), s.cfg.Timeouts.Drain)
 		defer cancel()
 		if err := srv.Shutdown(sCtx); err != nil {
@@ -141,6 +242,35 @@ func (s *server) Run(ctx context.Context) error {
 	return nil
 }
 
+// drain releases the parked checkins and reports the server as draining while the in-flight requests complete.
+func (s *server) drain(ctx context.Context) {
+	zerolog.Ctx(ctx).Info().Dur("timeout", s.cfg.Timeouts.Drain).Msgf("Draining API server on %s", strings.Join(s.addrs, ", "))
+	if s.st != nil {
+		s.st.drain()
+	}
+	if s.ct != nil {
+		s.ct.drain()
+	}
+}
+
+// drainGrace keeps serving for the drain grace period once the server is draining, so that the draining status can
+// be read from the status endpoint before the listener is closed.
+func (s *server) drainGrace(ctx context.Context, errCh <-chan error) error {
+	grace := s.cfg.Timeouts.DrainGrace
+	if s.st == nil || grace <= 0 {
+		return nil
+	}
+	zerolog.Ctx(ctx).Info().Dur("grace", grace).Msg("Serving the draining status before shutdown")
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case err := <-errCh:
+		return err
+	}
+}
+
 func diagConn(c net.Conn, s http.ConnState) {
 	if c == nil {
 		return
@@ -152,30 +282,58 @@ func diagConn(c net.Conn, s http.ConnState) {
 		Str("state", s.String()).
 		Msg("connection state change")
 
+	listener, labeled := connListener(c)
 	switch s {
 	case http.StateNew:
 		cntHTTPNew.Inc()
 		cntHTTPActive.Inc()
+		if labeled {
+			cntListenerNew.WithLabelValues(listener).Inc()
+			cntListenerActive.WithLabelValues(listener).Inc()
+		}
 	case http.StateClosed:
 		cntHTTPClose.Inc()
 		cntHTTPActive.Dec()
+		if labeled {
+			cntListenerClose.WithLabelValues(listener).Inc()
+			cntListenerActive.WithLabelValues(listener).Dec()
+		}
 	}
 }
 
-func wrapConnLimitter(ctx context.Context, ln net.Listener, cfg *config.Server) net.Listener {
-	hardLimit := cfg.Limits.MaxConnections
+// wrapConnLimitter wraps the listener with the connection limiter.
+// The limiter is always installed so the limit may be enabled or changed by a config reload.
+func (s *server) wrapConnLimitter(ctx context.Context, ln net.Listener) net.Listener {
+	hardLimit := int(s.maxConns.Load())
 
 	if hardLimit != 0 {
 		zerolog.Ctx(ctx).Info().
 			Int("hardConnLimit", hardLimit).
 			Msg("server hard connection limiter installed")
-
-		ln = limit.Listener(ln, hardLimit)
 	} else {
 		zerolog.Ctx(ctx).Info().Msg("server hard connection limiter disabled")
 	}
 
-	return ln
+	ll := limit.Listener(ln, hardLimit)
+	s.connLim.Store(ll)
+	// Catch a reload that occurred while the listener was being created.
+	ll.SetMax(int(s.maxConns.Load()))
+	ll.SetShedIdle(s.shedIdle.Load())
+	return ll
+}
+
+// rejectOverLimit answers the requests received on the connections accepted over the max connections limit
+// with a 503 and closes the connections.
+func (s *server) rejectOverLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !limit.Rejected(r.Context()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cntHTTPRejected.Inc()
+		w.Header().Set("Connection", "close")
+		ErrorResp(w, r, &limit.MaxConnsError{Max: s.maxConns.Load()})
+	})
 }
 
 type stubLogger struct {
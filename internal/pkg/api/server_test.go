@@ -10,9 +10,13 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -21,6 +25,8 @@ import (
 	libsconfig "github.com/elastic/elastic-agent-libs/config"
 	"github.com/elastic/elastic-agent-libs/transport/tlscommon"
 	"github.com/elastic/go-ucfg/yaml"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	fbuild "github.com/elastic/fleet-server/v7/internal/pkg/build"
@@ -39,11 +45,11 @@ func Test_server_Run(t *testing.T) {
 	require.NoError(t, err)
 	cfg := &config.Server{}
 	cfg.InitDefaults()
-	cfg.Host = "localhost"
+	cfg.Host = config.BindHosts{"localhost"}
 	cfg.Port = port
-	addr := cfg.BindEndpoints()[0]
+	addr := cfg.BindAddress()
 
-	srv := NewServer(addr, cfg, nil, nil, nil, nil, nil, nil, fbuild.Info{}, nil, nil, nil, nil, nil)
+	srv := NewServer([]string{addr}, cfg, nil, nil, nil, nil, nil, nil, fbuild.Info{}, nil, nil, nil, nil, nil, nil, nil, nil)
 
 	started := make(chan struct{}, 1)
 	errCh := make(chan error, 1)
@@ -118,13 +124,14 @@ func Test_server_ClientCert(t *testing.T) {
 		require.NoError(t, err)
 		cfg := &config.Server{}
 		cfg.InitDefaults()
-		cfg.Host = "localhost"
+		cfg.Timeouts.DrainGrace = 0
+		cfg.Host = config.BindHosts{"localhost"}
 		cfg.Port = port
-		addr := cfg.BindEndpoints()[0]
+		addr := cfg.BindAddress()
 		cfg.TLS = tlsCFG
 
 		st := NewStatusT(cfg, nil, nil)
-		srv := NewServer(addr, cfg, nil, nil, nil, nil, st, sm, fbuild.Info{}, nil, nil, nil, nil, nil)
+		srv := NewServer([]string{addr}, cfg, nil, nil, nil, nil, st, sm, fbuild.Info{}, nil, nil, nil, nil, nil, nil, nil, nil)
 
 		// make http client with no client certs
 		certPool := x509.NewCertPool()
@@ -188,13 +195,14 @@ func Test_server_ClientCert(t *testing.T) {
 		require.NoError(t, err)
 		cfg := &config.Server{}
 		cfg.InitDefaults()
-		cfg.Host = "localhost"
+		cfg.Timeouts.DrainGrace = 0
+		cfg.Host = config.BindHosts{"localhost"}
 		cfg.Port = port
-		addr := cfg.BindEndpoints()[0]
+		addr := cfg.BindAddress()
 		cfg.TLS = tlsCFG
 
 		st := NewStatusT(cfg, nil, nil)
-		srv := NewServer(addr, cfg, nil, nil, nil, nil, st, sm, fbuild.Info{}, nil, nil, nil, nil, nil)
+		srv := NewServer([]string{addr}, cfg, nil, nil, nil, nil, st, sm, fbuild.Info{}, nil, nil, nil, nil, nil, nil, nil, nil)
 
 		// make http client with valid client certs
 		clientCert := certs.GenCert(t, ca)
@@ -260,13 +268,14 @@ func Test_server_ClientCert(t *testing.T) {
 		require.NoError(t, err)
 		cfg := &config.Server{}
 		cfg.InitDefaults()
-		cfg.Host = "localhost"
+		cfg.Timeouts.DrainGrace = 0
+		cfg.Host = config.BindHosts{"localhost"}
 		cfg.Port = port
-		addr := cfg.BindEndpoints()[0]
+		addr := cfg.BindAddress()
 		cfg.TLS = tlsCFG
 
 		st := NewStatusT(cfg, nil, nil)
-		srv := NewServer(addr, cfg, nil, nil, nil, nil, st, sm, fbuild.Info{}, nil, nil, nil, nil, nil)
+		srv := NewServer([]string{addr}, cfg, nil, nil, nil, nil, st, sm, fbuild.Info{}, nil, nil, nil, nil, nil, nil, nil, nil)
 
 		// make http client with invalid client certs
 		clientCA := certs.GenCA(t)
@@ -331,9 +340,10 @@ func Test_server_ClientCert(t *testing.T) {
 		require.NoError(t, err)
 		cfg := &config.Server{}
 		cfg.InitDefaults()
-		cfg.Host = "localhost"
+		cfg.Timeouts.DrainGrace = 0
+		cfg.Host = config.BindHosts{"localhost"}
 		cfg.Port = port
-		addr := cfg.BindEndpoints()[0]
+		addr := cfg.BindAddress()
 
 		// prep server config without specifing client_authentication
 		tlsYML := fmt.Sprintf(`
@@ -349,7 +359,7 @@ key: %s`,
 		cfg.TLS = tlsCFG
 
 		st := NewStatusT(cfg, nil, nil)
-		srv := NewServer(addr, cfg, nil, nil, nil, nil, st, sm, fbuild.Info{}, nil, nil, nil, nil, nil)
+		srv := NewServer([]string{addr}, cfg, nil, nil, nil, nil, st, sm, fbuild.Info{}, nil, nil, nil, nil, nil, nil, nil, nil)
 
 		// make http client with valid client certs
 		clientCert := certs.GenCert(t, ca)
@@ -406,3 +416,596 @@ key: %s`,
 		}
 	})
 }
+
+func Test_server_MaxConnections(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = testlog.SetLogger(t).WithContext(ctx)
+
+	port, err := ftesting.FreePort()
+	require.NoError(t, err)
+	cfg := &config.Server{}
+	cfg.InitDefaults()
+	cfg.Host = config.BindHosts{"localhost"}
+	cfg.Port = port
+	cfg.Limits.MaxConnections = 1
+	addr := cfg.BindAddress()
+
+	// The long poll is held until release is closed.
+	release := make(chan struct{})
+	polling := make(chan struct{}, 1)
+	srv := &server{
+		addrs: []string{addr},
+		cfg:   cfg,
+		handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			polling <- struct{}{}
+			<-release
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	srv.maxConns.Store(1)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := srv.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			t.Error(err)
+		}
+	}()
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	pollDone := make(chan int, 1)
+	go func() {
+		client := &http.Client{Transport: &http.Transport{}}
+		var resp *http.Response
+		var err error
+		// Retry until the server is listening.
+		for i := 0; i < 50; i++ {
+			resp, err = client.Get("http://" + addr + "/poll") //nolint:noctx // test request
+			if err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			pollDone <- 0
+			return
+		}
+		resp.Body.Close()
+		pollDone <- resp.StatusCode
+	}()
+	select {
+	case <-polling:
+	case <-time.After(time.Second):
+		require.Fail(t, "timed out waiting for the long poll")
+	}
+
+	client := &http.Client{Transport: &http.Transport{}}
+	resp, err := client.Get("http://" + addr + "/") //nolint:noctx // test request
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.True(t, resp.Close, "the connection should be closed")
+	var body HTTPErrResp
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, "MaxConnections", body.Error)
+	assert.Equal(t, "exceeded the max connections limit of 1", body.Message)
+
+	close(release)
+	select {
+	case status := <-pollDone:
+		assert.Equal(t, http.StatusOK, status, "expected the long poll to complete")
+	case <-time.After(time.Second):
+		require.Fail(t, "timed out waiting for the long poll to complete")
+	}
+}
+
+func Test_server_MultipleListeners(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback is not available:", err)
+	}
+	ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = testlog.SetLogger(t).WithContext(ctx)
+	port, err := ftesting.FreePort()
+	require.NoError(t, err)
+	cfg := &config.Server{}
+	cfg.InitDefaults()
+	cfg.Host = config.BindHosts{"127.0.0.1", "::1"}
+	cfg.Port = port
+	cfg.Limits.MaxConnections = 1
+	addrs := cfg.BindAddresses()
+	require.Equal(t, []string{fmt.Sprintf("127.0.0.1:%d", port), fmt.Sprintf("[::1]:%d", port)}, addrs)
+
+	// The long poll is held until release is closed.
+	release := make(chan struct{})
+	polling := make(chan struct{}, 1)
+	srv := &server{
+		addrs: addrs,
+		cfg:   cfg,
+		handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/poll" {
+				polling <- struct{}{}
+				<-release
+			}
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	srv.maxConns.Store(1)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := srv.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			t.Error(err)
+		}
+	}()
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	// Both listeners serve the requests and count their connections.
+	for _, addr := range addrs {
+		opened := listenerOpened(t, addr)
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		var resp *http.Response
+		// Retry until the server is listening.
+		for i := 0; i < 50; i++ {
+			resp, err = client.Get("http://" + addr + "/") //nolint:noctx // test request
+			if err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, opened+1, listenerOpened(t, addr))
+	}
+
+	// The connection limit is shared by the listeners.
+	pollDone := make(chan int, 1)
+	go func() {
+		client := &http.Client{Transport: &http.Transport{}}
+		resp, err := client.Get("http://" + addrs[0] + "/poll") //nolint:noctx // test request
+		if err != nil {
+			pollDone <- 0
+			return
+		}
+		resp.Body.Close()
+		pollDone <- resp.StatusCode
+	}()
+	select {
+	case <-polling:
+	case <-time.After(time.Second):
+		require.Fail(t, "timed out waiting for the long poll")
+	}
+
+	client := &http.Client{Transport: &http.Transport{}}
+	resp, err := client.Get("http://" + addrs[1] + "/") //nolint:noctx // test request
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	close(release)
+	select {
+	case status := <-pollDone:
+		assert.Equal(t, http.StatusOK, status, "expected the long poll to complete")
+	case <-time.After(time.Second):
+		require.Fail(t, "timed out waiting for the long poll to complete")
+	}
+}
+
+func listenerOpened(t *testing.T, addr string) float64 {
+	t.Helper()
+	var m dto.Metric
+	require.NoError(t, cntListenerNew.WithLabelValues(addr).Write(&m))
+	return m.GetCounter().GetValue()
+}
+
+func Test_server_BindError(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+
+	// Hold the port of the second address so it can not be bound.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	port := uint16(ln.Addr().(*net.TCPAddr).Port) //nolint:gosec // port is in range
+	free, err := ftesting.FreePort()
+	require.NoError(t, err)
+
+	cfg := &config.Server{}
+	cfg.InitDefaults()
+	addrs := []string{fmt.Sprintf("localhost:%d", free), fmt.Sprintf("127.0.0.1:%d", port)}
+	srv := NewServer(addrs, cfg, nil, nil, nil, nil, nil, nil, fbuild.Info{}, nil, nil, nil, nil, nil, nil, nil, nil)
+
+	err = srv.Run(ctx)
+	require.ErrorContains(t, err, "unable to bind "+addrs[1])
+}
+
+func Test_server_UnixSocket(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = testlog.SetLogger(t).WithContext(ctx)
+	path := filepath.Join(t.TempDir(), "fleet-server.sock")
+
+	// A socket is left behind by a previous run.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	require.NoError(t, err)
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	require.FileExists(t, path)
+
+	port, err := ftesting.FreePort()
+	require.NoError(t, err)
+	cfg := &config.Server{}
+	cfg.InitDefaults()
+	cfg.Host = config.BindHosts{"127.0.0.1", "unix:" + path}
+	cfg.Port = port
+	addrs := cfg.BindAddresses()
+	require.Equal(t, []string{fmt.Sprintf("127.0.0.1:%d", port), "unix:" + path}, addrs)
+
+	srv := &server{
+		addrs: addrs,
+		cfg:   cfg,
+		handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	srv.maxConns.Store(10)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := srv.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			t.Error(err)
+		}
+	}()
+
+	opened := listenerOpened(t, addrs[1])
+	client := &http.Client{Transport: &http.Transport{
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+	var resp *http.Response
+	// Retry until the server is listening.
+	for i := 0; i < 50; i++ {
+		resp, err = client.Get("http://fleet-server/") //nolint:noctx // test request
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, opened+1, listenerOpened(t, addrs[1]))
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.NotZero(t, fi.Mode()&os.ModeSocket)
+	assert.Equal(t, unixSocketMode, fi.Mode().Perm())
+
+	// The socket of the running server is not replaced.
+	_, err = listenUnixSocket(path, unixSocketMode)
+	assert.ErrorContains(t, err, "in use")
+
+	cancel()
+	wg.Wait()
+	assert.NoFileExists(t, path, "the socket is removed on shutdown")
+}
+
+func Test_server_TLSReload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = testlog.SetLogger(t).WithContext(ctx)
+
+	ca := certs.GenCA(t)
+	caPath := certs.CertToFile(t, ca, "ca")
+	oldCert := certs.GenCert(t, ca)
+	certPath := certs.CertToFile(t, oldCert, "cert")
+	keyPath := certs.KeyToFile(t, oldCert, "key")
+
+	ucfg, err := yaml.NewConfig([]byte(fmt.Sprintf(tlsCFGTempl, caPath, certPath, keyPath)))
+	require.NoError(t, err)
+	tlsCFG := &tlscommon.ServerConfig{}
+	require.NoError(t, tlsCFG.Unpack(libsconfig.C(*ucfg)))
+
+	port, err := ftesting.FreePort()
+	require.NoError(t, err)
+	cfg := &config.Server{}
+	cfg.InitDefaults()
+	cfg.Host = config.BindHosts{"localhost"}
+	cfg.Port = port
+	cfg.TLS = tlsCFG
+	addr := cfg.BindAddress()
+
+	srv := &server{
+		addrs: []string{addr},
+		cfg:   cfg,
+		handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+		tlsReloadInterval: 10 * time.Millisecond,
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := srv.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			t.Error(err)
+		}
+	}()
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	certPool := x509.NewCertPool()
+	certPool.AddCert(ca.Leaf)
+	newClient := func() *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: certPool}}} //nolint:gosec // test client
+	}
+	// serial returns the serial number of the certificate of the connection that served the request.
+	serial := func(c *assert.CollectT, client *http.Client) string {
+		resp, err := client.Get("https://" + addr + "/") //nolint:noctx // test request
+		if !assert.NoError(c, err) {
+			return ""
+		}
+		resp.Body.Close()
+		if !assert.NotNil(c, resp.TLS) {
+			return ""
+		}
+		return resp.TLS.PeerCertificates[0].SerialNumber.String()
+	}
+
+	oldClient := newClient()
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, oldCert.Leaf.SerialNumber.String(), serial(c, oldClient))
+	}, time.Second, 10*time.Millisecond)
+
+	// Rotate the pair by replacing the files, like a mounted secret is updated.
+	newCert := certs.GenCert(t, ca)
+	require.NoError(t, os.Rename(certs.CertToFile(t, newCert, "cert"), certPath))
+	require.NoError(t, os.Rename(certs.KeyToFile(t, newCert, "key"), keyPath))
+
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, newCert.Leaf.SerialNumber.String(), serial(c, newClient()))
+	}, 5*time.Second, 20*time.Millisecond, "expected a new connection to use the rotated certificate")
+
+	// The connection established before the rotation is still alive and reused.
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, oldCert.Leaf.SerialNumber.String(), serial(c, oldClient))
+	}, time.Second, 10*time.Millisecond, "expected the existing connection to stay alive")
+
+	// An invalid replacement is rejected and the rotated certificate is kept.
+	errCount := cntTLSReloadErrors.metric.Get()
+	require.NoError(t, os.WriteFile(certPath, []byte("not a certificate"), 0o600))
+	require.Eventually(t, func() bool {
+		return cntTLSReloadErrors.metric.Get() > errCount
+	}, 5*time.Second, 20*time.Millisecond, "expected the invalid certificate to be reported")
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, newCert.Leaf.SerialNumber.String(), serial(c, newClient()))
+	}, time.Second, 10*time.Millisecond)
+}
+
+func Test_server_TLSVersions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = testlog.SetLogger(t).WithContext(ctx)
+
+	ca := certs.GenCA(t)
+	cert := certs.GenCert(t, ca)
+	tlsYML := fmt.Sprintf(`
+enabled: true
+certificate: "%s"
+key: "%s"
+supported_protocols: ["TLSv1.3"]
+`, certs.CertToFile(t, cert, "cert"), certs.KeyToFile(t, cert, "key"))
+	ucfg, err := yaml.NewConfig([]byte(tlsYML))
+	require.NoError(t, err)
+	tlsCFG := &tlscommon.ServerConfig{}
+	require.NoError(t, tlsCFG.Unpack(libsconfig.C(*ucfg)))
+
+	port, err := ftesting.FreePort()
+	require.NoError(t, err)
+	cfg := &config.Server{}
+	cfg.InitDefaults()
+	cfg.Host = config.BindHosts{"localhost"}
+	cfg.Port = port
+	cfg.TLS = tlsCFG
+	addr := cfg.BindAddress()
+
+	srv := &server{
+		addrs: []string{addr},
+		cfg:   cfg,
+		handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := srv.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			t.Error(err)
+		}
+	}()
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	certPool := x509.NewCertPool()
+	certPool.AddCert(ca.Leaf)
+	handshake := func(version uint16) error {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", addr, &tls.Config{
+			RootCAs:    certPool,
+			MinVersion: version,
+			MaxVersion: version,
+		})
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.NoError(c, handshake(tls.VersionTLS13))
+	}, time.Second, 10*time.Millisecond)
+	assert.Error(t, handshake(tls.VersionTLS12), "expected a TLS 1.2 client to be rejected")
+}
+
+func Test_server_InternalOnlyRoutes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = testlog.SetLogger(t).WithContext(ctx)
+
+	sm := mock.NewMockMonitor()
+	sm.On("State").Return(client.UnitStateHealthy)
+
+	port, err := ftesting.FreePort()
+	require.NoError(t, err)
+	internalPort, err := ftesting.FreePort()
+	require.NoError(t, err)
+	cfg := &config.Server{}
+	cfg.InitDefaults()
+	cfg.Timeouts.DrainGrace = 0
+	cfg.Host = config.BindHosts{"127.0.0.1"}
+	cfg.Port = port
+	cfg.InternalHost = "127.0.0.1"
+	cfg.InternalPort = internalPort
+	cfg.InternalOnlyRoutes = true
+	// A single status request is admitted, by any of the listeners.
+	cfg.Limits.StatusLimit = config.Limit{Interval: time.Hour, Burst: 1}
+	publicAddr, internalAddr := cfg.BindAddress(), cfg.BindInternalAddress()
+
+	st := NewStatusT(cfg, nil, nil)
+	l := Limiter(&cfg.Limits)
+	public := NewServer([]string{publicAddr}, cfg, nil, nil, nil, nil, st, sm, fbuild.Info{}, nil, nil, nil, nil, nil, nil, nil, nil, WithLimiter(l))
+	internal := NewServer([]string{internalAddr}, cfg, nil, nil, nil, nil, st, sm, fbuild.Info{}, nil, nil, nil, nil, nil, nil, nil, nil, WithLimiter(l), WithInternalListener())
+
+	var wg sync.WaitGroup
+	for _, srv := range []*server{public, internal} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				t.Error(err)
+			}
+		}()
+	}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	do := func(c assert.TestingT, method, addr, path string) int {
+		req, err := http.NewRequestWithContext(ctx, method, "http://"+addr+path, nil)
+		if !assert.NoError(c, err) {
+			return 0
+		}
+		if method == http.MethodPost {
+			// The enroll route answers with an error without a User-Agent, before reaching the handler.
+			req.Header.Set("User-Agent", "")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(c, err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, http.StatusNotFound, do(c, http.MethodPost, publicAddr, "/api/fleet/agents/enroll"))
+		status := do(c, http.MethodPost, internalAddr, "/api/fleet/agents/enroll")
+		assert.NotZero(c, status)
+		assert.NotEqual(c, http.StatusNotFound, status)
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, http.StatusNotFound, do(t, http.MethodPost, publicAddr, "/api/fleet/agents/agent-1/actions"))
+	assert.Equal(t, http.StatusNotFound, do(t, http.MethodGet, publicAddr, "/api/fleet/agents/agent-1/actions/action-1/result"))
+	assert.Equal(t, http.StatusNotFound, do(t, http.MethodGet, publicAddr, "/api/fleet/agents/agent-1/policy/preview"))
+
+	// The listeners share the limiter state.
+	assert.Equal(t, http.StatusOK, do(t, http.MethodGet, publicAddr, "/api/status"))
+	assert.Equal(t, http.StatusTooManyRequests, do(t, http.MethodGet, internalAddr, "/api/status"))
+}
+
+func Test_server_DrainGrace(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = testlog.SetLogger(t).WithContext(ctx)
+
+	sm := mock.NewMockMonitor()
+	sm.On("State").Return(client.UnitStateHealthy)
+
+	port, err := ftesting.FreePort()
+	require.NoError(t, err)
+	cfg := &config.Server{}
+	cfg.InitDefaults()
+	cfg.Host = config.BindHosts{"127.0.0.1"}
+	cfg.Port = port
+	cfg.Timeouts.DrainGrace = 2 * time.Second
+	addr := cfg.BindAddress()
+
+	srv := NewServer([]string{addr}, cfg, nil, nil, nil, nil, NewStatusT(cfg, nil, nil), sm, fbuild.Info{}, nil, nil, nil, nil, nil, nil, nil, nil)
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Run(ctx)
+	}()
+
+	status := func(c assert.TestingT) (int, StatusAPIResponse) {
+		var res StatusAPIResponse
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://"+addr+"/api/status", nil)
+		if !assert.NoError(c, err) {
+			return 0, res
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(c, err) {
+			return 0, res
+		}
+		defer resp.Body.Close()
+		assert.NoError(c, json.NewDecoder(resp.Body).Decode(&res))
+		return resp.StatusCode, res
+	}
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		code, _ := status(c)
+		assert.Equal(c, http.StatusOK, code)
+	}, time.Second, 10*time.Millisecond)
+
+	// The server keeps serving the draining status during the grace period.
+	cancel()
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		code, res := status(c)
+		assert.Equal(c, http.StatusServiceUnavailable, code)
+		if assert.NotNil(c, res.Message) {
+			assert.Equal(c, "draining", *res.Message)
+		}
+	}, time.Second, 10*time.Millisecond)
+	select {
+	case <-done:
+		require.Fail(t, "server stopped before the end of the drain grace period")
+	default:
+	}
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "server did not stop after the drain grace period")
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ErrEndpointTimeout is returned when a request fails because it exceeded the timeout of its endpoint.
+var ErrEndpointTimeout = errors.New("request exceeded the endpoint timeout")
+
+// withTimeout returns the request with a context that expires after the timeout of its endpoint.
+// A timeout of 0 leaves the request as it is.
+func withTimeout(r *http.Request, timeout time.Duration) (*http.Request, context.CancelFunc) {
+	if timeout <= 0 {
+		return r, func() {}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return r.WithContext(ctx), cancel
+}
+
+// timeoutErr returns err wrapped with ErrEndpointTimeout when the request failed after the context returned by
+// withTimeout expired, so that the failure is answered with a 503 instead of the error of the interrupted call.
+func timeoutErr(r *http.Request, err error) error {
+	if err == nil || !errors.Is(r.Context().Err(), context.DeadlineExceeded) || errors.Is(err, ErrEndpointTimeout) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrEndpointTimeout, err)
+}
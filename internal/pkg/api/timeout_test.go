@@ -0,0 +1,116 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/cache"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+// slowBulk is a bulker whose document reads answer that the document is not found after delay,
+// or fail with the error of the context when it is done first.
+type slowBulk struct {
+	*ftesting.MockBulk
+	delay time.Duration
+}
+
+func (b *slowBulk) ReadRaw(ctx context.Context, _, _ string, _ ...bulk.Opt) (*bulk.MgetResponseItem, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(b.delay):
+		return nil, es.ErrElasticNotFound
+	}
+}
+
+func TestEndpointTimeout(t *testing.T) {
+	bulker := &slowBulk{MockBulk: ftesting.NewMockBulk(), delay: 100 * time.Millisecond}
+	// The agent is looked up with a slow read of the agent document.
+	slowAuth := func(r *http.Request, _ *string, bulker bulk.Bulk, _ cache.Cache) (*model.Agent, error) {
+		agent, err := dl.GetAgent(r.Context(), bulker, "agent-1")
+		if err != nil {
+			return nil, err
+		}
+		return &agent, nil
+	}
+
+	cfg := &config.Server{}
+	cfg.InitDefaults()
+	cfg.Timeouts.Ack = 10 * time.Millisecond
+	cfg.Timeouts.Artifact = time.Second
+	ack := NewAckT(cfg, bulker, nil)
+	ack.authAgent = slowAuth
+	at := NewArtifactT(cfg, bulker, nil)
+	at.authAgent = slowAuth
+	a := &apiServer{ack: ack, at: at, bulker: bulker, timeouts: cfg.Timeouts}
+
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+
+	t.Run("ack exceeds its timeout", func(t *testing.T) {
+		timeouts := cntAcks.timeout.metric.Get()
+		r := httptest.NewRequest(http.MethodPost, "/api/fleet/agents/agent-1/acks", strings.NewReader(`{"events":[]}`)).WithContext(ctx)
+		w := httptest.NewRecorder()
+		start := time.Now()
+		a.AgentAcks(w, r, "agent-1", AgentAcksParams{})
+		assert.Less(t, time.Since(start), bulker.delay, "expected the request to stop at the ack timeout")
+
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		var body Error
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		require.NotNil(t, body.Code)
+		assert.Equal(t, string(ErrCodeServiceUnavailable), *body.Code)
+		assert.Equal(t, "EndpointTimeout", body.Error)
+		assert.Equal(t, timeouts+1, cntAcks.timeout.metric.Get())
+	})
+
+	t.Run("artifact within its timeout", func(t *testing.T) {
+		timeouts := cntArtifacts.timeout.metric.Get()
+		r := httptest.NewRequest(http.MethodGet, "/api/fleet/artifacts/endpoint-exceptionlist-macos-v1/"+strings.Repeat("a", 64), nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		a.Artifact(w, r, "endpoint-exceptionlist-macos-v1", strings.Repeat("a", 64), ArtifactParams{})
+
+		// The slow read completes, the request fails because the agent is not found.
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Equal(t, timeouts, cntArtifacts.timeout.metric.Get())
+	})
+}
+
+func TestTimeoutErr(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.NoError(t, timeoutErr(r, nil))
+	assert.Equal(t, dl.ErrNotFound, timeoutErr(r, dl.ErrNotFound), "expected the error of a request without timeout to be kept")
+
+	r, cancel := withTimeout(r, time.Nanosecond)
+	defer cancel()
+	<-r.Context().Done()
+	err := timeoutErr(r, context.DeadlineExceeded)
+	assert.ErrorIs(t, err, ErrEndpointTimeout)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, http.StatusServiceUnavailable, NewHTTPErrResp(err).StatusCode)
+
+	r, cancel = withTimeout(httptest.NewRequest(http.MethodGet, "/", nil), 0)
+	defer cancel()
+	_, ok := r.Context().Deadline()
+	assert.False(t, ok, "expected a timeout of 0 to be disabled")
+}
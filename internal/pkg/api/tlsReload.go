@@ -0,0 +1,144 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"maps"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/elastic-agent-libs/transport/tlscommon"
+	"github.com/rs/zerolog"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+)
+
+// defaultTLSReloadInterval is how often the certificate, key, and CA files are checked for changes.
+const defaultTLSReloadInterval = 30 * time.Second
+
+// fileStat is the state of a file used to detect that it has been replaced or rewritten.
+type fileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+// tlsReloader serves the TLS configuration of the server and rebuilds it when the certificate, key,
+// or CA files change on disk. New handshakes use the rebuilt configuration, established connections
+// keep the configuration they were negotiated with.
+type tlsReloader struct {
+	cfg  *tlscommon.ServerConfig
+	host string
+	pki  bool
+
+	tlsCfg atomic.Pointer[tls.Config]
+	stats  map[string]fileStat
+}
+
+func newTLSReloader(cfg *tlscommon.ServerConfig, host string, authMode string) (*tlsReloader, error) {
+	r := &tlsReloader{
+		cfg:  cfg,
+		host: host,
+		pki:  authMode == config.AuthModePKI,
+	}
+	r.stats = r.statFiles()
+	tlsCfg, err := r.build()
+	if err != nil {
+		return nil, err
+	}
+	r.tlsCfg.Store(tlsCfg)
+	return r, nil
+}
+
+// ServerConfig returns the configuration to pass to the listener, it picks the current configuration on each handshake.
+func (r *tlsReloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// Must enable http/2 in the configuration explicitly.
+		// (see https://golang.org/pkg/net/http/#Server.Serve)
+		NextProtos: []string{"h2", "http/1.1"},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.tlsCfg.Load(), nil
+		},
+	}
+}
+
+func (r *tlsReloader) build() (*tls.Config, error) {
+	commonTLSCfg, err := tlscommon.LoadTLSServerConfig(r.cfg)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg := commonTLSCfg.BuildServerConfig(r.host)
+	tlsCfg.NextProtos = []string{"h2", "http/1.1"}
+
+	// Client certificates are verified when the agent is authenticated.
+	if r.pki && tlsCfg.ClientAuth == tls.NoClientCert {
+		tlsCfg.ClientAuth = tls.RequestClientCert
+	}
+	return tlsCfg, nil
+}
+
+// files returns the certificate, key, and CA settings; the settings that hold inline PEM content are not watched.
+func (r *tlsReloader) files() []string {
+	files := make([]string, 0, len(r.cfg.CAs)+2)
+	files = append(files, r.cfg.Certificate.Certificate, r.cfg.Certificate.Key)
+	return append(files, r.cfg.CAs...)
+}
+
+func (r *tlsReloader) statFiles() map[string]fileStat {
+	stats := make(map[string]fileStat)
+	for _, path := range r.files() {
+		if path == "" {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		stats[path] = fileStat{modTime: fi.ModTime(), size: fi.Size()}
+	}
+	return stats
+}
+
+// Run checks the files for changes at each interval until the context is cancelled.
+func (r *tlsReloader) Run(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			r.reload(ctx)
+		}
+	}
+}
+
+// reload rebuilds the TLS configuration if any of the files changed.
+// If the new files can not be loaded the current configuration is kept.
+func (r *tlsReloader) reload(ctx context.Context) {
+	stats := r.statFiles()
+	if maps.EqualFunc(stats, r.stats, fileStat.equal) {
+		return
+	}
+	// Record the state even if loading fails so a broken file is reported once, and loaded again once it is fixed.
+	r.stats = stats
+
+	tlsCfg, err := r.build()
+	if err != nil {
+		cntTLSReloadErrors.Inc()
+		zerolog.Ctx(ctx).Error().Err(err).Msg("Unable to reload TLS configuration, keeping the current certificates")
+		return
+	}
+	r.tlsCfg.Store(tlsCfg)
+	cntTLSReloads.Inc()
+	zerolog.Ctx(ctx).Info().Msg("TLS configuration reloaded")
+}
+
+func (s fileStat) equal(other fileStat) bool {
+	return s.modTime.Equal(other.modTime) && s.size == other.size
+}
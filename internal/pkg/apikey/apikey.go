@@ -20,7 +20,8 @@ import (
 )
 
 const (
-	authPrefix = "ApiKey "
+	authPrefix   = "ApiKey "
+	bearerPrefix = "Bearer "
 )
 
 var (
@@ -147,3 +148,20 @@ func ExtractAPIKey(r *http.Request) (*APIKey, error) {
 	apiKeyStr = strings.TrimSpace(apiKeyStr)
 	return NewAPIKeyFromToken(apiKeyStr)
 }
+
+// ExtractServiceToken gathers the service account token associated with the request.
+func ExtractServiceToken(r *http.Request) (string, error) {
+	s, ok := r.Header[AuthKey]
+	if !ok {
+		return "", ErrNoAuthHeader
+	}
+	if len(s) != 1 || !strings.HasPrefix(s[0], bearerPrefix) {
+		return "", ErrMalformedHeader
+	}
+
+	token := strings.TrimSpace(s[0][len(bearerPrefix):])
+	if token == "" {
+		return "", ErrMalformedToken
+	}
+	return token, nil
+}
@@ -34,17 +34,25 @@ type SecurityInfo struct {
 // Authenticate will return the SecurityInfo associated with the APIKey (retrieved from Elasticsearch).
 // Note: Prefer the bulk wrapper on this API
 func (k APIKey) Authenticate(ctx context.Context, es *elasticsearch.Client) (*SecurityInfo, error) {
-
 	token := fmt.Sprintf("%s%s", authPrefix, k.Token())
+	return authenticate(ctx, es, token, "apikey auth", k.ID)
+}
+
+// AuthenticateServiceToken will return the SecurityInfo associated with the service account token (retrieved from Elasticsearch).
+// Note: Prefer the bulk wrapper on this API
+func AuthenticateServiceToken(ctx context.Context, es *elasticsearch.Client, token string) (*SecurityInfo, error) {
+	return authenticate(ctx, es, bearerPrefix+token, "service token auth", "")
+}
 
+func authenticate(ctx context.Context, es *elasticsearch.Client, header, op, id string) (*SecurityInfo, error) {
 	req := esapi.SecurityAuthenticateRequest{
-		Header: map[string][]string{AuthKey: []string{token}},
+		Header: map[string][]string{AuthKey: []string{header}},
 	}
 
 	res, err := req.Do(ctx, es)
 
 	if err != nil {
-		return nil, fmt.Errorf("apikey auth request %s: %w", k.ID, err)
+		return nil, fmt.Errorf("%s request %s: %w", op, id, err)
 	}
 
 	if res.Body != nil {
@@ -56,13 +64,13 @@ func (k APIKey) Authenticate(ctx context.Context, es *elasticsearch.Client) (*Se
 		if res.StatusCode == 429 {
 			returnError = ErrElasticsearchAuthLimit
 		}
-		return nil, fmt.Errorf("%w: %w", returnError, fmt.Errorf("apikey auth response %s: %s", k.ID, res.String()))
+		return nil, fmt.Errorf("%w: %w", returnError, fmt.Errorf("%s response %s: %s", op, id, res.String()))
 	}
 
 	var info SecurityInfo
 	decoder := json.NewDecoder(res.Body)
 	if err := decoder.Decode(&info); err != nil {
-		return nil, fmt.Errorf("apikey auth parse %s: %w", k.ID, err)
+		return nil, fmt.Errorf("%s parse %s: %w", op, id, err)
 	}
 
 	return &info, nil
@@ -7,12 +7,15 @@ package apikey
 import (
 	"context"
 	"encoding/base64"
+	"io"
 	"net/http"
+	"strings"
 	"testing"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/testing/esutil"
 	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const (
@@ -44,3 +47,28 @@ func TestAuth401(t *testing.T) {
 
 	assert.Equal(t, "unauthorized: apikey auth response  foo: [401 Unauthorized] ", err.Error())
 }
+
+func TestAuthServiceToken(t *testing.T) {
+	mockES, mockTransport := esutil.MockESClient(t)
+	mockTransport.RoundTripFn = func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get(AuthKey) != "Bearer test-token" {
+			return &http.Response{StatusCode: http.StatusUnauthorized}, nil
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"X-Elastic-Product": []string{"Elasticsearch"},
+				"Content-Type":      []string{"application/json"},
+			},
+			Body: io.NopCloser(strings.NewReader(`{"username":"elastic/fleet-server","enabled":true,"authentication_realm":{"name":"_service_account","type":"_service_account"}}`)),
+		}, nil
+	}
+
+	info, err := AuthenticateServiceToken(context.Background(), mockES, "test-token")
+	require.NoError(t, err)
+	assert.Equal(t, "elastic/fleet-server", info.UserName)
+	assert.Equal(t, "_service_account", info.AuthRealm["type"])
+
+	_, err = AuthenticateServiceToken(context.Background(), mockES, "other-token")
+	assert.ErrorIs(t, err, ErrUnauthorized)
+}
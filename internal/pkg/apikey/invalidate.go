@@ -10,12 +10,43 @@ import (
 	"encoding/json"
 	"fmt"
 
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger/audit"
 	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/elastic/go-elasticsearch/v8/esapi"
 )
 
 // Invalidate invalidates the provided API keys by ID.
 func Invalidate(ctx context.Context, client *elasticsearch.Client, ids ...string) error {
+	failed, err := invalidate(ctx, client, ids...)
+	if err != nil {
+		failed = ids
+	}
+	auditInvalidate(ctx, ids, failed)
+	return err
+}
+
+// auditInvalidate writes an audit event for the invalidation of each of the ids.
+func auditInvalidate(ctx context.Context, ids, failed []string) {
+	failures := make(map[string]struct{}, len(failed))
+	for _, id := range failed {
+		failures[id] = struct{}{}
+	}
+	for _, id := range ids {
+		outcome := audit.OutcomeSuccess
+		if _, ok := failures[id]; ok {
+			outcome = audit.OutcomeFailure
+		}
+		audit.Log(ctx, audit.Event{
+			Action:   audit.ActionAPIKeyInvalidate,
+			Outcome:  outcome,
+			APIKeyID: id,
+		})
+	}
+}
+
+// invalidate invalidates the provided API keys by ID and returns the ids that could not be invalidated
+// if Elasticsearch reports a partial failure.
+func invalidate(ctx context.Context, tr esapi.Transport, ids ...string) ([]string, error) {
 
 	payload := struct {
 		IDs   []string `json:"ids,omitempty"`
@@ -27,25 +58,47 @@ func Invalidate(ctx context.Context, client *elasticsearch.Client, ids ...string
 
 	body, err := json.Marshal(&payload)
 	if err != nil {
-		return fmt.Errorf("InvalidateAPIKey: %w", err)
+		return nil, fmt.Errorf("InvalidateAPIKey: %w", err)
 	}
 
-	opts := []func(*esapi.SecurityInvalidateAPIKeyRequest){
-		client.Security.InvalidateAPIKey.WithContext(ctx),
+	req := esapi.SecurityInvalidateAPIKeyRequest{
+		Body: bytes.NewReader(body),
 	}
-
-	res, err := client.Security.InvalidateAPIKey(
-		bytes.NewReader(body),
-		opts...,
-	)
+	res, err := req.Do(ctx, tr)
 	if err != nil {
-		return fmt.Errorf("InvalidateAPIKey: %w", err)
+		return nil, fmt.Errorf("InvalidateAPIKey: %w", err)
 	}
 	defer res.Body.Close()
 
 	if res.IsError() {
-		return fmt.Errorf("fail InvalidateAPIKey: %s", res.String())
+		return nil, fmt.Errorf("fail InvalidateAPIKey: %s", res.String())
+	}
+
+	var resp struct {
+		Invalidated           []string `json:"invalidated_api_keys"`
+		PreviouslyInvalidated []string `json:"previously_invalidated_api_keys"`
+		ErrorCount            int      `json:"error_count"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("could not decode elasticsearch InvalidateAPIKeyResponse: %w", err)
+	}
+	if resp.ErrorCount == 0 {
+		return nil, nil
 	}
 
-	return nil
+	// The error details do not reference the keys, every key that was not reported as invalidated failed.
+	done := make(map[string]struct{}, len(resp.Invalidated)+len(resp.PreviouslyInvalidated))
+	for _, id := range resp.Invalidated {
+		done[id] = struct{}{}
+	}
+	for _, id := range resp.PreviouslyInvalidated {
+		done[id] = struct{}{}
+	}
+	var failed []string
+	for _, id := range ids {
+		if _, ok := done[id]; !ok {
+			failed = append(failed, id)
+		}
+	}
+	return failed, nil
 }
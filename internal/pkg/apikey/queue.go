@@ -0,0 +1,173 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package apikey
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultInvalidateInterval    = time.Second
+	defaultInvalidateBatchSize   = 1000
+	defaultInvalidateMaxAttempts = 3
+
+	// invalidateDrainTimeout is how long the pending keys may take to be invalidated when the queue stops.
+	invalidateDrainTimeout = 10 * time.Second
+)
+
+// InvalidateQueue coalesces API key ids and invalidates them in batches.
+// It avoids a security API request per key when many agents retire their keys at once,
+// such as when a policy change forces a key rotation.
+type InvalidateQueue struct {
+	tr          esapi.Transport
+	interval    time.Duration
+	batchSize   int
+	maxAttempts int
+
+	mu       sync.Mutex
+	pending  []string
+	attempts map[string]int
+	fullCh   chan struct{}
+}
+
+// InvalidateQueueOpt is an option for the InvalidateQueue.
+type InvalidateQueueOpt func(*InvalidateQueue)
+
+// WithInvalidateInterval sets how often the queued keys are invalidated.
+func WithInvalidateInterval(d time.Duration) InvalidateQueueOpt {
+	return func(q *InvalidateQueue) {
+		q.interval = d
+	}
+}
+
+// WithInvalidateBatchSize sets the maximum number of keys invalidated by a single request.
+func WithInvalidateBatchSize(n int) InvalidateQueueOpt {
+	return func(q *InvalidateQueue) {
+		q.batchSize = n
+	}
+}
+
+// WithInvalidateMaxAttempts sets how many times the invalidation of a key is attempted before it is dropped.
+func WithInvalidateMaxAttempts(n int) InvalidateQueueOpt {
+	return func(q *InvalidateQueue) {
+		q.maxAttempts = n
+	}
+}
+
+// NewInvalidateQueue creates a queue that invalidates keys through the transport once Run is called.
+func NewInvalidateQueue(tr esapi.Transport, opts ...InvalidateQueueOpt) *InvalidateQueue {
+	q := &InvalidateQueue{
+		tr:          tr,
+		interval:    defaultInvalidateInterval,
+		batchSize:   defaultInvalidateBatchSize,
+		maxAttempts: defaultInvalidateMaxAttempts,
+		attempts:    make(map[string]int),
+		fullCh:      make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(q)
+	}
+	return q
+}
+
+// Enqueue adds the keys to the queue without waiting for them to be invalidated.
+func (q *InvalidateQueue) Enqueue(ids ...string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, id := range ids {
+		if _, ok := q.attempts[id]; ok || id == "" {
+			continue
+		}
+		q.attempts[id] = 0
+		q.pending = append(q.pending, id)
+	}
+	if len(q.pending) >= q.batchSize {
+		select {
+		case q.fullCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run invalidates the queued keys every interval, or as soon as a full batch is queued, until the context is cancelled.
+// Keys still pending when the context is cancelled are invalidated before Run returns.
+func (q *InvalidateQueue) Run(ctx context.Context) error {
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			q.flush(ctx)
+		case <-q.fullCh:
+			q.flush(ctx)
+			ticker.Reset(q.interval)
+		case <-ctx.Done():
+			dCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), invalidateDrainTimeout)
+			q.flush(dCtx)
+			cancel()
+			return ctx.Err()
+		}
+	}
+}
+
+// flush invalidates the pending keys in batches.
+// Keys that failed to be invalidated are queued again until they reach the max number of attempts.
+func (q *InvalidateQueue) flush(ctx context.Context) {
+	q.mu.Lock()
+	ids := q.pending
+	q.pending = nil
+	q.mu.Unlock()
+
+	for len(ids) > 0 {
+		n := min(len(ids), q.batchSize)
+		batch := ids[:n]
+		ids = ids[n:]
+
+		failed, err := invalidate(ctx, q.tr, batch...)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Int("count", len(batch)).Msg("Failed to invalidate API keys")
+			failed = batch
+		}
+		q.done(ctx, batch, failed)
+	}
+}
+
+// done removes the invalidated keys from the queue and queues the failed ones again.
+func (q *InvalidateQueue) done(ctx context.Context, batch, failed []string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	retry := make(map[string]struct{}, len(failed))
+	for _, id := range failed {
+		retry[id] = struct{}{}
+	}
+	var invalidated, dropped []string
+	for _, id := range batch {
+		if _, ok := retry[id]; !ok {
+			delete(q.attempts, id)
+			invalidated = append(invalidated, id)
+			continue
+		}
+		q.attempts[id]++
+		if q.attempts[id] >= q.maxAttempts {
+			delete(q.attempts, id)
+			dropped = append(dropped, id)
+			continue
+		}
+		q.pending = append(q.pending, id)
+	}
+	// Keys queued again are only audited once they are invalidated or dropped.
+	auditInvalidate(ctx, invalidated, nil)
+	auditInvalidate(ctx, dropped, dropped)
+	if len(dropped) > 0 {
+		zerolog.Ctx(ctx).Error().Strs("ids", dropped).Int("attempts", q.maxAttempts).Msg("Giving up on invalidating API keys, API keys will be orphaned")
+	}
+}
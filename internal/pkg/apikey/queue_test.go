@@ -0,0 +1,173 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package apikey
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// invalidateTransport is a mock ES transport that records the ids of invalidate requests.
+// fail returns the ids of a request that are reported as failed.
+type invalidateTransport struct {
+	mu       sync.Mutex
+	requests [][]string
+	fail     func(ids []string) []string
+}
+
+func (tr *invalidateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var payload struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+		return nil, err
+	}
+
+	tr.mu.Lock()
+	tr.requests = append(tr.requests, payload.IDs)
+	tr.mu.Unlock()
+
+	var failed []string
+	if tr.fail != nil {
+		failed = tr.fail(payload.IDs)
+	}
+	resp := struct {
+		Invalidated []string `json:"invalidated_api_keys"`
+		ErrorCount  int      `json:"error_count"`
+	}{Invalidated: []string{}, ErrorCount: len(failed)}
+	for _, id := range payload.IDs {
+		if !contains(failed, id) {
+			resp.Invalidated = append(resp.Invalidated, id)
+		}
+	}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(string(body))),
+		Header: http.Header{
+			"X-Elastic-Product": []string{"Elasticsearch"},
+			"Content-Type":      []string{"application/json"},
+		},
+	}, nil
+}
+
+func (tr *invalidateTransport) sent() [][]string {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return append([][]string(nil), tr.requests...)
+}
+
+func contains(ids []string, id string) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func newInvalidateQueue(t *testing.T, tr *invalidateTransport, opts ...InvalidateQueueOpt) *InvalidateQueue {
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Transport: tr})
+	require.NoError(t, err)
+	return NewInvalidateQueue(client, opts...)
+}
+
+func TestInvalidateQueueBatches(t *testing.T) {
+	tr := &invalidateTransport{}
+	q := newInvalidateQueue(t, tr, WithInvalidateBatchSize(3))
+
+	q.Enqueue("1", "2", "3", "4")
+	q.Enqueue("4", "5", "6", "7", "")
+	q.flush(context.Background())
+
+	assert.Equal(t, [][]string{{"1", "2", "3"}, {"4", "5", "6"}, {"7"}}, tr.sent())
+	assert.Empty(t, q.pending)
+	assert.Empty(t, q.attempts)
+
+	// nothing is sent once the queue is empty
+	q.flush(context.Background())
+	assert.Len(t, tr.sent(), 3)
+}
+
+func TestInvalidateQueueRetry(t *testing.T) {
+	t.Run("partial failure", func(t *testing.T) {
+		attempts := 0
+		tr := &invalidateTransport{fail: func(ids []string) []string {
+			attempts++
+			if attempts == 1 {
+				return []string{"2"}
+			}
+			return nil
+		}}
+		q := newInvalidateQueue(t, tr)
+
+		q.Enqueue("1", "2", "3")
+		q.flush(context.Background())
+		assert.Equal(t, []string{"2"}, q.pending)
+
+		q.flush(context.Background())
+		assert.Equal(t, [][]string{{"1", "2", "3"}, {"2"}}, tr.sent())
+		assert.Empty(t, q.pending)
+		assert.Empty(t, q.attempts)
+	})
+
+	t.Run("max attempts", func(t *testing.T) {
+		tr := &invalidateTransport{fail: func(ids []string) []string {
+			return []string{"2"}
+		}}
+		q := newInvalidateQueue(t, tr, WithInvalidateMaxAttempts(2))
+
+		q.Enqueue("1", "2")
+		q.flush(context.Background())
+		q.flush(context.Background())
+		q.flush(context.Background())
+
+		assert.Equal(t, [][]string{{"1", "2"}, {"2"}}, tr.sent())
+		assert.Empty(t, q.pending)
+		assert.Empty(t, q.attempts)
+	})
+}
+
+func TestInvalidateQueueRun(t *testing.T) {
+	t.Run("flush on full batch", func(t *testing.T) {
+		tr := &invalidateTransport{}
+		q := newInvalidateQueue(t, tr, WithInvalidateInterval(time.Hour), WithInvalidateBatchSize(2))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go q.Run(ctx) //nolint:errcheck // error is always the context error
+
+		q.Enqueue("1", "2")
+		require.Eventually(t, func() bool {
+			return len(tr.sent()) == 1
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("drain on stop", func(t *testing.T) {
+		tr := &invalidateTransport{}
+		q := newInvalidateQueue(t, tr, WithInvalidateInterval(time.Hour))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		q.Enqueue("1")
+		cancel()
+		require.ErrorIs(t, q.Run(ctx), context.Canceled)
+		assert.Equal(t, [][]string{{"1"}}, tr.sent())
+	})
+}
@@ -0,0 +1,61 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package bulk
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sort"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/rs/zerolog"
+)
+
+// refreshAliases resolves the indices again before the items that failed because their index was not found or
+// closed are retried. The resolved indices are logged, so that a rollover or a migration of a fleet index while
+// items were in flight can be told apart from a missing index.
+//
+// A failure to resolve the indices is only logged, the items are retried anyway.
+func (b *Bulker) refreshAliases(ctx context.Context, indices []string) {
+	aliasRefreshes.Inc()
+	log := zerolog.Ctx(ctx)
+
+	sort.Strings(indices)
+	indices = slices.Compact(indices)
+
+	ignoreUnavailable := true
+	req := esapi.IndicesGetAliasRequest{
+		Index:             indices,
+		IgnoreUnavailable: &ignoreUnavailable,
+	}
+	res, err := req.Do(ctx, b.es)
+	if err != nil {
+		log.Warn().Err(err).Str("mod", kModBulk).Strs("indices", indices).Msg("Fail to refresh the aliases of unavailable indices")
+		return
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		log.Warn().Err(parseError(res, log)).Str("mod", kModBulk).Strs("indices", indices).Msg("Fail to refresh the aliases of unavailable indices")
+		return
+	}
+
+	// The response has the concrete indices, with the aliases that point to them.
+	var resolved map[string]struct {
+		Aliases map[string]json.RawMessage `json:"aliases"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&resolved); err != nil {
+		log.Warn().Err(err).Str("mod", kModBulk).Strs("indices", indices).Msg("Fail to refresh the aliases of unavailable indices")
+		return
+	}
+	for index, v := range resolved {
+		aliases := make([]string, 0, len(v.Aliases))
+		for alias := range v.Aliases {
+			aliases = append(aliases, alias)
+		}
+		sort.Strings(aliases)
+		log.Info().Str("mod", kModBulk).Str("index", index).Strs("aliases", aliases).Msg("Refreshed the aliases of unavailable indices, retrying bulk items")
+	}
+}
@@ -19,9 +19,11 @@ type bulkT struct {
 	action   actionT    // requested actions
 	flags    flagsT     // execution flags
 	idx      int32      // idx of originating request, used in mulitOp
+	index    string     // index or alias targeted by a bulk action
 	ch       chan respT // response channel, caller is waiting synchronously
 	buf      Buf        // json payload to be sent to elastic
 	next     *bulkT     // pointer to next bulkT, used for fast internal queueing
+	held     int        // pending bytes held until the block is flushed
 	spanLink *apm.SpanLink
 }
 
@@ -29,6 +31,8 @@ type flagsT int8
 
 const (
 	flagRefresh flagsT = 1 << iota
+	flagLowPriority
+	flagRefreshWaitFor
 )
 
 func (ft flagsT) Has(f flagsT) bool {
@@ -71,8 +75,10 @@ func (blk *bulkT) reset() {
 	blk.action = 0
 	blk.flags = 0
 	blk.idx = 0
+	blk.index = ""
 	blk.buf.Reset()
 	blk.next = nil
+	blk.held = 0
 }
 
 type respT struct {
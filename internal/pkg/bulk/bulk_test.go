@@ -12,15 +12,21 @@ import (
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/apikey"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
 	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.elastic.co/apm/v2"
 )
 
 // TODO:
-// WithREfresh() options
 // Delete not found?
 
 type mockBulkTransport struct {
@@ -244,6 +250,20 @@ func TestCancelCtx(t *testing.T) {
 					t.Error("Expected empty result on context cancel:", res)
 				}
 
+				if !errors.Is(err, context.Canceled) {
+					t.Error("Expected context cancel err: ", err)
+				}
+			},
+		},
+		{
+			"mread",
+			func(t *testing.T, ctx context.Context) {
+				res, err := bulker.MRead(ctx, "testidx", []string{"11"})
+
+				if res != nil {
+					t.Error("Expected empty result on context cancel:", res)
+				}
+
 				if !errors.Is(err, context.Canceled) {
 					t.Error("Expected context cancel err: ", err)
 				}
@@ -396,3 +416,193 @@ func BenchmarkMockBulk(b *testing.B) {
 		b.Run(strconv.Itoa(n), bindFunc(n))
 	}
 }
+
+type traceTransport struct {
+	mu     sync.Mutex
+	traces []apm.TraceContext
+}
+
+func (m *traceTransport) Perform(req *http.Request) (*http.Response, error) {
+	if tc, ok := logger.TraceContextFromContext(req.Context()); ok {
+		m.mu.Lock()
+		m.traces = append(m.traces, tc)
+		m.mu.Unlock()
+	}
+	return (&mockBulkTransport{}).Perform(req)
+}
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestFlushTraceContext(t *testing.T) {
+	transport := &traceTransport{}
+	bulker := NewBulker(transport, nil, WithFlushInterval(time.Millisecond))
+
+	var logs lockedBuffer
+	ctx, cancel := context.WithCancel(zerolog.New(&logs).Level(zerolog.DebugLevel).WithContext(context.Background()))
+	defer cancel()
+	go func() {
+		_ = bulker.Run(ctx)
+	}()
+
+	reqTrace := logger.NewTraceContext()
+	_, err := bulker.Create(logger.ContextWithTraceContext(ctx, reqTrace), "testidx", "", []byte(`{"hey":"now"}`))
+	require.NoError(t, err)
+
+	transport.mu.Lock()
+	require.Len(t, transport.traces, 1)
+	flushTrace := transport.traces[0]
+	transport.mu.Unlock()
+	assert.NotEqual(t, reqTrace.Trace, flushTrace.Trace, "expected the flush to have its own trace")
+
+	// The flush trace is logged with the trace of the request it served.
+	var found bool
+	for _, line := range strings.Split(logs.String(), "\n") {
+		var entry struct {
+			Message string   `json:"message"`
+			TraceID string   `json:"trace.id"`
+			Links   []string `json:"trace.links"`
+		}
+		if line == "" || json.Unmarshal([]byte(line), &entry) != nil || entry.Message != "flushQueue trace" {
+			continue
+		}
+		found = true
+		assert.Equal(t, flushTrace.Trace.String(), entry.TraceID)
+		assert.Equal(t, []string{reqTrace.Trace.String()}, entry.Links)
+	}
+	assert.True(t, found, "expected the flush trace to be logged")
+}
+
+// slowTransport answers the bulk requests after a delay.
+type slowTransport struct {
+	delay time.Duration
+}
+
+func (m *slowTransport) Perform(req *http.Request) (*http.Response, error) {
+	time.Sleep(m.delay)
+	return (&mockBulkTransport{}).Perform(req)
+}
+
+func TestRequestTimingES(t *testing.T) {
+	bulker := NewBulker(&slowTransport{delay: 20 * time.Millisecond}, nil, WithFlushInterval(time.Millisecond))
+
+	ctx, cancel := context.WithCancel(testlog.SetLogger(t).WithContext(context.Background()))
+	defer cancel()
+	go func() {
+		_ = bulker.Run(ctx)
+	}()
+
+	timing := &logger.RequestTiming{}
+	reqCtx := logger.ContextWithRequestTiming(ctx, timing)
+
+	_, err := bulker.Create(reqCtx, "test", "a", []byte(`{}`))
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, timing.ES(), 20*time.Millisecond)
+
+	_, err = bulker.MUpdate(reqCtx, []MultiOp{{Index: "test", ID: "a", Body: []byte(`{"doc":{}}`)}})
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, timing.ES(), 40*time.Millisecond)
+	assert.Zero(t, timing.Wait())
+
+	// Operations without a request timing are not tracked.
+	es := timing.ES()
+	_, err = bulker.Create(ctx, "test", "b", []byte(`{}`))
+	require.NoError(t, err)
+	assert.Equal(t, es, timing.ES())
+}
+
+func TestLowPriorityQueue(t *testing.T) {
+	bulker := NewBulker(&mockBulkTransport{}, nil, WithFlushInterval(time.Hour), WithFlushThresholdCount(1))
+
+	ctx, cancel := context.WithCancel(testlog.SetLogger(t).WithContext(context.Background()))
+	defer cancel()
+	go func() {
+		_ = bulker.Run(ctx)
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := bulker.Create(ctx, "test", "low", []byte(`{}`), WithLowPriority())
+		done <- err
+	}()
+
+	// The low priority item does not reach the count threshold by itself.
+	select {
+	case err := <-done:
+		t.Fatalf("expected the low priority item to wait for a flush, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// It is flushed with the queue of an item over the threshold.
+	_, err := bulker.Create(ctx, "test", "high", []byte(`{}`))
+	require.NoError(t, err)
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the low priority item to be flushed with the other queues")
+	}
+}
+
+// refreshTransport records the refresh parameter of the bulk requests.
+type refreshTransport struct {
+	mockBulkTransport
+	mut      sync.Mutex
+	refreshs []string
+}
+
+func (m *refreshTransport) Perform(req *http.Request) (*http.Response, error) {
+	m.mut.Lock()
+	m.refreshs = append(m.refreshs, req.URL.Query().Get("refresh"))
+	m.mut.Unlock()
+	return m.mockBulkTransport.Perform(req)
+}
+
+func TestRefreshQueues(t *testing.T) {
+	tests := map[string]struct {
+		opts    []Opt
+		refresh string
+	}{
+		"no refresh": {},
+		"refresh": {
+			opts:    []Opt{WithRefresh()},
+			refresh: "true",
+		},
+		"refresh wait_for": {
+			opts:    []Opt{WithRefreshWaitFor()},
+			refresh: "wait_for",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			transport := &refreshTransport{}
+			bulker := NewBulker(transport, nil, WithFlushThresholdCount(1))
+
+			ctx, cancel := context.WithCancel(testlog.SetLogger(t).WithContext(context.Background()))
+			defer cancel()
+			go func() {
+				_ = bulker.Run(ctx)
+			}()
+
+			_, err := bulker.Create(ctx, "test", "1", []byte(`{}`), test.opts...)
+			require.NoError(t, err)
+			transport.mut.Lock()
+			defer transport.mut.Unlock()
+			assert.Equal(t, []string{test.refresh}, transport.refreshs)
+		})
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -19,6 +20,7 @@ import (
 	"github.com/elastic/fleet-server/v7/internal/pkg/config"
 	"github.com/elastic/fleet-server/v7/internal/pkg/es"
 	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger/errlog"
 	"github.com/elastic/go-ucfg"
 
 	"github.com/elastic/go-elasticsearch/v8"
@@ -61,14 +63,19 @@ type Bulk interface {
 	MIndex(ctx context.Context, ops []MultiOp, opts ...Opt) ([]BulkIndexerResponseItem, error)
 	MUpdate(ctx context.Context, ops []MultiOp, opts ...Opt) ([]BulkIndexerResponseItem, error)
 	MDelete(ctx context.Context, ops []MultiOp, opts ...Opt) ([]BulkIndexerResponseItem, error)
+	MRead(ctx context.Context, index string, ids []string, opts ...Opt) ([]MReadResult, error)
 
 	// APIKey operations
 	APIKeyCreate(ctx context.Context, name, ttl string, roles []byte, meta interface{}) (*APIKey, error)
 	APIKeyRead(ctx context.Context, id string, withOwner bool) (*APIKeyMetadata, error)
 	APIKeyAuth(ctx context.Context, key APIKey) (*SecurityInfo, error)
 	APIKeyInvalidate(ctx context.Context, ids ...string) error
+	APIKeyInvalidateAsync(ids ...string)
 	APIKeyUpdate(ctx context.Context, id, outputPolicyHash string, roles []byte) error
 
+	// ServiceTokenAuth authenticates a service account token
+	ServiceTokenAuth(ctx context.Context, token string) (*SecurityInfo, error)
+
 	// Accessor used to talk to elastic search direcly bypassing bulk engine
 	Client() *elasticsearch.Client
 
@@ -89,6 +96,9 @@ type Bulker struct {
 	opts                  bulkOptT
 	blkPool               sync.Pool
 	apikeyLimit           *semaphore.Weighted
+	apikeyInvalidate      *apikey.InvalidateQueue
+	pending               *pendingBytes
+	secrets               *secretCache
 	tracer                *apm.Tracer
 	remoteOutputConfigMap map[string]map[string]interface{}
 	bulkerMap             map[string]Bulk
@@ -114,17 +124,23 @@ func NewBulker(es esapi.Transport, tracer *apm.Tracer, opts ...BulkOpt) *Bulker
 		return &bulkT{ch: make(chan respT, 1)}
 	}
 
-	return &Bulker{
+	b := &Bulker{
 		opts:                  bopts,
 		es:                    es,
 		ch:                    make(chan *bulkT, bopts.blockQueueSz),
 		blkPool:               sync.Pool{New: poolFunc},
 		apikeyLimit:           semaphore.NewWeighted(int64(bopts.apikeyMaxParallel)),
+		pending:               newPendingBytes(bopts.maxPendingBytes, bopts.maxPendingWait),
+		secrets:               newSecretCache(),
 		tracer:                tracer,
 		remoteOutputConfigMap: make(map[string]map[string]interface{}),
 		// remote ES bulkers
 		bulkerMap: make(map[string]Bulk),
 	}
+	if es != nil {
+		b.apikeyInvalidate = apikey.NewInvalidateQueue(es)
+	}
+	return b
 }
 
 func (b *Bulker) GetBulker(outputName string) Bulk {
@@ -188,6 +204,9 @@ func (b *Bulker) CreateAndGetBulker(ctx context.Context, zlog zerolog.Logger, ou
 		select {
 		case err = <-errCh:
 			zlog.Error().Err(err).Str(logger.PolicyOutputName, outputName).Msg("Bulker error")
+			if !errors.Is(err, context.Canceled) {
+				errlog.Report(errlog.SubsystemBulker, outputName, err, nil)
+			}
 		case <-bulkCtx.Done():
 			zlog.Debug().Str(logger.PolicyOutputName, outputName).Msg("Bulk context done")
 			err = bulkCtx.Err()
@@ -273,14 +292,23 @@ func (b *Bulker) hasChangedAndUpdateRemoteOutputConfig(zlog zerolog.Logger, name
 }
 
 // read secrets one by one as there is no bulk API yet to read them in one request
+// the values are cached, a secret that does not exist fails with ErrSecretNotFound
 func (b *Bulker) ReadSecrets(ctx context.Context, secretIds []string) (map[string]string, error) {
 	result := make(map[string]string)
 	esClient := b.Client()
 	for _, id := range secretIds {
+		if _, ok := result[id]; ok {
+			continue
+		}
+		if val, ok := b.secrets.get(id, time.Now()); ok {
+			result[id] = val
+			continue
+		}
 		val, err := ReadSecret(ctx, esClient, id)
 		if err != nil {
 			return nil, err
 		}
+		b.secrets.set(id, val, time.Now())
 		result[id] = val
 	}
 	return result, nil
@@ -316,8 +344,12 @@ func blkToQueueType(blk *bulkT) queueType {
 	case ActionUpdateAPIKey:
 		queueIdx = kQueueAPIKeyUpdate
 	default:
-		if forceRefresh {
+		if blk.flags.Has(flagLowPriority) {
+			queueIdx = kQueueLowPriorityBulk
+		} else if forceRefresh {
 			queueIdx = kQueueRefreshBulk
+		} else if blk.flags.Has(flagRefreshWaitFor) {
+			queueIdx = kQueueRefreshWaitForBulk
 		}
 	}
 
@@ -345,6 +377,17 @@ func (b *Bulker) Run(ctx context.Context) error {
 
 	var itemCnt int
 	var byteCnt int
+	var lowCnt int // blocks of the low priority queue, they are not counted in the flush thresholds
+
+	invalidateDone := make(chan struct{})
+	if b.apikeyInvalidate != nil {
+		go func() {
+			defer close(invalidateDone)
+			_ = b.apikeyInvalidate.Run(ctx)
+		}()
+	} else {
+		close(invalidateDone)
+	}
 
 	doFlush := func() error {
 
@@ -361,12 +404,14 @@ func (b *Bulker) Run(ctx context.Context) error {
 				q.cnt = 0
 				q.head = nil
 				q.pending = 0
+				q.held = 0
 			}
 		}
 
 		// Reset threshold counters
 		itemCnt = 0
 		byteCnt = 0
+		lowCnt = 0
 
 		return nil
 	}
@@ -387,13 +432,23 @@ func (b *Bulker) Run(ctx context.Context) error {
 			// Update pending count on target queue
 			q.cnt += 1
 			q.pending += blk.buf.Len()
+			q.held += blk.held
+
+			// Low priority blocks wait for the timer or for the flush of the other queues
+			if queueIdx == kQueueLowPriorityBulk {
+				lowCnt += 1
+				if lowCnt == 1 && itemCnt == 0 {
+					timer.Reset(b.opts.flushInterval)
+				}
+				continue
+			}
 
 			// Update threshold counters
 			itemCnt += 1
 			byteCnt += blk.buf.Len()
 
 			// Start timer on first queued item
-			if itemCnt == 1 {
+			if itemCnt == 1 && lowCnt == 0 {
 				timer.Reset(b.opts.flushInterval)
 			}
 
@@ -431,6 +486,9 @@ func (b *Bulker) Run(ctx context.Context) error {
 		}
 	}()
 
+	// wait for the API keys that are still queued to be invalidated
+	<-invalidateDone
+
 	return err
 }
 
@@ -444,6 +502,7 @@ func (b *Bulker) flushQueue(ctx context.Context, w *semaphore.Weighted, queue qu
 		Msg("flushQueue Wait")
 
 	if err := w.Acquire(ctx, 1); err != nil {
+		b.pending.release(queue.held)
 		return err
 	}
 
@@ -464,9 +523,15 @@ func (b *Bulker) flushQueue(ctx context.Context, w *semaphore.Weighted, queue qu
 			trans.Context.SetLabel("queue.pending", queue.pending)
 			ctx = apm.ContextWithTransaction(ctx, trans)
 			defer trans.End()
+		} else {
+			// Without APM the flush gets its own trace, the traces of the requests it serves are logged.
+			tc := logger.NewTraceContext()
+			ctx = logger.ContextWithTraceContext(ctx, tc)
+			logQueueTraces(ctx, tc, queue)
 		}
 
 		defer w.Release(1)
+		defer b.pending.release(queue.held)
 
 		var err error
 		switch queue.ty {
@@ -480,9 +545,17 @@ func (b *Bulker) flushQueue(ctx context.Context, w *semaphore.Weighted, queue qu
 			err = b.flushBulk(ctx, queue)
 		}
 
+		observeFlush(queue, time.Since(start))
+		if b.opts.flushObserver != nil {
+			b.opts.flushObserver(err)
+		}
+
 		if err != nil {
 			failQueue(queue, err)
 			apm.CaptureError(ctx, err).Send()
+			if !errors.Is(err, context.Canceled) {
+				errlog.Report(errlog.SubsystemBulker, queue.Type(), err, map[string]string{"cnt": strconv.Itoa(queue.cnt)})
+			}
 		}
 
 		zerolog.Ctx(ctx).Trace().
@@ -499,11 +572,38 @@ func (b *Bulker) flushQueue(ctx context.Context, w *semaphore.Weighted, queue qu
 	return nil
 }
 
+// logQueueTraces logs the trace ids of the requests queued in a flush with the trace id of the flush,
+// the flush trace id is the one that is propagated to Elasticsearch.
+func logQueueTraces(ctx context.Context, tc apm.TraceContext, queue queueT) {
+	e := zerolog.Ctx(ctx).Debug()
+	if !e.Enabled() {
+		return
+	}
+	seen := make(map[apm.TraceID]struct{})
+	traces := make([]string, 0)
+	for n := queue.head; n != nil; n = n.next {
+		if n.spanLink == nil {
+			continue
+		}
+		if _, ok := seen[n.spanLink.Trace]; ok {
+			continue
+		}
+		seen[n.spanLink.Trace] = struct{}{}
+		traces = append(traces, n.spanLink.Trace.String())
+	}
+	e.Str("mod", kModBulk).
+		Str("queue", queue.Type()).
+		Str(logger.ECSTraceID, tc.Trace.String()).
+		Strs("trace.links", traces).
+		Msg("flushQueue trace")
+}
+
 func failQueue(queue queueT, err error) {
 	for n := queue.head; n != nil; {
 		next := n.next // 'n' is invalid immediately on channel send
 		n.ch <- respT{
 			err: err,
+			idx: n.idx,
 		}
 		n = next
 	}
@@ -523,6 +623,12 @@ func (b *Bulker) newBlk(action actionT, opts optionsT) *bulkT {
 	if opts.Refresh {
 		blk.flags.Set(flagRefresh)
 	}
+	if opts.RefreshWaitFor {
+		blk.flags.Set(flagRefreshWaitFor)
+	}
+	if opts.LowPriority {
+		blk.flags.Set(flagLowPriority)
+	}
 	blk.spanLink = opts.spanLink
 
 	return blk
@@ -565,13 +671,39 @@ func (b *Bulker) validateBody(body []byte) error {
 	return nil
 }
 
+// timeES adds the time until the returned func is called to the Elasticsearch time of the request that ctx belongs to.
+func timeES(ctx context.Context) func() {
+	t := logger.RequestTimingFromContext(ctx)
+	if t == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		t.AddES(time.Since(start))
+	}
+}
+
 func (b *Bulker) dispatch(ctx context.Context, blk *bulkT) respT {
+	defer timeES(ctx)()
 	start := time.Now()
 
+	held, err := b.pending.acquire(ctx, blk.buf.Len())
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().
+			Err(err).
+			Str("mod", kModBulk).
+			Str("action", blk.action.String()).
+			Dur("rtt", time.Since(start)).
+			Msg("Dispatch abort pending bytes")
+		return respT{err: err}
+	}
+	blk.held = held
+
 	// Dispatch to bulk Run loop
 	select {
 	case b.ch <- blk:
 	case <-ctx.Done():
+		b.pending.release(held)
 		zerolog.Ctx(ctx).Error().
 			Err(ctx.Err()).
 			Str("mod", kModBulk).
@@ -26,6 +26,19 @@ func (u UpdateFields) Marshal() ([]byte, error) {
 	return json.Marshal(doc)
 }
 
+// MarshalUpsert returns the body of an update that creates the document with the fields if it does not exist.
+func (u UpdateFields) MarshalUpsert() ([]byte, error) {
+	doc := struct {
+		Doc         map[string]interface{} `json:"doc"`
+		DocAsUpsert bool                   `json:"doc_as_upsert"`
+	}{
+		u,
+		true,
+	}
+
+	return json.Marshal(doc)
+}
+
 // Attempt to interpret the response as an elastic error,
 // otherwise return generic elastic error.
 func parseError(res *esapi.Response, log *zerolog.Logger) error {
@@ -50,7 +63,8 @@ func parseError(res *esapi.Response, log *zerolog.Logger) error {
 			log.Debug().Err(err).Bytes("body", b.Bytes()).Msg("Error content")
 		}
 
-		return err
+		// A proxy or Elasticsearch may answer with an empty or non-JSON body, such as a 413, the status is kept.
+		return es.TranslateError(res.StatusCode, nil)
 	}
 
 	return es.TranslateError(res.StatusCode, e.Err)
@@ -0,0 +1,65 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package bulk
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	flushItems = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "bulk",
+		Name:      "flush_items",
+		Help:      "Number of operations sent by a queue flush.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+	}, []string{"queue"})
+	flushBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "bulk",
+		Name:      "flush_bytes",
+		Help:      "Size of the payload sent by a queue flush.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 8),
+	}, []string{"queue"})
+	flushDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "bulk",
+		Name:      "flush_duration_seconds",
+		Help:      "Duration of a queue flush.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"queue"})
+	pendingBytesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "bulk",
+		Name:      "pending_bytes",
+		Help:      "Bytes of the operations queued or in flight to Elasticsearch, counted when max_pending_bytes is set.",
+	})
+	aliasRefreshes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "bulk",
+		Name:      "alias_refreshes_total",
+		Help:      "Number of times the aliases were resolved again to retry the items of an index that was not found or closed.",
+	})
+)
+
+func init() {
+	// Initialize the series of every queue so they are exported before the first flush.
+	for ty := queueType(0); ty < kNumQueues; ty++ {
+		q := queueT{ty: ty}.Type()
+		flushItems.WithLabelValues(q)
+		flushBytes.WithLabelValues(q)
+		flushDuration.WithLabelValues(q)
+	}
+}
+
+// MetricsCollectors returns the prometheus collectors of the bulk queue flushes.
+func MetricsCollectors() []prometheus.Collector {
+	return []prometheus.Collector{flushItems, flushBytes, flushDuration, pendingBytesGauge, aliasRefreshes}
+}
+
+// observeFlush records the size and duration of a queue flush.
+func observeFlush(queue queueT, d time.Duration) {
+	q := queue.Type()
+	flushItems.WithLabelValues(q).Observe(float64(queue.cnt))
+	flushBytes.WithLabelValues(q).Observe(float64(queue.pending))
+	flushDuration.WithLabelValues(q).Observe(d.Seconds())
+}
@@ -0,0 +1,88 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package bulk
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+)
+
+const defaultMirrorQueueSize = 1024
+
+type mirrorOpT struct {
+	action actionT
+	ops    []MultiOp
+}
+
+// Mirror duplicates selected writes to a secondary output.
+//
+// The writes are queued and sent to the bulker of the secondary output by Run, which has its own
+// queues and retries. Writes are dropped when the queue is full, so the secondary output never
+// blocks or fails the writes to the primary output.
+// All methods of a nil Mirror are no-ops.
+type Mirror struct {
+	bulker Bulk
+	queue  chan mirrorOpT
+}
+
+// NewMirror creates a Mirror that sends the writes to bulker.
+// A queueSize of 0 uses the default size.
+func NewMirror(bulker Bulk, queueSize int) *Mirror {
+	if queueSize <= 0 {
+		queueSize = defaultMirrorQueueSize
+	}
+	return &Mirror{
+		bulker: bulker,
+		queue:  make(chan mirrorOpT, queueSize),
+	}
+}
+
+// MUpdate queues the updates to be sent to the secondary output.
+func (m *Mirror) MUpdate(ctx context.Context, ops []MultiOp) {
+	m.enqueue(ctx, ActionUpdate, ops)
+}
+
+// MCreate queues the documents to be created in the secondary output.
+func (m *Mirror) MCreate(ctx context.Context, ops []MultiOp) {
+	m.enqueue(ctx, ActionCreate, ops)
+}
+
+func (m *Mirror) enqueue(ctx context.Context, action actionT, ops []MultiOp) {
+	if m == nil || len(ops) == 0 {
+		return
+	}
+	select {
+	case m.queue <- mirrorOpT{action: action, ops: ops}:
+	default:
+		zerolog.Ctx(ctx).Warn().Str("mod", kModBulk).Str("action", action.String()).Int("cnt", len(ops)).Msg("Mirror queue is full, dropping writes to the secondary output")
+	}
+}
+
+// Run sends the queued writes to the secondary output until the context is cancelled.
+// Failed writes are logged and dropped.
+func (m *Mirror) Run(ctx context.Context) error {
+	if m == nil {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case op := <-m.queue:
+			var err error
+			switch op.action {
+			case ActionUpdate:
+				_, err = m.bulker.MUpdate(ctx, op.ops)
+			case ActionCreate:
+				_, err = m.bulker.MCreate(ctx, op.ops)
+			}
+			if err != nil {
+				zerolog.Ctx(ctx).Warn().Err(err).Str("mod", kModBulk).Str("action", op.action.String()).Int("cnt", len(op.ops)).Msg("Failed to mirror writes to the secondary output")
+			}
+		}
+	}
+}
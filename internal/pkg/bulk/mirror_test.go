@@ -0,0 +1,152 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package bulk
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+// secondaryTransport stands for the secondary output, it fails the requests or blocks them until release is closed.
+type secondaryTransport struct {
+	requests atomic.Int64
+	fail     bool
+	release  chan struct{}
+}
+
+func (m *secondaryTransport) Perform(req *http.Request) (*http.Response, error) {
+	m.requests.Add(1)
+	if m.release != nil {
+		select {
+		case <-m.release:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	if m.fail {
+		_, _ = io.Copy(io.Discard, req.Body)
+		return nil, errors.New("secondary output is down")
+	}
+	return (&mockBulkTransport{}).Perform(req)
+}
+
+func runTestBulker(t *testing.T, transport esapi.Transport) *Bulker {
+	t.Helper()
+	bulker := NewBulker(transport, nil, WithFlushInterval(time.Millisecond))
+
+	ctx, cancel := context.WithCancel(testlog.SetLogger(t).WithContext(context.Background()))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := bulker.Run(ctx); !errors.Is(err, context.Canceled) {
+			t.Error(err)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	return bulker
+}
+
+func runTestMirror(t *testing.T, bulker Bulk, queueSize int) *Mirror {
+	t.Helper()
+	mirror := NewMirror(bulker, queueSize)
+
+	ctx, cancel := context.WithCancel(testlog.SetLogger(t).WithContext(context.Background()))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = mirror.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return mirror
+}
+
+func TestMirror(t *testing.T) {
+	ops := []MultiOp{{Index: "test", ID: "1", Body: []byte(`{"doc":{}}`)}}
+
+	t.Run("mirrored", func(t *testing.T) {
+		ctx := testlog.SetLogger(t).WithContext(context.Background())
+		secondary := &secondaryTransport{}
+		mirror := runTestMirror(t, runTestBulker(t, secondary), 0)
+
+		mirror.MUpdate(ctx, ops)
+		mirror.MCreate(ctx, ops)
+		require.Eventually(t, func() bool {
+			return secondary.requests.Load() == 2
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("secondary failures", func(t *testing.T) {
+		ctx := testlog.SetLogger(t).WithContext(context.Background())
+		primary := runTestBulker(t, &mockBulkTransport{})
+		secondary := &secondaryTransport{fail: true}
+		mirror := runTestMirror(t, runTestBulker(t, secondary), 0)
+
+		mirror.MUpdate(ctx, ops)
+		_, err := primary.MUpdate(ctx, ops)
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			return secondary.requests.Load() > 0
+		}, time.Second, time.Millisecond)
+
+		// The mirror keeps running after a failure.
+		n := secondary.requests.Load()
+		mirror.MUpdate(ctx, ops)
+		require.Eventually(t, func() bool {
+			return secondary.requests.Load() > n
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("secondary blocked", func(t *testing.T) {
+		ctx := testlog.SetLogger(t).WithContext(context.Background())
+		primary := runTestBulker(t, &mockBulkTransport{})
+		secondary := &secondaryTransport{release: make(chan struct{})}
+		mirror := runTestMirror(t, runTestBulker(t, secondary), 2)
+		// Released before the bulkers and the mirror are stopped.
+		t.Cleanup(func() { close(secondary.release) })
+
+		// The queue fills up while the secondary output is blocked, the writes are dropped instead of blocking.
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 10; i++ {
+				mirror.MUpdate(ctx, ops)
+			}
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("mirror blocked the caller")
+		}
+
+		_, err := primary.MUpdate(ctx, ops)
+		require.NoError(t, err)
+	})
+
+	t.Run("nil mirror", func(t *testing.T) {
+		var mirror *Mirror
+		assert.NotPanics(t, func() {
+			mirror.MUpdate(context.Background(), ops)
+		})
+	})
+}
@@ -39,6 +39,7 @@ type esAPIKeyBulkUpdateRequest struct {
 func (b *Bulker) APIKeyAuth(ctx context.Context, key APIKey) (*SecurityInfo, error) {
 	span, ctx := apm.StartSpan(ctx, "authAPIKey", "auth")
 	defer span.End()
+	defer timeES(ctx)()
 	if err := b.apikeyLimit.Acquire(ctx, 1); err != nil {
 		return nil, err
 	}
@@ -51,9 +52,21 @@ func (b *Bulker) APIKeyAuth(ctx context.Context, key APIKey) (*SecurityInfo, err
 	return key.Authenticate(ctx, b.Client())
 }
 
+func (b *Bulker) ServiceTokenAuth(ctx context.Context, token string) (*SecurityInfo, error) {
+	span, ctx := apm.StartSpan(ctx, "authServiceToken", "auth")
+	defer span.End()
+	defer timeES(ctx)()
+	if err := b.apikeyLimit.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+	defer b.apikeyLimit.Release(1)
+	return apikey.AuthenticateServiceToken(ctx, b.Client(), token)
+}
+
 func (b *Bulker) APIKeyCreate(ctx context.Context, name, ttl string, roles []byte, meta interface{}) (*APIKey, error) {
 	span, ctx := apm.StartSpan(ctx, "createAPIKey", "auth")
 	defer span.End()
+	defer timeES(ctx)()
 	if err := b.apikeyLimit.Acquire(ctx, 1); err != nil {
 		return nil, err
 	}
@@ -65,6 +78,7 @@ func (b *Bulker) APIKeyCreate(ctx context.Context, name, ttl string, roles []byt
 func (b *Bulker) APIKeyRead(ctx context.Context, id string, withOwner bool) (*APIKeyMetadata, error) {
 	span, ctx := apm.StartSpan(ctx, "readAPIKey", "auth")
 	defer span.End()
+	defer timeES(ctx)()
 	if err := b.apikeyLimit.Acquire(ctx, 1); err != nil {
 		return nil, err
 	}
@@ -76,6 +90,7 @@ func (b *Bulker) APIKeyRead(ctx context.Context, id string, withOwner bool) (*AP
 func (b *Bulker) APIKeyInvalidate(ctx context.Context, ids ...string) error {
 	span, ctx := apm.StartSpan(ctx, "invalidateAPIKey", "auth")
 	defer span.End()
+	defer timeES(ctx)()
 	if err := b.apikeyLimit.Acquire(ctx, 1); err != nil {
 		return err
 	}
@@ -84,6 +99,15 @@ func (b *Bulker) APIKeyInvalidate(ctx context.Context, ids ...string) error {
 	return apikey.Invalidate(ctx, b.Client(), ids...)
 }
 
+// APIKeyInvalidateAsync queues the API keys to be invalidated in batches and returns without waiting.
+func (b *Bulker) APIKeyInvalidateAsync(ids ...string) {
+	if b.apikeyInvalidate == nil {
+		zerolog.Ctx(context.TODO()).Error().Str("mod", kModBulk).Strs("ids", ids).Msg("API keys are not invalidated, the bulker has no elasticsearch transport")
+		return
+	}
+	b.apikeyInvalidate.Enqueue(ids...)
+}
+
 func (b *Bulker) APIKeyUpdate(ctx context.Context, id, outputPolicyHash string, roles []byte) error {
 	span, ctx := apm.StartSpan(ctx, "updateAPIKey", "auth") // NOTE: this is tracked as updateAPIKey/auth instead of update_api_key/bulker to be consistent with other auth actions that don't use a queue.
 	span.Context.SetLabel("api_key_id", id)
@@ -0,0 +1,82 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package bulk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+// invalidateTransport records the ids of the API key invalidation requests.
+type invalidateTransport struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+func (m *invalidateTransport) Perform(req *http.Request) (*http.Response, error) {
+	var body struct {
+		IDs []string `json:"ids"`
+	}
+	if req.Method == http.MethodDelete && req.URL.Path == "/_security/api_key" {
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		m.mu.Lock()
+		m.ids = append(m.ids, body.IDs...)
+		m.mu.Unlock()
+	}
+	resp, err := json.Marshal(map[string]interface{}{"invalidated_api_keys": body.IDs, "error_count": 0})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(resp)),
+	}, nil
+}
+
+func (m *invalidateTransport) invalidated() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.ids...)
+}
+
+func TestAPIKeyInvalidateAsync(t *testing.T) {
+	tr := &invalidateTransport{}
+	bulker := NewBulker(tr, nil)
+
+	ctx, cancel := context.WithCancel(testlog.SetLogger(t).WithContext(context.Background()))
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- bulker.Run(ctx)
+	}()
+
+	// The transport is not an elasticsearch client, the keys are still invalidated through it.
+	bulker.APIKeyInvalidateAsync("key-1", "key-2")
+	assert.Eventually(t, func() bool {
+		return len(tr.invalidated()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, []string{"key-1", "key-2"}, tr.invalidated())
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		require.Fail(t, "bulker did not stop")
+	}
+}
@@ -9,6 +9,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"syscall"
 	"time"
 
 	"github.com/elastic/go-elasticsearch/v8/esapi"
@@ -16,6 +19,7 @@ import (
 	"github.com/rs/zerolog"
 	"go.elastic.co/apm/v2"
 
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
 	"github.com/elastic/fleet-server/v7/internal/pkg/es"
 )
 
@@ -51,12 +55,13 @@ func (b *Bulker) waitBulkAction(ctx context.Context, action actionT, index, id s
 	defer span.End()
 	opt := b.parseOpts(append(opts, withAPMLinkedContext(ctx))...)
 	blk := b.newBlk(action, opt)
+	blk.index = index
 
 	// Serialize request
 	const kSlop = 64
 	blk.buf.Grow(len(body) + kSlop)
 
-	if err := b.writeBulkMeta(&blk.buf, action.String(), index, id, opt.RetryOnConflict); err != nil {
+	if err := b.writeBulkMeta(&blk.buf, action.String(), index, id, &opt); err != nil {
 		return nil, err
 	}
 
@@ -96,7 +101,7 @@ func (b *Bulker) writeMget(buf *Buf, index, id string) error {
 	return nil
 }
 
-func (b *Bulker) writeBulkMeta(buf *Buf, action, index, id, retry string) error {
+func (b *Bulker) writeBulkMeta(buf *Buf, action, index, id string, opt *optionsT) error {
 	if err := b.validateMeta(index, id); err != nil {
 		return err
 	}
@@ -109,9 +114,16 @@ func (b *Bulker) writeBulkMeta(buf *Buf, action, index, id, retry string) error
 		_, _ = buf.WriteString(id)
 		_, _ = buf.WriteString(`",`)
 	}
-	if retry != "" {
+	if opt.RetryOnConflict != "" {
 		_, _ = buf.WriteString(`"retry_on_conflict":`)
-		_, _ = buf.WriteString(retry)
+		_, _ = buf.WriteString(opt.RetryOnConflict)
+		_, _ = buf.WriteString(`,`)
+	}
+	if opt.IfSeqNo != "" {
+		_, _ = buf.WriteString(`"if_seq_no":`)
+		_, _ = buf.WriteString(opt.IfSeqNo)
+		_, _ = buf.WriteString(`,"if_primary_term":`)
+		_, _ = buf.WriteString(opt.IfPrimaryTerm)
 		_, _ = buf.WriteString(`,`)
 	}
 
@@ -166,23 +178,10 @@ func (b *Bulker) calcBulkSz(action, idx, id, retry string, body []byte) int {
 }
 
 func (b *Bulker) flushBulk(ctx context.Context, queue queueT) error {
-	start := time.Now()
-
-	const kRoughEstimatePerItem = 200
-
-	bufSz := queue.cnt * kRoughEstimatePerItem
-	if bufSz < queue.pending {
-		bufSz = queue.pending
-	}
-
-	var buf bytes.Buffer
-	buf.Grow(bufSz)
-
-	queueCnt := 0
+	nodes := make([]*bulkT, 0, queue.cnt)
 	links := []apm.SpanLink{}
 	for n := queue.head; n != nil; n = n.next {
-		buf.Write(n.buf.Bytes())
-		queueCnt += 1
+		nodes = append(nodes, n)
 		if n.spanLink != nil {
 			links = append(links, *n.spanLink)
 		}
@@ -198,19 +197,155 @@ func (b *Bulker) flushBulk(ctx context.Context, queue queueT) error {
 	})
 	defer span.End()
 
+	// WARNING: Once we start pushing items to
+	// the queue, the node pointers are invalid.
+	// Do NOT return a non-nil value once an item was
+	// answered or failQueue up the stack will fail.
+	answered := 0
+	fail := func(pending []*bulkT, err error) error {
+		if answered == 0 {
+			return err
+		}
+		zerolog.Ctx(ctx).Error().Err(err).Str("mod", kModBulk).Int("cnt", len(pending)).Msg("Fail retried bulk items")
+		for _, n := range pending {
+			n.ch <- respT{
+				err: err,
+				idx: n.idx,
+			}
+		}
+		return nil
+	}
+
+	// aliasRetried holds the items already sent again after their index was not found or closed.
+	var aliasRetried map[*bulkT]bool
+	pending := nodes
+	for attempt := 0; ; attempt++ {
+		items, err := b.doFlushBulk(ctx, queue, pending)
+		if err != nil {
+			if !errors.Is(err, errRetryableBulk) || attempt >= b.opts.bulkRetry.MaxRetries {
+				return fail(pending, err)
+			}
+		} else {
+			// Only the items rejected with a retryable status are sent again.
+			// The items that target an index that was not found or closed are sent again once, the alias of the
+			// index may have been moved to a new index while the request was in flight.
+			retry := pending[:0:0]
+			var refresh []string
+			for i, n := range pending {
+				item := items[i].Choose()
+				if item != nil && isRetryableStatus(item.Status) && attempt < b.opts.bulkRetry.MaxRetries {
+					retry = append(retry, n)
+					continue
+				}
+				if item != nil && n.index != "" && !aliasRetried[n] && isIndexUnavailable(item) {
+					if aliasRetried == nil {
+						aliasRetried = make(map[*bulkT]bool)
+					}
+					aliasRetried[n] = true
+					refresh = append(refresh, n.index)
+					retry = append(retry, n)
+					continue
+				}
+				select {
+				case n.ch <- respT{
+					err:  item.deriveError(),
+					idx:  n.idx,
+					data: item,
+				}:
+				default:
+					panic("Unexpected blocked response channel on flushBulk")
+				}
+				answered++
+			}
+			if len(retry) == 0 {
+				return nil
+			}
+			if len(refresh) > 0 {
+				b.refreshAliases(ctx, refresh)
+			}
+			pending = retry
+		}
+
+		wait := retryBackoff(b.opts.bulkRetry, attempt)
+		zerolog.Ctx(ctx).Warn().Err(err).
+			Str("mod", kModBulk).
+			Int("attempt", attempt+1).
+			Int("cnt", len(pending)).
+			Dur("backoff", wait).
+			Msg("Retrying bulk items")
+		select {
+		case <-ctx.Done():
+			return fail(pending, ctx.Err())
+		case <-time.After(wait):
+		}
+	}
+}
+
+// errRetryableBulk marks the bulk request errors that are expected to be transient.
+var errRetryableBulk = errors.New("retryable bulk error")
+
+// isRetryableStatus returns true if the status means that Elasticsearch is overloaded or briefly unavailable.
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+// isIndexUnavailable returns true if the item failed because its index was not found or is closed,
+// as it happens when the alias of the index is moved to a new index by a rollover or a migration.
+func isIndexUnavailable(item *BulkIndexerResponseItem) bool {
+	err := item.deriveError()
+	return errors.Is(err, es.ErrIndexNotFound) || errors.Is(err, es.ErrIndexClosed)
+}
+
+// retryBackoff returns how long to wait before the retry that follows the attempt.
+// The interval doubles with each attempt up to the max interval, with a jitter of up to half the interval.
+func retryBackoff(cfg config.BulkRetry, attempt int) time.Duration {
+	d := cfg.InitInterval << min(attempt, 30)
+	if d <= 0 || d > cfg.MaxInterval {
+		d = cfg.MaxInterval
+	}
+	if half := int64(d / 2); half > 0 {
+		d = d/2 + time.Duration(mrand.Int63n(half)) //nolint:gosec // used to generate a jitter offset value
+	}
+	return d
+}
+
+// doFlushBulk sends the nodes in a single bulk request and returns the response item of each of them.
+func (b *Bulker) doFlushBulk(ctx context.Context, queue queueT, nodes []*bulkT) ([]bulkStubItem, error) {
+	start := time.Now()
+
+	const kRoughEstimatePerItem = 200
+
+	bufSz := len(nodes) * kRoughEstimatePerItem
+	if bufSz < queue.pending {
+		bufSz = queue.pending
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(bufSz)
+
+	for _, n := range nodes {
+		buf.Write(n.buf.Bytes())
+	}
+
 	// Do actual bulk request; defer to the client
 	req := esapi.BulkRequest{
 		Body: bytes.NewReader(buf.Bytes()),
 	}
 
-	if queue.ty == kQueueRefreshBulk {
+	switch queue.ty {
+	case kQueueRefreshBulk:
 		req.Refresh = "true"
+	case kQueueRefreshWaitForBulk:
+		req.Refresh = "wait_for"
 	}
 
 	res, err := req.Do(ctx, b.es)
 	if err != nil {
 		zerolog.Ctx(ctx).Error().Err(err).Str("mod", kModBulk).Msg("Fail BulkRequest req.Do")
-		return err
+		if errors.Is(err, syscall.ECONNRESET) {
+			err = fmt.Errorf("%w: %w", errRetryableBulk, err)
+		}
+		return nil, err
 	}
 
 	if res.Body != nil {
@@ -219,7 +354,11 @@ func (b *Bulker) flushBulk(ctx context.Context, queue queueT) error {
 
 	if res.IsError() {
 		zerolog.Ctx(ctx).Error().Str("mod", kModBulk).Str("error.message", res.String()).Msg("Fail BulkRequest result")
-		return parseError(res, zerolog.Ctx(ctx))
+		err := parseError(res, zerolog.Ctx(ctx))
+		if isRetryableStatus(res.StatusCode) {
+			err = fmt.Errorf("%w: %w", errRetryableBulk, err)
+		}
+		return nil, err
 	}
 
 	// Reuse buffer
@@ -231,11 +370,11 @@ func (b *Bulker) flushBulk(ctx context.Context, queue queueT) error {
 			Err(err).
 			Str("mod", kModBulk).
 			Msg("Response error")
-		return err
+		return nil, err
 	}
 
 	var blk bulkIndexerResponse
-	blk.Items = make([]bulkStubItem, 0, queueCnt)
+	blk.Items = make([]bulkStubItem, 0, len(nodes))
 
 	// TODO: We're loosing information abut the errors, we should check a way
 	// to return the full error ES returns
@@ -243,7 +382,7 @@ func (b *Bulker) flushBulk(ctx context.Context, queue queueT) error {
 		zerolog.Ctx(ctx).Error().Err(err).
 			Str("mod", kModBulk).
 			Msg("flushBulk failed, could not unmarshal ES response")
-		return fmt.Errorf("flushBulk failed, could not unmarshal ES response: %w", err)
+		return nil, fmt.Errorf("flushBulk failed, could not unmarshal ES response: %w", err)
 	}
 	if blk.HasErrors {
 		// We lack information to properly correlate this error with what has failed.
@@ -253,7 +392,7 @@ func (b *Bulker) flushBulk(ctx context.Context, queue queueT) error {
 
 	zerolog.Ctx(ctx).Trace().
 		Err(err).
-		Bool("refresh", queue.ty == kQueueRefreshBulk).
+		Str("refresh", req.Refresh).
 		Str("mod", kModBulk).
 		Int("took", blk.Took).
 		Dur("rtt", time.Since(start)).
@@ -263,34 +402,11 @@ func (b *Bulker) flushBulk(ctx context.Context, queue queueT) error {
 		Int64("bodySz", bodySz).
 		Msg("flushBulk")
 
-	if len(blk.Items) != queueCnt {
-		return fmt.Errorf("Bulk queue length mismatch")
+	if len(blk.Items) != len(nodes) {
+		return nil, fmt.Errorf("Bulk queue length mismatch")
 	}
 
-	// WARNING: Once we start pushing items to
-	// the queue, the node pointers are invalid.
-	// Do NOT return a non-nil value or failQueue
-	// up the stack will fail.
-
-	n := queue.head
-	for i := range blk.Items {
-		next := n.next // 'n' is invalid immediately on channel send
-
-		item := blk.Items[i].Choose()
-		select {
-		case n.ch <- respT{
-			err:  item.deriveError(),
-			idx:  n.idx,
-			data: item,
-		}:
-		default:
-			panic("Unexpected blocked response channel on flushBulk")
-		}
-
-		n = next
-	}
-
-	return nil
+	return blk.Items, nil
 }
 
 func (b *Bulker) HasTracer() bool {
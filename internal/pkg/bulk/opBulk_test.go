@@ -0,0 +1,410 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package bulk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+// bulkStep is the scripted answer to a bulk request.
+// A status other than 200 fails the whole request, otherwise the items are answered
+// with the status in itemStatus for their document id, or 201.
+type bulkStep struct {
+	status     int
+	itemStatus map[string]int
+}
+
+// scriptedBulkTransport answers the bulk requests with its steps in order, the last step is repeated.
+type scriptedBulkTransport struct {
+	mu    sync.Mutex
+	steps []bulkStep
+	// ids holds the document ids of each request that was received.
+	ids [][]string
+}
+
+func (m *scriptedBulkTransport) Perform(req *http.Request) (*http.Response, error) {
+	var ids []string
+	decoder := json.NewDecoder(req.Body)
+	for decoder.More() {
+		var frame map[string]struct {
+			ID string `json:"_id"`
+		}
+		if err := decoder.Decode(&frame); err != nil {
+			return nil, err
+		}
+		meta, ok := frame["create"]
+		if !ok {
+			return nil, errors.New("unexpected op")
+		}
+		ids = append(ids, meta.ID)
+		// skip the document
+		var doc json.RawMessage
+		if err := decoder.Decode(&doc); err != nil {
+			return nil, err
+		}
+	}
+
+	m.mu.Lock()
+	step := m.steps[min(len(m.ids), len(m.steps)-1)]
+	m.ids = append(m.ids, ids)
+	m.mu.Unlock()
+
+	var body bytes.Buffer
+	status := step.status
+	if status == http.StatusOK {
+		hasErrors := false
+		body.WriteString(`{"took":1,"items":[`)
+		for i, id := range ids {
+			if i > 0 {
+				body.WriteString(",")
+			}
+			itemStatus, ok := step.itemStatus[id]
+			if !ok {
+				itemStatus = http.StatusCreated
+			}
+			body.WriteString(`{"create":{"_index":"test","_id":"` + id + `","status":` + strconv.Itoa(itemStatus))
+			if itemStatus >= 300 {
+				hasErrors = true
+				body.WriteString(`,"error":{"type":"test_exception","reason":"scripted failure"}`)
+			}
+			body.WriteString(`}}`)
+		}
+		body.WriteString(`],"errors":` + strconv.FormatBool(hasErrors) + `}`)
+	} else {
+		body.WriteString(`{"error":{"type":"test_exception","reason":"scripted failure"},"status":` + strconv.Itoa(status) + `}`)
+	}
+
+	return &http.Response{
+		Request:    req,
+		StatusCode: status,
+		Status:     strconv.Itoa(status) + " " + http.StatusText(status),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(&body),
+	}, nil
+}
+
+func (m *scriptedBulkTransport) requests() [][]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ids
+}
+
+func runScriptedBulker(t *testing.T, mock esapi.Transport, retry config.BulkRetry) *Bulker {
+	t.Helper()
+	bulker := NewBulker(mock, nil, WithFlushInterval(10*time.Millisecond), WithBulkRetry(retry))
+
+	ctx, cancel := context.WithCancel(testlog.SetLogger(t).WithContext(context.Background()))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := bulker.Run(ctx); !errors.Is(err, context.Canceled) {
+			t.Error(err)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	return bulker
+}
+
+func TestFlushBulkRetry(t *testing.T) {
+	retry := config.BulkRetry{MaxRetries: 3, InitInterval: time.Millisecond, MaxInterval: 5 * time.Millisecond}
+
+	t.Run("request rejected twice", func(t *testing.T) {
+		mock := &scriptedBulkTransport{steps: []bulkStep{
+			{status: http.StatusTooManyRequests},
+			{status: http.StatusTooManyRequests},
+			{status: http.StatusOK},
+		}}
+		bulker := runScriptedBulker(t, mock, retry)
+		ctx := testlog.SetLogger(t).WithContext(context.Background())
+
+		id, err := bulker.Create(ctx, "test", "a", []byte(`{}`))
+		require.NoError(t, err)
+		assert.Equal(t, "a", id)
+		assert.Equal(t, [][]string{{"a"}, {"a"}, {"a"}}, mock.requests())
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		mock := &scriptedBulkTransport{steps: []bulkStep{
+			{status: http.StatusServiceUnavailable},
+		}}
+		bulker := runScriptedBulker(t, mock, retry)
+		ctx := testlog.SetLogger(t).WithContext(context.Background())
+
+		_, err := bulker.Create(ctx, "test", "a", []byte(`{}`))
+		require.Error(t, err)
+		assert.Len(t, mock.requests(), retry.MaxRetries+1)
+	})
+
+	t.Run("request not retryable", func(t *testing.T) {
+		mock := &scriptedBulkTransport{steps: []bulkStep{
+			{status: http.StatusBadRequest},
+		}}
+		bulker := runScriptedBulker(t, mock, retry)
+		ctx := testlog.SetLogger(t).WithContext(context.Background())
+
+		_, err := bulker.Create(ctx, "test", "a", []byte(`{}`))
+		require.Error(t, err)
+		assert.Len(t, mock.requests(), 1)
+	})
+
+	t.Run("partial failure", func(t *testing.T) {
+		mock := &scriptedBulkTransport{steps: []bulkStep{
+			{status: http.StatusOK, itemStatus: map[string]int{"retry": http.StatusTooManyRequests, "fail": http.StatusBadRequest}},
+			{status: http.StatusOK},
+		}}
+		bulker := runScriptedBulker(t, mock, retry)
+		ctx := testlog.SetLogger(t).WithContext(context.Background())
+
+		results, err := bulker.MCreate(ctx, []MultiOp{
+			{Index: "test", ID: "ok", Body: []byte(`{}`)},
+			{Index: "test", ID: "retry", Body: []byte(`{}`)},
+			{Index: "test", ID: "fail", Body: []byte(`{}`)},
+		})
+		assert.Error(t, err, "expected the error of the failed item")
+		require.Len(t, results, 3)
+		assert.Equal(t, http.StatusCreated, results[0].Status)
+		assert.Equal(t, http.StatusCreated, results[1].Status, "expected the rejected item to be retried")
+		assert.Equal(t, http.StatusBadRequest, results[2].Status, "expected the failed item to be returned")
+
+		requests := mock.requests()
+		require.Len(t, requests, 2)
+		assert.ElementsMatch(t, []string{"ok", "retry", "fail"}, requests[0])
+		assert.Equal(t, []string{"retry"}, requests[1], "expected only the rejected item to be retried")
+	})
+}
+
+// aliasSwapTransport simulates the alias of an index being moved to a new index while bulk requests are in flight.
+// The items are rejected with errType until the aliases are resolved again, and swap is true.
+type aliasSwapTransport struct {
+	mu      sync.Mutex
+	status  int
+	errType string
+	swap    bool
+	swapped bool
+	// bulks holds the document ids of each bulk request that was received.
+	bulks [][]string
+	// aliases holds the path of each alias request that was received.
+	aliases []string
+}
+
+func (m *aliasSwapTransport) Perform(req *http.Request) (*http.Response, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var body bytes.Buffer
+	if strings.HasSuffix(req.URL.Path, "/_alias") {
+		m.aliases = append(m.aliases, req.URL.Path)
+		m.swapped = m.swap
+		body.WriteString(`{".fleet-agents-8":{"aliases":{".fleet-agents":{"is_write_index":true}}}}`)
+	} else {
+		var ids []string
+		body.WriteString(`{"took":1,"errors":` + strconv.FormatBool(!m.swapped) + `,"items":[`)
+		decoder := json.NewDecoder(req.Body)
+		for decoder.More() {
+			var frame map[string]struct {
+				ID string `json:"_id"`
+			}
+			if err := decoder.Decode(&frame); err != nil {
+				return nil, err
+			}
+			meta, ok := frame["update"]
+			if !ok {
+				return nil, errors.New("unexpected op")
+			}
+			// skip the document
+			var doc json.RawMessage
+			if err := decoder.Decode(&doc); err != nil {
+				return nil, err
+			}
+
+			if len(ids) > 0 {
+				body.WriteString(",")
+			}
+			ids = append(ids, meta.ID)
+			if m.swapped {
+				body.WriteString(`{"update":{"_index":".fleet-agents-8","_id":"` + meta.ID + `","result":"updated","status":200}}`)
+			} else {
+				body.WriteString(`{"update":{"_index":".fleet-agents-7","_id":"` + meta.ID + `","status":` + strconv.Itoa(m.status) +
+					`,"error":{"type":"` + m.errType + `","reason":"scripted failure"}}}`)
+			}
+		}
+		body.WriteString(`]}`)
+		m.bulks = append(m.bulks, ids)
+	}
+
+	return &http.Response{
+		Request:    req,
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(&body),
+	}, nil
+}
+
+func (m *aliasSwapTransport) requests() ([][]string, []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bulks, m.aliases
+}
+
+func TestFlushBulkAliasSwap(t *testing.T) {
+	retry := config.BulkRetry{MaxRetries: 3, InitInterval: time.Millisecond, MaxInterval: 5 * time.Millisecond}
+	counter := func(c prometheus.Counter) float64 {
+		var m dto.Metric
+		require.NoError(t, c.Write(&m))
+		return m.GetCounter().GetValue()
+	}
+
+	for _, tc := range []struct {
+		name    string
+		status  int
+		errType string
+	}{
+		{"index not found", http.StatusNotFound, "index_not_found_exception"},
+		{"index closed", http.StatusBadRequest, "index_closed_exception"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := &aliasSwapTransport{status: tc.status, errType: tc.errType, swap: true}
+			bulker := runScriptedBulker(t, mock, retry)
+			ctx := testlog.SetLogger(t).WithContext(context.Background())
+			refreshes := counter(aliasRefreshes)
+
+			results, err := bulker.MUpdate(ctx, []MultiOp{
+				{Index: ".fleet-agents", ID: "a", Body: []byte(`{"doc":{}}`)},
+				{Index: ".fleet-agents", ID: "b", Body: []byte(`{"doc":{}}`)},
+			})
+			require.NoError(t, err)
+			require.Len(t, results, 2)
+			assert.Equal(t, http.StatusOK, results[0].Status)
+			assert.Equal(t, http.StatusOK, results[1].Status)
+
+			bulks, aliases := mock.requests()
+			require.Len(t, bulks, 2)
+			assert.ElementsMatch(t, []string{"a", "b"}, bulks[1], "expected the items to be retried after the alias refresh")
+			assert.Equal(t, []string{"/.fleet-agents/_alias"}, aliases, "expected the alias to be resolved once")
+			assert.Equal(t, refreshes+1, counter(aliasRefreshes))
+		})
+	}
+
+	t.Run("index still not found", func(t *testing.T) {
+		mock := &aliasSwapTransport{status: http.StatusNotFound, errType: "index_not_found_exception"}
+		bulker := runScriptedBulker(t, mock, retry)
+		ctx := testlog.SetLogger(t).WithContext(context.Background())
+		refreshes := counter(aliasRefreshes)
+
+		err := bulker.Update(ctx, ".fleet-agents", "a", []byte(`{"doc":{}}`))
+		assert.ErrorIs(t, err, es.ErrIndexNotFound)
+
+		bulks, aliases := mock.requests()
+		assert.Len(t, bulks, 2, "expected the item to be retried once")
+		assert.Len(t, aliases, 1)
+		assert.Equal(t, refreshes+1, counter(aliasRefreshes))
+	})
+}
+
+func TestFlushBulkTooLarge(t *testing.T) {
+	for name, body := range map[string]string{
+		"empty body": "",
+		"html body":  "<html><body><h1>413 Request Entity Too Large</h1></body></html>",
+	} {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("X-Elastic-Product", "Elasticsearch")
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				fmt.Fprint(w, body)
+			}))
+			defer server.Close()
+			client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{server.URL}})
+			require.NoError(t, err)
+			bulker := runScriptedBulker(t, client, config.BulkRetry{})
+			ctx := testlog.SetLogger(t).WithContext(context.Background())
+
+			_, err = bulker.Create(ctx, "test", "a", []byte(`{}`))
+			var esErr *es.ErrElastic
+			require.ErrorAs(t, err, &esErr)
+			assert.Equal(t, http.StatusRequestEntityTooLarge, esErr.Status)
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	cfg := config.BulkRetry{MaxRetries: 10, InitInterval: 100 * time.Millisecond, MaxInterval: time.Second}
+	for attempt, want := range []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	} {
+		for i := 0; i < 10; i++ {
+			d := retryBackoff(cfg, attempt)
+			assert.GreaterOrEqual(t, d, want/2)
+			assert.Less(t, d, want)
+		}
+	}
+	assert.LessOrEqual(t, retryBackoff(cfg, 100), time.Second)
+}
+
+func TestWriteBulkMeta(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Opt
+		meta string
+	}{{
+		name: "no options",
+		meta: `{"update":{"_id":"agent-1","_index":".fleet-agents"}}`,
+	}, {
+		name: "retry on conflict",
+		opts: []Opt{WithRetryOnConflict(3)},
+		meta: `{"update":{"_id":"agent-1","retry_on_conflict":3,"_index":".fleet-agents"}}`,
+	}, {
+		name: "if seq no",
+		opts: []Opt{WithIfSeqNo(42, 7)},
+		meta: `{"update":{"_id":"agent-1","if_seq_no":42,"if_primary_term":7,"_index":".fleet-agents"}}`,
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &Bulker{}
+			opt := b.parseOpts(tc.opts...)
+			var buf Buf
+			require.NoError(t, b.writeBulkMeta(&buf, ActionUpdate.String(), ".fleet-agents", "agent-1", &opt))
+			assert.Equal(t, tc.meta+"\n", string(buf.Bytes()))
+		})
+	}
+}
@@ -13,22 +13,22 @@ import (
 // TODO: Are multi requests used by anything? a quick grep shows no hits outside the bulk package.
 
 func (b *Bulker) MCreate(ctx context.Context, ops []MultiOp, opts ...Opt) ([]BulkIndexerResponseItem, error) {
-	return b.multiWaitBulkOp(ctx, ActionCreate, ops)
+	return b.multiWaitBulkOp(ctx, ActionCreate, ops, opts...)
 }
 
 func (b *Bulker) MIndex(ctx context.Context, ops []MultiOp, opts ...Opt) ([]BulkIndexerResponseItem, error) {
-	return b.multiWaitBulkOp(ctx, ActionIndex, ops)
+	return b.multiWaitBulkOp(ctx, ActionIndex, ops, opts...)
 }
 
 func (b *Bulker) MUpdate(ctx context.Context, ops []MultiOp, opts ...Opt) ([]BulkIndexerResponseItem, error) {
-	return b.multiWaitBulkOp(ctx, ActionUpdate, ops)
+	return b.multiWaitBulkOp(ctx, ActionUpdate, ops, opts...)
 }
 
 func (b *Bulker) MDelete(ctx context.Context, ops []MultiOp, opts ...Opt) ([]BulkIndexerResponseItem, error) {
-	return b.multiWaitBulkOp(ctx, ActionDelete, ops)
+	return b.multiWaitBulkOp(ctx, ActionDelete, ops, opts...)
 }
 
-func (b *Bulker) multiWaitBulkOp(ctx context.Context, action actionT, ops []MultiOp, opts ...Opt) ([]BulkIndexerResponseItem, error) { //nolint:unparam // better to keep consistency with other methods
+func (b *Bulker) multiWaitBulkOp(ctx context.Context, action actionT, ops []MultiOp, opts ...Opt) ([]BulkIndexerResponseItem, error) {
 	if len(ops) == 0 {
 		return nil, nil
 	}
@@ -36,8 +36,12 @@ func (b *Bulker) multiWaitBulkOp(ctx context.Context, action actionT, ops []Mult
 	if uint(len(ops)) > math.MaxUint32 {
 		return nil, errors.New("too many bulk ops")
 	}
+	defer timeES(ctx)()
 
 	opt := b.parseOpts(append(opts, withAPMLinkedContext(ctx))...)
+	if opt.IfSeqNo != "" {
+		return nil, errors.New("if_seq_no is not supported by the multi operations")
+	}
 
 	// Contract is that consumer never blocks, so must preallocate.
 	// Could consider making the response channel *respT to limit memory usage.
@@ -67,7 +71,7 @@ func (b *Bulker) multiWaitBulkOp(ctx context.Context, action actionT, ops []Mult
 
 		op := &ops[i]
 
-		if err := b.writeBulkMeta(&bulkBuf, actionStr, op.Index, op.ID, opt.RetryOnConflict); err != nil {
+		if err := b.writeBulkMeta(&bulkBuf, actionStr, op.Index, op.ID, &opt); err != nil {
 			return nil, err
 		}
 
@@ -80,11 +84,18 @@ func (b *Bulker) multiWaitBulkOp(ctx context.Context, action actionT, ops []Mult
 		bulk := &bulks[i]
 		bulk.ch = ch
 		bulk.idx = int32(i)
+		bulk.index = op.Index
 		bulk.action = action
 		bulk.buf.Set(bodySlice)
 		if opt.Refresh {
 			bulk.flags.Set(flagRefresh)
 		}
+		if opt.RefreshWaitFor {
+			bulk.flags.Set(flagRefreshWaitFor)
+		}
+		if opt.LowPriority {
+			bulk.flags.Set(flagLowPriority)
+		}
 	}
 
 	// Dispatch requests
@@ -113,13 +124,96 @@ func (b *Bulker) multiWaitBulkOp(ctx context.Context, action actionT, ops []Mult
 	return items, lastErr
 }
 
+// MReadResult is the result of the read of a document by MRead.
+type MReadResult struct {
+	Source []byte
+	Err    error
+}
+
+// MRead reads the documents with the ids from the index.
+// The reads are queued like single reads, so they are sent in the same _mget requests as the reads of other callers
+// and flushed on the same interval and size thresholds.
+// The results are returned in the order of the ids; the error of a document that is not found is es.ErrElasticNotFound.
+func (b *Bulker) MRead(ctx context.Context, index string, ids []string, opts ...Opt) ([]MReadResult, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	if uint(len(ids)) > math.MaxUint32 {
+		return nil, errors.New("too many read ops")
+	}
+	defer timeES(ctx)()
+
+	opt := b.parseOpts(append(opts, withAPMLinkedContext(ctx))...)
+
+	// Contract is that consumer never blocks, so must preallocate.
+	ch := make(chan respT, len(ids))
+
+	const kSlop = 32
+	var byteCnt int
+	for _, id := range ids {
+		byteCnt += len(index) + len(id) + kSlop
+	}
+
+	// Create one buffer to serialize each piece, see multiWaitBulkOp.
+	var readBuf Buf
+	readBuf.Grow(byteCnt)
+
+	// Serialize requests
+	reads := make([]bulkT, len(ids))
+	for i, id := range ids {
+		bufIdx := readBuf.Len()
+
+		if err := b.writeMget(&readBuf, index, id); err != nil {
+			return nil, err
+		}
+
+		read := &reads[i]
+		read.ch = ch
+		read.idx = int32(i)
+		read.action = ActionRead
+		read.buf.Set(readBuf.Bytes()[bufIdx:])
+		read.spanLink = opt.spanLink
+		if opt.Refresh {
+			read.flags.Set(flagRefresh)
+		}
+	}
+
+	// Dispatch requests
+	if err := b.multiDispatch(ctx, reads); err != nil {
+		return nil, err
+	}
+
+	// Wait for response and populate return slice
+	results := make([]MReadResult, len(ids))
+	for i := 0; i < len(ids); i++ {
+		select {
+		case r := <-ch:
+			results[r.idx].Err = r.err
+			if item, ok := r.data.(*MgetResponseItem); ok {
+				results[r.idx].Source = item.Source
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return results, nil
+}
+
 func (b *Bulker) multiDispatch(ctx context.Context, blks []bulkT) error {
 
 	// Dispatch to bulk Run loop; Iterate by reference.
 	for i := range blks {
+		held, err := b.pending.acquire(ctx, blks[i].buf.Len())
+		if err != nil {
+			return err
+		}
+		blks[i].held = held
 		select {
 		case b.ch <- &blks[i]:
 		case <-ctx.Done():
+			b.pending.release(held)
 			return ctx.Err()
 		}
 	}
@@ -5,10 +5,23 @@
 package bulk
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
 	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
 )
 
@@ -63,3 +76,118 @@ func BenchmarkMultiUpdateMock(b *testing.B) {
 	}
 
 }
+
+// mockMgetTransport answers _mget requests, the documents with an id prefixed by "missing" are not found.
+type mockMgetTransport struct {
+	requests atomic.Int64
+}
+
+func (m *mockMgetTransport) Perform(req *http.Request) (*http.Response, error) {
+	m.requests.Add(1)
+
+	var mget struct {
+		Docs []struct {
+			ID string `json:"_id"`
+		} `json:"docs"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&mget); err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	body.WriteString(`{"docs":[`)
+	for i, doc := range mget.Docs {
+		if i > 0 {
+			body.WriteString(",")
+		}
+		if strings.HasPrefix(doc.ID, "missing") {
+			body.WriteString(`{"_id":"` + doc.ID + `","found":false}`)
+		} else {
+			body.WriteString(`{"_id":"` + doc.ID + `","found":true,"_source":{"id":"` + doc.ID + `"}}`)
+		}
+	}
+	body.WriteString(`]}`)
+
+	return &http.Response{
+		Request:    req,
+		StatusCode: 200,
+		Status:     "200 OK",
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(&body),
+	}, nil
+}
+
+func runMockMgetBulker(tb testing.TB, opts ...BulkOpt) (*Bulker, *mockMgetTransport) {
+	tb.Helper()
+	mock := &mockMgetTransport{}
+	bulker := NewBulker(mock, nil, opts...)
+
+	ctx, cancel := context.WithCancel(testlog.SetLogger(tb).WithContext(context.Background()))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := bulker.Run(ctx); !errors.Is(err, context.Canceled) {
+			tb.Error(err)
+		}
+	}()
+	tb.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	return bulker, mock
+}
+
+func TestMRead(t *testing.T) {
+	bulker, mock := runMockMgetBulker(t, WithFlushInterval(10*time.Millisecond))
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+
+	results, err := bulker.MRead(ctx, "test", []string{"a", "missing", "b"})
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+
+	assert.NoError(t, results[0].Err)
+	assert.JSONEq(t, `{"id":"a"}`, string(results[0].Source))
+	assert.ErrorIs(t, results[1].Err, es.ErrElasticNotFound)
+	assert.NoError(t, results[2].Err)
+	assert.JSONEq(t, `{"id":"b"}`, string(results[2].Source))
+	assert.Equal(t, int64(1), mock.requests.Load(), "expected the reads to be sent in a single _mget request")
+
+	results, err = bulker.MRead(ctx, "test", nil)
+	require.NoError(t, err)
+	assert.Empty(t, results)
+}
+
+// Simulates a checkin burst, every agent reads its document concurrently.
+// The mget/op metric reports how many _mget requests were sent for the burst.
+func BenchmarkMockMgetBurst(b *testing.B) {
+	const agents = 10000
+
+	bulker, mock := runMockMgetBulker(b)
+	ctx := testlog.SetLogger(b).WithContext(context.Background())
+
+	ids := make([]string, agents)
+	for i := range ids {
+		ids[i] = "agent-" + strconv.Itoa(i)
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		wg.Add(agents)
+		for _, id := range ids {
+			go func(id string) {
+				defer wg.Done()
+				if _, err := bulker.Read(ctx, "test", id); err != nil {
+					b.Error(err)
+				}
+			}(id)
+		}
+		wg.Wait()
+	}
+	b.ReportMetric(float64(mock.requests.Load())/float64(b.N), "mget/op")
+}
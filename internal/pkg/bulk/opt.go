@@ -14,6 +14,7 @@ import (
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/build"
 	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
 )
 
 //-----
@@ -21,10 +22,14 @@ import (
 
 type optionsT struct {
 	Refresh            bool
+	RefreshWaitFor     bool
 	RetryOnConflict    string
+	IfSeqNo            string
+	IfPrimaryTerm      string
 	Indices            []string
 	WaitForCheckpoints []int64
 	IgnoreUnavailable  bool
+	LowPriority        bool
 	spanLink           *apm.SpanLink
 }
 
@@ -36,18 +41,43 @@ func WithRefresh() Opt {
 	}
 }
 
+// WithRefreshWaitFor makes a write return once the documents are visible to searches, it waits for the next refresh
+// of the index instead of forcing one like WithRefresh.
+func WithRefreshWaitFor() Opt {
+	return func(opt *optionsT) {
+		opt.RefreshWaitFor = true
+	}
+}
+
 func WithIgnoreUnavailble() Opt {
 	return func(opt *optionsT) {
 		opt.IgnoreUnavailable = true
 	}
 }
 
+// WithLowPriority queues a bulk action on the low priority queue, that is flushed with the other queues
+// but never triggers a flush by itself before the flush interval.
+func WithLowPriority() Opt {
+	return func(opt *optionsT) {
+		opt.LowPriority = true
+	}
+}
+
 func WithRetryOnConflict(n int) Opt {
 	return func(opt *optionsT) {
 		opt.RetryOnConflict = strconv.Itoa(n)
 	}
 }
 
+// WithIfSeqNo makes a single document write fail with a version conflict if the document changed since it was read
+// with seqNo and primaryTerm. It can not be combined with WithRetryOnConflict, nor used with the multi operations.
+func WithIfSeqNo(seqNo, primaryTerm int64) Opt {
+	return func(opt *optionsT) {
+		opt.IfSeqNo = strconv.FormatInt(seqNo, 10)
+		opt.IfPrimaryTerm = strconv.FormatInt(primaryTerm, 10)
+	}
+}
+
 // WithIndex sets the index when searching
 func WithIndex(idx string) Opt {
 	return func(opt *optionsT) {
@@ -63,13 +93,14 @@ func WithWaitForCheckpoints(checkpoints []int64) Opt {
 	}
 }
 
+// withAPMLinkedContext links the operation to the trace of the request, the trace context of the APM
+// transaction is used if there is one.
 func withAPMLinkedContext(ctx context.Context) Opt {
 	return func(opt *optionsT) {
-		trace := apm.TransactionFromContext(ctx)
-		if trace == nil {
+		tCtx, ok := logger.TraceContextFromContext(ctx)
+		if !ok {
 			return
 		}
-		tCtx := trace.TraceContext()
 		opt.spanLink = &apm.SpanLink{
 			Trace: tCtx.Trace,
 			Span:  tCtx.Span,
@@ -90,6 +121,10 @@ type bulkOptT struct {
 	apikeyMaxReqSize  int
 	policyTokens      []config.PolicyToken
 	bi                build.Info
+	bulkRetry         config.BulkRetry
+	flushObserver     func(err error)
+	maxPendingBytes   int
+	maxPendingWait    time.Duration
 }
 
 type BulkOpt func(*bulkOptT)
@@ -152,12 +187,35 @@ func WithPolicyTokens(tokens []config.PolicyToken) BulkOpt {
 	}
 }
 
+// WithBulkRetry sets how the bulk requests that fail with a transient error are retried
+func WithBulkRetry(retry config.BulkRetry) BulkOpt {
+	return func(opt *bulkOptT) {
+		opt.bulkRetry = retry
+	}
+}
+
+// WithMaxPendingBytes limits the bytes of the operations queued or in flight to max, 0 disables the limit.
+// Operations over the limit wait for up to wait for the pending operations to be flushed, 0 waits as long as the context.
+func WithMaxPendingBytes(max int, wait time.Duration) BulkOpt {
+	return func(opt *bulkOptT) {
+		opt.maxPendingBytes = max
+		opt.maxPendingWait = wait
+	}
+}
+
 func WithBi(bi build.Info) BulkOpt {
 	return func(opt *bulkOptT) {
 		opt.bi = bi
 	}
 }
 
+// WithFlushObserver sets a function called with the outcome of every queue flush, a nil err is a success.
+func WithFlushObserver(f func(err error)) BulkOpt {
+	return func(opt *bulkOptT) {
+		opt.flushObserver = f
+	}
+}
+
 func parseBulkOpts(opts ...BulkOpt) bulkOptT {
 	bopt := bulkOptT{
 		flushInterval:     defaultFlushInterval,
@@ -169,6 +227,7 @@ func parseBulkOpts(opts ...BulkOpt) bulkOptT {
 		apikeyMaxReqSize:  defaultApikeyMaxReqSize,
 		policyTokens:      []config.PolicyToken{}, // default is empty
 	}
+	bopt.bulkRetry.InitDefaults()
 
 	for _, f := range opts {
 		f(&bopt)
@@ -185,6 +244,11 @@ func (o *bulkOptT) MarshalZerologObject(e *zerolog.Event) {
 	e.Int("blockQueueSz", o.blockQueueSz)
 	e.Int("apikeyMaxParallel", o.apikeyMaxParallel)
 	e.Int("apikeyMaxReqSize", o.apikeyMaxReqSize)
+	e.Int("bulkMaxRetries", o.bulkRetry.MaxRetries)
+	e.Dur("bulkRetryInitInterval", o.bulkRetry.InitInterval)
+	e.Dur("bulkRetryMaxInterval", o.bulkRetry.MaxInterval)
+	e.Int("maxPendingBytes", o.maxPendingBytes)
+	e.Dur("maxPendingWait", o.maxPendingWait)
 }
 
 // BulkOptsFromCfg transforms config to a slize of BulkOpt
@@ -193,9 +257,10 @@ func BulkOptsFromCfg(cfg *config.Config) []BulkOpt {
 	bulkCfg := cfg.Inputs[0].Server.Bulk
 
 	// Attempt to slice the max number of connections to leave room for the bulk flush queues
-	maxKeyParallel := cfg.Output.Elasticsearch.MaxConnPerHost
-	if cfg.Output.Elasticsearch.MaxConnPerHost > bulkCfg.FlushMaxPending {
-		maxKeyParallel = cfg.Output.Elasticsearch.MaxConnPerHost - bulkCfg.FlushMaxPending
+	maxConnsPerHost := cfg.Output.Elasticsearch.Pool().MaxConnsPerHost
+	maxKeyParallel := maxConnsPerHost
+	if maxConnsPerHost > bulkCfg.FlushMaxPending {
+		maxKeyParallel = maxConnsPerHost - bulkCfg.FlushMaxPending
 	}
 	policyTokens := []config.PolicyToken{}
 	if cfg.Inputs[0].Server.StaticPolicyTokens.Enabled {
@@ -209,5 +274,7 @@ func BulkOptsFromCfg(cfg *config.Config) []BulkOpt {
 		WithAPIKeyMaxParallel(maxKeyParallel),
 		WithAPIKeyMaxRequestSize(cfg.Output.Elasticsearch.MaxContentLength),
 		WithPolicyTokens(policyTokens),
+		WithBulkRetry(cfg.Output.Elasticsearch.BulkRetry),
+		WithMaxPendingBytes(cfg.Output.Elasticsearch.Bulk.MaxPendingBytes, cfg.Output.Elasticsearch.Bulk.MaxPendingWait),
 	}
 }
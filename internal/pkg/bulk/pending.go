@@ -0,0 +1,70 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package bulk
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// ErrPendingBytes is returned when an operation waited too long for the pending bytes to drop below the limit.
+var ErrPendingBytes = errors.New("too many bytes pending to elasticsearch")
+
+// pendingBytes limits the bytes of the operations that are queued or in flight to Elasticsearch.
+// The bytes of an operation are held from the time it's queued until the flush that sent it completes.
+type pendingBytes struct {
+	max  int64
+	wait time.Duration
+	sem  *semaphore.Weighted
+}
+
+func newPendingBytes(max int, wait time.Duration) *pendingBytes {
+	if max <= 0 {
+		return nil
+	}
+	return &pendingBytes{
+		max:  int64(max),
+		wait: wait,
+		sem:  semaphore.NewWeighted(int64(max)),
+	}
+}
+
+// acquire blocks until n bytes can be queued, it returns the number of bytes held which are released after the flush.
+// An operation larger than the limit holds the whole limit. If the bytes can not be acquired within the wait
+// ErrPendingBytes is returned, unless ctx is done first.
+func (p *pendingBytes) acquire(ctx context.Context, n int) (int, error) {
+	if p == nil || n <= 0 {
+		return 0, nil
+	}
+	held := min(int64(n), p.max)
+	if !p.sem.TryAcquire(held) {
+		wctx := ctx
+		if p.wait > 0 {
+			var cancel context.CancelFunc
+			wctx, cancel = context.WithTimeout(ctx, p.wait)
+			defer cancel()
+		}
+		if err := p.sem.Acquire(wctx, held); err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			return 0, ErrPendingBytes
+		}
+	}
+	pendingBytesGauge.Add(float64(held))
+	return int(held), nil
+}
+
+// release releases bytes held by acquire.
+func (p *pendingBytes) release(n int) {
+	if p == nil || n <= 0 {
+		return
+	}
+	pendingBytesGauge.Sub(float64(n))
+	p.sem.Release(int64(n))
+}
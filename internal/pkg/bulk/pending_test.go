@@ -0,0 +1,156 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package bulk
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+// stalledTransport blocks the bulk requests until it's released, like an Elasticsearch that stopped answering.
+type stalledTransport struct {
+	started  chan struct{}
+	released chan struct{}
+	once     sync.Once
+}
+
+func newStalledTransport() *stalledTransport {
+	return &stalledTransport{
+		started:  make(chan struct{}, 16),
+		released: make(chan struct{}),
+	}
+}
+
+func (m *stalledTransport) Perform(req *http.Request) (*http.Response, error) {
+	m.started <- struct{}{}
+	select {
+	case <-m.released:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	return (&mockBulkTransport{}).Perform(req)
+}
+
+func (m *stalledTransport) release() {
+	m.once.Do(func() { close(m.released) })
+}
+
+func pendingBytesValue(t *testing.T) float64 {
+	t.Helper()
+	var m dto.Metric
+	require.NoError(t, pendingBytesGauge.Write(&m))
+	return m.GetGauge().GetValue()
+}
+
+func TestPendingBytes(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("disabled", func(t *testing.T) {
+		p := newPendingBytes(0, time.Second)
+		held, err := p.acquire(ctx, 1024)
+		require.NoError(t, err)
+		assert.Zero(t, held)
+		p.release(held)
+	})
+
+	t.Run("wait expires", func(t *testing.T) {
+		p := newPendingBytes(100, 10*time.Millisecond)
+		held, err := p.acquire(ctx, 60)
+		require.NoError(t, err)
+		assert.Equal(t, 60, held)
+
+		_, err = p.acquire(ctx, 60)
+		assert.ErrorIs(t, err, ErrPendingBytes)
+
+		p.release(held)
+		held, err = p.acquire(ctx, 60)
+		require.NoError(t, err)
+		p.release(held)
+	})
+
+	t.Run("context cancelled", func(t *testing.T) {
+		p := newPendingBytes(100, time.Minute)
+		held, err := p.acquire(ctx, 100)
+		require.NoError(t, err)
+		defer p.release(held)
+
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err = p.acquire(cctx, 1)
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("operation larger than the limit", func(t *testing.T) {
+		p := newPendingBytes(100, 10*time.Millisecond)
+		held, err := p.acquire(ctx, 500)
+		require.NoError(t, err)
+		assert.Equal(t, 100, held, "expected the operation to hold the whole limit")
+		p.release(held)
+	})
+}
+
+func TestBulkerMaxPendingBytes(t *testing.T) {
+	transport := newStalledTransport()
+	defer transport.release()
+
+	body := []byte(`{"data":"` + string(bytes.Repeat([]byte("x"), 1024)) + `"}`)
+	const maxPending = 1500 // room for one operation only
+	bulker := NewBulker(transport, nil, WithFlushInterval(time.Millisecond), WithMaxPendingBytes(maxPending, 50*time.Millisecond))
+
+	ctx, cancel := context.WithCancel(testlog.SetLogger(t).WithContext(context.Background()))
+	defer cancel()
+	go func() {
+		_ = bulker.Run(ctx)
+	}()
+
+	base := pendingBytesValue(t)
+
+	// The first operation is flushed, its request stalls.
+	errCh := make(chan error, 2)
+	go func() {
+		_, err := bulker.Create(ctx, "test", "a", body)
+		errCh <- err
+	}()
+	select {
+	case <-transport.started:
+	case <-time.After(time.Second):
+		t.Fatal("bulk request was not sent")
+	}
+	pending := pendingBytesValue(t) - base
+	assert.Greater(t, pending, float64(len(body)))
+	assert.LessOrEqual(t, pending, float64(maxPending))
+
+	// The next operation waits for the stalled request, then gives up.
+	_, err := bulker.Create(ctx, "test", "b", body)
+	require.ErrorIs(t, err, ErrPendingBytes)
+	assert.Equal(t, pending, pendingBytesValue(t)-base, "expected the failed operation to hold no bytes")
+
+	// An operation waiting when the request completes goes through.
+	go func() {
+		_, err := bulker.Create(ctx, "test", "c", body)
+		errCh <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	transport.release()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errCh:
+			require.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("operation still blocked once the request completed")
+		}
+	}
+	assert.Eventually(t, func() bool { return pendingBytesValue(t) == base }, time.Second, time.Millisecond)
+}
@@ -9,6 +9,7 @@ type queueT struct {
 	cnt     int
 	head    *bulkT
 	pending int
+	held    int // pending bytes held by the blocks, released once the queue is flushed
 }
 
 type queueType int
@@ -21,6 +22,8 @@ const (
 	kQueueRefreshBulk
 	kQueueRefreshRead
 	kQueueAPIKeyUpdate
+	kQueueLowPriorityBulk
+	kQueueRefreshWaitForBulk
 	kNumQueues
 )
 
@@ -40,6 +43,10 @@ func (q queueT) Type() string {
 		return "refreshRead"
 	case kQueueAPIKeyUpdate:
 		return "apiKeyUpdate"
+	case kQueueLowPriorityBulk:
+		return "lowPriorityBulk"
+	case kQueueRefreshWaitForBulk:
+		return "refreshWaitForBulk"
 	}
 	panic("unknown")
 }
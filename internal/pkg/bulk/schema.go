@@ -47,8 +47,8 @@ type BulkIndexerResponseItem struct {
 	//	Index      string `json:"_index"`
 	DocumentID string `json:"_id"`
 	//	Version    int64  `json:"_version"`
-	//	Result     string `json:"result"`
-	Status int `json:"status"`
+	Result string `json:"result"`
+	Status int    `json:"status"`
 	//	SeqNo      int64  `json:"_seq_no"`
 	//	PrimTerm   int64  `json:"_primary_term"`
 
@@ -80,11 +80,11 @@ type MgetResponse struct {
 type MgetResponseItem struct {
 	//	Index      string          `json:"_index"`
 	//	Type       string          `json:"_type"`
-	DocumentID string `json:"_id"`
-	Version    int64  `json:"_version"`
-	SeqNo      int64  `json:"_seq_no"`
-	//	PrimTerm   int64           `json:"_primary_term"`
-	Found bool `json:"found"`
+	DocumentID  string `json:"_id"`
+	Version     int64  `json:"_version"`
+	SeqNo       int64  `json:"_seq_no"`
+	PrimaryTerm int64  `json:"_primary_term"`
+	Found       bool   `json:"found"`
 	//	Routing    string          `json:"_routing"`
 	Source json.RawMessage `json:"_source"`
 	//	Fields     json.RawMessage `json:"_fields"`
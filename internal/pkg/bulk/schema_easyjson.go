@@ -1045,6 +1045,14 @@ func easyjsonCef4e921DecodeGithubComElasticFleetServerV7InternalPkgBulk4(in *jle
 			continue
 		}
 		switch key {
+		case "_id":
+			out.DocumentID = string(in.String())
+		case "_version":
+			out.Version = int64(in.Int64())
+		case "_seq_no":
+			out.SeqNo = int64(in.Int64())
+		case "_primary_term":
+			out.PrimaryTerm = int64(in.Int64())
 		case "found":
 			out.Found = bool(in.Bool())
 		case "_source":
@@ -1066,8 +1074,28 @@ func easyjsonCef4e921EncodeGithubComElasticFleetServerV7InternalPkgBulk4(out *jw
 	first := true
 	_ = first
 	{
-		const prefix string = ",\"found\":"
+		const prefix string = ",\"_id\":"
 		out.RawString(prefix[1:])
+		out.String(string(in.DocumentID))
+	}
+	{
+		const prefix string = ",\"_version\":"
+		out.RawString(prefix)
+		out.Int64(int64(in.Version))
+	}
+	{
+		const prefix string = ",\"_seq_no\":"
+		out.RawString(prefix)
+		out.Int64(int64(in.SeqNo))
+	}
+	{
+		const prefix string = ",\"_primary_term\":"
+		out.RawString(prefix)
+		out.Int64(int64(in.PrimaryTerm))
+	}
+	{
+		const prefix string = ",\"found\":"
+		out.RawString(prefix)
 		out.Bool(bool(in.Found))
 	}
 	{
@@ -1220,6 +1248,8 @@ func easyjsonCef4e921DecodeGithubComElasticFleetServerV7InternalPkgBulk6(in *jle
 		switch key {
 		case "_id":
 			out.DocumentID = string(in.String())
+		case "result":
+			out.Result = string(in.String())
 		case "status":
 			out.Status = int(in.Int())
 		case "error":
@@ -1245,6 +1275,11 @@ func easyjsonCef4e921EncodeGithubComElasticFleetServerV7InternalPkgBulk6(out *jw
 		out.RawString(prefix[1:])
 		out.String(string(in.DocumentID))
 	}
+	{
+		const prefix string = ",\"result\":"
+		out.RawString(prefix)
+		out.String(string(in.Result))
+	}
 	{
 		const prefix string = ",\"status\":"
 		out.RawString(prefix)
@@ -7,12 +7,25 @@ package bulk
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/rs/zerolog"
 	"go.elastic.co/apm/v2"
 )
 
+// ErrSecretNotFound is returned when a secret referenced by a policy does not exist.
+var ErrSecretNotFound = errors.New("secret not found")
+
+// secretCacheTTL is how long secret values are cached. Fleet does not update secrets in place, a changed
+// secret is stored with a new ID, so the TTL only bounds how long the values of removed secrets are kept.
+const secretCacheTTL = time.Hour
+
 type ExtendedClient struct {
 	*elasticsearch.Client
 	Custom *ExtendedAPI
@@ -26,17 +39,23 @@ type ExtendedAPI struct {
 // GET /_fleet/secret/secretId
 func (c *ExtendedAPI) Read(ctx context.Context, secretID string) (*SecretResponse, error) {
 	req, err := http.NewRequestWithContext(ctx, "GET", "/_fleet/secret/"+secretID, nil)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
 
 	res, err := c.Perform(req)
 	if err != nil {
 		return nil, err
 	}
 	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", ErrSecretNotFound, secretID)
+	}
+	if res.StatusCode >= http.StatusMultipleChoices {
+		return nil, parseError(&esapi.Response{StatusCode: res.StatusCode, Header: res.Header, Body: res.Body}, zerolog.Ctx(ctx))
+	}
 	var secretResp SecretResponse
 
 	err = json.NewDecoder(res.Body).Decode(&secretResp)
@@ -63,3 +82,40 @@ func ReadSecret(ctx context.Context, client *elasticsearch.Client, secretID stri
 	}
 	return (*res).Value, err
 }
+
+// secretCache caches secret values by ID.
+type secretCache struct {
+	mu     sync.Mutex
+	values map[string]cachedSecret
+}
+
+type cachedSecret struct {
+	value   string
+	expires time.Time
+}
+
+func newSecretCache() *secretCache {
+	return &secretCache{values: make(map[string]cachedSecret)}
+}
+
+func (c *secretCache) get(id string, now time.Time) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.values[id]
+	if !ok || now.After(s.expires) {
+		return "", false
+	}
+	return s.value, true
+}
+
+// set caches the value of the secret, the expired secrets are removed.
+func (c *secretCache) set(id, value string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, s := range c.values {
+		if now.After(s.expires) {
+			delete(c.values, k)
+		}
+	}
+	c.values[id] = cachedSecret{value: value, expires: now.Add(secretCacheTTL)}
+}
@@ -0,0 +1,82 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package bulk
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/testing/esutil"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+func TestReadSecrets(t *testing.T) {
+	client, transport := esutil.MockESClient(t)
+	var reads []string
+	transport.RoundTripFn = func(req *http.Request) (*http.Response, error) {
+		id := strings.TrimPrefix(req.URL.Path, "/_fleet/secret/")
+		reads = append(reads, id)
+		header := http.Header{
+			"X-Elastic-Product": []string{"Elasticsearch"},
+			"Content-Type":      []string{"application/json"},
+		}
+		if strings.HasPrefix(id, "missing") {
+			return &http.Response{
+				StatusCode: http.StatusNotFound,
+				Header:     header,
+				Body:       io.NopCloser(strings.NewReader(`{"error":{"type":"resource_not_found_exception","reason":"No secret with id [` + id + `]"},"status":404}`)),
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     header,
+			Body:       io.NopCloser(strings.NewReader(`{"id":"` + id + `","value":"` + id + `_value"}`)),
+		}, nil
+	}
+	bulker := NewBulker(client, nil)
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+
+	secrets, err := bulker.ReadSecrets(ctx, []string{"a", "b", "a"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "a_value", "b": "b_value"}, secrets)
+	assert.Equal(t, []string{"a", "b"}, reads)
+
+	secrets, err = bulker.ReadSecrets(ctx, []string{"b", "c"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"b": "b_value", "c": "c_value"}, secrets)
+	assert.Equal(t, []string{"a", "b", "c"}, reads, "expected the cached secret not to be read again")
+
+	_, err = bulker.ReadSecrets(ctx, []string{"a", "missing-1"})
+	assert.ErrorIs(t, err, ErrSecretNotFound)
+	assert.ErrorContains(t, err, "missing-1")
+
+	_, err = bulker.ReadSecrets(ctx, []string{"missing-1"})
+	assert.ErrorIs(t, err, ErrSecretNotFound)
+	assert.Equal(t, []string{"a", "b", "c", "missing-1", "missing-1"}, reads, "expected a missing secret not to be cached")
+}
+
+func TestSecretCacheExpires(t *testing.T) {
+	c := newSecretCache()
+	now := time.Now()
+	c.set("a", "a_value", now)
+
+	val, ok := c.get("a", now.Add(secretCacheTTL))
+	assert.True(t, ok)
+	assert.Equal(t, "a_value", val)
+
+	later := now.Add(secretCacheTTL + time.Second)
+	_, ok = c.get("a", later)
+	assert.False(t, ok)
+
+	c.set("b", "b_value", later)
+	assert.NotContains(t, c.values, "a", "expected the expired secret to be removed")
+}
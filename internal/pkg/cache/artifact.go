@@ -0,0 +1,162 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+)
+
+// spillPattern is the name pattern of the files holding the spilled artifact bodies.
+const spillPattern = "fleet-server-artifact-*"
+
+// Artifact is a cached artifact. The decoded body of a small artifact is held in memory in Body, the body of a large
+// artifact is spilled to a file and Body is empty.
+type Artifact struct {
+	model.Artifact
+	spill *spillFile
+}
+
+// spillFile is a file holding an artifact body, it is removed once it is released by all its holders.
+type spillFile struct {
+	path string
+	size int64
+	refs atomic.Int64
+}
+
+// Size returns the size of the artifact body.
+func (a Artifact) Size() int64 {
+	if a.spill != nil {
+		return a.spill.size
+	}
+	return int64(len(a.Body))
+}
+
+// Spilled returns true when the artifact body is held in a file.
+func (a Artifact) Spilled() bool {
+	return a.spill != nil
+}
+
+// Open returns a reader of the artifact body, it must be closed once read.
+func (a Artifact) Open() (io.ReadSeekCloser, error) {
+	if a.spill != nil {
+		return os.Open(a.spill.path)
+	}
+	return nopCloser{bytes.NewReader(a.Body)}, nil
+}
+
+// Acquire holds the spilled body of the artifact for another reader, it returns false when the body was already
+// released by all its holders. The artifact must be released once it was read.
+func (a Artifact) Acquire() bool {
+	if a.spill == nil {
+		return true
+	}
+	for {
+		n := a.spill.refs.Load()
+		if n <= 0 {
+			return false
+		}
+		if a.spill.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// Release releases the spilled body of the artifact, the file is removed once no one holds it.
+func (a Artifact) Release() {
+	if a.spill == nil || a.spill.refs.Add(-1) != 0 {
+		return
+	}
+	if err := os.Remove(a.spill.path); err != nil {
+		zerolog.Ctx(context.TODO()).Warn().Err(err).Str("path", a.spill.path).Msg("Unable to remove spilled artifact")
+	}
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
+
+// readArtifact reads the artifact body from r. A body larger than spillSize is written to a file in dir, a negative
+// spillSize holds the body in memory whatever its size. The returned artifact is held by the caller.
+func readArtifact(artifact model.Artifact, r io.Reader, spillSize int64, dir string) (Artifact, error) {
+	if spillSize < 0 {
+		body, err := io.ReadAll(r)
+		if err != nil {
+			return Artifact{}, err
+		}
+		artifact.Body = body
+		return Artifact{Artifact: artifact}, nil
+	}
+
+	// The body is buffered until it exceeds spillSize.
+	body, err := io.ReadAll(io.LimitReader(r, spillSize+1))
+	if err != nil {
+		return Artifact{}, err
+	}
+	if int64(len(body)) <= spillSize {
+		artifact.Body = body
+		return Artifact{Artifact: artifact}, nil
+	}
+
+	spill, err := spillArtifact(dir, io.MultiReader(bytes.NewReader(body), r))
+	if err != nil {
+		return Artifact{}, err
+	}
+	artifact.Body = nil
+	return Artifact{Artifact: artifact, spill: spill}, nil
+}
+
+// spillArtifact writes the artifact body read from r to a new file in dir, the file is removed if r fails.
+func spillArtifact(dir string, r io.Reader) (*spillFile, error) {
+	f, err := os.CreateTemp(dir, spillPattern)
+	if err != nil {
+		return nil, err
+	}
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, errors.Join(err, os.Remove(f.Name()))
+	}
+	spill := &spillFile{path: f.Name(), size: n}
+	spill.refs.Store(1)
+	return spill, nil
+}
+
+// removeSpilled removes the artifact bodies spilled to dir by a previous run.
+func removeSpilled(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, spillPattern))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseEntry releases the spilled body of an artifact once its entry leaves the cache.
+func releaseEntry(val interface{}) {
+	if entry, ok := val.(artifactEntry); ok {
+		entry.artifact.Release()
+	}
+}
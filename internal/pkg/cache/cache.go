@@ -9,8 +9,14 @@ package cache
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
+	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -28,14 +34,23 @@ type Cache interface {
 	SetAction(model.Action)
 	GetAction(id string) (model.Action, bool)
 
+	SetActionResults(agentID string, acked map[string]bool, ttl time.Duration)
+	GetActionResults(agentID string) (map[string]bool, bool)
+
 	SetAPIKey(key APIKey, enabled bool)
 	ValidAPIKey(key APIKey) bool
+	DeleteAPIKey(id string)
+
+	SetUnauthorizedAPIKey(key APIKey)
+	UnauthorizedAPIKey(key APIKey) bool
 
-	SetEnrollmentAPIKey(id string, key model.EnrollmentAPIKey, cost int64)
+	SetEnrollmentAPIKey(id string, key model.EnrollmentAPIKey)
 	GetEnrollmentAPIKey(id string) (model.EnrollmentAPIKey, bool)
+	DeleteEnrollmentAPIKey(id string)
 
 	SetArtifact(artifact model.Artifact)
-	GetArtifact(ident, sha2 string) (model.Artifact, bool)
+	LoadArtifact(artifact model.Artifact, r io.Reader) (Artifact, error)
+	GetArtifact(ident, sha2 string) (artifact Artifact, stale bool, ok bool)
 
 	SetUpload(id string, info file.Info)
 	GetUpload(id string) (file.Info, bool)
@@ -60,6 +75,11 @@ type actionCache struct {
 
 // New creates a new cache.
 func New(cfg config.Cache) (*CacheT, error) {
+	if cfg.ArtifactSpillDir != "" {
+		if err := removeSpilled(cfg.ArtifactSpillDir); err != nil {
+			return nil, fmt.Errorf("unable to clean the artifact spill directory: %w", err)
+		}
+	}
 	cache, err := newCache(cfg)
 	if err != nil {
 		return nil, err
@@ -69,15 +89,93 @@ func New(cfg config.Cache) (*CacheT, error) {
 		cache: cache,
 		cfg:   cfg,
 	}
+	tracked.Store(&c)
 
 	return &c, nil
 }
 
+// stats returns the cost of the entries held by the cache and the ratio of the lookups that hit, zero for a nil cache.
+func (c *CacheT) stats() (int64, float64) {
+	if c == nil {
+		return 0, 0
+	}
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+	return statsOf(c.cache)
+}
+
+// Stats are the statistics of the cache since it was last configured.
+type Stats struct {
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	Cost        int64  `json:"cost"`
+	KeysAdded   uint64 `json:"keys_added"`
+	KeysEvicted uint64 `json:"keys_evicted"`
+}
+
+// Stats returns the statistics of the cache.
+func (c *CacheT) Stats() Stats {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+	return metricsOf(c.cache)
+}
+
+// Kinds of the entries that can be evicted with Evict.
+const (
+	KindAPIKey   = "apikey"
+	KindArtifact = "artifact"
+	KindAction   = "action"
+)
+
+var ErrUnknownKind = errors.New("unknown kind of cache entry")
+
+// Evict removes an entry from the cache, so that it is read from Elasticsearch on its next use.
+// The key of an API key is its ID, the key of an artifact is its identifier and decoded sha256 separated by a colon,
+// and the key of an action is its ID.
+func (c *CacheT) Evict(kind, key string) error {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+
+	var scopedKey string
+	switch kind {
+	case KindAPIKey:
+		scopedKey = "api:" + key
+	case KindArtifact:
+		ident, sha2, ok := strings.Cut(key, ":")
+		if !ok {
+			return fmt.Errorf("artifact key %q is not <identifier>:<sha256>", key)
+		}
+		scopedKey = makeArtifactKey(ident, sha2)
+	case KindAction:
+		scopedKey = "action:" + key
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownKind, kind)
+	}
+	c.cache.Del(scopedKey)
+	zerolog.Ctx(context.TODO()).Debug().Str("kind", kind).Str("key", scopedKey).Msg("cache entry evicted")
+	return nil
+}
+
+// maxCost returns the configured max_cost, zero for a nil cache.
+func (c *CacheT) maxCost() int64 {
+	if c == nil {
+		return 0
+	}
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+	return c.cfg.MaxCost
+}
+
 // Reconfigure will drop cache
 func (c *CacheT) Reconfigure(cfg config.Cache) error {
 	c.mut.Lock()
 	defer c.mut.Unlock()
 
+	if cfg.ArtifactSpillDir != "" {
+		if err := os.MkdirAll(cfg.ArtifactSpillDir, 0o700); err != nil {
+			return err
+		}
+	}
 	cache, err := newCache(cfg)
 	if err != nil {
 		return err
@@ -92,6 +190,13 @@ func (c *CacheT) Reconfigure(cfg config.Cache) error {
 	return nil
 }
 
+// get returns the value of the key and counts the lookup as a hit or miss of the kind of entry.
+func (c *CacheT) get(kind, key string) (interface{}, bool) {
+	v, ok := c.cache.Get(key)
+	observeLookup(kind, ok)
+	return v, ok
+}
+
 // SetAction sets an action in the cache.
 //
 // This will only cache the action ID and action Type. So `GetAction` will only
@@ -105,13 +210,13 @@ func (c *CacheT) SetAction(action model.Action) {
 		actionID:   action.ActionID,
 		actionType: action.Type,
 	}
-	cost := len(action.ActionID) + len(action.Type)
+	cost := entryCost(scopedKey, len(action.ActionID)+len(action.Type))
 	ttl := c.cfg.ActionTTL
-	ok := c.cache.SetWithTTL(scopedKey, v, int64(cost), ttl)
+	ok := c.cache.SetWithTTL(scopedKey, v, cost, ttl)
 	zerolog.Ctx(context.TODO()).Trace().
 		Bool("ok", ok).
 		Str("id", action.ActionID).
-		Int("cost", cost).
+		Int64("cost", cost).
 		Msg("Action cache SET")
 }
 
@@ -125,7 +230,7 @@ func (c *CacheT) GetAction(id string) (model.Action, bool) {
 
 	log := zerolog.Ctx(context.TODO())
 	scopedKey := "action:" + id
-	if v, ok := c.cache.Get(scopedKey); ok {
+	if v, ok := c.get(lookupAction, scopedKey); ok {
 		log.Trace().Str("id", id).Msg("Action cache HIT")
 		action, ok := v.(actionCache)
 		if !ok {
@@ -142,6 +247,51 @@ func (c *CacheT) GetAction(id string) (model.Action, bool) {
 	return model.Action{}, false
 }
 
+// SetActionResults caches whether the agent has acked the actions, keyed by action ID.
+//
+// The map must not be modified after it is passed in, it is shared with the callers of GetActionResults.
+func (c *CacheT) SetActionResults(agentID string, acked map[string]bool, ttl time.Duration) {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+
+	scopedKey := "action_results:" + agentID
+	size := 0
+	for id := range acked {
+		size += len(id) + 1
+	}
+	cost := entryCost(scopedKey, size)
+	ok := c.cache.SetWithTTL(scopedKey, acked, cost, ttl)
+	zerolog.Ctx(context.TODO()).Trace().
+		Bool("ok", ok).
+		Str("id", agentID).
+		Int64("cost", cost).
+		Dur("ttl", ttl).
+		Msg("Action results cache SET")
+}
+
+// GetActionResults returns whether the agent has acked the cached actions, keyed by action ID.
+//
+// The returned map must not be modified.
+func (c *CacheT) GetActionResults(agentID string) (map[string]bool, bool) {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+
+	log := zerolog.Ctx(context.TODO())
+	scopedKey := "action_results:" + agentID
+	if v, ok := c.get(lookupActionResults, scopedKey); ok {
+		log.Trace().Str("id", agentID).Msg("Action results cache HIT")
+		acked, ok := v.(map[string]bool)
+		if !ok {
+			log.Error().Str("id", agentID).Msg("Action results cache cast fail")
+			return nil, false
+		}
+		return acked, ok
+	}
+
+	log.Trace().Str("id", agentID).Msg("Action results cache MISS")
+	return nil, false
+}
+
 // SetAPIKey sets the API key in the cache.
 func (c *CacheT) SetAPIKey(key APIKey, enabled bool) {
 	c.mut.RLock()
@@ -149,9 +299,9 @@ func (c *CacheT) SetAPIKey(key APIKey, enabled bool) {
 
 	scopedKey := "api:" + key.ID
 
-	// Use the valid key as the payload of the record;
+	// Use the hash of the valid key as the payload of the record;
 	// If caller has marked key as not enabled, use empty string.
-	val := key.Key
+	val := hashAPIKey(key)
 	if !enabled {
 		val = ""
 	}
@@ -168,14 +318,14 @@ func (c *CacheT) SetAPIKey(key APIKey, enabled bool) {
 		}
 	}
 
-	cost := len(scopedKey) + len(val)
-	ok := c.cache.SetWithTTL(scopedKey, val, int64(cost), ttl)
+	cost := entryCost(scopedKey, len(val))
+	ok := c.cache.SetWithTTL(scopedKey, val, cost, ttl)
 	zerolog.Ctx(context.TODO()).Trace().
 		Bool("ok", ok).
 		Bool("enabled", enabled).
 		Str("key", key.ID).
 		Dur("ttl", ttl).
-		Int("cost", cost).
+		Int64("cost", cost).
 		Msg("ApiKey cache SET")
 }
 
@@ -186,12 +336,12 @@ func (c *CacheT) ValidAPIKey(key APIKey) bool {
 
 	log := zerolog.Ctx(context.TODO())
 	scopedKey := "api:" + key.ID
-	v, ok := c.cache.Get(scopedKey)
+	v, ok := c.get(lookupAPIKey, scopedKey)
 	if ok {
 		switch v {
 		case "":
 			log.Trace().Str("id", key.ID).Msg("ApiKey cache HIT on disabled KEY")
-		case key.Key:
+		case hashAPIKey(key):
 			log.Trace().Str("id", key.ID).Msg("ApiKey cache HIT")
 		default:
 			log.Trace().Str("id", key.ID).Msg("ApiKey cache MISMATCH")
@@ -203,6 +353,53 @@ func (c *CacheT) ValidAPIKey(key APIKey) bool {
 	return ok
 }
 
+// DeleteAPIKey removes the API key from the cache, so that it is authenticated again on its next use.
+func (c *CacheT) DeleteAPIKey(id string) {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+
+	c.cache.Del("api:" + id)
+	zerolog.Ctx(context.TODO()).Trace().Str("id", id).Msg("ApiKey cache DEL")
+}
+
+// SetUnauthorizedAPIKey caches that the API key failed authentication.
+//
+// The record is keyed by the hash of the key, as the ID of a bogus key can not be trusted.
+// It expires after a short TTL so that a key is not rejected for long if Elasticsearch failed to authenticate it transiently.
+func (c *CacheT) SetUnauthorizedAPIKey(key APIKey) {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+
+	scopedKey := "api_neg:" + hashAPIKey(key)
+	ttl := c.cfg.APIKeyNegTTL
+	cost := entryCost(scopedKey, 0)
+	ok := c.cache.SetWithTTL(scopedKey, struct{}{}, cost, ttl)
+	zerolog.Ctx(context.TODO()).Trace().
+		Bool("ok", ok).
+		Str("key", key.ID).
+		Dur("ttl", ttl).
+		Int64("cost", cost).
+		Msg("Unauthorized ApiKey cache SET")
+}
+
+// UnauthorizedAPIKey returns true if the API key failed authentication within the negative cache TTL.
+func (c *CacheT) UnauthorizedAPIKey(key APIKey) bool {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+
+	_, ok := c.get(lookupAPIKeyNegative, "api_neg:"+hashAPIKey(key))
+	if ok {
+		zerolog.Ctx(context.TODO()).Trace().Str("id", key.ID).Msg("Unauthorized ApiKey cache HIT")
+	}
+	return ok
+}
+
+// hashAPIKey returns the hash of the API key, so that the cache does not hold raw credentials.
+func hashAPIKey(key APIKey) string {
+	h := sha256.Sum256([]byte(key.ID + ":" + key.Key))
+	return hex.EncodeToString(h[:])
+}
+
 // GetEnrollmentAPIKey returns the enrollment API key by ID.
 func (c *CacheT) GetEnrollmentAPIKey(id string) (model.EnrollmentAPIKey, bool) { //nolint:dupl // similar getters to support strong typing
 	c.mut.RLock()
@@ -210,7 +407,7 @@ func (c *CacheT) GetEnrollmentAPIKey(id string) (model.EnrollmentAPIKey, bool) {
 
 	log := zerolog.Ctx(context.TODO())
 	scopedKey := "record:" + id
-	if v, ok := c.cache.Get(scopedKey); ok {
+	if v, ok := c.get(lookupEnrollmentAPIKey, scopedKey); ok {
 		log.Trace().Str("id", id).Msg("Enrollment cache HIT")
 		key, ok := v.(model.EnrollmentAPIKey)
 
@@ -226,11 +423,12 @@ func (c *CacheT) GetEnrollmentAPIKey(id string) (model.EnrollmentAPIKey, bool) {
 }
 
 // SetEnrollmentAPIKey adds the enrollment API key into the cache.
-func (c *CacheT) SetEnrollmentAPIKey(id string, key model.EnrollmentAPIKey, cost int64) {
+func (c *CacheT) SetEnrollmentAPIKey(id string, key model.EnrollmentAPIKey) {
 	c.mut.RLock()
 	defer c.mut.RUnlock()
 
 	scopedKey := "record:" + id
+	cost := enrollmentAPIKeyCost(scopedKey, key)
 	ttl := c.cfg.EnrollKeyTTL
 	ok := c.cache.SetWithTTL(scopedKey, key, cost, ttl)
 	zerolog.Ctx(context.TODO()).Trace().
@@ -241,48 +439,113 @@ func (c *CacheT) SetEnrollmentAPIKey(id string, key model.EnrollmentAPIKey, cost
 		Msg("EnrollmentApiKey cache SET")
 }
 
+// DeleteEnrollmentAPIKey removes the enrollment API key from the cache.
+func (c *CacheT) DeleteEnrollmentAPIKey(id string) {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+
+	c.cache.Del("record:" + id)
+	zerolog.Ctx(context.TODO()).Trace().Str("id", id).Msg("EnrollmentApiKey cache DEL")
+}
+
+// makeArtifactKey returns the key of an artifact in its own namespace of the cache.
+// The sha256 comes first, prefixed with its length, so that no identifier can make two artifacts share a key.
 func makeArtifactKey(ident, sha2 string) string {
-	return fmt.Sprintf("artifact:%s:%s", ident, sha2)
+	return fmt.Sprintf("artifact:%d:%s:%s", len(sha2), sha2, ident)
+}
+
+// artifactEntry is a cached artifact and the time after which it should be refreshed.
+type artifactEntry struct {
+	artifact  Artifact
+	refreshAt time.Time
 }
 
-func (c *CacheT) GetArtifact(ident, sha2 string) (model.Artifact, bool) {
+// GetArtifact returns the cached artifact, it must be released once it was served.
+//
+// stale is set once the remaining TTL of the entry drops below the refresh_artifact_fraction of ttl_artifact,
+// the artifact can still be served while it is fetched again.
+func (c *CacheT) GetArtifact(ident, sha2 string) (Artifact, bool, bool) {
 	c.mut.RLock()
 	defer c.mut.RUnlock()
 
 	log := zerolog.Ctx(context.TODO())
 	scopedKey := makeArtifactKey(ident, sha2)
-	if v, ok := c.cache.Get(scopedKey); ok {
+	if v, ok := c.get(lookupArtifact, scopedKey); ok {
 		log.Trace().Str("key", scopedKey).Msg("Artifact cache HIT")
-		key, ok := v.(model.Artifact)
+		entry, ok := v.(artifactEntry)
 
 		if !ok {
 			log.Error().Str("sha2", sha2).Msg("Artifact cache cast fail")
-			return model.Artifact{}, false
+			return Artifact{}, false, false
 		}
-		return key, ok
+		// The spilled body is released once the entry is evicted, it is a miss if that already happened.
+		if !entry.artifact.Acquire() {
+			log.Trace().Str("key", scopedKey).Msg("Artifact cache spilled body released")
+			return Artifact{}, false, false
+		}
+		stale := !entry.refreshAt.IsZero() && time.Now().After(entry.refreshAt)
+		return entry.artifact, stale, ok
 	}
 
 	log.Trace().Str("key", scopedKey).Msg("Artifact cache MISS")
-	return model.Artifact{}, false
+	return Artifact{}, false, false
 }
 
-// SetArtifact will set the cached artifact
-// TODO: strip body and spool to on disk cache if larger than a size threshold
+// SetArtifact will set the cached artifact, its body is held in memory.
 func (c *CacheT) SetArtifact(artifact model.Artifact) {
 	c.mut.RLock()
 	defer c.mut.RUnlock()
 
+	c.setArtifact(Artifact{Artifact: artifact})
+}
+
+// LoadArtifact reads the decoded body of the artifact from r and caches the artifact. A body larger than
+// spill_artifact_size is written to a file in spill_artifact_dir as it is read instead of being held in memory.
+//
+// Nothing is cached when r fails. The returned artifact must be released once it was served.
+func (c *CacheT) LoadArtifact(artifact model.Artifact, r io.Reader) (Artifact, error) {
+	// The body is read without holding the lock, so a reconfiguration does not wait for it.
+	c.mut.RLock()
+	spillSize, spillDir := c.cfg.ArtifactSpillSize, c.cfg.ArtifactSpillDir
+	c.mut.RUnlock()
+
+	art, err := readArtifact(artifact, r, spillSize, spillDir)
+	if err != nil {
+		return Artifact{}, err
+	}
+
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+	// The cache holds the artifact until the entry is evicted.
+	art.Acquire()
+	if !c.setArtifact(art) {
+		art.Release()
+	}
+	return art, nil
+}
+
+// setArtifact sets the artifact entry and returns false if it was dropped, the spilled body of the artifact is
+// released once the entry leaves the cache.
+func (c *CacheT) setArtifact(artifact Artifact) bool {
 	scopedKey := makeArtifactKey(artifact.Identifier, artifact.DecodedSha256)
-	cost := int64(len(artifact.Body))
+	// A spilled body is not held in memory, it is not part of the cost.
+	cost := artifactCost(scopedKey, artifact.Artifact)
 	ttl := c.cfg.ArtifactTTL
 
-	ok := c.cache.SetWithTTL(scopedKey, artifact, cost, ttl)
+	entry := artifactEntry{artifact: artifact}
+	if c.cfg.ArtifactRefreshFraction > 0 {
+		entry.refreshAt = time.Now().Add(ttl - time.Duration(float64(ttl)*c.cfg.ArtifactRefreshFraction))
+	}
+
+	ok := c.cache.SetWithTTL(scopedKey, entry, cost, ttl)
 	zerolog.Ctx(context.TODO()).Trace().
 		Bool("ok", ok).
+		Bool("spilled", artifact.Spilled()).
 		Str("key", scopedKey).
 		Int64("cost", cost).
 		Dur("ttl", ttl).
 		Msg("Artifact cache SET")
+	return ok
 }
 
 func (c *CacheT) SetUpload(id string, info file.Info) {
@@ -291,8 +554,7 @@ func (c *CacheT) SetUpload(id string, info file.Info) {
 
 	scopedKey := "upload:" + id
 	ttl := 30 * time.Minute // @todo: add to configurable
-	// cache cost for other entries use bytes as the unit. Add up the string lengths and the size of the int64s in the upload.Info struct, as a manual 'sizeof'
-	cost := int64(len(info.ID) + len(info.DocID) + len(info.ActionID) + len(info.AgentID) + len(info.Source) + len(info.Status) + 8*4)
+	cost := uploadCost(scopedKey, info)
 	ok := c.cache.SetWithTTL(scopedKey, info, cost, ttl)
 	zerolog.Ctx(context.TODO()).Trace().
 		Bool("ok", ok).
@@ -307,7 +569,7 @@ func (c *CacheT) GetUpload(id string) (file.Info, bool) { //nolint:dupl // a lit
 
 	log := zerolog.Ctx(context.TODO())
 	scopedKey := "upload:" + id
-	if v, ok := c.cache.Get(scopedKey); ok {
+	if v, ok := c.get(lookupUpload, scopedKey); ok {
 		log.Trace().Str("id", id).Msg("upload info cache HIT")
 		key, ok := v.(file.Info)
 		if !ok {
@@ -327,11 +589,12 @@ func (c *CacheT) SetPGPKey(id string, p []byte) {
 
 	scopedKey := "pgp:" + id
 	ttl := 30 * time.Minute // @todo: add to configurable
-	ok := c.cache.SetWithTTL(scopedKey, p, int64(len(p)), ttl)
+	cost := entryCost(scopedKey, len(p))
+	ok := c.cache.SetWithTTL(scopedKey, p, cost, ttl)
 	zerolog.Ctx(context.TODO()).Trace().
 		Bool("ok", ok).
 		Str("id", id).
-		Int("cost", len(p)).
+		Int64("cost", cost).
 		Dur("ttl", ttl).
 		Msg("PGP key cache SET")
 
@@ -342,7 +605,7 @@ func (c *CacheT) GetPGPKey(id string) ([]byte, bool) {
 
 	log := zerolog.Ctx(context.TODO())
 	scopedKey := "pgp:" + id
-	if v, ok := c.cache.Get(scopedKey); ok {
+	if v, ok := c.get(lookupPGPKey, scopedKey); ok {
 		log.Trace().Str("id", id).Msg("PGP key cache HIT")
 		key, ok := v.([]byte)
 		if !ok {
@@ -0,0 +1,300 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+)
+
+func newTestCache(t *testing.T, cfg config.Cache) *CacheT {
+	t.Helper()
+	cfg.NumCounters = 100
+	cfg.MaxCost = 100000
+	c, err := New(cfg)
+	require.NoError(t, err)
+	t.Cleanup(c.cache.Close)
+	return c
+}
+
+// wait blocks until the buffered writes are applied to the cache.
+func (c *CacheT) wait() {
+	c.cache.(*ristretto.Cache).Wait()
+}
+
+func TestAPIKeyCache(t *testing.T) {
+	key := APIKey{ID: "keyID", Key: "secret"}
+
+	t.Run("delete", func(t *testing.T) {
+		c := newTestCache(t, config.Cache{APIKeyTTL: time.Hour})
+		c.SetAPIKey(key, true)
+		c.wait()
+		require.True(t, c.ValidAPIKey(key))
+		assert.False(t, c.ValidAPIKey(APIKey{ID: key.ID, Key: "other"}))
+
+		// the raw key is not held by the cache
+		v, ok := c.cache.Get("api:" + key.ID)
+		require.True(t, ok)
+		assert.NotEqual(t, key.Key, v)
+
+		c.DeleteAPIKey(key.ID)
+		assert.False(t, c.ValidAPIKey(key))
+	})
+
+	t.Run("ttl", func(t *testing.T) {
+		c := newTestCache(t, config.Cache{APIKeyTTL: 100 * time.Millisecond})
+		c.SetAPIKey(key, true)
+		c.wait()
+		require.True(t, c.ValidAPIKey(key))
+
+		// an invalidated key stops authenticating from the cache once its TTL elapsed
+		assert.Eventually(t, func() bool {
+			return !c.ValidAPIKey(key)
+		}, time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestUnauthorizedAPIKeyCache(t *testing.T) {
+	key := APIKey{ID: "keyID", Key: "bogus"}
+	c := newTestCache(t, config.Cache{APIKeyNegTTL: 100 * time.Millisecond})
+
+	assert.False(t, c.UnauthorizedAPIKey(key))
+	c.SetUnauthorizedAPIKey(key)
+	c.wait()
+	assert.True(t, c.UnauthorizedAPIKey(key))
+
+	// the record is keyed by the whole key, not only its ID
+	assert.False(t, c.UnauthorizedAPIKey(APIKey{ID: key.ID, Key: "secret"}))
+	assert.False(t, c.ValidAPIKey(key))
+
+	assert.Eventually(t, func() bool {
+		return !c.UnauthorizedAPIKey(key)
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestArtifactCache(t *testing.T) {
+	artifact := model.Artifact{Identifier: "endpoint-exceptionlist", DecodedSha256: "abc", Body: []byte("body")}
+
+	t.Run("stale before expiry", func(t *testing.T) {
+		c := newTestCache(t, config.Cache{ArtifactTTL: time.Second, ArtifactRefreshFraction: 0.8})
+		c.SetArtifact(artifact)
+		c.wait()
+
+		got, stale, ok := c.GetArtifact(artifact.Identifier, artifact.DecodedSha256)
+		require.True(t, ok)
+		assert.False(t, stale)
+		assert.Equal(t, artifact, got.Artifact)
+
+		// the entry is still served once it is due for a refresh
+		assert.Eventually(t, func() bool {
+			got, stale, ok := c.GetArtifact(artifact.Identifier, artifact.DecodedSha256)
+			return ok && stale && assert.ObjectsAreEqual(artifact, got.Artifact)
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("refresh disabled", func(t *testing.T) {
+		c := newTestCache(t, config.Cache{ArtifactTTL: 100 * time.Millisecond, ArtifactRefreshFraction: -1})
+		c.SetArtifact(artifact)
+		c.wait()
+
+		_, stale, ok := c.GetArtifact(artifact.Identifier, artifact.DecodedSha256)
+		require.True(t, ok)
+		assert.False(t, stale)
+
+		assert.Eventually(t, func() bool {
+			_, stale, ok := c.GetArtifact(artifact.Identifier, artifact.DecodedSha256)
+			require.False(t, stale)
+			return !ok
+		}, time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestArtifactCacheKeys(t *testing.T) {
+	c := newTestCache(t, config.Cache{ArtifactTTL: time.Hour})
+	c.SetArtifact(model.Artifact{Identifier: "a:b", DecodedSha256: "c", Body: []byte("body")})
+	c.wait()
+
+	_, _, ok := c.GetArtifact("a:b", "c")
+	require.True(t, ok)
+	// the identifier can not reach another artifact or the api keys
+	_, _, ok = c.GetArtifact("a", "b:c")
+	assert.False(t, ok)
+	assert.NotEqual(t, makeArtifactKey("a:b", "c"), makeArtifactKey("a", "b:c"))
+	assert.False(t, strings.HasPrefix(makeArtifactKey("api", "key"), "api:"))
+}
+
+func TestArtifactCacheCost(t *testing.T) {
+	const maxCost = 1 << 20
+	c, err := New(config.Cache{NumCounters: 1000, MaxCost: maxCost, ArtifactTTL: time.Hour})
+	require.NoError(t, err)
+	t.Cleanup(c.cache.Close)
+	assert.Same(t, c, tracked.Load())
+
+	// the bodies of the artifacts sum to 4 times max_cost
+	const count = 16
+	artifact := func(i int) model.Artifact {
+		return model.Artifact{
+			Identifier:    fmt.Sprintf("endpoint-trustlist-%d", i),
+			DecodedSha256: fmt.Sprintf("sha-%d", i),
+			Body:          make([]byte, 256<<10),
+		}
+	}
+	for i := 0; i < count; i++ {
+		c.SetArtifact(artifact(i))
+		c.wait()
+	}
+
+	resident, hits := 0, 0
+	for i := 0; i < count; i++ {
+		a := artifact(i)
+		if got, _, ok := c.GetArtifact(a.Identifier, a.DecodedSha256); ok {
+			resident += len(got.Body)
+			hits++
+		}
+	}
+	assert.Positive(t, resident)
+	assert.LessOrEqual(t, resident, maxCost)
+
+	cost, ratio := c.stats()
+	assert.GreaterOrEqual(t, cost, int64(resident))
+	assert.LessOrEqual(t, cost, int64(maxCost))
+	assert.InDelta(t, float64(hits)/count, ratio, 0.001)
+
+	t.Run("artifact over max_cost", func(t *testing.T) {
+		a := model.Artifact{Identifier: "endpoint-blocklist", DecodedSha256: "large", Body: make([]byte, maxCost)}
+		c.SetArtifact(a)
+		c.wait()
+		_, _, ok := c.GetArtifact(a.Identifier, a.DecodedSha256)
+		assert.False(t, ok)
+	})
+}
+
+// readBody returns the body of the artifact.
+func readBody(t *testing.T, artifact Artifact) []byte {
+	t.Helper()
+	r, err := artifact.Open()
+	require.NoError(t, err)
+	defer r.Close()
+	body, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return body
+}
+
+// spilledFiles returns the artifact bodies spilled to dir.
+func spilledFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, spillPattern))
+	require.NoError(t, err)
+	return paths
+}
+
+func TestArtifactCacheSpill(t *testing.T) {
+	dir := t.TempDir()
+	c := newTestCache(t, config.Cache{ArtifactTTL: time.Hour, ArtifactSpillSize: 16, ArtifactSpillDir: dir})
+
+	t.Run("small body in memory", func(t *testing.T) {
+		artifact := model.Artifact{Identifier: "endpoint-exceptionlist", DecodedSha256: "small"}
+		loaded, err := c.LoadArtifact(artifact, strings.NewReader("small body"))
+		require.NoError(t, err)
+		defer loaded.Release()
+		assert.False(t, loaded.Spilled())
+		assert.Equal(t, "small body", string(loaded.Body))
+		assert.Empty(t, spilledFiles(t, dir))
+	})
+
+	t.Run("large body on disk", func(t *testing.T) {
+		body := strings.Repeat("large body ", 100)
+		artifact := model.Artifact{Identifier: "endpoint-exceptionlist", DecodedSha256: "large"}
+		loaded, err := c.LoadArtifact(artifact, strings.NewReader(body))
+		require.NoError(t, err)
+		require.True(t, loaded.Spilled())
+		assert.Empty(t, loaded.Body)
+		assert.Equal(t, int64(len(body)), loaded.Size())
+		assert.Equal(t, body, string(readBody(t, loaded)))
+		c.wait()
+		loaded.Release()
+
+		// the cache holds the file
+		require.Len(t, spilledFiles(t, dir), 1)
+		got, _, ok := c.GetArtifact(artifact.Identifier, artifact.DecodedSha256)
+		require.True(t, ok)
+		assert.Equal(t, body, string(readBody(t, got)))
+
+		// a reader holds the file once it is evicted
+		require.NoError(t, c.Evict(KindArtifact, artifact.Identifier+":"+artifact.DecodedSha256))
+		assert.Equal(t, body, string(readBody(t, got)))
+		got.Release()
+		assert.Empty(t, spilledFiles(t, dir))
+		assert.False(t, got.Acquire())
+	})
+
+	t.Run("read failure", func(t *testing.T) {
+		errRead := errors.New("read failure")
+		artifact := model.Artifact{Identifier: "endpoint-exceptionlist", DecodedSha256: "failed"}
+		_, err := c.LoadArtifact(artifact, io.MultiReader(strings.NewReader(strings.Repeat("partial body ", 100)), iotest.ErrReader(errRead)))
+		require.ErrorIs(t, err, errRead)
+		c.wait()
+
+		// nothing is cached and the partial body is removed
+		_, _, ok := c.GetArtifact(artifact.Identifier, artifact.DecodedSha256)
+		assert.False(t, ok)
+		assert.Empty(t, spilledFiles(t, dir))
+	})
+
+	t.Run("leftovers removed on start", func(t *testing.T) {
+		leftover := filepath.Join(dir, "fleet-server-artifact-leftover")
+		other := filepath.Join(dir, "other")
+		require.NoError(t, os.WriteFile(leftover, []byte("body"), 0o600))
+		require.NoError(t, os.WriteFile(other, []byte("other"), 0o600))
+		newTestCache(t, config.Cache{ArtifactSpillDir: dir})
+		assert.NoFileExists(t, leftover)
+		assert.FileExists(t, other)
+	})
+}
+
+func TestCacheEvict(t *testing.T) {
+	c := newTestCache(t, config.Cache{APIKeyTTL: time.Hour, ArtifactTTL: time.Hour, ActionTTL: time.Hour})
+	key := APIKey{ID: "keyID", Key: "secret"}
+	artifact := model.Artifact{Identifier: "endpoint-exceptionlist", DecodedSha256: "abc", Body: []byte("body")}
+	action := model.Action{ActionID: "actionID", Type: "UPGRADE"}
+	c.SetAPIKey(key, true)
+	c.SetArtifact(artifact)
+	c.SetAction(action)
+	c.wait()
+
+	require.NoError(t, c.Evict(KindAPIKey, key.ID))
+	assert.False(t, c.ValidAPIKey(key))
+
+	require.NoError(t, c.Evict(KindArtifact, artifact.Identifier+":"+artifact.DecodedSha256))
+	_, _, ok := c.GetArtifact(artifact.Identifier, artifact.DecodedSha256)
+	assert.False(t, ok)
+
+	require.NoError(t, c.Evict(KindAction, action.ActionID))
+	_, ok = c.GetAction(action.ActionID)
+	assert.False(t, ok)
+
+	assert.ErrorIs(t, c.Evict("upload", "id"), ErrUnknownKind)
+	assert.Error(t, c.Evict(KindArtifact, "no-sha"))
+
+	stats := c.Stats()
+	assert.Equal(t, uint64(3), stats.KeysAdded)
+	assert.Equal(t, uint64(3), stats.Misses)
+}
@@ -0,0 +1,47 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package cache
+
+import (
+	"github.com/elastic/fleet-server/v7/internal/pkg/file"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+)
+
+// The cost of the entries is their size in bytes, so that max_cost bounds the memory held by the cache.
+
+// entryOverhead is the memory used by an entry besides its key and the bytes of its value: the headers of
+// the strings and slices of the value and the bookkeeping of the cache for the key.
+const entryOverhead = 128
+
+// entryCost returns the cost of an entry whose value holds size bytes.
+func entryCost(scopedKey string, size int) int64 {
+	return int64(len(scopedKey) + size + entryOverhead)
+}
+
+// artifactCost returns the cost of an artifact, its decoded body is most of it.
+func artifactCost(scopedKey string, artifact model.Artifact) int64 {
+	return entryCost(scopedKey, len(artifact.Body)+len(artifact.Identifier)+len(artifact.DecodedSha256)+
+		len(artifact.EncodedSha256)+len(artifact.CompressionAlgorithm)+len(artifact.EncryptionAlgorithm)+
+		len(artifact.Created)+len(artifact.PackageName)+len(artifact.Id))
+}
+
+// enrollmentAPIKeyCost returns the cost of an enrollment API key record.
+func enrollmentAPIKeyCost(scopedKey string, key model.EnrollmentAPIKey) int64 {
+	size := len(key.Id) + len(key.APIKey) + len(key.APIKeyID) + len(key.CreatedAt) + len(key.ExpireAt) +
+		len(key.ExpiresAt) + len(key.Name) + len(key.PolicyID) + len(key.UpdatedAt)
+	for _, ns := range key.Namespaces {
+		size += len(ns)
+	}
+	return entryCost(scopedKey, size)
+}
+
+// uploadCost returns the cost of the upload info, the int64 fields are counted as 8 bytes each.
+func uploadCost(scopedKey string, info file.Info) int64 {
+	size := len(info.ID) + len(info.DocID) + len(info.ActionID) + len(info.AgentID) + len(info.Source) + len(info.Status) + 8*4
+	for _, ns := range info.Namespaces {
+		size += len(ns)
+	}
+	return entryCost(scopedKey, size)
+}
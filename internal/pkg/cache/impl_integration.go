@@ -16,19 +16,34 @@ func newCache(_ config.Cache) (Cacher, error) {
 	return &NoCache{}, nil
 }
 
+// statsOf returns the cost and the hit ratio of the cache, NoCache holds nothing.
+func statsOf(_ Cacher) (int64, float64) {
+	return 0, 0
+}
+
+// metricsOf returns the statistics of the cache, NoCache holds nothing.
+func metricsOf(_ Cacher) Stats {
+	return Stats{}
+}
+
 type NoCache struct{}
 
 func (c *NoCache) Get(_ interface{}) (interface{}, bool) {
 	return nil, false
 }
 
-func (c *NoCache) Set(_ interface{}, _ interface{}, _ int64) bool {
+func (c *NoCache) Set(_ interface{}, value interface{}, _ int64) bool {
+	releaseEntry(value)
 	return true
 }
 
-func (c *NoCache) SetWithTTL(_, _ interface{}, _ int64, _ time.Duration) bool {
+func (c *NoCache) SetWithTTL(_, value interface{}, _ int64, _ time.Duration) bool {
+	releaseEntry(value)
 	return true
 }
 
+func (c *NoCache) Del(_ interface{}) {
+}
+
 func (c *NoCache) Close() {
 }
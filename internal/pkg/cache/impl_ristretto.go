@@ -17,7 +17,36 @@ func newCache(cfg config.Cache) (Cacher, error) {
 		NumCounters: cfg.NumCounters,
 		MaxCost:     cfg.MaxCost,
 		BufferItems: 64,
+		// Metrics are needed to report the cost held by the cache.
+		Metrics: true,
+		// The spilled artifact bodies are removed once their entries are evicted.
+		OnExit: releaseEntry,
 	}
 
 	return ristretto.NewCache(rcfg)
 }
+
+// statsOf returns the cost of the entries held by the cache and the ratio of the lookups that hit.
+func statsOf(c Cacher) (cost int64, hitRatio float64) {
+	rc, ok := c.(*ristretto.Cache)
+	if !ok || rc.Metrics == nil {
+		return 0, 0
+	}
+	return int64(rc.Metrics.CostAdded() - rc.Metrics.CostEvicted()), rc.Metrics.Ratio()
+}
+
+// metricsOf returns the statistics of the cache.
+func metricsOf(c Cacher) Stats {
+	rc, ok := c.(*ristretto.Cache)
+	if !ok || rc.Metrics == nil {
+		return Stats{}
+	}
+	m := rc.Metrics
+	return Stats{
+		Hits:        m.Hits(),
+		Misses:      m.Misses(),
+		Cost:        int64(m.CostAdded() - m.CostEvicted()),
+		KeysAdded:   m.KeysAdded(),
+		KeysEvicted: m.KeysEvicted(),
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package cache
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Types of cache entries the lookups are counted by.
+const (
+	lookupAction           = "action"
+	lookupActionResults    = "actionResults"
+	lookupAPIKey           = "apiKey"
+	lookupAPIKeyNegative   = "apiKeyNegative"
+	lookupEnrollmentAPIKey = "enrollmentAPIKey"
+	lookupArtifact         = "artifact"
+	lookupUpload           = "upload"
+	lookupPGPKey           = "pgpKey"
+)
+
+var (
+	cacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cache",
+		Name:      "hit_total",
+		Help:      "Number of lookups found in the cache.",
+	}, []string{"type"})
+	cacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cache",
+		Name:      "miss_total",
+		Help:      "Number of lookups not found in the cache.",
+	}, []string{"type"})
+	cacheCost = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "cache",
+		Name:      "cost_bytes",
+		Help:      "Cost of the entries held by the cache, an estimate of their size in bytes.",
+	}, func() float64 {
+		cost, _ := tracked.Load().stats()
+		return float64(cost)
+	})
+	cacheMaxCost = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "cache",
+		Name:      "max_cost_bytes",
+		Help:      "Cost the cache evicts entries above, the configured max_cost.",
+	}, func() float64 {
+		return float64(tracked.Load().maxCost())
+	})
+	cacheHitRatio = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "cache",
+		Name:      "hit_ratio",
+		Help:      "Ratio of the lookups found in the cache since it was last configured.",
+	}, func() float64 {
+		_, ratio := tracked.Load().stats()
+		return ratio
+	})
+
+	// tracked is the cache reported by the cost and hit ratio gauges, the last one created.
+	tracked atomic.Pointer[CacheT]
+)
+
+func init() {
+	// Initialize the series of every type so they are exported before the first lookup.
+	for _, kind := range []string{lookupAction, lookupActionResults, lookupAPIKey, lookupAPIKeyNegative, lookupEnrollmentAPIKey, lookupArtifact, lookupUpload, lookupPGPKey} {
+		cacheHits.WithLabelValues(kind)
+		cacheMisses.WithLabelValues(kind)
+	}
+}
+
+// MetricsCollectors returns the prometheus collectors of the cache lookups.
+func MetricsCollectors() []prometheus.Collector {
+	return []prometheus.Collector{cacheHits, cacheMisses, cacheCost, cacheMaxCost, cacheHitRatio}
+}
+
+func observeLookup(kind string, hit bool) {
+	if hit {
+		cacheHits.WithLabelValues(kind).Inc()
+	} else {
+		cacheMisses.WithLabelValues(kind).Inc()
+	}
+}
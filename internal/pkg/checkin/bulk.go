@@ -8,11 +8,21 @@ package checkin
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
 	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
 	"github.com/elastic/fleet-server/v7/internal/pkg/sqn"
 
 	"github.com/rs/zerolog"
@@ -20,8 +30,23 @@ import (
 
 const defaultFlushInterval = 10 * time.Second
 
+// pendingOverhead approximates the serialized size of a pending checkin without its metadata and components.
+// It covers the bulk action line, the field names, and the timestamps.
+const pendingOverhead = 256
+
+// spoolDrainBatch is the number of spooled checkins written at once when the spool is drained.
+const spoolDrainBatch = 1024
+
+// fieldAgentVersion is the path of the agent version, the checkins only write the version of the agent object.
+const fieldAgentVersion = dl.FieldAgent + "." + dl.FieldAgentVersion
+
 type optionsT struct {
-	flushInterval time.Duration
+	flushInterval        time.Duration
+	flushMaxPendingBytes int
+	statusWriteInterval  time.Duration
+	mirror               *bulk.Mirror
+	spoolPath            string
+	spoolMaxSize         int64
 }
 
 type Opt func(*optionsT)
@@ -32,11 +57,47 @@ func WithFlushInterval(d time.Duration) Opt {
 	}
 }
 
+// WithFlushMaxPendingBytes flushes the pending checkins before the flush interval when their
+// approximate serialized size crosses n bytes. A value of 0 disables the size based flush.
+func WithFlushMaxPendingBytes(n int) Opt {
+	return func(opt *optionsT) {
+		opt.flushMaxPendingBytes = n
+	}
+}
+
+// WithStatusWriteInterval only rewrites the agent document of a checkin that changed nothing but the checkin time
+// if the document was last written more than d ago. The time of the skipped checkins is kept in memory, it is written
+// once d has elapsed or when the bulk checkin stops. A value of 0 writes every checkin.
+func WithStatusWriteInterval(d time.Duration) Opt {
+	return func(opt *optionsT) {
+		opt.statusWriteInterval = d
+	}
+}
+
+// WithMirror mirrors the checkin status updates to the secondary output of the mirror.
+// The agent documents are created in the secondary output if they do not exist.
+func WithMirror(m *bulk.Mirror) Opt {
+	return func(opt *optionsT) {
+		opt.mirror = m
+	}
+}
+
+// WithSpool queues the checkin updates that could not be written because elasticsearch was unreachable in a file at
+// path of at most maxSize bytes. The spool is drained once elasticsearch is reachable, only the newest update of
+// each agent is written. An empty path drops the updates that could not be written.
+func WithSpool(path string, maxSize int64) Opt {
+	return func(opt *optionsT) {
+		opt.spoolPath = path
+		opt.spoolMaxSize = maxSize
+	}
+}
+
 type extraT struct {
 	meta       []byte
 	seqNo      sqn.SeqNo
 	ver        string
 	components []byte
+	ip         string
 }
 
 // Minimize the size of this structure.
@@ -50,15 +111,78 @@ type pendingT struct {
 	unhealthyReason *[]string
 }
 
+// size returns the approximate serialized size of the pending checkin.
+func (p pendingT) size(id string) int {
+	n := pendingOverhead + len(id) + len(p.status) + len(p.message)
+	if p.extra != nil {
+		n += len(p.extra.meta) + len(p.extra.components) + len(p.extra.ver) + len(p.extra.ip)
+	}
+	if p.unhealthyReason != nil {
+		for _, r := range *p.unhealthyReason {
+			n += len(r)
+		}
+	}
+	return n
+}
+
+// writtenT is the last checkin of an agent that was queued for writing, and the time of the checkins skipped since.
+type writtenT struct {
+	// unix is the time the checkin was queued, in seconds.
+	unix            int64
+	status          string
+	message         string
+	unhealthyReason *[]string
+	// seen is the timestamp of the last skipped checkin, empty if there is none.
+	seen string
+}
+
+// unchanged returns true if a checkin with these values only changes the checkin time of the agent document.
+func (w writtenT) unchanged(status, message string, unhealthyReason *[]string) bool {
+	if w.status != status || w.message != message {
+		return false
+	}
+	if w.unhealthyReason == nil || unhealthyReason == nil {
+		return w.unhealthyReason == unhealthyReason
+	}
+	return slices.Equal(*w.unhealthyReason, *unhealthyReason)
+}
+
+// quarantineT holds the hashes of the local_metadata and components of an agent that elasticsearch rejected, 0 when
+// the field was not rejected.
+type quarantineT struct {
+	meta       uint64
+	components uint64
+}
+
+// hashPayload returns the hash of a checkin field, it is never 0.
+func hashPayload(p []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(p)
+	return max(h.Sum64(), 1)
+}
+
 // Bulk will batch pending checkins and update elasticsearch at a set interval.
 type Bulk struct {
 	opts    optionsT
 	bulker  bulk.Bulk
 	mut     sync.Mutex
 	pending map[string]pendingT
+	// written holds the last written checkin of the agents when the status writes are throttled.
+	written map[string]writtenT
+	// quarantined holds the fields rejected by elasticsearch of the agents, they are dropped from the checkins of the
+	// agent until they change.
+	quarantined map[string]quarantineT
+	// pendingBytes is the approximate serialized size of pending.
+	pendingBytes int
+	// flushCh signals Run to flush before the next tick.
+	flushCh chan struct{}
+	// spool holds the checkins that could not be written because elasticsearch was unreachable, nil when disabled.
+	// It is only used by flush.
+	spool *spool
 
 	ts   string
 	unix int64
+	now  func() time.Time
 }
 
 func NewBulk(bulker bulk.Bulk, opts ...Opt) *Bulk {
@@ -68,6 +192,11 @@ func NewBulk(bulker bulk.Bulk, opts ...Opt) *Bulk {
 		opts:    parsedOpts,
 		bulker:  bulker,
 		pending: make(map[string]pendingT),
+		written: make(map[string]writtenT),
+
+		quarantined: make(map[string]quarantineT),
+		flushCh:     make(chan struct{}, 1),
+		now:         time.Now,
 	}
 }
 
@@ -89,7 +218,7 @@ func parseOpts(opts ...Opt) optionsT {
 func (bc *Bulk) timestamp() string {
 
 	// WARNING: Expects mutex locked.
-	now := time.Now()
+	now := bc.now()
 	if now.Unix() != bc.unix {
 		bc.unix = now.Unix()
 		bc.ts = now.UTC().Format(time.RFC3339)
@@ -101,37 +230,121 @@ func (bc *Bulk) timestamp() string {
 // CheckIn will add the agent (identified by id) to the pending set.
 // The pending agents are sent to elasticsearch as a bulk update at each flush interval.
 // NOTE: If Checkin is called after Run has returned it will just add the entry to the pending map and not do any operations, this may occur when the fleet-server is shutting down.
+// The ip is the address the agent checked in from, it is only written when not empty.
 // WARNING: Bulk will take ownership of fields, so do not use after passing in.
-func (bc *Bulk) CheckIn(id string, status string, message string, meta []byte, components []byte, seqno sqn.SeqNo, newVer string, unhealthyReason *[]string) error {
+func (bc *Bulk) CheckIn(id string, status string, message string, meta []byte, components []byte, seqno sqn.SeqNo, newVer string, unhealthyReason *[]string, ip string) error {
+	bc.mut.Lock()
+
+	meta, components = bc.stripQuarantined(id, meta, components)
+
 	// Separate out the extra data to minimize
 	// the memory footprint of the 90% case of just
 	// updating the timestamp.
 	var extra *extraT
-	if meta != nil || seqno.IsSet() || newVer != "" || components != nil {
+	if meta != nil || seqno.IsSet() || newVer != "" || components != nil || ip != "" {
 		extra = &extraT{
 			meta:       meta,
 			seqNo:      seqno,
 			ver:        newVer,
 			components: components,
+			ip:         ip,
 		}
 	}
 
-	bc.mut.Lock()
+	ts := bc.timestamp()
+	if bc.opts.statusWriteInterval > 0 {
+		w, ok := bc.written[id]
+		if ok && extra == nil && bc.unix-w.unix < int64(bc.opts.statusWriteInterval.Seconds()) && w.unchanged(status, message, unhealthyReason) {
+			w.seen = ts
+			bc.written[id] = w
+			bc.mut.Unlock()
+			skipped.Inc()
+			return nil
+		}
+		bc.written[id] = writtenT{
+			unix:            bc.unix,
+			status:          status,
+			message:         message,
+			unhealthyReason: unhealthyReason,
+		}
+	}
 
-	bc.pending[id] = pendingT{
-		ts:              bc.timestamp(),
+	if prev, ok := bc.pending[id]; ok {
+		bc.pendingBytes -= prev.size(id)
+	}
+	p := pendingT{
+		ts:              ts,
 		status:          status,
 		message:         message,
 		extra:           extra,
 		unhealthyReason: unhealthyReason,
 	}
+	bc.pending[id] = p
+	bc.pendingBytes += p.size(id)
+	full := bc.opts.flushMaxPendingBytes > 0 && bc.pendingBytes >= bc.opts.flushMaxPendingBytes
 
 	bc.mut.Unlock()
+
+	if full {
+		select {
+		case bc.flushCh <- struct{}{}:
+		default:
+		}
+	}
 	return nil
 }
 
+// stripQuarantined drops the local_metadata and components of the agent that elasticsearch rejected before, so that
+// a rejected field is not sent on every checkin. A field that changed is sent again.
+// WARNING: Expects mutex locked.
+func (bc *Bulk) stripQuarantined(id string, meta, components []byte) ([]byte, []byte) {
+	q, ok := bc.quarantined[id]
+	if !ok {
+		return meta, components
+	}
+	stripped := false
+	if meta != nil && q.meta != 0 {
+		if hashPayload(meta) == q.meta {
+			meta, stripped = nil, true
+		} else {
+			q.meta = 0
+		}
+	}
+	if components != nil && q.components != 0 {
+		if hashPayload(components) == q.components {
+			components, stripped = nil, true
+		} else {
+			q.components = 0
+		}
+	}
+	if q.meta == 0 && q.components == 0 {
+		delete(bc.quarantined, id)
+	} else {
+		bc.quarantined[id] = q
+	}
+	if stripped {
+		quarantineStripped.Inc()
+	}
+	return meta, components
+}
+
+// rememberQuarantined remembers the rejected fields of the agent, see stripQuarantined.
+func (bc *Bulk) rememberQuarantined(id string, extra *extraT) {
+	bc.mut.Lock()
+	defer bc.mut.Unlock()
+	q := bc.quarantined[id]
+	if extra.meta != nil {
+		q.meta = hashPayload(extra.meta)
+	}
+	if extra.components != nil {
+		q.components = hashPayload(extra.components)
+	}
+	bc.quarantined[id] = q
+}
+
 // Run starts the flush timer and exit only when the context is cancelled.
 func (bc *Bulk) Run(ctx context.Context) error {
+	bc.openSpool(ctx)
 
 	tick := time.NewTicker(bc.opts.flushInterval)
 	defer tick.Stop()
@@ -145,8 +358,22 @@ LOOP:
 				zerolog.Ctx(ctx).Error().Err(err).Msg("Eat bulk checkin error; Keep on truckin'")
 			}
 
+		case <-bc.flushCh:
+			zerolog.Ctx(ctx).Debug().Int("max_pending_bytes", bc.opts.flushMaxPendingBytes).Msg("Pending checkins exceed max pending bytes, flushing early")
+			if err = bc.flush(ctx); err != nil {
+				zerolog.Ctx(ctx).Error().Err(err).Msg("Eat bulk checkin error; Keep on truckin'")
+			}
+			tick.Reset(bc.opts.flushInterval)
+
 		case <-ctx.Done():
 			err = ctx.Err()
+			// Flush the checkins that are still pending so they are not lost on shutdown.
+			bc.queueSkipped(true)
+			fCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), bc.opts.flushInterval)
+			if fErr := bc.flush(fCtx); fErr != nil {
+				zerolog.Ctx(ctx).Error().Err(fErr).Msg("Failed to flush pending checkins on shutdown")
+			}
+			cancel()
 			break LOOP
 		}
 	}
@@ -154,107 +381,142 @@ LOOP:
 	return err
 }
 
+// openSpool opens the spool of the checkins, the checkins are dropped when elasticsearch is unreachable if it fails.
+func (bc *Bulk) openSpool(ctx context.Context) {
+	if bc.opts.spoolPath == "" {
+		return
+	}
+	s, err := openSpool(ctx, bc.opts.spoolPath, bc.opts.spoolMaxSize)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Str("path", bc.opts.spoolPath).Msg("Unable to open the checkin spool, checkins are dropped while elasticsearch is unreachable")
+		return
+	}
+	bc.spool = s
+}
+
+// LastSeen returns the time of the last checkin of the agent that is not written to elasticsearch yet.
+func (bc *Bulk) LastSeen(id string) (time.Time, bool) {
+	bc.mut.Lock()
+	w, ok := bc.written[id]
+	bc.mut.Unlock()
+	if !ok || w.seen == "" {
+		return time.Time{}, false
+	}
+	seen, err := time.Parse(time.RFC3339, w.seen)
+	return seen, err == nil
+}
+
+// queueSkipped queues the writes of the skipped checkins whose agent document was written more than the status write
+// interval ago, or all of them if force is set. The agents that did not check in since their last write are forgotten,
+// their next checkin is written.
+func (bc *Bulk) queueSkipped(force bool) {
+	if bc.opts.statusWriteInterval <= 0 {
+		return
+	}
+	bc.mut.Lock()
+	defer bc.mut.Unlock()
+
+	now := bc.now().Unix()
+	interval := int64(bc.opts.statusWriteInterval.Seconds())
+	for id, w := range bc.written {
+		expired := now-w.unix >= interval
+		if w.seen == "" {
+			if expired {
+				delete(bc.written, id)
+			}
+			continue
+		}
+		if !expired && !force {
+			continue
+		}
+		if _, ok := bc.pending[id]; !ok {
+			p := pendingT{
+				ts:              w.seen,
+				status:          w.status,
+				message:         w.message,
+				unhealthyReason: w.unhealthyReason,
+			}
+			bc.pending[id] = p
+			bc.pendingBytes += p.size(id)
+		}
+		w.unix = now
+		w.seen = ""
+		bc.written[id] = w
+	}
+}
+
 // flush sends the minium data needed to update records in elasticsearch.
 func (bc *Bulk) flush(ctx context.Context) error {
 	start := time.Now()
 
+	bc.queueSkipped(false)
+
 	bc.mut.Lock()
 	pending := bc.pending
 	bc.pending = make(map[string]pendingT, len(pending))
+	bc.pendingBytes = 0
 	bc.mut.Unlock()
 
-	if len(pending) == 0 {
+	if len(pending) == 0 && bc.spool.empty() {
 		return nil
 	}
 
 	updates := make([]bulk.MultiOp, 0, len(pending))
+	var mirrorUpdates []bulk.MultiOp
+	if bc.opts.mirror != nil {
+		mirrorUpdates = make([]bulk.MultiOp, 0, len(pending))
+	}
 
-	simpleCache := make(map[pendingT][]byte)
+	simpleCache := make(map[pendingT]bodiesT)
 
 	nowTimestamp := start.UTC().Format(time.RFC3339)
 
-	var err error
 	var needRefresh bool
 	for id, pendingData := range pending {
-
-		// In the simple case, there are no fields and no seqNo.
-		// When that is true, we can reuse an already generated
-		// JSON body containing just the timestamp updates.
-		var body []byte
-		if pendingData.extra == nil {
-
-			var ok bool
-			body, ok = simpleCache[pendingData]
-			if !ok {
-				fields := bulk.UpdateFields{
-					dl.FieldLastCheckin:        pendingData.ts,
-					dl.FieldUpdatedAt:          nowTimestamp,
-					dl.FieldLastCheckinStatus:  pendingData.status,
-					dl.FieldLastCheckinMessage: pendingData.message,
-					dl.FieldUnhealthyReason:    pendingData.unhealthyReason,
-				}
-				if body, err = fields.Marshal(); err != nil {
-					return err
-				}
-				simpleCache[pendingData] = body
-			}
-		} else {
-
-			fields := bulk.UpdateFields{
-				dl.FieldLastCheckin:        pendingData.ts,      // Set the checkin timestamp
-				dl.FieldUpdatedAt:          nowTimestamp,        // Set "updated_at" to the current timestamp
-				dl.FieldLastCheckinStatus:  pendingData.status,  // Set the pending status
-				dl.FieldLastCheckinMessage: pendingData.message, // Set the status message
-				dl.FieldUnhealthyReason:    pendingData.unhealthyReason,
-			}
-
-			// If the agent version is not empty it needs to be updated
-			// Assuming the agent can by upgraded keeping the same id, but incrementing the version
-			if pendingData.extra.ver != "" {
-				fields[dl.FieldAgent] = map[string]interface{}{
-					dl.FieldAgentVersion: pendingData.extra.ver,
-				}
-			}
-
-			// Update local metadata if provided
-			if pendingData.extra.meta != nil {
-				// Surprise: The json encodeer compacts this raw JSON during
-				// the encode process, so there my be unexpected memory overhead:
-				// https://github.com/golang/go/blob/go1.16.3/src/encoding/json/encode.go#L499
-				fields[dl.FieldLocalMetadata] = json.RawMessage(pendingData.extra.meta)
-			}
-
-			// Update components if provided
-			if pendingData.extra.components != nil {
-				fields[dl.FieldComponents] = json.RawMessage(pendingData.extra.components)
-			}
-
-			// If seqNo changed, set the field appropriately
-			if pendingData.extra.seqNo.IsSet() {
-				fields[dl.FieldActionSeqNo] = pendingData.extra.seqNo
-
-				// Only refresh if seqNo changed; dropping metadata not important.
-				needRefresh = true
-			}
-
-			if body, err = fields.Marshal(); err != nil {
-				return err
-			}
+		body, refresh, err := bc.body(pendingData, nowTimestamp, simpleCache)
+		if err != nil {
+			return err
 		}
+		needRefresh = needRefresh || refresh
 
 		updates = append(updates, bulk.MultiOp{
 			ID:    id,
-			Body:  body,
+			Body:  body.update,
 			Index: dl.FleetAgents,
 		})
+		if mirrorUpdates != nil {
+			mirrorUpdates = append(mirrorUpdates, bulk.MultiOp{
+				ID:    id,
+				Body:  body.upsert,
+				Index: dl.FleetAgents,
+			})
+		}
 	}
 
+	// The mirror is fed before the update so that a slow primary output does not delay it.
+	bc.opts.mirror.MUpdate(ctx, mirrorUpdates)
+
 	var opts []bulk.Opt
 	if needRefresh {
 		opts = append(opts, bulk.WithRefresh())
 	}
 
-	_, err = bc.bulker.MUpdate(ctx, updates, opts...)
+	// The spooled checkins are drained first, the pending checkins of the same agents are newer.
+	var items []bulk.BulkIndexerResponseItem
+	err := bc.drain(ctx, pending, nowTimestamp)
+	if err == nil && len(updates) > 0 {
+		items, err = bc.update(ctx, updates, opts...)
+	}
+	switch {
+	case err == nil:
+	case isUnreachable(err):
+		bc.spoolPending(ctx, pending, updates, unwritten(updates, items))
+	case len(items) == len(updates):
+		err = bc.quarantine(ctx, pending, updates, items, nowTimestamp, opts...)
+	}
+	if err != nil {
+		bc.forget(pending)
+	}
 
 	zerolog.Ctx(ctx).Trace().
 		Err(err).
@@ -265,3 +527,370 @@ func (bc *Bulk) flush(ctx context.Context) error {
 
 	return err
 }
+
+// body returns the update bodies of a pending checkin, and true if the update needs a refresh.
+func (bc *Bulk) body(pendingData pendingT, nowTimestamp string, simpleCache map[pendingT]bodiesT) (bodiesT, bool, error) {
+	// In the simple case, there are no fields and no seqNo.
+	// When that is true, we can reuse an already generated
+	// JSON body containing just the timestamp updates.
+	if pendingData.extra == nil {
+		if body, ok := simpleCache[pendingData]; ok {
+			return body, false, nil
+		}
+		fields := bulk.UpdateFields{
+			dl.FieldLastCheckin:        pendingData.ts,
+			dl.FieldUpdatedAt:          nowTimestamp,
+			dl.FieldLastCheckinStatus:  pendingData.status,
+			dl.FieldLastCheckinMessage: pendingData.message,
+			dl.FieldUnhealthyReason:    pendingData.unhealthyReason,
+		}
+		body, err := bc.marshal(fields)
+		if err != nil {
+			return body, false, err
+		}
+		simpleCache[pendingData] = body
+		return body, false, nil
+	}
+
+	fields := bulk.UpdateFields{
+		dl.FieldLastCheckin:        pendingData.ts,      // Set the checkin timestamp
+		dl.FieldUpdatedAt:          nowTimestamp,        // Set "updated_at" to the current timestamp
+		dl.FieldLastCheckinStatus:  pendingData.status,  // Set the pending status
+		dl.FieldLastCheckinMessage: pendingData.message, // Set the status message
+		dl.FieldUnhealthyReason:    pendingData.unhealthyReason,
+	}
+
+	// If the agent version is not empty it needs to be updated
+	// Assuming the agent can by upgraded keeping the same id, but incrementing the version
+	if pendingData.extra.ver != "" {
+		fields[fieldAgentVersion] = pendingData.extra.ver
+	}
+
+	// Update local metadata if provided
+	if pendingData.extra.meta != nil {
+		// Surprise: The json encodeer compacts this raw JSON during
+		// the encode process, so there my be unexpected memory overhead:
+		// https://github.com/golang/go/blob/go1.16.3/src/encoding/json/encode.go#L499
+		fields[dl.FieldLocalMetadata] = json.RawMessage(pendingData.extra.meta)
+	}
+
+	// Update components if provided
+	if pendingData.extra.components != nil {
+		fields[dl.FieldComponents] = json.RawMessage(pendingData.extra.components)
+	}
+
+	// Update the client address if it changed
+	if pendingData.extra.ip != "" {
+		fields[dl.FieldLastCheckinIP] = pendingData.extra.ip
+	}
+
+	// If seqNo changed, set the field appropriately
+	// Only refresh if seqNo changed; dropping metadata not important.
+	needRefresh := false
+	if pendingData.extra.seqNo.IsSet() {
+		fields[dl.FieldActionSeqNo] = pendingData.extra.seqNo
+		needRefresh = true
+	}
+
+	body, err := bc.marshal(fields)
+	return body, needRefresh, err
+}
+
+// drain writes the spooled checkins, except the ones of the agents with a pending checkin which is newer. It returns an
+// error only if elasticsearch is still unreachable, the checkins that were not written stay in the spool.
+func (bc *Bulk) drain(ctx context.Context, pending map[string]pendingT, nowTimestamp string) error {
+	if bc.spool.empty() {
+		return nil
+	}
+	records, _, err := bc.spool.read()
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("Unable to read the checkin spool")
+		return nil
+	}
+	queue := slices.DeleteFunc(newestSpooled(records), func(s spooledT) bool {
+		_, ok := pending[s.ID]
+		return ok
+	})
+	spoolDropped.Add(float64(len(records) - len(queue)))
+
+	drained := 0
+	for len(queue) > 0 {
+		n := min(len(queue), spoolDrainBatch)
+		batch := make(map[string]pendingT, n)
+		sent := make([]spooledT, 0, n)
+		updates := make([]bulk.MultiOp, 0, n)
+		simpleCache := make(map[pendingT]bodiesT)
+		var needRefresh bool
+		for _, s := range queue[:n] {
+			p := s.pending()
+			body, refresh, err := bc.body(p, nowTimestamp, simpleCache)
+			if err != nil {
+				zerolog.Ctx(ctx).Warn().Err(err).Str(logger.AgentID, s.ID).Msg("Dropping spooled checkin")
+				continue
+			}
+			needRefresh = needRefresh || refresh
+			batch[s.ID] = p
+			sent = append(sent, s)
+			updates = append(updates, bulk.MultiOp{
+				ID:    s.ID,
+				Body:  body.update,
+				Index: dl.FleetAgents,
+			})
+		}
+
+		var opts []bulk.Opt
+		if needRefresh {
+			opts = append(opts, bulk.WithRefresh())
+		}
+		items, err := bc.update(ctx, updates, opts...)
+		if err != nil && isUnreachable(err) {
+			// The checkins that were not written stay in the spool, in the order they were received.
+			var remaining []spooledT
+			for _, i := range unwritten(updates, items) {
+				remaining = append(remaining, sent[i])
+			}
+			drained += len(updates) - len(remaining)
+			spoolDrained.Add(float64(len(updates) - len(remaining)))
+			if _, sErr := bc.spool.rewrite(append(remaining, queue[n:]...)); sErr != nil {
+				zerolog.Ctx(ctx).Error().Err(sErr).Msg("Unable to rewrite the checkin spool")
+			}
+			zerolog.Ctx(ctx).Debug().Err(err).Int("drained", drained).Msg("Elasticsearch is unreachable, the checkin spool is not drained")
+			return err
+		}
+		if err != nil && len(items) == len(updates) {
+			err = bc.quarantine(ctx, batch, updates, items, nowTimestamp, opts...)
+		}
+		if err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Int("cnt", len(updates)).Msg("Failed to write spooled checkins")
+		}
+		spoolDrained.Add(float64(len(updates)))
+		drained += len(updates)
+		queue = queue[n:]
+	}
+
+	if _, err := bc.spool.rewrite(nil); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("Unable to empty the checkin spool")
+	}
+	zerolog.Ctx(ctx).Info().Int("cnt", drained).Msg("Drained the checkin spool")
+	return nil
+}
+
+// spoolPending queues the pending checkins of the updates at indexes in the spool, they are written once elasticsearch
+// is reachable.
+func (bc *Bulk) spoolPending(ctx context.Context, pending map[string]pendingT, updates []bulk.MultiOp, indexes []int) {
+	if bc.spool == nil || len(indexes) == 0 {
+		return
+	}
+	records := make([]spooledT, 0, len(indexes))
+	for _, i := range indexes {
+		id := updates[i].ID
+		records = append(records, newSpooled(id, pending[id]))
+	}
+	// The checkins are spooled in the order they were received.
+	slices.SortStableFunc(records, func(a, b spooledT) int {
+		return strings.Compare(a.TS, b.TS)
+	})
+	dropped, err := bc.spool.append(records)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Int("cnt", len(records)).Msg("Unable to spool checkins, they are dropped")
+		return
+	}
+	spooled.Add(float64(len(records)))
+	spoolDropped.Add(float64(dropped))
+	zerolog.Ctx(ctx).Warn().Int("cnt", len(records)).Int("dropped", dropped).Msg("Elasticsearch is unreachable, checkins are spooled")
+}
+
+// forget removes the written checkins of the agents, so that their next checkin is written whatever changed.
+func (bc *Bulk) forget(pending map[string]pendingT) {
+	if bc.opts.statusWriteInterval <= 0 {
+		return
+	}
+	bc.mut.Lock()
+	defer bc.mut.Unlock()
+	for id := range pending {
+		delete(bc.written, id)
+	}
+}
+
+// bodiesT holds the update body of a checkin, and its upsert body when the checkins are mirrored.
+// The update only writes the fields that the checkins own, see dl.AgentUpdateBody.
+type bodiesT struct {
+	update []byte
+	upsert []byte
+}
+
+func (bc *Bulk) marshal(fields bulk.UpdateFields) (bodiesT, error) {
+	var body bodiesT
+	var err error
+	if body.update, err = dl.AgentUpdateBody(fields); err != nil {
+		return body, err
+	}
+	if bc.opts.mirror != nil {
+		if body.upsert, err = dl.AgentUpsertBody(fields); err != nil {
+			return body, err
+		}
+	}
+	return body, nil
+}
+
+// update sends the updates to elasticsearch and returns the response items in the order of the updates.
+// If elasticsearch rejects the request as too large the updates are split and retried in halves.
+func (bc *Bulk) update(ctx context.Context, updates []bulk.MultiOp, opts ...bulk.Opt) ([]bulk.BulkIndexerResponseItem, error) {
+	items, err := bc.bulker.MUpdate(ctx, updates, opts...)
+	if !isTooLarge(err) || len(updates) < 2 {
+		return items, err
+	}
+
+	half := len(updates) / 2
+	zerolog.Ctx(ctx).Warn().
+		Err(err).
+		Int("cnt", len(updates)).
+		Msg("Checkin updates too large, retrying in halves")
+	first, errFirst := bc.update(ctx, updates[:half], opts...)
+	second, errSecond := bc.update(ctx, updates[half:], opts...)
+	err = errors.Join(errFirst, errSecond)
+	if len(first) != half || len(second) != len(updates)-half {
+		return nil, err
+	}
+	return append(first, second...), err
+}
+
+// quarantine handles the updates that elasticsearch rejected with a 400, such as a local_metadata field that conflicts
+// with the mapping of the agents index. The agent document is updated again with only the core checkin fields,
+// and the rejected update is written to the dead-letter data stream so it does not fail unnoticed. The rejected fields
+// are remembered, the next checkins of the agent drop them until they change.
+// It returns the errors of the updates that failed for other reasons.
+func (bc *Bulk) quarantine(ctx context.Context, pending map[string]pendingT, updates []bulk.MultiOp, items []bulk.BulkIndexerResponseItem, nowTimestamp string, opts ...bulk.Opt) error {
+	var errs []error
+	var retries, deadLetters []bulk.MultiOp
+	for i, item := range items {
+		itemErr := es.TranslateError(item.Status, item.Error)
+		if itemErr == nil {
+			continue
+		}
+		id := updates[i].ID
+		pendingData, ok := pending[id]
+		if item.Status != http.StatusBadRequest || !ok || pendingData.extra == nil || (pendingData.extra.meta == nil && pendingData.extra.components == nil) {
+			errs = append(errs, itemErr)
+			continue
+		}
+
+		fields := bulk.UpdateFields{
+			dl.FieldLastCheckin:        pendingData.ts,
+			dl.FieldUpdatedAt:          nowTimestamp,
+			dl.FieldLastCheckinStatus:  pendingData.status,
+			dl.FieldLastCheckinMessage: pendingData.message,
+			dl.FieldUnhealthyReason:    pendingData.unhealthyReason,
+		}
+		if pendingData.extra.ver != "" {
+			fields[fieldAgentVersion] = pendingData.extra.ver
+		}
+		if pendingData.extra.seqNo.IsSet() {
+			fields[dl.FieldActionSeqNo] = pendingData.extra.seqNo
+		}
+		if pendingData.extra.ip != "" {
+			fields[dl.FieldLastCheckinIP] = pendingData.extra.ip
+		}
+		body, err := dl.AgentUpdateBody(fields)
+		if err != nil {
+			return err
+		}
+		retries = append(retries, bulk.MultiOp{
+			ID:    id,
+			Body:  body,
+			Index: dl.FleetAgents,
+		})
+		bc.rememberQuarantined(id, pendingData.extra)
+
+		// The rejected payload is stored as the original event, which is not indexed, so it cannot conflict with the
+		// mapping of the dead-letter data stream.
+		var deadLetter deadLetterT
+		deadLetter.Timestamp = nowTimestamp
+		deadLetter.DataStream = model.DataStream{Dataset: "fleet_server.checkin_deadletter", Type: "logs", Namespace: "default"}
+		deadLetter.Agent.ID = id
+		deadLetter.HTTP.Response.StatusCode = item.Status
+		deadLetter.Message = itemErr.Error()
+		deadLetter.Event.Original = string(updates[i].Body)
+		deadLetterBody, err := json.Marshal(deadLetter)
+		if err != nil {
+			return err
+		}
+		deadLetters = append(deadLetters, bulk.MultiOp{
+			Body:  deadLetterBody,
+			Index: dl.FleetAgentsDeadLetter,
+		})
+
+		zerolog.Ctx(ctx).Warn().
+			Err(itemErr).
+			Str(logger.AgentID, id).
+			Msg("Checkin update rejected, retrying without local_metadata and components, they are dropped until they change")
+	}
+	if len(retries) == 0 {
+		return errors.Join(errs...)
+	}
+
+	quarantined.Add(float64(len(retries)))
+	if _, err := bc.bulker.MUpdate(ctx, retries, opts...); err != nil {
+		errs = append(errs, fmt.Errorf("quarantined checkin update: %w", err))
+	}
+	if _, err := bc.bulker.MCreate(ctx, deadLetters); err != nil {
+		errs = append(errs, fmt.Errorf("checkin dead-letter: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// deadLetterT is a checkin update rejected by elasticsearch, with the ECS fields of the logs data streams.
+type deadLetterT struct {
+	Timestamp  string           `json:"@timestamp"`
+	DataStream model.DataStream `json:"data_stream"`
+	Agent      struct {
+		ID string `json:"id"`
+	} `json:"agent"`
+	HTTP struct {
+		Response struct {
+			StatusCode int `json:"status_code"`
+		} `json:"response"`
+	} `json:"http"`
+	// Message is the error of the rejected update.
+	Message string `json:"message"`
+	Event   struct {
+		// Original is the rejected update.
+		Original string `json:"original"`
+	} `json:"event"`
+}
+
+// isUnreachable returns true if the error means that elasticsearch could not be reached or is unavailable.
+func isUnreachable(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var esErr *es.ErrElastic
+	return errors.As(err, &esErr) && isUnavailableStatus(esErr.Status)
+}
+
+// unwritten returns the indexes of the updates that were not answered, or that were rejected because elasticsearch was
+// unavailable.
+func unwritten(updates []bulk.MultiOp, items []bulk.BulkIndexerResponseItem) []int {
+	var indexes []int
+	for i := range updates {
+		if i >= len(items) || items[i].Status == 0 || isUnavailableStatus(items[i].Status) {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+func isUnavailableStatus(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+func isTooLarge(err error) bool {
+	var esErr *es.ErrElastic
+	return errors.As(err, &esErr) && esErr.Status == http.StatusRequestEntityTooLarge
+}
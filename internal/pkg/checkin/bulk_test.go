@@ -8,18 +8,30 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
 	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
 	"github.com/elastic/fleet-server/v7/internal/pkg/sqn"
 	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
 	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
 
 	"github.com/google/go-cmp/cmp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/rs/xid"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 // Test simple,
@@ -48,16 +60,21 @@ func matchOp(tb testing.TB, c bulkcase, ts time.Time) func(ops []bulk.MultiOp) b
 			UpdatedAt   string          `json:"updated_at"`
 			Meta        json.RawMessage `json:"local_metadata"`
 			SeqNo       sqn.SeqNo       `json:"action_seq_no"`
+			IP          string          `json:"last_checkin_ip"`
 		}
 
-		m := make(map[string]updateT)
-		if err := json.Unmarshal(ops[0].Body, &m); err != nil {
+		// The update is only scripted when it replaces the local metadata object.
+		fields, scripted := updateFields(tb, ops[0])
+		if scripted != (c.meta != nil) {
+			tb.Errorf("unable to validate operation: scripted update is %t", scripted)
+		}
+		p, err := json.Marshal(fields)
+		if err != nil {
 			tb.Fatalf("unable to validate operation: %v", err)
 		}
-
-		sub, ok := m["doc"]
-		if !ok {
-			tb.Fatal("unable to validate operation: expected doc")
+		var sub updateT
+		if err := json.Unmarshal(p, &sub); err != nil {
+			tb.Fatalf("unable to validate operation: %v", err)
 		}
 		validateTimestamp(tb, ts.Truncate(time.Second), sub.LastCheckin)
 		validateTimestamp(tb, ts.Truncate(time.Second), sub.UpdatedAt)
@@ -75,6 +92,10 @@ func matchOp(tb testing.TB, c bulkcase, ts time.Time) func(ops []bulk.MultiOp) b
 			tb.Error("status mismatch")
 		}
 
+		if c.ip != sub.IP {
+			tb.Error("ip mismatch")
+		}
+
 		return true
 	}
 }
@@ -89,6 +110,7 @@ type bulkcase struct {
 	seqno           sqn.SeqNo
 	ver             string
 	unhealthyReason *[]string
+	ip              string
 }
 
 func TestBulkSimple(t *testing.T) {
@@ -106,6 +128,7 @@ func TestBulkSimple(t *testing.T) {
 			nil,
 			"",
 			nil,
+			"",
 		},
 		{
 			"Singled field case",
@@ -117,6 +140,7 @@ func TestBulkSimple(t *testing.T) {
 			nil,
 			"",
 			nil,
+			"",
 		},
 		{
 			"Multi field case",
@@ -128,6 +152,7 @@ func TestBulkSimple(t *testing.T) {
 			nil,
 			ver,
 			nil,
+			"",
 		},
 		{
 			"Multi field nested case",
@@ -139,6 +164,7 @@ func TestBulkSimple(t *testing.T) {
 			nil,
 			"",
 			nil,
+			"",
 		},
 		{
 			"Simple case with seqNo",
@@ -150,6 +176,7 @@ func TestBulkSimple(t *testing.T) {
 			sqn.SeqNo{1, 2, 3, 4},
 			ver,
 			nil,
+			"",
 		},
 		{
 			"Field case with seqNo",
@@ -161,6 +188,7 @@ func TestBulkSimple(t *testing.T) {
 			sqn.SeqNo{5, 6, 7, 8},
 			ver,
 			nil,
+			"",
 		},
 		{
 			"Unusual status",
@@ -172,6 +200,7 @@ func TestBulkSimple(t *testing.T) {
 			nil,
 			"",
 			nil,
+			"",
 		},
 		{
 			"Empty status",
@@ -183,6 +212,19 @@ func TestBulkSimple(t *testing.T) {
 			nil,
 			"",
 			nil,
+			"",
+		},
+		{
+			"Client IP case",
+			"ipId",
+			"online",
+			"message",
+			nil,
+			nil,
+			nil,
+			"",
+			nil,
+			"2001:db8::17",
 		},
 	}
 
@@ -193,7 +235,7 @@ func TestBulkSimple(t *testing.T) {
 			mockBulk.On("MUpdate", mock.Anything, mock.MatchedBy(matchOp(t, c, start)), mock.Anything).Return([]bulk.BulkIndexerResponseItem{}, nil).Once()
 			bc := NewBulk(mockBulk)
 
-			if err := bc.CheckIn(c.id, c.status, c.message, c.meta, c.components, c.seqno, c.ver, c.unhealthyReason); err != nil {
+			if err := bc.CheckIn(c.id, c.status, c.message, c.meta, c.components, c.seqno, c.ver, c.unhealthyReason, c.ip); err != nil {
 				t.Fatal(err)
 			}
 
@@ -206,6 +248,340 @@ func TestBulkSimple(t *testing.T) {
 	}
 }
 
+// flushRecorder is a fake bulker that records the number of operations of each MUpdate call.
+type flushRecorder struct {
+	*ftesting.MockBulk
+
+	mu    sync.Mutex
+	sizes []int
+	ids   map[string]struct{}
+	ops   []bulk.MultiOp
+	// maxOps is the largest request accepted, larger requests are rejected as too large.
+	maxOps int
+}
+
+func newFlushRecorder(maxOps int) *flushRecorder {
+	return &flushRecorder{
+		MockBulk: ftesting.NewMockBulk(),
+		ids:      make(map[string]struct{}),
+		maxOps:   maxOps,
+	}
+}
+
+func (f *flushRecorder) MUpdate(_ context.Context, ops []bulk.MultiOp, _ ...bulk.Opt) ([]bulk.BulkIndexerResponseItem, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sizes = append(f.sizes, len(ops))
+	if len(ops) > f.maxOps {
+		return nil, &es.ErrElastic{Status: http.StatusRequestEntityTooLarge}
+	}
+	for _, op := range ops {
+		f.ids[op.ID] = struct{}{}
+	}
+	f.ops = append(f.ops, ops...)
+	return nil, nil
+}
+
+// written returns the operations of the accepted requests since the last call.
+func (f *flushRecorder) written() []bulk.MultiOp {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ops := f.ops
+	f.ops = nil
+	return ops
+}
+
+func (f *flushRecorder) flushSizes() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]int(nil), f.sizes...)
+}
+
+func TestBulkFlushMaxPendingBytes(t *testing.T) {
+	ctx, cancel := context.WithCancel(testlog.SetLogger(t).WithContext(context.Background()))
+	defer cancel()
+
+	fb := newFlushRecorder(1024)
+	bc := NewBulk(fb, WithFlushInterval(time.Hour), WithFlushMaxPendingBytes(4096))
+	done := make(chan struct{})
+	go func() {
+		_ = bc.Run(ctx)
+		close(done)
+	}()
+
+	meta := []byte(`{"data":"` + strings.Repeat("x", 1024) + `"}`)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, bc.CheckIn(xid.New().String(), "online", "", meta, nil, nil, "", nil, ""))
+	}
+	require.Empty(t, fb.flushSizes(), "pending checkins are below the threshold")
+
+	require.NoError(t, bc.CheckIn(xid.New().String(), "online", "", meta, nil, nil, "", nil, ""))
+	require.Eventually(t, func() bool {
+		return len(fb.flushSizes()) == 1
+	}, time.Second, 10*time.Millisecond, "expected flush before the flush interval")
+	require.Equal(t, []int{4}, fb.flushSizes())
+
+	// Updating a pending checkin replaces its size instead of adding to it.
+	id := xid.New().String()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, bc.CheckIn(id, "online", "", meta, nil, nil, "", nil, ""))
+	}
+	bc.mut.Lock()
+	pendingBytes := bc.pendingBytes
+	bc.mut.Unlock()
+	require.Less(t, pendingBytes, 4096)
+
+	cancel()
+	<-done
+}
+
+func TestBulkFlushOnStop(t *testing.T) {
+	ctx, cancel := context.WithCancel(testlog.SetLogger(t).WithContext(context.Background()))
+
+	fb := newFlushRecorder(1024)
+	bc := NewBulk(fb, WithFlushInterval(time.Hour))
+	for i := 0; i < 3; i++ {
+		require.NoError(t, bc.CheckIn(xid.New().String(), "online", "", nil, nil, nil, "", nil, ""))
+	}
+
+	cancel()
+	require.ErrorIs(t, bc.Run(ctx), context.Canceled)
+	require.Equal(t, []int{3}, fb.flushSizes(), "pending checkins are flushed when the bulk checkin stops")
+}
+
+// lastCheckin returns the last_checkin field of an update.
+func lastCheckin(t *testing.T, op bulk.MultiOp) string {
+	t.Helper()
+	var ts string
+	fields, _ := updateFields(t, op)
+	if raw, ok := fields[dl.FieldLastCheckin]; ok {
+		require.NoError(t, json.Unmarshal(raw, &ts))
+	}
+	return ts
+}
+
+// updateFields returns the fields written by an update keyed by their path, and true if the update is scripted.
+func updateFields(tb testing.TB, op bulk.MultiOp) (map[string]json.RawMessage, bool) {
+	tb.Helper()
+	var body struct {
+		Doc    map[string]json.RawMessage `json:"doc"`
+		Script *struct {
+			Params struct {
+				Fields map[string]json.RawMessage `json:"fields"`
+			} `json:"params"`
+		} `json:"script"`
+	}
+	require.NoError(tb, json.Unmarshal(op.Body, &body))
+	if body.Script != nil {
+		return body.Script.Params.Fields, true
+	}
+	fields := make(map[string]json.RawMessage)
+	flattenDoc("", body.Doc, fields)
+	return fields, false
+}
+
+// flattenDoc adds the values of a partial document to fields, keyed by their path.
+func flattenDoc(prefix string, doc, fields map[string]json.RawMessage) {
+	for key, value := range doc {
+		var sub map[string]json.RawMessage
+		if bytes.HasPrefix(bytes.TrimSpace(value), []byte("{")) && json.Unmarshal(value, &sub) == nil {
+			flattenDoc(prefix+key+".", sub, fields)
+			continue
+		}
+		fields[prefix+key] = value
+	}
+}
+
+func TestBulkStatusWriteInterval(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	fb := newFlushRecorder(1024)
+	bc := NewBulk(fb, WithStatusWriteInterval(time.Minute))
+	bc.now = clock
+
+	checkIn := func(status string, meta []byte) []bulk.MultiOp {
+		t.Helper()
+		require.NoError(t, bc.CheckIn("agent-1", status, "", meta, nil, nil, "", nil, ""))
+		require.NoError(t, bc.flush(ctx))
+		return fb.written()
+	}
+
+	require.Len(t, checkIn("online", nil), 1, "the first checkin is written")
+	_, ok := bc.LastSeen("agent-1")
+	require.False(t, ok)
+
+	now = now.Add(30 * time.Second)
+	require.Empty(t, checkIn("online", nil), "an unchanged checkin is not written within the interval")
+	seen, ok := bc.LastSeen("agent-1")
+	require.True(t, ok)
+	require.Equal(t, now, seen)
+
+	now = now.Add(10 * time.Second)
+	written := checkIn("degraded", nil)
+	require.Len(t, written, 1, "a status change is written")
+	require.Equal(t, now.Format(time.RFC3339), lastCheckin(t, written[0]))
+	_, ok = bc.LastSeen("agent-1")
+	require.False(t, ok)
+
+	now = now.Add(10 * time.Second)
+	require.Len(t, checkIn("degraded", []byte(`{"host":{"name":"changed"}}`)), 1, "a metadata change is written")
+
+	now = now.Add(10 * time.Second)
+	require.Empty(t, checkIn("degraded", nil))
+	skippedAt := now
+
+	// The agent stops checking in, its last checkin is written once the interval has elapsed.
+	now = now.Add(40 * time.Second)
+	require.NoError(t, bc.flush(ctx))
+	require.Empty(t, fb.written(), "the last write is more recent than the interval")
+	now = now.Add(20 * time.Second)
+	require.NoError(t, bc.flush(ctx))
+	written = fb.written()
+	require.Len(t, written, 1)
+	require.Equal(t, skippedAt.Format(time.RFC3339), lastCheckin(t, written[0]), "the time of the skipped checkin is written")
+	_, ok = bc.LastSeen("agent-1")
+	require.False(t, ok)
+
+	// Agents that are not seen for an interval are forgotten, their next checkin is written.
+	now = now.Add(time.Minute)
+	require.NoError(t, bc.flush(ctx))
+	require.Empty(t, bc.written)
+	require.Len(t, checkIn("degraded", nil), 1)
+}
+
+func TestBulkStatusWriteIntervalRestart(t *testing.T) {
+	ctx, cancel := context.WithCancel(testlog.SetLogger(t).WithContext(context.Background()))
+	defer cancel()
+
+	fb := newFlushRecorder(1024)
+	bc := NewBulk(fb, WithFlushInterval(time.Hour), WithStatusWriteInterval(time.Hour))
+	require.NoError(t, bc.CheckIn("agent-1", "online", "", nil, nil, nil, "", nil, ""))
+	require.NoError(t, bc.flush(ctx))
+	require.Len(t, fb.written(), 1)
+	require.NoError(t, bc.CheckIn("agent-1", "online", "", nil, nil, nil, "", nil, ""))
+	require.NoError(t, bc.flush(ctx))
+	require.Empty(t, fb.written())
+
+	t.Run("lost on crash", func(t *testing.T) {
+		// The skipped checkin is lost with the process, the agent document keeps the checkin written before,
+		// and the first checkin after the restart is written.
+		restarted := NewBulk(fb, WithStatusWriteInterval(time.Hour))
+		_, ok := restarted.LastSeen("agent-1")
+		require.False(t, ok)
+		require.NoError(t, restarted.CheckIn("agent-1", "online", "", nil, nil, nil, "", nil, ""))
+		require.NoError(t, restarted.flush(ctx))
+		require.Len(t, fb.written(), 1)
+	})
+
+	t.Run("written on stop", func(t *testing.T) {
+		cancel()
+		require.ErrorIs(t, bc.Run(ctx), context.Canceled)
+		written := fb.written()
+		require.Len(t, written, 1, "the skipped checkins are written when the bulk checkin stops")
+		require.Equal(t, "agent-1", written[0].ID)
+	})
+}
+
+func TestBulkStatusWriteIntervalFailedFlush(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+
+	// Every request is rejected as too large.
+	fb := newFlushRecorder(0)
+	bc := NewBulk(fb, WithStatusWriteInterval(time.Hour))
+	require.NoError(t, bc.CheckIn("agent-1", "online", "", nil, nil, nil, "", nil, ""))
+	require.Error(t, bc.flush(ctx))
+
+	require.NoError(t, bc.CheckIn("agent-1", "online", "", nil, nil, nil, "", nil, ""))
+	bc.mut.Lock()
+	_, ok := bc.pending["agent-1"]
+	bc.mut.Unlock()
+	require.True(t, ok, "the checkin is written again after a failed write")
+}
+
+func TestBulkFlushSplitsTooLarge(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+
+	fb := newFlushRecorder(2)
+	bc := NewBulk(fb)
+	for i := 0; i < 8; i++ {
+		require.NoError(t, bc.CheckIn(xid.New().String(), "online", "", nil, nil, nil, "", nil, ""))
+	}
+
+	require.NoError(t, bc.flush(ctx))
+	require.Equal(t, []int{8, 4, 2, 2, 4, 2, 2}, fb.flushSizes())
+	require.Len(t, fb.ids, 8, "every checkin is written once")
+}
+
+func TestBulkFlushTooLargeSingleOp(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+
+	fb := newFlushRecorder(0)
+	bc := NewBulk(fb)
+	require.NoError(t, bc.CheckIn(xid.New().String(), "online", "", nil, nil, nil, "", nil, ""))
+
+	// A single update can not be split further, the error is returned.
+	err := bc.flush(ctx)
+	var esErr *es.ErrElastic
+	require.ErrorAs(t, err, &esErr)
+	require.Equal(t, http.StatusRequestEntityTooLarge, esErr.Status)
+	require.Equal(t, []int{1}, fb.flushSizes())
+}
+
+// mirrorRecorder sends the updates it receives to ops.
+type mirrorRecorder struct {
+	*ftesting.MockBulk
+	ops chan []bulk.MultiOp
+}
+
+func (m *mirrorRecorder) MUpdate(_ context.Context, ops []bulk.MultiOp, _ ...bulk.Opt) ([]bulk.BulkIndexerResponseItem, error) {
+	m.ops <- ops
+	return nil, nil
+}
+
+func TestBulkFlushMirror(t *testing.T) {
+	ctx, cancel := context.WithCancel(testlog.SetLogger(t).WithContext(context.Background()))
+	defer cancel()
+
+	secondary := &mirrorRecorder{MockBulk: ftesting.NewMockBulk(), ops: make(chan []bulk.MultiOp, 1)}
+	mirror := bulk.NewMirror(secondary, 0)
+	go func() {
+		_ = mirror.Run(ctx)
+	}()
+
+	// The primary output rejects the update, the mirror still gets it.
+	bc := NewBulk(newFlushRecorder(0), WithMirror(mirror))
+	id := xid.New().String()
+	require.NoError(t, bc.CheckIn(id, "online", "message", nil, nil, nil, "8.15.0", nil, ""))
+	require.Error(t, bc.flush(ctx))
+
+	select {
+	case ops := <-secondary.ops:
+		require.Len(t, ops, 1)
+		require.Equal(t, id, ops[0].ID)
+		require.Equal(t, dl.FleetAgents, ops[0].Index)
+
+		var update struct {
+			Doc struct {
+				Status  string `json:"last_checkin_status"`
+				Message string `json:"last_checkin_message"`
+				Agent   struct {
+					Version string `json:"version"`
+				} `json:"agent"`
+			} `json:"doc"`
+			DocAsUpsert bool `json:"doc_as_upsert"`
+		}
+		require.NoError(t, json.Unmarshal(ops[0].Body, &update))
+		require.True(t, update.DocAsUpsert, "expected the agent document to be created in the secondary output")
+		require.Equal(t, "online", update.Doc.Status)
+		require.Equal(t, "message", update.Doc.Message)
+		require.Equal(t, "8.15.0", update.Doc.Agent.Version)
+	case <-time.After(time.Second):
+		t.Fatal("expected the checkin to be mirrored")
+	}
+}
+
 func validateTimestamp(tb testing.TB, start time.Time, ts string) {
 	if t1, err := time.Parse(time.RFC3339, ts); err != nil {
 		tb.Error("expected rfc3999")
@@ -214,6 +590,112 @@ func validateTimestamp(tb testing.TB, start time.Time, ts string) {
 	}
 }
 
+// rejectRecorder is a fake bulker that rejects the updates of an agent that set local_metadata with a mapping error.
+type rejectRecorder struct {
+	*ftesting.MockBulk
+
+	poisonID string
+	updates  [][]bulk.MultiOp
+}
+
+func (f *rejectRecorder) MUpdate(_ context.Context, ops []bulk.MultiOp, _ ...bulk.Opt) ([]bulk.BulkIndexerResponseItem, error) {
+	f.updates = append(f.updates, ops)
+	var err error
+	items := make([]bulk.BulkIndexerResponseItem, len(ops))
+	for i, op := range ops {
+		items[i] = bulk.BulkIndexerResponseItem{DocumentID: op.ID, Status: http.StatusOK}
+		if op.ID == f.poisonID && bytes.Contains(op.Body, []byte(dl.FieldLocalMetadata)) {
+			items[i].Status = http.StatusBadRequest
+			items[i].Error = json.RawMessage(`{"type":"document_parsing_exception","reason":"failed to parse field [local_metadata.host]"}`)
+			err = es.TranslateError(items[i].Status, items[i].Error)
+		}
+	}
+	return items, err
+}
+
+func TestBulkQuarantine(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	fb := &rejectRecorder{MockBulk: ftesting.NewMockBulk(), poisonID: "poison"}
+	deadLetter := func(payload string) interface{} {
+		return mock.MatchedBy(func(ops []bulk.MultiOp) bool {
+			if len(ops) != 1 || ops[0].Index != dl.FleetAgentsDeadLetter || ops[0].ID != "" {
+				return false
+			}
+			var doc deadLetterT
+			if err := json.Unmarshal(ops[0].Body, &doc); err != nil {
+				return false
+			}
+			return doc.Agent.ID == "poison" && doc.HTTP.Response.StatusCode == http.StatusBadRequest &&
+				doc.DataStream.Dataset == "fleet_server.checkin_deadletter" &&
+				strings.Contains(doc.Message, "document_parsing_exception") &&
+				strings.Contains(doc.Event.Original, payload)
+		})
+	}
+	fb.On("MCreate", mock.Anything, deadLetter(`"host":"conflict"`), mock.Anything).Return([]bulk.BulkIndexerResponseItem{{Status: http.StatusCreated}}, nil).Once()
+	bc := NewBulk(fb)
+
+	before := quarantinedCount(t)
+	require.NoError(t, bc.CheckIn("poison", "online", "", []byte(`{"host":"conflict"}`), []byte(`[]`), sqn.SeqNo{1}, "8.15.0", nil, ""))
+	require.NoError(t, bc.CheckIn("healthy", "online", "", []byte(`{"host":{"name":"ok"}}`), nil, nil, "", nil, ""))
+
+	err := bc.flush(ctx)
+	require.NoError(t, err)
+	fb.AssertExpectations(t)
+
+	require.Len(t, fb.updates, 2, "expected the rejected update to be retried")
+	require.Len(t, fb.updates[0], 2)
+	require.Len(t, fb.updates[1], 1)
+	retry := fb.updates[1][0]
+	require.Equal(t, "poison", retry.ID)
+	require.Equal(t, dl.FleetAgents, retry.Index)
+
+	fields, _ := updateFields(t, retry)
+	require.NotContains(t, fields, dl.FieldLocalMetadata)
+	require.NotContains(t, fields, dl.FieldComponents)
+	require.JSONEq(t, `"online"`, string(fields[dl.FieldLastCheckinStatus]))
+	require.JSONEq(t, `[1]`, string(fields[dl.FieldActionSeqNo]))
+	require.JSONEq(t, `"8.15.0"`, string(fields["agent.version"]))
+	require.Equal(t, before+1, quarantinedCount(t))
+
+	// The next checkins with the same rejected fields are written without them, without another rejection.
+	stripped := strippedCount(t)
+	require.NoError(t, bc.CheckIn("poison", "online", "", []byte(`{"host":"conflict"}`), []byte(`[]`), nil, "", nil, ""))
+	require.NoError(t, bc.flush(ctx))
+	require.Len(t, fb.updates, 3)
+	require.Len(t, fb.updates[2], 1)
+	fields, _ = updateFields(t, fb.updates[2][0])
+	require.NotContains(t, fields, dl.FieldLocalMetadata)
+	require.NotContains(t, fields, dl.FieldComponents)
+	require.Equal(t, before+1, quarantinedCount(t))
+	require.Equal(t, stripped+1, strippedCount(t))
+	fb.AssertNumberOfCalls(t, "MCreate", 1)
+
+	// The fields are sent again once they change.
+	fb.On("MCreate", mock.Anything, deadLetter(`"host":"other"`), mock.Anything).Return([]bulk.BulkIndexerResponseItem{{Status: http.StatusCreated}}, nil).Once()
+	require.NoError(t, bc.CheckIn("poison", "online", "", []byte(`{"host":"other"}`), []byte(`[]`), nil, "", nil, ""))
+	require.NoError(t, bc.flush(ctx))
+	require.Len(t, fb.updates, 5, "expected the changed fields to be sent and rejected again")
+	fields, _ = updateFields(t, fb.updates[3][0])
+	require.Contains(t, fields, dl.FieldLocalMetadata)
+	require.NotContains(t, fields, dl.FieldComponents, "expected the unchanged components to stay dropped")
+	require.Equal(t, before+2, quarantinedCount(t))
+	fb.AssertExpectations(t)
+}
+
+func quarantinedCount(t *testing.T) float64 {
+	t.Helper()
+	var m dto.Metric
+	require.NoError(t, quarantined.Write(&m))
+	return m.GetCounter().GetValue()
+}
+
+func strippedCount(t *testing.T) float64 {
+	t.Helper()
+	var m dto.Metric
+	require.NoError(t, quarantineStripped.Write(&m))
+	return m.GetCounter().GetValue()
+}
+
 func benchmarkBulk(n int, b *testing.B) {
 	mockBulk := ftesting.NewMockBulk()
 	bc := NewBulk(mockBulk)
@@ -228,7 +710,7 @@ func benchmarkBulk(n int, b *testing.B) {
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
 		for _, id := range ids {
-			err := bc.CheckIn(id, "", "", nil, nil, nil, "", nil)
+			err := bc.CheckIn(id, "", "", nil, nil, nil, "", nil, "")
 			if err != nil {
 				b.Fatal(err)
 			}
@@ -254,7 +736,7 @@ func benchmarkFlush(n int, b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		b.StopTimer()
 		for _, id := range ids {
-			err := bc.CheckIn(id, "", "", nil, nil, nil, "", nil)
+			err := bc.CheckIn(id, "", "", nil, nil, nil, "", nil, "")
 			if err != nil {
 				b.Fatal(err)
 			}
@@ -269,6 +751,48 @@ func benchmarkFlush(n int, b *testing.B) {
 
 }
 
+// benchmarkStatusWrites reports the agent document writes per checkin of agents that check in every 30s
+// without changes, with the checkins flushed every 10s.
+func benchmarkStatusWrites(interval time.Duration, b *testing.B) {
+	ctx := context.Background()
+	const agents = 1024
+	fb := newFlushRecorder(agents)
+	bc := NewBulk(fb, WithStatusWriteInterval(interval))
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	bc.now = func() time.Time { return now }
+
+	ids := make([]string, 0, agents)
+	for i := 0; i < agents; i++ {
+		ids = append(ids, xid.New().String())
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, id := range ids {
+			if err := bc.CheckIn(id, "online", "", nil, nil, nil, "", nil, ""); err != nil {
+				b.Fatal(err)
+			}
+		}
+		for j := 0; j < 3; j++ {
+			if err := bc.flush(ctx); err != nil {
+				b.Fatal(err)
+			}
+			now = now.Add(10 * time.Second)
+		}
+	}
+	b.StopTimer()
+
+	var writes int
+	for _, n := range fb.flushSizes() {
+		writes += n
+	}
+	b.ReportMetric(float64(writes)/float64(b.N*agents), "writes/checkin")
+}
+
+func BenchmarkStatusWrites_0(b *testing.B)  { benchmarkStatusWrites(0, b) }
+func BenchmarkStatusWrites_5m(b *testing.B) { benchmarkStatusWrites(5*time.Minute, b) }
+
 func BenchmarkBulk_1(b *testing.B)      { benchmarkBulk(1, b) }
 func BenchmarkBulk_64(b *testing.B)     { benchmarkBulk(64, b) }
 func BenchmarkBulk_8192(b *testing.B)   { benchmarkBulk(8192, b) }
@@ -282,3 +806,158 @@ func BenchmarkFlush_8192(b *testing.B)   { benchmarkFlush(8192, b) }
 func BenchmarkFlush_37268(b *testing.B)  { benchmarkFlush(37268, b) }
 func BenchmarkFlush_131072(b *testing.B) { benchmarkFlush(131072, b) }
 func BenchmarkFlush_262144(b *testing.B) { benchmarkFlush(262144, b) }
+
+// outageTransport answers the bulk requests of the agent updates, or refuses the connections while it is down.
+type outageTransport struct {
+	mu   sync.Mutex
+	down bool
+	// updates holds the fields of the updates that were written, in the order they were received.
+	updates []bulk.MultiOp
+}
+
+func (m *outageTransport) setDown(down bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.down = down
+}
+
+func (m *outageTransport) written() []bulk.MultiOp {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	written := m.updates
+	m.updates = nil
+	return written
+}
+
+func (m *outageTransport) Perform(req *http.Request) (*http.Response, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.down {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	}
+
+	var body bytes.Buffer
+	body.WriteString(`{"took":1,"errors":false,"items":[`)
+	decoder := json.NewDecoder(req.Body)
+	for i := 0; decoder.More(); i++ {
+		var frame map[string]struct {
+			ID    string `json:"_id"`
+			Index string `json:"_index"`
+		}
+		if err := decoder.Decode(&frame); err != nil {
+			return nil, err
+		}
+		meta, ok := frame["update"]
+		if !ok {
+			return nil, errors.New("unexpected op")
+		}
+		var doc json.RawMessage
+		if err := decoder.Decode(&doc); err != nil {
+			return nil, err
+		}
+		m.updates = append(m.updates, bulk.MultiOp{ID: meta.ID, Index: meta.Index, Body: doc})
+		if i > 0 {
+			body.WriteString(",")
+		}
+		body.WriteString(`{"update":{"_index":"` + meta.Index + `","_id":"` + meta.ID + `","status":200}}`)
+	}
+	body.WriteString(`]}`)
+
+	return &http.Response{
+		Request:    req,
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(&body),
+	}, nil
+}
+
+func TestBulkSpoolOutage(t *testing.T) {
+	ctx, cancel := context.WithCancel(testlog.SetLogger(t).WithContext(context.Background()))
+	transport := &outageTransport{down: true}
+	bulker := bulk.NewBulker(transport, nil, bulk.WithFlushInterval(10*time.Millisecond))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := bulker.Run(ctx); !errors.Is(err, context.Canceled) {
+			t.Error(err)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	now := time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	path := filepath.Join(t.TempDir(), "checkins.spool")
+	bc := NewBulk(bulker, WithSpool(path, 1024*1024))
+	bc.now = clock
+	bc.openSpool(ctx)
+	checkIn := func(bc *Bulk, id, status string, meta []byte) {
+		t.Helper()
+		require.NoError(t, bc.CheckIn(id, status, "", meta, nil, nil, "", nil, ""))
+		now = now.Add(time.Second)
+	}
+
+	// Elasticsearch is unreachable, the checkins are spooled instead of being dropped.
+	checkIn(bc, "agent-1", "starting", nil)
+	checkIn(bc, "agent-2", "online", nil)
+	require.True(t, isUnreachable(bc.flush(ctx)))
+	agent1 := now
+	checkIn(bc, "agent-1", "online", nil)
+	agent3 := now
+	checkIn(bc, "agent-3", "degraded", []byte(`{"host":{"name":"agent-3"}}`))
+	require.True(t, isUnreachable(bc.flush(ctx)))
+	require.Empty(t, transport.written())
+
+	// fleet-server restarts before elasticsearch is reachable again, agent-2 checks in once it is.
+	restarted := NewBulk(bulker, WithSpool(path, 1024*1024))
+	restarted.now = clock
+	restarted.openSpool(ctx)
+	transport.setDown(false)
+	agent2 := now
+	checkIn(restarted, "agent-2", "error", nil)
+	require.NoError(t, restarted.flush(ctx))
+
+	// The spooled checkins are written before the pending ones, only the newest checkin of each agent is written.
+	written := transport.written()
+	require.Len(t, written, 3)
+	require.Equal(t, "agent-2", written[2].ID)
+	byID := make(map[string]bulk.MultiOp, len(written))
+	for _, op := range written {
+		require.Equal(t, dl.FleetAgents, op.Index)
+		byID[op.ID] = op
+	}
+	want := []struct {
+		id     string
+		status string
+		ts     time.Time
+	}{
+		{"agent-1", "online", agent1},
+		{"agent-3", "degraded", agent3},
+		{"agent-2", "error", agent2},
+	}
+	for _, w := range want {
+		op, ok := byID[w.id]
+		require.True(t, ok, w.id)
+		fields, _ := updateFields(t, op)
+		require.JSONEq(t, `"`+w.status+`"`, string(fields[dl.FieldLastCheckinStatus]), w.id)
+		require.Equal(t, w.ts.Format(time.RFC3339), lastCheckin(t, op), w.id)
+	}
+	fields, scripted := updateFields(t, byID["agent-3"])
+	require.True(t, scripted, "the local metadata is replaced by a script")
+	require.JSONEq(t, `{"host":{"name":"agent-3"}}`, string(fields[dl.FieldLocalMetadata]))
+
+	// The spool is empty once drained.
+	require.True(t, restarted.spool.empty())
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Zero(t, info.Size())
+	require.NoError(t, restarted.flush(ctx))
+	require.Empty(t, transport.written())
+}
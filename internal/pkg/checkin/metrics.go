@@ -0,0 +1,50 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package checkin
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var quarantined = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "checkin",
+	Name:      "quarantined_total",
+	Help:      "Number of agent documents updated without their rejected checkin fields.",
+})
+
+var quarantineStripped = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "checkin",
+	Name:      "quarantine_stripped_total",
+	Help:      "Number of checkins whose local_metadata or components were dropped because elasticsearch rejected them before.",
+})
+
+var skipped = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "checkin",
+	Name:      "status_writes_skipped_total",
+	Help:      "Number of checkins that did not rewrite the agent document because only the checkin time changed.",
+})
+
+var spooled = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "checkin",
+	Name:      "spooled_total",
+	Help:      "Number of checkin updates queued in the spool because elasticsearch was unreachable.",
+})
+
+var spoolDrained = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "checkin",
+	Name:      "spool_drained_total",
+	Help:      "Number of spooled checkin updates written once elasticsearch was reachable again.",
+})
+
+var spoolDropped = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "checkin",
+	Name:      "spool_dropped_total",
+	Help:      "Number of spooled checkin updates dropped because a newer update of the agent was queued, the spool was full, or the update was written from memory.",
+})
+
+// MetricsCollectors returns the prometheus collectors of the checkin updates.
+func MetricsCollectors() []prometheus.Collector {
+	return []prometheus.Collector{quarantined, quarantineStripped, skipped, spooled, spoolDrained, spoolDropped}
+}
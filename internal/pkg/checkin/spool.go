@@ -0,0 +1,274 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package checkin
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/sqn"
+
+	"github.com/rs/zerolog"
+)
+
+// spoolHeaderSize is the size of the header of a spooled record: the size of its payload and the CRC32 of the payload.
+const spoolHeaderSize = 8
+
+// spooledT is a checkin update queued in the spool.
+type spooledT struct {
+	ID              string          `json:"id"`
+	TS              string          `json:"ts"`
+	Status          string          `json:"status"`
+	Message         string          `json:"message"`
+	UnhealthyReason *[]string       `json:"unhealthy_reason,omitempty"`
+	Meta            json.RawMessage `json:"meta,omitempty"`
+	Components      json.RawMessage `json:"components,omitempty"`
+	SeqNo           sqn.SeqNo       `json:"seq_no,omitempty"`
+	Ver             string          `json:"ver,omitempty"`
+	IP              string          `json:"ip,omitempty"`
+}
+
+func newSpooled(id string, p pendingT) spooledT {
+	s := spooledT{
+		ID:              id,
+		TS:              p.ts,
+		Status:          p.status,
+		Message:         p.message,
+		UnhealthyReason: p.unhealthyReason,
+	}
+	if p.extra != nil {
+		s.Meta = p.extra.meta
+		s.Components = p.extra.components
+		s.SeqNo = p.extra.seqNo
+		s.Ver = p.extra.ver
+		s.IP = p.extra.ip
+	}
+	return s
+}
+
+func (s spooledT) pending() pendingT {
+	p := pendingT{
+		ts:              s.TS,
+		status:          s.Status,
+		message:         s.Message,
+		unhealthyReason: s.UnhealthyReason,
+	}
+	if s.Meta != nil || s.SeqNo.IsSet() || s.Ver != "" || s.Components != nil || s.IP != "" {
+		p.extra = &extraT{
+			meta:       s.Meta,
+			seqNo:      s.SeqNo,
+			ver:        s.Ver,
+			components: s.Components,
+			ip:         s.IP,
+		}
+	}
+	return p
+}
+
+// spool is a bounded file queue of the checkin updates that could not be written because elasticsearch was
+// unreachable. Each record is the JSON of a spooledT preceded by its size and its CRC32, a record that is cut short
+// or whose CRC32 does not match ends the queue. It is only used by the flush of the bulk checkin.
+type spool struct {
+	path    string
+	maxSize int64
+	// size is the size of the valid records of the file.
+	size int64
+}
+
+// openSpool opens the spool at path. A corrupt file is truncated after its last valid record, a file larger than
+// maxSize is compacted.
+func openSpool(ctx context.Context, path string, maxSize int64) (*spool, error) {
+	s := &spool{path: path, maxSize: maxSize}
+	records, size, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return s, nil
+	case err != nil:
+		return nil, err
+	}
+	s.size = size
+	if info.Size() > size {
+		// The bytes after the last valid record are lost, it is usually the last record cut short by a crash.
+		zerolog.Ctx(ctx).Warn().Str("path", path).Int64("size", info.Size()).Int64("valid", size).Msg("Truncating corrupt checkin spool")
+		if err := os.Truncate(path, size); err != nil {
+			return nil, err
+		}
+	}
+	if size > maxSize {
+		dropped, err := s.rewrite(records)
+		if err != nil {
+			return nil, err
+		}
+		spoolDropped.Add(float64(dropped))
+		zerolog.Ctx(ctx).Warn().Str("path", path).Int("dropped", dropped).Int64("max_size", maxSize).Msg("Compacted oversized checkin spool")
+	}
+	return s, nil
+}
+
+// empty returns true if the spool is disabled or holds no record.
+func (s *spool) empty() bool {
+	return s == nil || s.size == 0
+}
+
+// read returns the records of the spool in the order they were queued, and the size of the valid records.
+func (s *spool) read() ([]spooledT, int64, error) {
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var records []spooledT
+	var size int64
+	r := bufio.NewReader(f)
+	header := make([]byte, spoolHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return records, size, nil
+			}
+			return nil, 0, err
+		}
+		n := int64(binary.BigEndian.Uint32(header[:4]))
+		if n > s.maxSize {
+			return records, size, nil
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return records, size, nil
+			}
+			return nil, 0, err
+		}
+		var record spooledT
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) || json.Unmarshal(payload, &record) != nil {
+			return records, size, nil
+		}
+		records = append(records, record)
+		size += spoolHeaderSize + n
+	}
+}
+
+// append queues the records, the spool is compacted if they do not fit. It returns the number of dropped records.
+func (s *spool) append(records []spooledT) (int, error) {
+	data, err := encodeSpooled(records)
+	if err != nil {
+		return 0, err
+	}
+	if s.size+int64(len(data)) > s.maxSize {
+		queued, _, err := s.read()
+		if err != nil {
+			return 0, err
+		}
+		return s.rewrite(append(queued, records...))
+	}
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// The partly written records are removed so that the next records are not queued after them.
+		if terr := os.Truncate(s.path, s.size); terr != nil && !errors.Is(terr, os.ErrNotExist) {
+			err = errors.Join(err, terr)
+		}
+		return 0, err
+	}
+	s.size += int64(len(data))
+	return 0, nil
+}
+
+// rewrite replaces the records of the spool with the newest record of each agent, the oldest ones are dropped until
+// they fit in the spool. It returns the number of dropped records.
+func (s *spool) rewrite(records []spooledT) (int, error) {
+	newest := newestSpooled(records)
+	encoded := make([][]byte, len(newest))
+	var size int64
+	for i := range newest {
+		var err error
+		if encoded[i], err = encodeSpooled(newest[i : i+1]); err != nil {
+			return 0, err
+		}
+		size += int64(len(encoded[i]))
+	}
+	first := 0
+	for ; size > s.maxSize; first++ {
+		size -= int64(len(encoded[first]))
+	}
+	data := slices.Concat(encoded[first:]...)
+	dropped := len(records) - len(newest) + first
+
+	// The spool is replaced at once so that a crash leaves either the old or the new records.
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		return 0, errors.Join(err, os.Remove(tmp))
+	}
+	s.size = int64(len(data))
+	return dropped, nil
+}
+
+// newestSpooled returns the newest record of each agent, in the order they were queued.
+func newestSpooled(records []spooledT) []spooledT {
+	seen := make(map[string]struct{}, len(records))
+	newest := make([]spooledT, 0, len(records))
+	for i := len(records) - 1; i >= 0; i-- {
+		if _, ok := seen[records[i].ID]; ok {
+			continue
+		}
+		seen[records[i].ID] = struct{}{}
+		newest = append(newest, records[i])
+	}
+	slices.Reverse(newest)
+	return newest
+}
+
+func encodeSpooled(records []spooledT) ([]byte, error) {
+	var data []byte
+	for _, record := range records {
+		payload, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		data = binary.BigEndian.AppendUint32(data, uint32(len(payload))) //nolint:gosec // a checkin update is far smaller than 4GiB
+		data = binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(payload))
+		data = append(data, payload...)
+	}
+	return data, nil
+}
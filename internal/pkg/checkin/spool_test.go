@@ -0,0 +1,152 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package checkin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+// spooledIDs returns the agent ids and statuses of the records of the spool, in the order they were queued.
+func spooledIDs(t *testing.T, s *spool) []string {
+	t.Helper()
+	records, size, err := s.read()
+	require.NoError(t, err)
+	require.Equal(t, s.size, size)
+	ids := make([]string, 0, len(records))
+	for _, r := range records {
+		ids = append(ids, r.ID+":"+r.Status)
+	}
+	return ids
+}
+
+func TestSpool(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+
+	t.Run("append and reopen", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "checkins.spool")
+		s, err := openSpool(ctx, path, 1024*1024)
+		require.NoError(t, err)
+		require.True(t, s.empty())
+
+		dropped, err := s.append([]spooledT{{ID: "agent-1", Status: "starting"}, {ID: "agent-2", Status: "online"}})
+		require.NoError(t, err)
+		require.Zero(t, dropped)
+		dropped, err = s.append([]spooledT{{ID: "agent-1", Status: "online", Meta: []byte(`{"host":{"name":"a"}}`)}})
+		require.NoError(t, err)
+		require.Zero(t, dropped)
+		require.False(t, s.empty())
+
+		reopened, err := openSpool(ctx, path, 1024*1024)
+		require.NoError(t, err)
+		require.Equal(t, s.size, reopened.size)
+		require.Equal(t, []string{"agent-1:starting", "agent-2:online", "agent-1:online"}, spooledIDs(t, reopened))
+
+		records, _, err := reopened.read()
+		require.NoError(t, err)
+		newest := newestSpooled(records)
+		require.Len(t, newest, 2)
+		require.Equal(t, "agent-2", newest[0].ID)
+		require.Equal(t, "agent-1", newest[1].ID)
+		require.JSONEq(t, `{"host":{"name":"a"}}`, string(newest[1].pending().extra.meta))
+	})
+
+	t.Run("corrupt file is truncated", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "checkins.spool")
+		s, err := openSpool(ctx, path, 1024*1024)
+		require.NoError(t, err)
+		_, err = s.append([]spooledT{{ID: "agent-1", Status: "online"}, {ID: "agent-2", Status: "online"}})
+		require.NoError(t, err)
+		valid := s.size
+
+		// A record cut short by a crash.
+		data, err := encodeSpooled([]spooledT{{ID: "agent-3", Status: "online"}})
+		require.NoError(t, err)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+		require.NoError(t, err)
+		_, err = f.Write(data[:len(data)-3])
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		reopened, err := openSpool(ctx, path, 1024*1024)
+		require.NoError(t, err)
+		require.Equal(t, valid, reopened.size)
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, valid, info.Size())
+		require.Equal(t, []string{"agent-1:online", "agent-2:online"}, spooledIDs(t, reopened))
+
+		// A record whose checksum does not match ends the spool.
+		data[spoolHeaderSize] ^= 0xff
+		require.NoError(t, os.WriteFile(path, data, 0o600))
+		reopened, err = openSpool(ctx, path, 1024*1024)
+		require.NoError(t, err)
+		require.True(t, reopened.empty())
+		info, err = os.Stat(path)
+		require.NoError(t, err)
+		require.Zero(t, info.Size())
+
+		// New records are queued after the valid ones.
+		_, err = reopened.append([]spooledT{{ID: "agent-4", Status: "online"}})
+		require.NoError(t, err)
+		require.Equal(t, []string{"agent-4:online"}, spooledIDs(t, reopened))
+	})
+
+	t.Run("oversized file is compacted", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "checkins.spool")
+		s, err := openSpool(ctx, path, 1024*1024)
+		require.NoError(t, err)
+		_, err = s.append([]spooledT{
+			{ID: "agent-1", Status: "starting"},
+			{ID: "agent-2", Status: "online"},
+			{ID: "agent-3", Status: "online"},
+			{ID: "agent-1", Status: "online"},
+		})
+		require.NoError(t, err)
+		record, err := encodeSpooled([]spooledT{{ID: "agent-1", Status: "online"}})
+		require.NoError(t, err)
+
+		// The spool holds two records once it is opened with a smaller size, the newest of each agent are kept.
+		reopened, err := openSpool(ctx, path, int64(2*len(record)))
+		require.NoError(t, err)
+		require.Equal(t, []string{"agent-3:online", "agent-1:online"}, spooledIDs(t, reopened))
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, reopened.size, info.Size())
+	})
+
+	t.Run("full spool drops the oldest records", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "checkins.spool")
+		record, err := encodeSpooled([]spooledT{{ID: "agent-1", Status: "online"}})
+		require.NoError(t, err)
+		s, err := openSpool(ctx, path, int64(3*len(record)))
+		require.NoError(t, err)
+
+		dropped, err := s.append([]spooledT{{ID: "agent-1", Status: "online"}, {ID: "agent-2", Status: "online"}})
+		require.NoError(t, err)
+		require.Zero(t, dropped)
+		dropped, err = s.append([]spooledT{{ID: "agent-3", Status: "online"}, {ID: "agent-4", Status: "online"}})
+		require.NoError(t, err)
+		require.Equal(t, 1, dropped)
+		require.Equal(t, []string{"agent-2:online", "agent-3:online", "agent-4:online"}, spooledIDs(t, s))
+
+		// A newer record of a spooled agent replaces it instead of dropping another agent, the records have the same size.
+		dropped, err = s.append([]spooledT{{ID: "agent-2", Status: "failed"}})
+		require.NoError(t, err)
+		require.Equal(t, 1, dropped)
+		require.Equal(t, []string{"agent-3:online", "agent-4:online", "agent-2:failed"}, spooledIDs(t, s))
+
+		_, err = s.rewrite(nil)
+		require.NoError(t, err)
+		require.True(t, s.empty())
+		require.Empty(t, spooledIDs(t, s))
+	})
+}
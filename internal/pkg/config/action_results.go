@@ -0,0 +1,28 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package config
+
+import "fmt"
+
+const defaultMaxActionResponseSize = 64 * 1024 // 64KiB
+
+// ActionResults is the configuration of the action results written for the ack events.
+type ActionResults struct {
+	// MaxResponseSize is the size in bytes of the largest action_response stored in an action result, a larger
+	// action_response is truncated. 0 stores the action responses whatever their size.
+	MaxResponseSize int `config:"max_response_size"`
+}
+
+func (c *ActionResults) InitDefaults() {
+	c.MaxResponseSize = defaultMaxActionResponseSize
+}
+
+// Validate ensures that the configuration is valid.
+func (c *ActionResults) Validate() error {
+	if c.MaxResponseSize < 0 {
+		return fmt.Errorf("max_response_size must not be negative, got %d", c.MaxResponseSize)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package config
+
+import "errors"
+
+// Admin is the configuration of the admin endpoint used to inspect and evict the cache.
+// It is only served on a unix socket, that is created with 0600 permissions.
+type Admin struct {
+	Enabled    bool   `config:"enabled"`
+	SocketPath string `config:"socket_path"`
+}
+
+// Validate ensures that the configuration is valid.
+func (c *Admin) Validate() error {
+	if c.Enabled && c.SocketPath == "" {
+		return errors.New("socket_path is required when the admin endpoint is enabled")
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+const defaultAgentActionExpiration = 24 * time.Hour
+
+// AgentActions is the configuration of the actions added by the agent actions endpoint.
+type AgentActions struct {
+	// DefaultExpiration is how long an action added without an expiration is valid. The actions are only dispatched
+	// until they expire, an action without an expiration would never be dispatched.
+	DefaultExpiration time.Duration `config:"default_expiration"`
+}
+
+func (c *AgentActions) InitDefaults() {
+	c.DefaultExpiration = defaultAgentActionExpiration
+}
+
+// Validate ensures that the configuration is valid.
+func (c *AgentActions) Validate() error {
+	if c.DefaultExpiration <= 0 {
+		return fmt.Errorf("default_expiration must be positive, got %s", c.DefaultExpiration)
+	}
+	return nil
+}
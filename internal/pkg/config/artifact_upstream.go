@@ -0,0 +1,83 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/elastic/elastic-agent-libs/transport/httpcommon"
+	"github.com/elastic/elastic-agent-libs/transport/tlscommon"
+)
+
+const (
+	defaultArtifactUpstreamTimeout = 30 * time.Second
+	defaultArtifactUpstreamMaxSize = 50 * 1024 * 1024 // 50MiB
+)
+
+// ArtifactUpstream is the artifact service an artifact is fetched from when it is not found in Elasticsearch.
+// An artifact is fetched from <base_url>/<identifier>/<decoded sha256>, and it is only served if its sha256 matches.
+type ArtifactUpstream struct {
+	Enabled      bool              `config:"enabled"`
+	BaseURL      string            `config:"base_url"`
+	TLS          *tlscommon.Config `config:"ssl"`
+	ProxyURL     string            `config:"proxy_url"`
+	ProxyDisable bool              `config:"proxy_disable"`
+	ProxyHeaders map[string]string `config:"proxy_headers"`
+	// Timeout bounds the fetch of an artifact.
+	Timeout time.Duration `config:"timeout"`
+	// MaxSize is the largest artifact accepted from the upstream, before and after it is decompressed.
+	MaxSize int64 `config:"max_size"`
+}
+
+func (c *ArtifactUpstream) InitDefaults() {
+	c.Timeout = defaultArtifactUpstreamTimeout
+	c.MaxSize = defaultArtifactUpstreamMaxSize
+}
+
+// Validate ensures that the configuration is valid.
+func (c *ArtifactUpstream) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.BaseURL == "" {
+		return errors.New("base_url is required when the artifact upstream is enabled")
+	}
+	if u, err := url.Parse(c.BaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid base_url %q", c.BaseURL)
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("timeout must be positive, got %s", c.Timeout)
+	}
+	if c.MaxSize <= 0 {
+		return fmt.Errorf("max_size must be positive, got %d", c.MaxSize)
+	}
+	if _, err := httpcommon.NewProxyURIFromString(c.ProxyURL); err != nil {
+		return fmt.Errorf("invalid proxy_url: %w", err)
+	}
+	if c.TLS != nil && c.TLS.IsEnabled() {
+		if _, err := tlscommon.LoadTLSConfig(c.TLS); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Client returns the HTTP client used to fetch the artifacts from the upstream.
+func (c *ArtifactUpstream) Client() (*http.Client, error) {
+	proxy, err := httpcommon.NewHTTPClientProxySettings(c.ProxyURL, c.ProxyHeaders, c.ProxyDisable)
+	if err != nil {
+		return nil, err
+	}
+	settings := httpcommon.HTTPTransportSettings{
+		TLS:     c.TLS,
+		Timeout: c.Timeout,
+		Proxy:   *proxy,
+	}
+	return settings.Client()
+}
@@ -0,0 +1,133 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package config
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/elastic/elastic-agent-libs/transport/tlscommon"
+)
+
+const (
+	// AuthModeAPIKey authenticates agents with the access API key sent in the Authorization header.
+	AuthModeAPIKey = "apikey"
+	// AuthModePKI authenticates agents with the client certificate of the TLS connection.
+	AuthModePKI = "pki"
+
+	defaultAgentIDPattern = `^(.+)$`
+)
+
+// ServerAuth is the configuration for authenticating agent checkin and ack requests.
+type ServerAuth struct {
+	Mode string  `config:"mode"`
+	PKI  PKIAuth `config:"pki"`
+}
+
+// InitDefaults initializes the defaults for the configuration.
+func (c *ServerAuth) InitDefaults() {
+	c.Mode = AuthModeAPIKey
+	c.PKI.InitDefaults()
+}
+
+// Validate ensures that the configuration is valid.
+func (c *ServerAuth) Validate() error {
+	switch c.Mode {
+	case AuthModeAPIKey:
+		return nil
+	case AuthModePKI:
+		return c.PKI.validate()
+	default:
+		return fmt.Errorf("unknown auth mode %q, must be %q or %q", c.Mode, AuthModeAPIKey, AuthModePKI)
+	}
+}
+
+// PKIAuth is the configuration for authenticating agents with client certificates.
+type PKIAuth struct {
+	// CertificateAuthorities are the CA bundles the client certificates are verified against.
+	CertificateAuthorities []string `config:"certificate_authorities"`
+	// AgentIDPattern matches the agent ID in the certificate SANs or CN.
+	// The first capture group is used as the ID if there is one, otherwise the whole match.
+	AgentIDPattern string `config:"agent_id_pattern"`
+	// CRLs are the PEM or DER certificate revocation list files the client certificates are checked against.
+	CRLs []string `config:"crls"`
+}
+
+// InitDefaults initializes the defaults for the configuration.
+func (c *PKIAuth) InitDefaults() {
+	c.AgentIDPattern = defaultAgentIDPattern
+}
+
+// validate ensures that the configuration is valid, it is only called in pki mode: go-ucfg would call an exported
+// Validate for every mode.
+func (c *PKIAuth) validate() error {
+	if _, err := c.CertPool(); err != nil {
+		return err
+	}
+	if _, err := c.AgentIDRegexp(); err != nil {
+		return err
+	}
+	if _, err := c.RevocationLists(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// CertPool loads the certificate authorities.
+func (c *PKIAuth) CertPool() (*x509.CertPool, error) {
+	if len(c.CertificateAuthorities) == 0 {
+		return nil, errors.New("pki auth requires certificate_authorities")
+	}
+	pool, errs := tlscommon.LoadCertificateAuthorities(c.CertificateAuthorities)
+	if len(errs) != 0 {
+		return nil, fmt.Errorf("unable to load pki auth certificate authorities: %w", errors.Join(errs...))
+	}
+	return pool, nil
+}
+
+// AgentIDRegexp compiles the agent ID pattern.
+func (c *PKIAuth) AgentIDRegexp() (*regexp.Regexp, error) {
+	re, err := regexp.Compile(c.AgentIDPattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pki auth agent_id_pattern: %w", err)
+	}
+	return re, nil
+}
+
+// RevocationLists loads the certificate revocation lists, a file may hold several PEM encoded lists.
+func (c *PKIAuth) RevocationLists() ([]*x509.RevocationList, error) {
+	var lists []*x509.RevocationList
+	for _, path := range c.CRLs {
+		p, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read pki auth crl: %w", err)
+		}
+		ders := [][]byte{p}
+		if bytes.Contains(p, []byte("-----BEGIN")) {
+			ders = nil
+			for block, rest := pem.Decode(p); block != nil; block, rest = pem.Decode(rest) {
+				if block.Type == "X509 CRL" {
+					ders = append(ders, block.Bytes)
+				}
+			}
+			if len(ders) == 0 {
+				return nil, fmt.Errorf("pki auth crl %s contains no X509 CRL", path)
+			}
+		}
+		for _, der := range ders {
+			list, err := x509.ParseRevocationList(der)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pki auth crl %s: %w", path, err)
+			}
+			lists = append(lists, list)
+		}
+	}
+	return lists, nil
+}
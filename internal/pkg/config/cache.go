@@ -16,6 +16,10 @@ const (
 	defaultArtifactTTL  = time.Hour * 24
 	defaultAPIKeyTTL    = time.Minute * 15 // APIKey validation is a bottleneck.
 	defaultAPIKeyJitter = time.Minute * 5  // Jitter allows some randomness on APIKeyTTL, zero to disable
+	defaultAPIKeyNegTTL = time.Second * 10 // Keys that failed authentication are not checked again for this duration.
+
+	defaultArtifactRefreshFraction = 0.1             // Artifacts are fetched again in the background once less than this fraction of their TTL remains.
+	defaultArtifactSpillSize       = 8 * 1024 * 1024 // Larger artifact bodies are written to disk instead of being held in memory.
 )
 
 type Cache struct {
@@ -26,6 +30,18 @@ type Cache struct {
 	ArtifactTTL  time.Duration `config:"ttl_artifact"`
 	APIKeyTTL    time.Duration `config:"ttl_api_key"`
 	APIKeyJitter time.Duration `config:"jitter_api_key"`
+	APIKeyNegTTL time.Duration `config:"ttl_api_key_negative"`
+
+	// ArtifactRefreshFraction is the fraction of ArtifactTTL remaining below which a cached artifact is fetched
+	// again in the background while it is still served, a negative value disables it.
+	ArtifactRefreshFraction float64 `config:"refresh_artifact_fraction"`
+
+	// ArtifactSpillSize is the size in bytes above which the body of a cached artifact is written to a file in
+	// ArtifactSpillDir instead of being held in memory, a negative value holds all the bodies in memory.
+	ArtifactSpillSize int64 `config:"spill_artifact_size"`
+	// ArtifactSpillDir is the directory of the spilled artifact bodies, the system temporary directory if empty.
+	// The bodies left in it by a previous run are removed on start, it must not be shared by fleet-servers.
+	ArtifactSpillDir string `config:"spill_artifact_dir"`
 }
 
 func (c *Cache) InitDefaults() {}
@@ -49,12 +65,21 @@ func (c *Cache) LoadLimits(limits *envLimits) {
 	if c.ArtifactTTL == 0 {
 		c.ArtifactTTL = defaultArtifactTTL
 	}
+	if c.ArtifactRefreshFraction == 0 {
+		c.ArtifactRefreshFraction = defaultArtifactRefreshFraction
+	}
+	if c.ArtifactSpillSize == 0 {
+		c.ArtifactSpillSize = defaultArtifactSpillSize
+	}
 	if c.APIKeyTTL == 0 {
 		c.APIKeyTTL = defaultAPIKeyTTL
 	}
 	if c.APIKeyJitter == 0 {
 		c.APIKeyJitter = defaultAPIKeyJitter
 	}
+	if c.APIKeyNegTTL == 0 {
+		c.APIKeyNegTTL = defaultAPIKeyNegTTL
+	}
 }
 
 // CopyCache returns a copy of the config's Cache settings
@@ -68,6 +93,11 @@ func CopyCache(cfg *Config) Cache {
 		ArtifactTTL:  ccfg.ArtifactTTL,
 		APIKeyTTL:    ccfg.APIKeyTTL,
 		APIKeyJitter: ccfg.APIKeyJitter,
+		APIKeyNegTTL: ccfg.APIKeyNegTTL,
+
+		ArtifactRefreshFraction: ccfg.ArtifactRefreshFraction,
+		ArtifactSpillSize:       ccfg.ArtifactSpillSize,
+		ArtifactSpillDir:        ccfg.ArtifactSpillDir,
 	}
 }
 
@@ -78,6 +108,10 @@ func (c *Cache) MarshalZerologObject(e *zerolog.Event) {
 	e.Dur("actionTTL", c.ActionTTL)
 	e.Dur("enrollTTL", c.EnrollKeyTTL)
 	e.Dur("artifactTTL", c.ArtifactTTL)
+	e.Float64("artifactRefreshFraction", c.ArtifactRefreshFraction)
+	e.Int64("artifactSpillSize", c.ArtifactSpillSize)
+	e.Str("artifactSpillDir", c.ArtifactSpillDir)
 	e.Dur("apiKeyTTL", c.APIKeyTTL)
 	e.Dur("apiKeyJitter", c.APIKeyJitter)
+	e.Dur("apiKeyNegativeTTL", c.APIKeyNegTTL)
 }
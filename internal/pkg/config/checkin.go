@@ -0,0 +1,28 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package config
+
+import "fmt"
+
+const defaultMaxActionsPerResponse = 100
+
+// Checkin is the configuration of the checkin responses.
+type Checkin struct {
+	// MaxActionsPerResponse is the number of actions returned in a checkin response, the remaining actions are
+	// returned on the next checkins. The upgrade and unenroll actions are returned first. 0 returns all the actions.
+	MaxActionsPerResponse int `config:"max_actions_per_response"`
+}
+
+func (c *Checkin) InitDefaults() {
+	c.MaxActionsPerResponse = defaultMaxActionsPerResponse
+}
+
+// Validate ensures that the configuration is valid.
+func (c *Checkin) Validate() error {
+	if c.MaxActionsPerResponse < 0 {
+		return fmt.Errorf("max_actions_per_response must not be negative, got %d", c.MaxActionsPerResponse)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package config
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-version"
+)
+
+// Compatibility restricts the versions of the agents that can enroll and check in.
+type Compatibility struct {
+	// MinAgentVersion is the oldest accepted agent version, such as 7.16.
+	MinAgentVersion string `config:"min_agent_version"`
+	// MaxAgentVersion is the newest accepted agent version. A version without patch, such as 8.15, accepts all the
+	// patches of the minor.
+	MaxAgentVersion string `config:"max_agent_version"`
+	// RejectUnparsableVersion rejects the agents whose version can not be parsed, they are accepted with a warning
+	// otherwise.
+	RejectUnparsableVersion bool `config:"reject_unparsable_version"`
+}
+
+// Validate ensures that the configuration is valid.
+func (c *Compatibility) Validate() error {
+	minVer, maxVer, err := c.AgentVersionRange()
+	if err != nil {
+		return err
+	}
+	if minVer != nil && maxVer != nil && minVer.GreaterThan(maxVer) {
+		return fmt.Errorf("compatibility min_agent_version %s is greater than max_agent_version %s", c.MinAgentVersion, c.MaxAgentVersion)
+	}
+	return nil
+}
+
+// AgentVersionRange parses the accepted agent versions, a nil version is not bounded.
+func (c *Compatibility) AgentVersionRange() (*version.Version, *version.Version, error) {
+	var minVer, maxVer *version.Version
+	if c.MinAgentVersion != "" {
+		v, err := version.NewVersion(c.MinAgentVersion)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid compatibility min_agent_version: %w", err)
+		}
+		minVer = v.Core()
+	}
+	if c.MaxAgentVersion != "" {
+		v, err := version.NewVersion(c.MaxAgentVersion)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid compatibility max_agent_version: %w", err)
+		}
+		// The segments that are not set accept any value.
+		core, _, _ := strings.Cut(strings.TrimPrefix(c.MaxAgentVersion, "v"), "-")
+		set := strings.Count(core, ".") + 1
+		segments := v.Core().Segments()
+		s := make([]string, len(segments))
+		for i, segment := range segments {
+			if i >= set {
+				segment = math.MaxInt32
+			}
+			s[i] = strconv.Itoa(segment)
+		}
+		maxVer = version.Must(version.NewVersion(strings.Join(s, ".")))
+	}
+	return minVer, maxVer, nil
+}
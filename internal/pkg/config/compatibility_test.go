@@ -0,0 +1,78 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompatibilityAgentVersionRange(t *testing.T) {
+	tests := map[string]struct {
+		cfg Compatibility
+		min string
+		max string
+		err string
+	}{
+		"not bounded": {},
+		"min and max": {
+			cfg: Compatibility{MinAgentVersion: "7.16", MaxAgentVersion: "8.15.2"},
+			min: "7.16.0",
+			max: "8.15.2",
+		},
+		"max without patch": {
+			cfg: Compatibility{MaxAgentVersion: "8.15"},
+			max: "8.15.2147483647",
+		},
+		"max major": {
+			cfg: Compatibility{MaxAgentVersion: "8"},
+			max: "8.2147483647.2147483647",
+		},
+		"snapshot": {
+			cfg: Compatibility{MinAgentVersion: "8.16.0-SNAPSHOT"},
+			min: "8.16.0",
+		},
+		"invalid": {
+			cfg: Compatibility{MinAgentVersion: "seven"},
+			err: "invalid compatibility min_agent_version",
+		},
+		"min greater than max": {
+			cfg: Compatibility{MinAgentVersion: "8.16", MaxAgentVersion: "8.15"},
+			err: "compatibility min_agent_version 8.16 is greater than max_agent_version 8.15",
+		},
+		"min equals max minor": {
+			cfg: Compatibility{MinAgentVersion: "8.15.3", MaxAgentVersion: "8.15"},
+			min: "8.15.3",
+			max: "8.15.2147483647",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := test.cfg.Validate()
+			if test.err != "" {
+				assert.ErrorContains(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+
+			minVer, maxVer, err := test.cfg.AgentVersionRange()
+			require.NoError(t, err)
+			if test.min == "" {
+				assert.Nil(t, minVer)
+			} else {
+				assert.Equal(t, test.min, minVer.String())
+			}
+			if test.max == "" {
+				assert.Nil(t, maxVer)
+			} else {
+				assert.Equal(t, test.max, maxVer.String())
+			}
+		})
+	}
+}
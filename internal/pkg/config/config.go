@@ -8,6 +8,8 @@ package config
 import (
 	"context"
 	"errors"
+	"fmt"
+	"slices"
 	"sync"
 
 	"github.com/elastic/fleet-server/v7/version"
@@ -52,6 +54,18 @@ type Config struct {
 	Logging Logging `config:"logging"`
 	HTTP    HTTP    `config:"http"`
 	m       sync.Mutex
+
+	// userLimits are the limits and cache settings before the settings of a limits tier are merged
+	// into them, so that the limits can be loaded again for a different tier.
+	userLimits *userLimits
+}
+
+type userLimits struct {
+	server     ServerLimits
+	cache      Cache
+	output     ConnPool
+	monitoring ConnPool
+	enroll     int
 }
 
 var deprecatedConfigOptions = map[string]string{
@@ -83,12 +97,32 @@ func (c *Config) Validate() error {
 	if len(c.Inputs) > 1 {
 		return errors.New("only 1 fleet-server input can be defined")
 	}
+	// The checkin time written to the agent documents lags by up to status_write_interval.
+	if interval, timeout := c.Inputs[0].Server.Bulk.Checkin.StatusWriteInterval, c.Fleet.Agent.InactivityTimeout; interval > 0 && timeout > 0 && interval >= timeout {
+		return fmt.Errorf("status_write_interval (%s) must be shorter than inactivity_timeout (%s)", interval, timeout)
+	}
 	return nil
 }
 
 // LoadServerLimits should be called after initialization, so we may access the user defined
 // agent limit setting.
 func (c *Config) LoadServerLimits() error {
+	return c.loadServerLimits(loadLimits)
+}
+
+// LoadServerLimitsForAgents loads the limits like LoadServerLimits, but uses the tier for the passed number
+// of active agents when max_agents is not set.
+// It may be called again on the same configuration, the settings the user defined are kept.
+func (c *Config) LoadServerLimitsForAgents(activeAgents int) error {
+	return c.loadServerLimits(func(maxAgents int) *envLimits {
+		if maxAgents != 0 {
+			return loadLimits(maxAgents)
+		}
+		return loadLimitsForAgents(activeAgents)
+	})
+}
+
+func (c *Config) loadServerLimits(load func(maxAgents int) *envLimits) error {
 	c.m.Lock()
 	defer c.m.Unlock()
 	err := c.Validate()
@@ -98,9 +132,80 @@ func (c *Config) LoadServerLimits() error {
 	}
 
 	fleetInput := &c.Inputs[0]
-	agentLimits := loadLimits(fleetInput.Server.Limits.MaxAgents)
+	if c.userLimits == nil {
+		c.userLimits = &userLimits{server: fleetInput.Server.Limits, cache: fleetInput.Cache, output: c.Output.Elasticsearch.ConnPool, enroll: fleetInput.Server.Enroll.MaxConcurrency}
+		if c.Output.Monitoring != nil {
+			c.userLimits.monitoring = c.Output.Monitoring.Elasticsearch.ConnPool
+		}
+	}
+	fleetInput.Server.Limits = c.userLimits.server
+	fleetInput.Cache = c.userLimits.cache
+	fleetInput.Server.Enroll.MaxConcurrency = c.userLimits.enroll
+	c.Output.Elasticsearch.ConnPool = c.userLimits.output
+
+	agentLimits := load(fleetInput.Server.Limits.MaxAgents)
 	fleetInput.Cache.LoadLimits(agentLimits)
 	fleetInput.Server.Limits.LoadLimits(agentLimits)
+	fleetInput.Server.Enroll.LoadLimits(agentLimits)
+	c.Output.Elasticsearch.LoadLimits(agentLimits)
+	if c.Output.Monitoring != nil {
+		c.Output.Monitoring.Elasticsearch.ConnPool = c.userLimits.monitoring
+		c.Output.Monitoring.Elasticsearch.LoadLimits(agentLimits)
+	}
+	return nil
+}
+
+// Copy returns a shallow copy of the configuration.
+// The inputs and the monitoring output are copied so the limits of the copy can be loaded again without changing c.
+func (c *Config) Copy() *Config {
+	c.m.Lock()
+	defer c.m.Unlock()
+	output := c.Output
+	if output.Monitoring != nil {
+		monitoring := *output.Monitoring
+		output.Monitoring = &monitoring
+	}
+	return &Config{
+		Fleet:      c.Fleet,
+		Output:     output,
+		Inputs:     slices.Clone(c.Inputs),
+		Logging:    c.Logging,
+		HTTP:       c.HTTP,
+		userLimits: c.userLimits,
+	}
+}
+
+// CopyOutputNoLimits returns a copy of the output configuration with the connection pool settings that are defined by
+// the user, the settings loaded from the limits tier are left out.
+func (c *Config) CopyOutputNoLimits() Output {
+	c.m.Lock()
+	defer c.m.Unlock()
+	output := c.Output
+	if c.userLimits == nil {
+		return output
+	}
+	output.Elasticsearch.ConnPool = c.userLimits.output
+	if output.Monitoring != nil {
+		monitoring := *output.Monitoring
+		monitoring.Elasticsearch.ConnPool = c.userLimits.monitoring
+		output.Monitoring = &monitoring
+	}
+	return output
+}
+
+// LoadServiceTokens reads the service tokens of the elasticsearch outputs that are configured with service_token_path.
+// It should be called each time the configuration is (re)loaded so changes to the token files are detected.
+func (c *Config) LoadServiceTokens() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if err := c.Output.Elasticsearch.LoadServiceToken(); err != nil {
+		return err
+	}
+	if c.Output.Monitoring != nil {
+		if err := c.Output.Monitoring.Elasticsearch.LoadServiceToken(); err != nil {
+			return fmt.Errorf("monitoring: %w", err)
+		}
+	}
 	return nil
 }
 
@@ -149,13 +254,30 @@ func (c *Config) Merge(other *Config) (*Config, error) {
 
 func redactOutput(cfg *Config) Output {
 	redacted := cfg.Output
+	redacted.Elasticsearch = redactElasticsearch(redacted.Elasticsearch)
 
-	if redacted.Elasticsearch.ServiceToken != "" {
-		redacted.Elasticsearch.ServiceToken = kRedacted
+	if redacted.Monitoring != nil {
+		monitoring := *redacted.Monitoring
+		monitoring.Elasticsearch = redactElasticsearch(monitoring.Elasticsearch)
+		redacted.Monitoring = &monitoring
 	}
 
-	if redacted.Elasticsearch.TLS != nil {
-		newTLS := *redacted.Elasticsearch.TLS
+	return redacted
+}
+
+func redactElasticsearch(redacted Elasticsearch) Elasticsearch {
+	if redacted.ServiceToken != "" {
+		redacted.ServiceToken = kRedacted
+	}
+	if redacted.Password != "" {
+		redacted.Password = kRedacted
+	}
+	if redacted.APIKey != "" {
+		redacted.APIKey = kRedacted
+	}
+
+	if redacted.TLS != nil {
+		newTLS := *redacted.TLS
 
 		if newTLS.Certificate.Key != "" {
 			newTLS.Certificate.Key = kRedacted
@@ -164,7 +286,7 @@ func redactOutput(cfg *Config) Output {
 			newTLS.Certificate.Passphrase = kRedacted
 		}
 
-		redacted.Elasticsearch.TLS = &newTLS
+		redacted.TLS = &newTLS
 	}
 
 	return redacted
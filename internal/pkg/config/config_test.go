@@ -42,6 +42,7 @@ func TestConfig(t *testing.T) {
 							FetchSize:          defaultFetchSize,
 							PollTimeout:        defaultPollTimeout,
 							PolicyDebounceTime: defaultPolicyDebounceTime,
+							ReplayMaxDocs:      defaultReplayMaxDocs,
 						},
 					},
 				},
@@ -71,6 +72,68 @@ func TestConfig(t *testing.T) {
 							FetchSize:          defaultFetchSize,
 							PollTimeout:        defaultPollTimeout,
 							PolicyDebounceTime: defaultPolicyDebounceTime,
+							ReplayMaxDocs:      defaultReplayMaxDocs,
+						},
+					},
+				},
+				Logging: defaultLogging(),
+				HTTP:    defaultHTTP(),
+			},
+		},
+		"logging-audit": {
+			cfg: &Config{
+				Fleet: defaultFleet(),
+				Output: Output{
+					Elasticsearch: defaultElastic(),
+				},
+				Inputs: []Input{
+					{
+						Type:   "fleet-server",
+						Server: defaultServer(),
+						Cache:  defaultCache(),
+						Monitor: Monitor{
+							FetchSize:          defaultFetchSize,
+							PollTimeout:        defaultPollTimeout,
+							PolicyDebounceTime: defaultPolicyDebounceTime,
+							ReplayMaxDocs:      defaultReplayMaxDocs,
+						},
+					},
+				},
+				Logging: func() Logging {
+					d := defaultLogging()
+					files := &LoggingAuditFiles{}
+					files.InitDefaults()
+					files.Path = "/var/log/fleet-server"
+					d.Audit = LoggingAudit{Enabled: true, Files: files}
+					return d
+				}(),
+				HTTP: defaultHTTP(),
+			},
+		},
+		"output-monitoring": {
+			cfg: &Config{
+				Fleet: defaultFleet(),
+				Output: Output{
+					Elasticsearch: defaultElastic(),
+					Monitoring: &MonitoringOutput{
+						Elasticsearch: func() Elasticsearch {
+							d := defaultElastic()
+							d.Hosts = []string{"monitoring:9200"}
+							d.ServiceToken = "monitoring-token"
+							return d
+						}(),
+					},
+				},
+				Inputs: []Input{
+					{
+						Type:   "fleet-server",
+						Server: defaultServer(),
+						Cache:  defaultCache(),
+						Monitor: Monitor{
+							FetchSize:          defaultFetchSize,
+							PollTimeout:        defaultPollTimeout,
+							PolicyDebounceTime: defaultPolicyDebounceTime,
+							ReplayMaxDocs:      defaultReplayMaxDocs,
 						},
 					},
 				},
@@ -93,6 +156,7 @@ func TestConfig(t *testing.T) {
 							FetchSize:          defaultFetchSize,
 							PollTimeout:        defaultPollTimeout,
 							PolicyDebounceTime: defaultPolicyDebounceTime,
+							ReplayMaxDocs:      defaultReplayMaxDocs,
 						},
 					},
 				},
@@ -110,7 +174,7 @@ func TestConfig(t *testing.T) {
 					{
 						Type: "fleet-server",
 						Server: Server{
-							Host:         "localhost",
+							Host:         BindHosts{"localhost"},
 							Port:         8888,
 							InternalPort: 8221,
 							Timeouts: ServerTimeouts{
@@ -123,6 +187,11 @@ func TestConfig(t *testing.T) {
 								CheckinJitter:    30 * time.Second,
 								CheckinMaxPoll:   10 * time.Minute,
 								Drain:            10 * time.Second,
+								DrainGrace:       5 * time.Second,
+								Enroll:           time.Minute,
+								Ack:              time.Minute,
+								Artifact:         2 * time.Minute,
+								UploadChunk:      2 * time.Minute,
 							},
 							Profiler: ServerProfiler{
 								Enabled: false,
@@ -137,12 +206,25 @@ func TestConfig(t *testing.T) {
 								UpstreamURL: defaultPGPUpstreamURL,
 								Dir:         filepath.Join(retrieveExecutableDir(), defaultPGPDirectoryName),
 							},
+							Auth:        defaultServerAuth(),
+							HealthCheck: defaultServerHealthCheck(),
+							Enroll:      defaultServerEnroll(),
+							ArtifactUpstream: ArtifactUpstream{
+								Timeout: defaultArtifactUpstreamTimeout,
+								MaxSize: defaultArtifactUpstreamMaxSize,
+							},
+							Checkin:          Checkin{MaxActionsPerResponse: defaultMaxActionsPerResponse},
+							ActionResults:    ActionResults{MaxResponseSize: defaultMaxActionResponseSize},
+							AgentActions:     AgentActions{DefaultExpiration: defaultAgentActionExpiration},
+							SelfMetrics:      SelfMetrics{Interval: defaultSelfMetricsInterval},
+							ConfigPrecedence: PrecedencePolicy,
 						},
 						Cache: generateCache(0),
 						Monitor: Monitor{
 							FetchSize:          defaultFetchSize,
 							PollTimeout:        defaultPollTimeout,
 							PolicyDebounceTime: defaultPolicyDebounceTime,
+							ReplayMaxDocs:      defaultReplayMaxDocs,
 						},
 					},
 				},
@@ -160,7 +242,16 @@ func TestConfig(t *testing.T) {
 			err: "invalid log level; must be one of: trace, debug, info, warn, error",
 		},
 		"bad-output": {
-			err: "can only contain elasticsearch key",
+			err: "can only contain elasticsearch or monitoring keys",
+		},
+		"bad-server-tls": {
+			err: "invalid tls cipher suite 'RC4-MD5'",
+		},
+		"bad-http-tls": {
+			err: "invalid tls version 'SSLv3'",
+		},
+		"bad-http-tls-curve": {
+			err: "invalid tls curve type 'P-128'",
 		},
 	}
 
@@ -175,7 +266,12 @@ func TestConfig(t *testing.T) {
 					t.Error("no error was reported")
 				} else {
 					cfgErr := err.(ucfg.Error) //nolint:errcheck,errorlint // this is checked below, but the linter doesn't respect it.
-					require.Equal(t, test.err, cfgErr.Reason().Error())
+					// The tls settings are unpacked again by tlscommon, their errors are wrapped twice.
+					reason := cfgErr.Reason()
+					for inner, ok := reason.(ucfg.Error); ok; inner, ok = reason.(ucfg.Error) { //nolint:errorlint // the reasons are not wrapped
+						reason = inner.Reason()
+					}
+					require.Equal(t, test.err, reason.Error())
 				}
 			} else {
 				require.NoError(t, err)
@@ -207,7 +303,7 @@ func TestConfig(t *testing.T) {
 		expected := Config{
 			Fleet: defaultFleet(),
 			Output: Output{
-				Elasticsearch: defaultElastic(),
+				Elasticsearch: generateElastic(2500),
 			},
 			Inputs: []Input{
 				{
@@ -218,6 +314,7 @@ func TestConfig(t *testing.T) {
 						FetchSize:          defaultFetchSize,
 						PollTimeout:        defaultPollTimeout,
 						PolicyDebounceTime: defaultPolicyDebounceTime,
+						ReplayMaxDocs:      defaultReplayMaxDocs,
 					},
 				},
 			},
@@ -225,6 +322,7 @@ func TestConfig(t *testing.T) {
 			HTTP:    defaultHTTP(),
 		}
 		expected.Inputs[0].Server.Limits = generateServerLimits(2500)
+		expected.Inputs[0].Server.Enroll.MaxConcurrency = 25
 		t.Log("After expect")
 		assert.EqualExportedValues(t, expected, *cfg)
 
@@ -303,9 +401,119 @@ func TestLoadServerLimits(t *testing.T) {
 		assert.NotZero(t, c.Inputs[0].Server.Limits.CheckinLimit.Burst)
 		assert.NotZero(t, c.Inputs[0].Cache.ActionTTL)
 	})
+	t.Run("enroll retry limits", func(t *testing.T) {
+		c := &Config{Inputs: []Input{{}}}
+		require.NoError(t, c.LoadServerLimits())
+		l := c.Inputs[0].Server.Limits.EnrollLimit
+		assert.Equal(t, defaultEnrollRetryFactor*l.Burst, l.RetryBurst)
+		assert.Equal(t, defaultEnrollRetryFactor*l.Max, l.RetryMax)
+		assert.Equal(t, Limit{Interval: l.Interval, Burst: l.RetryBurst, Max: l.RetryMax, MaxBody: l.MaxBody, MaxWait: l.MaxWait}, l.RetryLimit())
+
+		c = &Config{Inputs: []Input{{
+			Server: Server{
+				Limits: ServerLimits{
+					EnrollLimit: EnrollLimit{RetryBurst: 1000},
+				},
+			},
+		}}}
+		require.NoError(t, c.LoadServerLimits())
+		l = c.Inputs[0].Server.Limits.EnrollLimit
+		assert.Equal(t, 1000, l.RetryBurst)
+		assert.Equal(t, defaultEnrollRetryFactor*l.Max, l.RetryMax)
+	})
 
 }
 
+func TestLoadServerLimitsForAgents(t *testing.T) {
+	t.Run("tier follows the active agents", func(t *testing.T) {
+		c := &Config{Inputs: []Input{{
+			Server: Server{
+				Limits: ServerLimits{
+					ActionLimit: Limit{
+						Interval: time.Millisecond,
+					},
+				},
+			},
+		}}}
+		require.NoError(t, c.LoadServerLimitsForAgents(100))
+		assert.Equal(t, AgentRange{Min: 0, Max: 2500}, c.Inputs[0].Server.Limits.Agents)
+		assert.Equal(t, int64(2500), c.Inputs[0].Server.Limits.CheckinLimit.Max)
+		assert.Equal(t, 128, c.Output.Elasticsearch.ConnPool.MaxConnsPerHost)
+		assert.Equal(t, 25, c.Inputs[0].Server.Enroll.MaxConcurrency)
+
+		require.NoError(t, c.LoadServerLimitsForAgents(12000))
+		assert.Equal(t, AgentRange{Min: 10001, Max: 20000}, c.Inputs[0].Server.Limits.Agents)
+		assert.Equal(t, int64(20000), c.Inputs[0].Server.Limits.CheckinLimit.Max)
+		assert.Equal(t, int64(134217728), c.Inputs[0].Cache.MaxCost)
+		assert.Equal(t, 256, c.Output.Elasticsearch.ConnPool.MaxConnsPerHost)
+		assert.Equal(t, 150, c.Output.Elasticsearch.ConnPool.MaxIdleConnsPerHost)
+		assert.Equal(t, time.Millisecond, c.Inputs[0].Server.Limits.ActionLimit.Interval, "user defined limits are kept")
+		assert.Equal(t, 75, c.Inputs[0].Server.Enroll.MaxConcurrency)
+
+		require.NoError(t, c.LoadServerLimitsForAgents(100))
+		assert.Equal(t, int64(2500), c.Inputs[0].Server.Limits.CheckinLimit.Max)
+		assert.Equal(t, int64(52428800), c.Inputs[0].Cache.MaxCost)
+		assert.Equal(t, 128, c.Output.Elasticsearch.ConnPool.MaxConnsPerHost)
+	})
+	t.Run("user defined connection pool is kept", func(t *testing.T) {
+		c := &Config{
+			Output: Output{
+				Elasticsearch: Elasticsearch{ConnPool: ConnPool{MaxIdleConnsPerHost: 64}},
+				Monitoring:    &MonitoringOutput{Elasticsearch: Elasticsearch{MaxConnPerHost: 16}},
+			},
+			Inputs: []Input{{}},
+		}
+		require.NoError(t, c.LoadServerLimitsForAgents(12000))
+		assert.Equal(t, 64, c.Output.Elasticsearch.ConnPool.MaxIdleConnsPerHost)
+		assert.Equal(t, 256, c.Output.Elasticsearch.ConnPool.MaxConnsPerHost)
+		assert.Equal(t, 16, c.Output.Monitoring.Elasticsearch.ConnPool.MaxConnsPerHost, "max_conn_per_host is used")
+		assert.Equal(t, 500, c.Output.Monitoring.Elasticsearch.ConnPool.MaxIdleConns)
+	})
+	t.Run("user defined enroll concurrency is kept", func(t *testing.T) {
+		c := &Config{Inputs: []Input{{Server: Server{Enroll: Enroll{MaxConcurrency: 10}}}}}
+		require.NoError(t, c.LoadServerLimitsForAgents(12000))
+		assert.Equal(t, 10, c.Inputs[0].Server.Enroll.MaxConcurrency)
+		require.NoError(t, c.LoadServerLimitsForAgents(100))
+		assert.Equal(t, 10, c.Inputs[0].Server.Enroll.MaxConcurrency)
+	})
+	t.Run("max_agents takes precedence", func(t *testing.T) {
+		c := &Config{Inputs: []Input{{
+			Server: Server{
+				Limits: ServerLimits{
+					MaxAgents: 2500,
+				},
+			},
+		}}}
+		require.NoError(t, c.LoadServerLimitsForAgents(12000))
+		assert.Equal(t, AgentRange{Min: 0, Max: 2500}, c.Inputs[0].Server.Limits.Agents)
+	})
+	t.Run("copy is loaded independently", func(t *testing.T) {
+		c := &Config{Inputs: []Input{{}}}
+		require.NoError(t, c.LoadServerLimitsForAgents(100))
+		cp := c.Copy()
+		require.NoError(t, cp.LoadServerLimitsForAgents(12000))
+		assert.Equal(t, int64(2500), c.Inputs[0].Server.Limits.CheckinLimit.Max)
+		assert.Equal(t, int64(20000), cp.Inputs[0].Server.Limits.CheckinLimit.Max)
+	})
+	t.Run("output without limits", func(t *testing.T) {
+		c := &Config{
+			Output: Output{
+				Elasticsearch: Elasticsearch{ConnPool: ConnPool{MaxIdleConnsPerHost: 64}},
+				Monitoring:    &MonitoringOutput{},
+			},
+			Inputs: []Input{{}},
+		}
+		require.NoError(t, c.LoadServerLimitsForAgents(100))
+		cp := c.Copy()
+		require.NoError(t, cp.LoadServerLimitsForAgents(12000))
+		require.NotEqual(t, c.Output, cp.Output)
+		assert.Equal(t, c.CopyOutputNoLimits(), cp.CopyOutputNoLimits(), "the pool of the tier is left out")
+		assert.Equal(t, ConnPool{MaxIdleConnsPerHost: 64}, cp.CopyOutputNoLimits().Elasticsearch.ConnPool)
+		assert.Equal(t, ConnPool{}, cp.CopyOutputNoLimits().Monitoring.Elasticsearch.ConnPool)
+		assert.Equal(t, 256, cp.Output.Monitoring.Elasticsearch.ConnPool.MaxConnsPerHost, "the loaded pool is kept")
+	})
+}
+
 // Stub out the defaults so that the above is easier to maintain
 
 func defaultCache() Cache {
@@ -340,6 +548,25 @@ func defaultServerGC() GC {
 	return d
 }
 
+func defaultServerAuth() ServerAuth {
+	var d ServerAuth
+	d.InitDefaults()
+	return d
+}
+
+func defaultServerHealthCheck() HealthCheck {
+	var d HealthCheck
+	d.InitDefaults()
+	return d
+}
+
+func defaultServerEnroll() Enroll {
+	var d Enroll
+	d.InitDefaults()
+	d.LoadLimits(loadLimits(0))
+	return d
+}
+
 func defaultLogging() Logging {
 	var d Logging
 	d.InitDefaults()
@@ -362,21 +589,35 @@ func defaultFleet() Fleet {
 }
 
 func defaultElastic() Elasticsearch {
-	return Elasticsearch{
+	return generateElastic(0)
+}
+
+func generateElastic(maxAgents int) Elasticsearch {
+	d := Elasticsearch{
 		Protocol:         "http",
 		ServiceToken:     "test-token",
 		Hosts:            []string{"localhost:9200"},
 		MaxRetries:       3,
-		MaxConnPerHost:   128,
 		MaxContentLength: 104857600,
 		Timeout:          90 * time.Second,
+		BulkRetry: BulkRetry{
+			MaxRetries:   3,
+			InitInterval: 250 * time.Millisecond,
+			MaxInterval:  5 * time.Second,
+		},
+		Bulk: OutputBulk{
+			MaxPendingWait: 30 * time.Second,
+		},
 	}
+	d.LoadLimits(loadLimits(maxAgents))
+	return d
 }
 
 func defaultServer() Server {
 	var d Server
 	d.InitDefaults()
 	d.Limits.LoadLimits(loadLimits(0))
+	d.Enroll.LoadLimits(loadLimits(0))
 	return d
 }
 
@@ -0,0 +1,168 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package config
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/elastic/elastic-agent-libs/transport/tlscommon"
+)
+
+const (
+	defaultKubernetesAPIServer = "https://kubernetes.default.svc"
+	defaultKubernetesCA        = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	defaultKubernetesTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	defaultKubernetesTimeout   = 10 * time.Second
+
+	defaultEnrollMaxConcurrencyWait = time.Second
+)
+
+// Consistencies of the agent documents written by the enrollments, selected with enroll.consistency.
+const (
+	// EnrollConsistencyWaitFor is the default, the enrollment returns once the agent document is visible to searches.
+	EnrollConsistencyWaitFor = "wait_for"
+	// EnrollConsistencyRealtimeGet returns without waiting for a refresh, the agent documents that searches miss are
+	// looked up with a realtime get by their id.
+	EnrollConsistencyRealtimeGet = "realtime_get"
+)
+
+// Enroll is the configuration of the enrollments, and of the enrollment auth providers used besides the enrollment
+// tokens.
+type Enroll struct {
+	// Consistency selects how the agents see their document right after they enrolled.
+	Consistency string `config:"consistency"`
+	// MaxConcurrency is the max number of authenticated enrollments creating API keys and writing to Elasticsearch
+	// at once, 0 uses the value of the limits tier.
+	MaxConcurrency int `config:"max_concurrency"`
+	// MaxConcurrencyWait is how long an enrollment over max_concurrency waits before it is answered with a 503.
+	MaxConcurrencyWait time.Duration    `config:"max_concurrency_wait"`
+	Kubernetes         KubernetesEnroll `config:"kubernetes"`
+}
+
+// InitDefaults initializes the defaults for the configuration.
+func (c *Enroll) InitDefaults() {
+	c.Consistency = EnrollConsistencyWaitFor
+	c.MaxConcurrencyWait = defaultEnrollMaxConcurrencyWait
+	c.Kubernetes.InitDefaults()
+}
+
+// Validate ensures that the configuration is valid.
+func (c *Enroll) Validate() error {
+	switch c.Consistency {
+	case "", EnrollConsistencyWaitFor, EnrollConsistencyRealtimeGet:
+	default:
+		return fmt.Errorf("enroll consistency must be %q or %q", EnrollConsistencyWaitFor, EnrollConsistencyRealtimeGet)
+	}
+	if c.MaxConcurrency < 0 {
+		return fmt.Errorf("enroll max_concurrency must not be negative, got %d", c.MaxConcurrency)
+	}
+	if c.MaxConcurrencyWait < 0 {
+		return fmt.Errorf("enroll max_concurrency_wait must not be negative, got %s", c.MaxConcurrencyWait)
+	}
+	return nil
+}
+
+// LoadLimits sets max_concurrency to the value of the limits tier when it is not set.
+func (c *Enroll) LoadLimits(limits *envLimits) {
+	if c.MaxConcurrency == 0 {
+		c.MaxConcurrency = limits.Server.EnrollMaxConcurrency
+	}
+}
+
+// KubernetesEnroll is the configuration for enrolling agents with a Kubernetes service account token.
+// The token is validated with the TokenReview API of the cluster, and the namespace and service account
+// it was issued to select the policy the agent is enrolled in.
+type KubernetesEnroll struct {
+	Enabled bool `config:"enabled"`
+	// APIServer is the URL of the Kubernetes API server.
+	APIServer string `config:"api_server"`
+	// CertificateAuthorities are the CA bundles the API server certificate is verified against.
+	CertificateAuthorities []string `config:"certificate_authorities"`
+	// TokenFile holds the token fleet-server authenticates to the API server with, it is read on each review
+	// so that a rotated token is picked up.
+	TokenFile string `config:"token_file"`
+	// Audience is the audience the service account tokens must be issued for.
+	Audience string        `config:"audience"`
+	Timeout  time.Duration `config:"timeout"`
+	// FallbackToToken continues with the enrollment token authentication when the service account token is rejected.
+	FallbackToToken bool `config:"fallback_to_token"`
+	// Policies maps the service accounts to the policies, the first matching entry is used.
+	Policies []KubernetesPolicy `config:"policies"`
+}
+
+// KubernetesPolicy maps the service accounts of a namespace to a policy.
+type KubernetesPolicy struct {
+	Namespace string `config:"namespace"`
+	// ServiceAccount is the name of the service account, any service account of the namespace matches if it's empty.
+	ServiceAccount string `config:"service_account"`
+	PolicyID       string `config:"policy_id"`
+}
+
+// InitDefaults initializes the defaults for the configuration.
+func (c *KubernetesEnroll) InitDefaults() {
+	c.APIServer = defaultKubernetesAPIServer
+	c.CertificateAuthorities = []string{defaultKubernetesCA}
+	c.TokenFile = defaultKubernetesTokenFile
+	c.Timeout = defaultKubernetesTimeout
+	c.FallbackToToken = true
+}
+
+// Validate ensures that the configuration is valid, it's only checked when the provider is enabled.
+func (c *KubernetesEnroll) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	u, err := url.Parse(c.APIServer)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("kubernetes enroll api_server must be an https URL, got %q", c.APIServer)
+	}
+	if c.Audience == "" {
+		return errors.New("kubernetes enroll requires an audience")
+	}
+	if c.TokenFile == "" {
+		return errors.New("kubernetes enroll requires a token_file")
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("kubernetes enroll timeout must be positive, got %s", c.Timeout)
+	}
+	if len(c.Policies) == 0 {
+		return errors.New("kubernetes enroll requires at least one policy")
+	}
+	for i, p := range c.Policies {
+		if p.Namespace == "" || p.PolicyID == "" {
+			return fmt.Errorf("kubernetes enroll policy %d requires a namespace and a policy_id", i)
+		}
+	}
+	if _, err := c.CertPool(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// CertPool loads the certificate authorities of the API server.
+func (c *KubernetesEnroll) CertPool() (*x509.CertPool, error) {
+	if len(c.CertificateAuthorities) == 0 {
+		return nil, errors.New("kubernetes enroll requires certificate_authorities")
+	}
+	pool, errs := tlscommon.LoadCertificateAuthorities(c.CertificateAuthorities)
+	if len(errs) != 0 {
+		return nil, fmt.Errorf("unable to load kubernetes enroll certificate authorities: %w", errors.Join(errs...))
+	}
+	return pool, nil
+}
+
+// PolicyID returns the policy of the service account, and false if no policy is mapped to it.
+func (c *KubernetesEnroll) PolicyID(namespace, serviceAccount string) (string, bool) {
+	for _, p := range c.Policies {
+		if p.Namespace == namespace && (p.ServiceAccount == "" || p.ServiceAccount == serviceAccount) {
+			return p.PolicyID, true
+		}
+	}
+	return "", false
+}
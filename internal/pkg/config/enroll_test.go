@@ -0,0 +1,129 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elastic/go-ucfg"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+func TestKubernetesEnrollValidate(t *testing.T) {
+	testcases := map[string]struct {
+		cfg map[string]interface{}
+		err string
+	}{
+		"disabled": {
+			cfg: map[string]interface{}{"audience": ""},
+		},
+		"missing audience": {
+			cfg: map[string]interface{}{
+				"enabled":  true,
+				"policies": []map[string]interface{}{{"namespace": "monitoring", "policy_id": "policy-k8s"}},
+			},
+			err: "kubernetes enroll requires an audience",
+		},
+		"http api server": {
+			cfg: map[string]interface{}{
+				"enabled":    true,
+				"api_server": "http://kubernetes.default.svc",
+				"audience":   "fleet-server",
+			},
+			err: "kubernetes enroll api_server must be an https URL",
+		},
+		"no policies": {
+			cfg: map[string]interface{}{
+				"enabled":  true,
+				"audience": "fleet-server",
+			},
+			err: "kubernetes enroll requires at least one policy",
+		},
+		"policy without namespace": {
+			cfg: map[string]interface{}{
+				"enabled":  true,
+				"audience": "fleet-server",
+				"policies": []map[string]interface{}{{"policy_id": "policy-k8s"}},
+			},
+			err: "kubernetes enroll policy 0 requires a namespace and a policy_id",
+		},
+	}
+
+	for name, test := range testcases {
+		t.Run(name, func(t *testing.T) {
+			c, err := ucfg.NewFrom(map[string]interface{}{"enroll": map[string]interface{}{"kubernetes": test.cfg}}, DefaultOptions...)
+			require.NoError(t, err)
+
+			var cfg Server
+			cfg.InitDefaults()
+			err = c.Unpack(&cfg, DefaultOptions...)
+			if test.err != "" {
+				assert.ErrorContains(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestKubernetesEnrollPolicyID(t *testing.T) {
+	cfg := KubernetesEnroll{
+		Policies: []KubernetesPolicy{
+			{Namespace: "monitoring", ServiceAccount: "elastic-agent", PolicyID: "policy-agent"},
+			{Namespace: "monitoring", PolicyID: "policy-monitoring"},
+			{Namespace: "monitoring", ServiceAccount: "other", PolicyID: "policy-shadowed"},
+		},
+	}
+
+	policyID, ok := cfg.PolicyID("monitoring", "elastic-agent")
+	assert.True(t, ok)
+	assert.Equal(t, "policy-agent", policyID)
+
+	policyID, ok = cfg.PolicyID("monitoring", "other")
+	assert.True(t, ok)
+	assert.Equal(t, "policy-monitoring", policyID, "the first matching entry is used")
+
+	_, ok = cfg.PolicyID("default", "elastic-agent")
+	assert.False(t, ok)
+}
+
+func TestEnrollConsistency(t *testing.T) {
+	var cfg Server
+	cfg.InitDefaults()
+	assert.Equal(t, EnrollConsistencyWaitFor, cfg.Enroll.Consistency)
+
+	c, err := ucfg.NewFrom(map[string]interface{}{"enroll": map[string]interface{}{"consistency": "realtime_get"}}, DefaultOptions...)
+	require.NoError(t, err)
+	require.NoError(t, c.Unpack(&cfg, DefaultOptions...))
+	assert.Equal(t, EnrollConsistencyRealtimeGet, cfg.Enroll.Consistency)
+
+	c, err = ucfg.NewFrom(map[string]interface{}{"enroll": map[string]interface{}{"consistency": "true"}}, DefaultOptions...)
+	require.NoError(t, err)
+	cfg.InitDefaults()
+	assert.ErrorContains(t, c.Unpack(&cfg, DefaultOptions...), `enroll consistency must be "wait_for" or "realtime_get"`)
+}
+
+func TestEnrollMaxConcurrency(t *testing.T) {
+	log := testlog.SetLogger(t)
+	zerolog.DefaultContextLogger = &log
+
+	var cfg Enroll
+	cfg.InitDefaults()
+	assert.Equal(t, time.Second, cfg.MaxConcurrencyWait)
+	cfg.LoadLimits(loadLimits(2500))
+	assert.Equal(t, 25, cfg.MaxConcurrency)
+	cfg.LoadLimits(loadLimits(40001))
+	assert.Equal(t, 25, cfg.MaxConcurrency, "the value that is set is kept")
+
+	cfg.MaxConcurrency = -1
+	assert.ErrorContains(t, cfg.Validate(), "enroll max_concurrency must not be negative")
+}
@@ -5,16 +5,21 @@
 package config
 
 import (
+	"cmp"
 	"context"
 	"embed"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"math"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/docker/go-units"
 	"github.com/elastic/go-ucfg/yaml"
 	"github.com/pbnjay/memory"
 	"github.com/rs/zerolog"
@@ -26,6 +31,13 @@ const (
 
 	defaultMaxConnections = 0 // no limit
 
+	defaultEnrollMaxConcurrency = 50
+
+	defaultOutputMaxIdleConns        = 100
+	defaultOutputMaxIdleConnsPerHost = 32
+	defaultOutputMaxConnsPerHost     = 128
+	defaultOutputIdleConnTimeout     = 60 * time.Second
+
 	defaultActionInterval = 0 // no throttle
 	defaultActionBurst    = 5
 
@@ -81,6 +93,11 @@ const (
 	defaultPGPRetrievalBurst    = 25
 	defaultPGPRetrievalMax      = 50
 	defaultPGPRetrievalMaxBody  = 0
+
+	defaultAgentActionsInterval = time.Millisecond * 100
+	defaultAgentActionsBurst    = 10
+	defaultAgentActionsMax      = 10
+	defaultAgentActionsMaxBody  = 1024 * 1024
 )
 
 type valueRange struct {
@@ -93,6 +110,7 @@ type envLimits struct {
 	RecommendedRAM int                  `config:"recommended_min_ram"`
 	Server         *serverLimitDefaults `config:"server_limits"`
 	Cache          *cacheLimits         `config:"cache_limits"`
+	Output         *outputLimits        `config:"output_limits"`
 }
 
 func defaultEnvLimits() *envLimits {
@@ -103,21 +121,100 @@ func defaultEnvLimits() *envLimits {
 		},
 		Server: defaultserverLimitDefaults(),
 		Cache:  defaultCacheLimits(),
+		Output: defaultOutputLimits(),
+	}
+}
+
+// outputLimits is the connection pool of the transport to Elasticsearch.
+type outputLimits struct {
+	MaxIdleConns        int           `config:"max_idle_conns"`
+	MaxIdleConnsPerHost int           `config:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int           `config:"max_conns_per_host"`
+	IdleConnTimeout     time.Duration `config:"idle_conn_timeout"`
+}
+
+func defaultOutputLimits() *outputLimits {
+	return &outputLimits{
+		MaxIdleConns:        defaultOutputMaxIdleConns,
+		MaxIdleConnsPerHost: defaultOutputMaxIdleConnsPerHost,
+		MaxConnsPerHost:     defaultOutputMaxConnsPerHost,
+		IdleConnTimeout:     defaultOutputIdleConnTimeout,
 	}
 }
 
 type cacheLimits struct {
 	NumCounters int64 `config:"num_counters"`
-	MaxCost     int64 `config:"max_cost"`
+	// MaxCostSpec is the max_cost as written in the spec.
+	// It may be a number of bytes, a human readable size (100MiB), or a percentage of the system memory (5%).
+	MaxCostSpec string `config:"max_cost"`
+	// MaxCost is the MaxCostSpec resolved to bytes, it is set when the limits are loaded.
+	MaxCost int64 `config:",ignore"`
 }
 
 func defaultCacheLimits() *cacheLimits {
 	return &cacheLimits{
 		NumCounters: defaultCacheNumCounters,
+		MaxCostSpec: strconv.Itoa(defaultCacheMaxCost),
 		MaxCost:     defaultCacheMaxCost,
 	}
 }
 
+// cacheCost is a parsed cache max_cost spec.
+// Only one of size or percent is set.
+type cacheCost struct {
+	size    int64
+	percent float64
+}
+
+// newCacheCost parses and validates a max_cost spec without resolving percentages.
+func newCacheCost(s string) (cacheCost, error) {
+	s = strings.TrimSpace(s)
+	if pct, ok := strings.CutSuffix(s, "%"); ok {
+		p, err := strconv.ParseFloat(strings.TrimSpace(pct), 64)
+		if err != nil {
+			return cacheCost{}, fmt.Errorf("invalid percentage %q: %w", s, err)
+		}
+		if p <= 0 || p > 100 {
+			return cacheCost{}, fmt.Errorf("percentage %q must be greater than 0%% and at most 100%%", s)
+		}
+		return cacheCost{percent: p}, nil
+	}
+	size, err := units.RAMInBytes(s)
+	if err != nil {
+		return cacheCost{}, fmt.Errorf("invalid size %q: %w", s, err)
+	}
+	if size <= 0 {
+		return cacheCost{}, fmt.Errorf("size %q must be greater than 0", s)
+	}
+	return cacheCost{size: size}, nil
+}
+
+// bytes returns the cost in bytes, percentages are resolved against totalMem.
+func (c cacheCost) bytes(totalMem uint64) (int64, error) {
+	if c.percent == 0 {
+		return c.size, nil
+	}
+	if totalMem == 0 {
+		return 0, errors.New("unable to detect total system memory")
+	}
+	return int64(float64(totalMem) * c.percent / 100), nil
+}
+
+// memTotal returns the system total memory in bytes.
+// It wraps memory.TotalMemory() so that we can replace the var in unit tests.
+var memTotal func() uint64 = memory.TotalMemory
+
+// parseCacheCost parses a max_cost spec into bytes.
+// Accepted values are a number of bytes (52428800), a human readable size (100MiB), or a percentage
+// of the total system memory (5%).
+func parseCacheCost(s string) (int64, error) {
+	c, err := newCacheCost(s)
+	if err != nil {
+		return 0, err
+	}
+	return c.bytes(memTotal())
+}
+
 type limit struct {
 	// Interval is the rate limiter's max frequency of requests (1s means 1req/s, 1ms means 1req/ms)
 	// A rate of 0 disables the rate limiter
@@ -133,11 +230,26 @@ type limit struct {
 	// Used in the ack, checkin, and enroll endpoints.
 	// A zero value disabled the check.
 	MaxBody int64 `config:"max_body_byte_size"`
+	// MaxWait is how long a request over the rate limit may be queued before it is rejected.
+	// A zero value rejects the request immediately.
+	MaxWait time.Duration `config:"max_wait"`
+	// PerKey is an optional rate limit applied to each API key individually.
+	PerKey keyLimit `config:"per_key"`
+}
+
+type keyLimit struct {
+	// Interval is the per key rate limiter's max frequency of requests.
+	// A rate of 0 disables the per key limiter.
+	Interval time.Duration `config:"interval"`
+	// Burst is the per key rate limiter's burst allocation.
+	Burst int `config:"burst"`
 }
 
 type serverLimitDefaults struct {
 	PolicyThrottle time.Duration `config:"policy_throttle"` // deprecated: replaced by policy_limit
 	MaxConnections int           `config:"max_connections"`
+	// EnrollMaxConcurrency is the default of enroll.max_concurrency.
+	EnrollMaxConcurrency int `config:"enroll_max_concurrency"`
 
 	ActionLimit      limit `config:"action_limit"`
 	PolicyLimit      limit `config:"policy_limit"`
@@ -151,11 +263,13 @@ type serverLimitDefaults struct {
 	UploadChunkLimit limit `config:"upload_chunk_limit"`
 	DeliverFileLimit limit `config:"file_delivery_limit"`
 	GetPGPKeyLimit   limit `config:"pgp_retrieval_limit"`
+	AgentActions     limit `config:"agent_actions_limit"`
 }
 
 func defaultserverLimitDefaults() *serverLimitDefaults {
 	return &serverLimitDefaults{
-		MaxConnections: defaultMaxConnections,
+		MaxConnections:       defaultMaxConnections,
+		EnrollMaxConcurrency: defaultEnrollMaxConcurrency,
 		ActionLimit: limit{
 			Interval: defaultActionInterval,
 			Burst:    defaultActionBurst,
@@ -224,6 +338,12 @@ func defaultserverLimitDefaults() *serverLimitDefaults {
 			Max:      defaultPGPRetrievalMax,
 			MaxBody:  defaultPGPRetrievalMaxBody,
 		},
+		AgentActions: limit{
+			Interval: defaultAgentActionsInterval,
+			Burst:    defaultAgentActionsBurst,
+			Max:      defaultAgentActionsMax,
+			MaxBody:  defaultAgentActionsMaxBody,
+		},
 	}
 }
 
@@ -233,14 +353,30 @@ var defaults []*envLimits
 var defaultsFS embed.FS
 
 func init() {
-	err := fs.WalkDir(defaultsFS, ".", func(path string, d fs.DirEntry, err error) error {
+	var err error
+	defaults, err = loadSpecs(defaultsFS)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// envSpec is a limits spec along with the file it was read from.
+type envSpec struct {
+	path   string
+	limits *envLimits
+}
+
+// loadSpecs reads and validates all limits specs in fsys.
+func loadSpecs(fsys fs.FS) ([]*envLimits, error) {
+	var specs []envSpec
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
 		if d.IsDir() {
 			return nil
 		}
-		f, err := defaultsFS.Open(path)
+		f, err := fsys.Open(path)
 		if err != nil {
 			return fmt.Errorf("unable to open embedded file %s: %w", path, err)
 		}
@@ -256,11 +392,122 @@ func init() {
 		if err := cfg.Unpack(&l, DefaultOptions...); err != nil {
 			return fmt.Errorf("cannot unpack spec from %s: %w", path, err)
 		}
-		defaults = append(defaults, l)
+		if _, err := newCacheCost(l.Cache.MaxCostSpec); err != nil {
+			return fmt.Errorf("invalid cache_limits.max_cost in spec %s: %w", path, err)
+		}
+		specs = append(specs, envSpec{path: path, limits: l})
 		return nil
 	})
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if err := validateSpecs(specs); err != nil {
+		return nil, err
+	}
+	limits := make([]*envLimits, 0, len(specs))
+	for _, spec := range specs {
+		limits = append(limits, spec.limits)
+	}
+	return limits, nil
+}
+
+// validateSpecs checks that the specs cover every agent count from 0 with ranges that do not overlap,
+// that no limit is negative, and that recommended_min_ram does not decrease as the number of agents grows.
+// The specs are sorted by num_agents.min.
+func validateSpecs(specs []envSpec) error {
+	var errs []error
+	for _, spec := range specs {
+		if spec.limits.Agents.Min > spec.limits.Agents.Max {
+			errs = append(errs, fmt.Errorf("spec %s: num_agents.min %d is greater than num_agents.max %d", spec.path, spec.limits.Agents.Min, spec.limits.Agents.Max))
+		}
+		errs = append(errs, spec.limits.validateValues(spec.path)...)
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	slices.SortFunc(specs, func(a, b envSpec) int {
+		return cmp.Compare(a.limits.Agents.Min, b.limits.Agents.Min)
+	})
+	if len(specs) > 0 && specs[0].limits.Agents.Min != 0 {
+		errs = append(errs, fmt.Errorf("spec %s: agents 0-%d are not covered by any spec", specs[0].path, specs[0].limits.Agents.Min-1))
+	}
+	for i := 1; i < len(specs); i++ {
+		prev, cur := specs[i-1], specs[i]
+		switch {
+		case cur.limits.Agents.Min <= prev.limits.Agents.Max:
+			errs = append(errs, fmt.Errorf("spec %s: num_agents %d-%d overlaps num_agents %d-%d of spec %s",
+				cur.path, cur.limits.Agents.Min, cur.limits.Agents.Max, prev.limits.Agents.Min, prev.limits.Agents.Max, prev.path))
+		case cur.limits.Agents.Min > prev.limits.Agents.Max+1:
+			errs = append(errs, fmt.Errorf("spec %s: agents %d-%d are not covered between spec %s and spec %s",
+				cur.path, prev.limits.Agents.Max+1, cur.limits.Agents.Min-1, prev.path, cur.path))
+		}
+		if cur.limits.RecommendedRAM < prev.limits.RecommendedRAM {
+			errs = append(errs, fmt.Errorf("spec %s: recommended_min_ram %d is lower than recommended_min_ram %d of spec %s",
+				cur.path, cur.limits.RecommendedRAM, prev.limits.RecommendedRAM, prev.path))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateValues returns an error for each negative value in the spec.
+func (l *envLimits) validateValues(path string) []error {
+	var errs []error
+	check := func(name string, v int64) {
+		if v < 0 {
+			errs = append(errs, fmt.Errorf("spec %s: %s must not be negative, found %d", path, name, v))
+		}
+	}
+	check("recommended_min_ram", int64(l.RecommendedRAM))
+	if l.Cache != nil {
+		check("cache_limits.num_counters", l.Cache.NumCounters)
+	}
+	if l.Output != nil {
+		check("output_limits.max_idle_conns", int64(l.Output.MaxIdleConns))
+		check("output_limits.max_idle_conns_per_host", int64(l.Output.MaxIdleConnsPerHost))
+		check("output_limits.max_conns_per_host", int64(l.Output.MaxConnsPerHost))
+		check("output_limits.idle_conn_timeout", int64(l.Output.IdleConnTimeout))
+	}
+	if l.Server == nil {
+		return errs
+	}
+	check("server_limits.policy_throttle", int64(l.Server.PolicyThrottle))
+	check("server_limits.max_connections", int64(l.Server.MaxConnections))
+	check("server_limits.enroll_max_concurrency", int64(l.Server.EnrollMaxConcurrency))
+	for _, nl := range l.Server.limits() {
+		prefix := "server_limits." + nl.name + "."
+		check(prefix+"interval", int64(nl.limit.Interval))
+		check(prefix+"burst", int64(nl.limit.Burst))
+		check(prefix+"max", nl.limit.Max)
+		check(prefix+"max_body_byte_size", nl.limit.MaxBody)
+		check(prefix+"max_wait", int64(nl.limit.MaxWait))
+		check(prefix+"per_key.interval", int64(nl.limit.PerKey.Interval))
+		check(prefix+"per_key.burst", int64(nl.limit.PerKey.Burst))
+	}
+	return errs
+}
+
+type namedLimit struct {
+	name  string
+	limit limit
+}
+
+// limits returns the endpoint limits along with their setting names.
+func (s *serverLimitDefaults) limits() []namedLimit {
+	return []namedLimit{
+		{"action_limit", s.ActionLimit},
+		{"policy_limit", s.PolicyLimit},
+		{"checkin_limit", s.CheckinLimit},
+		{"artifact_limit", s.ArtifactLimit},
+		{"enroll_limit", s.EnrollLimit},
+		{"ack_limit", s.AckLimit},
+		{"status_limit", s.StatusLimit},
+		{"upload_start_limit", s.UploadStartLimit},
+		{"upload_end_limit", s.UploadEndLimit},
+		{"upload_chunk_limit", s.UploadChunkLimit},
+		{"file_delivery_limit", s.DeliverFileLimit},
+		{"pgp_retrieval_limit", s.GetPGPKeyLimit},
+		{"agent_actions_limit", s.AgentActions},
 	}
 }
 
@@ -273,22 +520,45 @@ func loadLimits(agentLimit int) *envLimits {
 	if agentLimit < 0 {
 		return defaultEnvLimits()
 	} else if agentLimit == 0 {
-		return memEnvLimits()
+		return loadLimitsForRAM(memMB())
 	}
+	return loadLimitsForAgents(agentLimit)
+}
+
+// loadLimitsForAgents returns the settings from the default/*.yml file that matches the number of agents.
+// If no file matches, default settings are used.
+func loadLimitsForAgents(agents int) *envLimits {
 	log := zerolog.Ctx(context.TODO())
+	l := findLimitsForAgents(agents)
+	if l == nil {
+		log.Info().Msgf("No applicable limit for %d agents, using default.", agents)
+		return defaultEnvLimits()
+	}
+	log.Info().Msgf("Using system limits for %d to %d agents for a configured value of %d agents", l.Agents.Min, l.Agents.Max, agents)
+	ramSize := int(memory.TotalMemory() / 1024 / 1024)
+	if ramSize < l.RecommendedRAM {
+		log.Warn().Msgf("Detected %d MB of system RAM, which is lower than the recommended amount (%d MB) for the configured agent limit", ramSize, l.RecommendedRAM)
+	}
+	return l.resolve()
+}
+
+func findLimitsForAgents(agents int) *envLimits {
 	for _, l := range defaults {
 		// get nearest limits for configured agent numbers
-		if l.Agents.Min <= agentLimit && agentLimit <= l.Agents.Max {
-			log.Info().Msgf("Using system limits for %d to %d agents for a configured value of %d agents", l.Agents.Min, l.Agents.Max, agentLimit)
-			ramSize := int(memory.TotalMemory() / 1024 / 1024)
-			if ramSize < l.RecommendedRAM {
-				log.Warn().Msgf("Detected %d MB of system RAM, which is lower than the recommended amount (%d MB) for the configured agent limit", ramSize, l.RecommendedRAM)
-			}
+		if l.Agents.Min <= agents && agents <= l.Agents.Max {
 			return l
 		}
 	}
-	log.Info().Msgf("No applicable limit for %d agents, using default.", agentLimit)
-	return defaultEnvLimits()
+	return nil
+}
+
+// LimitsTier returns the agent range of the limits tier used for the passed number of agents.
+func LimitsTier(agents int) AgentRange {
+	l := findLimitsForAgents(agents)
+	if l == nil {
+		l = defaultEnvLimits()
+	}
+	return AgentRange{Min: l.Agents.Min, Max: l.Agents.Max}
 }
 
 // memMB returns the system total memory in MB
@@ -297,23 +567,43 @@ var memMB func() int = func() int {
 	return int(memory.TotalMemory() / 1024 / 1024)
 }
 
-func memEnvLimits() *envLimits {
-	mem := memMB()
-	k := 0
-	recRAM := 0
+// loadLimitsForRAM returns the settings from default/*.yml with the largest recommended_min_ram that does not exceed ramMB.
+// If ramMB is below the recommended_min_ram of every tier the default settings are used.
+func loadLimitsForRAM(ramMB int) *envLimits {
+	var selected *envLimits
 	log := zerolog.Ctx(context.TODO())
-	for i, l := range defaults {
-		if mem >= l.RecommendedRAM && l.RecommendedRAM > recRAM {
-			k = i
-			recRAM = l.RecommendedRAM
+	for _, l := range defaults {
+		if ramMB >= l.RecommendedRAM && (selected == nil || l.RecommendedRAM > selected.RecommendedRAM) {
+			selected = l
 		}
 	}
-	if recRAM == 0 {
-		log.Warn().Int("memory_mb", mem).Msg("No settings with recommended ram found, using default.")
+	if selected == nil || selected.RecommendedRAM == 0 {
+		log.Warn().Int("memory_mb", ramMB).Msg("No settings with recommended ram found, using default.")
 		return defaultEnvLimits()
 	}
-	log.Info().Int("memory_mb", mem).Int("recommended_mb", recRAM).Msg("Found settings with recommended ram.")
-	return defaults[k]
+	log.Info().
+		Int("memory_mb", ramMB).
+		Int("recommended_mb", selected.RecommendedRAM).
+		Int("agents_min", selected.Agents.Min).
+		Int("agents_max", selected.Agents.Max).
+		Msgf("Using system limits for %d to %d agents based on detected system memory, set max_agents to override.", selected.Agents.Min, selected.Agents.Max)
+	return selected.resolve()
+}
+
+// resolve returns a copy of the limits with the cache max_cost resolved to bytes.
+// If the max_cost cannot be resolved the default cache size is used.
+func (l *envLimits) resolve() *envLimits {
+	r := *l
+	cache := *l.Cache
+	r.Cache = &cache
+
+	maxCost, err := parseCacheCost(cache.MaxCostSpec)
+	if err != nil {
+		zerolog.Ctx(context.TODO()).Warn().Err(err).Str("max_cost", cache.MaxCostSpec).Msg("Unable to resolve cache max_cost, using default.")
+		maxCost = defaultCacheMaxCost
+	}
+	r.Cache.MaxCost = maxCost
+	return &r
 }
 
 func getMaxInt() int64 {
@@ -2,17 +2,18 @@
 // or more contributor license agreements. Licensed under the Elastic License;
 // you may not use this file except in compliance with the Elastic License.
 
-// Code generated by dev-tools/cmd/buildlimits/buildlimits.go - DO NOT EDIT.
-
 package config
 
 import (
+	"fmt"
 	"testing"
+	"testing/fstest"
 
 	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
 
-	"github.com/stretchr/testify/require"
+	"github.com/pbnjay/memory"
 	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLoadLimits(t *testing.T) {
@@ -39,3 +40,242 @@ func TestLoadLimits(t *testing.T) {
 		})
 	}
 }
+
+func TestLoadLimitsForAgentsOutput(t *testing.T) {
+	log := testlog.SetLogger(t)
+	zerolog.DefaultContextLogger = &log
+
+	var prev *outputLimits
+	for _, agents := range []int{100, 3000, 6000, 12000, 30000, 50000} {
+		l := loadLimitsForAgents(agents).Output
+		require.NotNil(t, l)
+		if prev != nil {
+			require.GreaterOrEqual(t, l.MaxIdleConns, prev.MaxIdleConns, "%d agents", agents)
+			require.GreaterOrEqual(t, l.MaxIdleConnsPerHost, prev.MaxIdleConnsPerHost, "%d agents", agents)
+			require.GreaterOrEqual(t, l.MaxConnsPerHost, prev.MaxConnsPerHost, "%d agents", agents)
+			require.NotEqual(t, *prev, *l, "%d agents", agents)
+		}
+		prev = l
+	}
+	require.Equal(t, *defaultOutputLimits(), *loadLimitsForAgents(100).Output)
+}
+
+func TestParseCacheCost(t *testing.T) {
+	memTotal = func() uint64 { return 8 * 1024 * 1024 * 1024 }
+	t.Cleanup(func() { memTotal = memory.TotalMemory })
+
+	testCases := []struct {
+		Name     string
+		Spec     string
+		Expected int64
+		Err      string
+	}{
+		{"bytes", "52428800", 52428800, ""},
+		{"human size", "100MiB", 100 * 1024 * 1024, ""},
+		{"human size short", "1g", 1024 * 1024 * 1024, ""},
+		{"percentage", "5%", 429496729, ""},
+		{"percentage with space", " 50 %", 4 * 1024 * 1024 * 1024, ""},
+		{"full memory", "100%", 8 * 1024 * 1024 * 1024, ""},
+		{"zero percent", "0%", 0, "must be greater than 0%"},
+		{"above 100 percent", "101%", 0, "at most 100%"},
+		{"negative percent", "-5%", 0, "must be greater than 0%"},
+		{"malformed percent", "five%", 0, "invalid percentage"},
+		{"zero bytes", "0", 0, "must be greater than 0"},
+		{"malformed suffix", "100MiBs", 0, "invalid size"},
+		{"unknown suffix", "100x", 0, "invalid size"},
+		{"empty", "", 0, "invalid size"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			v, err := parseCacheCost(tc.Spec)
+			if tc.Err != "" {
+				require.ErrorContains(t, err, tc.Err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.Expected, v)
+		})
+	}
+}
+
+func TestParseCacheCostUnknownMemory(t *testing.T) {
+	memTotal = func() uint64 { return 0 }
+	t.Cleanup(func() { memTotal = memory.TotalMemory })
+
+	_, err := parseCacheCost("5%")
+	require.Error(t, err)
+
+	v, err := parseCacheCost("1MiB")
+	require.NoError(t, err)
+	require.Equal(t, int64(1024*1024), v)
+}
+
+func TestLoadLimitsCacheMaxCost(t *testing.T) {
+	log := testlog.SetLogger(t)
+	zerolog.DefaultContextLogger = &log
+
+	t.Run("embedded specs resolve", func(t *testing.T) {
+		for _, l := range defaults {
+			_, err := newCacheCost(l.Cache.MaxCostSpec)
+			require.NoError(t, err)
+		}
+		l := loadLimits(512)
+		require.Equal(t, int64(52428800), l.Cache.MaxCost)
+	})
+
+	t.Run("percentage", func(t *testing.T) {
+		memTotal = func() uint64 { return 1024 * 1024 * 1024 }
+		t.Cleanup(func() { memTotal = memory.TotalMemory })
+
+		l := &envLimits{Cache: &cacheLimits{MaxCostSpec: "10%"}}
+		r := l.resolve()
+		require.Equal(t, int64(107374182), r.Cache.MaxCost)
+		require.Zero(t, l.Cache.MaxCost, "resolve must not modify the packed spec")
+	})
+
+	t.Run("unresolvable percentage uses default", func(t *testing.T) {
+		memTotal = func() uint64 { return 0 }
+		t.Cleanup(func() { memTotal = memory.TotalMemory })
+
+		l := &envLimits{Cache: &cacheLimits{MaxCostSpec: "10%"}}
+		require.Equal(t, int64(defaultCacheMaxCost), l.resolve().Cache.MaxCost)
+	})
+}
+
+func TestLoadLimitsForRAM(t *testing.T) {
+	testCases := []struct {
+		Name              string
+		RAM               int
+		ExpectedAgentsMin int
+		ExpectedAgentsMax int
+	}{
+		{"below smallest tier", 512, 0, int(getMaxInt())},
+		{"smallest tier", 1024, 0, 2500},
+		{"between tiers", 3000, 2501, 5000},
+		{"exact tier boundary", 8096, 10001, 20000},
+		{"just below tier boundary", 16191, 10001, 20000},
+		{"largest tier", 32384, 40001, int(getMaxInt())},
+		{"above largest tier", 256000, 40001, int(getMaxInt())},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			log := testlog.SetLogger(t)
+			zerolog.DefaultContextLogger = &log
+			l := loadLimitsForRAM(tc.RAM)
+
+			require.Equal(t, tc.ExpectedAgentsMin, l.Agents.Min)
+			require.Equal(t, tc.ExpectedAgentsMax, l.Agents.Max)
+		})
+	}
+}
+
+func TestLoadLimitsUsesRAMWhenAgentLimitUnset(t *testing.T) {
+	log := testlog.SetLogger(t)
+	zerolog.DefaultContextLogger = &log
+	memMB = func() int { return 4096 }
+	t.Cleanup(func() {
+		memMB = func() int { return int(memory.TotalMemory() / 1024 / 1024) }
+	})
+
+	l := loadLimits(0)
+	require.Equal(t, 10000, l.Agents.Max)
+
+	// An explicit agent limit overrides the memory based selection.
+	l = loadLimits(15000)
+	require.Equal(t, 20000, l.Agents.Max)
+
+	l = loadLimits(-1)
+	require.Equal(t, int(getMaxInt()), l.Agents.Max)
+}
+
+func TestLoadSpecs(t *testing.T) {
+	spec := func(minAgents, maxAgents, ram int) *fstest.MapFile {
+		return &fstest.MapFile{Data: []byte(fmt.Sprintf("num_agents:\n  min: %d\n  max: %d\nrecommended_min_ram: %d\n", minAgents, maxAgents, ram))}
+	}
+
+	t.Run("embedded specs are valid", func(t *testing.T) {
+		specs, err := loadSpecs(defaultsFS)
+		require.NoError(t, err)
+		require.Len(t, specs, len(defaults))
+	})
+
+	t.Run("valid specs", func(t *testing.T) {
+		specs, err := loadSpecs(fstest.MapFS{
+			"b.yml": spec(101, 200, 2048),
+			"a.yml": spec(0, 100, 1024),
+			"c.yml": {Data: []byte("num_agents:\n  min: 201\nrecommended_min_ram: 2048\n")},
+		})
+		require.NoError(t, err)
+		require.Len(t, specs, 3)
+	})
+
+	testCases := []struct {
+		name   string
+		fsys   fstest.MapFS
+		errMsg string
+	}{{
+		name: "inverted range",
+		fsys: fstest.MapFS{
+			"a.yml": spec(100, 0, 1024),
+		},
+		errMsg: "spec a.yml: num_agents.min 100 is greater than num_agents.max 0",
+	}, {
+		name: "overlap",
+		fsys: fstest.MapFS{
+			"a.yml": spec(0, 100, 1024),
+			"b.yml": spec(50, 200, 2048),
+		},
+		errMsg: "spec b.yml: num_agents 50-200 overlaps num_agents 0-100 of spec a.yml",
+	}, {
+		name: "gap",
+		fsys: fstest.MapFS{
+			"a.yml": spec(0, 100, 1024),
+			"b.yml": spec(150, 200, 2048),
+		},
+		errMsg: "spec b.yml: agents 101-149 are not covered between spec a.yml and spec b.yml",
+	}, {
+		name: "does not start at 0",
+		fsys: fstest.MapFS{
+			"a.yml": spec(10, 100, 1024),
+		},
+		errMsg: "spec a.yml: agents 0-9 are not covered by any spec",
+	}, {
+		name: "decreasing ram",
+		fsys: fstest.MapFS{
+			"a.yml": spec(0, 100, 2048),
+			"b.yml": spec(101, 200, 1024),
+		},
+		errMsg: "spec b.yml: recommended_min_ram 1024 is lower than recommended_min_ram 2048 of spec a.yml",
+	}, {
+		name: "negative ram",
+		fsys: fstest.MapFS{
+			"a.yml": spec(0, 100, -1),
+		},
+		errMsg: "spec a.yml: recommended_min_ram must not be negative, found -1",
+	}, {
+		name: "negative limit",
+		fsys: fstest.MapFS{
+			"a.yml": {Data: []byte("num_agents:\n  min: 0\n  max: 100\nserver_limits:\n  checkin_limit:\n    burst: -5\n")},
+		},
+		errMsg: "spec a.yml: server_limits.checkin_limit.burst must not be negative, found -5",
+	}, {
+		name: "negative cache counters",
+		fsys: fstest.MapFS{
+			"a.yml": {Data: []byte("num_agents:\n  min: 0\n  max: 100\ncache_limits:\n  num_counters: -1\n")},
+		},
+		errMsg: "spec a.yml: cache_limits.num_counters must not be negative, found -1",
+	}, {
+		name: "negative output connections",
+		fsys: fstest.MapFS{
+			"a.yml": {Data: []byte("num_agents:\n  min: 0\n  max: 100\noutput_limits:\n  max_idle_conns_per_host: -1\n")},
+		},
+		errMsg: "spec a.yml: output_limits.max_idle_conns_per_host must not be negative, found -1",
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := loadSpecs(tc.fsys)
+			require.ErrorContains(t, err, tc.errMsg)
+		})
+	}
+}
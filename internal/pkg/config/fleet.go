@@ -7,6 +7,7 @@ package config
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog"
 )
@@ -36,11 +37,78 @@ func (c *AgentLogging) LogLevel() zerolog.Level {
 	return l
 }
 
+// RolloutRate is the rate at which policy changes are delivered to agents.
+// A zero rate disables it and the policy limit is used instead.
+type RolloutRate struct {
+	Rate  float64 `config:"rate"`
+	Burst int     `config:"burst"`
+}
+
+// Validate ensures that the configuration is valid.
+func (c *RolloutRate) Validate() error {
+	if c.Rate < 0 {
+		return fmt.Errorf("rollout_rate.rate must not be negative, got %v", c.Rate)
+	}
+	if c.Burst < 0 {
+		return fmt.Errorf("rollout_rate.burst must not be negative, got %d", c.Burst)
+	}
+	return nil
+}
+
+// AgentLimits controls how the limits tier is selected when max_agents is not set.
+type AgentLimits struct {
+	// Auto selects the limits tier from the number of active agents instead of the system memory.
+	Auto bool `config:"auto"`
+	// Interval is how often the active agents are counted, a zero interval uses the default.
+	Interval time.Duration `config:"interval"`
+}
+
+// Validate ensures that the configuration is valid.
+func (c *AgentLimits) Validate() error {
+	if c.Interval < 0 {
+		return fmt.Errorf("limits.interval must not be negative, got %s", c.Interval)
+	}
+	return nil
+}
+
 // Agent is the ID and logging configuration of the Agent running this Fleet Server.
 type Agent struct {
-	ID      string       `config:"id"`
-	Version string       `config:"version"`
-	Logging AgentLogging `config:"logging"`
+	ID          string       `config:"id"`
+	Version     string       `config:"version"`
+	Logging     AgentLogging `config:"logging"`
+	RolloutRate RolloutRate  `config:"rollout_rate"`
+	Limits      AgentLimits  `config:"limits"`
+
+	// InactivityTimeout marks the agents that did not check in for longer as inactive, 0 disables it.
+	InactivityTimeout time.Duration `config:"inactivity_timeout"`
+	// CleanupAfter unenrolls the agents that did not check in for longer and invalidates their API keys, 0 disables it.
+	CleanupAfter time.Duration `config:"cleanup_after"`
+	// CleanupDelete deletes the documents of the cleaned up agents instead of keeping them as inactive.
+	CleanupDelete bool `config:"cleanup_delete"`
+	// CleanupDryRun logs the agents that would be marked inactive or cleaned up without changing them.
+	CleanupDryRun bool `config:"cleanup_dry_run"`
+	// CleanupConcurrency is the number of agents marked inactive or cleaned up at once, a default is used when 0.
+	CleanupConcurrency int `config:"cleanup_concurrency"`
+	// CleanupUnenrollTimeout unenrolls the agents that did not check in for longer than the unenroll_timeout of their
+	// policy and invalidates their API keys.
+	CleanupUnenrollTimeout bool `config:"cleanup_unenroll_timeout"`
+}
+
+// Validate ensures that the configuration is valid.
+func (c *Agent) Validate() error {
+	if c.InactivityTimeout < 0 {
+		return fmt.Errorf("inactivity_timeout must not be negative, got %s", c.InactivityTimeout)
+	}
+	if c.CleanupAfter < 0 {
+		return fmt.Errorf("cleanup_after must not be negative, got %s", c.CleanupAfter)
+	}
+	if c.CleanupConcurrency < 0 {
+		return fmt.Errorf("cleanup_concurrency must not be negative, got %d", c.CleanupConcurrency)
+	}
+	if c.InactivityTimeout > 0 && c.CleanupAfter > 0 && c.CleanupAfter < c.InactivityTimeout {
+		return fmt.Errorf("cleanup_after (%s) must not be shorter than inactivity_timeout (%s)", c.CleanupAfter, c.InactivityTimeout)
+	}
+	return nil
 }
 
 // Host is the ID of the host of the Agent running this Fleet Server.
@@ -49,23 +117,42 @@ type Host struct {
 	Name string `config:"name"`
 }
 
+// Bootstrap is the setup of a cluster without Kibana by a standalone Fleet Server.
+type Bootstrap struct {
+	// Enabled creates a policy with the fleet-server integration and an enrollment key on the first start against a
+	// cluster that has neither, the enrollment token is printed once.
+	Enabled bool `config:"enabled"`
+}
+
 // Fleet is the configuration of Agent running inside of Fleet.
 type Fleet struct {
-	Agent Agent `config:"agent"`
-	Host  Host  `config:"host"`
+	Agent     Agent     `config:"agent"`
+	Host      Host      `config:"host"`
+	Bootstrap Bootstrap `config:"bootstrap"`
 }
 
 // CopyNoLogging returns a copy of Fleet without any logging specifiers.
 func (c *Fleet) CopyNoLogging() *Fleet {
 	return &Fleet{
 		Agent: Agent{
-			ID:      c.Agent.ID,
-			Version: c.Agent.Version,
+			ID:          c.Agent.ID,
+			Version:     c.Agent.Version,
+			RolloutRate: c.Agent.RolloutRate,
+			Limits:      c.Agent.Limits,
+
+			InactivityTimeout: c.Agent.InactivityTimeout,
+			CleanupAfter:      c.Agent.CleanupAfter,
+			CleanupDelete:     c.Agent.CleanupDelete,
+			CleanupDryRun:     c.Agent.CleanupDryRun,
+
+			CleanupConcurrency:     c.Agent.CleanupConcurrency,
+			CleanupUnenrollTimeout: c.Agent.CleanupUnenrollTimeout,
 		},
 		Host: Host{
 			ID:   c.Host.ID,
 			Name: c.Host.Name,
 		},
+		Bootstrap: c.Bootstrap,
 	}
 }
 
@@ -6,9 +6,11 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestFleetAgentDefaultLevel(t *testing.T) {
@@ -20,13 +22,19 @@ func TestFleetAgentDefaultLevel(t *testing.T) {
 func TestFleetCopyNoLogging(t *testing.T) {
 	c1 := &Fleet{
 		Agent: Agent{
-			ID:      "test-id",
-			Version: "test-ver",
+			ID:          "test-id",
+			Version:     "test-ver",
+			RolloutRate: RolloutRate{Rate: 100, Burst: 10},
+
+			InactivityTimeout: time.Hour,
+			CleanupAfter:      24 * time.Hour,
+			CleanupDryRun:     true,
 		},
 		Host: Host{
 			ID:   "test-id",
 			Name: "test-host",
 		},
+		Bootstrap: Bootstrap{Enabled: true},
 	}
 
 	c2 := &Fleet{
@@ -36,12 +44,29 @@ func TestFleetCopyNoLogging(t *testing.T) {
 			Logging: AgentLogging{
 				Level: "info",
 			},
+			RolloutRate: RolloutRate{Rate: 100, Burst: 10},
+
+			InactivityTimeout: time.Hour,
+			CleanupAfter:      24 * time.Hour,
+			CleanupDryRun:     true,
 		},
 		Host: Host{
 			ID:   "test-id",
 			Name: "test-host",
 		},
+		Bootstrap: Bootstrap{Enabled: true},
 	}
 
 	assert.Equal(t, c1, c2.CopyNoLogging())
 }
+
+func TestAgentValidateCleanup(t *testing.T) {
+	require.NoError(t, (&Agent{}).Validate(), "cleanup is disabled by default")
+	require.NoError(t, (&Agent{InactivityTimeout: time.Hour, CleanupAfter: 24 * time.Hour}).Validate())
+	require.NoError(t, (&Agent{CleanupAfter: time.Minute}).Validate())
+
+	require.EqualError(t, (&Agent{InactivityTimeout: -time.Hour}).Validate(), "inactivity_timeout must not be negative, got -1h0m0s")
+	require.EqualError(t, (&Agent{CleanupAfter: -time.Hour}).Validate(), "cleanup_after must not be negative, got -1h0m0s")
+	require.EqualError(t, (&Agent{CleanupConcurrency: -1}).Validate(), "cleanup_concurrency must not be negative, got -1")
+	require.EqualError(t, (&Agent{InactivityTimeout: time.Hour, CleanupAfter: time.Minute}).Validate(), "cleanup_after (1m0s) must not be shorter than inactivity_timeout (1h0m0s)")
+}
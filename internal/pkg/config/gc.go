@@ -9,16 +9,24 @@ import "time"
 const (
 	defaultScheduleInterval            = time.Hour
 	defaultCleanupIntervalAfterExpired = "30d" // cleanup expired actions with expiration time older than 30 days from now
+	defaultSweepAfterExpired           = time.Hour
+	defaultOutputKeyGrace              = 30 * time.Minute
 )
 
 // GC is the configuration for the Fleet Server data garbage collection.
-// Currently manages the expired actions cleanup
+// Currently manages the expired actions cleanup, the expired actions sweep, and the retired output API keys
 type GC struct {
 	ScheduleInterval            time.Duration `config:"schedule_interval"`
 	CleanupAfterExpiredInterval string        `config:"cleanup_after_expired_interval"`
+	SweepAfterExpired           time.Duration `config:"sweep_after_expired"`
+	// OutputKeyGrace is how long a replaced output API key stays valid if the agent does not ack the policy
+	// revision with the new key.
+	OutputKeyGrace time.Duration `config:"output_key_grace"`
 }
 
 func (g *GC) InitDefaults() {
 	g.ScheduleInterval = defaultScheduleInterval
 	g.CleanupAfterExpiredInterval = defaultCleanupIntervalAfterExpired
+	g.SweepAfterExpired = defaultSweepAfterExpired
+	g.OutputKeyGrace = defaultOutputKeyGrace
 }
@@ -0,0 +1,48 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	defaultHealthCheckWindow         = time.Minute
+	defaultHealthCheckErrorThreshold = 0.5
+	defaultHealthCheckMinRequests    = 10
+)
+
+// HealthCheck is the configuration of the self health check against Elasticsearch.
+// The server reports a degraded state while the rate of the failed Elasticsearch requests over the last
+// Window exceeds ErrorThreshold, and a healthy state again once it drops back.
+type HealthCheck struct {
+	Window time.Duration `config:"window"`
+	// ErrorThreshold is the rate of failed requests, between 0 and 1, above which the server is degraded.
+	// A threshold of 1 never degrades the server.
+	ErrorThreshold float64 `config:"error_threshold"`
+	// MinRequests is the number of requests the window needs before the error rate is evaluated.
+	MinRequests int `config:"min_requests"`
+}
+
+func (h *HealthCheck) InitDefaults() {
+	h.Window = defaultHealthCheckWindow
+	h.ErrorThreshold = defaultHealthCheckErrorThreshold
+	h.MinRequests = defaultHealthCheckMinRequests
+}
+
+// Validate ensures that the configuration is valid.
+func (h *HealthCheck) Validate() error {
+	if h.Window <= 0 {
+		return fmt.Errorf("window must be positive, got %s", h.Window)
+	}
+	if h.ErrorThreshold <= 0 || h.ErrorThreshold > 1 {
+		return fmt.Errorf("error_threshold must be greater than 0 and at most 1, got %v", h.ErrorThreshold)
+	}
+	if h.MinRequests < 0 {
+		return fmt.Errorf("min_requests must not be negative, got %d", h.MinRequests)
+	}
+	return nil
+}
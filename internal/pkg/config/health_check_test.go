@@ -0,0 +1,62 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elastic/go-ucfg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthCheck(t *testing.T) {
+	testcases := map[string]struct {
+		cfg    map[string]interface{}
+		result HealthCheck
+		err    string
+	}{
+		"defaults": {
+			cfg:    map[string]interface{}{},
+			result: HealthCheck{Window: time.Minute, ErrorThreshold: 0.5, MinRequests: 10},
+		},
+		"custom": {
+			cfg:    map[string]interface{}{"window": "5m", "error_threshold": 0.2, "min_requests": 100},
+			result: HealthCheck{Window: 5 * time.Minute, ErrorThreshold: 0.2, MinRequests: 100},
+		},
+		"zero window": {
+			cfg: map[string]interface{}{"window": "0s"},
+			err: "window must be positive",
+		},
+		"threshold above 1": {
+			cfg: map[string]interface{}{"error_threshold": 1.5},
+			err: "error_threshold must be greater than 0 and at most 1",
+		},
+		"negative min requests": {
+			cfg: map[string]interface{}{"min_requests": -1},
+			err: "min_requests must not be negative",
+		},
+	}
+
+	for name, test := range testcases {
+		t.Run(name, func(t *testing.T) {
+			c, err := ucfg.NewFrom(map[string]interface{}{"health_check": test.cfg}, DefaultOptions...)
+			require.NoError(t, err)
+
+			var cfg Server
+			cfg.InitDefaults()
+			err = c.Unpack(&cfg, DefaultOptions...)
+			if test.err != "" {
+				assert.ErrorContains(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.result, cfg.HealthCheck)
+		})
+	}
+}
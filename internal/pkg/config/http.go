@@ -4,20 +4,30 @@
 
 package config
 
+import "github.com/elastic/elastic-agent-libs/transport/tlscommon"
+
 const kDefaultHTTPHost = "localhost"
 const kDefaultHTTPPort = 5066
 
 // HTTP is the configuration for the API endpoint.
 type HTTP struct {
-	Enabled            bool   `config:"enabled"`
-	Host               string `config:"host"`
-	Port               int    `config:"port"`
-	User               string `config:"named_pipe.user"`
-	SecurityDescriptor string `config:"named_pipe.security_descriptor"`
+	Enabled            bool                    `config:"enabled"`
+	Host               string                  `config:"host"`
+	Port               int                     `config:"port"`
+	User               string                  `config:"named_pipe.user"`
+	SecurityDescriptor string                  `config:"named_pipe.security_descriptor"`
+	Prometheus         Prometheus              `config:"prometheus"`
+	TLS                *tlscommon.ServerConfig `config:"ssl"`
+}
+
+// Prometheus is the configuration for the prometheus metrics endpoint of the API.
+type Prometheus struct {
+	Enabled bool `config:"enabled"`
 }
 
 func (h *HTTP) InitDefaults() {
 	h.Enabled = false
 	h.Host = kDefaultHTTPHost
 	h.Port = kDefaultHTTPPort
+	h.Prometheus.Enabled = true
 }
@@ -6,7 +6,10 @@ package config
 
 import (
 	"compress/flate"
+	"errors"
 	"fmt"
+	"net/netip"
+	"slices"
 	"strings"
 	"time"
 
@@ -49,6 +52,7 @@ type ServerBulk struct {
 	FlushThresholdCount int           `config:"flush_threshold_cnt"`
 	FlushThresholdSize  int           `config:"flush_threshold_size"`
 	FlushMaxPending     int           `config:"flush_max_pending"`
+	Checkin             CheckinBulk   `config:"checkin"`
 }
 
 func (c *ServerBulk) InitDefaults() {
@@ -56,14 +60,46 @@ func (c *ServerBulk) InitDefaults() {
 	c.FlushThresholdCount = 2048
 	c.FlushThresholdSize = 1024 * 1024
 	c.FlushMaxPending = 8
+	c.Checkin.InitDefaults()
+}
+
+// CheckinBulk is the configuration for batching agent checkin updates.
+type CheckinBulk struct {
+	// FlushMaxPendingBytes flushes pending checkins early when their approximate size crosses it, 0 disables it.
+	FlushMaxPendingBytes int `config:"flush_max_pending_bytes"`
+	// StatusWriteInterval only rewrites the agent document of a checkin that changed nothing but the checkin time
+	// if it was last written longer ago, 0 writes every checkin.
+	StatusWriteInterval time.Duration `config:"status_write_interval"`
+	// SpoolPath is the file the checkin updates are queued in while elasticsearch is unreachable, they are written
+	// once it is reachable again. An empty path drops the updates that could not be written.
+	SpoolPath string `config:"spool_path"`
+	// SpoolMaxSize is the size in bytes of the spool file, the oldest updates are dropped once it is full.
+	SpoolMaxSize int64 `config:"spool_max_size"`
+}
+
+func (c *CheckinBulk) InitDefaults() {
+	c.FlushMaxPendingBytes = 10 * 1024 * 1024
+	c.SpoolMaxSize = 64 * 1024 * 1024
+}
+
+func (c *CheckinBulk) Validate() error {
+	if c.StatusWriteInterval < 0 {
+		return fmt.Errorf("status_write_interval must not be negative, got %s", c.StatusWriteInterval)
+	}
+	if c.SpoolPath != "" && c.SpoolMaxSize <= 0 {
+		return fmt.Errorf("spool_max_size must be positive, got %d", c.SpoolMaxSize)
+	}
+	return nil
 }
 
 // Server is the configuration for the server
 type (
 	Server struct {
-		Host               string                  `config:"host"`
+		Host               BindHosts               `config:"host"`
 		Port               uint16                  `config:"port"`
 		InternalPort       uint16                  `config:"internal_port"`
+		InternalHost       string                  `config:"internal_host"`
+		InternalTLS        *tlscommon.ServerConfig `config:"internal_ssl"`
 		TLS                *tlscommon.ServerConfig `config:"ssl"`
 		Timeouts           ServerTimeouts          `config:"timeouts"`
 		Profiler           ServerProfiler          `config:"profiler"`
@@ -76,6 +112,41 @@ type (
 		Instrumentation    Instrumentation         `config:"instrumentation"`
 		StaticPolicyTokens StaticPolicyTokens      `config:"static_policy_tokens"`
 		PGP                PGP                     `config:"pgp"`
+		Auth               ServerAuth              `config:"auth"`
+		// StrictSchema rejects request bodies with unknown fields or mismatched types instead of ignoring them.
+		StrictSchema bool `config:"strict_schema"`
+		// HealthCheck degrades the reported state while the Elasticsearch requests are failing.
+		HealthCheck HealthCheck `config:"health_check"`
+		// Enroll configures the auth providers agents can enroll with besides the enrollment tokens.
+		Enroll Enroll `config:"enroll"`
+		// TrustedProxies are the peers whose X-Forwarded-For and Forwarded headers are honored for the client address.
+		TrustedProxies TrustedProxies `config:"trusted_proxies"`
+		// OutputPermissions configures the index privileges of the output API keys of the agents.
+		OutputPermissions OutputPermissions `config:"output_permissions"`
+		// ArtifactUpstream is the artifact service the artifacts missing from Elasticsearch are fetched from.
+		ArtifactUpstream ArtifactUpstream `config:"artifact_upstream"`
+		// Checkin configures the checkin responses.
+		Checkin Checkin `config:"checkin"`
+		// ActionResults configures the action results written for the acks.
+		ActionResults ActionResults `config:"action_results"`
+		// AgentActions configures the actions added by the agent actions endpoint.
+		AgentActions AgentActions `config:"agent_actions"`
+		// Admin configures the admin endpoint served on a unix socket.
+		Admin Admin `config:"admin"`
+		// SelfMetrics configures the documents with the internal metrics written to Elasticsearch.
+		SelfMetrics SelfMetrics `config:"self_metrics"`
+		// InternalOnlyRoutes serves the enroll, agent actions, action result and policy preview routes only on the internal listener,
+		// they answer with a 404 on the other listeners.
+		InternalOnlyRoutes bool `config:"internal_only_routes"`
+		// ConfigPrecedence selects which of the policy and the local settings wins when both set a setting.
+		ConfigPrecedence string `config:"config_precedence"`
+		// BasePath is the path all the routes are served under, when fleet-server is exposed behind a reverse proxy
+		// at a path. The internal listener always serves the routes at the root.
+		BasePath string `config:"base_path"`
+		// Signing configures the verification of the signatures of the policies and the actions before they are dispatched.
+		Signing Signing `config:"signing"`
+		// Compatibility restricts the versions of the agents that can enroll and check in.
+		Compatibility Compatibility `config:"compatibility"`
 	}
 
 	StaticPolicyTokens struct {
@@ -94,7 +165,7 @@ type (
 
 // InitDefaults initializes the defaults for the configuration.
 func (c *Server) InitDefaults() {
-	c.Host = kDefaultHost
+	c.Host = BindHosts{kDefaultHost}
 	c.Port = kDefaultPort
 	c.InternalPort = kDefaultInternalPort
 	c.Timeouts.InitDefaults()
@@ -106,42 +177,190 @@ func (c *Server) InitDefaults() {
 	c.Bulk.InitDefaults()
 	c.GC.InitDefaults()
 	c.PGP.InitDefaults()
+	c.Auth.InitDefaults()
+	c.HealthCheck.InitDefaults()
+	c.Enroll.InitDefaults()
+	c.ArtifactUpstream.InitDefaults()
+	c.Checkin.InitDefaults()
+	c.ActionResults.InitDefaults()
+	c.AgentActions.InitDefaults()
+	c.SelfMetrics.InitDefaults()
+	c.ConfigPrecedence = PrecedencePolicy
 }
 
-// BindEndpoints returns the binding address for the all HTTP server listeners.
-func (c *Server) BindEndpoints() []string {
-	primaryAddress := c.BindAddress()
-	endpoints := make([]string, 0, 2)
-	endpoints = append(endpoints, primaryAddress)
+// Validate ensures that the configuration is valid.
+func (c *Server) Validate() error {
+	if c.InternalOnlyRoutes && slices.Contains(c.BindAddresses(), c.BindInternalAddress()) {
+		return errors.New("internal_only_routes requires the internal listener to be bound to another address than the server")
+	}
+	switch c.ConfigPrecedence {
+	case "", PrecedencePolicy, PrecedenceLocal:
+	default:
+		return fmt.Errorf("config_precedence must be %q or %q", PrecedencePolicy, PrecedenceLocal)
+	}
+	if strings.ContainsAny(c.BasePath, "?#") || strings.Contains(c.RoutesBasePath(), "//") {
+		return fmt.Errorf("base_path %q must be a path without empty segments, query or fragment", c.BasePath)
+	}
+	return nil
+}
 
-	if internalAddress := c.BindInternalAddress(); internalAddress != "" && internalAddress != ":0" && internalAddress != primaryAddress {
-		endpoints = append(endpoints, internalAddress)
+// RoutesBasePath returns the base path of the routes with a leading slash and without a trailing slash, or an empty
+// string when the routes are served at the root.
+func (c *Server) RoutesBasePath() string {
+	p := strings.Trim(c.BasePath, "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// CopyNoReloadableLimits returns a copy of the server configuration without the limits that can be reloaded at runtime.
+// enroll.max_concurrency is one of them.
+func (c *Server) CopyNoReloadableLimits() Server {
+	r := *c
+	r.Limits = c.Limits.CopyNoReloadable()
+	r.Enroll.MaxConcurrency = 0
+	return r
+}
+
+// BindEndpoints returns the binding addresses for the all HTTP server listeners.
+// Each entry holds the addresses served by one HTTP server, the internal address is the second entry when it's
+// not already served by the first one.
+func (c *Server) BindEndpoints() [][]string {
+	primaryAddresses := c.BindAddresses()
+	endpoints := make([][]string, 0, 2)
+	endpoints = append(endpoints, primaryAddresses)
+
+	if internalAddress := c.BindInternalAddress(); internalAddress != "" && internalAddress != ":0" && !slices.Contains(primaryAddresses, internalAddress) {
+		endpoints = append(endpoints, []string{internalAddress})
 	}
 
 	return endpoints
 }
 
-// BindAddress returns the binding address for the HTTP server.
+// BindAddress returns the binding address for the first host of the HTTP server.
 func (c *Server) BindAddress() string {
-	return bindAddress(c.Host, c.Port)
+	if len(c.Host) == 0 {
+		return bindAddress("", c.Port)
+	}
+	return bindAddress(c.Host[0], c.Port)
+}
+
+// BindAddresses returns the binding addresses for all the hosts of the HTTP server.
+func (c *Server) BindAddresses() []string {
+	if len(c.Host) == 0 {
+		return []string{bindAddress("", c.Port)}
+	}
+	addrs := make([]string, 0, len(c.Host))
+	for _, host := range c.Host {
+		addrs = append(addrs, bindAddress(host, c.Port))
+	}
+	return addrs
 }
 
 // BindInternalAddress returns the binding address for the internal HTTP server.
 func (c *Server) BindInternalAddress() string {
+	host := c.InternalHost
+	if host == "" {
+		host = kDefaultInternalHost
+	}
 	if c.InternalPort <= 0 {
-		return bindAddress(kDefaultInternalHost, kDefaultInternalPort)
+		return bindAddress(host, kDefaultInternalPort)
 	}
 
-	return bindAddress(kDefaultInternalHost, c.InternalPort)
+	return bindAddress(host, c.InternalPort)
+}
+
+// InternalTLSConfig returns the TLS configuration of the internal HTTP server, the one of the server unless it
+// is overridden by internal_ssl.
+func (c *Server) InternalTLSConfig() *tlscommon.ServerConfig {
+	if c.InternalTLS != nil {
+		return c.InternalTLS
+	}
+	return c.TLS
 }
 
+// UnixSocketPrefix prefixes a host that is the path of a unix socket, it is bound without a port.
+const UnixSocketPrefix = "unix:"
+
 func bindAddress(host string, port uint16) string {
+	if strings.HasPrefix(host, UnixSocketPrefix) {
+		return host
+	}
 	if strings.Count(host, ":") > 1 && strings.Count(host, "]") == 0 {
 		host = "[" + host + "]"
 	}
 	return fmt.Sprintf("%s:%d", host, port)
 }
 
+// BindHosts are the hosts the HTTP server listens on, each host gets its own listener.
+// It is unpacked from a single host or a list of hosts.
+type BindHosts []string
+
+// Unpack accepts a single host or a list of hosts.
+func (h *BindHosts) Unpack(v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		*h = BindHosts{v}
+	case []interface{}:
+		if len(v) == 0 {
+			return errors.New("host list must not be empty")
+		}
+		hosts := make(BindHosts, 0, len(v))
+		for _, host := range v {
+			s, ok := host.(string)
+			if !ok {
+				return fmt.Errorf("host must be a string, found %T", host)
+			}
+			hosts = append(hosts, s)
+		}
+		*h = hosts
+	default:
+		return fmt.Errorf("host must be a string or a list of strings, found %T", v)
+	}
+	return nil
+}
+
+// TrustedProxies are the networks of the proxies in front of the server, an IP address is a network of its own.
+type TrustedProxies []netip.Prefix
+
+// Unpack parses the networks from a list of CIDR blocks or IP addresses.
+func (p *TrustedProxies) Unpack(v interface{}) error {
+	list, ok := v.([]interface{})
+	if !ok {
+		return fmt.Errorf("trusted_proxies must be a list of CIDR blocks, found %T", v)
+	}
+	prefixes := make(TrustedProxies, 0, len(list))
+	for _, entry := range list {
+		s, ok := entry.(string)
+		if !ok {
+			return fmt.Errorf("trusted proxy must be a string, found %T", entry)
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, aErr := netip.ParseAddr(s)
+			if aErr != nil {
+				return fmt.Errorf("trusted proxy %q is not a CIDR block or an IP address", s)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	*p = prefixes
+	return nil
+}
+
+// Contains returns true if addr is the address of a trusted proxy.
+func (p TrustedProxies) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
 // Input is the input defined by Agent to run Fleet Server.
 type Input struct {
 	Type    string  `config:"type"`
@@ -7,12 +7,16 @@
 package config
 
 import (
+	"net/netip"
 	"testing"
+	"time"
 
 	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
 
+	"github.com/elastic/go-ucfg"
 	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestBindAddress(t *testing.T) {
@@ -22,14 +26,14 @@ func TestBindAddress(t *testing.T) {
 	}{
 		"localhost": {
 			cfg: Server{
-				Host: "localhost",
+				Host: BindHosts{"localhost"},
 				Port: 5000,
 			},
 			result: "localhost:5000",
 		},
 		"ipv6": {
 			cfg: Server{
-				Host: "::1",
+				Host: BindHosts{"::1"},
 				Port: 6565,
 			},
 			result: "[::1]:6565",
@@ -49,3 +53,194 @@ func TestBindAddress(t *testing.T) {
 		})
 	}
 }
+
+func TestBindHosts(t *testing.T) {
+	testcases := map[string]struct {
+		host   interface{}
+		result []string
+		err    string
+	}{
+		"single host": {
+			host:   "localhost",
+			result: []string{"localhost:8220"},
+		},
+		"list of hosts": {
+			host:   []interface{}{"127.0.0.1", "::1"},
+			result: []string{"127.0.0.1:8220", "[::1]:8220"},
+		},
+		"unix socket": {
+			host:   []interface{}{"0.0.0.0", "unix:/run/fleet-server.sock"},
+			result: []string{"0.0.0.0:8220", "unix:/run/fleet-server.sock"},
+		},
+		"empty list": {
+			host: []interface{}{},
+			err:  "host list must not be empty",
+		},
+		"not a string": {
+			host: []interface{}{"127.0.0.1", 1},
+			err:  "host must be a string",
+		},
+	}
+
+	for name, test := range testcases {
+		t.Run(name, func(t *testing.T) {
+			c, err := ucfg.NewFrom(map[string]interface{}{"host": test.host}, DefaultOptions...)
+			require.NoError(t, err)
+
+			var cfg Server
+			cfg.InitDefaults()
+			err = c.Unpack(&cfg, DefaultOptions...)
+			if test.err != "" {
+				assert.ErrorContains(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.result, cfg.BindAddresses())
+			assert.Equal(t, append([][]string{test.result}, []string{"localhost:8221"}), cfg.BindEndpoints())
+		})
+	}
+}
+
+func TestInternalOnlyRoutes(t *testing.T) {
+	testcases := map[string]struct {
+		cfg      map[string]interface{}
+		internal string
+		err      string
+	}{
+		"default internal listener": {
+			cfg:      map[string]interface{}{"internal_only_routes": true},
+			internal: "localhost:8221",
+		},
+		"internal host": {
+			cfg:      map[string]interface{}{"internal_only_routes": true, "internal_host": "10.0.0.1", "internal_port": 9000},
+			internal: "10.0.0.1:9000",
+		},
+		"internal address served by the server": {
+			cfg: map[string]interface{}{"internal_only_routes": true, "host": "localhost", "internal_port": 8220},
+			err: "internal_only_routes requires the internal listener",
+		},
+		"internal address served by the server without internal only routes": {
+			cfg:      map[string]interface{}{"host": "localhost", "internal_port": 8220},
+			internal: "localhost:8220",
+		},
+	}
+
+	for name, test := range testcases {
+		t.Run(name, func(t *testing.T) {
+			c, err := ucfg.NewFrom(test.cfg, DefaultOptions...)
+			require.NoError(t, err)
+
+			var cfg Server
+			cfg.InitDefaults()
+			err = c.Unpack(&cfg, DefaultOptions...)
+			if test.err != "" {
+				assert.ErrorContains(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.internal, cfg.BindInternalAddress())
+		})
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	testcases := map[string]struct {
+		basePath string
+		routes   string
+		err      string
+	}{
+		"empty":                 {basePath: "", routes: ""},
+		"root":                  {basePath: "/", routes: ""},
+		"path":                  {basePath: "/fleet", routes: "/fleet"},
+		"trailing slash":        {basePath: "/fleet/", routes: "/fleet"},
+		"no leading slash":      {basePath: "fleet", routes: "/fleet"},
+		"nested":                {basePath: "/a/b/", routes: "/a/b"},
+		"empty segment":         {basePath: "/a//b", err: "must be a path without empty segments"},
+		"query":                 {basePath: "/fleet?x=1", err: "must be a path without empty segments"},
+		"fragment":              {basePath: "/fleet#x", err: "must be a path without empty segments"},
+		"leading double slash":  {basePath: "//fleet", routes: "/fleet"},
+		"trailing double slash": {basePath: "/fleet//", routes: "/fleet"},
+	}
+
+	for name, test := range testcases {
+		t.Run(name, func(t *testing.T) {
+			c, err := ucfg.NewFrom(map[string]interface{}{"base_path": test.basePath}, DefaultOptions...)
+			require.NoError(t, err)
+
+			var cfg Server
+			cfg.InitDefaults()
+			err = c.Unpack(&cfg, DefaultOptions...)
+			if test.err != "" {
+				assert.ErrorContains(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.routes, cfg.RoutesBasePath())
+		})
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	testcases := map[string]struct {
+		proxies interface{}
+		trusted []string
+		other   []string
+		err     string
+	}{
+		"networks and addresses": {
+			proxies: []interface{}{"10.0.0.0/8", "192.168.1.10", "2001:db8::/32", "::1"},
+			trusted: []string{"10.1.2.3", "192.168.1.10", "2001:db8::17", "::1", "::ffff:10.0.0.1"},
+			other:   []string{"11.0.0.1", "192.168.1.11", "2001:db9::1", "::2"},
+		},
+		"not a list": {
+			proxies: "10.0.0.0/8",
+			err:     "trusted_proxies must be a list of CIDR blocks",
+		},
+		"invalid entry": {
+			proxies: []interface{}{"10.0.0.0/33"},
+			err:     `trusted proxy "10.0.0.0/33" is not a CIDR block or an IP address`,
+		},
+	}
+
+	for name, test := range testcases {
+		t.Run(name, func(t *testing.T) {
+			c, err := ucfg.NewFrom(map[string]interface{}{"trusted_proxies": test.proxies}, DefaultOptions...)
+			require.NoError(t, err)
+
+			var cfg Server
+			cfg.InitDefaults()
+			err = c.Unpack(&cfg, DefaultOptions...)
+			if test.err != "" {
+				assert.ErrorContains(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			for _, addr := range test.trusted {
+				assert.True(t, cfg.TrustedProxies.Contains(netip.MustParseAddr(addr)), addr)
+			}
+			for _, addr := range test.other {
+				assert.False(t, cfg.TrustedProxies.Contains(netip.MustParseAddr(addr)), addr)
+			}
+		})
+	}
+}
+
+func TestValidateStatusWriteInterval(t *testing.T) {
+	require.EqualError(t, (&CheckinBulk{StatusWriteInterval: -time.Minute}).Validate(), "status_write_interval must not be negative, got -1m0s")
+
+	cfg := &Config{Inputs: []Input{{}}}
+	cfg.Inputs[0].Server.Bulk.Checkin.StatusWriteInterval = 5 * time.Minute
+	require.NoError(t, cfg.Validate(), "the inactivity timeout is disabled")
+
+	cfg.Fleet.Agent.InactivityTimeout = time.Hour
+	require.NoError(t, cfg.Validate())
+
+	cfg.Fleet.Agent.InactivityTimeout = 5 * time.Minute
+	require.EqualError(t, cfg.Validate(), "status_write_interval (5m0s) must be shorter than inactivity_timeout (5m0s)")
+}
+
+func TestValidateSpoolMaxSize(t *testing.T) {
+	require.NoError(t, (&CheckinBulk{}).Validate(), "the spool is disabled")
+	require.NoError(t, (&CheckinBulk{SpoolPath: "checkins.spool", SpoolMaxSize: 1024}).Validate())
+	require.EqualError(t, (&CheckinBulk{SpoolPath: "checkins.spool"}).Validate(), "spool_max_size must be positive, got 0")
+}
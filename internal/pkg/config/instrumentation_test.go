@@ -165,7 +165,7 @@ func TestAPMHTTPTransportOptions(t *testing.T) {
 			APIKeyPath: "/path/does/not/exist",
 		}
 		_, err := i.APMHTTPTransportOptions()
-		assert.ErrorAs(t, err, &os.ErrNotExist)
+		assert.ErrorIs(t, err, os.ErrNotExist)
 	})
 }
 
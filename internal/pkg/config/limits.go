@@ -13,26 +13,86 @@ type Limit struct {
 	Burst    int           `config:"burst"`
 	Max      int64         `config:"max"`
 	MaxBody  int64         `config:"max_body_byte_size"`
+	MaxWait  time.Duration `config:"max_wait"`
+	PerKey   KeyLimit      `config:"per_key"`
+}
+
+// KeyLimit is a rate limit applied to each API key individually.
+// A zero interval disables the limit.
+type KeyLimit struct {
+	Interval time.Duration `config:"interval"`
+	Burst    int           `config:"burst"`
+}
+
+// defaultEnrollRetryFactor is how many more re-enrollments than new enrollments are admitted when the retry
+// limits are not set.
+const defaultEnrollRetryFactor = 4
+
+// EnrollLimit is the rate limit of the enroll endpoint.
+//
+// The enroll requests that reference an existing agent, the re-enrollments and replacements of agents, are
+// limited separately with a more generous burst and max, so that a mass re-enrollment does not reject the
+// enrollment of new agents, or the other way round. They use the interval, max_wait and max_body_byte_size of the
+// limit.
+type EnrollLimit struct {
+	Limit `config:",inline"`
+	// RetryBurst is the burst of the re-enrollments, 0 uses 4 times the burst of the limit.
+	RetryBurst int `config:"retry_burst"`
+	// RetryMax is the max number of concurrent re-enrollments, 0 uses 4 times the max of the limit.
+	RetryMax int64 `config:"retry_max"`
+}
+
+// RetryLimit returns the limit of the re-enrollments.
+func (c *EnrollLimit) RetryLimit() Limit {
+	return Limit{
+		Interval: c.Interval,
+		Burst:    c.RetryBurst,
+		Max:      c.RetryMax,
+		MaxBody:  c.MaxBody,
+		MaxWait:  c.MaxWait,
+	}
+}
+
+func (c *EnrollLimit) loadRetryDefaults() {
+	if c.RetryBurst == 0 {
+		c.RetryBurst = defaultEnrollRetryFactor * c.Burst
+	}
+	if c.RetryMax == 0 {
+		c.RetryMax = defaultEnrollRetryFactor * c.Max
+	}
+}
+
+// AgentRange is the range of agents a limits tier is recommended for.
+type AgentRange struct {
+	Min int
+	Max int
 }
 
 type ServerLimits struct {
-	MaxAgents         int           `config:"max_agents"`
-	PolicyThrottle    time.Duration `config:"policy_throttle"` // deprecated: replaced by policy_limit
-	MaxHeaderByteSize int           `config:"max_header_byte_size"`
-	MaxConnections    int           `config:"max_connections"`
-
-	ActionLimit      Limit `config:"action_limit"`
-	PolicyLimit      Limit `config:"policy_limit"`
-	CheckinLimit     Limit `config:"checkin_limit"`
-	ArtifactLimit    Limit `config:"artifact_limit"`
-	EnrollLimit      Limit `config:"enroll_limit"`
-	AckLimit         Limit `config:"ack_limit"`
-	StatusLimit      Limit `config:"status_limit"`
-	UploadStartLimit Limit `config:"upload_start_limit"`
-	UploadEndLimit   Limit `config:"upload_end_limit"`
-	UploadChunkLimit Limit `config:"upload_chunk_limit"`
-	DeliverFileLimit Limit `config:"file_delivery_limit"`
-	GetPGPKey        Limit `config:"pgp_retrieval_limit"`
+	MaxAgents           int           `config:"max_agents"`
+	PolicyThrottle      time.Duration `config:"policy_throttle"` // deprecated: replaced by policy_limit
+	MaxHeaderByteSize   int           `config:"max_header_byte_size"`
+	MaxConnections      int           `config:"max_connections"`
+	ShedIdleConnections bool          `config:"shed_idle_connections"`
+	// PolicyDispatchWorkers is the number of workers delivering policy changes to the agents, 0 uses 4 per CPU.
+	PolicyDispatchWorkers int `config:"policy_dispatch_workers"`
+
+	ActionLimit      Limit       `config:"action_limit"`
+	PolicyLimit      Limit       `config:"policy_limit"`
+	CheckinLimit     Limit       `config:"checkin_limit"`
+	ArtifactLimit    Limit       `config:"artifact_limit"`
+	EnrollLimit      EnrollLimit `config:"enroll_limit"`
+	AckLimit         Limit       `config:"ack_limit"`
+	StatusLimit      Limit       `config:"status_limit"`
+	UploadStartLimit Limit       `config:"upload_start_limit"`
+	UploadEndLimit   Limit       `config:"upload_end_limit"`
+	UploadChunkLimit Limit       `config:"upload_chunk_limit"`
+	DeliverFileLimit Limit       `config:"file_delivery_limit"`
+	GetPGPKey        Limit       `config:"pgp_retrieval_limit"`
+	AgentActions     Limit       `config:"agent_actions_limit"`
+
+	// Agents is the agent range of the limits tier selected by LoadLimits.
+	Agents AgentRange `config:",ignore"`
 }
 
 // InitDefaults initializes the defaults for the configuration.
@@ -40,6 +100,7 @@ func (c *ServerLimits) InitDefaults() {}
 
 func (c *ServerLimits) LoadLimits(limits *envLimits) {
 	l := limits.Server
+	c.Agents = AgentRange{Min: limits.Agents.Min, Max: limits.Agents.Max}
 
 	if c.MaxHeaderByteSize == 0 {
 		c.MaxHeaderByteSize = 8192 // 8k
@@ -55,7 +116,8 @@ func (c *ServerLimits) LoadLimits(limits *envLimits) {
 	c.PolicyLimit = mergeEnvLimit(c.PolicyLimit, l.PolicyLimit)
 	c.CheckinLimit = mergeEnvLimit(c.CheckinLimit, l.CheckinLimit)
 	c.ArtifactLimit = mergeEnvLimit(c.ArtifactLimit, l.ArtifactLimit)
-	c.EnrollLimit = mergeEnvLimit(c.EnrollLimit, l.EnrollLimit)
+	c.EnrollLimit.Limit = mergeEnvLimit(c.EnrollLimit.Limit, l.EnrollLimit)
+	c.EnrollLimit.loadRetryDefaults()
 	c.AckLimit = mergeEnvLimit(c.AckLimit, l.AckLimit)
 	c.StatusLimit = mergeEnvLimit(c.StatusLimit, l.StatusLimit)
 	c.UploadStartLimit = mergeEnvLimit(c.UploadStartLimit, l.UploadStartLimit)
@@ -63,6 +125,27 @@ func (c *ServerLimits) LoadLimits(limits *envLimits) {
 	c.UploadChunkLimit = mergeEnvLimit(c.UploadChunkLimit, l.UploadChunkLimit)
 	c.DeliverFileLimit = mergeEnvLimit(c.DeliverFileLimit, l.DeliverFileLimit)
 	c.GetPGPKey = mergeEnvLimit(c.GetPGPKey, l.GetPGPKeyLimit)
+	c.AgentActions = mergeEnvLimit(c.AgentActions, l.AgentActions)
+}
+
+// CopyNoReloadable returns a copy of the limits without the settings that can be applied to a running server.
+// The endpoint rate limits (interval, burst, max, and max_wait), the action limit, max_connections and
+// shed_idle_connections are reloadable. The agents range of the tier is only reported, it is reloaded as well.
+func (c *ServerLimits) CopyNoReloadable() ServerLimits {
+	r := *c
+	r.MaxConnections = 0
+	r.ShedIdleConnections = false
+	r.Agents = AgentRange{}
+	r.EnrollLimit.RetryBurst = 0
+	r.EnrollLimit.RetryMax = 0
+	for _, l := range []*Limit{
+		&r.CheckinLimit, &r.ArtifactLimit, &r.EnrollLimit.Limit, &r.AckLimit, &r.StatusLimit,
+		&r.UploadStartLimit, &r.UploadEndLimit, &r.UploadChunkLimit, &r.DeliverFileLimit, &r.GetPGPKey,
+		&r.AgentActions, &r.ActionLimit,
+	} {
+		*l = Limit{MaxBody: l.MaxBody}
+	}
+	return r
 }
 
 func mergeEnvLimit(L Limit, l limit) Limit {
@@ -71,6 +154,8 @@ func mergeEnvLimit(L Limit, l limit) Limit {
 		Burst:    L.Burst,
 		Max:      L.Max,
 		MaxBody:  L.MaxBody,
+		MaxWait:  L.MaxWait,
+		PerKey:   L.PerKey,
 	}
 	if result.Interval == 0 {
 		result.Interval = l.Interval
@@ -84,5 +169,14 @@ func mergeEnvLimit(L Limit, l limit) Limit {
 	if result.MaxBody == 0 {
 		result.MaxBody = l.MaxBody
 	}
+	if result.MaxWait == 0 {
+		result.MaxWait = l.MaxWait
+	}
+	if result.PerKey.Interval == 0 {
+		result.PerKey.Interval = l.PerKey.Interval
+	}
+	if result.PerKey.Burst == 0 {
+		result.PerKey.Burst = l.PerKey.Burst
+	}
 	return result
 }
@@ -11,7 +11,11 @@ import (
 	"github.com/rs/zerolog"
 )
 
-const defaultLevel = "info"
+const (
+	defaultLevel = "info"
+
+	defaultRecentErrorsSize = 200
+)
 
 // LoggingFiles configuration for the logging file output.
 type LoggingFiles struct {
@@ -42,6 +46,53 @@ func (c *LoggingFiles) InitDefaults() {
 	c.RotateOnStartup = true
 }
 
+// LoggingAudit configuration for the audit log.
+//
+// The audit log records enrollments, unenrollments and API key invalidations as JSON lines,
+// separately from the main log so it is not affected by its level.
+type LoggingAudit struct {
+	Enabled  bool               `config:"enabled"`
+	ToStdout bool               `config:"to_stdout"`
+	Files    *LoggingAuditFiles `config:"files"`
+}
+
+// LoggingAuditFiles configuration for the audit log file output.
+// It has the same settings and defaults as LoggingFiles except for the file name.
+type LoggingAuditFiles struct {
+	Path            string        `config:"path"`
+	Name            string        `config:"name"`
+	MaxSize         uint          `config:"rotateeverybytes" validate:"min=1"`
+	MaxBackups      uint          `config:"keepfiles" validate:"max=1024"`
+	Permissions     uint32        `config:"permissions"`
+	Interval        time.Duration `config:"interval"`
+	RotateOnStartup bool          `config:"rotateonstartup"`
+}
+
+// InitDefaults initializes the defaults for the configuration.
+func (c *LoggingAuditFiles) InitDefaults() {
+	var d LoggingFiles
+	d.InitDefaults()
+
+	c.Path = d.Path
+	c.Name = "fleet-server-audit.log"
+	c.MaxSize = d.MaxSize
+	c.MaxBackups = d.MaxBackups
+	c.Permissions = d.Permissions
+	c.Interval = d.Interval
+	c.RotateOnStartup = d.RotateOnStartup
+}
+
+// LoggingRecentErrors configuration for the last errors of each subsystem kept for the diagnostics bundle.
+type LoggingRecentErrors struct {
+	// Size is the number of errors kept per subsystem, 0 disables the recording.
+	Size int `config:"size" validate:"min=0"`
+}
+
+// InitDefaults initializes the defaults for the configuration.
+func (c *LoggingRecentErrors) InitDefaults() {
+	c.Size = defaultRecentErrorsSize
+}
+
 // Logging configuration.
 type Logging struct {
 	Level    string        `config:"level"`
@@ -49,6 +100,12 @@ type Logging struct {
 	ToFiles  bool          `config:"to_files"`
 	Pretty   bool          `config:"pretty"`
 	Files    *LoggingFiles `config:"files"`
+	Audit    LoggingAudit  `config:"audit"`
+
+	RecentErrors LoggingRecentErrors `config:"recent_errors"`
+
+	// SlowRequestThreshold is the duration over which API requests are logged as slow, 0 disables the logging.
+	SlowRequestThreshold time.Duration `config:"slow_request_threshold" validate:"min=0"`
 }
 
 func (c *Logging) EqualExcludeLevel(cfg Logging) bool {
@@ -67,6 +124,7 @@ func (c *Logging) EqualExcludeLevel(cfg Logging) bool {
 func (c *Logging) InitDefaults() {
 	c.Level = defaultLevel
 	c.ToFiles = true
+	c.RecentErrors.InitDefaults()
 }
 
 // Validate ensures that the configuration is valid.
@@ -10,16 +10,33 @@ const (
 	defaultFetchSize          = 1000
 	defaultPollTimeout        = 4 * time.Minute
 	defaultPolicyDebounceTime = time.Second
+	defaultReplayMaxDocs      = 10000
 )
 
 type Monitor struct {
 	FetchSize          int           `config:"fetch_size"`
 	PollTimeout        time.Duration `config:"poll_timeout"`
 	PolicyDebounceTime time.Duration `config:"policy_debounce_time"`
+	// ReplayMaxDocs is the maximum number of documents written while fleet-server was not running that the monitors
+	// send on start. The processed checkpoints are not persisted when it is 0.
+	ReplayMaxDocs int `config:"replay_max_docs" validate:"min=0"`
+	// LowLatency dispatches new actions without waiting for the action monitor to see the global checkpoint advance.
+	LowLatency LowLatency `config:"low_latency"`
+}
+
+// LowLatency is the configuration of the low latency mode of the action monitor.
+type LowLatency struct {
+	Enabled bool `config:"enabled"`
+	// PollInterval fetches the new actions on an interval, it is disabled when 0.
+	PollInterval time.Duration `config:"poll_interval" validate:"min=0"`
+	// ActionTypes are the types of the actions added through the agent actions endpoint that are fetched as soon as
+	// they are written, all types when empty.
+	ActionTypes []string `config:"action_types"`
 }
 
 func (m *Monitor) InitDefaults() {
 	m.FetchSize = defaultFetchSize
 	m.PollTimeout = defaultPollTimeout
 	m.PolicyDebounceTime = defaultPolicyDebounceTime
+	m.ReplayMaxDocs = defaultReplayMaxDocs
 }
@@ -7,6 +7,7 @@ package config
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -17,7 +18,6 @@ import (
 	"strings"
 	"time"
 
-	urlutil "github.com/elastic/elastic-agent-libs/kibana"
 	"github.com/elastic/elastic-agent-libs/transport/httpcommon"
 	"github.com/elastic/elastic-agent-libs/transport/tlscommon"
 	"github.com/elastic/go-elasticsearch/v8"
@@ -34,9 +34,16 @@ var hasScheme = regexp.MustCompile(`^([a-z][a-z0-9+\-.]*)://`)
 // Output is the output configuration to elasticsearch.
 type Output struct {
 	Elasticsearch Elasticsearch          `config:"elasticsearch"`
+	Monitoring    *MonitoringOutput      `config:"monitoring"`
 	Extra         map[string]interface{} `config:",inline"`
 }
 
+// MonitoringOutput is the configuration of the secondary elasticsearch cluster
+// that the agent checkin status and the status of fleet-server are mirrored to.
+type MonitoringOutput struct {
+	Elasticsearch Elasticsearch `config:"elasticsearch"`
+}
+
 // Elasticsearch is the configuration for elasticsearch.
 type Elasticsearch struct {
 	Protocol         string            `config:"protocol"`
@@ -45,14 +52,85 @@ type Elasticsearch struct {
 	Headers          map[string]string `config:"headers"`
 	ServiceToken     string            `config:"service_token"`
 	ServiceTokenPath string            `config:"service_token_path"`
+	Username         string            `config:"username"`
+	Password         string            `config:"password"`
+	APIKey           string            `config:"api_key"`
 	ProxyURL         string            `config:"proxy_url"`
 	ProxyDisable     bool              `config:"proxy_disable"`
 	ProxyHeaders     map[string]string `config:"proxy_headers"`
+	NoProxy          []string          `config:"no_proxy"`
 	TLS              *tlscommon.Config `config:"ssl"`
 	MaxRetries       int               `config:"max_retries"`
-	MaxConnPerHost   int               `config:"max_conn_per_host"`
+	MaxConnPerHost   int               `config:"max_conn_per_host"` // deprecated: replaced by max_conns_per_host
+	ConnPool         ConnPool          `config:",inline"`
 	Timeout          time.Duration     `config:"timeout"`
 	MaxContentLength int               `config:"max_content_length"`
+	BulkRetry        BulkRetry         `config:"bulk_retry"`
+	Bulk             OutputBulk        `config:"bulk"`
+	// StartupTimeout is how long fleet-server waits for Elasticsearch to be reachable when it starts, 0 waits forever.
+	StartupTimeout time.Duration `config:"startup_timeout" validate:"min=0"`
+}
+
+// ConnPool is the connection pool of the transport to Elasticsearch.
+// The settings that are not defined are taken from the limits tier selected by max_agents.
+type ConnPool struct {
+	MaxIdleConns        int           `config:"max_idle_conns" validate:"min=0"`
+	MaxIdleConnsPerHost int           `config:"max_idle_conns_per_host" validate:"min=0"`
+	MaxConnsPerHost     int           `config:"max_conns_per_host" validate:"min=0"`
+	IdleConnTimeout     time.Duration `config:"idle_conn_timeout" validate:"min=0"`
+}
+
+// LoadLimits loads envLimits for any attribute that is not defined in ConnPool.
+func (c *ConnPool) LoadLimits(limits *envLimits) {
+	l := limits.Output
+
+	if c.MaxIdleConns == 0 {
+		c.MaxIdleConns = l.MaxIdleConns
+	}
+	if c.MaxIdleConnsPerHost == 0 {
+		c.MaxIdleConnsPerHost = l.MaxIdleConnsPerHost
+	}
+	if c.MaxConnsPerHost == 0 {
+		c.MaxConnsPerHost = l.MaxConnsPerHost
+	}
+	if c.IdleConnTimeout == 0 {
+		c.IdleConnTimeout = l.IdleConnTimeout
+	}
+}
+
+// OutputBulk limits the memory used by the bulk operations waiting to be sent to Elasticsearch.
+type OutputBulk struct {
+	MaxPendingBytes int           `config:"max_pending_bytes" validate:"min=0"`
+	MaxPendingWait  time.Duration `config:"max_pending_wait" validate:"min=0"`
+}
+
+// InitDefaults initializes the defaults for the configuration.
+func (c *OutputBulk) InitDefaults() {
+	c.MaxPendingBytes = 0
+	c.MaxPendingWait = 30 * time.Second
+}
+
+// BulkRetry is the retry policy of the bulk requests that fail with a transient error,
+// such as Elasticsearch rejecting the request with a 429 status.
+type BulkRetry struct {
+	MaxRetries   int           `config:"max_retries" validate:"min=0"`
+	InitInterval time.Duration `config:"init_interval" validate:"nonzero"`
+	MaxInterval  time.Duration `config:"max_interval" validate:"nonzero"`
+}
+
+// InitDefaults initializes the defaults for the configuration.
+func (c *BulkRetry) InitDefaults() {
+	c.MaxRetries = 3
+	c.InitInterval = 250 * time.Millisecond
+	c.MaxInterval = 5 * time.Second
+}
+
+// Validate ensures that the configuration is valid.
+func (c *BulkRetry) Validate() error {
+	if c.InitInterval > c.MaxInterval {
+		return fmt.Errorf("bulk_retry.init_interval (%s) must not be greater than bulk_retry.max_interval (%s)", c.InitInterval, c.MaxInterval)
+	}
+	return nil
 }
 
 // InitDefaults initializes the defaults for the configuration.
@@ -61,14 +139,20 @@ func (c *Elasticsearch) InitDefaults() {
 	c.Hosts = []string{"localhost:9200"}
 	c.Timeout = 90 * time.Second
 	c.MaxRetries = 3
-	c.MaxConnPerHost = 128
 	c.MaxContentLength = 100 * 1024 * 1024
+	c.BulkRetry.InitDefaults()
+	c.Bulk.InitDefaults()
 }
 
 // Validate ensures that the configuration is valid.
 func (c *Elasticsearch) Validate() error {
-	if c.ProxyURL != "" && !c.ProxyDisable {
-		if _, err := urlutil.ParseURL(c.ProxyURL); err != nil {
+	if !c.ProxyDisable {
+		if c.ProxyURL != "" {
+			if _, err := parseProxyURL(c.ProxyURL); err != nil {
+				return err
+			}
+		}
+		if _, err := parseNoProxy(c.NoProxy); err != nil {
 			return err
 		}
 	}
@@ -78,6 +162,61 @@ func (c *Elasticsearch) Validate() error {
 			return err
 		}
 	}
+	return c.validateAuth()
+}
+
+// LoadLimits loads the connection pool settings that are not defined from limits.
+// The deprecated max_conn_per_host is used when max_conns_per_host is not set.
+func (c *Elasticsearch) LoadLimits(limits *envLimits) {
+	if c.ConnPool.MaxConnsPerHost == 0 {
+		c.ConnPool.MaxConnsPerHost = c.MaxConnPerHost
+	}
+	c.ConnPool.LoadLimits(limits)
+}
+
+// Pool returns the connection pool settings.
+// The settings that are not loaded from a limits tier use the default limits.
+func (c *Elasticsearch) Pool() ConnPool {
+	p := c.ConnPool
+	if p.MaxConnsPerHost == 0 {
+		p.MaxConnsPerHost = c.MaxConnPerHost
+	}
+	p.LoadLimits(defaultEnvLimits())
+	return p
+}
+
+// validateAuth ensures that at most one authentication method is configured.
+func (c *Elasticsearch) validateAuth() error {
+	var methods []string
+	if c.ServiceToken != "" || c.ServiceTokenPath != "" {
+		methods = append(methods, "service_token")
+	}
+	if c.Username != "" || c.Password != "" {
+		if c.Username == "" || c.Password == "" {
+			return errors.New("username and password must be set together")
+		}
+		methods = append(methods, "username/password")
+	}
+	if c.APIKey != "" {
+		methods = append(methods, "api_key")
+	}
+	if len(methods) > 1 {
+		return fmt.Errorf("only one authentication method may be set, found: %s", strings.Join(methods, ", "))
+	}
+	return nil
+}
+
+// LoadServiceToken reads the service token from service_token_path if service_token is not set.
+// It should be called every time the configuration is loaded so a rotated token file is picked up on reload.
+func (c *Elasticsearch) LoadServiceToken() error {
+	if c.ServiceToken != "" || c.ServiceTokenPath == "" {
+		return nil
+	}
+	p, err := os.ReadFile(c.ServiceTokenPath)
+	if err != nil {
+		return fmt.Errorf("unable to read service_token_path: %w", err)
+	}
+	c.ServiceToken = string(p)
 	return nil
 }
 
@@ -94,6 +233,7 @@ func (c *Elasticsearch) ToESConfig(longPoll bool) (elasticsearch.Config, error)
 	}
 
 	// build the transport from the config
+	pool := c.Pool()
 	httpTransport := &http.Transport{
 		DialContext: (&net.Dialer{
 			Timeout:   10 * time.Second,
@@ -102,10 +242,10 @@ func (c *Elasticsearch) ToESConfig(longPoll bool) (elasticsearch.Config, error)
 		TLSHandshakeTimeout:   10 * time.Second,
 		DisableKeepAlives:     false,
 		DisableCompression:    false,
-		MaxIdleConns:          100,
-		MaxIdleConnsPerHost:   32,
-		MaxConnsPerHost:       c.MaxConnPerHost,
-		IdleConnTimeout:       60 * time.Second,
+		MaxIdleConns:          pool.MaxIdleConns,
+		MaxIdleConnsPerHost:   pool.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       pool.MaxConnsPerHost,
+		IdleConnTimeout:       pool.IdleConnTimeout,
 		ResponseHeaderTimeout: c.Timeout,
 		ExpectContinueTimeout: 1 * time.Second,
 	}
@@ -129,24 +269,9 @@ func (c *Elasticsearch) ToESConfig(longPoll bool) (elasticsearch.Config, error)
 	}
 
 	if !c.ProxyDisable {
-		if c.ProxyURL != "" {
-			proxyURL, err := urlutil.ParseURL(c.ProxyURL)
-			if err != nil {
-				return elasticsearch.Config{}, err
-			}
-			httpTransport.Proxy = http.ProxyURL(proxyURL)
-		} else {
-			httpTransport.Proxy = http.ProxyFromEnvironment
-		}
-
-		var proxyHeaders http.Header
-		if len(c.ProxyHeaders) > 0 {
-			proxyHeaders = make(http.Header, len(c.ProxyHeaders))
-			for k, v := range c.ProxyHeaders {
-				proxyHeaders.Add(k, v)
-			}
+		if err := c.setProxy(httpTransport); err != nil {
+			return elasticsearch.Config{}, err
 		}
-		httpTransport.ProxyConnectHeader = proxyHeaders
 	}
 
 	h := http.Header{}
@@ -170,6 +295,9 @@ func (c *Elasticsearch) ToESConfig(longPoll bool) (elasticsearch.Config, error)
 	return elasticsearch.Config{
 		Addresses:    addrs,
 		ServiceToken: serviceToken,
+		Username:     c.Username,
+		Password:     c.Password,
+		APIKey:       c.APIKey,
 		Header:       h,
 		Transport:    httpTransport,
 		MaxRetries:   c.MaxRetries,
@@ -177,14 +305,15 @@ func (c *Elasticsearch) ToESConfig(longPoll bool) (elasticsearch.Config, error)
 	}, nil
 }
 
-// Validate validates that only elasticsearch is defined on the output.
+// Validate validates that only elasticsearch and monitoring are defined on the output.
 func (c *Output) Validate() error {
 	if c.Extra == nil {
 		return nil
 	}
-	_, ok := c.Extra["elasticsearch"]
-	if (!ok && len(c.Extra) > 0) || (ok && len(c.Extra) > 1) {
-		return fmt.Errorf("can only contain elasticsearch key")
+	for k := range c.Extra {
+		if k != "elasticsearch" && k != "monitoring" {
+			return fmt.Errorf("can only contain elasticsearch or monitoring keys")
+		}
 	}
 	// clear Extra because its valid (only used for validation)
 	c.Extra = nil
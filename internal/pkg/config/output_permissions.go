@@ -0,0 +1,12 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package config
+
+// OutputPermissions is the configuration of the output API keys fleet-server mints for the agents.
+type OutputPermissions struct {
+	// WildcardNamespaces keeps the data stream patterns of the policy permissions, such as logs-*, instead of
+	// restricting them to the namespaces of the policy.
+	WildcardNamespaces bool `config:"wildcard_namespaces"`
+}
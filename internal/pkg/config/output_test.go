@@ -85,6 +85,58 @@ func TestToESConfig(t *testing.T) {
 				},
 			},
 		},
+		"username and password": {
+			cfg: Elasticsearch{
+				Protocol:       "http",
+				Hosts:          []string{"localhost:9200"},
+				Username:       "elastic",
+				Password:       "changeme",
+				MaxRetries:     3,
+				MaxConnPerHost: 128,
+				Timeout:        90 * time.Second,
+			},
+			result: elasticsearch.Config{
+				Addresses:  []string{"http://localhost:9200"},
+				Username:   "elastic",
+				Password:   "changeme",
+				Header:     http.Header{},
+				MaxRetries: 3,
+				Transport: &http.Transport{
+					TLSHandshakeTimeout:   10 * time.Second,
+					MaxIdleConns:          100,
+					MaxIdleConnsPerHost:   32,
+					MaxConnsPerHost:       128,
+					IdleConnTimeout:       60 * time.Second,
+					ResponseHeaderTimeout: 90 * time.Second,
+					ExpectContinueTimeout: 1 * time.Second,
+				},
+			},
+		},
+		"api_key": {
+			cfg: Elasticsearch{
+				Protocol:       "http",
+				Hosts:          []string{"localhost:9200"},
+				APIKey:         "test-api-key",
+				MaxRetries:     3,
+				MaxConnPerHost: 128,
+				Timeout:        90 * time.Second,
+			},
+			result: elasticsearch.Config{
+				Addresses:  []string{"http://localhost:9200"},
+				APIKey:     "test-api-key",
+				Header:     http.Header{},
+				MaxRetries: 3,
+				Transport: &http.Transport{
+					TLSHandshakeTimeout:   10 * time.Second,
+					MaxIdleConns:          100,
+					MaxIdleConnsPerHost:   32,
+					MaxConnsPerHost:       128,
+					IdleConnTimeout:       60 * time.Second,
+					ResponseHeaderTimeout: 90 * time.Second,
+					ExpectContinueTimeout: 1 * time.Second,
+				},
+			},
+		},
 		"multi-http": {
 			cfg: Elasticsearch{
 				Protocol:     "http",
@@ -193,7 +245,7 @@ func TestToESConfig(t *testing.T) {
 
 	copts := cmp.Options{
 		cmpopts.IgnoreUnexported(http.Transport{}),
-		cmpopts.IgnoreFields(http.Transport{}, "DialContext"),
+		cmpopts.IgnoreFields(http.Transport{}, "DialContext", "OnProxyConnectResponse"),
 		cmpopts.IgnoreUnexported(tls.Config{}), //nolint:gosec //test case
 	}
 
@@ -286,7 +338,131 @@ func TestToESConfig(t *testing.T) {
 			Timeout:          90 * time.Second,
 		}
 		_, err := cfg.ToESConfig(false)
-		assert.ErrorAs(t, err, &os.ErrNotExist)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+func TestToESConfigConnPool(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Elasticsearch
+		want ConnPool
+	}{{
+		name: "defaults",
+		want: ConnPool{MaxIdleConns: 100, MaxIdleConnsPerHost: 32, MaxConnsPerHost: 128, IdleConnTimeout: 60 * time.Second},
+	}, {
+		name: "max_conn_per_host",
+		cfg:  Elasticsearch{MaxConnPerHost: 256},
+		want: ConnPool{MaxIdleConns: 100, MaxIdleConnsPerHost: 32, MaxConnsPerHost: 256, IdleConnTimeout: 60 * time.Second},
+	}, {
+		name: "conn pool",
+		cfg: Elasticsearch{
+			MaxConnPerHost: 256,
+			ConnPool:       ConnPool{MaxIdleConns: 50, MaxIdleConnsPerHost: 10, MaxConnsPerHost: 20, IdleConnTimeout: time.Second},
+		},
+		want: ConnPool{MaxIdleConns: 50, MaxIdleConnsPerHost: 10, MaxConnsPerHost: 20, IdleConnTimeout: time.Second},
+	}, {
+		name: "tier limits",
+		cfg: func() Elasticsearch {
+			var c Elasticsearch
+			c.LoadLimits(loadLimitsForAgents(12000))
+			return c
+		}(),
+		want: ConnPool{MaxIdleConns: 500, MaxIdleConnsPerHost: 150, MaxConnsPerHost: 256, IdleConnTimeout: 90 * time.Second},
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := tc.cfg.ToESConfig(false)
+			require.NoError(t, err)
+			transport := res.Transport.(*http.Transport) //nolint:errcheck // test case
+			assert.Equal(t, tc.want.MaxIdleConns, transport.MaxIdleConns)
+			assert.Equal(t, tc.want.MaxIdleConnsPerHost, transport.MaxIdleConnsPerHost)
+			assert.Equal(t, tc.want.MaxConnsPerHost, transport.MaxConnsPerHost)
+			assert.Equal(t, tc.want.IdleConnTimeout, transport.IdleConnTimeout)
+		})
+	}
+}
+
+func TestElasticsearchValidateAuth(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Elasticsearch
+		err  string
+	}{{
+		name: "no auth",
+	}, {
+		name: "service_token",
+		cfg:  Elasticsearch{ServiceToken: "token"},
+	}, {
+		name: "service_token and service_token_path",
+		cfg:  Elasticsearch{ServiceToken: "token", ServiceTokenPath: "/path/to/token"},
+	}, {
+		name: "username and password",
+		cfg:  Elasticsearch{Username: "elastic", Password: "changeme"},
+	}, {
+		name: "api_key",
+		cfg:  Elasticsearch{APIKey: "key"},
+	}, {
+		name: "username without password",
+		cfg:  Elasticsearch{Username: "elastic"},
+		err:  "username and password must be set together",
+	}, {
+		name: "password without username",
+		cfg:  Elasticsearch{Password: "changeme"},
+		err:  "username and password must be set together",
+	}, {
+		name: "service_token and api_key",
+		cfg:  Elasticsearch{ServiceToken: "token", APIKey: "key"},
+		err:  "only one authentication method may be set, found: service_token, api_key",
+	}, {
+		name: "service_token_path and username",
+		cfg:  Elasticsearch{ServiceTokenPath: "/path/to/token", Username: "elastic", Password: "changeme"},
+		err:  "only one authentication method may be set, found: service_token, username/password",
+	}, {
+		name: "username and api_key",
+		cfg:  Elasticsearch{Username: "elastic", Password: "changeme", APIKey: "key"},
+		err:  "only one authentication method may be set, found: username/password, api_key",
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.cfg.Validate()
+			if tc.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tc.err)
+		})
+	}
+}
+
+func TestElasticsearchLoadServiceToken(t *testing.T) {
+	t.Run("service_token takes precedence", func(t *testing.T) {
+		cfg := &Elasticsearch{
+			ServiceToken:     "test-token",
+			ServiceTokenPath: filepath.Join(t.TempDir(), "some-file"),
+		}
+		require.NoError(t, cfg.LoadServiceToken())
+		assert.Equal(t, "test-token", cfg.ServiceToken)
+	})
+
+	t.Run("service_token_path is read on every load", func(t *testing.T) {
+		fileName := writeTestFile(t, "test-token")
+		cfg := &Elasticsearch{ServiceTokenPath: fileName}
+		require.NoError(t, cfg.LoadServiceToken())
+		assert.Equal(t, "test-token", cfg.ServiceToken)
+
+		err := os.WriteFile(fileName, []byte("rotated-token"), 0o600)
+		require.NoError(t, err)
+		reloaded := &Elasticsearch{ServiceTokenPath: fileName}
+		require.NoError(t, reloaded.LoadServiceToken())
+		assert.Equal(t, "rotated-token", reloaded.ServiceToken)
+		assert.NotEqual(t, *cfg, *reloaded, "expected a rotated token to change the configuration")
+	})
+
+	t.Run("service_token_path does not exist", func(t *testing.T) {
+		cfg := &Elasticsearch{ServiceTokenPath: filepath.Join(t.TempDir(), "some-file")}
+		err := cfg.LoadServiceToken()
+		assert.ErrorIs(t, err, os.ErrNotExist)
 	})
 }
 
@@ -0,0 +1,298 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/elastic/go-ucfg"
+	"github.com/elastic/go-ucfg/parse"
+	"github.com/rs/zerolog"
+)
+
+// Sources of the configuration settings.
+const (
+	SourceFile   = "file"   // the local YAML file and the -E flags
+	SourceEnv    = "env"    // the FLEET_SERVER_CONFIG_ environment variables
+	SourcePolicy = "policy" // the fleet policy received from the agent
+)
+
+// Precedences of the configuration sources, selected with server.config_precedence.
+const (
+	// PrecedencePolicy is the default, the policy wins over the environment that wins over the file.
+	PrecedencePolicy = "policy"
+	// PrecedenceLocal inverts the default, the file wins over the environment that wins over the policy.
+	PrecedenceLocal = "local"
+)
+
+// EnvConfigPrefix is the prefix of the environment variables that set a configuration setting.
+// The rest of the name is the path of the setting, with __ separating its parts:
+//
+//	FLEET_SERVER_CONFIG_INPUTS__0__SERVER__LIMITS__MAX_CONNECTIONS=1000
+const EnvConfigPrefix = "FLEET_SERVER_CONFIG_"
+
+const precedenceKey = "inputs.0.server.config_precedence"
+
+// secretKeys are the parts of the settings paths whose values are redacted when they are logged.
+var secretKeys = []string{"service_token", "password", "api_key", "key", "passphrase", "secret_token", "policy_tokens", "headers"}
+
+// Sources are the configurations read from each source, a nil source sets nothing.
+type Sources struct {
+	File   *ucfg.Config
+	Env    *ucfg.Config
+	Policy *ucfg.Config
+}
+
+// EnvSource returns the configuration set by the FLEET_SERVER_CONFIG_ variables of environ,
+// in the format of os.Environ. The values are parsed like the values of the -E flags.
+func EnvSource(environ []string) (*ucfg.Config, error) {
+	settings := make(map[string]interface{})
+	for _, kv := range environ {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || !strings.HasPrefix(name, EnvConfigPrefix) {
+			continue
+		}
+		key := strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(name, EnvConfigPrefix), "__", "."))
+		v, err := parse.Value(value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %w", name, err)
+		}
+		settings[key] = v
+	}
+	return ucfg.NewFrom(settings, DefaultOptions...)
+}
+
+// Merged is a configuration merged from its sources, with the source each setting was taken from.
+type Merged struct {
+	precedence string
+	settings   map[string]interface{} // values by flattened path
+	origins    map[string]string      // winning source by flattened path
+	overridden map[string][]string    // sources that also set the path, and lost
+}
+
+// MergeSources merges the settings of the sources in the order of their precedence.
+//
+// Settings are merged key by key: a setting is taken from the source with the highest precedence that sets it,
+// whatever the sources set around it. Lists, such as the hosts, are settings of their own and are never merged
+// element by element, except for the inputs that are merged by position.
+//
+// The precedence is read from server.config_precedence of the environment, then of the file. The policy
+// can not change it.
+func MergeSources(s Sources) (*Merged, error) {
+	flat := make(map[string]map[string]interface{}, 3)
+	for name, c := range map[string]*ucfg.Config{SourceFile: s.File, SourceEnv: s.Env, SourcePolicy: s.Policy} {
+		settings := make(map[string]interface{})
+		if c != nil {
+			var m map[string]interface{}
+			if err := c.Unpack(&m, DefaultOptions...); err != nil {
+				return nil, fmt.Errorf("unable to read the %s configuration: %w", name, err)
+			}
+			flatten("", m, settings)
+		}
+		flat[name] = settings
+	}
+
+	// The precedence in effect is the one of the merged configuration.
+	delete(flat[SourcePolicy], precedenceKey)
+	precedence := PrecedencePolicy
+	for _, source := range []string{SourceEnv, SourceFile} {
+		if v, ok := flat[source][precedenceKey]; ok {
+			precedence = fmt.Sprint(v)
+			break
+		}
+	}
+	var order []string // highest precedence first
+	switch precedence {
+	case PrecedencePolicy:
+		order = []string{SourcePolicy, SourceEnv, SourceFile}
+	case PrecedenceLocal:
+		order = []string{SourceFile, SourceEnv, SourcePolicy}
+	default:
+		return nil, fmt.Errorf("unknown config_precedence %q, it must be %q or %q", precedence, PrecedencePolicy, PrecedenceLocal)
+	}
+
+	m := &Merged{
+		precedence: precedence,
+		settings:   make(map[string]interface{}),
+		origins:    make(map[string]string),
+		overridden: make(map[string][]string),
+	}
+	for _, source := range order {
+		for key, v := range flat[source] {
+			if _, ok := m.origins[key]; ok {
+				m.overridden[key] = append(m.overridden[key], source)
+				continue
+			}
+			m.settings[key] = v
+			m.origins[key] = source
+		}
+	}
+	return m, nil
+}
+
+// Precedence returns the precedence the sources were merged with.
+func (m *Merged) Precedence() string {
+	return m.precedence
+}
+
+// Origin returns the source the setting at the flattened path was taken from, or an empty string.
+func (m *Merged) Origin(key string) string {
+	return m.origins[key]
+}
+
+// UCfg returns the merged configuration.
+func (m *Merged) UCfg() (*ucfg.Config, error) {
+	return ucfg.NewFrom(unflatten(m.settings), DefaultOptions...)
+}
+
+// Config returns the merged configuration.
+func (m *Merged) Config() (*Config, error) {
+	c, err := m.UCfg()
+	if err != nil {
+		return nil, err
+	}
+	return FromConfig(c)
+}
+
+// Change is a setting that changed between two merged configurations.
+type Change struct {
+	Key        string   `json:"key"`
+	Source     string   `json:"source,omitempty"` // the source the new value was taken from, empty if it was removed
+	Overridden []string `json:"overridden,omitempty"`
+	Old        string   `json:"old,omitempty"`
+	New        string   `json:"new,omitempty"`
+}
+
+// Diff returns the settings that changed since prev, sorted by key, with their secret values redacted.
+// All the settings are changed when prev is nil.
+func (m *Merged) Diff(prev *Merged) []Change {
+	var old map[string]interface{}
+	if prev != nil {
+		old = prev.settings
+	}
+	var changes []Change
+	for key, v := range m.settings {
+		ov, ok := old[key]
+		if ok && reflect.DeepEqual(ov, v) {
+			continue
+		}
+		c := Change{Key: key, Source: m.origins[key], Overridden: m.overridden[key], New: redactSetting(key, v)}
+		if ok {
+			c.Old = redactSetting(key, ov)
+		}
+		changes = append(changes, c)
+	}
+	for key, ov := range old {
+		if _, ok := m.settings[key]; !ok {
+			changes = append(changes, Change{Key: key, Old: redactSetting(key, ov)})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+// LogDiff logs the settings that changed since prev and the source they were taken from.
+func (m *Merged) LogDiff(ctx context.Context, prev *Merged) {
+	changes := m.Diff(prev)
+	if len(changes) == 0 {
+		return
+	}
+	overridden := 0
+	for _, c := range changes {
+		if len(c.Overridden) > 0 {
+			overridden++
+		}
+	}
+	zerolog.Ctx(ctx).Info().
+		Str("config_precedence", m.precedence).
+		Int("changed", len(changes)).
+		Int("overridden", overridden).
+		Interface("changes", changes).
+		Msg("Configuration changed")
+}
+
+// flatten adds the settings of m to out by their dotted path.
+// Maps are flattened, an empty map sets nothing. Lists are values of their own, except the inputs that are
+// flattened by position.
+func flatten(prefix string, m map[string]interface{}, out map[string]interface{}) {
+	for k, v := range m {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			flatten(key, v, out)
+		case []interface{}:
+			if key != "inputs" {
+				out[key] = v
+				continue
+			}
+			for i, input := range v {
+				if im, ok := input.(map[string]interface{}); ok {
+					flatten(key+"."+strconv.Itoa(i), im, out)
+				}
+			}
+		default:
+			out[key] = v
+		}
+	}
+}
+
+// unflatten returns the nested settings of the flattened settings.
+func unflatten(settings map[string]interface{}) map[string]interface{} {
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	root := make(map[string]interface{})
+	for _, key := range keys {
+		v := settings[key]
+		parts := strings.Split(key, ".")
+		m := root
+		for _, part := range parts[:len(parts)-1] {
+			next, ok := m[part].(map[string]interface{})
+			if !ok {
+				next = make(map[string]interface{})
+				m[part] = next
+			}
+			m = next
+		}
+		m[parts[len(parts)-1]] = v
+	}
+
+	// The inputs were flattened by position.
+	if inputs, ok := root["inputs"].(map[string]interface{}); ok {
+		list := make([]interface{}, 0, len(inputs))
+		for i := 0; ; i++ {
+			input, ok := inputs[strconv.Itoa(i)]
+			if !ok {
+				break
+			}
+			list = append(list, input)
+		}
+		root["inputs"] = list
+	}
+	return root
+}
+
+// redactSetting returns the value to log for the setting at key.
+func redactSetting(key string, v interface{}) string {
+	parts := strings.Split(key, ".")
+	for _, part := range parts {
+		if slices.Contains(secretKeys, part) {
+			return kRedacted
+		}
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,200 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elastic/go-ucfg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustSource(t *testing.T, server map[string]interface{}) *ucfg.Config {
+	t.Helper()
+	c, err := ucfg.NewFrom(map[string]interface{}{
+		"inputs": []interface{}{map[string]interface{}{"server": server}},
+	}, DefaultOptions...)
+	require.NoError(t, err)
+	return c
+}
+
+func TestMergeSources(t *testing.T) {
+	file := map[string]interface{}{
+		"host": []interface{}{"10.0.0.1", "10.0.0.2"},
+		"limits": map[string]interface{}{
+			"max_connections": 100,
+			"checkin_limit":   map[string]interface{}{"interval": "5ms", "burst": 10},
+		},
+	}
+	policy := map[string]interface{}{
+		"host": []interface{}{"0.0.0.0"},
+		"limits": map[string]interface{}{
+			"max_connections": 10,
+			"checkin_limit":   map[string]interface{}{"burst": 20},
+		},
+	}
+
+	testcases := map[string]struct {
+		file       map[string]interface{}
+		env        map[string]interface{}
+		policy     map[string]interface{}
+		precedence string
+		hosts      BindHosts
+		maxConns   int
+		burst      int
+		interval   time.Duration
+		err        string
+	}{
+		"policy wins by default": {
+			file:       file,
+			policy:     policy,
+			precedence: PrecedencePolicy,
+			hosts:      BindHosts{"0.0.0.0"},
+			maxConns:   10,
+			burst:      20,
+			interval:   5 * time.Millisecond,
+		},
+		"env wins over file": {
+			file:       file,
+			env:        map[string]interface{}{"limits": map[string]interface{}{"max_connections": 50}},
+			precedence: PrecedencePolicy,
+			hosts:      BindHosts{"10.0.0.1", "10.0.0.2"},
+			maxConns:   50,
+			burst:      10,
+			interval:   5 * time.Millisecond,
+		},
+		"local precedence": {
+			file:       merge(file, map[string]interface{}{"config_precedence": PrecedenceLocal}),
+			env:        map[string]interface{}{"limits": map[string]interface{}{"max_connections": 50}},
+			policy:     policy,
+			precedence: PrecedenceLocal,
+			hosts:      BindHosts{"10.0.0.1", "10.0.0.2"},
+			maxConns:   100,
+			burst:      10,
+			interval:   5 * time.Millisecond,
+		},
+		"local precedence from env": {
+			file:       map[string]interface{}{"limits": map[string]interface{}{"checkin_limit": map[string]interface{}{"burst": 10}}},
+			env:        map[string]interface{}{"config_precedence": PrecedenceLocal, "limits": map[string]interface{}{"max_connections": 50}},
+			policy:     policy,
+			precedence: PrecedenceLocal,
+			hosts:      BindHosts{"0.0.0.0"},
+			maxConns:   50,
+			burst:      10,
+		},
+		"policy can not change the precedence": {
+			file:       file,
+			policy:     merge(policy, map[string]interface{}{"config_precedence": PrecedenceLocal}),
+			precedence: PrecedencePolicy,
+			hosts:      BindHosts{"0.0.0.0"},
+			maxConns:   10,
+			burst:      20,
+			interval:   5 * time.Millisecond,
+		},
+		"unknown precedence": {
+			file: map[string]interface{}{"config_precedence": "env"},
+			err:  "unknown config_precedence",
+		},
+	}
+
+	for name, test := range testcases {
+		t.Run(name, func(t *testing.T) {
+			var s Sources
+			if test.file != nil {
+				s.File = mustSource(t, test.file)
+			}
+			if test.env != nil {
+				s.Env = mustSource(t, test.env)
+			}
+			if test.policy != nil {
+				s.Policy = mustSource(t, test.policy)
+			}
+			merged, err := MergeSources(s)
+			if test.err != "" {
+				assert.ErrorContains(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.precedence, merged.Precedence())
+
+			cfg, err := merged.Config()
+			require.NoError(t, err)
+			require.Len(t, cfg.Inputs, 1)
+			server := cfg.Inputs[0].Server
+			assert.Equal(t, test.hosts, server.Host)
+			assert.Equal(t, test.maxConns, server.Limits.MaxConnections)
+			assert.Equal(t, test.burst, server.Limits.CheckinLimit.Burst)
+			// The nested settings that are only set by the file are kept.
+			assert.Equal(t, test.interval, server.Limits.CheckinLimit.Interval)
+		})
+	}
+}
+
+func merge(a, b map[string]interface{}) map[string]interface{} {
+	m := make(map[string]interface{}, len(a)+len(b))
+	for k, v := range a {
+		m[k] = v
+	}
+	for k, v := range b {
+		m[k] = v
+	}
+	return m
+}
+
+func TestEnvSource(t *testing.T) {
+	c, err := EnvSource([]string{
+		"PATH=/usr/bin",
+		"FLEET_SERVER_CONFIG_INPUTS__0__SERVER__LIMITS__MAX_CONNECTIONS=1000",
+		"FLEET_SERVER_CONFIG_INPUTS__0__SERVER__HOST=[127.0.0.1, ::1]",
+		"FLEET_SERVER_CONFIG_LOGGING__LEVEL=debug",
+	})
+	require.NoError(t, err)
+
+	merged, err := MergeSources(Sources{Env: c})
+	require.NoError(t, err)
+	assert.Equal(t, SourceEnv, merged.Origin("inputs.0.server.limits.max_connections"))
+	assert.Empty(t, merged.Origin("path"))
+
+	cfg, err := merged.Config()
+	require.NoError(t, err)
+	assert.Equal(t, 1000, cfg.Inputs[0].Server.Limits.MaxConnections)
+	assert.Equal(t, BindHosts{"127.0.0.1", "::1"}, cfg.Inputs[0].Server.Host)
+	assert.Equal(t, "debug", cfg.Logging.Level)
+}
+
+func TestMergedDiff(t *testing.T) {
+	output := func(token string) *ucfg.Config {
+		c, err := ucfg.NewFrom(map[string]interface{}{
+			"output": map[string]interface{}{"elasticsearch": map[string]interface{}{"service_token": token}},
+		}, DefaultOptions...)
+		require.NoError(t, err)
+		return c
+	}
+
+	prev, err := MergeSources(Sources{
+		File:   mustSource(t, map[string]interface{}{"limits": map[string]interface{}{"max_connections": 100}, "port": 8220}),
+		Policy: output("old-token"),
+	})
+	require.NoError(t, err)
+	next, err := MergeSources(Sources{
+		File:   mustSource(t, map[string]interface{}{"limits": map[string]interface{}{"max_connections": 100}, "compression_level": 1}),
+		Policy: mustSource(t, map[string]interface{}{"limits": map[string]interface{}{"max_connections": 10}}),
+		Env:    output("new-token"),
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []Change{
+		{Key: "inputs.0.server.compression_level", Source: SourceFile, New: "1"},
+		{Key: "inputs.0.server.limits.max_connections", Source: SourcePolicy, Overridden: []string{SourceFile}, Old: "100", New: "10"},
+		{Key: "inputs.0.server.port", Old: "8220"},
+		{Key: "output.elasticsearch.service_token", Source: SourceEnv, Old: kRedacted, New: kRedacted},
+	}, next.Diff(prev))
+	assert.Empty(t, next.Diff(next))
+	assert.Len(t, prev.Diff(nil), 3)
+}
@@ -0,0 +1,202 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	urlutil "github.com/elastic/elastic-agent-libs/kibana"
+)
+
+// proxyDefaultPorts are the ports of the proxy_url schemes supported by the http transport.
+var proxyDefaultPorts = map[string]string{
+	"http":   "80",
+	"https":  "443",
+	"socks5": "1080",
+}
+
+// ProxyError is returned for a request to Elasticsearch that failed at the proxy, either because the
+// proxy is unreachable or because it refused to open the tunnel.
+type ProxyError struct {
+	// Proxy is the proxy URL without its password.
+	Proxy string
+	Err   error
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("proxy %s: %v", e.Proxy, e.Err)
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// parseProxyURL parses proxy_url, a missing scheme defaults to http.
+func parseProxyURL(raw string) (*url.URL, error) {
+	proxyURL, err := urlutil.ParseURL(raw)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := proxyDefaultPorts[proxyURL.Scheme]; !ok {
+		return nil, fmt.Errorf("proxy_url scheme %q is not supported, use http, https or socks5", proxyURL.Scheme)
+	}
+	return proxyURL, nil
+}
+
+// proxyAddr returns the host:port the transport dials to reach the proxy.
+func proxyAddr(proxyURL *url.URL) string {
+	port := proxyURL.Port()
+	if port == "" {
+		port = proxyDefaultPorts[proxyURL.Scheme]
+	}
+	return net.JoinHostPort(proxyURL.Hostname(), port)
+}
+
+// setProxy configures the transport to use the proxy of the configuration, the hosts of no_proxy are
+// reached directly. The failures to reach the proxy or to open a tunnel through it are returned as a ProxyError.
+func (c *Elasticsearch) setProxy(t *http.Transport) error {
+	noProxy, err := parseNoProxy(c.NoProxy)
+	if err != nil {
+		return err
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if c.ProxyURL != "" {
+		proxyURL, err := parseProxyURL(c.ProxyURL)
+		if err != nil {
+			return err
+		}
+		proxy = http.ProxyURL(proxyURL)
+
+		addr := proxyAddr(proxyURL)
+		redacted := proxyURL.Redacted()
+		dial := t.DialContext
+		t.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := dial(ctx, network, address)
+			if err != nil && address == addr {
+				return nil, &ProxyError{Proxy: redacted, Err: err}
+			}
+			return conn, err
+		}
+	}
+	if len(noProxy) > 0 {
+		t.Proxy = func(r *http.Request) (*url.URL, error) {
+			if noProxy.match(r.URL) {
+				return nil, nil
+			}
+			return proxy(r)
+		}
+	} else {
+		t.Proxy = proxy
+	}
+
+	t.OnProxyConnectResponse = func(_ context.Context, proxyURL *url.URL, connectReq *http.Request, connectRes *http.Response) error {
+		if connectRes.StatusCode != http.StatusOK {
+			return &ProxyError{Proxy: proxyURL.Redacted(), Err: fmt.Errorf("CONNECT %s: %s", connectReq.Host, connectRes.Status)}
+		}
+		return nil
+	}
+
+	if len(c.ProxyHeaders) > 0 {
+		proxyHeaders := make(http.Header, len(c.ProxyHeaders))
+		for k, v := range c.ProxyHeaders {
+			proxyHeaders.Add(k, v)
+		}
+		t.ProxyConnectHeader = proxyHeaders
+	}
+	return nil
+}
+
+// noProxyEntry is a single no_proxy entry, an empty port matches any port.
+type noProxyEntry struct {
+	// any matches every host, set for "*".
+	any bool
+	// network matches the IP addresses of a CIDR block.
+	network *net.IPNet
+	// host is an IP address or a domain name, a domain also matches its subdomains.
+	host string
+	// subdomainsOnly is set for the entries with a leading "." or "*.", they don't match the domain itself.
+	subdomainsOnly bool
+	port           string
+}
+
+// noProxyList is the list of hosts reached without the proxy, in the format of the NO_PROXY environment variable.
+type noProxyList []noProxyEntry
+
+func parseNoProxy(entries []string) (noProxyList, error) {
+	list := make(noProxyList, 0, len(entries))
+	for _, raw := range entries {
+		entry := strings.ToLower(strings.TrimSpace(raw))
+		if entry == "" {
+			return nil, fmt.Errorf("no_proxy entry %q is empty", raw)
+		}
+		if entry == "*" {
+			list = append(list, noProxyEntry{any: true})
+			continue
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			list = append(list, noProxyEntry{network: network})
+			continue
+		}
+
+		var e noProxyEntry
+		if host, port, err := net.SplitHostPort(entry); err == nil {
+			if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+				return nil, fmt.Errorf("no_proxy entry %q has an invalid port", raw)
+			}
+			entry, e.port = host, port
+		}
+		switch {
+		case strings.HasPrefix(entry, "*."):
+			entry, e.subdomainsOnly = entry[2:], true
+		case strings.HasPrefix(entry, "."):
+			entry, e.subdomainsOnly = entry[1:], true
+		}
+		if entry == "" {
+			return nil, fmt.Errorf("no_proxy entry %q has no host", raw)
+		}
+		e.host = entry
+		list = append(list, e)
+	}
+	return list, nil
+}
+
+// match returns true if the host of u must be reached without the proxy.
+func (l noProxyList) match(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" {
+		port = proxyDefaultPorts[u.Scheme]
+	}
+	ip := net.ParseIP(host)
+
+	for _, e := range l {
+		switch {
+		case e.any:
+			return true
+		case e.network != nil:
+			if ip != nil && e.network.Contains(ip) {
+				return true
+			}
+		case e.port != "" && e.port != port:
+			// the host may match but the port doesn't
+		case ip != nil:
+			if entryIP := net.ParseIP(e.host); entryIP != nil && entryIP.Equal(ip) {
+				return true
+			}
+		case strings.HasSuffix(host, "."+e.host):
+			return true
+		case host == e.host && !e.subdomainsOnly:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,269 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/elastic-agent-libs/transport/tlscommon"
+)
+
+// testProxy is an HTTP proxy that only supports CONNECT tunnels.
+type testProxy struct {
+	// status is the response to the CONNECT requests, the tunnel is opened if it's 0.
+	status int
+
+	mu       sync.Mutex
+	connects []string
+	header   http.Header
+}
+
+func (p *testProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	p.mu.Lock()
+	p.connects = append(p.connects, r.Host)
+	p.header = r.Header.Clone()
+	p.mu.Unlock()
+
+	if p.status != 0 {
+		w.WriteHeader(p.status)
+		return
+	}
+	dst, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	conn, brw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		dst.Close()
+		return
+	}
+	_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	go func() {
+		_, _ = io.Copy(dst, brw)
+		dst.Close()
+	}()
+	_, _ = io.Copy(conn, dst)
+	conn.Close()
+}
+
+func (p *testProxy) requests() ([]string, http.Header) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.connects, p.header
+}
+
+func TestESProxyTunnel(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		fmt.Fprint(w, `{}`)
+	}))
+	t.Cleanup(target.Close)
+	targetHost := target.Listener.Addr().String()
+
+	roundTrip := func(t *testing.T, cfg Elasticsearch) error {
+		t.Helper()
+		cfg.Protocol = "https"
+		cfg.Hosts = []string{targetHost}
+		cfg.Timeout = 10 * time.Second
+		cfg.TLS = &tlscommon.Config{VerificationMode: tlscommon.VerifyNone}
+
+		res, err := cfg.ToESConfig(false)
+		require.NoError(t, err)
+		transport := res.Transport.(*http.Transport) //nolint:errcheck // test case
+		t.Cleanup(transport.CloseIdleConnections)
+
+		req, err := http.NewRequest(http.MethodGet, res.Addresses[0], nil) //nolint:noctx // test case
+		require.NoError(t, err)
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		return nil
+	}
+
+	t.Run("TLS endpoint is reached with CONNECT", func(t *testing.T) {
+		p := &testProxy{}
+		proxy := httptest.NewServer(p)
+		t.Cleanup(proxy.Close)
+
+		err := roundTrip(t, Elasticsearch{
+			ProxyURL:     proxy.URL,
+			ProxyHeaders: map[string]string{"X-Proxy-Auth": "secret"},
+		})
+		require.NoError(t, err)
+
+		connects, header := p.requests()
+		assert.Equal(t, []string{targetHost}, connects)
+		assert.Equal(t, "secret", header.Get("X-Proxy-Auth"))
+	})
+
+	t.Run("no_proxy host is reached directly", func(t *testing.T) {
+		p := &testProxy{}
+		proxy := httptest.NewServer(p)
+		t.Cleanup(proxy.Close)
+
+		err := roundTrip(t, Elasticsearch{
+			ProxyURL: proxy.URL,
+			NoProxy:  []string{"127.0.0.0/8"},
+		})
+		require.NoError(t, err)
+
+		connects, _ := p.requests()
+		assert.Empty(t, connects)
+	})
+
+	t.Run("CONNECT refused by the proxy", func(t *testing.T) {
+		p := &testProxy{status: http.StatusProxyAuthRequired}
+		proxy := httptest.NewServer(p)
+		t.Cleanup(proxy.Close)
+
+		err := roundTrip(t, Elasticsearch{ProxyURL: proxy.URL})
+		var proxyErr *ProxyError
+		require.ErrorAs(t, err, &proxyErr)
+		assert.Equal(t, proxy.URL, proxyErr.Proxy)
+		assert.ErrorContains(t, err, "CONNECT "+targetHost+": 407 Proxy Authentication Required")
+	})
+
+	t.Run("proxy unreachable", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		proxyURL := "http://user:pass@" + ln.Addr().String()
+		ln.Close()
+
+		err = roundTrip(t, Elasticsearch{ProxyURL: proxyURL})
+		var proxyErr *ProxyError
+		require.ErrorAs(t, err, &proxyErr)
+		assert.Equal(t, "http://user:xxxxx@"+ln.Addr().String(), proxyErr.Proxy)
+	})
+}
+
+func TestESProxyURLValidate(t *testing.T) {
+	testcases := map[string]struct {
+		cfg  Elasticsearch
+		want string
+		err  string
+	}{
+		"socks5": {
+			cfg:  Elasticsearch{ProxyURL: "socks5://proxy.com:1080"},
+			want: "socks5://proxy.com:1080",
+		},
+		"default scheme": {
+			cfg:  Elasticsearch{ProxyURL: "proxy.com:3128"},
+			want: "http://proxy.com:3128",
+		},
+		"unsupported scheme": {
+			cfg: Elasticsearch{ProxyURL: "ftp://proxy.com"},
+			err: `proxy_url scheme "ftp" is not supported`,
+		},
+		"empty no_proxy entry": {
+			cfg: Elasticsearch{NoProxy: []string{"example.com", " "}},
+			err: "is empty",
+		},
+		"invalid no_proxy port": {
+			cfg: Elasticsearch{NoProxy: []string{"example.com:http"}},
+			err: "has an invalid port",
+		},
+		"ignored when disabled": {
+			cfg: Elasticsearch{ProxyDisable: true, ProxyURL: "ftp://proxy.com", NoProxy: []string{""}},
+		},
+	}
+
+	for name, test := range testcases {
+		t.Run(name, func(t *testing.T) {
+			err := test.cfg.Validate()
+			if test.err != "" {
+				require.ErrorContains(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			if test.want == "" {
+				return
+			}
+
+			res, err := test.cfg.ToESConfig(false)
+			require.NoError(t, err)
+			transport := res.Transport.(*http.Transport) //nolint:errcheck // test case
+
+			req, err := http.NewRequest(http.MethodGet, "https://es.example.com:9200", nil) //nolint:noctx // test case
+			require.NoError(t, err)
+			got, err := transport.Proxy(req)
+			require.NoError(t, err)
+			assert.Equal(t, test.want, got.String())
+		})
+	}
+}
+
+func TestNoProxyMatch(t *testing.T) {
+	list, err := parseNoProxy([]string{
+		"internal.example.com",
+		".corp.example.com",
+		"*.dev.example.com",
+		"es.example.com:9243",
+		"10.0.0.0/8",
+		"192.168.1.10",
+		"[::1]:9200",
+	})
+	require.NoError(t, err)
+
+	testcases := map[string]bool{
+		"https://internal.example.com:9200":      true,
+		"https://es.internal.example.com:9200":   true,
+		"https://INTERNAL.example.com":           true,
+		"https://notinternal.example.com:9200":   false,
+		"https://corp.example.com:9200":          false,
+		"https://es.corp.example.com:9200":       true,
+		"https://dev.example.com:9200":           false,
+		"https://es.dev.example.com:9200":        true,
+		"https://es.example.com:9243":            true,
+		"https://es.example.com:9200":            false,
+		"https://10.1.2.3:9200":                  true,
+		"https://11.1.2.3:9200":                  false,
+		"https://192.168.1.10:9200":              true,
+		"https://192.168.1.11:9200":              false,
+		"http://[::1]:9200":                      true,
+		"http://[::1]:9300":                      false,
+		"https://elasticsearch.example.org:9200": false,
+	}
+	for rawURL, want := range testcases {
+		t.Run(rawURL, func(t *testing.T) {
+			u, err := url.Parse(rawURL)
+			require.NoError(t, err)
+			assert.Equal(t, want, list.match(u))
+		})
+	}
+
+	t.Run("wildcard", func(t *testing.T) {
+		list, err := parseNoProxy([]string{"*"})
+		require.NoError(t, err)
+		assert.True(t, list.match(&url.URL{Scheme: "https", Host: "anything.example.com"}))
+	})
+}
+
+func TestProxyErrorUnwrap(t *testing.T) {
+	err := fmt.Errorf("request failed: %w", &ProxyError{Proxy: "http://proxy.com", Err: io.ErrUnexpectedEOF})
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+	assert.EqualError(t, err, "request failed: proxy http://proxy.com: unexpected EOF")
+}
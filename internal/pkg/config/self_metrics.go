@@ -0,0 +1,32 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package config
+
+import (
+	"errors"
+	"time"
+)
+
+const defaultSelfMetricsInterval = time.Minute
+
+// SelfMetrics is the configuration of the documents with a snapshot of the internal metrics of fleet-server,
+// written to the metrics-fleet_server.usage-default data stream for historical analysis.
+type SelfMetrics struct {
+	Enabled  bool          `config:"enabled"`
+	Interval time.Duration `config:"interval"`
+}
+
+// InitDefaults initializes the defaults for the configuration.
+func (c *SelfMetrics) InitDefaults() {
+	c.Interval = defaultSelfMetricsInterval
+}
+
+// Validate ensures that the configuration is valid.
+func (c *SelfMetrics) Validate() error {
+	if c.Enabled && c.Interval <= 0 {
+		return errors.New("interval must be positive when the self metrics are enabled")
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Signing configures the verification of the signatures Fleet attaches to the policies and the actions.
+type Signing struct {
+	// Verify refuses to dispatch the policies and the actions without a valid signature.
+	Verify bool `config:"verify"`
+	// PublicKey is the ECDSA public key of Fleet, PEM encoded or base64 encoded PKIX DER like the signing_key of the
+	// agent policies.
+	PublicKey string `config:"public_key"`
+}
+
+// Validate ensures that the configuration is valid.
+func (c *Signing) Validate() error {
+	if !c.Verify {
+		return nil
+	}
+	if c.PublicKey == "" {
+		return errors.New("public_key is required when the signature verification is enabled")
+	}
+	if _, err := c.ECDSAPublicKey(); err != nil {
+		return fmt.Errorf("invalid public_key: %w", err)
+	}
+	return nil
+}
+
+// ECDSAPublicKey parses the public key.
+func (c *Signing) ECDSAPublicKey() (*ecdsa.PublicKey, error) {
+	der := []byte(strings.TrimSpace(c.PublicKey))
+	if block, _ := pem.Decode(der); block != nil {
+		der = block.Bytes
+	} else {
+		b, err := base64.StdEncoding.DecodeString(string(der))
+		if err != nil {
+			return nil, fmt.Errorf("not PEM or base64 encoded: %w", err)
+		}
+		der = b
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported public key type %T, an ECDSA key is required", key)
+	}
+	return ecKey, nil
+}
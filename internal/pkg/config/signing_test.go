@@ -0,0 +1,80 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+
+	"github.com/elastic/go-ucfg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSigningKey = "MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEdVNHj79XPe3l+uBYBzzpnaOfhjlKt197we8bkDo2pmmObM3iPY9Z57P0ha1qAxaknOg+rcrAG8Z+33v0/nSu6g=="
+
+func TestSigning(t *testing.T) {
+	der, err := base64.StdEncoding.DecodeString(testSigningKey)
+	require.NoError(t, err)
+	edKey, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	edDER, err := x509.MarshalPKIXPublicKey(edKey)
+	require.NoError(t, err)
+
+	testcases := map[string]struct {
+		cfg map[string]interface{}
+		err string
+	}{
+		"disabled": {
+			cfg: map[string]interface{}{},
+		},
+		"disabled with invalid key": {
+			cfg: map[string]interface{}{"public_key": "invalid"},
+		},
+		"base64 DER key": {
+			cfg: map[string]interface{}{"verify": true, "public_key": testSigningKey},
+		},
+		"PEM key": {
+			cfg: map[string]interface{}{"verify": true, "public_key": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))},
+		},
+		"missing key": {
+			cfg: map[string]interface{}{"verify": true},
+			err: "public_key is required",
+		},
+		"invalid key": {
+			cfg: map[string]interface{}{"verify": true, "public_key": "invalid"},
+			err: "invalid public_key",
+		},
+		"not an ECDSA key": {
+			cfg: map[string]interface{}{"verify": true, "public_key": base64.StdEncoding.EncodeToString(edDER)},
+			err: "an ECDSA key is required",
+		},
+	}
+
+	for name, test := range testcases {
+		t.Run(name, func(t *testing.T) {
+			c, err := ucfg.NewFrom(test.cfg, DefaultOptions...)
+			require.NoError(t, err)
+
+			var cfg Signing
+			err = c.Unpack(&cfg, DefaultOptions...)
+			if test.err != "" {
+				assert.ErrorContains(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			if cfg.Verify {
+				key, err := cfg.ECDSAPublicKey()
+				require.NoError(t, err)
+				assert.NotNil(t, key)
+			}
+		})
+	}
+}
@@ -19,8 +19,19 @@ type ServerTimeouts struct {
 	CheckinJitter    time.Duration `config:"checkin_jitter"`
 	CheckinMaxPoll   time.Duration `config:"checkin_max_poll"`
 	Drain            time.Duration `config:"drain"`
+	DrainGrace       time.Duration `config:"drain_grace"`
+
+	// Request timeouts of the endpoints, a request that exceeds the timeout of its endpoint gets a 503. 0 disables it.
+	Enroll      time.Duration `config:"enroll"`
+	Ack         time.Duration `config:"ack"`
+	Artifact    time.Duration `config:"artifact"`
+	UploadChunk time.Duration `config:"upload_chunk"`
 }
 
+// timeoutHeadroom is added to the longest endpoint timeout for the write timeout of the HTTP server,
+// so that a request that exceeds the timeout of its endpoint gets its error response before the connection expires.
+const timeoutHeadroom = 30 * time.Second
+
 // InitDefaults initializes the defaults for the configuration.
 func (c *ServerTimeouts) InitDefaults() {
 	// see https://blog.gopheracademy.com/advent-2016/exposing-go-on-the-internet/
@@ -70,4 +81,22 @@ func (c *ServerTimeouts) InitDefaults() {
 	// It is used as a context timeout value for server.ShutDown(ctx).
 	// A long-poll checkin connection should immediately return with a 200 status and the same ackToken it was sent, the same as if the long-poll completed with no changes detected.
 	c.Drain = 10 * time.Second
+
+	// DrainGrace is how long the server keeps serving after a shutdown signal before it closes its listeners, so that
+	// the load balancers polling the status endpoint see the draining status and stop sending requests.
+	c.DrainGrace = 5 * time.Second
+
+	// The endpoint timeouts bound the requests that do not long poll, so that a request stuck on a slow backend
+	// does not hold its connection until the write timeout.
+	c.Enroll = time.Minute
+	c.Ack = time.Minute
+	c.Artifact = 2 * time.Minute
+	c.UploadChunk = 2 * time.Minute
+}
+
+// WriteTimeout returns the write timeout of the HTTP server. It is raised to the longest endpoint timeout or checkin
+// long poll plus some headroom when write is lower, so that the requests expire with the timeout of their endpoint.
+func (c *ServerTimeouts) WriteTimeout() time.Duration {
+	longest := max(c.CheckinLongPoll, c.Enroll, c.Ack, c.Artifact, c.UploadChunk)
+	return max(c.Write, longest+timeoutHeadroom)
 }
@@ -0,0 +1,27 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerTimeoutsWriteTimeout(t *testing.T) {
+	var c ServerTimeouts
+	c.InitDefaults()
+	assert.Equal(t, 10*time.Minute, c.WriteTimeout(), "expected the configured write timeout when it covers the endpoint timeouts")
+
+	c.Write = 5 * time.Second
+	assert.Equal(t, 5*time.Minute+timeoutHeadroom, c.WriteTimeout(), "expected the checkin long poll plus headroom")
+
+	c.CheckinLongPoll = 30 * time.Second
+	c.UploadChunk = 10 * time.Minute
+	assert.Equal(t, 10*time.Minute+timeoutHeadroom, c.WriteTimeout(), "expected the longest endpoint timeout plus headroom")
+}
@@ -11,16 +11,68 @@ import (
 	"time"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dsl"
 	"github.com/elastic/fleet-server/v7/internal/pkg/es"
 	"github.com/elastic/fleet-server/v7/internal/pkg/model"
 	"github.com/rs/zerolog"
 )
 
+var (
+	QueryAgentActionResults  = prepareFindAgentActionResults()
+	QueryActionResultsAgents = prepareFindActionResultsAgents()
+	QueryActionResult        = prepareFindActionResult()
+)
+
+func prepareFindAgentActionResults() *dsl.Tmpl {
+	tmpl := dsl.NewTmpl()
+	root := dsl.NewRoot()
+	filter := root.Query().Bool().Filter()
+	filter.Term(FieldAgentID, tmpl.Bind(FieldAgentID), nil)
+	filter.Terms(FieldActionID, tmpl.Bind(FieldActionID), nil)
+	root.Size(maxAgentActionsFetchSize)
+	root.Source().Includes(FieldActionID)
+	tmpl.MustResolve(root)
+	return tmpl
+}
+
+func prepareFindActionResultsAgents() *dsl.Tmpl {
+	tmpl := dsl.NewTmpl()
+	root := dsl.NewRoot()
+	filter := root.Query().Bool().Filter()
+	filter.Term(FieldActionID, tmpl.Bind(FieldActionID), nil)
+	filter.Terms(FieldAgentID, tmpl.Bind(FieldAgentID), nil)
+	root.Size(maxAgentActionsFetchSize)
+	root.Source().Includes(FieldAgentID)
+	tmpl.MustResolve(root)
+	return tmpl
+}
+
+func prepareFindActionResult() *dsl.Tmpl {
+	tmpl := dsl.NewTmpl()
+	root := dsl.NewRoot()
+	filter := root.Query().Bool().Filter()
+	filter.Term(FieldActionID, tmpl.Bind(FieldActionID), nil)
+	filter.Term(FieldAgentID, tmpl.Bind(FieldAgentID), nil)
+	root.Size(1)
+	tmpl.MustResolve(root)
+	return tmpl
+}
+
+// CreateActionResult creates the result document of the action for the agent.
+//
+// The document ID is derived from the action and agent IDs, so an ack that is retried does not create a second result.
 func CreateActionResult(ctx context.Context, bulker bulk.Bulk, acr model.ActionResult) error {
-	return createActionResult(ctx, bulker, FleetActionsResults, acr)
+	return createActionResult(ctx, bulker, FleetActionsResults, acr, false)
 }
 
-func createActionResult(ctx context.Context, bulker bulk.Bulk, index string, acr model.ActionResult) error {
+// UpsertActionResult creates the result document like CreateActionResult, but if the result already exists and the
+// new one has an error, the error and timestamp of the existing document are updated.
+// It's used for the upgrade acks, as an upgrade that fails after it was acked reports the error with a later ack.
+func UpsertActionResult(ctx context.Context, bulker bulk.Bulk, acr model.ActionResult) error {
+	return createActionResult(ctx, bulker, FleetActionsResults, acr, true)
+}
+
+func createActionResult(ctx context.Context, bulker bulk.Bulk, index string, acr model.ActionResult, upsert bool) error {
 	if acr.Timestamp == "" {
 		acr.Timestamp = time.Now().UTC().Format(time.RFC3339)
 	}
@@ -29,12 +81,132 @@ func createActionResult(ctx context.Context, bulker bulk.Bulk, index string, acr
 		return err
 	}
 
-	id := acr.ActionID + ":" + acr.AgentID
+	id := ActionResultID(acr.ActionID, acr.AgentID)
 	_, err = bulker.Create(ctx, index, id, body, bulk.WithRefresh())
-	// ignoring version conflict in case the same action result is tried to be created multiple times (unique id with actionID and agentID)
-	if errors.Is(err, es.ErrElasticVersionConflict) {
+	if !errors.Is(err, es.ErrElasticVersionConflict) {
+		return err
+	}
+	if !upsert || acr.Error == "" {
+		// ignoring version conflict in case the same action result is tried to be created multiple times (unique id with actionID and agentID)
 		zerolog.Ctx(ctx).Debug().Err(err).Str("id", id).Msg("action result already exists, ignoring")
 		return nil
 	}
-	return err
+
+	body, err = bulk.UpdateFields{
+		FieldError:     acr.Error,
+		FieldTimestamp: acr.Timestamp,
+	}.Marshal()
+	if err != nil {
+		return err
+	}
+	zerolog.Ctx(ctx).Debug().Str("id", id).Msg("action result already exists, updating its error")
+	return bulker.Update(ctx, index, id, body, bulk.WithRefresh(), bulk.WithRetryOnConflict(3))
+}
+
+// ActionResultID returns the ID of the result document of the action for the agent.
+func ActionResultID(actionID, agentID string) string {
+	return actionID + ":" + agentID
+}
+
+// FindAckedActionIDs returns the subset of actionIDs that have a result document for the agent.
+//
+// The action IDs are looked up in batches of maxAgentActionsFetchSize, so a single query never returns more results than it asked for.
+func FindAckedActionIDs(ctx context.Context, bulker bulk.Bulk, agentID string, actionIDs []string) (map[string]struct{}, error) {
+	return findAckedActionIDs(ctx, bulker, FleetActionsResults, agentID, actionIDs)
+}
+
+func findAckedActionIDs(ctx context.Context, bulker bulk.Bulk, index, agentID string, actionIDs []string) (map[string]struct{}, error) {
+	acked := make(map[string]struct{})
+	for len(actionIDs) > 0 {
+		batch := actionIDs[:min(len(actionIDs), maxAgentActionsFetchSize)]
+		actionIDs = actionIDs[len(batch):]
+
+		res, err := Search(ctx, bulker, QueryAgentActionResults, index, map[string]interface{}{
+			FieldAgentID:  agentID,
+			FieldActionID: batch,
+		})
+		if err != nil {
+			if errors.Is(err, es.ErrIndexNotFound) {
+				zerolog.Ctx(ctx).Debug().Str("index", index).Msg(es.ErrIndexNotFound.Error())
+				return acked, nil
+			}
+			return nil, err
+		}
+
+		for _, hit := range res.Hits {
+			var acr model.ActionResult
+			if err := hit.Unmarshal(&acr); err != nil {
+				return nil, err
+			}
+			acked[acr.ActionID] = struct{}{}
+		}
+	}
+	return acked, nil
+}
+
+// FindActionResultAgentIDs returns the subset of agentIDs that have a result document for the action.
+//
+// The agent IDs are looked up in batches of maxAgentActionsFetchSize, like FindAckedActionIDs.
+func FindActionResultAgentIDs(ctx context.Context, bulker bulk.Bulk, actionID string, agentIDs []string) (map[string]struct{}, error) {
+	return findActionResultAgentIDs(ctx, bulker, FleetActionsResults, actionID, agentIDs)
+}
+
+func findActionResultAgentIDs(ctx context.Context, bulker bulk.Bulk, index, actionID string, agentIDs []string) (map[string]struct{}, error) {
+	found := make(map[string]struct{})
+	for len(agentIDs) > 0 {
+		batch := agentIDs[:min(len(agentIDs), maxAgentActionsFetchSize)]
+		agentIDs = agentIDs[len(batch):]
+
+		res, err := Search(ctx, bulker, QueryActionResultsAgents, index, map[string]interface{}{
+			FieldActionID: actionID,
+			FieldAgentID:  batch,
+		})
+		if err != nil {
+			if errors.Is(err, es.ErrIndexNotFound) {
+				zerolog.Ctx(ctx).Debug().Str("index", index).Msg(es.ErrIndexNotFound.Error())
+				return found, nil
+			}
+			return nil, err
+		}
+
+		for _, hit := range res.Hits {
+			var acr model.ActionResult
+			if err := hit.Unmarshal(&acr); err != nil {
+				return nil, err
+			}
+			found[acr.AgentID] = struct{}{}
+		}
+	}
+	return found, nil
+}
+
+// FindActionResult returns the result document of the action for the agent, or ErrNotFound if the agent has not
+// acked the action.
+//
+// The result is searched by its fields rather than its ID, as the results written by older versions have random IDs.
+func FindActionResult(ctx context.Context, bulker bulk.Bulk, actionID, agentID string) (*model.ActionResult, error) {
+	return findActionResult(ctx, bulker, FleetActionsResults, actionID, agentID)
+}
+
+func findActionResult(ctx context.Context, bulker bulk.Bulk, index, actionID, agentID string) (*model.ActionResult, error) {
+	res, err := Search(ctx, bulker, QueryActionResult, index, map[string]interface{}{
+		FieldActionID: actionID,
+		FieldAgentID:  agentID,
+	})
+	if err != nil {
+		if errors.Is(err, es.ErrIndexNotFound) {
+			zerolog.Ctx(ctx).Debug().Str("index", index).Msg(es.ErrIndexNotFound.Error())
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if len(res.Hits) == 0 {
+		return nil, ErrNotFound
+	}
+
+	var acr model.ActionResult
+	if err := res.Hits[0].Unmarshal(&acr); err != nil {
+		return nil, err
+	}
+	return &acr, nil
 }
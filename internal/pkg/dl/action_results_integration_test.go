@@ -9,6 +9,7 @@ package dl
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"testing"
 	"time"
 
@@ -70,7 +71,7 @@ func storeRandomActionResults(ctx context.Context, bulker bulk.Bulk, index strin
 	}
 
 	for _, result := range results {
-		err = createActionResult(ctx, bulker, index, result)
+		err = createActionResult(ctx, bulker, index, result, false)
 		if err != nil {
 			return nil, err
 		}
@@ -137,3 +138,84 @@ func TestActionsResultsStored(t *testing.T) {
 		}
 	}
 }
+
+func TestActionResultCreatedOnce(t *testing.T) {
+	ctx, cn := context.WithCancel(context.Background())
+	defer cn()
+	ctx = testlog.SetLogger(t).WithContext(ctx)
+
+	index, bulker := ftesting.SetupCleanIndex(ctx, t, FleetActionsResults)
+	acr := model.ActionResult{
+		ActionID: uuid.Must(uuid.NewV4()).String(),
+		AgentID:  uuid.Must(uuid.NewV4()).String(),
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := createActionResult(ctx, bulker, index, acr, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := bulker.Search(ctx, index, []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Hits) != 1 {
+		t.Fatalf("expected 1 action result, got %d", len(res.Hits))
+	}
+
+	acr.Error = "upgrade failed"
+	if err := createActionResult(ctx, bulker, index, acr, true); err != nil {
+		t.Fatal(err)
+	}
+	res, err = bulker.Search(ctx, index, []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Hits) != 1 {
+		t.Fatalf("expected 1 action result, got %d", len(res.Hits))
+	}
+	var stored model.ActionResult
+	if err := res.Hits[0].Unmarshal(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Error != acr.Error {
+		t.Fatalf("expected the error to be updated, got %q", stored.Error)
+	}
+}
+
+func TestFindActionResult(t *testing.T) {
+	ctx, cn := context.WithCancel(context.Background())
+	defer cn()
+	ctx = testlog.SetLogger(t).WithContext(ctx)
+
+	index, bulker := ftesting.SetupCleanIndex(ctx, t, FleetActionsResults)
+	acr := model.ActionResult{
+		ActionID:       uuid.Must(uuid.NewV4()).String(),
+		AgentID:        uuid.Must(uuid.NewV4()).String(),
+		ActionResponse: json.RawMessage(`{"output":{"lines":["a","b"]},"code":0}`),
+		Timestamp:      time.Now().UTC().Format(time.RFC3339),
+	}
+	if err := createActionResult(ctx, bulker, index, acr, false); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := findActionResult(ctx, bulker, index, acr.ActionID, acr.AgentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want, got interface{}
+	if err := json.Unmarshal(acr.ActionResponse, &want); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(found.ActionResponse, &got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+
+	_, err = findActionResult(ctx, bulker, index, acr.ActionID, uuid.Must(uuid.NewV4()).String())
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
@@ -20,9 +20,13 @@ import (
 )
 
 const (
-	FieldAgents     = "agents"
-	FieldExpiration = "expiration"
-	FieldSize       = "size"
+	FieldAgents          = "agents"
+	FieldExpiration      = "expiration"
+	FieldExpirationAfter = "expiration_after"
+	FieldNamespaces      = "namespaces"
+	FieldSize            = "size"
+
+	fieldExpiredActionsAfter = "expired_actions_after"
 
 	maxAgentActionsFetchSize = 100
 )
@@ -30,11 +34,18 @@ const (
 var (
 	QueryAction          = prepareFindAction()
 	QueryAllAgentActions = prepareFindAllAgentsActions()
-	QueryAgentActions    = prepareFindAgentActions()
+	QueryAgentActions    = prepareFindAgentActions(false)
+
+	// QueryAgentActionsInNamespaces only selects the actions of the agent namespaces and the actions without namespaces.
+	QueryAgentActionsInNamespaces = prepareFindAgentActions(true)
 
 	// Query for expired actions GC
 	QueryDeleteExpiredActions = prepareDeleteExpiredAction()
 	QueryFindExpiredActions   = prepareFindExpiredAction()
+
+	// Query for the expired actions sweep
+	QueryExpiredActionsInRange      = prepareFindExpiredActionsInRange(false)
+	QueryExpiredActionsInRangeAfter = prepareFindExpiredActionsInRange(true)
 )
 
 func prepareFindAllAgentsActions() *dsl.Tmpl {
@@ -74,10 +85,44 @@ func prepareFindExpiredAction() *dsl.Tmpl {
 	return tmpl
 }
 
-func prepareFindAgentActions() *dsl.Tmpl {
+// prepareFindExpiredActionsInRange returns the query of a page of the expired actions sorted by expiration,
+// action_id and _seq_no, the page follows the sort values of a hit when after is true.
+// The _seq_no breaks the ties between the documents of an action that is split in several documents.
+func prepareFindExpiredActionsInRange(after bool) *dsl.Tmpl {
+	tmpl := dsl.NewTmpl()
+	root := dsl.NewRoot()
+	filter := root.Query().Bool().Filter()
+	filter.Range(FieldExpiration, dsl.WithRangeGT(tmpl.Bind(FieldExpirationAfter)), dsl.WithRangeLTE(tmpl.Bind(FieldExpiration)))
+	root.Source().Includes(FieldActionID, FieldAgents, FieldExpiration)
+	sort := root.Sort()
+	sort.SortOrder(FieldExpiration, dsl.SortAscend)
+	sort.SortOrder(FieldActionID, dsl.SortAscend)
+	sort.SortOrder(FieldSeqNo, dsl.SortAscend)
+	if after {
+		root.Param("search_after", tmpl.Bind(fieldExpiredActionsAfter))
+	}
+	root.WithSize(tmpl.Bind(FieldSize))
+	tmpl.MustResolve(root)
+	return tmpl
+}
+
+func prepareFindAgentActions(inNamespaces bool) *dsl.Tmpl {
 	tmpl, root, filter := createBaseActionsQuery()
 
-	filter.Terms(FieldAgents, tmpl.Bind(FieldAgents), nil)
+	// The action is either addressed to the agent or to any of its tags.
+	boolNode := root.Query().Bool()
+	should := boolNode.Should()
+	should.Terms(FieldAgents, tmpl.Bind(FieldAgents), nil)
+	should.Terms(FieldTags, tmpl.Bind(FieldTags), nil)
+	boolNode.MinimumShouldMatch(1)
+
+	if inNamespaces {
+		nsNode := filter.AppendBool()
+		nsShould := nsNode.Should()
+		nsShould.Terms(FieldNamespaces, tmpl.Bind(FieldNamespaces), nil)
+		nsShould.AppendBool().MustNot().Exists(FieldNamespaces)
+		nsNode.MinimumShouldMatch(1)
+	}
 
 	// Select more actions per agent since the agents array is not loaded
 	root.Size(maxAgentActionsFetchSize)
@@ -102,6 +147,17 @@ func createBaseActionsQuery() (tmpl *dsl.Tmpl, root, filter *dsl.Node) {
 	return //nolint:nakedret // simple function
 }
 
+// CreateAction indexes the action using its action ID as the document ID.
+func CreateAction(ctx context.Context, bulker bulk.Bulk, action model.Action, opt ...Option) error {
+	o := newOption(FleetActions, opt...)
+	body, err := json.Marshal(action)
+	if err != nil {
+		return err
+	}
+	_, err = bulker.Create(ctx, o.indexName, action.ActionID, body, bulk.WithRefresh())
+	return err
+}
+
 func FindAction(ctx context.Context, bulker bulk.Bulk, id string, opts ...Option) ([]model.Action, error) {
 	o := newOption(FleetActions, opts...)
 	return findActions(ctx, bulker, QueryAction, o.indexName, map[string]interface{}{
@@ -109,16 +165,27 @@ func FindAction(ctx context.Context, bulker bulk.Bulk, id string, opts ...Option
 	}, nil)
 }
 
-func FindAgentActions(ctx context.Context, bulker bulk.Bulk, minSeqNo, maxSeqNo sqn.SeqNo, agentID string) ([]model.Action, error) {
+// FindAgentActions returns the actions in the sequence number range addressed to the agent ID or to any of the agent tags.
+// When the agent has namespaces, the actions of the other namespaces are not returned.
+func FindAgentActions(ctx context.Context, bulker bulk.Bulk, minSeqNo, maxSeqNo sqn.SeqNo, agentID string, tags, namespaces []string) ([]model.Action, error) {
 	const index = FleetActions
+	if tags == nil {
+		tags = []string{}
+	}
 	params := map[string]interface{}{
 		FieldSeqNo:      minSeqNo.Value(),
 		FieldMaxSeqNo:   maxSeqNo.Value(),
 		FieldExpiration: time.Now().UTC().Format(time.RFC3339),
 		FieldAgents:     []string{agentID},
+		FieldTags:       tags,
+	}
+	tmpl := QueryAgentActions
+	if len(namespaces) > 0 {
+		tmpl = QueryAgentActionsInNamespaces
+		params[FieldNamespaces] = namespaces
 	}
 
-	res, err := findActionsHits(ctx, bulker, QueryAgentActions, index, params, maxSeqNo)
+	res, err := findActionsHits(ctx, bulker, tmpl, index, params, maxSeqNo)
 	if err != nil || res == nil {
 		return nil, err
 	}
@@ -181,6 +248,27 @@ func FindExpiredActionsHitsForIndex(ctx context.Context, index string, bulker bu
 	return nil, nil
 }
 
+// FindExpiredActionsInRange returns the hits of up to size actions that expired after expiredAfter and at or before
+// expiredBefore, sorted by expiration, action_id and _seq_no. The page follows the sort values after of the last hit of
+// the previous page, unless after is empty. Only the action id, agents and expiration are loaded.
+func FindExpiredActionsInRange(ctx context.Context, bulker bulk.Bulk, expiredAfter, expiredBefore time.Time, after []interface{}, size int) ([]es.HitT, error) {
+	tmpl := QueryExpiredActionsInRange
+	params := map[string]interface{}{
+		FieldExpirationAfter: expiredAfter.UTC().Format(time.RFC3339),
+		FieldExpiration:      expiredBefore.UTC().Format(time.RFC3339),
+		FieldSize:            size,
+	}
+	if len(after) > 0 {
+		tmpl = QueryExpiredActionsInRangeAfter
+		params[fieldExpiredActionsAfter] = after
+	}
+	res, err := findActionsHits(ctx, bulker, tmpl, FleetActions, params, nil)
+	if err != nil || res == nil {
+		return nil, err
+	}
+	return res.Hits, nil
+}
+
 func findActionsHits(ctx context.Context, bulker bulk.Bulk, tmpl *dsl.Tmpl, index string, params map[string]interface{}, seqNos []int64) (*es.HitsT, error) {
 	var ops []bulk.Opt
 	if len(seqNos) > 0 {
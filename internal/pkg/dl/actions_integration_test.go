@@ -12,8 +12,12 @@ import (
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
+	"github.com/elastic/fleet-server/v7/internal/pkg/dsl"
 	"github.com/elastic/fleet-server/v7/internal/pkg/gcheckpt"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
 	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
 	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
 )
@@ -53,3 +57,93 @@ func TestSearchActionsQuery(t *testing.T) {
 	})
 
 }
+
+func TestFindAgentActionsInNamespaces(t *testing.T) {
+	ctx, cn := context.WithCancel(context.Background())
+	defer cn()
+	ctx = testlog.SetLogger(t).WithContext(ctx)
+
+	index, bulker := ftesting.SetupCleanIndex(ctx, t, FleetActions)
+	expiration := time.Now().UTC().Add(time.Hour).Format(time.RFC3339)
+	var actions []model.Action
+	for id, namespaces := range map[string][]string{
+		"space1-action":   {"space1"},
+		"space2-action":   {"space2"},
+		"unscoped-action": nil,
+	} {
+		actions = append(actions, model.Action{
+			ESDocument: model.ESDocument{Id: id},
+			ActionID:   id,
+			Agents:     []string{"agent-1"},
+			Namespaces: namespaces,
+			Expiration: expiration,
+			Type:       "SETTINGS",
+		})
+	}
+	require.NoError(t, ftesting.StoreActions(ctx, bulker, index, actions))
+
+	checkpoint, err := gcheckpt.Query(ctx, bulker.Client(), index)
+	require.NoError(t, err)
+
+	find := func(tmpl *dsl.Tmpl, namespaces []string) []string {
+		params := map[string]interface{}{
+			FieldSeqNo:      -1,
+			FieldMaxSeqNo:   checkpoint.Value(),
+			FieldExpiration: time.Now().UTC().Format(time.RFC3339),
+			FieldAgents:     []string{"agent-1"},
+			FieldTags:       []string{},
+		}
+		if namespaces != nil {
+			params[FieldNamespaces] = namespaces
+		}
+		found, err := findActions(ctx, bulker, tmpl, index, params, nil)
+		require.NoError(t, err)
+		var ids []string
+		for _, action := range found {
+			ids = append(ids, action.ActionID)
+		}
+		return ids
+	}
+
+	assert.ElementsMatch(t, []string{"space1-action", "unscoped-action"}, find(QueryAgentActionsInNamespaces, []string{"space1"}))
+	assert.ElementsMatch(t, []string{"space2-action", "unscoped-action"}, find(QueryAgentActionsInNamespaces, []string{"space2"}))
+	assert.ElementsMatch(t, []string{"space1-action", "space2-action", "unscoped-action"}, find(QueryAgentActions, nil))
+}
+
+func TestFindExpiredActionsInRangePages(t *testing.T) {
+	ctx, cn := context.WithCancel(context.Background())
+	defer cn()
+	ctx = testlog.SetLogger(t).WithContext(ctx)
+
+	index, bulker := ftesting.SetupCleanIndex(ctx, t, FleetActions)
+	expiredBefore := time.Now().UTC().Truncate(time.Second)
+	expiration := expiredBefore.Add(-time.Minute).Format(time.RFC3339)
+
+	// All the actions expire in the same second, and the split action has two documents.
+	actions := []model.Action{
+		{ESDocument: model.ESDocument{Id: "doc-1"}, ActionID: "action-1", Agents: []string{"agent-1"}, Expiration: expiration, Type: "SETTINGS"},
+		{ESDocument: model.ESDocument{Id: "doc-2"}, ActionID: "action-2", Agents: []string{"agent-1"}, Expiration: expiration, Type: "SETTINGS"},
+		{ESDocument: model.ESDocument{Id: "doc-3"}, ActionID: "split-action", Agents: []string{"agent-1"}, Expiration: expiration, Type: "SETTINGS"},
+		{ESDocument: model.ESDocument{Id: "doc-4"}, ActionID: "split-action", Agents: []string{"agent-2"}, Expiration: expiration, Type: "SETTINGS"},
+		{ESDocument: model.ESDocument{Id: "doc-5"}, ActionID: "action-3", Agents: []string{"agent-1"}, Expiration: expiration, Type: "SETTINGS"},
+	}
+	require.NoError(t, ftesting.StoreActions(ctx, bulker, index, actions))
+
+	var (
+		ids   []string
+		after []interface{}
+	)
+	for {
+		hits, err := FindExpiredActionsInRange(ctx, bulker, expiredBefore.Add(-time.Hour), expiredBefore, after, 2)
+		require.NoError(t, err)
+		for _, hit := range hits {
+			ids = append(ids, hit.ID)
+		}
+		if len(hits) < 2 {
+			break
+		}
+		after = hits[len(hits)-1].Sort
+		require.NotEmpty(t, after)
+	}
+	assert.ElementsMatch(t, []string{"doc-1", "doc-2", "doc-3", "doc-4", "doc-5"}, ids, "each action document is returned once")
+}
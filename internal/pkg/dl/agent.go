@@ -5,10 +5,13 @@
 package dl
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
 	"github.com/elastic/fleet-server/v7/internal/pkg/dsl"
@@ -18,12 +21,26 @@ import (
 
 const (
 	FieldAccessAPIKeyID = "access_api_key_id"
+	FieldOutputs        = "outputs"
+
+	fieldRetiredKeysQuery = "retired_keys_query"
+	retiredKeysFetchSize  = 100
+
+	fieldInactiveAgentsQuery = "inactive_agents_query"
+	fieldInactiveAgentsAfter = "inactive_agents_after"
+	inactiveAgentsFetchSize  = 100
+	inactiveAgentsSortField  = "agent.id"
 )
 
 var (
 	QueryAgentByAssessAPIKeyID = prepareAgentFindByAccessAPIKeyID()
 	QueryAgentByID             = prepareAgentFindByID()
 	QueryAgentByEnrollmentID   = prepareAgentFindByEnrollmentID()
+	QueryAgentIDs              = prepareFindAgentIDs()
+	QueryActiveAgents          = prepareActiveAgents()
+	QueryAgentsRetiredKeys     = prepareAgentsRetiredKeys()
+	QueryInactiveAgents        = prepareInactiveAgents(false)
+	QueryInactiveAgentsAfter   = prepareInactiveAgents(true)
 )
 
 func prepareAgentFindByID() *dsl.Tmpl {
@@ -38,6 +55,52 @@ func prepareAgentFindByEnrollmentID() *dsl.Tmpl {
 	return prepareAgentFindByField(FieldEnrollmentID)
 }
 
+func prepareFindAgentIDs() *dsl.Tmpl {
+	tmpl := dsl.NewTmpl()
+	root := dsl.NewRoot()
+	root.Query().Bool().Filter().Terms(FieldID, tmpl.Bind(FieldID), nil)
+	root.Size(maxAgentActionsFetchSize)
+	root.Source().Includes(FieldActive)
+	tmpl.MustResolve(root)
+	return tmpl
+}
+
+func prepareActiveAgents() *dsl.Tmpl {
+	tmpl := dsl.NewTmpl()
+	root := dsl.NewRoot()
+	root.Query().Bool().Filter().Term(FieldActive, true, nil)
+	tmpl.MustResolve(root)
+	return tmpl
+}
+
+func prepareAgentsRetiredKeys() *dsl.Tmpl {
+	tmpl := dsl.NewTmpl()
+	root := dsl.NewRoot()
+	root.Query().Bool().Filter().QueryString(tmpl.Bind(fieldRetiredKeysQuery))
+	root.Size(retiredKeysFetchSize)
+	root.Source().Includes(FieldOutputs)
+	tmpl.MustResolve(root)
+	return tmpl
+}
+
+// queryStringEscaper escapes a value quoted in a query_string query.
+var queryStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// prepareInactiveAgents returns the query of a page of the inactive agents sorted by ID, the page follows an agent
+// ID when after is true.
+func prepareInactiveAgents(after bool) *dsl.Tmpl {
+	tmpl := dsl.NewTmpl()
+	root := dsl.NewRoot()
+	root.Query().Bool().Filter().QueryString(tmpl.Bind(fieldInactiveAgentsQuery))
+	root.Size(inactiveAgentsFetchSize)
+	root.Sort().SortOrder(inactiveAgentsSortField, dsl.SortAscend)
+	if after {
+		root.Param("search_after", []interface{}{tmpl.Bind(fieldInactiveAgentsAfter)})
+	}
+	tmpl.MustResolve(root)
+	return tmpl
+}
+
 func prepareAgentFindByField(field string) *dsl.Tmpl {
 	return prepareFindByField(field, map[string]interface{}{"version": true})
 }
@@ -83,3 +146,138 @@ func FindAgent(ctx context.Context, bulker bulk.Bulk, tmpl *dsl.Tmpl, name strin
 
 	return agent, nil
 }
+
+// FindAgentIDs returns the subset of agentIDs that have an agent document.
+//
+// The agent IDs are looked up in batches of maxAgentActionsFetchSize, like FindAckedActionIDs.
+func FindAgentIDs(ctx context.Context, bulker bulk.Bulk, agentIDs []string, opt ...Option) (map[string]struct{}, error) {
+	o := newOption(FleetAgents, opt...)
+	found := make(map[string]struct{})
+	for len(agentIDs) > 0 {
+		batch := agentIDs[:min(len(agentIDs), maxAgentActionsFetchSize)]
+		agentIDs = agentIDs[len(batch):]
+
+		res, err := Search(ctx, bulker, QueryAgentIDs, o.indexName, map[string]interface{}{
+			FieldID: batch,
+		})
+		if err != nil {
+			if errors.Is(err, es.ErrIndexNotFound) {
+				return found, nil
+			}
+			return nil, err
+		}
+		for _, hit := range res.Hits {
+			found[hit.ID] = struct{}{}
+		}
+	}
+	return found, nil
+}
+
+// CountActiveAgents returns the number of active agents.
+// An agents index that is not created yet has no active agents.
+func CountActiveAgents(ctx context.Context, bulker bulk.Bulk, opt ...Option) (int64, error) {
+	o := newOption(FleetAgents, opt...)
+	query, err := QueryActiveAgents.Render(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	client := bulker.Client()
+	res, err := client.Count(
+		client.Count.WithContext(ctx),
+		client.Count.WithIndex(o.indexName),
+		client.Count.WithBody(bytes.NewReader(query)),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	var esres es.CountResponse
+	err = json.NewDecoder(res.Body).Decode(&esres)
+	if err != nil {
+		return 0, err
+	}
+
+	if res.IsError() {
+		err = es.TranslateError(res.StatusCode, esres.Error)
+		if err != nil {
+			if errors.Is(err, es.ErrIndexNotFound) {
+				return 0, nil
+			}
+			return 0, err
+		}
+	}
+	return esres.Count, nil
+}
+
+// FindAgentsWithRetiredKeys returns up to retiredKeysFetchSize agents with output API keys that were retired at or before retiredBefore.
+// The output names are dynamic, so the retired_at fields of all outputs are matched with a wildcard.
+func FindAgentsWithRetiredKeys(ctx context.Context, bulker bulk.Bulk, retiredBefore time.Time, opt ...Option) ([]model.Agent, error) {
+	o := newOption(FleetAgents, opt...)
+	query := fmt.Sprintf(`%s.\*.%s.retired_at:[* TO "%s"]`, FieldOutputs, FieldPolicyOutputToRetireAPIKeyIDs, retiredBefore.UTC().Format(time.RFC3339))
+	res, err := Search(ctx, bulker, QueryAgentsRetiredKeys, o.indexName, map[string]interface{}{
+		fieldRetiredKeysQuery: query,
+	})
+	if err != nil {
+		if errors.Is(err, es.ErrIndexNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	agents := make([]model.Agent, 0, len(res.Hits))
+	for _, hit := range res.Hits {
+		var agent model.Agent
+		if err := hit.Unmarshal(&agent); err != nil {
+			return nil, err
+		}
+		agents = append(agents, agent)
+	}
+	return agents, nil
+}
+
+// FindInactiveAgents returns a page of up to inactiveAgentsFetchSize active agents that did not check in since
+// seenBefore, sorted by agent.id. Agents that never checked in are matched by their enrollment time. Only the agents
+// of policyID are returned, unless policyID is empty. Agents whose last checkin status is skipStatus are left out,
+// unless skipStatus is empty. The page follows the agent.id after, unless after is empty.
+//
+// The documents without agent.id are never returned, they can not be paged through by agent.id. The enrollment
+// always writes it.
+func FindInactiveAgents(ctx context.Context, bulker bulk.Bulk, seenBefore time.Time, policyID, skipStatus, after string, opt ...Option) ([]model.Agent, error) {
+	o := newOption(FleetAgents, opt...)
+	ts := seenBefore.UTC().Format(time.RFC3339)
+	query := fmt.Sprintf(`%s:true AND _exists_:%s AND (%s:[* TO "%s"] OR (NOT _exists_:%s AND %s:[* TO "%s"]))`,
+		FieldActive, inactiveAgentsSortField, FieldLastCheckin, ts, FieldLastCheckin, FieldEnrolledAt, ts)
+	if policyID != "" {
+		query += fmt.Sprintf(` AND %s:"%s"`, FieldPolicyID, queryStringEscaper.Replace(policyID))
+	}
+	if skipStatus != "" {
+		query += fmt.Sprintf(` AND NOT %s:"%s"`, FieldLastCheckinStatus, skipStatus)
+	}
+	tmpl := QueryInactiveAgents
+	params := map[string]interface{}{
+		fieldInactiveAgentsQuery: query,
+	}
+	if after != "" {
+		tmpl = QueryInactiveAgentsAfter
+		params[fieldInactiveAgentsAfter] = after
+	}
+	res, err := Search(ctx, bulker, tmpl, o.indexName, params)
+	if err != nil {
+		if errors.Is(err, es.ErrIndexNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	agents := make([]model.Agent, 0, len(res.Hits))
+	for _, hit := range res.Hits {
+		var agent model.Agent
+		if err := hit.Unmarshal(&agent); err != nil {
+			return nil, err
+		}
+		agents = append(agents, agent)
+	}
+	return agents, nil
+}
@@ -5,9 +5,17 @@
 package dl
 
 import (
+	"context"
+	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
 )
 
 func TestPrepareAgentFindByEnrollmentID(t *testing.T) {
@@ -16,3 +24,35 @@ func TestPrepareAgentFindByEnrollmentID(t *testing.T) {
 	query, _ := tmpl.RenderOne(FieldEnrollmentID, "1")
 	assert.Equal(t, `{"query":{"bool":{"filter":[{"term":{"enrollment_id":"1"}}]}},"version":true}`, string(query[:]))
 }
+
+func TestFindInactiveAgentsQuery(t *testing.T) {
+	seenBefore := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	var body []byte
+	mBulk := ftesting.NewMockBulk()
+	mBulk.On("Search", mock.Anything, FleetAgents, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		body = args.Get(2).([]byte)
+	}).Return(&es.ResultT{}, nil)
+
+	_, err := FindInactiveAgents(context.Background(), mBulk, seenBefore, `policy "1"`, "inactive", "agent-1")
+	require.NoError(t, err)
+
+	var req struct {
+		Query struct {
+			Bool struct {
+				Filter []struct {
+					QueryString struct {
+						Query string `json:"query"`
+					} `json:"query_string"`
+				} `json:"filter"`
+			} `json:"bool"`
+		} `json:"query"`
+		Sort        []json.RawMessage `json:"sort"`
+		SearchAfter []string          `json:"search_after"`
+	}
+	require.NoError(t, json.Unmarshal(body, &req))
+	require.Len(t, req.Query.Bool.Filter, 1)
+	assert.Equal(t, `active:true AND _exists_:agent.id AND (last_checkin:[* TO "2024-03-01T12:00:00Z"] OR (NOT _exists_:last_checkin AND enrolled_at:[* TO "2024-03-01T12:00:00Z"])) AND policy_id:"policy \"1\"" AND NOT last_checkin_status:"inactive"`, req.Query.Bool.Filter[0].QueryString.Query)
+	require.Len(t, req.Sort, 1)
+	assert.Contains(t, string(req.Sort[0]), `"agent.id"`, "only the agents with an agent.id are paged through by it")
+	assert.Equal(t, []string{"agent-1"}, req.SearchAfter)
+}
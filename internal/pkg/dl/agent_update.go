@@ -0,0 +1,140 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package dl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+)
+
+// setAgentFieldsScript sets each of params.fields at its dotted path in the agent document, creating the objects on
+// the path that are missing. Only the value at the end of each path is written, the other fields of the objects on
+// the path are left as they are.
+const setAgentFieldsScript = `for (def field : params.fields.entrySet()) { String[] path = field.getKey().splitOnToken('.'); def obj = ctx._source; for (int i = 0; i < path.length - 1; i++) { if (!(obj[path[i]] instanceof Map)) { obj[path[i]] = [:]; } obj = obj[path[i]]; } obj[path[path.length - 1]] = field.getValue(); }`
+
+// AgentUpdateBody returns the body of an update that only writes the fields of the agent document that the writer
+// owns. The fields are keyed by their dotted path, such as agent.version, and their values replace the values at the
+// path. Fleet-servers of different versions can update the same agent documents during a rolling upgrade, this keeps
+// the fields of a document written by one version that the other version does not know about.
+//
+// The update is a partial document, which merges the objects on the paths into the document. A partial document would
+// merge an object value into the current one instead of replacing it, the fields are written with a script when one
+// of the values is an object, such as local_metadata.
+func AgentUpdateBody(fields bulk.UpdateFields) ([]byte, error) {
+	if !hasObjectValue(fields) {
+		return nestFields(fields).Marshal()
+	}
+	return json.Marshal(map[string]interface{}{
+		"script": map[string]interface{}{
+			"lang":   "painless",
+			"source": setAgentFieldsScript,
+			"params": map[string]interface{}{
+				"fields": fields,
+			},
+		},
+	})
+}
+
+// AgentUpsertBody returns the body of an update that writes the fields of the agent document keyed by their dotted
+// path, and creates the document with them if it does not exist.
+func AgentUpsertBody(fields bulk.UpdateFields) ([]byte, error) {
+	return nestFields(fields).MarshalUpsert()
+}
+
+// nestFields returns the fields keyed by their dotted path as nested objects.
+func nestFields(fields bulk.UpdateFields) bulk.UpdateFields {
+	doc := make(bulk.UpdateFields, len(fields))
+	for path, value := range fields {
+		obj := doc
+		keys := strings.Split(path, ".")
+		for _, key := range keys[:len(keys)-1] {
+			sub, ok := obj[key].(bulk.UpdateFields)
+			if !ok {
+				sub = bulk.UpdateFields{}
+				obj[key] = sub
+			}
+			obj = sub
+		}
+		obj[keys[len(keys)-1]] = value
+	}
+	return doc
+}
+
+// hasObjectValue returns true if one of the values of fields is encoded as a JSON object.
+func hasObjectValue(fields bulk.UpdateFields) bool {
+	for _, value := range fields {
+		switch v := value.(type) {
+		case nil:
+		case json.RawMessage:
+			if b := bytes.TrimSpace(v); len(b) > 0 && b[0] == '{' {
+				return true
+			}
+		default:
+			switch reflect.Indirect(reflect.ValueOf(v)).Kind() {
+			case reflect.Map, reflect.Struct:
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AgentUpdateFunc returns the fields to update in the agent document, keyed by their dotted path, from the current
+// document. It returns no fields to leave the document as it is.
+type AgentUpdateFunc func(agent *model.Agent) (bulk.UpdateFields, error)
+
+// UpdateAgentIfUnchanged reads the agent document and writes the fields that update returns for it, only if the
+// document was not written since it was read. It is meant for the updates of several fields that depend on the
+// current document, which must not overwrite the changes of another writer.
+//
+// When another writer updated the document in between, it is read again and update is called once more. The conflict
+// of the retry is returned.
+func UpdateAgentIfUnchanged(ctx context.Context, bulker bulk.Bulk, agentID string, update AgentUpdateFunc, opts ...bulk.Opt) error {
+	err := updateAgentIfUnchanged(ctx, bulker, agentID, update, opts...)
+	if !errors.Is(err, es.ErrElasticVersionConflict) {
+		return err
+	}
+	agentUpdateConflictRetries.Inc()
+	zerolog.Ctx(ctx).Debug().Str("agent_id", agentID).Msg("Agent document changed since it was read, retrying the update")
+	return updateAgentIfUnchanged(ctx, bulker, agentID, update, opts...)
+}
+
+func updateAgentIfUnchanged(ctx context.Context, bulker bulk.Bulk, agentID string, update AgentUpdateFunc, opts ...bulk.Opt) error {
+	data, err := bulker.ReadRaw(ctx, FleetAgents, agentID)
+	if err != nil {
+		if errors.Is(err, es.ErrElasticNotFound) {
+			return ErrNotFound
+		}
+		return err
+	}
+	var agent model.Agent
+	if err := json.Unmarshal(data.Source, &agent); err != nil {
+		return err
+	}
+	agent.Id = agentID
+	agent.SeqNo = data.SeqNo
+	agent.Version = data.Version
+
+	fields, err := update(&agent)
+	if err != nil || len(fields) == 0 {
+		return err
+	}
+	body, err := AgentUpdateBody(fields)
+	if err != nil {
+		return err
+	}
+	opts = append([]bulk.Opt{bulk.WithIfSeqNo(data.SeqNo, data.PrimaryTerm)}, opts...)
+	return bulker.Update(ctx, FleetAgents, agentID, body, opts...)
+}
@@ -0,0 +1,255 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package dl
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+)
+
+// agentStore is a fake bulker that holds a single agent document, and applies the updates built by AgentUpdateBody
+// like the painless script. An update fails with a version conflict when the document was written since the last read.
+type agentStore struct {
+	*ftesting.MockBulk
+
+	t      *testing.T
+	doc    map[string]interface{}
+	seqNo  int64
+	readAt int64
+	reads  int
+	// interleave is called before the updates, to let another writer update the document in between.
+	interleave func(s *agentStore)
+}
+
+func (s *agentStore) ReadRaw(_ context.Context, index, id string, _ ...bulk.Opt) (*bulk.MgetResponseItem, error) {
+	require.Equal(s.t, FleetAgents, index)
+	s.reads++
+	s.readAt = s.seqNo
+	source, err := json.Marshal(s.doc)
+	require.NoError(s.t, err)
+	return &bulk.MgetResponseItem{DocumentID: id, Found: true, SeqNo: s.seqNo, PrimaryTerm: 1, Source: source}, nil
+}
+
+func (s *agentStore) Update(_ context.Context, index, _ string, body []byte, opts ...bulk.Opt) error {
+	require.Equal(s.t, FleetAgents, index)
+	require.NotEmpty(s.t, opts, "expected the update to be conditional")
+	if s.interleave != nil {
+		s.interleave(s)
+	}
+	if s.readAt != s.seqNo {
+		return es.ErrElasticVersionConflict
+	}
+	s.apply(body)
+	return nil
+}
+
+// apply writes the fields of an update body to the document, like Elasticsearch merges a partial document or like
+// the painless script.
+func (s *agentStore) apply(body []byte) {
+	var update struct {
+		Doc    map[string]interface{} `json:"doc"`
+		Script struct {
+			Source string `json:"source"`
+			Params struct {
+				Fields map[string]interface{} `json:"fields"`
+			} `json:"params"`
+		} `json:"script"`
+	}
+	require.NoError(s.t, json.Unmarshal(body, &update))
+	s.seqNo++
+	if update.Doc != nil {
+		mergeDoc(s.doc, update.Doc)
+		return
+	}
+	require.Equal(s.t, setAgentFieldsScript, update.Script.Source)
+	for path, value := range update.Script.Params.Fields {
+		obj := s.doc
+		keys := strings.Split(path, ".")
+		for _, key := range keys[:len(keys)-1] {
+			sub, ok := obj[key].(map[string]interface{})
+			if !ok {
+				sub = map[string]interface{}{}
+				obj[key] = sub
+			}
+			obj = sub
+		}
+		obj[keys[len(keys)-1]] = value
+	}
+}
+
+// mergeDoc merges the objects of a partial document into doc, the other values replace the values of doc.
+func mergeDoc(doc, partial map[string]interface{}) {
+	for key, value := range partial {
+		sub, ok := value.(map[string]interface{})
+		cur, isObj := doc[key].(map[string]interface{})
+		if ok && isObj {
+			mergeDoc(cur, sub)
+			continue
+		}
+		doc[key] = value
+	}
+}
+
+// write updates the document as another writer that owns the fields.
+func (s *agentStore) write(fields bulk.UpdateFields) {
+	body, err := AgentUpdateBody(fields)
+	require.NoError(s.t, err)
+	s.apply(body)
+}
+
+func conflictRetries(t *testing.T) float64 {
+	t.Helper()
+	var m dto.Metric
+	require.NoError(t, agentUpdateConflictRetries.Write(&m))
+	return m.GetCounter().GetValue()
+}
+
+func TestUpdateAgentIfUnchanged(t *testing.T) {
+	newStore := func(t *testing.T) *agentStore {
+		return &agentStore{
+			MockBulk: ftesting.NewMockBulk(),
+			t:        t,
+			doc: map[string]interface{}{
+				"agent":           map[string]interface{}{"id": "agent-1", "version": "8.15.0"},
+				"upgrade_details": map[string]interface{}{"action_id": "action-1", "state": "UPG_WATCHING"},
+				"components":      []interface{}{map[string]interface{}{"id": "winlog-default", "status": "HEALTHY"}},
+			},
+		}
+	}
+	// completeUpgrade clears the upgrade details and sets upgraded_at, only when the document has upgrade details.
+	completeUpgrade := func(calls *int) AgentUpdateFunc {
+		return func(agent *model.Agent) (bulk.UpdateFields, error) {
+			*calls++
+			if agent.UpgradeDetails == nil {
+				return nil, nil
+			}
+			return bulk.UpdateFields{
+				FieldUpgradeDetails: nil,
+				FieldUpgradedAt:     "2024-10-08T12:00:00Z",
+			}, nil
+		}
+	}
+
+	t.Run("no conflict", func(t *testing.T) {
+		store := newStore(t)
+		before := conflictRetries(t)
+		var calls int
+		require.NoError(t, UpdateAgentIfUnchanged(context.Background(), store, "agent-1", completeUpgrade(&calls)))
+		assert.Equal(t, 1, calls)
+		assert.Nil(t, store.doc[FieldUpgradeDetails])
+		assert.Equal(t, "2024-10-08T12:00:00Z", store.doc[FieldUpgradedAt])
+		assert.Equal(t, before, conflictRetries(t))
+	})
+
+	t.Run("interleaved writer", func(t *testing.T) {
+		store := newStore(t)
+		// Another fleet-server writes the checkin of the agent between the read and the update.
+		store.interleave = func(s *agentStore) {
+			s.interleave = nil
+			s.write(bulk.UpdateFields{
+				"agent.version":  "8.16.0",
+				FieldComponents:  []interface{}{map[string]interface{}{"id": "winlog-default", "status": "HEALTHY", "units": []interface{}{}}},
+				FieldLastCheckin: "2024-10-08T12:00:00Z",
+			})
+		}
+		before := conflictRetries(t)
+		var calls int
+		require.NoError(t, UpdateAgentIfUnchanged(context.Background(), store, "agent-1", completeUpgrade(&calls)))
+		assert.Equal(t, 2, calls, "expected the update to be computed again from the new document")
+		assert.Equal(t, 2, store.reads)
+		assert.Equal(t, before+1, conflictRetries(t))
+
+		// The fields of both writers are kept.
+		assert.Equal(t, map[string]interface{}{"id": "agent-1", "version": "8.16.0"}, store.doc[FieldAgent])
+		assert.Len(t, store.doc[FieldComponents], 1)
+		assert.Contains(t, store.doc[FieldComponents].([]interface{})[0], "units")
+		assert.Equal(t, "2024-10-08T12:00:00Z", store.doc[FieldLastCheckin])
+		assert.Nil(t, store.doc[FieldUpgradeDetails])
+		assert.Equal(t, "2024-10-08T12:00:00Z", store.doc[FieldUpgradedAt])
+	})
+
+	t.Run("interleaved writer changes the outcome", func(t *testing.T) {
+		store := newStore(t)
+		// Another writer completes the upgrade first, the update is not needed anymore.
+		store.interleave = func(s *agentStore) {
+			s.interleave = nil
+			s.write(bulk.UpdateFields{
+				FieldUpgradeDetails: nil,
+				FieldUpgradedAt:     "2024-10-08T11:59:00Z",
+			})
+		}
+		var calls int
+		require.NoError(t, UpdateAgentIfUnchanged(context.Background(), store, "agent-1", completeUpgrade(&calls)))
+		assert.Equal(t, 2, calls)
+		assert.Equal(t, "2024-10-08T11:59:00Z", store.doc[FieldUpgradedAt], "expected the other writer's update to be kept")
+	})
+
+	t.Run("conflict on retry", func(t *testing.T) {
+		store := newStore(t)
+		store.interleave = func(s *agentStore) {
+			s.write(bulk.UpdateFields{FieldLastCheckin: "2024-10-08T12:00:00Z"})
+		}
+		before := conflictRetries(t)
+		var calls int
+		err := UpdateAgentIfUnchanged(context.Background(), store, "agent-1", completeUpgrade(&calls))
+		assert.ErrorIs(t, err, es.ErrElasticVersionConflict)
+		assert.Equal(t, 2, calls, "expected a single retry")
+		assert.Equal(t, before+1, conflictRetries(t))
+		assert.NotNil(t, store.doc[FieldUpgradeDetails])
+	})
+}
+
+func TestAgentUpsertBody(t *testing.T) {
+	body, err := AgentUpsertBody(bulk.UpdateFields{
+		"agent.version":  "8.16.0",
+		FieldLastCheckin: "2024-10-08T12:00:00Z",
+	})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"doc":{"agent":{"version":"8.16.0"},"last_checkin":"2024-10-08T12:00:00Z"},"doc_as_upsert":true}`, string(body))
+}
+
+func TestAgentUpdateBody(t *testing.T) {
+	t.Run("partial document", func(t *testing.T) {
+		body, err := AgentUpdateBody(bulk.UpdateFields{
+			"agent.version":     "8.16.0",
+			FieldLastCheckin:    "2024-10-08T12:00:00Z",
+			FieldComponents:     json.RawMessage(`[{"id":"winlog-default"}]`),
+			FieldUpgradeDetails: nil,
+		})
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"doc":{"agent":{"version":"8.16.0"},"last_checkin":"2024-10-08T12:00:00Z","components":[{"id":"winlog-default"}],"upgrade_details":null}}`, string(body))
+	})
+	t.Run("object value", func(t *testing.T) {
+		// A partial document would merge the local metadata into the current one, it is replaced by the script.
+		body, err := AgentUpdateBody(bulk.UpdateFields{
+			"agent.version":    "8.16.0",
+			FieldLocalMetadata: json.RawMessage(` {"os":{"name":"linux"}}`),
+		})
+		require.NoError(t, err)
+		var update struct {
+			Script struct {
+				Source string `json:"source"`
+				Params struct {
+					Fields map[string]json.RawMessage `json:"fields"`
+				} `json:"params"`
+			} `json:"script"`
+		}
+		require.NoError(t, json.Unmarshal(body, &update))
+		assert.Equal(t, setAgentFieldsScript, update.Script.Source)
+		assert.JSONEq(t, `"8.16.0"`, string(update.Script.Params.Fields["agent.version"]))
+		assert.JSONEq(t, `{"os":{"name":"linux"}}`, string(update.Script.Params.Fields[FieldLocalMetadata]))
+	})
+}
@@ -0,0 +1,49 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package dl
+
+import "strings"
+
+// fleetAliases are the aliases of the fleet system indices.
+var fleetAliases = []string{
+	FleetActions,
+	FleetActionsResults,
+	FleetAgents,
+	FleetArtifacts,
+	FleetEnrollmentAPIKeys,
+	FleetPolicies,
+	FleetPoliciesLeader,
+	FleetServers,
+}
+
+// Alias returns the alias of a concrete index of a fleet system index, such as .fleet-agents-7 or
+// .fleet-agents_8.15.0_001, any other index is returned as is.
+//
+// The concrete index behind an alias changes on a rollover or when the index is migrated, and the operations
+// still sent to the old index fail, so the fleet indices are always addressed through their alias.
+func Alias(index string) string {
+	for _, alias := range fleetAliases {
+		suffix, ok := strings.CutPrefix(index, alias)
+		if !ok || suffix == "" {
+			continue
+		}
+		if suffix[0] == '_' || (suffix[0] == '-' && isDigits(suffix[1:])) {
+			return alias
+		}
+	}
+	return index
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
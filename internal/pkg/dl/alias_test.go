@@ -0,0 +1,34 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package dl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlias(t *testing.T) {
+	for index, alias := range map[string]string{
+		FleetAgents:                         FleetAgents,
+		".fleet-agents-7":                   FleetAgents,
+		".fleet-agents_8.15.0_001":          FleetAgents,
+		".fleet-actions-results":            FleetActionsResults,
+		".fleet-actions-results_8.15.0_001": FleetActionsResults,
+		".fleet-actions-7":                  FleetActions,
+		".fleet-policies-leader-7":          FleetPoliciesLeader,
+		FleetAgentsDeadLetter:               FleetAgentsDeadLetter,
+		".fleet-agents-":                    ".fleet-agents-",
+		"test-index-7":                      "test-index-7",
+	} {
+		assert.Equal(t, alias, Alias(index), index)
+	}
+}
+
+func TestNewOptionAlias(t *testing.T) {
+	assert.Equal(t, FleetAgents, newOption(".fleet-agents-7").indexName)
+	assert.Equal(t, FleetAgents, newOption(FleetActions, WithIndexName(".fleet-agents_8.15.0_001")).indexName)
+	assert.Equal(t, "test-index", newOption(FleetAgents, WithIndexName("test-index")).indexName)
+}
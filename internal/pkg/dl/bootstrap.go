@@ -0,0 +1,103 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package dl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dsl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+)
+
+// bootstrapID is the id of the document recording the bootstrap of the cluster in the fleet-servers index.
+const bootstrapID = "fleet-server-bootstrap"
+
+// The status of the bootstrap document.
+const (
+	BootstrapStarted   = "started"
+	BootstrapCompleted = "completed"
+)
+
+var tmplQueryAnyDocument = prepareQueryAnyDocument()
+
+func prepareQueryAnyDocument() []byte {
+	root := dsl.NewRoot()
+	root.Size(1)
+	return root.MustMarshalJSON()
+}
+
+// BootstrapRecord is the bootstrap document with the primary term it was read at, see UpdateBootstrap.
+type BootstrapRecord struct {
+	model.Bootstrap
+
+	primaryTerm int64
+}
+
+// Completed returns true when the bootstrap created all its documents.
+func (r *BootstrapRecord) Completed() bool {
+	return r.Status == "" || r.Status == BootstrapCompleted
+}
+
+// ReadBootstrap returns the document recording the bootstrap of the cluster by a standalone fleet-server, it is nil
+// when the cluster was not bootstrapped.
+func ReadBootstrap(ctx context.Context, bulker bulk.Bulk) (*BootstrapRecord, error) {
+	data, err := bulker.ReadRaw(ctx, FleetServers, bootstrapID, bulk.WithRefresh())
+	if errors.Is(err, es.ErrElasticNotFound) || errors.Is(err, es.ErrIndexNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rec := &BootstrapRecord{primaryTerm: data.PrimaryTerm}
+	if err := json.Unmarshal(data.Source, &rec.Bootstrap); err != nil {
+		return nil, err
+	}
+	rec.ESInitialize(bootstrapID, data.SeqNo, data.Version)
+	return rec, nil
+}
+
+// CreateBootstrap records the bootstrap of the cluster, it is the lease of the server that creates the documents. It
+// fails with es.ErrElasticVersionConflict when the bootstrap was already recorded.
+func CreateBootstrap(ctx context.Context, bulker bulk.Bulk, doc model.Bootstrap) error {
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = bulker.Create(ctx, FleetServers, bootstrapID, body, bulk.WithRefresh())
+	return err
+}
+
+// UpdateBootstrap replaces the bootstrap document read as rec with doc. It fails with es.ErrElasticVersionConflict
+// when another server wrote the document since it was read, the returned record is the document as written.
+func UpdateBootstrap(ctx context.Context, bulker bulk.Bulk, rec *BootstrapRecord, doc model.Bootstrap) (*BootstrapRecord, error) {
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := bulker.Index(ctx, FleetServers, bootstrapID, body, bulk.WithRefresh(), bulk.WithIfSeqNo(rec.SeqNo, rec.primaryTerm)); err != nil {
+		return nil, err
+	}
+	written, err := ReadBootstrap(ctx, bulker)
+	if err == nil && written == nil {
+		return nil, es.ErrElasticVersionConflict
+	}
+	return written, err
+}
+
+// HasDocuments returns true when the index holds at least one document, a missing index holds none.
+func HasDocuments(ctx context.Context, bulker bulk.Bulk, index string) (bool, error) {
+	res, err := bulker.Search(ctx, index, tmplQueryAnyDocument, bulk.WithIgnoreUnavailble())
+	if errors.Is(err, es.ErrIndexNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return len(res.Hits) > 0, nil
+}
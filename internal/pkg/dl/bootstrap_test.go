@@ -0,0 +1,116 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package dl
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+)
+
+func TestBootstrap(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("not bootstrapped", func(t *testing.T) {
+		mBulk := ftesting.NewMockBulk()
+		mBulk.On("ReadRaw", mock.Anything, FleetServers, bootstrapID, mock.Anything).Return((*bulk.MgetResponseItem)(nil), es.ErrIndexNotFound)
+
+		doc, err := ReadBootstrap(ctx, mBulk)
+		require.NoError(t, err)
+		assert.Nil(t, doc)
+	})
+
+	t.Run("create update and read", func(t *testing.T) {
+		var stored []byte
+		mBulk := ftesting.NewMockBulk()
+		mBulk.On("Create", mock.Anything, FleetServers, bootstrapID, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			stored = args.Get(3).([]byte)
+		}).Return(bootstrapID, nil).Once()
+		server := model.ServerMetadata{ID: "server-1", Version: "8.16.0"}
+		require.NoError(t, CreateBootstrap(ctx, mBulk, model.Bootstrap{
+			PolicyID: "fleet-server-policy",
+			Server:   &server,
+			Status:   BootstrapStarted,
+		}))
+
+		item := &bulk.MgetResponseItem{DocumentID: bootstrapID, SeqNo: 3, PrimaryTerm: 1, Found: true, Source: stored}
+		mBulk.On("ReadRaw", mock.Anything, FleetServers, bootstrapID, mock.Anything).Return(item, nil)
+		rec, err := ReadBootstrap(ctx, mBulk)
+		require.NoError(t, err)
+		require.NotNil(t, rec)
+		assert.False(t, rec.Completed())
+		assert.Equal(t, "fleet-server-policy", rec.PolicyID)
+		assert.Empty(t, rec.EnrollmentAPIKeyID)
+		assert.Equal(t, server, *rec.Server)
+		assert.EqualValues(t, 3, rec.SeqNo)
+		assert.EqualValues(t, 1, rec.primaryTerm)
+
+		// The bootstrap is recorded once
+		mBulk.On("Create", mock.Anything, FleetServers, bootstrapID, mock.Anything, mock.Anything).Return("", es.ErrElasticVersionConflict).Once()
+		err = CreateBootstrap(ctx, mBulk, rec.Bootstrap)
+		assert.ErrorIs(t, err, es.ErrElasticVersionConflict)
+
+		done := rec.Bootstrap
+		done.EnrollmentAPIKeyID = "key-1"
+		done.Status = BootstrapCompleted
+		mBulk.On("Index", mock.Anything, FleetServers, bootstrapID, mock.Anything, mock.MatchedBy(func(opts []bulk.Opt) bool {
+			return len(opts) == 2
+		})).Run(func(args mock.Arguments) {
+			item.Source = args.Get(3).([]byte)
+		}).Return(bootstrapID, nil).Once()
+		rec, err = UpdateBootstrap(ctx, mBulk, rec, done)
+		require.NoError(t, err)
+		assert.True(t, rec.Completed())
+		assert.Equal(t, "key-1", rec.EnrollmentAPIKeyID)
+
+		// The document changed since it was read
+		mBulk.On("Index", mock.Anything, FleetServers, bootstrapID, mock.Anything, mock.Anything).Return("", es.ErrElasticVersionConflict).Once()
+		_, err = UpdateBootstrap(ctx, mBulk, rec, done)
+		assert.ErrorIs(t, err, es.ErrElasticVersionConflict)
+		mBulk.AssertExpectations(t)
+	})
+}
+
+func TestHasDocuments(t *testing.T) {
+	hit, err := json.Marshal(map[string]interface{}{"policy_id": "policy-1"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		res      *es.ResultT
+		err      error
+		expected bool
+	}{{
+		name: "empty index",
+		res:  &es.ResultT{},
+	}, {
+		name:     "documents",
+		res:      &es.ResultT{HitsT: es.HitsT{Hits: []es.HitT{{ID: "doc-1", Source: hit}}}},
+		expected: true,
+	}, {
+		name: "missing index",
+		res:  (*es.ResultT)(nil),
+		err:  es.ErrIndexNotFound,
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mBulk := ftesting.NewMockBulk()
+			mBulk.On("Search", mock.Anything, FleetPolicies, mock.Anything, mock.Anything).Return(tc.res, tc.err)
+
+			found, err := HasDocuments(context.Background(), mBulk, FleetPolicies)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, found)
+		})
+	}
+}
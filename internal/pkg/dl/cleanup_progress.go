@@ -0,0 +1,55 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package dl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+)
+
+func cleanupProgressID(name string) string {
+	return "cleanup-progress:" + name
+}
+
+// LoadCleanupProgress returns the ID of the last agent processed by the unfinished pass of the cleanup named name,
+// it is empty if no pass is in progress.
+func LoadCleanupProgress(ctx context.Context, bulker bulk.Bulk, name string) (string, error) {
+	data, err := bulker.Read(ctx, FleetServers, cleanupProgressID(name))
+	if errors.Is(err, es.ErrElasticNotFound) || errors.Is(err, es.ErrIndexNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var doc model.CleanupProgress
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return "", err
+	}
+	return doc.LastAgentID, nil
+}
+
+// SaveCleanupProgress stores the ID of the last agent processed by the cleanup named name, an empty ID marks the
+// pass as finished. Cleanups are run by the fleet-server holding their lease, so there is a document per cleanup in
+// the fleet-servers index.
+func SaveCleanupProgress(ctx context.Context, bulker bulk.Bulk, name string, server model.ServerMetadata, lastAgentID string) error {
+	doc := model.CleanupProgress{
+		LastAgentID: lastAgentID,
+		Name:        name,
+		Server:      &server,
+		Timestamp:   time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = bulker.Index(ctx, FleetServers, cleanupProgressID(name), body, bulk.WithRefresh())
+	return err
+}
@@ -25,5 +25,6 @@ func newOption(defaultIndex string, opts ...Option) queryOption {
 	for _, opt := range opts {
 		opt(&o)
 	}
+	o.indexName = Alias(o.indexName)
 	return o
 }
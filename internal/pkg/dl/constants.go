@@ -13,8 +13,14 @@ const (
 	FleetAgents            = ".fleet-agents"
 	FleetArtifacts         = ".fleet-artifacts"
 	FleetEnrollmentAPIKeys = ".fleet-enrollment-api-keys"
+	FleetIndexMigrations   = ".fleet-index-migrations"
 	FleetPolicies          = ".fleet-policies"
+	FleetPoliciesLeader    = ".fleet-policies-leader"
+	FleetServers           = ".fleet-servers"
+	FleetAgentsDeadLetter  = "logs-fleet_server.checkin_deadletter-default"
 	FleetOutputHealth      = "logs-fleet_server.output_health-default"
+	FleetServerStatus      = "logs-fleet_server.status-default"
+	FleetServerUsage       = "metrics-fleet_server.usage-default"
 )
 
 // Query fields
@@ -28,10 +34,12 @@ const (
 
 	FieldActionID                      = "action_id"
 	FieldAgent                         = "agent"
+	FieldAgentID                       = "agent_id"
 	FieldAgentVersion                  = "version"
 	FieldLastCheckin                   = "last_checkin"
 	FieldLastCheckinStatus             = "last_checkin_status"
 	FieldLastCheckinMessage            = "last_checkin_message"
+	FieldLastCheckinIP                 = "last_checkin_ip"
 	FieldLocalMetadata                 = "local_metadata"
 	FieldComponents                    = "components"
 	FieldPolicyID                      = "policy_id"
@@ -44,6 +52,7 @@ const (
 	FieldUnenrolledReason              = "unenrolled_reason"
 	FiledType                          = "type"
 	FieldUnhealthyReason               = "unhealthy_reason"
+	FieldTags                          = "tags"
 
 	FieldActive           = "active"
 	FieldUpdatedAt        = "updated_at"
@@ -57,6 +66,10 @@ const (
 	FieldIdentifier    = "identifier"
 	FieldSharedID      = "shared_id"
 	FieldEnrollmentID  = "enrollment_id"
+	FieldEnrolledAt    = "enrolled_at"
+
+	FieldError     = "error"
+	FieldTimestamp = "@timestamp"
 )
 
 // Private constants
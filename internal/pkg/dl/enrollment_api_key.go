@@ -7,6 +7,7 @@ package dl
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
@@ -18,6 +19,19 @@ const (
 	FieldAPIKeyID = "api_key_id"
 )
 
+// enrollmentUsageRetryOnConflict is the number of times the usage counter update is retried when enrollments race.
+const enrollmentUsageRetryOnConflict = 20
+
+// ErrEnrollmentAPIKeyExhausted is returned when the enrollment key was used to enroll max_agents agents.
+var ErrEnrollmentAPIKeyExhausted = errors.New("enrollment key usage limit reached")
+
+// The claim is a noop when the key is exhausted, so the counter never exceeds max_agents.
+const (
+	claimEnrollmentAPIKeyScript = `long used = ctx._source.usage_count == null ? 0 : ctx._source.usage_count;
+if (ctx._source.max_agents != null && used >= ctx._source.max_agents) { ctx.op = 'noop' } else { ctx._source.usage_count = used + 1 }`
+	releaseEnrollmentAPIKeyScript = `if (ctx._source.usage_count != null && ctx._source.usage_count > 0) { ctx._source.usage_count -= 1 } else { ctx.op = 'noop' }`
+)
+
 var (
 	QueryEnrollmentAPIKeyByID       = prepareFindActiveEnrollmentAPIKeyByID()
 	QueryEnrollmentAPIKeyByPolicyID = prepareFindActiveEnrollmentAPIKeyByPolicyID()
@@ -95,3 +109,51 @@ func CreateEnrollmentAPIKey(ctx context.Context, bulker bulk.Bulk, key model.Enr
 	}
 	return bulker.Create(ctx, o.indexName, "", data, bulk.WithRefresh())
 }
+
+// ClaimEnrollmentAPIKey atomically increments the usage counter of the enrollment key document with the given id.
+// It returns ErrEnrollmentAPIKeyExhausted if the key was already used to enroll max_agents agents.
+func ClaimEnrollmentAPIKey(ctx context.Context, bulker bulk.Bulk, docID string) error {
+	return claimEnrollmentAPIKey(ctx, bulker, FleetEnrollmentAPIKeys, docID)
+}
+
+func claimEnrollmentAPIKey(ctx context.Context, bulker bulk.Bulk, index, docID string) error {
+	result, err := updateEnrollmentAPIKeyUsage(ctx, bulker, index, docID, claimEnrollmentAPIKeyScript)
+	if err != nil {
+		return err
+	}
+	if result == "noop" {
+		return ErrEnrollmentAPIKeyExhausted
+	}
+	return nil
+}
+
+// ReleaseEnrollmentAPIKey decrements the usage counter of the enrollment key document with the given id.
+// It gives back the usage claimed for an enrollment that failed.
+func ReleaseEnrollmentAPIKey(ctx context.Context, bulker bulk.Bulk, docID string) error {
+	_, err := updateEnrollmentAPIKeyUsage(ctx, bulker, FleetEnrollmentAPIKeys, docID, releaseEnrollmentAPIKeyScript)
+	return err
+}
+
+func updateEnrollmentAPIKeyUsage(ctx context.Context, bulker bulk.Bulk, index, docID, script string) (string, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"script": map[string]interface{}{
+			"lang":   "painless",
+			"source": script,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	items, err := bulker.MUpdate(ctx, []bulk.MultiOp{{
+		ID:    docID,
+		Index: index,
+		Body:  body,
+	}}, bulk.WithRetryOnConflict(enrollmentUsageRetryOnConflict))
+	if err != nil {
+		return "", err
+	}
+	if len(items) != 1 {
+		return "", fmt.Errorf("unexpected update response count %d", len(items))
+	}
+	return items[0].Result, nil
+}
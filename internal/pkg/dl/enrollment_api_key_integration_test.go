@@ -9,6 +9,8 @@ package dl
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"sync"
 	"testing"
 	"time"
 
@@ -146,3 +148,142 @@ func TestSearchEnrollmentAPIKeyByPolicyIDWithInactiveIDs(t *testing.T) {
 		t.Fatalf("expected content does not match: %v", diff)
 	}
 }
+
+func TestClaimEnrollmentAPIKey(t *testing.T) {
+	ctx, cn := context.WithCancel(context.Background())
+	defer cn()
+	ctx = testlog.SetLogger(t).WithContext(ctx)
+
+	index, bulker := ftesting.SetupCleanIndex(ctx, t, FleetEnrollmentAPIKeys)
+
+	rec := createRandomEnrollmentAPIKey(uuid.Must(uuid.NewV4()).String(), true)
+	rec.MaxAgents = 2
+	body, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = bulker.Create(ctx, index, rec.Id, body, bulk.WithRefresh()); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := claimEnrollmentAPIKey(ctx, bulker, index, rec.Id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := claimEnrollmentAPIKey(ctx, bulker, index, rec.Id); !errors.Is(err, ErrEnrollmentAPIKeyExhausted) {
+		t.Fatalf("expected ErrEnrollmentAPIKeyExhausted, got %v", err)
+	}
+
+	if _, err := updateEnrollmentAPIKeyUsage(ctx, bulker, index, rec.Id, releaseEnrollmentAPIKeyScript); err != nil {
+		t.Fatal(err)
+	}
+	if err := claimEnrollmentAPIKey(ctx, bulker, index, rec.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read is realtime, the updates are visible without a refresh.
+	p, err := bulker.Read(ctx, index, rec.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var foundRec model.EnrollmentAPIKey
+	if err := json.Unmarshal(p, &foundRec); err != nil {
+		t.Fatal(err)
+	}
+	if foundRec.UsageCount != 2 {
+		t.Fatalf("expected usage count 2, got %d", foundRec.UsageCount)
+	}
+}
+
+func TestClaimEnrollmentAPIKeyConcurrent(t *testing.T) {
+	ctx, cn := context.WithCancel(context.Background())
+	defer cn()
+	ctx = testlog.SetLogger(t).WithContext(ctx)
+
+	index, bulker := ftesting.SetupCleanIndex(ctx, t, FleetEnrollmentAPIKeys)
+
+	const (
+		maxAgents   = 5
+		enrollments = 16
+	)
+	rec := createRandomEnrollmentAPIKey(uuid.Must(uuid.NewV4()).String(), true)
+	rec.MaxAgents = maxAgents
+	body, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = bulker.Create(ctx, index, rec.Id, body, bulk.WithRefresh()); err != nil {
+		t.Fatal(err)
+	}
+
+	usageCount := func() int64 {
+		t.Helper()
+		p, err := bulker.Read(ctx, index, rec.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var foundRec model.EnrollmentAPIKey
+		if err := json.Unmarshal(p, &foundRec); err != nil {
+			t.Fatal(err)
+		}
+		return foundRec.UsageCount
+	}
+
+	// The enrollments race on the same document, only max_agents of them claim a slot.
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		claimed   int
+		exhausted int
+		errs      []error
+	)
+	for i := 0; i < enrollments; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := claimEnrollmentAPIKey(ctx, bulker, index, rec.Id)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				claimed++
+			case errors.Is(err, ErrEnrollmentAPIKeyExhausted):
+				exhausted++
+			default:
+				errs = append(errs, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		t.Fatalf("unexpected claim errors: %v", errs)
+	}
+	if claimed != maxAgents || exhausted != enrollments-maxAgents {
+		t.Fatalf("expected %d claimed and %d exhausted, got %d and %d", maxAgents, enrollments-maxAgents, claimed, exhausted)
+	}
+	if n := usageCount(); n != maxAgents {
+		t.Fatalf("expected usage count %d, got %d", maxAgents, n)
+	}
+
+	// Racing releases never take the counter below zero.
+	for i := 0; i < enrollments; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := updateEnrollmentAPIKeyUsage(ctx, bulker, index, rec.Id, releaseEnrollmentAPIKeyScript)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		t.Fatalf("unexpected release errors: %v", errs)
+	}
+	if n := usageCount(); n != 0 {
+		t.Fatalf("expected usage count 0, got %d", n)
+	}
+}
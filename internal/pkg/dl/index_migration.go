@@ -0,0 +1,143 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package dl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+)
+
+const (
+	// indexMigrationsID is the id of the lease and of the document recording the applied version.
+	indexMigrationsID       = "fleet-server-index-migrations"
+	indexMigrationsLeaseTTL = 5 * time.Minute
+)
+
+// indexMigration is a versioned step of the setup of the fleet indices. The mappings are added to the index,
+// which is created if it is missing. A released step must not change, new mappings are added with a new step.
+type indexMigration struct {
+	version  int64
+	name     string
+	index    string
+	mappings string
+}
+
+// indexMigrations are the steps applied by MigrateIndices, in order of version.
+var indexMigrations = []indexMigration{{
+	version:  1,
+	name:     "IndexMigrations",
+	index:    FleetIndexMigrations,
+	mappings: `{"properties":{"@timestamp":{"type":"date"},"version":{"type":"long"}}}`,
+}, {
+	version:  2,
+	name:     "AgentLastCheckinIP",
+	index:    FleetAgents,
+	mappings: `{"properties":{"last_checkin_ip":{"type":"ip"}}}`,
+}, {
+	version:  3,
+	name:     "MonitorCheckpoints",
+	index:    FleetServers,
+	mappings: `{"properties":{"checkpoint":{"type":"long"},"index":{"type":"keyword"}}}`,
+}}
+
+// MigrateIndices adds the mappings that this version of fleet-server needs to the fleet indices, so that it
+// does not rely on Kibana to set them up.
+//
+// A single fleet-server applies the migrations, the one holding the migrations lease. The version of the last
+// applied step is recorded in an index of its own and the steps up to it are skipped, nothing is applied when
+// a newer setup recorded a version this fleet-server does not know. The steps of an index whose mappings are
+// managed by Kibana, or by Elasticsearch as a system index, are skipped, its mappings are left to their owner.
+func MigrateIndices(ctx context.Context, bulker bulk.Bulk, server model.ServerMetadata) error {
+	return migrateIndices(ctx, bulker, server, FleetPoliciesLeader, FleetIndexMigrations, indexMigrations)
+}
+
+func migrateIndices(ctx context.Context, bulker bulk.Bulk, server model.ServerMetadata, leaseIndex, stateIndex string, migrations []indexMigration) error {
+	log := zerolog.Ctx(ctx)
+	if len(migrations) == 0 {
+		return nil
+	}
+
+	leader, err := acquireLease(ctx, bulker, leaseIndex, indexMigrationsID, server, indexMigrationsLeaseTTL, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to acquire the index migrations lease: %w", err)
+	}
+	if !leader {
+		log.Info().Msg("index migrations are applied by another fleet-server")
+		return nil
+	}
+
+	applied, err := readIndexMigrations(ctx, bulker, stateIndex)
+	if err != nil {
+		return fmt.Errorf("failed to read the applied index migrations: %w", err)
+	}
+	if latest := migrations[len(migrations)-1].version; applied > latest {
+		log.Info().
+			Int64("fleet.migration.version", applied).
+			Int64("fleet.migration.latest", latest).
+			Msg("index migrations were applied by a newer setup, skipping")
+		return nil
+	}
+
+	for _, m := range migrations {
+		if m.version <= applied {
+			continue
+		}
+		managed, err := es.IndexManaged(ctx, bulker.Client(), m.index)
+		if err != nil {
+			return fmt.Errorf("failed to read the mappings of index migration %d %s: %w", m.version, m.name, err)
+		}
+		msg := "index migration applied"
+		if managed {
+			msg = "index mappings are managed by another setup, index migration skipped"
+		} else if err := es.PutMapping(ctx, bulker.Client(), m.index, []byte(m.mappings)); err != nil {
+			return fmt.Errorf("failed to apply index migration %d %s: %w", m.version, m.name, err)
+		}
+
+		doc := model.IndexMigrations{
+			Server:    &server,
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Version:   m.version,
+		}
+		body, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		if _, err := bulker.Index(ctx, stateIndex, indexMigrationsID, body, bulk.WithRefresh()); err != nil {
+			return fmt.Errorf("failed to record index migration %d %s: %w", m.version, m.name, err)
+		}
+		applied = m.version
+		log.Info().
+			Int64("fleet.migration.version", m.version).
+			Str("fleet.migration.name", m.name).
+			Str("fleet.migration.index", m.index).
+			Msg(msg)
+	}
+	return nil
+}
+
+// readIndexMigrations returns the version of the last applied index migration, 0 if none was applied.
+func readIndexMigrations(ctx context.Context, bulker bulk.Bulk, index string) (int64, error) {
+	data, err := bulker.Read(ctx, index, indexMigrationsID, bulk.WithRefresh())
+	if errors.Is(err, es.ErrElasticNotFound) || errors.Is(err, es.ErrIndexNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var doc model.IndexMigrations
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return 0, err
+	}
+	return doc.Version, nil
+}
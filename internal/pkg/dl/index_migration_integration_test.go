@@ -0,0 +1,128 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build integration
+
+package dl
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+func TestMigrateIndices(t *testing.T) {
+	ctx, cn := context.WithCancel(context.Background())
+	defer cn()
+	ctx = testlog.SetLogger(t).WithContext(ctx)
+
+	bulker := ftesting.SetupBulk(ctx, t)
+	server := model.ServerMetadata{ID: "server-1", Version: "8.16.0"}
+	leaseIndex := xid.New().String()
+	stateIndex := xid.New().String()
+	index := xid.New().String()
+
+	migrations := []indexMigration{{
+		version:  1,
+		name:     "Create",
+		index:    index,
+		mappings: `{"properties":{"name":{"type":"keyword"}}}`,
+	}, {
+		version:  2,
+		name:     "AddField",
+		index:    index,
+		mappings: `{"properties":{"address":{"type":"ip"}}}`,
+	}}
+
+	// The second run finds the migrations applied and changes nothing.
+	for i := 0; i < 2; i++ {
+		err := migrateIndices(ctx, bulker, server, leaseIndex, stateIndex, migrations)
+		require.NoError(t, err, "run %d", i+1)
+
+		version, err := readIndexMigrations(ctx, bulker, stateIndex)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), version)
+	}
+
+	res, err := bulker.Client().Indices.GetMapping(bulker.Client().Indices.GetMapping.WithIndex(index))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	var mappings map[string]struct {
+		Mappings struct {
+			Properties map[string]struct {
+				Type string `json:"type"`
+			} `json:"properties"`
+		} `json:"mappings"`
+	}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&mappings))
+	props := mappings[index].Mappings.Properties
+	assert.Equal(t, "keyword", props["name"].Type)
+	assert.Equal(t, "ip", props["address"].Type)
+
+	t.Run("managed index", func(t *testing.T) {
+		managed := xid.New().String()
+		res, err := bulker.Client().Indices.Create(managed, bulker.Client().Indices.Create.WithBody(
+			strings.NewReader(`{"mappings":{"_meta":{"managed":true},"properties":{"name":{"type":"keyword"}}}}`),
+		))
+		require.NoError(t, err)
+		res.Body.Close()
+		require.False(t, res.IsError(), res.String())
+
+		stateIndex := xid.New().String()
+		err = migrateIndices(ctx, bulker, server, leaseIndex, stateIndex, []indexMigration{{
+			version:  1,
+			name:     "Managed",
+			index:    managed,
+			mappings: `{"properties":{"address":{"type":"ip"}}}`,
+		}})
+		require.NoError(t, err)
+
+		// The step is recorded so that it is not checked again, the mappings are left to their owner.
+		version, err := readIndexMigrations(ctx, bulker, stateIndex)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), version)
+
+		res, err = bulker.Client().Indices.GetMapping(bulker.Client().Indices.GetMapping.WithIndex(managed))
+		require.NoError(t, err)
+		defer res.Body.Close()
+		var mappings map[string]struct {
+			Mappings struct {
+				Properties map[string]interface{} `json:"properties"`
+			} `json:"mappings"`
+		}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&mappings))
+		assert.NotContains(t, mappings[managed].Mappings.Properties, "address")
+	})
+
+	t.Run("newer setup", func(t *testing.T) {
+		body, err := json.Marshal(model.IndexMigrations{Version: 10})
+		require.NoError(t, err)
+		_, err = bulker.Index(ctx, stateIndex, indexMigrationsID, body, bulk.WithRefresh())
+		require.NoError(t, err)
+
+		other := xid.New().String()
+		err = migrateIndices(ctx, bulker, server, leaseIndex, stateIndex, []indexMigration{{
+			version:  3,
+			name:     "Skipped",
+			index:    other,
+			mappings: `{"properties":{"name":{"type":"keyword"}}}`,
+		}})
+		require.NoError(t, err)
+
+		res, err := bulker.Client().Indices.Exists([]string{other})
+		require.NoError(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, 404, res.StatusCode, "no migration is applied over a newer setup")
+	})
+}
@@ -0,0 +1,65 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package dl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+)
+
+const (
+	// takeLeaseScript takes the lease when it is held by the same server or was not renewed before the ttl.
+	takeLeaseScript = `if (ctx._source.server != null && ctx._source.server.id != params.server.id && ctx._source['@timestamp'] != null && ZonedDateTime.parse(ctx._source['@timestamp']).toInstant().toEpochMilli() > params.expired_before) { ctx.op = 'noop' } else { ctx._source.server = params.server; ctx._source['@timestamp'] = params.timestamp }`
+
+	leaseRetryOnConflict = 3
+)
+
+// AcquireLease takes or renews the lease named name for the server.
+//
+// Leases are documents in the policies leader index. A lease held by another server is taken over once
+// it has not been renewed for the ttl, so a single fleet-server holds the lease while it keeps renewing it
+// within the ttl. It returns true when the server holds the lease.
+func AcquireLease(ctx context.Context, bulker bulk.Bulk, name string, server model.ServerMetadata, ttl time.Duration) (bool, error) {
+	return acquireLease(ctx, bulker, FleetPoliciesLeader, name, server, ttl, time.Now())
+}
+
+func acquireLease(ctx context.Context, bulker bulk.Bulk, index, name string, server model.ServerMetadata, ttl time.Duration, now time.Time) (bool, error) {
+	var lease model.PolicyLeader
+	lease.Server = &server
+	lease.SetTime(now.UTC())
+
+	body, err := json.Marshal(map[string]interface{}{
+		"script": map[string]interface{}{
+			"lang":   "painless",
+			"source": takeLeaseScript,
+			"params": map[string]interface{}{
+				"server":         lease.Server,
+				"timestamp":      lease.Timestamp,
+				"expired_before": now.Add(-ttl).UnixMilli(),
+			},
+		},
+		"upsert": lease,
+	})
+	if err != nil {
+		return false, err
+	}
+	items, err := bulker.MUpdate(ctx, []bulk.MultiOp{{
+		ID:    name,
+		Index: index,
+		Body:  body,
+	}}, bulk.WithRetryOnConflict(leaseRetryOnConflict))
+	if err != nil {
+		return false, err
+	}
+	if len(items) != 1 {
+		return false, fmt.Errorf("unexpected update response count %d", len(items))
+	}
+	return items[0].Result != "noop", nil
+}
@@ -0,0 +1,60 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package dl
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+)
+
+func TestAcquireLease(t *testing.T) {
+	now := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	server := model.ServerMetadata{ID: "server-1", Version: "8.16.0"}
+
+	for result, leader := range map[string]bool{
+		"created": true,
+		"updated": true,
+		"noop":    false,
+	} {
+		t.Run(result, func(t *testing.T) {
+			mBulk := ftesting.NewMockBulk()
+			mBulk.On("MUpdate", mock.Anything, mock.MatchedBy(func(ops []bulk.MultiOp) bool {
+				if len(ops) != 1 || ops[0].ID != "test-lease" || ops[0].Index != FleetPoliciesLeader {
+					return false
+				}
+				var body struct {
+					Script struct {
+						Params struct {
+							Server        model.ServerMetadata `json:"server"`
+							ExpiredBefore int64                `json:"expired_before"`
+						} `json:"params"`
+					} `json:"script"`
+					Upsert model.PolicyLeader `json:"upsert"`
+				}
+				if err := json.Unmarshal(ops[0].Body, &body); err != nil {
+					return false
+				}
+				return body.Script.Params.Server == server &&
+					body.Script.Params.ExpiredBefore == now.Add(-time.Minute).UnixMilli() &&
+					body.Upsert.Server != nil && *body.Upsert.Server == server
+			}), mock.Anything).Return([]bulk.BulkIndexerResponseItem{{Result: result}}, nil)
+
+			ok, err := acquireLease(context.Background(), mBulk, FleetPoliciesLeader, "test-lease", server, time.Minute, now)
+			require.NoError(t, err)
+			assert.Equal(t, leader, ok)
+			mBulk.AssertExpectations(t)
+		})
+	}
+}
@@ -0,0 +1,18 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package dl
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var agentUpdateConflictRetries = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "dl",
+	Name:      "agent_update_conflict_retries_total",
+	Help:      "Number of agent document updates retried because another writer changed the document since it was read.",
+})
+
+// MetricsCollectors returns the prometheus collectors of the data layer.
+func MetricsCollectors() []prometheus.Collector {
+	return []prometheus.Collector{agentUpdateConflictRetries}
+}
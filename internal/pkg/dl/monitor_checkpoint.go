@@ -0,0 +1,68 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package dl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	"github.com/elastic/fleet-server/v7/internal/pkg/sqn"
+)
+
+// MonitorCheckpoints stores the checkpoints processed by the index monitors of a fleet-server, so that they resume
+// from them after a restart. There is a document per server and monitored index in the fleet-servers index.
+type MonitorCheckpoints struct {
+	bulker bulk.Bulk
+	server model.ServerMetadata
+}
+
+// NewMonitorCheckpoints returns the checkpoint store of the server.
+func NewMonitorCheckpoints(bulker bulk.Bulk, server model.ServerMetadata) *MonitorCheckpoints {
+	return &MonitorCheckpoints{
+		bulker: bulker,
+		server: server,
+	}
+}
+
+func (c *MonitorCheckpoints) id(index string) string {
+	return c.server.ID + ":checkpoint:" + index
+}
+
+// LoadCheckpoint returns the stored checkpoint of the index, it is not set if none was stored.
+func (c *MonitorCheckpoints) LoadCheckpoint(ctx context.Context, index string) (sqn.SeqNo, error) {
+	data, err := c.bulker.Read(ctx, FleetServers, c.id(index))
+	if errors.Is(err, es.ErrElasticNotFound) || errors.Is(err, es.ErrIndexNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var doc model.MonitorCheckpoint
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return doc.Checkpoint, nil
+}
+
+// SaveCheckpoint stores the checkpoint of the index.
+func (c *MonitorCheckpoints) SaveCheckpoint(ctx context.Context, index string, checkpoint sqn.SeqNo) error {
+	doc := model.MonitorCheckpoint{
+		Checkpoint: checkpoint,
+		Index:      index,
+		Server:     &c.server,
+		Timestamp:  time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = c.bulker.Index(ctx, FleetServers, c.id(index), body)
+	return err
+}
@@ -0,0 +1,57 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package dl
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	"github.com/elastic/fleet-server/v7/internal/pkg/sqn"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+)
+
+func TestMonitorCheckpoints(t *testing.T) {
+	ctx := context.Background()
+	server := model.ServerMetadata{ID: "server-1", Version: "8.16.0"}
+	const id = "server-1:checkpoint:" + FleetActions
+
+	t.Run("not stored", func(t *testing.T) {
+		mBulk := ftesting.NewMockBulk()
+		mBulk.On("Read", mock.Anything, FleetServers, id, mock.Anything).Return([]byte(nil), es.ErrElasticNotFound)
+
+		checkpoint, err := NewMonitorCheckpoints(mBulk, server).LoadCheckpoint(ctx, FleetActions)
+		require.NoError(t, err)
+		assert.False(t, checkpoint.IsSet())
+	})
+
+	t.Run("save and load", func(t *testing.T) {
+		var stored []byte
+		mBulk := ftesting.NewMockBulk()
+		mBulk.On("Index", mock.Anything, FleetServers, id, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			stored = args.Get(3).([]byte)
+		}).Return(id, nil)
+		checkpoints := NewMonitorCheckpoints(mBulk, server)
+		require.NoError(t, checkpoints.SaveCheckpoint(ctx, FleetActions, sqn.SeqNo{42}))
+
+		var doc model.MonitorCheckpoint
+		require.NoError(t, json.Unmarshal(stored, &doc))
+		assert.Equal(t, FleetActions, doc.Index)
+		assert.Equal(t, []int64{42}, doc.Checkpoint)
+		assert.Equal(t, server, *doc.Server)
+		assert.NotEmpty(t, doc.Timestamp)
+
+		mBulk.On("Read", mock.Anything, FleetServers, id, mock.Anything).Return(stored, nil)
+		checkpoint, err := checkpoints.LoadCheckpoint(ctx, FleetActions)
+		require.NoError(t, err)
+		assert.Equal(t, sqn.SeqNo{42}, checkpoint)
+	})
+}
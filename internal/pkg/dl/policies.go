@@ -22,6 +22,7 @@ var (
 	tmplQueryLatestPolicies = prepareQueryLatestPolicies()
 	ErrMissingAggregations  = errors.New("missing expected aggregation result")
 	tmplQueryPolicies       = prepareQueryPolicies()
+	QueryLatestPolicy       = prepareFindLatestPolicy()
 )
 
 func prepareQueryLatestPolicies() []byte {
@@ -67,6 +68,40 @@ func QueryLatestPolicies(ctx context.Context, bulker bulk.Bulk, opt ...Option) (
 	return policies, nil
 }
 
+func prepareFindLatestPolicy() *dsl.Tmpl {
+	tmpl := dsl.NewTmpl()
+	root := dsl.NewRoot()
+	root.Query().Bool().Filter().Term(FieldPolicyID, tmpl.Bind(FieldPolicyID), nil)
+	root.Sort().SortOrder(FieldRevisionIdx, dsl.SortDescend)
+	root.Size(1)
+	tmpl.MustResolve(root)
+	return tmpl
+}
+
+// FindLatestPolicy gets the latest revision of the policy, or ErrNotFound if the policy does not exist.
+func FindLatestPolicy(ctx context.Context, bulker bulk.Bulk, policyID string, opt ...Option) (*model.Policy, error) {
+	o := newOption(FleetPolicies, opt...)
+	res, err := Search(ctx, bulker, QueryLatestPolicy, o.indexName, map[string]interface{}{
+		FieldPolicyID: policyID,
+	})
+	if err != nil {
+		if errors.Is(err, es.ErrIndexNotFound) {
+			zerolog.Ctx(ctx).Debug().Str("index", o.indexName).Msg(es.ErrIndexNotFound.Error())
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if len(res.Hits) == 0 {
+		return nil, ErrNotFound
+	}
+
+	var policy model.Policy
+	if err := res.Hits[0].Unmarshal(&policy); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
 // CreatePolicy creates a new policy in the index
 func CreatePolicy(ctx context.Context, bulker bulk.Bulk, policy model.Policy, opt ...Option) (string, error) {
 	o := newOption(FleetPolicies, opt...)
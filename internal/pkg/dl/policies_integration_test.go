@@ -86,6 +86,27 @@ func TestQueryLatestPolicies(t *testing.T) {
 	}
 }
 
+func TestFindLatestPolicy(t *testing.T) {
+	ctx, cn := context.WithCancel(context.Background())
+	defer cn()
+	ctx = testlog.SetLogger(t).WithContext(ctx)
+
+	index, bulker := ftesting.SetupCleanIndex(ctx, t, FleetPolicies)
+
+	rec, err := storeRandomPolicy(ctx, bulker, index)
+	require.NoError(t, err)
+	_, err = storeRandomPolicy(ctx, bulker, index)
+	require.NoError(t, err)
+
+	policy, err := FindLatestPolicy(ctx, bulker, rec.PolicyID, WithIndexName(index))
+	require.NoError(t, err)
+	require.Equal(t, rec.PolicyID, policy.PolicyID)
+	require.Equal(t, rec.RevisionIdx, policy.RevisionIdx)
+
+	_, err = FindLatestPolicy(ctx, bulker, "missing", WithIndexName(index))
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
 func TestCreatePolicy(t *testing.T) {
 	ctx, cn := context.WithCancel(context.Background())
 	defer cn()
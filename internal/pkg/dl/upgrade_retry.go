@@ -0,0 +1,220 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package dl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dsl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+)
+
+const (
+	// UpgradeStatusRetryScheduled is the upgrade status of an agent whose failed upgrade is retried after a delay.
+	UpgradeStatusRetryScheduled = "retry_scheduled"
+
+	FieldTimestampAfter = "timestamp_after"
+
+	fieldFailedActionResultsAfter = "failed_action_results_after"
+
+	actionTypeUpgrade = "UPGRADE"
+
+	// Fields of the upgrade action data written to the retries.
+	fieldRetryCount = "retry_count"
+	fieldRetryOf    = "retry_of"
+)
+
+var (
+	// QueryFailedActionResultsInRange finds the failed results that the upgrade retries are scheduled from.
+	QueryFailedActionResultsInRange      = prepareFindFailedActionResultsInRange(false)
+	QueryFailedActionResultsInRangeAfter = prepareFindFailedActionResultsInRange(true)
+)
+
+// prepareFindFailedActionResultsInRange returns the query of a page of the failed results sorted by timestamp, action
+// ID and agent ID, the page follows the sort values of a result when after is true. There is one result per action
+// and agent, the _id of the results is not sorted on as Elasticsearch does not allow it by default.
+func prepareFindFailedActionResultsInRange(after bool) *dsl.Tmpl {
+	tmpl := dsl.NewTmpl()
+	root := dsl.NewRoot()
+	root.Query().Bool().Must().Exists(FieldError)
+	filter := root.Query().Bool().Filter()
+	filter.Range(FieldTimestamp, dsl.WithRangeGT(tmpl.Bind(FieldTimestampAfter)), dsl.WithRangeLTE(tmpl.Bind(FieldTimestamp)))
+	root.Source().Includes(FieldActionID, FieldAgentID, FieldError, FieldTimestamp)
+	sort := root.Sort()
+	sort.SortOrder(FieldTimestamp, dsl.SortAscend)
+	sort.SortOrder(FieldActionID, dsl.SortAscend)
+	sort.SortOrder(FieldAgentID, dsl.SortAscend)
+	if after {
+		root.Param("search_after", tmpl.Bind(fieldFailedActionResultsAfter))
+	}
+	root.WithSize(tmpl.Bind(FieldSize))
+	tmpl.MustResolve(root)
+	return tmpl
+}
+
+// FindFailedActionResultsInRange returns a page of up to size results with an error whose timestamp is after after
+// and at or before before, ordered by timestamp, action ID and agent ID. Only the action id, agent id, error and timestamp are loaded.
+// The page follows the sort values searchAfter, unless it is empty, and the sort values of its last result are
+// returned to fetch the next page.
+func FindFailedActionResultsInRange(ctx context.Context, bulker bulk.Bulk, after, before time.Time, searchAfter []interface{}, size int) ([]model.ActionResult, []interface{}, error) {
+	tmpl := QueryFailedActionResultsInRange
+	params := map[string]interface{}{
+		FieldTimestampAfter: after.UTC().Format(time.RFC3339Nano),
+		FieldTimestamp:      before.UTC().Format(time.RFC3339Nano),
+		FieldSize:           size,
+	}
+	if len(searchAfter) > 0 {
+		tmpl = QueryFailedActionResultsInRangeAfter
+		params[fieldFailedActionResultsAfter] = searchAfter
+	}
+	res, err := Search(ctx, bulker, tmpl, FleetActionsResults, params)
+	if err != nil {
+		if errors.Is(err, es.ErrIndexNotFound) {
+			zerolog.Ctx(ctx).Debug().Str("index", FleetActionsResults).Msg(es.ErrIndexNotFound.Error())
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	results := make([]model.ActionResult, 0, len(res.Hits))
+	for _, hit := range res.Hits {
+		var acr model.ActionResult
+		if err := hit.Unmarshal(&acr); err != nil {
+			return nil, nil, err
+		}
+		results = append(results, acr)
+	}
+	if len(res.Hits) == 0 {
+		return results, nil, nil
+	}
+	return results, res.Hits[len(res.Hits)-1].Sort, nil
+}
+
+// UpgradeRetry is the automatic retry of an upgrade action that failed, it's configured with a retry_delay list of
+// durations in the action data. Each retry is a new upgrade action for the agent that failed, written with the next
+// delay and a retry_count, until the delays are exhausted.
+type UpgradeRetry struct {
+	// Delays are the delays before each retry.
+	Delays []time.Duration
+	// Count is the number of retries before the action, 0 for the original action.
+	Count int
+	// RetryOf is the ID of the original action.
+	RetryOf string
+}
+
+// ParseUpgradeRetry returns the retry of the action, ok is false if the action is not an upgrade that is retried.
+// Signed actions are not retried, as the retry could not be signed.
+func ParseUpgradeRetry(action model.Action) (retry UpgradeRetry, ok bool, err error) {
+	if action.Type != actionTypeUpgrade || action.Signed != nil || len(action.Data) == 0 {
+		return retry, false, nil
+	}
+	var data struct {
+		RetryDelay []string `json:"retry_delay"`
+		RetryCount int      `json:"retry_count"`
+		RetryOf    string   `json:"retry_of"`
+	}
+	if err := json.Unmarshal(action.Data, &data); err != nil {
+		return retry, false, fmt.Errorf("upgrade action %s data: %w", action.ActionID, err)
+	}
+	if len(data.RetryDelay) == 0 {
+		return retry, false, nil
+	}
+	retry.Delays = make([]time.Duration, 0, len(data.RetryDelay))
+	for _, s := range data.RetryDelay {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return UpgradeRetry{}, false, fmt.Errorf("upgrade action %s retry_delay %q is not a duration", action.ActionID, s)
+		}
+		retry.Delays = append(retry.Delays, d)
+	}
+	retry.Count = data.RetryCount
+	retry.RetryOf = data.RetryOf
+	if retry.RetryOf == "" {
+		retry.RetryOf = action.ActionID
+	}
+	return retry, true, nil
+}
+
+// Exhausted returns true if the action is the last retry.
+func (r UpgradeRetry) Exhausted() bool {
+	return r.Count >= len(r.Delays)
+}
+
+// UpgradeRetryActionID returns the ID of the count-th retry of the original action for the agent.
+// The ID is the same whichever fleet-server writes the retry, so a retry is never written twice.
+func UpgradeRetryActionID(retryOf, agentID string, count int) string {
+	return fmt.Sprintf("%s:retry-%d:%s", retryOf, count, agentID)
+}
+
+// NewUpgradeRetryAction returns the next retry of the action for the agent whose upgrade failed at failedAt.
+// The retry starts after the next delay, it expires after as long as the action did.
+func NewUpgradeRetryAction(action model.Action, retry UpgradeRetry, agentID string, failedAt, now time.Time) (model.Action, error) {
+	if retry.Exhausted() {
+		return model.Action{}, fmt.Errorf("upgrade action %s has no retry left", action.ActionID)
+	}
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal(action.Data, &data); err != nil {
+		return model.Action{}, fmt.Errorf("upgrade action %s data: %w", action.ActionID, err)
+	}
+	count := retry.Count + 1
+	data[fieldRetryCount] = json.RawMessage(fmt.Sprint(count))
+	retryOf, err := json.Marshal(retry.RetryOf)
+	if err != nil {
+		return model.Action{}, err
+	}
+	data[fieldRetryOf] = retryOf
+	body, err := json.Marshal(data)
+	if err != nil {
+		return model.Action{}, err
+	}
+
+	start := failedAt.Add(retry.Delays[retry.Count]).UTC()
+	retryAction := model.Action{
+		ActionID:                 UpgradeRetryActionID(retry.RetryOf, agentID, count),
+		Agents:                   []string{agentID},
+		Data:                     body,
+		InputType:                action.InputType,
+		MinimumExecutionDuration: action.MinimumExecutionDuration,
+		Namespaces:               action.Namespaces,
+		StartTime:                start.Format(time.RFC3339),
+		Timeout:                  action.Timeout,
+		Timestamp:                now.UTC().Format(time.RFC3339),
+		Type:                     action.Type,
+		UserID:                   action.UserID,
+	}
+	if action.Expiration != "" {
+		ttl, err := actionTTL(action)
+		if err != nil {
+			return model.Action{}, err
+		}
+		retryAction.Expiration = start.Add(ttl).Format(time.RFC3339)
+	}
+	return retryAction, nil
+}
+
+// actionTTL returns how long the action is valid, from its start time or its creation if it has none.
+func actionTTL(action model.Action) (time.Duration, error) {
+	expiration, err := time.Parse(time.RFC3339, action.Expiration)
+	if err != nil {
+		return 0, fmt.Errorf("upgrade action %s expiration: %w", action.ActionID, err)
+	}
+	from := action.StartTime
+	if from == "" {
+		from = action.Timestamp
+	}
+	start, err := time.Parse(time.RFC3339, from)
+	if err != nil {
+		return 0, fmt.Errorf("upgrade action %s start: %w", action.ActionID, err)
+	}
+	return max(expiration.Sub(start), 0), nil
+}
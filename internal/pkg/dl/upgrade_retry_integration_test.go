@@ -0,0 +1,74 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build integration
+
+package dl
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+func TestFindFailedActionResultsInRangePages(t *testing.T) {
+	ctx, cn := context.WithCancel(context.Background())
+	defer cn()
+	ctx = testlog.SetLogger(t).WithContext(ctx)
+
+	index, bulker := ftesting.SetupCleanIndex(ctx, t, FleetActionsResults)
+	now := time.Now().UTC().Truncate(time.Second)
+	failedAt := now.Add(-time.Minute)
+
+	// The failed results share a timestamp, so the pages only move forward on the action and agent IDs.
+	actionID := uuid.Must(uuid.NewV4()).String()
+	want := make([]string, 0, 5)
+	for i := 0; i < 5; i++ {
+		acr := model.ActionResult{
+			ActionID:  actionID,
+			AgentID:   fmt.Sprintf("agent-%d", i),
+			Error:     "upgrade failed",
+			Timestamp: failedAt.Format(time.RFC3339),
+		}
+		require.NoError(t, createActionResult(ctx, bulker, index, acr, false))
+		want = append(want, acr.AgentID)
+	}
+	require.NoError(t, createActionResult(ctx, bulker, index, model.ActionResult{
+		ActionID:  actionID,
+		AgentID:   "agent-ok",
+		Timestamp: failedAt.Format(time.RFC3339),
+	}, false))
+	require.NoError(t, createActionResult(ctx, bulker, index, model.ActionResult{
+		ActionID:  actionID,
+		AgentID:   "agent-old",
+		Error:     "upgrade failed",
+		Timestamp: now.Add(-2 * time.Hour).Format(time.RFC3339),
+	}, false))
+
+	var got []string
+	var searchAfter []interface{}
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, 5, "the pages do not move forward")
+		results, next, err := FindFailedActionResultsInRange(ctx, bulker, now.Add(-time.Hour), now, searchAfter, 2)
+		require.NoError(t, err)
+		for _, acr := range results {
+			got = append(got, acr.AgentID)
+		}
+		if len(results) < 2 {
+			break
+		}
+		require.NotEmpty(t, next)
+		searchAfter = next
+	}
+	assert.Equal(t, want, got)
+}
@@ -20,10 +20,13 @@ const (
 	kKeywordMax         = "max"
 	kKeywordMust        = "must"
 	kKeywordMustNot     = "must_not"
+	kKeywordMinShould   = "minimum_should_match"
 	kKeywordNULL        = "null"
 	kKeywordParams      = "params"
 	kKeywordQuery       = "query"
+	kKeywordQueryString = "query_string"
 	kKeywordScript      = "script"
+	kKeywordShould      = "should"
 	kKeywordSize        = "size"
 	kKeywordSort        = "sort"
 	kKeywordSource      = "_source"
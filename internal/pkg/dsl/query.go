@@ -27,3 +27,21 @@ func (n *Node) MustNot() *Node {
 	}
 	return childNode
 }
+
+func (n *Node) Should() *Node {
+	childNode := n.findOrCreateChildByName(kKeywordShould)
+	if childNode.nodeList == nil {
+		childNode.nodeList = nodeListT{}
+	}
+	return childNode
+}
+
+// MinimumShouldMatch sets the number of should clauses a document must match.
+func (n *Node) MinimumShouldMatch(v interface{}) {
+	n.Param(kKeywordMinShould, v)
+}
+
+// AppendBool adds a nested bool query to a list of clauses, such as a filter or should list.
+func (n *Node) AppendBool() *Node {
+	return n.appendOrSetChildNode(kKeywordBool)
+}
@@ -0,0 +1,11 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package dsl
+
+// QueryString adds a query_string query, the field names in the query may contain wildcards.
+func (n *Node) QueryString(query interface{}) {
+	childNode := n.appendOrSetChildNode(kKeywordQueryString)
+	childNode.nodeMap = nodeMapT{kKeywordQuery: &Node{leaf: query}}
+}
@@ -11,9 +11,12 @@ import (
 	"runtime"
 
 	"go.elastic.co/apm/module/apmelasticsearch/v2"
+	"go.elastic.co/apm/module/apmhttp/v2"
+	"go.elastic.co/apm/v2"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/build"
 	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
 	"github.com/rs/zerolog"
 
 	"github.com/elastic/go-elasticsearch/v8"
@@ -22,17 +25,29 @@ import (
 type ConfigOption func(config *elasticsearch.Config)
 
 func NewClient(ctx context.Context, cfg *config.Config, longPoll bool, opts ...ConfigOption) (*elasticsearch.Client, error) {
-	escfg, err := cfg.Output.Elasticsearch.ToESConfig(longPoll)
+	return NewOutputClient(ctx, &cfg.Output.Elasticsearch, longPoll, opts...)
+}
+
+// NewOutputClient creates a client for the given elasticsearch output.
+func NewOutputClient(ctx context.Context, output *config.Elasticsearch, longPoll bool, opts ...ConfigOption) (*elasticsearch.Client, error) {
+	escfg, err := output.ToESConfig(longPoll)
 	if err != nil {
 		return nil, err
 	}
-	addr := cfg.Output.Elasticsearch.Hosts
-	mcph := cfg.Output.Elasticsearch.MaxConnPerHost
+	addr := output.Hosts
+	mcph := output.Pool().MaxConnsPerHost
+
+	if t, ok := escfg.Transport.(*http.Transport); ok {
+		escfg.Transport = withConnMetrics(t)
+	}
 
 	// Apply configuration options
 	for _, opt := range opts {
 		opt(&escfg)
 	}
+	if escfg.Transport != nil {
+		escfg.Transport = &traceparentTransport{next: escfg.Transport}
+	}
 
 	zlog := zerolog.Ctx(ctx).With().
 		Strs("cluster.addr", addr).
@@ -78,6 +93,27 @@ func InstrumentRoundTripper() ConfigOption {
 	}
 }
 
+// traceparentTransport sets the traceparent header of the requests to the trace context of their context
+// so the Elasticsearch audit and slow logs can be joined with the fleet-server logs.
+// Requests that already have the header, or that are traced by APM, are not changed.
+type traceparentTransport struct {
+	next http.RoundTripper
+}
+
+func (t *traceparentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get(apmhttp.W3CTraceparentHeader) != "" || apm.TransactionFromContext(req.Context()) != nil {
+		return t.next.RoundTrip(req)
+	}
+	tc, ok := logger.TraceContextFromContext(req.Context())
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	// A RoundTripper must not modify the request.
+	req = req.Clone(req.Context())
+	req.Header.Set(apmhttp.W3CTraceparentHeader, apmhttp.FormatTraceparentHeader(tc))
+	return t.next.RoundTrip(req)
+}
+
 func userAgent(name string, bi build.Info) string {
 	return fmt.Sprintf("Elastic-%s/%s (%s; %s; %s; %s)",
 		name,
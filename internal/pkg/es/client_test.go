@@ -15,8 +15,10 @@ import (
 
 	"github.com/elastic/elastic-agent-libs/transport/tlscommon"
 	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
 	"github.com/elastic/fleet-server/v7/internal/pkg/testing/certs"
 	"github.com/stretchr/testify/require"
+	"go.elastic.co/apm/module/apmhttp/v2"
 )
 
 var enabled bool = true
@@ -162,3 +164,46 @@ func TestClientCerts(t *testing.T) {
 		require.Error(t, err)
 	})
 }
+
+func TestClientTraceparent(t *testing.T) {
+	headers := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Get("traceparent")
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		fmt.Fprintln(w, "You know, For Search.")
+	}))
+	defer server.Close()
+
+	client, err := NewClient(context.Background(), &config.Config{
+		Output: config.Output{
+			Elasticsearch: config.Elasticsearch{
+				Protocol: "http",
+				Hosts:    []string{server.URL},
+			},
+		},
+	}, false)
+	require.NoError(t, err)
+
+	t.Run("request with a trace context", func(t *testing.T) {
+		tc := logger.NewTraceContext()
+		req, err := http.NewRequestWithContext(logger.ContextWithTraceContext(context.Background(), tc), "GET", server.URL, nil)
+		require.NoError(t, err)
+
+		resp, err := client.Perform(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, apmhttp.FormatTraceparentHeader(tc), <-headers)
+	})
+
+	t.Run("request without a trace context", func(t *testing.T) {
+		req, err := http.NewRequestWithContext(context.Background(), "GET", server.URL, nil)
+		require.NoError(t, err)
+
+		resp, err := client.Perform(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Empty(t, <-headers)
+	})
+}
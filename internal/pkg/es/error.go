@@ -15,6 +15,7 @@ const (
 	unknownErrorType         = "unknown_error"
 	timeoutErrorType         = "timeout_exception"
 	indexNotFoundErrorType   = "index_not_found_exception"
+	indexClosedErrorType     = "index_closed_exception"
 	versionConflictErrorType = "version_conflict_engine_exception"
 )
 
@@ -33,6 +34,8 @@ type ErrElastic struct {
 func (e *ErrElastic) Unwrap() error {
 	if e.Type == indexNotFoundErrorType {
 		return ErrIndexNotFound
+	} else if e.Type == indexClosedErrorType {
+		return ErrIndexClosed
 	} else if e.Type == timeoutErrorType {
 		return ErrTimeout
 	}
@@ -72,12 +75,14 @@ var (
 	ErrElasticNotFound        = errors.New("elastic not found")
 	ErrInvalidBody            = errors.New("invalid body")
 	ErrIndexNotFound          = errors.New("index not found")
+	ErrIndexClosed            = errors.New("index closed")
 	ErrTimeout                = errors.New("timeout")
 	ErrNotFound               = errors.New("not found")
 
-	knownErrorTypes = [3]string{
+	knownErrorTypes = [4]string{
 		timeoutErrorType,
 		indexNotFoundErrorType,
+		indexClosedErrorType,
 		versionConflictErrorType,
 	}
 
@@ -87,6 +92,8 @@ var (
 	errorTranslationMap = map[string]string{
 		ErrIndexNotFound.Error():              indexNotFoundErrorType,
 		"IndexNotFoundException":              indexNotFoundErrorType,
+		ErrIndexClosed.Error():                indexClosedErrorType,
+		"IndexClosedException":                indexClosedErrorType,
 		ErrTimeout.Error():                    timeoutErrorType,
 		"ElasticsearchTimeoutException":       timeoutErrorType,
 		"ProcessClusterEventTimeoutException": timeoutErrorType,
@@ -185,6 +185,19 @@ func TestErrorTranslation(t *testing.T) {
 			indexNotFoundErrorType,
 			"IndexNotFoundException[no such index [.fleet-actions]]",
 		},
+		{
+			400,
+			"detailed index closed json",
+			[]byte(`{
+				"type": "index_closed_exception",
+				"reason": "closed",
+				"index_uuid": "pVpHV-bIRMuW0kM6f13UPw",
+				"index": ".fleet-agents-7"
+			  }`),
+			true,
+			indexClosedErrorType,
+			"closed",
+		},
 	}
 
 	for _, tc := range testCases {
@@ -209,6 +222,15 @@ func TestErrorTranslation(t *testing.T) {
 	}
 }
 
+func TestErrorUnwrap(t *testing.T) {
+	err := TranslateError(404, errorTinBytes(ErrorT{Type: indexNotFoundErrorType, Reason: "no such index"}))
+	require.ErrorIs(t, err, ErrIndexNotFound)
+
+	err = TranslateError(400, errorTinBytes(ErrorT{Type: indexClosedErrorType, Reason: "closed"}))
+	require.ErrorIs(t, err, ErrIndexClosed)
+	require.NotErrorIs(t, err, ErrIndexNotFound)
+}
+
 func errorTinBytes(e ErrorT) []byte {
 	b, _ := json.Marshal(e)
 	return b
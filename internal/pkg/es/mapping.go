@@ -0,0 +1,114 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package es
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+const resourceAlreadyExistsErrorType = "resource_already_exists_exception"
+
+// PutMapping adds the field mappings to the index, the index is created with the mappings if it does not exist.
+// Adding mappings that the index already has is a no-op.
+func PutMapping(ctx context.Context, es *elasticsearch.Client, index string, mappings []byte) error {
+	err := putMapping(ctx, es, index, mappings)
+	if !errors.Is(err, ErrIndexNotFound) {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]json.RawMessage{"mappings": mappings})
+	if err != nil {
+		return err
+	}
+	res, err := es.Indices.Create(index,
+		es.Indices.Create.WithBody(bytes.NewReader(body)),
+		es.Indices.Create.WithContext(ctx),
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	err = decodeAck(res.StatusCode, res.Body)
+	var esErr *ErrElastic
+	if errors.As(err, &esErr) && esErr.Type == resourceAlreadyExistsErrorType {
+		// The index was created concurrently, add the mappings to it.
+		return putMapping(ctx, es, index, mappings)
+	}
+	return err
+}
+
+// IndexManaged returns true if the mappings of the index are managed by Kibana or by Elasticsearch as a system
+// index, both record it in the _meta of the mappings. It returns false if the index does not exist.
+func IndexManaged(ctx context.Context, es *elasticsearch.Client, index string) (bool, error) {
+	res, err := es.Indices.GetMapping(
+		es.Indices.GetMapping.WithIndex(index),
+		es.Indices.GetMapping.WithContext(ctx),
+	)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if res.IsError() {
+		var eres struct {
+			Error json.RawMessage `json:"error"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&eres); err != nil {
+			return false, err
+		}
+		return false, TranslateError(res.StatusCode, eres.Error)
+	}
+
+	// The mappings are keyed by the concrete index, the index may be an alias.
+	var indices map[string]struct {
+		Mappings struct {
+			Meta map[string]interface{} `json:"_meta"`
+		} `json:"mappings"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&indices); err != nil {
+		return false, err
+	}
+	for _, idx := range indices {
+		if managed, _ := idx.Mappings.Meta["managed"].(bool); managed {
+			return true, nil
+		}
+		if _, ok := idx.Mappings.Meta["managed_index_mappings_version"]; ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func putMapping(ctx context.Context, es *elasticsearch.Client, index string, mappings []byte) error {
+	res, err := es.Indices.PutMapping([]string{index}, bytes.NewReader(mappings),
+		es.Indices.PutMapping.WithContext(ctx),
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return decodeAck(res.StatusCode, res.Body)
+}
+
+func decodeAck(status int, body io.Reader) error {
+	var ares AckResponse
+	if err := json.NewDecoder(body).Decode(&ares); err != nil {
+		return err
+	}
+	if !ares.Acknowledged {
+		return TranslateError(status, ares.Error)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package es
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexManaged(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		managed bool
+		errType string
+	}{{
+		name:   "not managed",
+		status: http.StatusOK,
+		body:   `{".fleet-agents-7":{"mappings":{"properties":{"agent":{"type":"object"}}}}}`,
+	}, {
+		name:   "other meta",
+		status: http.StatusOK,
+		body:   `{".fleet-agents-7":{"mappings":{"_meta":{"version":"8.16.0"}}}}`,
+	}, {
+		name:    "managed by kibana",
+		status:  http.StatusOK,
+		body:    `{".fleet-agents-7":{"mappings":{"_meta":{"managed":true}}}}`,
+		managed: true,
+	}, {
+		name:    "system index",
+		status:  http.StatusOK,
+		body:    `{".fleet-agents-7":{"mappings":{"_meta":{"managed_index_mappings_version":1}}}}`,
+		managed: true,
+	}, {
+		name:   "missing index",
+		status: http.StatusNotFound,
+		body:   `{"error":{"type":"index_not_found_exception","reason":"no such index"},"status":404}`,
+	}, {
+		name:    "forbidden",
+		status:  http.StatusForbidden,
+		body:    `{"error":{"type":"security_exception","reason":"action is unauthorized"},"status":403}`,
+		errType: "security_exception",
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/.fleet-agents/_mapping", r.URL.Path)
+				w.Header().Set("X-Elastic-Product", "Elasticsearch")
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tc.status)
+				fmt.Fprint(w, tc.body)
+			}))
+			defer server.Close()
+			client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{server.URL}})
+			require.NoError(t, err)
+
+			managed, err := IndexManaged(context.Background(), client, ".fleet-agents")
+			if tc.errType != "" {
+				var esErr *ErrElastic
+				require.ErrorAs(t, err, &esErr)
+				assert.Equal(t, tc.errType, esErr.Type)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.managed, managed)
+		})
+	}
+}
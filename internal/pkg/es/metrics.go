@@ -0,0 +1,126 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package es
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	connsOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "elasticsearch",
+		Subsystem: "connections",
+		Name:      "open",
+		Help:      "Number of open connections to Elasticsearch.",
+	})
+	connsIdle = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "elasticsearch",
+		Subsystem: "connections",
+		Name:      "idle",
+		Help:      "Number of connections to Elasticsearch that are idle in the pool of the transport.",
+	})
+)
+
+// MetricsCollectors returns the prometheus collectors of the connections to Elasticsearch.
+func MetricsCollectors() []prometheus.Collector {
+	return []prometheus.Collector{connsOpen, connsIdle}
+}
+
+// trackedConn is a connection counted in the connection metrics until it is closed.
+type trackedConn struct {
+	net.Conn
+
+	mx     sync.Mutex
+	idle   bool
+	closed bool
+}
+
+func (c *trackedConn) setIdle(idle bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.closed || c.idle == idle {
+		return
+	}
+	c.idle = idle
+	if idle {
+		connsIdle.Inc()
+	} else {
+		connsIdle.Dec()
+	}
+}
+
+func (c *trackedConn) Close() error {
+	c.mx.Lock()
+	if !c.closed {
+		c.closed = true
+		connsOpen.Dec()
+		if c.idle {
+			c.idle = false
+			connsIdle.Dec()
+		}
+	}
+	c.mx.Unlock()
+	return c.Conn.Close()
+}
+
+// asTrackedConn returns the tracked connection under conn.
+func asTrackedConn(conn net.Conn) *trackedConn {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	c, _ := conn.(*trackedConn)
+	return c
+}
+
+// withConnMetrics counts the connections of t in the connection metrics.
+// The connections are counted when they are dialed and closed, the httptrace hooks of the requests
+// follow them as they are taken from and put back in the idle pool.
+func withConnMetrics(t *http.Transport) http.RoundTripper {
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	t.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		connsOpen.Inc()
+		return &trackedConn{Conn: conn}, nil
+	}
+	return &connMetricsTransport{next: t}
+}
+
+type connMetricsTransport struct {
+	next http.RoundTripper
+}
+
+func (t *connMetricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var conn atomic.Pointer[trackedConn]
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c := asTrackedConn(info.Conn)
+			if c == nil {
+				return
+			}
+			conn.Store(c)
+			c.setIdle(false)
+		},
+		PutIdleConn: func(err error) {
+			if c := conn.Load(); c != nil && err == nil {
+				c.setIdle(true)
+			}
+		},
+	}
+	return t.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
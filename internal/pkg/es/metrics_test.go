@@ -0,0 +1,58 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package es
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnMetrics(t *testing.T) {
+	gauge := func(g prometheus.Gauge) float64 {
+		var m dto.Metric
+		require.NoError(t, g.Write(&m))
+		return m.GetGauge().GetValue()
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	transport := &http.Transport{MaxIdleConnsPerHost: 1}
+	client := &http.Client{Transport: withConnMetrics(transport)}
+	// The connections of the other tests are closed in the background once their server is closed.
+	require.Eventually(t, func() bool { return gauge(connsOpen) == 0 }, 5*time.Second, 10*time.Millisecond)
+	open, idle := gauge(connsOpen), gauge(connsIdle)
+
+	get := func() {
+		res, err := client.Get(server.URL) //nolint:noctx // test case
+		require.NoError(t, err)
+		_, err = io.Copy(io.Discard, res.Body)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+	}
+
+	get()
+	assert.Equal(t, open+1, gauge(connsOpen))
+	assert.Eventually(t, func() bool { return gauge(connsIdle) == idle+1 }, time.Second, 10*time.Millisecond, "the connection is put back in the idle pool")
+
+	get()
+	assert.Equal(t, open+1, gauge(connsOpen), "the idle connection is reused")
+	assert.Eventually(t, func() bool { return gauge(connsIdle) == idle+1 }, time.Second, 10*time.Millisecond)
+
+	transport.CloseIdleConnections()
+	assert.Equal(t, open, gauge(connsOpen))
+	assert.Equal(t, idle, gauge(connsIdle))
+}
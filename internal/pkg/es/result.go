@@ -34,6 +34,7 @@ type HitT struct {
 	Source  json.RawMessage        `json:"_source"`
 	Score   *float64               `json:"_score"`
 	Fields  map[string]interface{} `json:"fields"`
+	Sort    []interface{}          `json:"sort"`
 }
 
 func (hit *HitT) Unmarshal(v interface{}) error {
@@ -130,6 +131,12 @@ type Response struct {
 	Error json.RawMessage `json:"error,omitempty"`
 }
 
+type CountResponse struct {
+	Count int64 `json:"count"`
+
+	Error json.RawMessage `json:"error,omitempty"`
+}
+
 type DeleteByQueryResponse struct {
 	Status   int    `json:"status"`
 	Took     uint64 `json:"took"`
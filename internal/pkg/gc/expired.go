@@ -0,0 +1,164 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package gc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	"github.com/elastic/fleet-server/v7/internal/pkg/scheduler"
+)
+
+const (
+	expiredActionsSweepLease = "expired-actions-sweep"
+	expiredActionsSweepSize  = 100
+
+	// ExpiredActionError is the error of the result documents written for the agents that did not complete an expired action.
+	ExpiredActionError = "action expired"
+)
+
+// expiredActionsSweep writes a result document for each agent that has no result for an action
+// that expired more than after ago, so the action is no longer counted as pending.
+//
+// Only the fleet-server that holds the sweep lease runs the sweep. Each run looks at the actions that
+// expired in the window of two schedule intervals before after ago, the result documents have unique ids
+// so sweeping an action again does not write duplicates.
+type expiredActionsSweep struct {
+	bulker   bulk.Bulk
+	server   model.ServerMetadata
+	interval time.Duration
+	after    time.Duration
+
+	acquireLease func(ctx context.Context, bulker bulk.Bulk, name string, server model.ServerMetadata, ttl time.Duration) (bool, error)
+	now          func() time.Time
+}
+
+func getExpiredActionsSweepFunc(bulker bulk.Bulk, server model.ServerMetadata, interval, after time.Duration) scheduler.WorkFunc {
+	s := &expiredActionsSweep{
+		bulker:       bulker,
+		server:       server,
+		interval:     interval,
+		after:        after,
+		acquireLease: dl.AcquireLease,
+		now:          time.Now,
+	}
+	return s.run
+}
+
+func (s *expiredActionsSweep) run(ctx context.Context) error {
+	log := zerolog.Ctx(ctx).With().Str("ctx", "expired actions sweep").Logger()
+
+	// The lease outlives a missed run, so the leader does not change while it is running.
+	leader, err := s.acquireLease(ctx, s.bulker, expiredActionsSweepLease, s.server, 2*s.interval)
+	if err != nil {
+		log.Debug().Err(err).Msg("failed to acquire expired actions sweep lease")
+		return err
+	}
+	if !leader {
+		log.Debug().Msg("expired actions sweep is run by another fleet-server")
+		return nil
+	}
+
+	now := s.now().UTC()
+	expiredBefore := now.Add(-s.after)
+	expiredAfter := expiredBefore.Add(-2 * s.interval)
+
+	var (
+		count int
+		after []interface{}
+	)
+	for {
+		hits, err := dl.FindExpiredActionsInRange(ctx, s.bulker, expiredAfter, expiredBefore, after, expiredActionsSweepSize)
+		if err != nil {
+			log.Debug().Err(err).Msg("failed to find expired actions")
+			return err
+		}
+		for _, hit := range hits {
+			var action model.Action
+			if err := hit.Unmarshal(&action); err != nil {
+				return err
+			}
+			n, err := s.sweepAction(ctx, action, now)
+			if err != nil {
+				log.Debug().Err(err).Str("action_id", action.ActionID).Msg("failed to sweep expired action")
+				return err
+			}
+			count += n
+		}
+		if len(hits) < expiredActionsSweepSize {
+			break
+		}
+		after = hits[len(hits)-1].Sort
+		if len(after) == 0 {
+			return fmt.Errorf("expired action %s has no sort values", hits[len(hits)-1].ID)
+		}
+	}
+	log.Debug().Int("count", count).Msg("wrote expired action results")
+	return nil
+}
+
+// sweepAction writes the expired result documents of the action, it returns the number of documents written.
+func (s *expiredActionsSweep) sweepAction(ctx context.Context, action model.Action, now time.Time) (int, error) {
+	if len(action.Agents) == 0 {
+		return 0, nil
+	}
+	found, err := dl.FindActionResultAgentIDs(ctx, s.bulker, action.ActionID, action.Agents)
+	if err != nil {
+		return 0, err
+	}
+
+	ops := make([]bulk.MultiOp, 0, len(action.Agents)-len(found))
+	for _, agentID := range action.Agents {
+		if _, ok := found[agentID]; ok {
+			continue
+		}
+		body, err := json.Marshal(model.ActionResult{
+			ActionID:    action.ActionID,
+			AgentID:     agentID,
+			CompletedAt: now.Format(time.RFC3339),
+			Error:       ExpiredActionError,
+			Timestamp:   now.Format(time.RFC3339),
+		})
+		if err != nil {
+			return 0, err
+		}
+		ops = append(ops, bulk.MultiOp{
+			ID:    action.ActionID + ":" + agentID,
+			Index: dl.FleetActionsResults,
+			Body:  body,
+		})
+	}
+	if len(ops) == 0 {
+		return 0, nil
+	}
+
+	items, err := s.bulker.MCreate(ctx, ops)
+	if err != nil && len(items) == 0 {
+		return 0, err
+	}
+	var created int
+	for _, item := range items {
+		switch {
+		case item.Status == http.StatusConflict:
+			// A result created since the lookup is kept, same as in dl.CreateActionResult.
+		case item.Status > 0 && item.Status < http.StatusMultipleChoices:
+			created++
+		default:
+			if err == nil {
+				err = fmt.Errorf("unexpected result status %d", item.Status)
+			}
+			return created, err
+		}
+	}
+	return created, nil
+}
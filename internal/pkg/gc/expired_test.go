@@ -0,0 +1,166 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package gc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+func newTestSweep(bulker bulk.Bulk, leader bool, leaseErr error, now time.Time) *expiredActionsSweep {
+	return &expiredActionsSweep{
+		bulker:   bulker,
+		server:   model.ServerMetadata{ID: "server-1"},
+		interval: 30 * time.Minute,
+		after:    time.Hour,
+		acquireLease: func(_ context.Context, _ bulk.Bulk, name string, _ model.ServerMetadata, ttl time.Duration) (bool, error) {
+			if name != expiredActionsSweepLease || ttl != time.Hour {
+				return false, errors.New("unexpected lease")
+			}
+			return leader, leaseErr
+		},
+		now: func() time.Time { return now },
+	}
+}
+
+func TestExpiredActionsSweepNotLeader(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	mBulk := ftesting.NewMockBulk()
+
+	err := newTestSweep(mBulk, false, nil, time.Now()).run(ctx)
+	require.NoError(t, err)
+	mBulk.AssertNotCalled(t, "Search", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	mBulk.AssertNotCalled(t, "MCreate", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestExpiredActionsSweepLeaseError(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	mBulk := ftesting.NewMockBulk()
+	leaseErr := errors.New("lease error")
+
+	err := newTestSweep(mBulk, false, leaseErr, time.Now()).run(ctx)
+	require.ErrorIs(t, err, leaseErr)
+	mBulk.AssertNotCalled(t, "Search", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestExpiredActionsSweepLeader(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	now := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	mBulk := ftesting.NewMockBulk()
+
+	// The window ends after ago and starts two schedule intervals before, the start is excluded.
+	mBulk.On("Search", mock.Anything, dl.FleetActions, mock.MatchedBy(func(body []byte) bool {
+		return bytes.Contains(body, []byte(`"expiration":{"gt":"2024-01-02T10:00:00Z","lte":"2024-01-02T11:00:00Z"}`))
+	}), mock.Anything).Return(&es.ResultT{
+		HitsT: es.HitsT{
+			Hits: []es.HitT{{
+				ID:     "action-doc",
+				Source: []byte(`{"action_id":"action-1","agents":["agent-1","agent-2","agent-3"],"expiration":"2024-01-02T10:30:00Z"}`),
+			}, {
+				ID:     "broadcast-doc",
+				Source: []byte(`{"action_id":"action-2","expiration":"2024-01-02T10:30:00Z"}`),
+			}},
+		},
+	}, nil).Once()
+	mBulk.On("Search", mock.Anything, dl.FleetActionsResults, mock.Anything, mock.Anything).Return(&es.ResultT{
+		HitsT: es.HitsT{
+			Hits: []es.HitT{{
+				ID:     "action-1:agent-1",
+				Source: []byte(`{"agent_id":"agent-1"}`),
+			}},
+		},
+	}, nil).Once()
+	mBulk.On("MCreate", mock.Anything, mock.MatchedBy(func(ops []bulk.MultiOp) bool {
+		if len(ops) != 2 || ops[0].ID != "action-1:agent-2" || ops[1].ID != "action-1:agent-3" {
+			return false
+		}
+		var acr model.ActionResult
+		if err := json.Unmarshal(ops[0].Body, &acr); err != nil {
+			return false
+		}
+		return ops[0].Index == dl.FleetActionsResults && acr.ActionID == "action-1" && acr.AgentID == "agent-2" && acr.Error == ExpiredActionError
+	}), mock.Anything).Return([]bulk.BulkIndexerResponseItem{
+		{Status: http.StatusCreated},
+		{Status: http.StatusConflict},
+	}, errors.New("version conflict")).Once()
+
+	err := newTestSweep(mBulk, true, nil, now).run(ctx)
+	require.NoError(t, err)
+	mBulk.AssertExpectations(t)
+}
+
+func TestExpiredActionsSweepPages(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	now := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	mBulk := ftesting.NewMockBulk()
+
+	// A full page of actions expiring in the same second, the next page follows the sort values of the last hit.
+	page := make([]es.HitT, 0, expiredActionsSweepSize)
+	for i := 0; i < expiredActionsSweepSize; i++ {
+		page = append(page, es.HitT{
+			ID:     fmt.Sprintf("doc-%d", i),
+			Source: []byte(`{"action_id":"broadcast","expiration":"2024-01-02T10:30:00Z"}`),
+			Sort:   []interface{}{float64(1704191400000), "broadcast", float64(i)},
+		})
+	}
+	mBulk.On("Search", mock.Anything, dl.FleetActions, mock.MatchedBy(func(body []byte) bool {
+		return !bytes.Contains(body, []byte(`"search_after"`))
+	}), mock.Anything).Return(&es.ResultT{HitsT: es.HitsT{Hits: page}}, nil).Once()
+	mBulk.On("Search", mock.Anything, dl.FleetActions, mock.MatchedBy(func(body []byte) bool {
+		return bytes.Contains(body, []byte(`"search_after":[1704191400000,"broadcast",99]`)) &&
+			bytes.Contains(body, []byte(`"expiration":{"gt":"2024-01-02T10:00:00Z","lte":"2024-01-02T11:00:00Z"}`))
+	}), mock.Anything).Return(&es.ResultT{
+		HitsT: es.HitsT{
+			Hits: []es.HitT{{
+				ID:     "doc-100",
+				Source: []byte(`{"action_id":"action-1","expiration":"2024-01-02T10:30:00Z"}`),
+				Sort:   []interface{}{float64(1704191400000), "action-1", float64(100)},
+			}},
+		},
+	}, nil).Once()
+
+	err := newTestSweep(mBulk, true, nil, now).run(ctx)
+	require.NoError(t, err)
+	mBulk.AssertExpectations(t)
+}
+
+func TestExpiredActionsSweepCreateError(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	mBulk := ftesting.NewMockBulk()
+	createErr := errors.New("create failed")
+
+	mBulk.On("MCreate", mock.Anything, mock.Anything, mock.Anything).Return([]bulk.BulkIndexerResponseItem{
+		{Status: http.StatusCreated},
+		{Status: http.StatusBadRequest},
+	}, createErr).Once()
+	mBulk.On("Search", mock.Anything, dl.FleetActionsResults, mock.Anything, mock.Anything).Return(&es.ResultT{}, nil).Once()
+
+	n, err := newTestSweep(mBulk, true, nil, time.Now()).sweepAction(ctx, model.Action{
+		ActionID: "action-1",
+		Agents:   []string{"agent-1", "agent-2"},
+	}, time.Now())
+	require.ErrorIs(t, err, createErr)
+	assert.Equal(t, 1, n)
+	mBulk.AssertExpectations(t)
+}
@@ -0,0 +1,352 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package gc
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger/audit"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	"github.com/elastic/fleet-server/v7/internal/pkg/scheduler"
+)
+
+const (
+	inactiveAgentsLease = "inactive-agents-cleanup"
+
+	// The progress of the sweeps is stored under these names.
+	inactiveAgentsMarkSweep    = "inactive-agents-mark"
+	inactiveAgentsCleanupSweep = "inactive-agents-cleanup"
+	// The progress of the sweep of the agents of a policy is stored under this prefix followed by the policy ID.
+	unenrollTimeoutSweepPrefix = "unenroll-timeout:"
+
+	defaultInactiveAgentsConcurrency = 4
+
+	// inactiveAgentStatus is the last checkin status of the agents marked inactive, the next checkin of the
+	// agent overwrites it.
+	inactiveAgentStatus = "inactive"
+
+	unenrolledReasonTimeout = "timeout"
+)
+
+// InactiveAgents configures the cleanup of the agents that stopped checking in.
+type InactiveAgents struct {
+	// InactivityTimeout marks the agents that did not check in for longer as inactive, 0 disables it.
+	InactivityTimeout time.Duration
+	// CleanupAfter unenrolls the agents that did not check in for longer, 0 disables it.
+	CleanupAfter time.Duration
+	// UnenrollTimeout unenrolls the agents that did not check in for longer than the unenroll_timeout of their policy.
+	UnenrollTimeout bool
+	// Delete deletes the documents of the cleaned up agents instead of unenrolling them.
+	Delete bool
+	// DryRun logs the agents that would be marked or cleaned up without changing them.
+	DryRun bool
+	// Concurrency is the number of agents marked or cleaned up at once, defaultInactiveAgentsConcurrency when 0.
+	Concurrency int
+	// LastSeen returns the time of the last checkin of an agent that is not written to its document yet, if any.
+	LastSeen func(agentID string) (time.Time, bool)
+}
+
+func (c InactiveAgents) enabled() bool {
+	return c.InactivityTimeout > 0 || c.CleanupAfter > 0 || c.UnenrollTimeout
+}
+
+func (c InactiveAgents) concurrency() int {
+	if c.Concurrency > 0 {
+		return c.Concurrency
+	}
+	return defaultInactiveAgentsConcurrency
+}
+
+// interval returns the shortest of the enabled thresholds and scheduleInterval.
+func (c InactiveAgents) interval(scheduleInterval time.Duration) time.Duration {
+	interval := scheduleInterval
+	if c.InactivityTimeout > 0 {
+		interval = min(interval, c.InactivityTimeout)
+	}
+	if c.CleanupAfter > 0 {
+		interval = min(interval, c.CleanupAfter)
+	}
+	return interval
+}
+
+// inactiveAgentsCleaner marks the active agents that did not check in for InactivityTimeout as inactive,
+// and unenrolls the ones that did not check in for CleanupAfter, or for the unenroll_timeout of their policy when
+// UnenrollTimeout is set: their API keys are invalidated and the documents are marked as unenrolled, or deleted.
+// Agents that never checked in are judged by their enrollment time. Only the fleet-server that holds the cleanup
+// lease runs it.
+type inactiveAgentsCleaner struct {
+	bulker     bulk.Bulk
+	server     model.ServerMetadata
+	interval   time.Duration
+	cfg        InactiveAgents
+	invalidate InvalidateFunc
+
+	acquireLease func(ctx context.Context, bulker bulk.Bulk, name string, server model.ServerMetadata, ttl time.Duration) (bool, error)
+	findAgents   func(ctx context.Context, bulker bulk.Bulk, seenBefore time.Time, policyID, skipStatus, after string, opt ...dl.Option) ([]model.Agent, error)
+	findPolicies func(ctx context.Context, bulker bulk.Bulk, opt ...dl.Option) ([]model.Policy, error)
+	loadProgress func(ctx context.Context, bulker bulk.Bulk, name string) (string, error)
+	saveProgress func(ctx context.Context, bulker bulk.Bulk, name string, server model.ServerMetadata, lastAgentID string) error
+	now          func() time.Time
+}
+
+func getInactiveAgentsCleanupFunc(bulker bulk.Bulk, server model.ServerMetadata, interval time.Duration, cfg InactiveAgents, invalidate InvalidateFunc) scheduler.WorkFunc {
+	c := &inactiveAgentsCleaner{
+		bulker:       bulker,
+		server:       server,
+		interval:     interval,
+		cfg:          cfg,
+		invalidate:   invalidate,
+		acquireLease: dl.AcquireLease,
+		findAgents:   dl.FindInactiveAgents,
+		findPolicies: dl.QueryLatestPolicies,
+		loadProgress: dl.LoadCleanupProgress,
+		saveProgress: dl.SaveCleanupProgress,
+		now:          time.Now,
+	}
+	return c.run
+}
+
+func (c *inactiveAgentsCleaner) run(ctx context.Context) error {
+	log := zerolog.Ctx(ctx).With().Str("ctx", "inactive agents cleanup").Bool("dry_run", c.cfg.DryRun).Logger()
+	ctx = log.WithContext(ctx)
+
+	leader, err := c.acquireLease(ctx, c.bulker, inactiveAgentsLease, c.server, 2*c.interval)
+	if err != nil {
+		log.Debug().Err(err).Msg("failed to acquire inactive agents cleanup lease")
+		return err
+	}
+	if !leader {
+		log.Debug().Msg("inactive agents cleanup is run by another fleet-server")
+		return nil
+	}
+
+	now := c.now().UTC()
+	if c.cfg.InactivityTimeout > 0 {
+		count, err := c.sweep(ctx, inactiveAgentsMarkSweep, now.Add(-c.cfg.InactivityTimeout), "", inactiveAgentStatus, c.markInactive)
+		if err != nil {
+			log.Debug().Err(err).Msg("failed to mark inactive agents")
+			return err
+		}
+		log.Debug().Int("count", count).Msg("marked inactive agents")
+	}
+	if c.cfg.CleanupAfter > 0 {
+		count, err := c.sweep(ctx, inactiveAgentsCleanupSweep, now.Add(-c.cfg.CleanupAfter), "", "", c.cleanup)
+		if err != nil {
+			log.Debug().Err(err).Msg("failed to clean up inactive agents")
+			return err
+		}
+		log.Debug().Int("count", count).Msg("cleaned up inactive agents")
+	}
+	if c.cfg.UnenrollTimeout {
+		if err := c.unenrollTimedOut(ctx, now); err != nil {
+			log.Debug().Err(err).Msg("failed to unenroll the agents after the unenroll timeout of their policy")
+			return err
+		}
+	}
+	return nil
+}
+
+// unenrollTimedOut cleans up the agents that did not check in for longer than the unenroll_timeout of their policy,
+// each policy with an unenroll_timeout is swept on its own.
+func (c *inactiveAgentsCleaner) unenrollTimedOut(ctx context.Context, now time.Time) error {
+	policies, err := c.findPolicies(ctx, c.bulker)
+	if err != nil {
+		return fmt.Errorf("failed to read the policies: %w", err)
+	}
+	for _, policy := range policies {
+		if policy.UnenrollTimeout <= 0 {
+			continue
+		}
+		timeout := time.Duration(policy.UnenrollTimeout) * time.Second
+		count, err := c.sweep(ctx, unenrollTimeoutSweepPrefix+policy.PolicyID, now.Add(-timeout), policy.PolicyID, "", c.cleanup)
+		if err != nil {
+			return fmt.Errorf("policy %s: %w", policy.PolicyID, err)
+		}
+		zerolog.Ctx(ctx).Debug().Str(logger.PolicyID, policy.PolicyID).Dur("unenroll_timeout", timeout).Int("count", count).Msg("unenrolled agents after the unenroll timeout")
+	}
+	return nil
+}
+
+// sweep calls fn for the agents not seen since seenBefore, of policyID unless it is empty, it returns the number of
+// agents fn was called for. The agents are paged through by agent.id and the agents of a page are handled by up to Concurrency workers. The last
+// agent of each handled page is stored as the progress of the sweep named name, so that a sweep interrupted by an
+// error or a restart resumes after it instead of scanning all the agents again. A page is handled again when it
+// was interrupted, its agents that were changed no longer match the search. Nothing changes in dry run mode, so
+// no progress is stored.
+func (c *inactiveAgentsCleaner) sweep(ctx context.Context, name string, seenBefore time.Time, policyID, skipStatus string, fn func(ctx context.Context, agent model.Agent, now time.Time) error) (int, error) {
+	log := zerolog.Ctx(ctx).With().Str("sweep", name).Logger()
+	var after string
+	if !c.cfg.DryRun {
+		var err error
+		if after, err = c.loadProgress(ctx, c.bulker, name); err != nil {
+			return 0, fmt.Errorf("failed to load the progress: %w", err)
+		}
+		if after != "" {
+			log.Info().Str(logger.AgentID, after).Msg("Resuming the sweep after the last processed agent")
+		}
+	}
+
+	var count int
+	for {
+		agents, err := c.findAgents(ctx, c.bulker, seenBefore, policyID, skipStatus, after)
+		if err != nil {
+			return count, err
+		}
+		if len(agents) == 0 {
+			break
+		}
+		handled, err := c.handlePage(ctx, agents, seenBefore, fn)
+		count += handled
+		if err != nil {
+			return count, err
+		}
+
+		last := agentSortID(agents[len(agents)-1])
+		if last <= after {
+			// The agents are not sorted by ID, the next page would be the same.
+			log.Warn().Str(logger.AgentID, last).Msg("Sweep stopped, the agents are not sorted by ID")
+			break
+		}
+		after = last
+		if !c.cfg.DryRun {
+			if err := c.saveProgress(ctx, c.bulker, name, c.server, after); err != nil {
+				return count, fmt.Errorf("failed to save the progress: %w", err)
+			}
+		}
+	}
+
+	if after != "" && !c.cfg.DryRun {
+		if err := c.saveProgress(ctx, c.bulker, name, c.server, ""); err != nil {
+			return count, fmt.Errorf("failed to save the progress: %w", err)
+		}
+	}
+	return count, nil
+}
+
+// handlePage calls fn for the agents of a page that were not seen since seenBefore, it returns the number of agents
+// fn succeeded for. All the agents are handled when fn fails for one of them.
+func (c *inactiveAgentsCleaner) handlePage(ctx context.Context, agents []model.Agent, seenBefore time.Time, fn func(ctx context.Context, agent model.Agent, now time.Time) error) (int, error) {
+	var handled atomic.Int64
+	var g errgroup.Group
+	g.SetLimit(c.cfg.concurrency())
+	for _, agent := range agents {
+		// Never touch an agent that was seen since, whatever the search returned.
+		if seenSince(agent, seenBefore) || c.seenInMemorySince(agent.Id, seenBefore) {
+			continue
+		}
+		g.Go(func() error {
+			if err := fn(ctx, agent, c.now().UTC()); err != nil {
+				return fmt.Errorf("agent %s: %w", agent.Id, err)
+			}
+			handled.Add(1)
+			return nil
+		})
+	}
+	err := g.Wait()
+	return int(handled.Load()), err
+}
+
+// agentSortID returns the agent.id the agents are sorted by in the searches, the searches only return the agents
+// that have one.
+func agentSortID(agent model.Agent) string {
+	if agent.Agent == nil {
+		return ""
+	}
+	return agent.Agent.ID
+}
+
+// seenSince returns true if the agent checked in, or enrolled if it never checked in, after t.
+// An agent whose times can not be parsed is considered seen.
+func seenSince(agent model.Agent, t time.Time) bool {
+	seen := agent.LastCheckin
+	if seen == "" {
+		seen = agent.EnrolledAt
+	}
+	seenAt, err := time.Parse(time.RFC3339, seen)
+	return err != nil || seenAt.After(t)
+}
+
+// seenInMemorySince returns true if the agent checked in after t, but the checkin is not written to its document yet.
+func (c *inactiveAgentsCleaner) seenInMemorySince(agentID string, t time.Time) bool {
+	if c.cfg.LastSeen == nil {
+		return false
+	}
+	seenAt, ok := c.cfg.LastSeen(agentID)
+	return ok && seenAt.After(t)
+}
+
+func (c *inactiveAgentsCleaner) markInactive(ctx context.Context, agent model.Agent, now time.Time) error {
+	zlog := zerolog.Ctx(ctx).With().Str(logger.AgentID, agent.Id).Str("last_checkin", agent.LastCheckin).Logger()
+	if c.cfg.DryRun {
+		zlog.Info().Msg("Agent would be marked inactive")
+		return nil
+	}
+
+	body, err := bulk.UpdateFields{
+		dl.FieldLastCheckinStatus: inactiveAgentStatus,
+		dl.FieldUpdatedAt:         now.Format(time.RFC3339),
+	}.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := c.bulker.Update(ctx, dl.FleetAgents, agent.Id, body, bulk.WithRefresh(), bulk.WithRetryOnConflict(3)); err != nil {
+		return err
+	}
+	zlog.Info().Msg("Agent marked inactive")
+	return nil
+}
+
+func (c *inactiveAgentsCleaner) cleanup(ctx context.Context, agent model.Agent, now time.Time) error {
+	apiKeys := agent.APIKeyIDs()
+	zlog := zerolog.Ctx(ctx).With().Str(logger.AgentID, agent.Id).Str("last_checkin", agent.LastCheckin).Bool("delete", c.cfg.Delete).Logger()
+	if c.cfg.DryRun {
+		zlog.Info().Any("fleet.policy.apiKeyIDsToRetire", apiKeys).Msg("Inactive agent would be cleaned up")
+		return nil
+	}
+
+	zlog.Info().Any("fleet.policy.apiKeyIDsToRetire", apiKeys).Msg("Clean up inactive agent, invalidate API keys")
+	c.invalidate(ctx, c.bulker, apiKeys)
+
+	event := audit.Event{
+		Action:   audit.ActionUnenroll,
+		Outcome:  audit.OutcomeSuccess,
+		AgentID:  agent.Id,
+		PolicyID: agent.PolicyID,
+	}
+	if err := c.removeAgent(ctx, agent, now); err != nil {
+		event.Outcome = audit.OutcomeFailure
+		audit.Log(ctx, event)
+		return err
+	}
+	audit.Log(ctx, event)
+	return nil
+}
+
+// removeAgent deletes the agent document or marks the agent as unenrolled because of the timeout.
+func (c *inactiveAgentsCleaner) removeAgent(ctx context.Context, agent model.Agent, now time.Time) error {
+	if c.cfg.Delete {
+		return c.bulker.Delete(ctx, dl.FleetAgents, agent.Id, bulk.WithRefresh())
+	}
+	ts := now.Format(time.RFC3339)
+	body, err := bulk.UpdateFields{
+		dl.FieldActive:           false,
+		dl.FieldUnenrolledAt:     ts,
+		dl.FieldUnenrolledReason: unenrolledReasonTimeout,
+		dl.FieldUpdatedAt:        ts,
+	}.Marshal()
+	if err != nil {
+		return err
+	}
+	return c.bulker.Update(ctx, dl.FleetAgents, agent.Id, body, bulk.WithRefresh(), bulk.WithRetryOnConflict(3))
+}
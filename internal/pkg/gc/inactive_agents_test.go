@@ -0,0 +1,363 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package gc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+// cleanupRecorder returns the pages of agents per searched last checkin status to skip, or per unenroll timeout sweep
+// of a policy.
+type cleanupRecorder struct {
+	mx          sync.Mutex
+	pages       map[string][][]model.Agent
+	seenBefore  map[string][]time.Time
+	after       map[string][]string
+	progress    map[string]string
+	invalidated []model.ToRetireAPIKeyIdsItems
+	policies    []model.Policy
+}
+
+func newTestCleaner(bulker bulk.Bulk, rec *cleanupRecorder, cfg InactiveAgents, leader bool, clock func() time.Time) *inactiveAgentsCleaner {
+	rec.seenBefore = make(map[string][]time.Time)
+	rec.after = make(map[string][]string)
+	if rec.progress == nil {
+		rec.progress = make(map[string]string)
+	}
+	return &inactiveAgentsCleaner{
+		bulker:   bulker,
+		server:   model.ServerMetadata{ID: "server-1"},
+		interval: time.Hour,
+		cfg:      cfg,
+		invalidate: func(_ context.Context, _ bulk.Bulk, keys []model.ToRetireAPIKeyIdsItems) {
+			rec.mx.Lock()
+			defer rec.mx.Unlock()
+			rec.invalidated = append(rec.invalidated, keys...)
+		},
+		acquireLease: func(_ context.Context, _ bulk.Bulk, name string, _ model.ServerMetadata, ttl time.Duration) (bool, error) {
+			if name != inactiveAgentsLease || ttl != 2*time.Hour {
+				return false, errors.New("unexpected lease")
+			}
+			return leader, nil
+		},
+		findAgents: func(_ context.Context, _ bulk.Bulk, seenBefore time.Time, policyID, skipStatus, after string, _ ...dl.Option) ([]model.Agent, error) {
+			key := skipStatus
+			if policyID != "" {
+				key = unenrollTimeoutSweepPrefix + policyID
+			}
+			rec.seenBefore[key] = append(rec.seenBefore[key], seenBefore)
+			rec.after[key] = append(rec.after[key], after)
+			pages := rec.pages[key]
+			if len(pages) == 0 {
+				return nil, nil
+			}
+			rec.pages[key] = pages[1:]
+			return pages[0], nil
+		},
+		findPolicies: func(_ context.Context, _ bulk.Bulk, _ ...dl.Option) ([]model.Policy, error) {
+			return rec.policies, nil
+		},
+		loadProgress: func(_ context.Context, _ bulk.Bulk, name string) (string, error) {
+			return rec.progress[name], nil
+		},
+		saveProgress: func(_ context.Context, _ bulk.Bulk, name string, _ model.ServerMetadata, lastAgentID string) error {
+			rec.progress[name] = lastAgentID
+			return nil
+		},
+		now: clock,
+	}
+}
+
+func testAgent(id string, lastCheckin time.Time) model.Agent {
+	return model.Agent{
+		ESDocument:     model.ESDocument{Id: id},
+		Agent:          &model.AgentMetadata{ID: id},
+		Active:         true,
+		PolicyID:       "policy-1",
+		AccessAPIKeyID: id + "-access",
+		EnrolledAt:     lastCheckin.Add(-24 * time.Hour).Format(time.RFC3339),
+		LastCheckin:    lastCheckin.Format(time.RFC3339),
+	}
+}
+
+func updatedFields(t *testing.T, body []byte) map[string]interface{} {
+	t.Helper()
+	var req struct {
+		Doc map[string]interface{} `json:"doc"`
+	}
+	require.NoError(t, json.Unmarshal(body, &req))
+	return req.Doc
+}
+
+func TestInactiveAgentsCleanupNotLeader(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	mBulk := ftesting.NewMockBulk()
+	rec := &cleanupRecorder{}
+
+	err := newTestCleaner(mBulk, rec, InactiveAgents{InactivityTimeout: time.Hour, CleanupAfter: 24 * time.Hour}, false, time.Now).run(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, rec.seenBefore)
+	mBulk.AssertNotCalled(t, "Update", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestInactiveAgentsCleanup(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	cfg := InactiveAgents{InactivityTimeout: time.Hour, CleanupAfter: 24 * time.Hour}
+
+	stale := testAgent("stale", now.Add(-2*time.Hour))
+	gone := testAgent("gone", now.Add(-48*time.Hour))
+	// Returned by the searches, but checked in since the search, it must never be touched.
+	recent := testAgent("recent", now.Add(-time.Minute))
+
+	t.Run("mark and unenroll", func(t *testing.T) {
+		ctx := testlog.SetLogger(t).WithContext(context.Background())
+		mBulk := ftesting.NewMockBulk()
+		mBulk.On("Update", mock.Anything, dl.FleetAgents, "stale", mock.MatchedBy(func(body []byte) bool {
+			doc := updatedFields(t, body)
+			return doc[dl.FieldLastCheckinStatus] == inactiveAgentStatus
+		}), mock.Anything).Return(nil).Once()
+		mBulk.On("Update", mock.Anything, dl.FleetAgents, "gone", mock.MatchedBy(func(body []byte) bool {
+			doc := updatedFields(t, body)
+			return doc[dl.FieldActive] == false && doc[dl.FieldUnenrolledReason] == unenrolledReasonTimeout &&
+				doc[dl.FieldUnenrolledAt] == now.Format(time.RFC3339)
+		}), mock.Anything).Return(nil).Once()
+
+		// The pages are sorted by agent ID like the searches.
+		rec := &cleanupRecorder{pages: map[string][][]model.Agent{
+			inactiveAgentStatus: {{recent, stale}},
+			"":                  {{gone, recent}},
+		}}
+		err := newTestCleaner(mBulk, rec, cfg, true, clock).run(ctx)
+		require.NoError(t, err)
+
+		assert.Equal(t, []time.Time{now.Add(-time.Hour), now.Add(-time.Hour)}, rec.seenBefore[inactiveAgentStatus], "search again until no agent is left")
+		assert.Equal(t, []time.Time{now.Add(-24 * time.Hour), now.Add(-24 * time.Hour)}, rec.seenBefore[""])
+		assert.Equal(t, gone.APIKeyIDs(), rec.invalidated)
+		assert.Equal(t, []string{"", "stale"}, rec.after[inactiveAgentStatus], "the next page follows the last agent")
+		assert.Equal(t, map[string]string{inactiveAgentsMarkSweep: "", inactiveAgentsCleanupSweep: ""}, rec.progress, "finished sweeps have no progress")
+		mBulk.AssertExpectations(t)
+		mBulk.AssertNotCalled(t, "Update", mock.Anything, mock.Anything, "recent", mock.Anything, mock.Anything)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		ctx := testlog.SetLogger(t).WithContext(context.Background())
+		mBulk := ftesting.NewMockBulk()
+		mBulk.On("Delete", mock.Anything, dl.FleetAgents, "gone", mock.Anything).Return(nil).Once()
+
+		rec := &cleanupRecorder{pages: map[string][][]model.Agent{
+			"": {{gone, recent}},
+		}}
+		err := newTestCleaner(mBulk, rec, InactiveAgents{CleanupAfter: 24 * time.Hour, Delete: true}, true, clock).run(ctx)
+		require.NoError(t, err)
+
+		assert.Empty(t, rec.seenBefore[inactiveAgentStatus], "marking is disabled")
+		assert.Equal(t, gone.APIKeyIDs(), rec.invalidated)
+		mBulk.AssertExpectations(t)
+		mBulk.AssertNotCalled(t, "Delete", mock.Anything, mock.Anything, "recent", mock.Anything)
+		mBulk.AssertNotCalled(t, "Update", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		ctx := testlog.SetLogger(t).WithContext(context.Background())
+		mBulk := ftesting.NewMockBulk()
+
+		dryRun := cfg
+		dryRun.DryRun = true
+		stale2 := testAgent("stale2", now.Add(-2*time.Hour))
+		rec := &cleanupRecorder{pages: map[string][][]model.Agent{
+			inactiveAgentStatus: {{stale}, {stale2}},
+			"":                  {{gone}},
+		}}
+		err := newTestCleaner(mBulk, rec, dryRun, true, clock).run(ctx)
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"", "stale", "stale2"}, rec.after[inactiveAgentStatus], "all the pages are logged")
+		assert.Equal(t, []string{"", "gone"}, rec.after[""])
+		assert.Empty(t, rec.progress, "no progress is stored")
+		assert.Empty(t, rec.invalidated)
+		mBulk.AssertNotCalled(t, "Update", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+		mBulk.AssertNotCalled(t, "Delete", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("checkin not written yet", func(t *testing.T) {
+		ctx := testlog.SetLogger(t).WithContext(context.Background())
+		mBulk := ftesting.NewMockBulk()
+		mBulk.On("Update", mock.Anything, dl.FleetAgents, "stale", mock.Anything, mock.Anything).Return(nil).Once()
+
+		// throttled checked in a minute ago but its document still holds the checkin of two hours ago.
+		throttled := testAgent("throttled", now.Add(-2*time.Hour))
+		lastSeen := InactiveAgents{
+			InactivityTimeout: time.Hour,
+			LastSeen: func(agentID string) (time.Time, bool) {
+				if agentID == "throttled" {
+					return now.Add(-time.Minute), true
+				}
+				return time.Time{}, false
+			},
+		}
+		rec := &cleanupRecorder{pages: map[string][][]model.Agent{
+			inactiveAgentStatus: {{stale, throttled}},
+		}}
+		err := newTestCleaner(mBulk, rec, lastSeen, true, clock).run(ctx)
+		require.NoError(t, err)
+
+		mBulk.AssertExpectations(t)
+		mBulk.AssertNotCalled(t, "Update", mock.Anything, mock.Anything, "throttled", mock.Anything, mock.Anything)
+	})
+
+	t.Run("policy unenroll timeout", func(t *testing.T) {
+		ctx := testlog.SetLogger(t).WithContext(context.Background())
+		mBulk := ftesting.NewMockBulk()
+		mBulk.On("Update", mock.Anything, dl.FleetAgents, "stale", mock.MatchedBy(func(body []byte) bool {
+			doc := updatedFields(t, body)
+			return doc[dl.FieldActive] == false && doc[dl.FieldUnenrolledReason] == unenrolledReasonTimeout
+		}), mock.Anything).Return(nil).Once()
+
+		rec := &cleanupRecorder{
+			policies: []model.Policy{
+				{PolicyID: "policy-1", UnenrollTimeout: 3600},
+				{PolicyID: "policy-2"},
+			},
+			pages: map[string][][]model.Agent{
+				unenrollTimeoutSweepPrefix + "policy-1": {{recent, stale}},
+			},
+		}
+		err := newTestCleaner(mBulk, rec, InactiveAgents{UnenrollTimeout: true}, true, clock).run(ctx)
+		require.NoError(t, err)
+
+		assert.Equal(t, []time.Time{now.Add(-time.Hour), now.Add(-time.Hour)}, rec.seenBefore[unenrollTimeoutSweepPrefix+"policy-1"])
+		assert.NotContains(t, rec.seenBefore, unenrollTimeoutSweepPrefix+"policy-2", "policies without unenroll_timeout are left out")
+		assert.Empty(t, rec.seenBefore[""], "cleanup_after is disabled")
+		assert.Equal(t, stale.APIKeyIDs(), rec.invalidated)
+		assert.Equal(t, map[string]string{unenrollTimeoutSweepPrefix + "policy-1": ""}, rec.progress)
+		mBulk.AssertExpectations(t)
+		mBulk.AssertNotCalled(t, "Update", mock.Anything, mock.Anything, "recent", mock.Anything, mock.Anything)
+	})
+
+	t.Run("update error", func(t *testing.T) {
+		ctx := testlog.SetLogger(t).WithContext(context.Background())
+		mBulk := ftesting.NewMockBulk()
+		mBulk.On("Update", mock.Anything, dl.FleetAgents, "gone", mock.Anything, mock.Anything).Return(errors.New("update failed"))
+
+		rec := &cleanupRecorder{pages: map[string][][]model.Agent{
+			"": {{gone}},
+		}}
+		err := newTestCleaner(mBulk, rec, InactiveAgents{CleanupAfter: 24 * time.Hour}, true, clock).run(ctx)
+		require.EqualError(t, err, "agent gone: update failed")
+	})
+}
+
+// TestInactiveAgentsCleanupResume runs a cleanup that fails in its second page, then again as after a restart, over
+// a fake index where the unenrolled agents no longer match.
+func TestInactiveAgentsCleanupResume(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	var mx sync.Mutex
+	unenrolled := make(map[string]int)
+	agents := []model.Agent{
+		testAgent("agent-1", now.Add(-48*time.Hour)),
+		testAgent("agent-2", now.Add(-48*time.Hour)),
+		testAgent("agent-3", now.Add(-48*time.Hour)),
+		testAgent("agent-4", now.Add(-48*time.Hour)),
+		testAgent("agent-5", now.Add(-48*time.Hour)),
+	}
+
+	mBulk := ftesting.NewMockBulk()
+	mBulk.On("Update", mock.Anything, dl.FleetAgents, "agent-4", mock.Anything, mock.Anything).Return(errors.New("update failed")).Once()
+	mBulk.On("Update", mock.Anything, dl.FleetAgents, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		mx.Lock()
+		defer mx.Unlock()
+		unenrolled[args.String(2)]++
+	}).Return(nil)
+
+	rec := &cleanupRecorder{}
+	c := newTestCleaner(mBulk, rec, InactiveAgents{CleanupAfter: 24 * time.Hour, Concurrency: 2}, true, clock)
+	c.findAgents = func(_ context.Context, _ bulk.Bulk, _ time.Time, _, _, after string, _ ...dl.Option) ([]model.Agent, error) {
+		mx.Lock()
+		defer mx.Unlock()
+		rec.after[""] = append(rec.after[""], after)
+		var page []model.Agent
+		for _, agent := range agents {
+			if agent.Id > after && unenrolled[agent.Id] == 0 && len(page) < 2 {
+				page = append(page, agent)
+			}
+		}
+		return page, nil
+	}
+
+	err := c.run(ctx)
+	require.EqualError(t, err, "agent agent-4: update failed")
+	assert.Equal(t, "agent-2", rec.progress[inactiveAgentsCleanupSweep], "the progress is the last page fully processed")
+
+	rec.after = make(map[string][]string)
+	require.NoError(t, c.run(ctx))
+	assert.Equal(t, []string{"agent-2", "agent-5"}, rec.after[""], "the cleanup resumes after the progress")
+	assert.Equal(t, "", rec.progress[inactiveAgentsCleanupSweep])
+	assert.Equal(t, map[string]int{"agent-1": 1, "agent-2": 1, "agent-3": 1, "agent-4": 1, "agent-5": 1}, unenrolled, "no agent is unenrolled twice")
+}
+
+func TestInactiveAgentsSeenSince(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	threshold := now.Add(-time.Hour)
+
+	neverCheckedIn := testAgent("enrolled", now)
+	neverCheckedIn.LastCheckin = ""
+	neverCheckedIn.EnrolledAt = now.Add(-2 * time.Hour).Format(time.RFC3339)
+	assert.False(t, seenSince(neverCheckedIn, threshold), "agents that never checked in are judged by their enrollment")
+
+	neverCheckedIn.EnrolledAt = now.Add(-time.Minute).Format(time.RFC3339)
+	assert.True(t, seenSince(neverCheckedIn, threshold))
+
+	assert.True(t, seenSince(testAgent("recent", now.Add(-time.Minute)), threshold))
+	assert.False(t, seenSince(testAgent("stale", now.Add(-2*time.Hour)), threshold))
+
+	invalid := testAgent("invalid", now)
+	invalid.LastCheckin = "yesterday"
+	assert.True(t, seenSince(invalid, threshold), "unparsable times are never cleaned up")
+}
+
+func TestInactiveAgentsSchedule(t *testing.T) {
+	schedules := Schedules(nil, model.ServerMetadata{}, time.Hour, "", 0, 0, nil, InactiveAgents{})
+	assert.Len(t, schedules, 4, "disabled by default")
+
+	schedules = Schedules(nil, model.ServerMetadata{}, time.Hour, "", 0, 0, nil, InactiveAgents{InactivityTimeout: 10 * time.Minute, CleanupAfter: 24 * time.Hour})
+	require.Len(t, schedules, 5)
+	assert.Equal(t, "fleet inactive agents cleanup", schedules[4].Name)
+	assert.Equal(t, 10*time.Minute, schedules[4].Interval)
+
+	schedules = Schedules(nil, model.ServerMetadata{}, time.Hour, "", 0, 0, nil, InactiveAgents{UnenrollTimeout: true})
+	require.Len(t, schedules, 5)
+	assert.Equal(t, time.Hour, schedules[4].Interval)
+}
+
+func TestInactiveAgentsSortID(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	agent := testAgent("doc-1", now)
+	agent.Agent.ID = "agent-1"
+	assert.Equal(t, "agent-1", agentSortID(agent), "the agents are sorted by agent.id, not _id")
+
+	agent.Agent = nil
+	assert.Empty(t, agentSortID(agent))
+}
@@ -0,0 +1,150 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package gc
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	"github.com/elastic/fleet-server/v7/internal/pkg/scheduler"
+)
+
+const retiredKeysReapLease = "retired-output-keys-reap"
+
+// removeRetiredKeysScript removes the reaped keys, given per output in params.ids, from the agent document.
+const removeRetiredKeysScript = `
+for (entry in params.ids.entrySet()) {
+  def output = ctx._source.outputs == null ? null : ctx._source.outputs[entry.getKey()];
+  if (output != null && output.to_retire_api_key_ids != null) {
+    output.to_retire_api_key_ids.removeIf(k -> entry.getValue().contains(k.id));
+  }
+}`
+
+// InvalidateFunc invalidates output API keys.
+type InvalidateFunc func(ctx context.Context, bulker bulk.Bulk, keys []model.ToRetireAPIKeyIdsItems)
+
+// retiredKeysReaper invalidates the output API keys that were replaced more than grace ago, and removes
+// them from the agent documents.
+//
+// A replaced key is kept valid until the agent acks the policy revision with the new key, so an agent
+// that is in the middle of a checkin does not end up with a revoked key. The reaper invalidates the keys
+// of the agents that did not ack within the grace period. The ack does not remove the keys from the agent
+// document, so the keys invalidated by an ack are invalidated again once the grace period passed, which is a
+// no-op, and removed. Only the fleet-server that holds the reap lease runs it.
+type retiredKeysReaper struct {
+	bulker     bulk.Bulk
+	server     model.ServerMetadata
+	interval   time.Duration
+	grace      time.Duration
+	invalidate InvalidateFunc
+
+	acquireLease func(ctx context.Context, bulker bulk.Bulk, name string, server model.ServerMetadata, ttl time.Duration) (bool, error)
+	findAgents   func(ctx context.Context, bulker bulk.Bulk, retiredBefore time.Time, opt ...dl.Option) ([]model.Agent, error)
+	now          func() time.Time
+}
+
+func getRetiredKeysReapFunc(bulker bulk.Bulk, server model.ServerMetadata, interval, grace time.Duration, invalidate InvalidateFunc) scheduler.WorkFunc {
+	r := &retiredKeysReaper{
+		bulker:       bulker,
+		server:       server,
+		interval:     interval,
+		grace:        grace,
+		invalidate:   invalidate,
+		acquireLease: dl.AcquireLease,
+		findAgents:   dl.FindAgentsWithRetiredKeys,
+		now:          time.Now,
+	}
+	return r.run
+}
+
+func (r *retiredKeysReaper) run(ctx context.Context) error {
+	log := zerolog.Ctx(ctx).With().Str("ctx", "retired output keys reap").Logger()
+
+	leader, err := r.acquireLease(ctx, r.bulker, retiredKeysReapLease, r.server, 2*r.interval)
+	if err != nil {
+		log.Debug().Err(err).Msg("failed to acquire retired output keys reap lease")
+		return err
+	}
+	if !leader {
+		log.Debug().Msg("retired output keys reap is run by another fleet-server")
+		return nil
+	}
+
+	retiredBefore := r.now().UTC().Add(-r.grace)
+	var count int
+	for {
+		agents, err := r.findAgents(ctx, r.bulker, retiredBefore)
+		if err != nil {
+			log.Debug().Err(err).Msg("failed to find agents with retired output keys")
+			return err
+		}
+		var reaped int
+		for _, agent := range agents {
+			n, err := r.reapAgent(ctx, agent, retiredBefore)
+			if err != nil {
+				log.Debug().Err(err).Str(logger.AgentID, agent.Id).Msg("failed to reap retired output keys")
+				return err
+			}
+			reaped += n
+		}
+		count += reaped
+		// The reaped keys are removed from the documents, so the next search returns the remaining agents.
+		// Stop if nothing was reaped so agents whose keys can not be matched are not searched over and over.
+		if len(agents) == 0 || reaped == 0 {
+			break
+		}
+	}
+	log.Debug().Int("count", count).Msg("invalidated retired output keys")
+	return nil
+}
+
+// reapAgent invalidates the keys of the agent retired at or before retiredBefore, it returns the number of keys invalidated.
+func (r *retiredKeysReaper) reapAgent(ctx context.Context, agent model.Agent, retiredBefore time.Time) (int, error) {
+	var keys []model.ToRetireAPIKeyIdsItems
+	ids := make(map[string][]string)
+	for name, output := range agent.Outputs {
+		if output == nil {
+			continue
+		}
+		for _, key := range output.ToRetireAPIKeyIds {
+			retiredAt, err := time.Parse(time.RFC3339, key.RetiredAt)
+			if err != nil || retiredAt.After(retiredBefore) || key.ID == "" {
+				continue
+			}
+			keys = append(keys, key)
+			ids[name] = append(ids[name], key.ID)
+		}
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	zerolog.Ctx(ctx).Info().Str(logger.AgentID, agent.Id).Any("fleet.policy.apiKeyIDsToRetire", keys).Msg("Grace period expired, invalidate retired output API keys")
+	r.invalidate(ctx, r.bulker, keys)
+
+	body, err := json.Marshal(map[string]interface{}{
+		"script": map[string]interface{}{
+			"lang":   "painless",
+			"source": removeRetiredKeysScript,
+			"params": map[string]interface{}{
+				"ids": ids,
+			},
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := r.bulker.Update(ctx, dl.FleetAgents, agent.Id, body, bulk.WithRefresh(), bulk.WithRetryOnConflict(3)); err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
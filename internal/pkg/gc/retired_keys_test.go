@@ -0,0 +1,165 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package gc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+type reapRecorder struct {
+	pages       [][]model.Agent
+	searches    int
+	invalidated []model.ToRetireAPIKeyIdsItems
+}
+
+func newTestReaper(bulker bulk.Bulk, rec *reapRecorder, leader bool, now time.Time) *retiredKeysReaper {
+	return &retiredKeysReaper{
+		bulker:   bulker,
+		server:   model.ServerMetadata{ID: "server-1"},
+		interval: 15 * time.Minute,
+		grace:    30 * time.Minute,
+		invalidate: func(_ context.Context, _ bulk.Bulk, keys []model.ToRetireAPIKeyIdsItems) {
+			rec.invalidated = append(rec.invalidated, keys...)
+		},
+		acquireLease: func(_ context.Context, _ bulk.Bulk, name string, _ model.ServerMetadata, ttl time.Duration) (bool, error) {
+			if name != retiredKeysReapLease || ttl != 30*time.Minute {
+				return false, errors.New("unexpected lease")
+			}
+			return leader, nil
+		},
+		findAgents: func(_ context.Context, _ bulk.Bulk, retiredBefore time.Time, _ ...dl.Option) ([]model.Agent, error) {
+			if !retiredBefore.Equal(now.Add(-30 * time.Minute)) {
+				return nil, errors.New("unexpected retiredBefore")
+			}
+			rec.searches++
+			if len(rec.pages) == 0 {
+				return nil, nil
+			}
+			page := rec.pages[0]
+			rec.pages = rec.pages[1:]
+			return page, nil
+		},
+		now: func() time.Time { return now },
+	}
+}
+
+func retiredKey(id string, retiredAt time.Time) model.ToRetireAPIKeyIdsItems {
+	return model.ToRetireAPIKeyIdsItems{
+		ID:        id,
+		Output:    "default",
+		RetiredAt: retiredAt.UTC().Format(time.RFC3339),
+	}
+}
+
+func TestRetiredKeysReapNotLeader(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	mBulk := ftesting.NewMockBulk()
+	rec := &reapRecorder{}
+
+	err := newTestReaper(mBulk, rec, false, time.Now()).run(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, rec.searches)
+	mBulk.AssertNotCalled(t, "Update", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestRetiredKeysReap(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+
+	t.Run("expiry before ack", func(t *testing.T) {
+		ctx := testlog.SetLogger(t).WithContext(context.Background())
+		mBulk := ftesting.NewMockBulk()
+		mBulk.On("Update", mock.Anything, dl.FleetAgents, "agent-1", mock.MatchedBy(func(body []byte) bool {
+			var req struct {
+				Script struct {
+					Params struct {
+						IDs map[string][]string `json:"ids"`
+					} `json:"params"`
+				} `json:"script"`
+			}
+			if err := json.Unmarshal(body, &req); err != nil {
+				return false
+			}
+			return assert.ObjectsAreEqual(map[string][]string{"default": {"expired"}}, req.Script.Params.IDs)
+		}), mock.Anything).Return(nil).Once()
+
+		rec := &reapRecorder{pages: [][]model.Agent{{{
+			ESDocument: model.ESDocument{Id: "agent-1"},
+			Outputs: map[string]*model.PolicyOutput{
+				"default": {
+					APIKeyID: "current",
+					ToRetireAPIKeyIds: []model.ToRetireAPIKeyIdsItems{
+						retiredKey("expired", now.Add(-time.Hour)),
+						retiredKey("in-grace", now.Add(-5*time.Minute)),
+					},
+				},
+			},
+		}}}}
+
+		err := newTestReaper(mBulk, rec, true, now).run(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, []model.ToRetireAPIKeyIdsItems{retiredKey("expired", now.Add(-time.Hour))}, rec.invalidated)
+		assert.Equal(t, 2, rec.searches, "search again after reaping until no agent is found")
+		mBulk.AssertExpectations(t)
+	})
+
+	t.Run("ack before expiry", func(t *testing.T) {
+		// The key is still in the grace period, it is left to the ack of the agent.
+		ctx := testlog.SetLogger(t).WithContext(context.Background())
+		mBulk := ftesting.NewMockBulk()
+		rec := &reapRecorder{pages: [][]model.Agent{{{
+			ESDocument: model.ESDocument{Id: "agent-1"},
+			Outputs: map[string]*model.PolicyOutput{
+				"default": {
+					APIKeyID: "current",
+					ToRetireAPIKeyIds: []model.ToRetireAPIKeyIdsItems{
+						retiredKey("in-grace", now.Add(-5*time.Minute)),
+					},
+				},
+			},
+		}}}}
+
+		err := newTestReaper(mBulk, rec, true, now).run(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, rec.invalidated)
+		assert.Equal(t, 1, rec.searches, "stop when nothing was reaped")
+		mBulk.AssertNotCalled(t, "Update", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("update error", func(t *testing.T) {
+		ctx := testlog.SetLogger(t).WithContext(context.Background())
+		mBulk := ftesting.NewMockBulk()
+		mBulk.On("Update", mock.Anything, dl.FleetAgents, "agent-1", mock.Anything, mock.Anything).Return(errors.New("update failed"))
+		rec := &reapRecorder{pages: [][]model.Agent{{{
+			ESDocument: model.ESDocument{Id: "agent-1"},
+			Outputs: map[string]*model.PolicyOutput{
+				"default": {
+					ToRetireAPIKeyIds: []model.ToRetireAPIKeyIdsItems{
+						retiredKey("expired", now.Add(-time.Hour)),
+					},
+				},
+			},
+		}}}}
+
+		err := newTestReaper(mBulk, rec, true, now).run(ctx)
+		require.EqualError(t, err, "update failed")
+		assert.Equal(t, 1, rec.searches)
+	})
+}
@@ -8,28 +8,69 @@ import (
 	"time"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
 	"github.com/elastic/fleet-server/v7/internal/pkg/scheduler"
 )
 
 const (
 	defaultScheduleInterval            = time.Hour
 	defaultCleanupIntervalAfterExpired = "30d" // cleanup with expiration older than 30 days from now
+	defaultSweepAfterExpired           = time.Hour
+	defaultOutputKeyGrace              = 30 * time.Minute
+	defaultUpgradeRetriesInterval      = time.Minute
 )
 
 // Schedules returns the GC schedules
-func Schedules(bulker bulk.Bulk, scheduleInterval time.Duration, cleanupIntervalAfterExpired string) []scheduler.Schedule {
+// The expired actions sweep and the retired output keys reap are run by the fleet-server described by server.
+// The retired output keys reap runs at least once per outputKeyGrace.
+// The upgrade retries are also written by the fleet-server described by server, at least once a minute.
+// The inactive agents cleanup is only scheduled if one of its thresholds is set, it is also run by the
+// fleet-server described by server.
+func Schedules(bulker bulk.Bulk, server model.ServerMetadata, scheduleInterval time.Duration, cleanupIntervalAfterExpired string, sweepAfterExpired, outputKeyGrace time.Duration, invalidate InvalidateFunc, inactiveAgents InactiveAgents) []scheduler.Schedule {
 	if scheduleInterval == 0 {
 		scheduleInterval = defaultScheduleInterval
 	}
 	if cleanupIntervalAfterExpired == "" {
 		cleanupIntervalAfterExpired = defaultCleanupIntervalAfterExpired
 	}
+	if sweepAfterExpired == 0 {
+		sweepAfterExpired = defaultSweepAfterExpired
+	}
+	if outputKeyGrace == 0 {
+		outputKeyGrace = defaultOutputKeyGrace
+	}
+	reapInterval := min(scheduleInterval, outputKeyGrace)
+	upgradeRetriesInterval := min(scheduleInterval, defaultUpgradeRetriesInterval)
 
-	return []scheduler.Schedule{
+	schedules := []scheduler.Schedule{
 		{
 			Name:     "fleet actions cleanup",
 			Interval: scheduleInterval,
 			WorkFn:   getActionsGCFunc(bulker, cleanupIntervalAfterExpired),
 		},
+		{
+			Name:     "fleet expired actions sweep",
+			Interval: scheduleInterval,
+			WorkFn:   getExpiredActionsSweepFunc(bulker, server, scheduleInterval, sweepAfterExpired),
+		},
+		{
+			Name:     "fleet retired output keys reap",
+			Interval: reapInterval,
+			WorkFn:   getRetiredKeysReapFunc(bulker, server, reapInterval, outputKeyGrace, invalidate),
+		},
+		{
+			Name:     "fleet upgrade retries",
+			Interval: upgradeRetriesInterval,
+			WorkFn:   getUpgradeRetriesFunc(bulker, server, upgradeRetriesInterval),
+		},
+	}
+	if inactiveAgents.enabled() {
+		interval := inactiveAgents.interval(scheduleInterval)
+		schedules = append(schedules, scheduler.Schedule{
+			Name:     "fleet inactive agents cleanup",
+			Interval: interval,
+			WorkFn:   getInactiveAgentsCleanupFunc(bulker, server, interval, inactiveAgents, invalidate),
+		})
 	}
+	return schedules
 }
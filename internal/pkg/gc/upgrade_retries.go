@@ -0,0 +1,164 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package gc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	"github.com/elastic/fleet-server/v7/internal/pkg/scheduler"
+)
+
+const (
+	upgradeRetriesLease = "upgrade-retries"
+	upgradeRetriesSize  = 100
+
+	// upgradeRetriesLookback is how far back each run looks at the failed results, so the results missed while the
+	// lease moves to another fleet-server are still retried.
+	upgradeRetriesLookback = time.Hour
+)
+
+// upgradeRetries writes the next retry of the upgrade actions that failed and have a retry_delay in their data,
+// see dl.UpgradeRetry. The ack of the failure marks the agent upgrade as retry_scheduled if the action has a retry
+// left, or failed once the retries are exhausted.
+//
+// Only the fleet-server that holds the lease writes the retries. The retries have deterministic ids so the failed
+// results that are looked at again, or by a new leader, do not write a second retry.
+type upgradeRetries struct {
+	bulker   bulk.Bulk
+	server   model.ServerMetadata
+	interval time.Duration
+
+	acquireLease func(ctx context.Context, bulker bulk.Bulk, name string, server model.ServerMetadata, ttl time.Duration) (bool, error)
+	now          func() time.Time
+}
+
+func getUpgradeRetriesFunc(bulker bulk.Bulk, server model.ServerMetadata, interval time.Duration) scheduler.WorkFunc {
+	u := &upgradeRetries{
+		bulker:       bulker,
+		server:       server,
+		interval:     interval,
+		acquireLease: dl.AcquireLease,
+		now:          time.Now,
+	}
+	return u.run
+}
+
+func (u *upgradeRetries) run(ctx context.Context) error {
+	log := zerolog.Ctx(ctx).With().Str("ctx", "upgrade retries").Logger()
+
+	leader, err := u.acquireLease(ctx, u.bulker, upgradeRetriesLease, u.server, 2*u.interval)
+	if err != nil {
+		log.Debug().Err(err).Msg("failed to acquire upgrade retries lease")
+		return err
+	}
+	if !leader {
+		log.Debug().Msg("upgrade retries are run by another fleet-server")
+		return nil
+	}
+
+	now := u.now().UTC()
+	after := now.Add(-upgradeRetriesLookback)
+
+	// The upgrade actions that are retried by id, nil for the other actions.
+	actions := make(map[string]*model.Action)
+	var count int
+	var searchAfter []interface{}
+	for {
+		results, next, err := dl.FindFailedActionResultsInRange(ctx, u.bulker, after, now, searchAfter, upgradeRetriesSize)
+		if err != nil {
+			log.Debug().Err(err).Msg("failed to find failed action results")
+			return err
+		}
+		for _, acr := range results {
+			written, err := u.retry(ctx, log, actions, acr, now)
+			if err != nil {
+				log.Debug().Err(err).Str("action_id", acr.ActionID).Str("agent_id", acr.AgentID).Msg("failed to write upgrade retry")
+				return err
+			}
+			if written {
+				count++
+			}
+		}
+		if len(results) < upgradeRetriesSize || len(next) == 0 {
+			break
+		}
+		// Continue after the timestamp, action ID and agent ID of the last result, so the results that share a
+		// timestamp across pages are each looked at once.
+		searchAfter = next
+	}
+	log.Debug().Int("count", count).Msg("wrote upgrade retries")
+	return nil
+}
+
+// retry writes the next retry of the failed action for the agent, it returns true if the retry was written.
+func (u *upgradeRetries) retry(ctx context.Context, log zerolog.Logger, actions map[string]*model.Action, acr model.ActionResult, now time.Time) (bool, error) {
+	action, ok := actions[acr.ActionID]
+	if !ok {
+		found, err := dl.FindAction(ctx, u.bulker, acr.ActionID)
+		if err != nil {
+			return false, err
+		}
+		for i := range found {
+			if _, ok, _ := dl.ParseUpgradeRetry(found[i]); ok {
+				action = &found[i]
+				break
+			}
+		}
+		actions[acr.ActionID] = action
+	}
+	if action == nil {
+		return false, nil
+	}
+	retry, _, err := dl.ParseUpgradeRetry(*action)
+	if err != nil || retry.Exhausted() {
+		return false, nil
+	}
+
+	// The agent upgrade is only retried if the ack of the failure scheduled it, and not if the agent retries or
+	// upgraded since.
+	agent, err := dl.FindAgent(ctx, u.bulker, dl.QueryAgentByID, dl.FieldID, acr.AgentID)
+	if errors.Is(err, dl.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if agent.UpgradeStatus != dl.UpgradeStatusRetryScheduled {
+		return false, nil
+	}
+
+	failedAt, err := time.Parse(time.RFC3339Nano, acr.Timestamp)
+	if err != nil {
+		failedAt = now
+	}
+	retryAction, err := dl.NewUpgradeRetryAction(*action, retry, acr.AgentID, failedAt, now)
+	if err != nil {
+		return false, err
+	}
+	body, err := json.Marshal(retryAction)
+	if err != nil {
+		return false, err
+	}
+	_, err = u.bulker.Create(ctx, dl.FleetActions, retryAction.ActionID, body, bulk.WithRefresh())
+	if errors.Is(err, es.ErrElasticVersionConflict) {
+		// The retry was already written, by this or a previous leader.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	log.Info().Str("action_id", retryAction.ActionID).Str("agent_id", acr.AgentID).Str("start_time", retryAction.StartTime).
+		Msg("wrote upgrade retry")
+	return true, nil
+}
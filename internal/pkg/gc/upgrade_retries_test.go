@@ -0,0 +1,242 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package gc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+func newTestUpgradeRetries(bulker bulk.Bulk, leader bool, now time.Time) *upgradeRetries {
+	return &upgradeRetries{
+		bulker:   bulker,
+		server:   model.ServerMetadata{ID: "server-1"},
+		interval: time.Minute,
+		acquireLease: func(_ context.Context, _ bulk.Bulk, name string, _ model.ServerMetadata, ttl time.Duration) (bool, error) {
+			if name != upgradeRetriesLease || ttl != 2*time.Minute {
+				return false, fmt.Errorf("unexpected lease %s %s", name, ttl)
+			}
+			return leader, nil
+		},
+		now: func() time.Time { return now },
+	}
+}
+
+func searchResult(t *testing.T, docs ...interface{}) *es.ResultT {
+	t.Helper()
+	hits := make([]es.HitT, 0, len(docs))
+	for _, doc := range docs {
+		p, err := json.Marshal(doc)
+		require.NoError(t, err)
+		hits = append(hits, es.HitT{Source: p})
+	}
+	return &es.ResultT{HitsT: es.HitsT{Hits: hits}}
+}
+
+// failUpgrade runs the upgrade retries after the agent failed the action, it returns the retry that was written.
+func failUpgrade(t *testing.T, action model.Action, agentStatus string, failedAt time.Time) *model.Action {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	now := failedAt.Add(time.Minute)
+	mBulk := ftesting.NewMockBulk()
+
+	mBulk.On("Search", mock.Anything, dl.FleetActionsResults, mock.MatchedBy(func(body []byte) bool {
+		return bytes.Contains(body, []byte(fmt.Sprintf(`"gt":"%s"`, now.Add(-upgradeRetriesLookback).Format(time.RFC3339Nano))))
+	}), mock.Anything).Return(searchResult(t, model.ActionResult{
+		ActionID:  action.ActionID,
+		AgentID:   "agent-1",
+		Error:     "upgrade failed",
+		Timestamp: failedAt.Format(time.RFC3339Nano),
+	}), nil).Once()
+	mBulk.On("Search", mock.Anything, dl.FleetActions, mock.Anything, mock.Anything).Return(searchResult(t, action), nil).Once()
+	mBulk.On("Search", mock.Anything, dl.FleetAgents, mock.Anything, mock.Anything).Return(searchResult(t, model.Agent{
+		ESDocument:    model.ESDocument{Id: "agent-1"},
+		UpgradeStatus: agentStatus,
+	}), nil).Maybe()
+	var written *model.Action
+	mBulk.On("Create", mock.Anything, dl.FleetActions, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		var a model.Action
+		require.NoError(t, json.Unmarshal(args.Get(3).([]byte), &a))
+		require.Equal(t, args.String(2), a.ActionID)
+		written = &a
+	}).Return("", nil).Maybe()
+
+	err := newTestUpgradeRetries(mBulk, true, now).run(ctx)
+	require.NoError(t, err)
+	mBulk.AssertExpectations(t)
+	return written
+}
+
+func TestUpgradeRetriesLadder(t *testing.T) {
+	start := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	action := model.Action{
+		ActionID:   "upgrade-1",
+		Type:       "UPGRADE",
+		Agents:     []string{"agent-1", "agent-2"},
+		Data:       json.RawMessage(`{"version":"8.1.0","retry_delay":["5m","30m"]}`),
+		Namespaces: []string{"default"},
+		Timestamp:  start.Format(time.RFC3339),
+		Expiration: start.Add(2 * time.Hour).Format(time.RFC3339),
+	}
+
+	failedAt := start.Add(10 * time.Minute)
+	retry := failUpgrade(t, action, dl.UpgradeStatusRetryScheduled, failedAt)
+	require.NotNil(t, retry)
+	assert.Equal(t, "upgrade-1:retry-1:agent-1", retry.ActionID)
+	assert.Equal(t, []string{"agent-1"}, retry.Agents)
+	assert.Equal(t, "UPGRADE", retry.Type)
+	assert.Equal(t, []string{"default"}, retry.Namespaces)
+	assert.Equal(t, failedAt.Add(5*time.Minute).Format(time.RFC3339), retry.StartTime)
+	assert.Equal(t, failedAt.Add(5*time.Minute+2*time.Hour).Format(time.RFC3339), retry.Expiration)
+	assert.JSONEq(t, `{"version":"8.1.0","retry_delay":["5m","30m"],"retry_count":1,"retry_of":"upgrade-1"}`, string(retry.Data))
+
+	failedAt = failedAt.Add(20 * time.Minute)
+	retry = failUpgrade(t, *retry, dl.UpgradeStatusRetryScheduled, failedAt)
+	require.NotNil(t, retry)
+	assert.Equal(t, "upgrade-1:retry-2:agent-1", retry.ActionID)
+	assert.Equal(t, failedAt.Add(30*time.Minute).Format(time.RFC3339), retry.StartTime)
+	assert.JSONEq(t, `{"version":"8.1.0","retry_delay":["5m","30m"],"retry_count":2,"retry_of":"upgrade-1"}`, string(retry.Data))
+
+	// The ladder is exhausted, the ack of the failure marked the agent upgrade as failed.
+	retry = failUpgrade(t, *retry, "failed", failedAt.Add(40*time.Minute))
+	assert.Nil(t, retry)
+}
+
+func TestUpgradeRetriesSkipped(t *testing.T) {
+	failedAt := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	upgrade := model.Action{
+		ActionID: "upgrade-1",
+		Type:     "UPGRADE",
+		Data:     json.RawMessage(`{"version":"8.1.0","retry_delay":["5m"]}`),
+	}
+
+	t.Run("agent retries on its own", func(t *testing.T) {
+		assert.Nil(t, failUpgrade(t, upgrade, "retrying", failedAt))
+	})
+	t.Run("no retry delay", func(t *testing.T) {
+		action := upgrade
+		action.Data = json.RawMessage(`{"version":"8.1.0"}`)
+		assert.Nil(t, failUpgrade(t, action, dl.UpgradeStatusRetryScheduled, failedAt))
+	})
+	t.Run("signed action", func(t *testing.T) {
+		action := upgrade
+		action.Signed = &model.Signed{Data: "data", Signature: "signature"}
+		assert.Nil(t, failUpgrade(t, action, dl.UpgradeStatusRetryScheduled, failedAt))
+	})
+	t.Run("other action type", func(t *testing.T) {
+		action := upgrade
+		action.Type = "UNENROLL"
+		assert.Nil(t, failUpgrade(t, action, dl.UpgradeStatusRetryScheduled, failedAt))
+	})
+}
+
+func TestUpgradeRetriesAlreadyWritten(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	now := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	mBulk := ftesting.NewMockBulk()
+
+	mBulk.On("Search", mock.Anything, dl.FleetActionsResults, mock.Anything, mock.Anything).Return(searchResult(t, model.ActionResult{
+		ActionID:  "upgrade-1",
+		AgentID:   "agent-1",
+		Error:     "upgrade failed",
+		Timestamp: now.Add(-time.Minute).Format(time.RFC3339Nano),
+	}, model.ActionResult{
+		ActionID:  "upgrade-1",
+		AgentID:   "agent-2",
+		Error:     "upgrade failed",
+		Timestamp: now.Add(-time.Minute).Format(time.RFC3339Nano),
+	}), nil).Once()
+	// The action is looked up once for both results.
+	mBulk.On("Search", mock.Anything, dl.FleetActions, mock.Anything, mock.Anything).Return(searchResult(t, model.Action{
+		ActionID: "upgrade-1",
+		Type:     "UPGRADE",
+		Data:     json.RawMessage(`{"retry_delay":["5m"]}`),
+	}), nil).Once()
+	mBulk.On("Search", mock.Anything, dl.FleetAgents, mock.Anything, mock.Anything).Return(searchResult(t, model.Agent{
+		UpgradeStatus: dl.UpgradeStatusRetryScheduled,
+	}), nil).Twice()
+	// A previous leader wrote the retry of the first agent.
+	mBulk.On("Create", mock.Anything, dl.FleetActions, "upgrade-1:retry-1:agent-1", mock.Anything, mock.Anything).Return("", es.ErrElasticVersionConflict).Once()
+	mBulk.On("Create", mock.Anything, dl.FleetActions, "upgrade-1:retry-1:agent-2", mock.Anything, mock.Anything).Return("", nil).Once()
+
+	err := newTestUpgradeRetries(mBulk, true, now).run(ctx)
+	require.NoError(t, err)
+	mBulk.AssertExpectations(t)
+}
+
+func TestUpgradeRetriesPages(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	now := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	failedAt := now.Add(-time.Minute)
+	mBulk := ftesting.NewMockBulk()
+
+	// All the results of the first page and the first result of the next page share a timestamp.
+	page := func(from, to int) *es.ResultT {
+		hits := make([]es.HitT, 0, to-from)
+		for i := from; i < to; i++ {
+			agentID := fmt.Sprintf("agent-%03d", i)
+			p, err := json.Marshal(model.ActionResult{
+				ActionID:  "upgrade-1",
+				AgentID:   agentID,
+				Error:     "upgrade failed",
+				Timestamp: failedAt.Format(time.RFC3339Nano),
+			})
+			require.NoError(t, err)
+			hits = append(hits, es.HitT{Source: p, Sort: []interface{}{failedAt.UnixMilli(), "upgrade-1", agentID}})
+		}
+		return &es.ResultT{HitsT: es.HitsT{Hits: hits}}
+	}
+	mBulk.On("Search", mock.Anything, dl.FleetActionsResults, mock.MatchedBy(func(body []byte) bool {
+		return !bytes.Contains(body, []byte(`"search_after"`))
+	}), mock.Anything).Return(page(0, upgradeRetriesSize), nil).Once()
+	mBulk.On("Search", mock.Anything, dl.FleetActionsResults, mock.MatchedBy(func(body []byte) bool {
+		return bytes.Contains(body, []byte(fmt.Sprintf(`"search_after":[%d,"upgrade-1","agent-099"]`, failedAt.UnixMilli())))
+	}), mock.Anything).Return(page(upgradeRetriesSize, upgradeRetriesSize+1), nil).Once()
+	mBulk.On("Search", mock.Anything, dl.FleetActions, mock.Anything, mock.Anything).Return(searchResult(t, model.Action{
+		ActionID: "upgrade-1",
+		Type:     "UPGRADE",
+		Data:     json.RawMessage(`{"retry_delay":["5m"]}`),
+	}), nil).Once()
+	mBulk.On("Search", mock.Anything, dl.FleetAgents, mock.Anything, mock.Anything).Return(searchResult(t, model.Agent{
+		UpgradeStatus: dl.UpgradeStatusRetryScheduled,
+	}), nil)
+	retries := make(map[string]struct{})
+	mBulk.On("Create", mock.Anything, dl.FleetActions, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		retries[args.String(2)] = struct{}{}
+	}).Return("", nil)
+
+	err := newTestUpgradeRetries(mBulk, true, now).run(ctx)
+	require.NoError(t, err)
+	mBulk.AssertExpectations(t)
+	// Each result is looked at once.
+	mBulk.AssertNumberOfCalls(t, "Create", upgradeRetriesSize+1)
+	assert.Len(t, retries, upgradeRetriesSize+1)
+}
+
+func TestUpgradeRetriesNotLeader(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	mBulk := ftesting.NewMockBulk()
+
+	err := newTestUpgradeRetries(mBulk, false, time.Now()).run(ctx)
+	require.NoError(t, err)
+	mBulk.AssertNotCalled(t, "Search", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	mBulk.AssertNotCalled(t, "Create", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
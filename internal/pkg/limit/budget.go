@@ -0,0 +1,91 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package limit
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	HeaderRateLimitLimit     = "X-RateLimit-Limit"
+	HeaderRateLimitRemaining = "X-RateLimit-Remaining"
+	HeaderRateLimitReset     = "X-RateLimit-Reset"
+)
+
+// Budget is the state of a rate limit after a request was admitted, it is sent to the agents so that they can pace
+// their requests instead of backing off once they are rejected.
+type Budget struct {
+	// Limit is the burst of the rate limit.
+	Limit int
+	// Remaining is the number of requests that would be admitted right away.
+	Remaining int
+	// Reset is the time until the burst is fully refilled.
+	Reset time.Duration
+}
+
+// budgetAt returns the budget of the rate limiter at now.
+func budgetAt(rl *rate.Limiter, now time.Time) Budget {
+	tokens := rl.TokensAt(now)
+	b := Budget{Limit: rl.Burst()}
+	if tokens > 0 {
+		b.Remaining = int(math.Floor(tokens))
+	}
+	if missing := float64(b.Limit) - tokens; missing > 0 && rl.Limit() > 0 && rl.Limit() != rate.Inf {
+		b.Reset = time.Duration(missing / float64(rl.Limit()) * float64(time.Second))
+	}
+	return b
+}
+
+// lower returns true if b admits fewer requests than o.
+func (b Budget) lower(o Budget) bool {
+	if b.Remaining != o.Remaining {
+		return b.Remaining < o.Remaining
+	}
+	return b.Reset > o.Reset
+}
+
+// SetHeaders sets the X-RateLimit headers of the budget, the reset is rounded up to the next second.
+func (b Budget) SetHeaders(h http.Header) {
+	h.Set(HeaderRateLimitLimit, strconv.Itoa(b.Limit))
+	h.Set(HeaderRateLimitRemaining, strconv.Itoa(b.Remaining))
+	h.Set(HeaderRateLimitReset, strconv.FormatInt(int64(math.Ceil(b.Reset.Seconds())), 10))
+}
+
+type budgetCtxKey struct{}
+
+// budgetHeader holds the X-RateLimit headers of a response, they report the lowest budget of the limits the request
+// went through.
+type budgetHeader struct {
+	header http.Header
+	budget Budget
+	set    bool
+}
+
+// add reports b in the headers if it is lower than the budget already reported.
+func (h *budgetHeader) add(b Budget) {
+	if h.set && !b.lower(h.budget) {
+		return
+	}
+	h.budget, h.set = b, true
+	b.SetHeaders(h.header)
+}
+
+// withBudgetHeader returns a context carrying the budget headers of the response.
+func withBudgetHeader(ctx context.Context, h *budgetHeader) context.Context {
+	return context.WithValue(ctx, budgetCtxKey{}, h)
+}
+
+// addBudget reports b in the budget headers of the response, if the limiter of the endpoint sends them.
+func addBudget(ctx context.Context, b Budget) {
+	if h, ok := ctx.Value(budgetCtxKey{}).(*budgetHeader); ok {
+		h.add(b)
+	}
+}
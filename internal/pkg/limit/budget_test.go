@@ -0,0 +1,130 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package limit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+)
+
+// fakeClock is the time of the limiters under test.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+// budgetServe returns a function that serves a request of key through the limiter and returns the response.
+func budgetServe(t *testing.T, cfg *config.Limit, opts ...LimiterOpt) (func(key string) *http.Response, *fakeClock) {
+	t.Helper()
+	clock := &fakeClock{t: time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)}
+	l := NewLimiter(cfg, opts...)
+	l.now = clock.now
+	if l.keyLimit != nil {
+		l.keyLimit.now = clock.now
+	}
+	h := l.Wrap("name", nil, zerolog.DebugLevel)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := CheckKey(r.Context(), r.Header.Get("X-Key")); err != nil {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	return func(key string) *http.Response {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Key", key)
+		h.ServeHTTP(w, r)
+		return w.Result()
+	}, clock
+}
+
+// assertBudget checks the X-RateLimit headers of an admitted response.
+func assertBudget(t *testing.T, resp *http.Response, limit, remaining, reset string) {
+	t.Helper()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, limit, resp.Header.Get(HeaderRateLimitLimit))
+	assert.Equal(t, remaining, resp.Header.Get(HeaderRateLimitRemaining))
+	assert.Equal(t, reset, resp.Header.Get(HeaderRateLimitReset))
+}
+
+func TestLimiterBudgetHeaders(t *testing.T) {
+	t.Run("drain and refill", func(t *testing.T) {
+		serve, clock := budgetServe(t, &config.Limit{Interval: time.Second, Burst: 3}, WithBudgetHeaders())
+
+		assertBudget(t, serve("a"), "3", "2", "1")
+		assertBudget(t, serve("a"), "3", "1", "2")
+		assertBudget(t, serve("a"), "3", "0", "3")
+
+		// A rejected request reports when to retry, not a budget.
+		resp := serve("a")
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+		assert.Empty(t, resp.Header.Get(HeaderRateLimitRemaining))
+
+		// Half a token is left once the admitted request took its token, the burst is full 2.5s later.
+		clock.advance(1500 * time.Millisecond)
+		assertBudget(t, serve("a"), "3", "0", "3")
+		clock.advance(2 * time.Second)
+		assertBudget(t, serve("a"), "3", "1", "2")
+
+		// The burst is not exceeded however long the limiter was idle.
+		clock.advance(time.Hour)
+		assertBudget(t, serve("a"), "3", "2", "1")
+	})
+
+	t.Run("per key budget", func(t *testing.T) {
+		serve, clock := budgetServe(t, &config.Limit{
+			Interval: time.Second,
+			Burst:    10,
+			PerKey:   config.KeyLimit{Interval: time.Minute, Burst: 2},
+		}, WithBudgetHeaders())
+
+		// The budget of the key is lower than the budget of the endpoint.
+		assertBudget(t, serve("a"), "2", "1", "60")
+		assertBudget(t, serve("a"), "2", "0", "120")
+		assert.Equal(t, http.StatusTooManyRequests, serve("a").StatusCode)
+
+		// The budget of another key is untouched, the endpoint budget is lower once it is drained.
+		for i := 0; i < 6; i++ {
+			assertBudget(t, serve("b"+strconv.Itoa(i)), "2", "1", "60")
+		}
+		assertBudget(t, serve("c"), "10", "0", "10")
+
+		// The key gets a token back every minute.
+		clock.advance(time.Minute)
+		assertBudget(t, serve("a"), "2", "0", "120")
+		clock.advance(2 * time.Minute)
+		assertBudget(t, serve("a"), "2", "1", "60")
+	})
+
+	t.Run("unlimited endpoint", func(t *testing.T) {
+		serve, _ := budgetServe(t, &config.Limit{PerKey: config.KeyLimit{Interval: time.Second, Burst: 5}}, WithBudgetHeaders())
+		assertBudget(t, serve("a"), "5", "4", "1")
+
+		serve, _ = budgetServe(t, &config.Limit{Max: 10}, WithBudgetHeaders())
+		assertBudget(t, serve("a"), "", "", "")
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		serve, _ := budgetServe(t, &config.Limit{Interval: time.Second, Burst: 3})
+		assertBudget(t, serve("a"), "", "", "")
+	})
+}
@@ -7,29 +7,90 @@ package limit
 import (
 	"encoding/json"
 	"errors"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/rs/zerolog"
 )
 
 var (
-	ErrRateLimit = errors.New("rate limit")
-	ErrMaxLimit  = errors.New("max limit")
+	ErrRateLimit    = errors.New("rate limit")
+	ErrMaxLimit     = errors.New("max limit")
+	ErrKeyRateLimit = errors.New("key rate limit")
+	ErrMaxConns     = errors.New("max connections")
+	ErrBodyTooLarge = errors.New("body too large")
 )
 
+// BodyTooLargeError is the error of a request whose body exceeds the max body size of the endpoint.
+type BodyTooLargeError struct {
+	Endpoint string
+	Limit    int64
+}
+
+func (e *BodyTooLargeError) Error() string {
+	return "request body of the " + e.Endpoint + " endpoint exceeds the limit of " + strconv.FormatInt(e.Limit, 10) + " bytes"
+}
+
+func (e *BodyTooLargeError) Unwrap() error {
+	return ErrBodyTooLarge
+}
+
+// MaxConnsError is the error of a request received on a connection accepted over the max connections limit.
+type MaxConnsError struct {
+	Max int64
+}
+
+func (e *MaxConnsError) Error() string {
+	return "exceeded the max connections limit of " + strconv.FormatInt(e.Max, 10)
+}
+
+func (e *MaxConnsError) Unwrap() error {
+	return ErrMaxConns
+}
+
+// RateLimitError is a limiter error that tells the client when to retry.
+type RateLimitError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return e.Err
+}
+
+// RetryAfterSeconds returns the value for the Retry-After header, the delay rounded up to the next second.
+func (e *RateLimitError) RetryAfterSeconds() string {
+	return strconv.FormatInt(int64(math.Ceil(e.RetryAfter.Seconds())), 10)
+}
+
 // writeError recreates the behaviour of api/error.go.
 // It is defined separately here to stop a circular import
 func writeError(log *zerolog.Logger, w http.ResponseWriter, err error) error {
 	resp := struct {
-		Status  int    `json:"statusCode"`
-		Error   string `json:"error"`
-		Message string `json:"message"`
+		Status   int    `json:"statusCode"`
+		Error    string `json:"error"`
+		Message  string `json:"message"`
+		Endpoint string `json:"endpoint,omitempty"`
+		Limit    int64  `json:"limit,omitempty"`
 	}{
 		Status:  http.StatusTooManyRequests,
 		Error:   "UnknownLimiterError",
 		Message: "unknown limiter error encountered",
 	}
+	var btlErr *BodyTooLargeError
 	switch {
+	case errors.As(err, &btlErr):
+		resp.Status = http.StatusRequestEntityTooLarge
+		resp.Error = "BodyTooLarge"
+		resp.Message = btlErr.Error()
+		resp.Endpoint = btlErr.Endpoint
+		resp.Limit = btlErr.Limit
 	case errors.Is(err, ErrRateLimit):
 		resp.Error = "RateLimit"
 		resp.Message = "exceeded the rate limit"
@@ -45,7 +106,11 @@ func writeError(log *zerolog.Logger, w http.ResponseWriter, err error) error {
 	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
-	w.WriteHeader(http.StatusTooManyRequests)
+	var rlErr *RateLimitError
+	if errors.As(err, &rlErr) {
+		w.Header().Set("Retry-After", rlErr.RetryAfterSeconds())
+	}
+	w.WriteHeader(resp.Status)
 	_, wErr = w.Write(p)
 	return wErr
 }
@@ -57,3 +57,29 @@ func TestWriteError(t *testing.T) {
 		})
 	}
 }
+
+func TestWriteErrorBodyTooLarge(t *testing.T) {
+	w := httptest.NewRecorder()
+
+	log := testlog.SetLogger(t)
+	err := writeError(&log, w, &BodyTooLargeError{Endpoint: "checkin", Limit: 1024})
+	require.NoError(t, err)
+	resp := w.Result()
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	var body struct {
+		Status   int    `json:"statusCode"`
+		Error    string `json:"error"`
+		Message  string `json:"message"`
+		Endpoint string `json:"endpoint"`
+		Limit    int64  `json:"limit"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusRequestEntityTooLarge, body.Status)
+	require.Equal(t, "BodyTooLarge", body.Error)
+	require.Equal(t, "request body of the checkin endpoint exceeds the limit of 1024 bytes", body.Message)
+	require.Equal(t, "checkin", body.Endpoint)
+	require.Equal(t, int64(1024), body.Limit)
+}
@@ -0,0 +1,123 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package limit
+
+import (
+	"context"
+	"time"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"golang.org/x/time/rate"
+)
+
+// keyCacheSize is the max number of keys tracked by a KeyLimiter.
+// When a key is evicted its budget is reset.
+const keyCacheSize = 65536
+
+type keyLimiterCtxKey struct{}
+
+// KeyLimiter rate limits requests per key, such as an API key id.
+// It is used in addition to the endpoint limits so a single client can not exhaust the shared budget.
+type KeyLimiter struct {
+	interval time.Duration
+	burst    int
+	cache    *lru.Cache[string, *rate.Limiter]
+	now      func() time.Time // injectable for testing purposes
+}
+
+// NewKeyLimiter returns a KeyLimiter for the passed settings.
+// A nil KeyLimiter is returned if the settings do not enable the per key limits.
+// A burst of at least 1 is enforced.
+func NewKeyLimiter(cfg *config.KeyLimit) *KeyLimiter {
+	if cfg == nil || cfg.Interval == 0 {
+		return nil
+	}
+	cache, err := lru.New[string, *rate.Limiter](keyCacheSize)
+	if err != nil {
+		// only returned for a non-positive size
+		panic(err)
+	}
+	burst := cfg.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	return &KeyLimiter{
+		interval: cfg.Interval,
+		burst:    burst,
+		cache:    cache,
+	}
+}
+
+// Allow reports whether a request for key may proceed.
+// If it may not proceed, the returned duration is the time until the key has budget again.
+func (l *KeyLimiter) Allow(key string) (time.Duration, bool) {
+	_, d, ok := l.allow(key)
+	return d, ok
+}
+
+// allow reports whether a request for key may proceed, and the budget left to the key if it may.
+func (l *KeyLimiter) allow(key string) (Budget, time.Duration, bool) {
+	if l == nil {
+		return Budget{}, 0, true
+	}
+	rl, ok := l.cache.Get(key)
+	if !ok {
+		rl = rate.NewLimiter(rate.Every(l.interval), l.burst)
+		if prev, ok, _ := l.cache.PeekOrAdd(key, rl); ok {
+			rl = prev
+		}
+	}
+	now := l.clock()
+	if rl.AllowN(now, 1) {
+		return budgetAt(rl, now), 0, true
+	}
+	return Budget{}, time.Duration((1 - rl.TokensAt(now)) * float64(l.interval)), false
+}
+
+// clock returns the current time of the limiter.
+func (l *KeyLimiter) clock() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
+
+// Check returns a RateLimitError if the key exceeded its budget.
+func (l *KeyLimiter) Check(key string) error {
+	_, err := l.check(key)
+	return err
+}
+
+// check returns the budget left to the key, or a RateLimitError if the key exceeded it.
+func (l *KeyLimiter) check(key string) (Budget, error) {
+	b, d, ok := l.allow(key)
+	if !ok {
+		return Budget{}, &RateLimitError{Err: ErrKeyRateLimit, RetryAfter: d}
+	}
+	return b, nil
+}
+
+// WithKeyLimiter returns a context carrying the KeyLimiter of the endpoint handling the request.
+func WithKeyLimiter(ctx context.Context, l *KeyLimiter) context.Context {
+	return context.WithValue(ctx, keyLimiterCtxKey{}, l)
+}
+
+// CheckKey checks key against the KeyLimiter in ctx, if there is one.
+// It is called once the key of the request is known, for example after authentication.
+// The budget left to the key is reported in the X-RateLimit headers if it is lower than the endpoint budget.
+func CheckKey(ctx context.Context, key string) error {
+	l, ok := ctx.Value(keyLimiterCtxKey{}).(*KeyLimiter)
+	if !ok || l == nil {
+		return nil
+	}
+	b, err := l.check(key)
+	if err != nil {
+		return err
+	}
+	addBudget(ctx, b)
+	return nil
+}
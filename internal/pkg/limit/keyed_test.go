@@ -0,0 +1,121 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package limit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewKeyLimiter(t *testing.T) {
+	assert.Nil(t, NewKeyLimiter(nil))
+	assert.Nil(t, NewKeyLimiter(&config.KeyLimit{Burst: 10}))
+
+	l := NewKeyLimiter(&config.KeyLimit{Interval: time.Second})
+	require.NotNil(t, l)
+	assert.Equal(t, 1, l.burst, "a burst of at least 1 is enforced")
+
+	var nilLimiter *KeyLimiter
+	_, ok := nilLimiter.Allow("key")
+	assert.True(t, ok, "nil limiter allows all keys")
+}
+
+func TestKeyLimiterAllow(t *testing.T) {
+	l := NewKeyLimiter(&config.KeyLimit{Interval: time.Minute, Burst: 2})
+
+	for i := 0; i < 2; i++ {
+		_, ok := l.Allow("noisy")
+		require.True(t, ok)
+	}
+	d, ok := l.Allow("noisy")
+	require.False(t, ok, "noisy key exceeded its budget")
+	assert.Greater(t, d, time.Duration(0))
+	assert.LessOrEqual(t, d, time.Minute)
+
+	// other keys have their own budget
+	_, ok = l.Allow("quiet")
+	assert.True(t, ok)
+
+	err := l.Check("noisy")
+	require.ErrorIs(t, err, ErrKeyRateLimit)
+	var rlErr *RateLimitError
+	require.ErrorAs(t, err, &rlErr)
+	assert.Equal(t, "60", rlErr.RetryAfterSeconds())
+}
+
+func TestCheckKey(t *testing.T) {
+	ctx := context.Background()
+	require.NoError(t, CheckKey(ctx, "key"), "no limiter in context")
+
+	ctx = WithKeyLimiter(ctx, NewKeyLimiter(&config.KeyLimit{Interval: time.Hour, Burst: 1}))
+	require.NoError(t, CheckKey(ctx, "key"))
+	require.ErrorIs(t, CheckKey(ctx, "key"), ErrKeyRateLimit)
+	require.NoError(t, CheckKey(ctx, "other"))
+}
+
+func TestLimiterWrapKeyLimiter(t *testing.T) {
+	l := NewLimiter(&config.Limit{
+		PerKey: config.KeyLimit{Interval: time.Hour, Burst: 1},
+	})
+	h := l.Wrap("name", nil, zerolog.DebugLevel)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := CheckKey(r.Context(), r.Header.Get("X-Key")); err != nil {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(key string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Key", key)
+		h.ServeHTTP(w, r)
+		return w.Result().StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, serve("a"))
+	assert.Equal(t, http.StatusTooManyRequests, serve("a"))
+	assert.Equal(t, http.StatusOK, serve("b"))
+}
+
+func BenchmarkKeyLimiterAllow(b *testing.B) {
+	l := NewKeyLimiter(&config.KeyLimit{Interval: time.Nanosecond, Burst: 1000})
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = "api-key-" + strconv.Itoa(i)
+	}
+
+	b.Run("single key", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			l.Allow(keys[0])
+		}
+	})
+	b.Run("many keys", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			l.Allow(keys[i%len(keys)])
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				l.Allow(keys[i%len(keys)])
+				i++
+			}
+		})
+	})
+}
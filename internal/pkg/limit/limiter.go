@@ -6,7 +6,9 @@
 package limit
 
 import (
+	"context"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/config"
@@ -26,51 +28,157 @@ type StatIncer interface {
 }
 
 type Limiter struct {
+	// mu guards the limiters so they can be swapped on a config reload.
+	mu        sync.RWMutex
+	cfg       config.Limit
 	rateLimit *rate.Limiter
 	maxLimit  *semaphore.Weighted
+	keyLimit  *KeyLimiter
+
+	budgetHeaders bool             // set the X-RateLimit headers of the responses
+	now           func() time.Time // injectable for testing purposes
+}
+
+// LimiterOpt is an option of a Limiter.
+type LimiterOpt func(*Limiter)
+
+// WithBudgetHeaders sets the X-RateLimit headers of the admitted requests to the lowest budget of the endpoint rate
+// limit and of the per key rate limit. A limit that is disabled does not report any budget.
+func WithBudgetHeaders() LimiterOpt {
+	return func(l *Limiter) {
+		l.budgetHeaders = true
+	}
 }
 
-func NewLimiter(cfg *config.Limit) *Limiter {
+func NewLimiter(cfg *config.Limit, opts ...LimiterOpt) *Limiter {
 	l := &Limiter{}
+	for _, opt := range opts {
+		opt(l)
+	}
+	l.Reload(cfg)
+	return l
+}
+
+// clock returns the current time of the limiter.
+func (l *Limiter) clock() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
 
+// Reload applies the passed settings to the limiter.
+//
+// Requests that are in flight keep and release the limits they were admitted with,
+// new requests are checked against the new limits. Limiters whose settings did not
+// change are kept as is.
+func (l *Limiter) Reload(cfg *config.Limit) {
 	if cfg == nil {
-		return l
+		cfg = &config.Limit{}
 	}
 
-	if cfg.Interval != time.Duration(0) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch {
+	case cfg.Interval == time.Duration(0):
+		l.rateLimit = nil
+	case l.rateLimit == nil || cfg.Interval != l.cfg.Interval || cfg.Burst != l.cfg.Burst:
 		l.rateLimit = rate.NewLimiter(rate.Every(cfg.Interval), cfg.Burst)
 	}
 
-	if cfg.Max != 0 {
+	switch {
+	case cfg.Max == 0:
+		l.maxLimit = nil
+	case l.maxLimit == nil || cfg.Max != l.cfg.Max:
 		l.maxLimit = semaphore.NewWeighted(cfg.Max)
 	}
 
-	return l
+	if l.keyLimit == nil || cfg.PerKey != l.cfg.PerKey {
+		l.keyLimit = NewKeyLimiter(&cfg.PerKey)
+		if l.keyLimit != nil {
+			l.keyLimit.now = l.now
+		}
+	}
+
+	l.cfg = *cfg
 }
 
-func (l *Limiter) acquire() (releaseFunc, error) {
+// acquire admits a request, the budget of the rate limit is nil when it is disabled.
+func (l *Limiter) acquire(ctx context.Context) (releaseFunc, *KeyLimiter, *Budget, error) {
 	releaseFunc := noop
 
-	if l.rateLimit != nil && !l.rateLimit.Allow() {
-		return nil, ErrRateLimit
+	l.mu.RLock()
+	rateLimit, maxLimit, keyLimit, maxWait := l.rateLimit, l.maxLimit, l.keyLimit, l.cfg.MaxWait
+	l.mu.RUnlock()
+
+	// The max limit is checked first, a request rejected by it does not take a token from the rate limit.
+	if maxLimit != nil {
+		if !maxLimit.TryAcquire(1) {
+			return nil, nil, nil, &RateLimitError{Err: ErrMaxLimit, RetryAfter: max(delay(rateLimit, l.clock()), minRetryAfter)}
+		}
+		releaseFunc = func() {
+			maxLimit.Release(1)
+		}
 	}
 
-	if l.maxLimit != nil {
-		if !l.maxLimit.TryAcquire(1) {
-			return nil, ErrMaxLimit
+	var budget *Budget
+	if rateLimit != nil {
+		if err := reserve(ctx, rateLimit, maxWait, l.clock()); err != nil {
+			releaseFunc()
+			return nil, nil, nil, err
 		}
-		releaseFunc = l.release
+		b := budgetAt(rateLimit, l.clock())
+		budget = &b
 	}
 
-	return releaseFunc, nil
+	return releaseFunc, keyLimit, budget, nil
 }
 
-func (l *Limiter) release() {
-	if l.maxLimit != nil {
-		l.maxLimit.Release(1)
+// minRetryAfter is the Retry-After sent when the limiter can not tell when a request would be admitted.
+const minRetryAfter = time.Second
+
+// reserve takes a token from the rate limiter.
+// If no token is available the request is queued for up to maxWait, past that it is rejected
+// with the delay of its reservation, which grows with the number of queued requests.
+func reserve(ctx context.Context, rl *rate.Limiter, maxWait time.Duration, now time.Time) error {
+	res := rl.ReserveN(now, 1)
+	if !res.OK() {
+		return &RateLimitError{Err: ErrRateLimit, RetryAfter: minRetryAfter}
+	}
+	d := res.DelayFrom(now)
+	if d == 0 {
+		return nil
+	}
+	if d > maxWait {
+		res.CancelAt(now)
+		return &RateLimitError{Err: ErrRateLimit, RetryAfter: d}
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		res.Cancel()
+		return ctx.Err()
 	}
 }
 
+// delay returns how long until the rate limiter admits the next request.
+func delay(rl *rate.Limiter, now time.Time) time.Duration {
+	if rl == nil {
+		return 0
+	}
+	res := rl.ReserveN(now, 1)
+	if !res.OK() {
+		return 0
+	}
+	defer res.CancelAt(now)
+	return res.DelayFrom(now)
+}
+
 func (l *Limiter) Wrap(name string, si StatIncer, ll zerolog.Level) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -79,7 +187,23 @@ func (l *Limiter) Wrap(name string, si StatIncer, ll zerolog.Level) func(http.Ha
 				defer dfunc()
 			}
 
-			lf, err := l.acquire()
+			// The body size is checked first, an oversized request does not take a token from the rate limits.
+			if err := l.limitBody(w, r, name); err != nil {
+				hlog.FromRequest(r).WithLevel(ll).Str("route", name).Err(err).Msg("request body too large")
+				if wErr := writeError(hlog.FromRequest(r), w, err); wErr != nil {
+					hlog.FromRequest(r).Error().Err(wErr).Msg("fail writing error response")
+				}
+				if si != nil {
+					si.IncError(err)
+				}
+				return
+			}
+
+			lf, kl, budget, err := l.acquire(r.Context())
+			if err != nil && r.Context().Err() != nil {
+				// The client went away while the request was queued.
+				return
+			}
 			if err != nil {
 				hlog.FromRequest(r).WithLevel(ll).Str("route", name).Err(err).Msg("limit reached")
 				if wErr := writeError(hlog.FromRequest(r), w, err); wErr != nil {
@@ -91,10 +215,40 @@ func (l *Limiter) Wrap(name string, si StatIncer, ll zerolog.Level) func(http.Ha
 				return
 			}
 			defer lf()
+			if l.budgetHeaders {
+				// The per key budget is added once the key is checked.
+				h := &budgetHeader{header: w.Header()}
+				if budget != nil {
+					h.add(*budget)
+				}
+				r = r.WithContext(withBudgetHeader(r.Context(), h))
+			}
+			if kl != nil {
+				// The key is only known after authentication, the handler checks it against the limiter in the context.
+				r = r.WithContext(WithKeyLimiter(r.Context(), kl))
+			}
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
+// limitBody rejects a request whose Content-Length exceeds the max body size of the endpoint. The body of
+// the other requests is limited to the max body size, so a chunked body fails with an *http.MaxBytesError
+// once the limit is read.
+func (l *Limiter) limitBody(w http.ResponseWriter, r *http.Request, name string) error {
+	l.mu.RLock()
+	maxBody := l.cfg.MaxBody
+	l.mu.RUnlock()
+
+	if maxBody <= 0 || r.Body == nil {
+		return nil
+	}
+	if r.ContentLength > maxBody {
+		return &BodyTooLargeError{Endpoint: name, Limit: maxBody}
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+	return nil
+}
+
 func noop() {
 }
@@ -5,9 +5,15 @@
 package limit
 
 import (
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
 
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
@@ -29,6 +35,12 @@ func (m *mockIncer) IncStart() func() {
 	return args.Get(0).(func())
 }
 
+func isErr(target error) func(error) bool {
+	return func(err error) bool {
+		return errors.Is(err, target)
+	}
+}
+
 func stubHandle() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -58,7 +70,7 @@ func Test_Limiter_Wrap(t *testing.T) {
 		stats: func() *mockIncer {
 			m := &mockIncer{}
 			m.On("IncStart").Return(noop).Once()
-			m.On("IncError", ErrMaxLimit).Once()
+			m.On("IncError", mock.MatchedBy(isErr(ErrMaxLimit))).Once()
 			return m
 		},
 		status: http.StatusTooManyRequests,
@@ -70,7 +82,7 @@ func Test_Limiter_Wrap(t *testing.T) {
 		stats: func() *mockIncer {
 			m := &mockIncer{}
 			m.On("IncStart").Return(noop).Once()
-			m.On("IncError", ErrRateLimit).Once()
+			m.On("IncError", mock.MatchedBy(isErr(ErrRateLimit))).Once()
 			return m
 		},
 		status: http.StatusTooManyRequests,
@@ -90,3 +102,253 @@ func Test_Limiter_Wrap(t *testing.T) {
 		})
 	}
 }
+
+func Test_Limiter_BodySize(t *testing.T) {
+	readBody := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			var mbErr *http.MaxBytesError
+			assert.ErrorAs(t, err, &mbErr)
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name    string
+		size    int
+		chunked bool
+		stats   func() *mockIncer
+		status  int
+	}{{
+		name: "under the limit",
+		size: 9,
+		stats: func() *mockIncer {
+			m := &mockIncer{}
+			m.On("IncStart").Return(noop).Once()
+			return m
+		},
+		status: http.StatusOK,
+	}, {
+		name: "at the limit",
+		size: 10,
+		stats: func() *mockIncer {
+			m := &mockIncer{}
+			m.On("IncStart").Return(noop).Once()
+			return m
+		},
+		status: http.StatusOK,
+	}, {
+		name: "over the limit",
+		size: 11,
+		stats: func() *mockIncer {
+			m := &mockIncer{}
+			m.On("IncStart").Return(noop).Once()
+			m.On("IncError", mock.MatchedBy(isErr(ErrBodyTooLarge))).Once()
+			return m
+		},
+		status: http.StatusRequestEntityTooLarge,
+	}, {
+		name:    "chunked over the limit",
+		size:    11,
+		chunked: true,
+		stats: func() *mockIncer {
+			m := &mockIncer{}
+			m.On("IncStart").Return(noop).Once()
+			return m
+		},
+		// The handler reads past the limit.
+		status: http.StatusRequestEntityTooLarge,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLimiter(&config.Limit{MaxBody: 10})
+			mi := tt.stats()
+			h := l.Wrap("checkin", mi, zerolog.DebugLevel)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("a", tt.size)))
+			if tt.chunked {
+				r.ContentLength = -1
+			}
+			h(readBody).ServeHTTP(w, r)
+
+			resp := w.Result()
+			resp.Body.Close()
+			assert.Equal(t, tt.status, resp.StatusCode)
+			mi.AssertExpectations(t)
+		})
+	}
+}
+
+func Test_Limiter_Reload(t *testing.T) {
+	l := NewLimiter(&config.Limit{
+		Interval: time.Hour,
+		Burst:    1,
+		Max:      1,
+	})
+
+	inFlight := make(chan struct{})
+	unblock := make(chan struct{})
+	h := l.Wrap("name", nil, zerolog.DebugLevel)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			close(inFlight)
+			<-unblock
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(path string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Result().StatusCode
+	}
+
+	blockedStatus := make(chan int, 1)
+	go func() {
+		blockedStatus <- serve("/block")
+	}()
+	<-inFlight
+
+	// Burst is exhausted, the request is rejected.
+	assert.Equal(t, http.StatusTooManyRequests, serve("/"))
+
+	l.Reload(&config.Limit{
+		Interval: time.Hour,
+		Burst:    3,
+		Max:      3,
+	})
+
+	// New requests observe the new burst while the in-flight request is still running.
+	assert.Equal(t, http.StatusOK, serve("/"))
+	assert.Equal(t, http.StatusOK, serve("/"))
+	assert.Equal(t, http.StatusOK, serve("/"))
+	assert.Equal(t, http.StatusTooManyRequests, serve("/"))
+
+	close(unblock)
+	assert.Equal(t, http.StatusOK, <-blockedStatus)
+
+	// Unchanged settings keep the current limiter state.
+	l.Reload(&config.Limit{
+		Interval: time.Hour,
+		Burst:    3,
+		Max:      3,
+	})
+	assert.Equal(t, http.StatusTooManyRequests, serve("/"))
+
+	// Zero values disable the limits.
+	l.Reload(&config.Limit{})
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, http.StatusOK, serve("/"))
+	}
+}
+
+func Test_Limiter_RetryAfter(t *testing.T) {
+	l := NewLimiter(&config.Limit{
+		Interval: time.Second,
+		Burst:    1,
+	})
+	serve := func() *http.Response {
+		w := httptest.NewRecorder()
+		l.Wrap("name", nil, zerolog.DebugLevel)(stubHandle()).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w.Result()
+	}
+
+	assert.Equal(t, http.StatusOK, serve().StatusCode)
+
+	resp := serve()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	// Queued requests push back the time a new request would be admitted.
+	now := time.Now()
+	l.rateLimit.ReserveN(now, 1)
+	l.rateLimit.ReserveN(now, 1)
+
+	resp = serve()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "3", resp.Header.Get("Retry-After"))
+}
+
+func Test_Limiter_MaxLimitKeepsRateBudget(t *testing.T) {
+	l := NewLimiter(&config.Limit{
+		Interval: time.Second,
+		Burst:    2,
+		Max:      1,
+	})
+	inFlight := make(chan struct{})
+	unblock := make(chan struct{})
+	h := l.Wrap("name", nil, zerolog.DebugLevel)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight <- struct{}{}
+		<-unblock
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func() *http.Response {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w.Result()
+	}
+
+	done := make(chan int, 1)
+	go func() {
+		done <- serve().StatusCode
+	}()
+	<-inFlight
+
+	// The requests rejected by the max limit do not use the rate budget.
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusTooManyRequests, serve().StatusCode)
+	}
+	assert.InDelta(t, 1, l.rateLimit.TokensAt(time.Now()), 0.1)
+
+	close(unblock)
+	assert.Equal(t, http.StatusOK, <-done)
+	go func() {
+		<-inFlight
+	}()
+	assert.Equal(t, http.StatusOK, serve().StatusCode)
+}
+
+func Test_Limiter_MaxWait(t *testing.T) {
+	l := NewLimiter(&config.Limit{
+		Interval: 10 * time.Millisecond,
+		Burst:    1,
+		MaxWait:  time.Second,
+	})
+	h := l.Wrap("name", nil, zerolog.DebugLevel)(stubHandle())
+
+	// The second request is queued until a token is available instead of being rejected.
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	}
+}
+
+func Test_Limiter_ZeroMaxIsUnlimited(t *testing.T) {
+	l := NewLimiter(&config.Limit{})
+
+	inFlight := make(chan struct{})
+	unblock := make(chan struct{})
+	h := l.Wrap("name", nil, zerolog.DebugLevel)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight <- struct{}{}
+		<-unblock
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	const n = 100
+	status := make(chan int, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			status <- w.Result().StatusCode
+		}()
+	}
+	for i := 0; i < n; i++ {
+		<-inFlight
+	}
+	close(unblock)
+	for i := 0; i < n; i++ {
+		assert.Equal(t, http.StatusOK, <-status)
+	}
+}
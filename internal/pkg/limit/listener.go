@@ -6,8 +6,11 @@ package limit
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
+	"net/http"
 	"sync"
+	"sync/atomic"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
 	"github.com/rs/zerolog"
@@ -21,35 +24,162 @@ import (
 // to prevent DDOS attack that eats all the server's CPU.
 // The downside to this is that it will Close() valid connections
 // indiscriminately.
+// A few connections over the limit are kept open so their requests are
+// answered with a 503 by Handler, connections beyond those are closed.
 
-func Listener(l net.Listener, n int) net.Listener {
-	return &limitListener{
+// maxRejectConns is the number of connections over the limit that are kept open to be answered with a 503.
+const maxRejectConns = 64
+
+// Listener wraps l so that at most n connections are open at a time.
+// A limit of 0 disables the check.
+func Listener(l net.Listener, n int) *LimitListener {
+	ll := &LimitListener{
 		Listener: l,
-		sem:      make(chan struct{}, n),
 		done:     make(chan struct{}),
 	}
+	ll.max.Store(int64(n))
+	return ll
 }
 
-type limitListener struct {
+type LimitListener struct {
 	net.Listener
-	sem       chan struct{}
+	max       atomic.Int64
+	active    atomic.Int64
+	rejecting atomic.Int64
 	closeOnce sync.Once     // ensures the done chan is only closed once
 	done      chan struct{} // no values sent; closed when Close is called
+
+	shedIdle atomic.Bool
+	mu       sync.Mutex
+	idleSeq  uint64
+	idle     map[*limitListenerConn]uint64 // idle keep-alive connections and the order they became idle
+}
+
+// SetMax changes the connection limit.
+// Open connections are not affected, the limit applies when new connections are accepted.
+func (l *LimitListener) SetMax(n int) {
+	l.max.Store(int64(n))
+}
+
+// Max returns the connection limit.
+func (l *LimitListener) Max() int64 {
+	return l.max.Load()
+}
+
+// Active returns the number of open connections counted against the limit.
+func (l *LimitListener) Active() int64 {
+	return l.active.Load()
+}
+
+// SetShedIdle enables closing the idle keep-alive connection that became idle last when a new connection
+// is accepted at the limit. Connections with requests in flight, such as long-polling checkins, are never shed.
+func (l *LimitListener) SetShedIdle(enabled bool) {
+	l.shedIdle.Store(enabled)
+	if !enabled {
+		l.mu.Lock()
+		l.idle = nil
+		l.mu.Unlock()
+	}
 }
 
-func (l *limitListener) acquire() bool {
+func (l *LimitListener) acquire() bool {
 	select {
 	case <-l.done:
 		return false
-	case l.sem <- struct{}{}:
-		return true
 	default:
+	}
+	n := l.active.Add(1)
+	if limit := l.max.Load(); limit > 0 && n > limit {
+		l.active.Add(-1)
 		return false
 	}
+	return true
 }
-func (l *limitListener) release() { <-l.sem }
+func (l *LimitListener) release() { l.active.Add(-1) }
 
-func (l *limitListener) Accept() (net.Conn, error) {
+func (l *LimitListener) acquireReject() bool {
+	if n := l.rejecting.Add(1); n > maxRejectConns {
+		l.rejecting.Add(-1)
+		return false
+	}
+	return true
+}
+func (l *LimitListener) releaseReject() { l.rejecting.Add(-1) }
+
+// shedIdleConn closes the connection that became idle last, it returns false if there are no idle connections.
+func (l *LimitListener) shedIdleConn() bool {
+	l.mu.Lock()
+	var (
+		newest *limitListenerConn
+		seq    uint64
+	)
+	for c, s := range l.idle {
+		if newest == nil || s > seq {
+			newest, seq = c, s
+		}
+	}
+	delete(l.idle, newest)
+	l.mu.Unlock()
+
+	if newest == nil {
+		return false
+	}
+	zerolog.Ctx(context.TODO()).Debug().
+		Str(logger.ECSClientAddress, newest.RemoteAddr().String()).
+		Int64("max", l.max.Load()).
+		Msg("Idle connection closed to accept a new connection at the max limit")
+	_ = newest.Close()
+	return true
+}
+
+// ConnState tracks the idle keep-alive connections that may be shed, it is meant to be used as a http.Server ConnState hook.
+func (l *LimitListener) ConnState(c net.Conn, state http.ConnState) {
+	if !l.shedIdle.Load() {
+		return
+	}
+	lc, ok := unwrapConn(c)
+	if !ok || lc.rejected {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if state != http.StateIdle {
+		delete(l.idle, lc)
+		return
+	}
+	if l.idle == nil {
+		l.idle = make(map[*limitListenerConn]uint64)
+	}
+	l.idleSeq++
+	l.idle[lc] = l.idleSeq
+}
+
+type rejectedKey struct{}
+
+// ConnContext marks the requests of the connections accepted over the limit, it is meant to be used as a http.Server ConnContext hook.
+func (l *LimitListener) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if lc, ok := unwrapConn(c); ok && lc.rejected {
+		return context.WithValue(ctx, rejectedKey{}, true)
+	}
+	return ctx
+}
+
+// Rejected returns true if the request was received on a connection accepted over the limit.
+func Rejected(ctx context.Context) bool {
+	rejected, _ := ctx.Value(rejectedKey{}).(bool)
+	return rejected
+}
+
+// unwrapConn returns the connection returned by Accept from c or the TLS connection that wraps it.
+func unwrapConn(c net.Conn) (*limitListenerConn, bool) {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	lc, ok := c.(*limitListenerConn)
+	return lc, ok
+}
+
+func (l *LimitListener) Accept() (net.Conn, error) {
 
 	// Accept the connection irregardless
 	c, err := l.Listener.Accept()
@@ -57,26 +187,33 @@ func (l *limitListener) Accept() (net.Conn, error) {
 		return nil, err
 	}
 
-	// If we cannot acquire the semaphore, close the connection
-	if acquired := l.acquire(); !acquired {
-		zlog := zerolog.Ctx(context.TODO()).Warn()
+	acquired := l.acquire()
+	if !acquired && l.shedIdle.Load() && l.shedIdleConn() {
+		acquired = l.acquire()
+	}
+	if acquired {
+		return &limitListenerConn{Conn: c, release: l.release}, nil
+	}
 
-		var err error
-		if c != nil {
-			err = c.Close()
-			zlog.Str(logger.ECSServerAddress, c.LocalAddr().String())
-			zlog.Str(logger.ECSClientAddress, c.RemoteAddr().String())
-			zlog.Err(err)
-		}
-		zlog.Int("max", cap(l.sem)).Msg("Connection closed due to max limit")
+	// Keep the connection open to answer with a 503 while there is room for it
+	if l.acquireReject() {
+		return &limitListenerConn{Conn: c, release: l.releaseReject, rejected: true}, nil
+	}
 
-		return c, nil
+	// Otherwise, close the connection
+	zlog := zerolog.Ctx(context.TODO()).Warn()
+	if c != nil {
+		err = c.Close()
+		zlog.Str(logger.ECSServerAddress, c.LocalAddr().String())
+		zlog.Str(logger.ECSClientAddress, c.RemoteAddr().String())
+		zlog.Err(err)
 	}
+	zlog.Int64("max", l.max.Load()).Msg("Connection closed due to max limit")
 
-	return &limitListenerConn{Conn: c, release: l.release}, nil
+	return c, nil
 }
 
-func (l *limitListener) Close() error {
+func (l *LimitListener) Close() error {
 	err := l.Listener.Close()
 	l.closeOnce.Do(func() { close(l.done) })
 	return err
@@ -86,6 +223,7 @@ type limitListenerConn struct {
 	net.Conn
 	releaseOnce sync.Once
 	release     func()
+	rejected    bool // accepted over the limit
 }
 
 func (l *limitListenerConn) Close() error {
@@ -93,3 +231,8 @@ func (l *limitListenerConn) Close() error {
 	l.releaseOnce.Do(l.release)
 	return err
 }
+
+// NetConn returns the underlying connection that is wrapped by l.
+func (l *limitListenerConn) NetConn() net.Conn {
+	return l.Conn
+}
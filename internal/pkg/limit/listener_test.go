@@ -0,0 +1,133 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package limit
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runLimitedServer serves on a listener limited to max connections.
+// Requests to /poll block until release is closed, requests on connections over the limit are answered with a 503.
+func runLimitedServer(t *testing.T, max int, release chan struct{}) (*LimitListener, string, chan struct{}) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ll := Listener(ln, max)
+
+	polling := make(chan struct{}, max)
+	srv := &http.Server{ //nolint:gosec // test server
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if Rejected(r.Context()) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if r.URL.Path == "/poll" {
+				polling <- struct{}{}
+				select {
+				case <-release:
+				case <-r.Context().Done():
+					return
+				}
+			}
+			w.WriteHeader(http.StatusOK)
+		}),
+		ConnState:   ll.ConnState,
+		ConnContext: ll.ConnContext,
+	}
+	go func() { _ = srv.Serve(ll) }()
+	t.Cleanup(func() { _ = srv.Close() })
+	return ll, "http://" + ln.Addr().String(), polling
+}
+
+// newClient returns a client that uses its own connection.
+func newClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{MaxConnsPerHost: 1},
+		Timeout:   5 * time.Second,
+	}
+}
+
+func get(t *testing.T, client *http.Client, url string) int {
+	t.Helper()
+	resp, err := client.Get(url) //nolint:noctx // test request
+	require.NoError(t, err)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestLimitListenerReject(t *testing.T) {
+	release := make(chan struct{})
+	ll, url, polling := runLimitedServer(t, 1, release)
+
+	pollDone := make(chan int, 1)
+	go func() {
+		resp, err := newClient().Get(url + "/poll") //nolint:noctx // test request
+		if err != nil {
+			pollDone <- 0
+			return
+		}
+		resp.Body.Close()
+		pollDone <- resp.StatusCode
+	}()
+	<-polling
+	assert.Equal(t, int64(1), ll.Active())
+
+	assert.Equal(t, http.StatusServiceUnavailable, get(t, newClient(), url))
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-pollDone, "expected the long poll to complete")
+}
+
+func TestLimitListenerShedIdle(t *testing.T) {
+	release := make(chan struct{})
+	ll, url, polling := runLimitedServer(t, 2, release)
+	ll.SetShedIdle(true)
+
+	pollDone := make(chan int, 1)
+	go func() {
+		resp, err := newClient().Get(url + "/poll") //nolint:noctx // test request
+		if err != nil {
+			pollDone <- 0
+			return
+		}
+		resp.Body.Close()
+		pollDone <- resp.StatusCode
+	}()
+	<-polling
+
+	// The keep-alive connection stays open and idle after the request.
+	idle := newClient()
+	require.Equal(t, http.StatusOK, get(t, idle, url))
+	require.Eventually(t, func() bool {
+		ll.mu.Lock()
+		defer ll.mu.Unlock()
+		return len(ll.idle) == 1
+	}, time.Second, time.Millisecond)
+
+	// The idle connection is shed for the new connection instead of the long poll.
+	assert.Equal(t, http.StatusOK, get(t, newClient(), url))
+	assert.Equal(t, int64(2), ll.Active())
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-pollDone, "expected the long poll to complete")
+}
+
+func TestLimitListenerRejectLimit(t *testing.T) {
+	ll := Listener(nil, 1)
+	for i := 0; i < maxRejectConns; i++ {
+		require.True(t, ll.acquireReject())
+	}
+	assert.False(t, ll.acquireReject(), "expected the connections over the reject limit to be closed")
+	ll.releaseReject()
+	assert.True(t, ll.acquireReject())
+}
@@ -0,0 +1,209 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+// Package audit writes the audit log of fleet-server.
+//
+// The audit log is a stream of JSON lines recording which agents were enrolled or unenrolled, which API keys were invalidated
+// and which agent client certificates were rejected.
+// It is written separately from the main log, and its events are never sampled or rate limited.
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/elastic/elastic-agent-libs/file"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+)
+
+// Event actions.
+const (
+	ActionEnroll           = "enroll"
+	ActionUnenroll         = "unenroll"
+	ActionAPIKeyInvalidate = "api_key_invalidate" //nolint:gosec // not a credential
+	ActionAgentPKIAuth     = "agent_pki_auth"
+)
+
+// Event outcomes.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Fields of the audit events.
+const (
+	FieldTimestamp = "@timestamp"
+	FieldAction    = "event.action"
+	FieldOutcome   = "event.outcome"
+	FieldAgentID   = "agent.id"
+	FieldPolicyID  = "policy.id"
+	FieldAPIKeyID  = "api_key.id" //nolint:gosec // not a credential
+	FieldClientIP  = "client.ip"
+	FieldReason    = "event.reason"
+
+	FieldTLSClientSerialNumber = "tls.client.x509.serial_number"
+	FieldTLSClientIssuer       = "tls.client.issuer"
+	FieldTLSClientSubject      = "tls.client.subject"
+	FieldTLSClientNotAfter     = "tls.client.not_after"
+)
+
+// Event is an entry of the audit log.
+// Empty fields are omitted from the entry.
+type Event struct {
+	Action   string
+	Outcome  string
+	AgentID  string
+	PolicyID string
+	// APIKeyID is the ID of the API key the event refers to, it is hashed before it is written.
+	APIKeyID string
+	ClientIP string
+	// Reason is why the action failed.
+	Reason string
+	// ClientCert is the client certificate the event refers to.
+	ClientCert *ClientCert
+}
+
+// ClientCert is the client certificate of an event.
+type ClientCert struct {
+	SerialNumber string
+	Issuer       string
+	Subject      string
+	NotAfter     time.Time
+}
+
+type auditor struct {
+	mu   sync.RWMutex
+	cfg  config.LoggingAudit
+	log  zerolog.Logger
+	sync io.Closer
+}
+
+var gAuditor = &auditor{log: zerolog.Nop()}
+
+// Configure sets the output of the audit log.
+// The current output is kept if the configuration did not change.
+func Configure(cfg config.LoggingAudit) error {
+	return gAuditor.configure(cfg)
+}
+
+// Log writes the event to the audit log.
+// The client IP of the event defaults to the one associated with the context.
+func Log(ctx context.Context, e Event) {
+	if e.ClientIP == "" {
+		e.ClientIP, _ = ctx.Value(ctxClientIPKey{}).(string)
+	}
+	gAuditor.write(e)
+}
+
+type ctxClientIPKey struct{}
+
+// WithClientIP returns a context associated with the client IP that is added to the events logged with it.
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, ctxClientIPKey{}, ip)
+}
+
+// SetOutput sets the writer the audit events are written to, regardless of the configuration.
+// It is meant to capture the events in tests.
+func SetOutput(w io.Writer) {
+	gAuditor.mu.Lock()
+	defer gAuditor.mu.Unlock()
+	gAuditor.log = zerolog.New(w)
+}
+
+func (a *auditor) configure(cfg config.LoggingAudit) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if reflect.DeepEqual(a.cfg, cfg) {
+		return nil
+	}
+
+	var (
+		out    io.Writer = io.Discard
+		closer io.Closer
+	)
+	switch {
+	case !cfg.Enabled:
+	case cfg.ToStdout:
+		out = os.Stdout
+	default:
+		rotator, err := fileRotator(cfg.Files)
+		if err != nil {
+			return err
+		}
+		out, closer = rotator, rotator
+	}
+
+	if a.sync != nil {
+		a.sync.Close() //nolint:errcheck // nowhere to report an error
+	}
+	a.cfg = cfg
+	a.log = zerolog.New(out)
+	a.sync = closer
+	return nil
+}
+
+func (a *auditor) write(e Event) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	ev := a.log.Log().
+		Str(FieldTimestamp, time.Now().UTC().Format(time.RFC3339Nano)).
+		Str(FieldAction, e.Action).
+		Str(FieldOutcome, e.Outcome)
+	if e.AgentID != "" {
+		ev.Str(FieldAgentID, e.AgentID)
+	}
+	if e.PolicyID != "" {
+		ev.Str(FieldPolicyID, e.PolicyID)
+	}
+	if e.APIKeyID != "" {
+		ev.Str(FieldAPIKeyID, hashID(e.APIKeyID))
+	}
+	if e.ClientIP != "" {
+		ev.Str(FieldClientIP, e.ClientIP)
+	}
+	if e.Reason != "" {
+		ev.Str(FieldReason, e.Reason)
+	}
+	if c := e.ClientCert; c != nil {
+		if c.SerialNumber != "" {
+			ev.Str(FieldTLSClientSerialNumber, c.SerialNumber)
+		}
+		ev.Str(FieldTLSClientIssuer, c.Issuer).
+			Str(FieldTLSClientSubject, c.Subject).
+			Str(FieldTLSClientNotAfter, c.NotAfter.UTC().Format(time.RFC3339))
+	}
+	ev.Send()
+}
+
+// hashID returns the hash of an API key ID, so that the audit log can be correlated without holding the ID itself.
+func hashID(id string) string {
+	h := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(h[:])
+}
+
+func fileRotator(files *config.LoggingAuditFiles) (*file.Rotator, error) {
+	if files == nil {
+		files = &config.LoggingAuditFiles{}
+		files.InitDefaults()
+	}
+	filename := filepath.Join(files.Path, files.Name)
+	return file.NewFileRotator(filename,
+		file.MaxSizeBytes(files.MaxSize),
+		file.MaxBackups(files.MaxBackups),
+		file.Permissions(os.FileMode(files.Permissions)),
+		file.Interval(files.Interval),
+		file.RotateOnStartup(files.RotateOnStartup),
+	)
+}
@@ -0,0 +1,78 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+)
+
+func TestLog(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	defer SetOutput(io.Discard)
+
+	ctx := WithClientIP(context.Background(), "192.0.2.1")
+	Log(ctx, Event{
+		Action:   ActionAPIKeyInvalidate,
+		Outcome:  OutcomeFailure,
+		APIKeyID: "key-id",
+	})
+
+	var event map[string]string
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &event))
+	assert.NotEmpty(t, event[FieldTimestamp])
+	delete(event, FieldTimestamp)
+	assert.Equal(t, map[string]string{
+		FieldAction:   ActionAPIKeyInvalidate,
+		FieldOutcome:  OutcomeFailure,
+		FieldAPIKeyID: hashID("key-id"),
+		FieldClientIP: "192.0.2.1",
+	}, event)
+	assert.NotContains(t, buf.String(), "key-id", "API key ID must be hashed")
+}
+
+func TestConfigureFiles(t *testing.T) {
+	defer SetOutput(io.Discard)
+
+	files := &config.LoggingAuditFiles{}
+	files.InitDefaults()
+	files.Path = t.TempDir()
+	cfg := config.LoggingAudit{Enabled: true, Files: files}
+	require.NoError(t, Configure(cfg))
+	defer func() {
+		require.NoError(t, Configure(config.LoggingAudit{}))
+	}()
+
+	Log(context.Background(), Event{Action: ActionEnroll, Outcome: OutcomeSuccess, AgentID: "agent-id"})
+	// Configuring the same settings keeps the current output.
+	require.NoError(t, Configure(cfg))
+	Log(context.Background(), Event{Action: ActionUnenroll, Outcome: OutcomeSuccess, AgentID: "agent-id"})
+
+	// The rotator suffixes the file name with the date.
+	names, err := filepath.Glob(filepath.Join(files.Path, "fleet-server-audit.log*"))
+	require.NoError(t, err)
+	require.Len(t, names, 1)
+	p, err := os.ReadFile(names[0])
+	require.NoError(t, err)
+	lines := bytes.Split(bytes.TrimSpace(p), []byte("\n"))
+	require.Len(t, lines, 2)
+	for i, action := range []string{ActionEnroll, ActionUnenroll} {
+		var event map[string]string
+		require.NoError(t, json.Unmarshal(lines[i], &event))
+		assert.Equal(t, action, event[FieldAction])
+		assert.Equal(t, "agent-id", event[FieldAgentID])
+	}
+}
@@ -51,10 +51,19 @@ const (
 
 	// Event
 	ECSEventDuration = "event.duration"
+	ECSEventKind     = "event.kind"
+	ECSEventCategory = "event.category"
+	ECSEventAction   = "event.action"
+	ECSEventOutcome  = "event.outcome"
+	ECSEventReason   = "event.reason"
 
 	// Service
 	ECSServiceName = "service.name"
 	ECSServiceType = "service.type"
+
+	// Tracing
+	ECSTraceID       = "trace.id"
+	ECSTransactionID = "transaction.id"
 )
 
 // Non ECS compliant contants used in logging
@@ -71,4 +80,5 @@ const (
 	PolicyOutputName      = "fleet.policy.output.name"
 	RevisionIdx           = "fleet.revision_idx"
 	CoordinatorIdx        = "fleet.coordinator_idx"
+	ESDuration            = "fleet.elasticsearch.duration" // nanoseconds spent waiting on Elasticsearch, like event.duration
 )
@@ -0,0 +1,204 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+// Package errlog keeps the last errors of each subsystem of fleet-server for the diagnostics bundle.
+//
+// The errors are usually rotated out of the logs by the time a diagnostics bundle is collected, so the last ones are
+// kept in memory in a ring buffer per subsystem. Their messages and fields are redacted when they are reported.
+package errlog
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+)
+
+// Subsystems reporting errors.
+const (
+	SubsystemBulker      = "bulker"
+	SubsystemMonitor     = "monitor"
+	SubsystemCoordinator = "coordinator"
+	SubsystemHandler     = "handler"
+)
+
+const redacted = "[redacted]"
+
+// Record is an error reported by a subsystem.
+type Record struct {
+	Timestamp time.Time `json:"@timestamp"`
+	// Source is the part of the subsystem that failed, such as the endpoint of a handler or the index of a monitor.
+	Source string            `json:"source"`
+	Error  string            `json:"error"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// ring holds the last records of a subsystem, the oldest record is overwritten once it is full.
+type ring struct {
+	records []Record
+	next    int
+	full    bool
+}
+
+func (r *ring) add(rec Record) {
+	r.records[r.next] = rec
+	r.next++
+	if r.next == len(r.records) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// list returns the records from the oldest to the newest.
+func (r *ring) list() []Record {
+	if !r.full {
+		return append([]Record(nil), r.records[:r.next]...)
+	}
+	return append(append([]Record(nil), r.records[r.next:]...), r.records[:r.next]...)
+}
+
+type recorder struct {
+	mu    sync.Mutex
+	size  int
+	rings map[string]*ring
+}
+
+var gRecorder = newRecorder(defaultConfig())
+
+func defaultConfig() config.LoggingRecentErrors {
+	var cfg config.LoggingRecentErrors
+	cfg.InitDefaults()
+	return cfg
+}
+
+func newRecorder(cfg config.LoggingRecentErrors) *recorder {
+	r := &recorder{rings: make(map[string]*ring)}
+	r.configure(cfg)
+	return r
+}
+
+// Configure sets the number of errors kept per subsystem.
+// The newest errors are kept if the size is reduced.
+func Configure(cfg config.LoggingRecentErrors) {
+	gRecorder.configure(cfg)
+}
+
+// Report records err as the last error of the subsystem, the fields add the context of the error.
+func Report(subsystem, source string, err error, fields map[string]string) {
+	if err == nil {
+		return
+	}
+	gRecorder.report(subsystem, source, err, fields)
+}
+
+// Snapshot returns the records of each subsystem from the oldest to the newest.
+func Snapshot() map[string][]Record {
+	return gRecorder.snapshot()
+}
+
+// Dump returns the records of each subsystem as indented JSON, it is included in the diagnostics bundle.
+func Dump() ([]byte, error) {
+	return json.MarshalIndent(Snapshot(), "", "  ")
+}
+
+func (r *recorder) configure(cfg config.LoggingRecentErrors) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if cfg.Size == r.size {
+		return
+	}
+	r.size = cfg.Size
+	for subsystem, old := range r.rings {
+		if r.size <= 0 {
+			delete(r.rings, subsystem)
+			continue
+		}
+		resized := &ring{records: make([]Record, r.size)}
+		records := old.list()
+		if len(records) > r.size {
+			records = records[len(records)-r.size:]
+		}
+		for _, rec := range records {
+			resized.add(rec)
+		}
+		r.rings[subsystem] = resized
+	}
+}
+
+func (r *recorder) report(subsystem, source string, err error, fields map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.size <= 0 {
+		return
+	}
+	rec := Record{
+		Timestamp: time.Now().UTC(),
+		Source:    source,
+		Error:     redact(err.Error()),
+	}
+	if len(fields) > 0 {
+		rec.Fields = make(map[string]string, len(fields))
+		for k, v := range fields {
+			if isSecretKey(k) {
+				v = redacted
+			}
+			rec.Fields[k] = redact(v)
+		}
+	}
+	rg, ok := r.rings[subsystem]
+	if !ok {
+		rg = &ring{records: make([]Record, r.size)}
+		r.rings[subsystem] = rg
+	}
+	rg.add(rec)
+}
+
+func (r *recorder) snapshot() map[string][]Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	snap := make(map[string][]Record, len(r.rings))
+	for subsystem, rg := range r.rings {
+		snap[subsystem] = rg.list()
+	}
+	return snap
+}
+
+// secretKeys are the names of the settings, fields and parameters whose values are redacted.
+var secretKeys = []string{"password", "passphrase", "api_key", "apikey", "token", "secret", "authorization"}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range secretKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+var redactions = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// Credentials of authorization headers.
+	{regexp.MustCompile(`(?i)\b(ApiKey|Bearer|Basic)\s+[A-Za-z0-9+/=._~:-]+`), "${1} " + redacted},
+	// User info of URLs.
+	{regexp.MustCompile(`://[^/@\s]+@`), "://" + redacted + "@"},
+	// Values of secret settings and query parameters.
+	{regexp.MustCompile(`(?i)\b(\w*(?:password|passphrase|api_key|apikey|token|secret)\w*)("?\s*[:=]\s*"?)[^\s"&,}]+`), "${1}${2}" + redacted},
+}
+
+// redact replaces the credentials and secret values found in s.
+func redact(s string) string {
+	for _, r := range redactions {
+		s = r.re.ReplaceAllString(s, r.repl)
+	}
+	return s
+}
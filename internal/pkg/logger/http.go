@@ -21,6 +21,7 @@ import (
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/apikey"
 	"go.elastic.co/apm/module/apmzerolog/v2"
+	"go.elastic.co/apm/v2"
 )
 
 const (
@@ -196,6 +197,7 @@ func httpDebug(r *http.Request, e *zerolog.Event) {
 // It will also attach a (zerolog) logger, and request start time to each requests' context.
 // The default settings will result in an ECS compliant entry if the response code is not 2XX.
 // The middleware will generate a new UUID if there's no X-Request-ID header
+// Without an APM transaction the trace context is taken from the traceparent header or generated, see TraceContextFromContext.
 // Responses will also have the X-Request-ID header set.
 // If debug is enabled a request will result in 2 log entries; one at the start of the request and one when the response is sent (regardless of status code)
 func Middleware(next http.Handler) http.Handler {
@@ -220,6 +222,11 @@ func Middleware(next http.Handler) http.Handler {
 		// Add trace correlation fields
 		ctx := r.Context()
 		zlog := zerolog.Ctx(ctx).Hook(apmzerolog.TraceContextHook(ctx))
+		if apm.TransactionFromContext(ctx) == nil {
+			tc := requestTraceContext(r)
+			ctx = ContextWithTraceContext(ctx, tc)
+			zlog = withTraceContext(zlog, tc)
+		}
 		// Update request context
 		// NOTE this injects the request id and addr into all logs that use the request logger
 		zlog = zlog.With().Str(ECSHTTPRequestID, reqID).Str(ECSServerAddress, addr).Logger()
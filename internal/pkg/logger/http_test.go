@@ -5,13 +5,18 @@
 package logger
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.elastic.co/apm/v2"
 
 	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
 )
@@ -39,3 +44,56 @@ func TestMiddleware(t *testing.T) {
 	reqID := req.Header.Get(HeaderRequestID)
 	require.NotEmpty(t, reqID)
 }
+
+func TestMiddlewareTraceContext(t *testing.T) {
+	const traceparent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+
+	tests := []struct {
+		name        string
+		traceparent string
+		traceID     string
+	}{{
+		name:        "incoming traceparent",
+		traceparent: traceparent,
+		traceID:     "0af7651916cd43dd8448eb211c80319c",
+	}, {
+		name: "no traceparent",
+	}, {
+		name:        "invalid traceparent",
+		traceparent: "00-invalid",
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			ctx := zerolog.New(&buf).Level(zerolog.InfoLevel).WithContext(context.Background())
+
+			var trace apm.TraceContext
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var ok bool
+				trace, ok = TraceContextFromContext(r.Context())
+				require.True(t, ok, "expected context to have a trace context")
+				zerolog.Ctx(r.Context()).Info().Msg("handled")
+				w.WriteHeader(http.StatusOK)
+			})
+
+			req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+			if tc.traceparent != "" {
+				req.Header.Set("traceparent", tc.traceparent)
+			}
+			Middleware(h).ServeHTTP(httptest.NewRecorder(), req)
+
+			require.NoError(t, trace.Trace.Validate())
+			require.NoError(t, trace.Span.Validate())
+			if tc.traceID != "" {
+				assert.Equal(t, tc.traceID, trace.Trace.String())
+				assert.NotEqual(t, "b7ad6b7169203331", trace.Span.String(), "expected the request to have its own span")
+			}
+
+			var entry map[string]interface{}
+			require.NoError(t, json.Unmarshal(bytes.SplitN(buf.Bytes(), []byte("\n"), 2)[0], &entry))
+			assert.Equal(t, "handled", entry["message"])
+			assert.Equal(t, trace.Trace.String(), entry[ECSTraceID])
+			assert.Equal(t, trace.Span.String(), entry[ECSTransactionID])
+		})
+	}
+}
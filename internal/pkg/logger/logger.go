@@ -20,6 +20,8 @@ import (
 
 	"github.com/elastic/elastic-agent-libs/file"
 	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger/audit"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger/errlog"
 )
 
 var once sync.Once
@@ -62,6 +64,11 @@ func (l *Logger) Reload(_ context.Context, cfg *config.Config) error {
 		log.Logger = l.log
 		zerolog.DefaultContextLogger = &l.log // introduces race conditions in integration test?
 	}
+	if err := audit.Configure(cfg.Logging.Audit); err != nil {
+		return err
+	}
+	errlog.Configure(cfg.Logging.RecentErrors)
+	SetSlowRequestThreshold(cfg.Logging.SlowRequestThreshold)
 	l.cfg = cfg
 	return nil
 }
@@ -79,10 +86,17 @@ func Init(cfg *config.Config, svcName string) (*Logger, error) {
 	once.Do(func() {
 		zerolog.SetGlobalLevel(level(cfg))
 
-		out, wr, err := getOutput(cfg)
+		var out io.Writer
+		var wr WriterSync
+		out, wr, err = getOutput(cfg)
 		if err != nil {
 			return
 		}
+		if err = audit.Configure(cfg.Logging.Audit); err != nil {
+			return
+		}
+		errlog.Configure(cfg.Logging.RecentErrors)
+		SetSlowRequestThreshold(cfg.Logging.SlowRequestThreshold)
 		l := ecszerolog.New(out)
 		if svcName != "" {
 			l = l.With().Str(ECSServiceName, svcName).Str(ECSServiceType, svcName).Logger()
@@ -0,0 +1,79 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package logger
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Slow request logging.
+//
+// The requests that take longer than the threshold are logged with the time they spent waiting on Elasticsearch,
+// which is added to the RequestTiming of the request context by the bulker. The time a request spends
+// waiting on purpose, such as a checkin long poll, is not counted.
+
+var slowRequestThreshold atomic.Int64
+
+// SetSlowRequestThreshold sets the duration over which requests are logged as slow, 0 disables the logging.
+func SetSlowRequestThreshold(d time.Duration) {
+	slowRequestThreshold.Store(int64(d))
+}
+
+// SlowRequestThreshold returns the duration over which requests are logged as slow.
+func SlowRequestThreshold() time.Duration {
+	return time.Duration(slowRequestThreshold.Load())
+}
+
+// RequestTiming accumulates where the time of a request is spent. It is safe for concurrent use and the methods
+// of a nil RequestTiming do nothing.
+type RequestTiming struct {
+	es   atomic.Int64
+	wait atomic.Int64
+}
+
+type requestTimingKey struct{}
+
+// ContextWithRequestTiming returns a copy of ctx that carries t.
+func ContextWithRequestTiming(ctx context.Context, t *RequestTiming) context.Context {
+	return context.WithValue(ctx, requestTimingKey{}, t)
+}
+
+// RequestTimingFromContext returns the RequestTiming of the request that ctx belongs to, or nil.
+func RequestTimingFromContext(ctx context.Context) *RequestTiming {
+	t, _ := ctx.Value(requestTimingKey{}).(*RequestTiming)
+	return t
+}
+
+// AddES adds time spent waiting on Elasticsearch.
+func (t *RequestTiming) AddES(d time.Duration) {
+	if t != nil {
+		t.es.Add(int64(d))
+	}
+}
+
+// AddWait adds time the request spent waiting on purpose.
+func (t *RequestTiming) AddWait(d time.Duration) {
+	if t != nil {
+		t.wait.Add(int64(d))
+	}
+}
+
+// ES returns the time spent waiting on Elasticsearch.
+func (t *RequestTiming) ES() time.Duration {
+	if t == nil {
+		return 0
+	}
+	return time.Duration(t.es.Load())
+}
+
+// Wait returns the time the request spent waiting on purpose.
+func (t *RequestTiming) Wait() time.Duration {
+	if t == nil {
+		return 0
+	}
+	return time.Duration(t.wait.Load())
+}
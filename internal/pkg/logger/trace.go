@@ -0,0 +1,64 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package logger
+
+import (
+	"context"
+	"crypto/rand"
+	"net/http"
+
+	"github.com/rs/zerolog"
+	"go.elastic.co/apm/module/apmhttp/v2"
+	"go.elastic.co/apm/v2"
+)
+
+// Trace context of the requests when the APM tracer is disabled.
+//
+// When the APM tracer is enabled the transactions started by the APM middleware carry the trace context,
+// the trace ids are added to the logs by the apmzerolog hook and propagated to Elasticsearch by the
+// instrumented round tripper. Otherwise a trace context is honored from the traceparent header of the
+// request or generated, so the logs of a request can still be joined with the Elasticsearch logs.
+
+type traceCtxKey struct{}
+
+// ContextWithTraceContext returns a copy of ctx that carries tc.
+func ContextWithTraceContext(ctx context.Context, tc apm.TraceContext) context.Context {
+	return context.WithValue(ctx, traceCtxKey{}, tc)
+}
+
+// TraceContextFromContext returns the trace context of the request that ctx belongs to.
+// The trace context of the APM transaction is returned if there is one.
+func TraceContextFromContext(ctx context.Context) (apm.TraceContext, bool) {
+	if tx := apm.TransactionFromContext(ctx); tx != nil {
+		return tx.TraceContext(), true
+	}
+	tc, ok := ctx.Value(traceCtxKey{}).(apm.TraceContext)
+	return tc, ok
+}
+
+// NewTraceContext returns a trace context with a new trace id.
+func NewTraceContext() apm.TraceContext {
+	var tc apm.TraceContext
+	_, _ = rand.Read(tc.Trace[:])
+	_, _ = rand.Read(tc.Span[:])
+	return tc
+}
+
+// requestTraceContext returns the trace context of r. The trace id of a valid traceparent header is kept,
+// the request gets its own span id as a child of the caller.
+func requestTraceContext(r *http.Request) apm.TraceContext {
+	if h := r.Header.Get(apmhttp.W3CTraceparentHeader); h != "" {
+		if tc, err := apmhttp.ParseTraceparentHeader(h); err == nil {
+			_, _ = rand.Read(tc.Span[:])
+			return tc
+		}
+	}
+	return NewTraceContext()
+}
+
+// withTraceContext adds the ids of tc to the log entries.
+func withTraceContext(zlog zerolog.Logger, tc apm.TraceContext) zerolog.Logger {
+	return zlog.With().Str(ECSTraceID, tc.Trace.String()).Str(ECSTransactionID, tc.Span.String()).Logger()
+}
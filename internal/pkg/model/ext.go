@@ -5,8 +5,10 @@
 package model
 
 import (
-	"maps"
+	"slices"
 	"time"
+
+	"github.com/rs/zerolog"
 )
 
 // Time returns the time for the current leader.
@@ -42,6 +44,20 @@ func (a *Agent) CheckDifferentVersion(ver string) string {
 	return ""
 }
 
+// InNamespaces returns true when a document with the namespaces is visible to an agent with agentNamespaces. Agents
+// without namespaces see the documents of all the namespaces, and documents without namespaces are visible to all the agents.
+func InNamespaces(agentNamespaces, namespaces []string) bool {
+	if len(agentNamespaces) == 0 || len(namespaces) == 0 {
+		return true
+	}
+	for _, ns := range namespaces {
+		if slices.Contains(agentNamespaces, ns) {
+			return true
+		}
+	}
+	return false
+}
+
 // APIKeyIDs returns all the API keys, the valid, in-use as well as the one
 // marked to be retired.
 func (a *Agent) APIKeyIDs() []ToRetireAPIKeyIdsItems {
@@ -80,42 +96,26 @@ func (a *Agent) APIKeyIDs() []ToRetireAPIKeyIdsItems {
 
 }
 
-func ClonePolicyData(d *PolicyData) *PolicyData {
-	if d == nil {
-		return nil
+// MarshalZerologObject logs the policy with its data redacted, the data of a policy being dispatched holds resolved secret values.
+func (p Policy) MarshalZerologObject(e *zerolog.Event) {
+	e.Str("policy_id", p.PolicyID).
+		Int64("revision_idx", p.RevisionIdx).
+		Int64("coordinator_idx", p.CoordinatorIdx)
+	if p.Data != nil {
+		e.Object("data", p.Data)
 	}
-	res := &PolicyData{
-		Agent:             d.Agent,
-		Fleet:             d.Fleet,
-		ID:                d.ID,
-		Inputs:            make([]map[string]interface{}, 0, len(d.Inputs)),
-		OutputPermissions: d.OutputPermissions,
-		Outputs:           cloneMap(d.Outputs),
-		Revision:          d.Revision,
-		SecretReferences:  make([]SecretReferencesItems, 0, len(d.SecretReferences)),
-	}
-	for _, m := range d.Inputs {
-		res.Inputs = append(res.Inputs, maps.Clone(m))
-	}
-	res.SecretReferences = append(res.SecretReferences, d.SecretReferences...)
-	if d.Signed != nil {
-		res.Signed = &Signed{
-			Data:      d.Signed.Data,
-			Signature: d.Signed.Signature,
-		}
-	}
-	return res
 }
 
-// cloneMap does a deep copy on a map of objects
-// TODO generics?
-func cloneMap(m map[string]map[string]interface{}) map[string]map[string]interface{} {
-	if m == nil {
-		return nil
-	}
-	r := make(map[string]map[string]interface{})
-	for k, v := range m {
-		r[k] = maps.Clone(v)
+// MarshalZerologObject logs the outline of the policy data, the inputs and outputs are not logged as they may hold resolved secret values.
+func (d PolicyData) MarshalZerologObject(e *zerolog.Event) {
+	outputs := make([]string, 0, len(d.Outputs))
+	for name := range d.Outputs {
+		outputs = append(outputs, name)
 	}
-	return r
+	slices.Sort(outputs)
+	e.Str("id", d.ID).
+		Int64("revision", d.Revision).
+		Int("inputs", len(d.Inputs)).
+		Strs("outputs", outputs).
+		Int("secret_references", len(d.SecretReferences))
 }
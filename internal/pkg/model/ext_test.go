@@ -165,3 +165,35 @@ func TestAgentAPIKeyIDs(t *testing.T) {
 		})
 	}
 }
+
+func TestInNamespaces(t *testing.T) {
+	tests := []struct {
+		name            string
+		agentNamespaces []string
+		namespaces      []string
+		want            bool
+	}{{
+		name:       "agent without namespaces",
+		namespaces: []string{"space1"},
+		want:       true,
+	}, {
+		name:            "document without namespaces",
+		agentNamespaces: []string{"space1"},
+		want:            true,
+	}, {
+		name:            "same namespace",
+		agentNamespaces: []string{"space1"},
+		namespaces:      []string{"space2", "space1"},
+		want:            true,
+	}, {
+		name:            "other namespace",
+		agentNamespaces: []string{"space1"},
+		namespaces:      []string{"space2"},
+		want:            false,
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, InNamespaces(tc.agentNamespaces, tc.namespaces))
+		})
+	}
+}
@@ -61,6 +61,9 @@ type Action struct {
 	// The action start date/time
 	StartTime string `json:"start_time,omitempty"`
 
+	// The agent tags the action is intended for, the action is delivered to the agents with any of the tags in addition to the listed agents.
+	Tags []string `json:"tags,omitempty"`
+
 	// The optional action timeout in seconds
 	Timeout int64 `json:"timeout,omitempty"`
 
@@ -93,6 +96,9 @@ type ActionResult struct {
 	// The custom action response payload.
 	ActionResponse json.RawMessage `json:"action_response,omitempty"`
 
+	// The custom action response payload was larger than the max size and was truncated.
+	ActionResponseTruncated bool `json:"action_response_truncated,omitempty"`
+
 	// The agent id.
 	AgentID string `json:"agent_id,omitempty"`
 
@@ -150,6 +156,9 @@ type Agent struct {
 	// Date/time the Elastic Agent checked in last time
 	LastCheckin string `json:"last_checkin,omitempty"`
 
+	// IP address the Elastic Agent checked in from last time
+	LastCheckinIP string `json:"last_checkin_ip,omitempty"`
+
 	// Last checkin message
 	LastCheckinMessage string `json:"last_checkin_message,omitempty"`
 
@@ -183,6 +192,9 @@ type Agent struct {
 	// The current policy revision_idx for the Elastic Agent
 	PolicyRevisionIdx int64 `json:"policy_revision_idx,omitempty"`
 
+	// Hash of the token that allows the Elastic Agent to be replaced when it enrolls again with the same ID
+	ReplaceToken string `json:"replace_token,omitempty"`
+
 	// Shared ID
 	SharedID string `json:"shared_id,omitempty"`
 
@@ -268,6 +280,24 @@ type Artifact struct {
 	PackageName string `json:"package_name,omitempty"`
 }
 
+// Bootstrap The policy and enrollment key created by a standalone Fleet Server on a cluster without Kibana
+type Bootstrap struct {
+	ESDocument
+
+	// The API key ID of the created enrollment key
+	EnrollmentAPIKeyID string `json:"enrollment_api_key_id,omitempty"`
+
+	// The ID of the created policy
+	PolicyID string          `json:"policy_id"`
+	Server   *ServerMetadata `json:"server,omitempty"`
+
+	// The status of the bootstrap, started while the server creates the documents and completed once they are created. A document without status is completed.
+	Status string `json:"status,omitempty"`
+
+	// Date/time the bootstrap was last updated
+	Timestamp string `json:"@timestamp,omitempty"`
+}
+
 // Checkin An Elastic Agent checkin to Fleet
 type Checkin struct {
 	ESDocument
@@ -317,6 +347,21 @@ type CheckinPolicyInputItems struct {
 	TemplateID string `json:"template_id"`
 }
 
+// CleanupProgress The last agent processed by an unfinished pass of a cleanup of the agents
+type CleanupProgress struct {
+	ESDocument
+
+	// The ID of the last processed agent, empty when no pass is in progress
+	LastAgentID string `json:"last_agent_id"`
+
+	// The name of the cleanup
+	Name   string          `json:"name"`
+	Server *ServerMetadata `json:"server,omitempty"`
+
+	// Date/time the progress was stored
+	Timestamp string `json:"@timestamp,omitempty"`
+}
+
 // ComponentsItems
 type ComponentsItems struct {
 	ID      string       `json:"id,omitempty"`
@@ -347,6 +392,12 @@ type EnrollmentAPIKey struct {
 	CreatedAt string `json:"created_at,omitempty"`
 	ExpireAt  string `json:"expire_at,omitempty"`
 
+	// Date/time after which the key can not be used to enroll agents
+	ExpiresAt string `json:"expires_at,omitempty"`
+
+	// The maximum number of agents that can be enrolled with the key, unlimited when not set
+	MaxAgents int64 `json:"max_agents,omitempty"`
+
 	// Enrollment key name
 	Name string `json:"name,omitempty"`
 
@@ -354,6 +405,9 @@ type EnrollmentAPIKey struct {
 	Namespaces []string `json:"namespaces,omitempty"`
 	PolicyID   string   `json:"policy_id,omitempty"`
 	UpdatedAt  string   `json:"updated_at,omitempty"`
+
+	// The number of agents enrolled with the key, maintained when max_agents is set
+	UsageCount int64 `json:"usage_count,omitempty"`
 }
 
 // HostMetadata The host metadata for the Elastic Agent
@@ -372,6 +426,33 @@ type HostMetadata struct {
 	Name string `json:"name"`
 }
 
+// IndexMigrations The version of the index migrations applied by Fleet Server
+type IndexMigrations struct {
+	ESDocument
+	Server *ServerMetadata `json:"server,omitempty"`
+
+	// Date/time the last migration was applied
+	Timestamp string `json:"@timestamp,omitempty"`
+
+	// The version of the last applied migration
+	Version int64 `json:"version"`
+}
+
+// MonitorCheckpoint The last checkpoint of an index processed by the monitor of a Fleet Server
+type MonitorCheckpoint struct {
+	ESDocument
+
+	// The global checkpoint of the index
+	Checkpoint []int64 `json:"checkpoint"`
+
+	// The monitored index
+	Index  string          `json:"index"`
+	Server *ServerMetadata `json:"server"`
+
+	// Date/time the checkpoint was stored
+	Timestamp string `json:"@timestamp,omitempty"`
+}
+
 // OutputHealth Output health represents a health state of an output
 type OutputHealth struct {
 	ESDocument
@@ -534,4 +615,10 @@ type UnitsItems struct {
 
 // UpgradeDetails Additional upgrade status details.
 type UpgradeDetails struct {
+
+	// The upgrade action ID the details are associated with.
+	ActionID string `json:"action_id,omitempty"`
+
+	// The upgrade state.
+	State string `json:"state,omitempty"`
 }
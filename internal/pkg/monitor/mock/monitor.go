@@ -74,7 +74,16 @@ func (m *MockMonitor) Output() <-chan []es.HitT {
 	return args.Get(0).(<-chan []es.HitT)
 }
 
+func (m *MockMonitor) Nudge() {
+	m.Called()
+}
+
 func (m *MockMonitor) State() client.UnitState {
 	args := m.Called()
 	return args.Get(0).(client.UnitState)
 }
+
+func (m *MockMonitor) PolicyReady() bool {
+	args := m.Called()
+	return args.Bool(0)
+}
@@ -11,6 +11,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
 	"sync"
 	"time"
 
@@ -18,6 +19,7 @@ import (
 	"github.com/elastic/fleet-server/v7/internal/pkg/dsl"
 	"github.com/elastic/fleet-server/v7/internal/pkg/es"
 	"github.com/elastic/fleet-server/v7/internal/pkg/gcheckpt"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger/errlog"
 	"github.com/elastic/fleet-server/v7/internal/pkg/sleep"
 	"github.com/elastic/fleet-server/v7/internal/pkg/sqn"
 
@@ -73,6 +75,9 @@ type SimpleMonitor interface {
 	BaseMonitor
 	// Output is the channel the monitor send new documents to
 	Output() <-chan []es.HitT
+	// Nudge makes a low latency monitor fetch the documents written up to the current global checkpoint without
+	// waiting for the global checkpoint to advance. It does nothing on other monitors.
+	Nudge()
 }
 
 // simpleMonitorT monitors for new documents in an index
@@ -88,6 +93,16 @@ type simpleMonitorT struct {
 	withExpiration bool
 	fetchSize      int
 	debounceTime   time.Duration
+	healthObserver func(err error)
+
+	checkpointStore CheckpointStore
+	maxReplay       int
+	savedCheckpoint sqn.SeqNo // last checkpoint saved in the store, only accessed by Run
+
+	lowLatency   bool
+	pollInterval time.Duration
+	nudgeCh      chan struct{}
+	after        func(time.Duration) <-chan time.Time // poll interval timer, replaced in tests
 
 	checkpoint sqn.SeqNo    // index global checkpoint
 	mx         sync.RWMutex // checkpoint mutex
@@ -99,6 +114,15 @@ type simpleMonitorT struct {
 	readyCh chan error
 }
 
+// CheckpointStore persists the checkpoint processed by a monitor, so that a restarted monitor replays the documents
+// written while it was not running.
+type CheckpointStore interface {
+	// LoadCheckpoint returns the stored checkpoint of the index, it is not set if none was stored.
+	LoadCheckpoint(ctx context.Context, index string) (sqn.SeqNo, error)
+	// SaveCheckpoint stores the checkpoint of the index.
+	SaveCheckpoint(ctx context.Context, index string, checkpoint sqn.SeqNo) error
+}
+
 // Option is a functional configuration option.
 type Option func(SimpleMonitor)
 
@@ -115,6 +139,8 @@ func NewSimple(index string, esCli, monCli *elasticsearch.Client, opts ...Option
 		debounceTime:   0,
 		checkpoint:     sqn.DefaultSeqNo,
 		outCh:          make(chan []es.HitT, 1),
+		nudgeCh:        make(chan struct{}, 1),
+		after:          time.After,
 	}
 
 	for _, opt := range opts {
@@ -178,11 +204,58 @@ func WithDebounceTime(dur time.Duration) Option {
 	}
 }
 
+// WithHealthObserver sets a function called with the outcome of the requests of the monitor to Elasticsearch,
+// a nil err is a success.
+func WithHealthObserver(f func(err error)) Option {
+	return func(m SimpleMonitor) {
+		m.(*simpleMonitorT).healthObserver = f
+	}
+}
+
+// WithCheckpointStore saves the processed checkpoint in store. On start the documents written since the stored
+// checkpoint are sent before the new ones, up to maxReplay documents.
+func WithCheckpointStore(store CheckpointStore, maxReplay int) Option {
+	return func(m SimpleMonitor) {
+		m.(*simpleMonitorT).checkpointStore = store
+		m.(*simpleMonitorT).maxReplay = maxReplay
+	}
+}
+
+// WithLowLatency makes the monitor fetch the new documents when it is nudged, instead of waiting for the global
+// checkpoint to advance. A pollInterval greater than 0 nudges the monitor on that interval.
+func WithLowLatency(pollInterval time.Duration) Option {
+	return func(m SimpleMonitor) {
+		m.(*simpleMonitorT).lowLatency = true
+		m.(*simpleMonitorT).pollInterval = pollInterval
+	}
+}
+
+func (m *simpleMonitorT) observe(err error) {
+	if m.healthObserver != nil {
+		m.healthObserver(err)
+	}
+	// The index is missing until the first document is written, it is not reported as an error.
+	if !errors.Is(err, es.ErrIndexNotFound) && !errors.Is(err, context.Canceled) {
+		errlog.Report(errlog.SubsystemMonitor, m.index, err, nil)
+	}
+}
+
 // Output returns the output channel for the monitor.
 func (m *simpleMonitorT) Output() <-chan []es.HitT {
 	return m.outCh
 }
 
+// Nudge implements SimpleMonitor interface.
+func (m *simpleMonitorT) Nudge() {
+	if !m.lowLatency {
+		return
+	}
+	select {
+	case m.nudgeCh <- struct{}{}:
+	default:
+	}
+}
+
 // GetCheckpoint implements GlobalCheckpointProvider interface.
 func (m *simpleMonitorT) GetCheckpoint() sqn.SeqNo {
 	return m.loadCheckpoint()
@@ -210,6 +283,7 @@ func (m *simpleMonitorT) Run(ctx context.Context) (err error) {
 			err = nil
 		}
 		m.log.Info().Err(err).Msg("index monitor exited")
+		errlog.Report(errlog.SubsystemMonitor, m.index, err, map[string]string{"event": "exited"})
 	}()
 
 	defer func() {
@@ -228,6 +302,7 @@ func (m *simpleMonitorT) Run(ctx context.Context) (err error) {
 		span, sCtx := apm.StartSpan(ctx, "global_checkpoint", "fleet_global_checkpoints")
 		checkpoint, err := gcheckpt.Query(sCtx, m.monCli, m.index)
 		span.End()
+		m.observe(err)
 		if err != nil {
 			m.log.Warn().Err(err).Msg("failed to initialize the global checkpoints, will retry")
 			err = sleep.WithContext(ctx, retryDelay)
@@ -258,6 +333,11 @@ func (m *simpleMonitorT) Run(ctx context.Context) (err error) {
 		m.readyCh = nil
 	}
 
+	if m.checkpointStore != nil {
+		m.replay(ctx, m.loadCheckpoint())
+		m.saveCheckpoint(ctx)
+	}
+
 	for {
 		if m.tracer != nil {
 			trans = m.tracer.StartTransaction(fmt.Sprintf("Monitor index %s", m.index), "monitor")
@@ -269,8 +349,12 @@ func (m *simpleMonitorT) Run(ctx context.Context) (err error) {
 		// It returns only if there are new documents fully indexed with _seq_no greater than the passed checkpoint value
 		// or the timeout (long poll interval).
 		span, gCtx := apm.StartSpan(ctx, "global_checkpoint", "wait_for_advance")
-		newCheckpoint, err := gcheckpt.WaitAdvance(gCtx, m.monCli, m.index, checkpoint, m.pollTimeout)
+		newCheckpoint, err := m.waitAdvance(gCtx, checkpoint)
 		span.End()
+		if !errors.Is(err, es.ErrTimeout) {
+			// A timeout is the end of the long poll, not a failure.
+			m.observe(err)
+		}
 		if err != nil {
 			if errors.Is(err, es.ErrIndexNotFound) {
 				// Wait until created
@@ -309,6 +393,13 @@ func (m *simpleMonitorT) Run(ctx context.Context) (err error) {
 			}
 			continue
 		}
+		if newCheckpoint.Value() <= checkpoint.Value() {
+			// Nudged with no new documents
+			if m.tracer != nil {
+				trans.End()
+			}
+			continue
+		}
 
 		// This is an example of steps for fetching the documents without "holes" (not-yet-indexed documents in between)
 		// as recommended by Elasticsearch team on August 25th, 2021
@@ -328,6 +419,7 @@ func (m *simpleMonitorT) Run(ctx context.Context) (err error) {
 		for count == m.fetchSize {
 			// Fetch the documents between the last known checkpoint and the new checkpoint value received from "wait advance".
 			hits, err := m.fetch(ctx, checkpoint, newCheckpoint)
+			m.observe(err)
 			if err != nil {
 				m.log.Error().Err(err).Msg("failed checking new documents")
 				if m.tracer != nil {
@@ -357,6 +449,7 @@ func (m *simpleMonitorT) Run(ctx context.Context) (err error) {
 				m.storeCheckpoint(newCheckpoint)
 			}
 		}
+		m.saveCheckpoint(ctx)
 		if m.tracer != nil {
 			trans.End()
 		}
@@ -373,6 +466,101 @@ func (m *simpleMonitorT) Run(ctx context.Context) (err error) {
 	}
 }
 
+// waitAdvance waits for the global checkpoint of the index to advance past checkpoint.
+// A low latency monitor stops waiting when it is nudged or its poll interval elapses, it returns the current global
+// checkpoint then, which may not have advanced.
+func (m *simpleMonitorT) waitAdvance(ctx context.Context, checkpoint sqn.SeqNo) (sqn.SeqNo, error) {
+	if !m.lowLatency {
+		return gcheckpt.WaitAdvance(ctx, m.monCli, m.index, checkpoint, m.pollTimeout)
+	}
+
+	type result struct {
+		checkpoint sqn.SeqNo
+		err        error
+	}
+	wCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	resCh := make(chan result, 1)
+	go func() {
+		checkpoint, err := gcheckpt.WaitAdvance(wCtx, m.monCli, m.index, checkpoint, m.pollTimeout)
+		resCh <- result{checkpoint, err}
+	}()
+
+	var poll <-chan time.Time
+	if m.pollInterval > 0 {
+		poll = m.after(m.pollInterval)
+	}
+	select {
+	case res := <-resCh:
+		return res.checkpoint, res.err
+	case <-m.nudgeCh:
+	case <-poll:
+	}
+	cancel()
+	<-resCh
+	return gcheckpt.Query(ctx, m.monCli, m.index)
+}
+
+// replay sends the documents written between the stored checkpoint and current, the checkpoint the monitor starts
+// from, so that the documents written while the monitor was not running are not missed. At most maxReplay documents
+// are sent. The monitor checkpoint is current afterwards.
+func (m *simpleMonitorT) replay(ctx context.Context, current sqn.SeqNo) {
+	defer m.storeCheckpoint(current)
+
+	stored, err := m.checkpointStore.LoadCheckpoint(ctx, m.index)
+	if err != nil {
+		m.log.Warn().Err(err).Msg("failed to load the stored checkpoint, the documents written before the start are not replayed")
+		return
+	}
+	if !stored.IsSet() || stored.Value() >= current.Value() {
+		return
+	}
+
+	from := stored
+	replayed := 0
+	for replayed < m.maxReplay {
+		hits, err := m.fetch(ctx, from, current)
+		m.observe(err)
+		if err != nil {
+			m.log.Warn().Err(err).Int("replayed", replayed).Msg("failed to replay the documents written before the start")
+			return
+		}
+		if room := m.maxReplay - replayed; len(hits) > room {
+			hits = hits[:room]
+		}
+		n := m.notify(ctx, hits)
+		replayed += n
+		if n < m.fetchSize {
+			break
+		}
+		from = sqn.SeqNo{hits[n-1].SeqNo}
+	}
+
+	if replayed >= m.maxReplay {
+		m.log.Warn().Ints64("from", stored).Ints64("to", current).Int("max_replay", m.maxReplay).
+			Msg("replay limit reached, the later documents written before the start are not replayed")
+		return
+	}
+	m.log.Info().Ints64("from", stored).Ints64("to", current).Int("replayed", replayed).
+		Msg("replayed the documents written before the start")
+}
+
+// saveCheckpoint saves the checkpoint in the store if it changed since it was last saved.
+func (m *simpleMonitorT) saveCheckpoint(ctx context.Context) {
+	if m.checkpointStore == nil {
+		return
+	}
+	checkpoint := m.loadCheckpoint()
+	if slices.Equal(checkpoint, m.savedCheckpoint) {
+		return
+	}
+	if err := m.checkpointStore.SaveCheckpoint(ctx, m.index, checkpoint); err != nil {
+		m.log.Warn().Err(err).Msg("failed to save the checkpoint, documents may be replayed after a restart")
+		return
+	}
+	m.savedCheckpoint = checkpoint
+}
+
 func (m *simpleMonitorT) notify(ctx context.Context, hits []es.HitT) int {
 	sz := len(hits)
 	if sz > 0 {
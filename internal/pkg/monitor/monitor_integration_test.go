@@ -191,6 +191,118 @@ func TestSimpleMonitorCheckpointOutOfSync(t *testing.T) {
 	require.NoError(t, g.Wait())
 }
 
+// memCheckpointStore is a CheckpointStore that keeps the checkpoints in memory.
+type memCheckpointStore struct {
+	mx          sync.Mutex
+	checkpoints map[string]sqn.SeqNo
+}
+
+func (s *memCheckpointStore) LoadCheckpoint(_ context.Context, index string) (sqn.SeqNo, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.checkpoints[index].Clone(), nil
+}
+
+func (s *memCheckpointStore) SaveCheckpoint(_ context.Context, index string, checkpoint sqn.SeqNo) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.checkpoints == nil {
+		s.checkpoints = make(map[string]sqn.SeqNo)
+	}
+	s.checkpoints[index] = checkpoint.Clone()
+	return nil
+}
+
+func TestSimpleMonitorReplayAfterRestart(t *testing.T) {
+	ctx, cn := context.WithCancel(context.Background())
+	defer cn()
+	ctx = testlog.SetLogger(t).WithContext(ctx)
+
+	index, bulker := ftesting.SetupCleanIndex(ctx, t, dl.FleetActions)
+	store := &memCheckpointStore{}
+
+	// start runs a monitor with the store until the returned function is called.
+	start := func(maxReplay int) (SimpleMonitor, func()) {
+		readyCh := make(chan error, 1)
+		mon, err := NewSimple(index, bulker.Client(), bulker.Client(),
+			WithReadyChan(readyCh),
+			WithCheckpointStore(store, maxReplay),
+		)
+		require.NoError(t, err)
+		monCtx, monCn := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_ = mon.Run(monCtx)
+		}()
+		require.NoError(t, <-readyCh)
+		return mon, func() {
+			monCn()
+			<-done
+		}
+	}
+	// receive returns the IDs of the actions the monitor sends within the timeout.
+	receive := func(mon SimpleMonitor, n int) []string {
+		var ids []string
+		timeout := time.After(10 * time.Second)
+		for len(ids) < n {
+			select {
+			case hits := <-mon.Output():
+				for _, hit := range hits {
+					ids = append(ids, hit.ID)
+				}
+			case <-timeout:
+				t.Fatalf("timed out waiting for actions, got %v", ids)
+			}
+		}
+		return ids
+	}
+	// waitSaved waits for the store to hold the index checkpoint.
+	waitSaved := func() {
+		checkpoint, err := gcheckpt.Query(ctx, bulker.Client(), index)
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			saved, _ := store.LoadCheckpoint(ctx, index)
+			return saved.Value() == checkpoint.Value()
+		}, 10*time.Second, 100*time.Millisecond)
+	}
+	actionIDs := func(actions []model.Action) []string {
+		ids := make([]string, 0, len(actions))
+		for _, a := range actions {
+			ids = append(ids, a.Id)
+		}
+		return ids
+	}
+
+	mon, stop := start(10)
+	created, err := ftesting.StoreRandomActions(ctx, bulker, index, 1, 1)
+	require.NoError(t, err)
+	assert.Equal(t, actionIDs(created), receive(mon, 1))
+	waitSaved()
+	stop()
+
+	// The actions written while the monitor is stopped are sent after the restart, the delivered one is not.
+	created, err = ftesting.StoreRandomActions(ctx, bulker, index, 1, 3)
+	require.NoError(t, err)
+	mon, stop = start(10)
+	assert.Equal(t, actionIDs(created), receive(mon, 3))
+	waitSaved()
+	stop()
+
+	// The replay is bounded.
+	created, err = ftesting.StoreRandomActions(ctx, bulker, index, 1, 3)
+	require.NoError(t, err)
+	mon, stop = start(2)
+	defer stop()
+	assert.Equal(t, actionIDs(created)[:2], receive(mon, 2))
+	waitSaved()
+	select {
+	case hits := <-mon.Output():
+		t.Fatalf("unexpected actions sent over the replay limit: %v", hits)
+	case <-time.After(time.Second):
+	}
+}
+
 type onReadyFunc func(ctx context.Context) error
 
 func runNewSimpleMonitor(t *testing.T, ctx context.Context, index string, bulker bulk.Bulk, ch chan<- model.Action, onReady onReadyFunc) error {
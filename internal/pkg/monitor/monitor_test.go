@@ -0,0 +1,187 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+// fakeActionsES serves the global checkpoints and the search of an index on a fake clock. A wait for the global
+// checkpoint to advance returns when the clock passes the poll timeout, like a monitor polling on an interval.
+type fakeActionsES struct {
+	mx      sync.Mutex
+	now     time.Time
+	docs    []es.HitT
+	written map[string]time.Time
+	served  int
+	tick    chan struct{}
+}
+
+func newFakeActionsES(now time.Time) *fakeActionsES {
+	return &fakeActionsES{
+		now:     now,
+		written: make(map[string]time.Time),
+		tick:    make(chan struct{}),
+	}
+}
+
+func (f *fakeActionsES) client(t *testing.T) *elasticsearch.Client {
+	cli, err := elasticsearch.NewClient(elasticsearch.Config{
+		Transport:    f,
+		DisableRetry: true,
+	})
+	require.NoError(t, err)
+	return cli
+}
+
+// write adds a document at the current time of the clock.
+func (f *fakeActionsES) write(id string) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	f.docs = append(f.docs, es.HitT{ID: id, SeqNo: int64(len(f.docs)), Source: json.RawMessage(`{}`)})
+	f.written[id] = f.now
+}
+
+// advance moves the clock, the pending waits for the global checkpoint return.
+func (f *fakeActionsES) advance(d time.Duration) {
+	f.mx.Lock()
+	f.now = f.now.Add(d)
+	tick := f.tick
+	f.tick = make(chan struct{})
+	f.mx.Unlock()
+	close(tick)
+}
+
+// latency returns the time since the document was written.
+func (f *fakeActionsES) latency(id string) time.Duration {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	return f.now.Sub(f.written[id])
+}
+
+func (f *fakeActionsES) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body string
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/_fleet/global_checkpoints"):
+		if req.URL.Query().Get("wait_for_advance") == "true" {
+			f.mx.Lock()
+			tick := f.tick
+			f.mx.Unlock()
+			select {
+			case <-tick:
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+		}
+		f.mx.Lock()
+		body = fmt.Sprintf(`{"global_checkpoints":[%d],"timed_out":false}`, len(f.docs)-1)
+		f.mx.Unlock()
+	case strings.HasSuffix(req.URL.Path, "/_fleet/_fleet_search"):
+		f.mx.Lock()
+		hits, err := json.Marshal(f.docs[f.served:])
+		f.served = len(f.docs)
+		f.mx.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		body = fmt.Sprintf(`{"hits":{"hits":%s}}`, hits)
+	default:
+		return nil, fmt.Errorf("unexpected request %s", req.URL.Path)
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Header: http.Header{
+			"X-Elastic-Product": []string{"Elasticsearch"},
+			"Content-Type":      []string{"application/json"},
+		},
+	}, nil
+}
+
+func TestSimpleMonitorLowLatency(t *testing.T) {
+	const pollTimeout = time.Minute
+	start := time.Date(2024, 9, 18, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		opts    []Option
+		trigger func(SimpleMonitor, chan time.Time)
+		latency time.Duration
+	}{{
+		name:    "without nudge",
+		trigger: func(SimpleMonitor, chan time.Time) {},
+		latency: pollTimeout,
+	}, {
+		name:    "nudge ignored without low latency",
+		trigger: func(m SimpleMonitor, _ chan time.Time) { m.Nudge() },
+		latency: pollTimeout,
+	}, {
+		name:    "nudge",
+		opts:    []Option{WithLowLatency(0)},
+		trigger: func(m SimpleMonitor, _ chan time.Time) { m.Nudge() },
+		latency: 0,
+	}, {
+		name:    "poll interval",
+		opts:    []Option{WithLowLatency(500 * time.Millisecond)},
+		trigger: func(_ SimpleMonitor, poll chan time.Time) { poll <- start },
+		latency: 0,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ctx = testlog.SetLogger(t).WithContext(ctx)
+
+			fake := newFakeActionsES(start)
+			cli := fake.client(t)
+			readyCh := make(chan error, 1)
+			mon, err := NewSimple("test-actions", cli, cli, append(tc.opts,
+				WithPollTimeout(pollTimeout),
+				WithReadyChan(readyCh),
+			)...)
+			require.NoError(t, err)
+			poll := make(chan time.Time, 1)
+			mon.(*simpleMonitorT).after = func(time.Duration) <-chan time.Time { return poll }
+
+			go func() {
+				_ = mon.Run(ctx)
+			}()
+			require.NoError(t, <-readyCh)
+
+			fake.write("action-1")
+			tc.trigger(mon, poll)
+
+			var hits []es.HitT
+			select {
+			case hits = <-mon.Output():
+			case <-time.After(100 * time.Millisecond):
+				// Not dispatched until the wait for the global checkpoint returns.
+				fake.advance(pollTimeout)
+				hits = <-mon.Output()
+			}
+			require.Len(t, hits, 1)
+			assert.Equal(t, "action-1", hits[0].ID)
+			assert.Equal(t, tc.latency, fake.latency("action-1"))
+		})
+	}
+}
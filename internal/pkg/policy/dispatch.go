@@ -0,0 +1,127 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package policy
+
+import (
+	"context"
+	"runtime"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
+)
+
+// dispatchQueuePerWorker is the number of dispatches that may be queued for each worker before submit blocks.
+const dispatchQueuePerWorker = 64
+
+var dispatchQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "policy",
+	Name:      "dispatch_queue_depth",
+	Help:      "Number of policy dispatches queued for the dispatch workers.",
+})
+
+// MetricsCollectors returns the prometheus collectors of the policy dispatch.
+func MetricsCollectors() []prometheus.Collector {
+	return []prometheus.Collector{dispatchQueueDepth}
+}
+
+// defaultDispatchWorkers returns the number of dispatch workers used when it's not configured.
+func defaultDispatchWorkers() int {
+	return runtime.NumCPU() * 4
+}
+
+type dispatchT struct {
+	s  *subT
+	pp *ParsedPolicy
+}
+
+// dispatchPool delivers the policies to the subscriptions with a bounded number of workers.
+// Each agent is always dispatched by the same worker so that its deliveries are in order.
+type dispatchPool struct {
+	log    zerolog.Logger
+	queues []chan dispatchT
+	wg     sync.WaitGroup
+}
+
+func newDispatchPool(log zerolog.Logger, workers int) *dispatchPool {
+	p := &dispatchPool{
+		log:    log,
+		queues: make([]chan dispatchT, workers),
+	}
+	for i := range p.queues {
+		p.queues[i] = make(chan dispatchT, dispatchQueuePerWorker)
+	}
+	return p
+}
+
+// run starts the workers, they stop once the context is cancelled. The queued dispatches are dropped then.
+func (p *dispatchPool) run(ctx context.Context) {
+	for _, q := range p.queues {
+		p.wg.Add(1)
+		go func(q chan dispatchT) {
+			defer p.wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case d := <-q:
+					dispatchQueueDepth.Dec()
+					deliver(p.log, d.s, d.pp)
+				}
+			}
+		}(q)
+	}
+}
+
+// wait blocks until the workers have stopped.
+func (p *dispatchPool) wait() {
+	p.wg.Wait()
+}
+
+// submit queues the dispatch to the worker of the agent. It blocks while the queue of the worker is full.
+func (p *dispatchPool) submit(ctx context.Context, s *subT, pp *ParsedPolicy) error {
+	q := p.queues[shard(s.agentID, len(p.queues))]
+	dispatchQueueDepth.Inc()
+	select {
+	case q <- dispatchT{s: s, pp: pp}:
+		return nil
+	case <-ctx.Done():
+		dispatchQueueDepth.Dec()
+		return ctx.Err()
+	}
+}
+
+// shard returns the FNV-1a hash of the agent ID modulo n.
+func shard(agentID string, n int) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(agentID); i++ {
+		h ^= uint32(agentID[i])
+		h *= 16777619
+	}
+	return int(h % uint32(n)) //nolint:gosec // n is a positive int
+}
+
+// deliver sends the policy to the subscription. It returns false if the subscription channel is full.
+func deliver(log zerolog.Logger, s *subT, pp *ParsedPolicy) bool {
+	select {
+	case s.ch <- pp:
+		log.Debug().
+			Str(logger.PolicyID, s.policyID).
+			Int64("subscription_revision_idx", s.revIdx).
+			Int64(logger.RevisionIdx, s.revIdx).
+			Msg("dispatch policy change")
+		return true
+	default:
+		// Should never block on a channel; we created a channel of size one.
+		// A block here indicates a logic error somewheres.
+		log.Error().
+			Str(logger.PolicyID, s.policyID).
+			Str(logger.AgentID, s.agentID).
+			Msg("logic error: should never block on policy channel")
+		return false
+	}
+}
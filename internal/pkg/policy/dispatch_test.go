@@ -0,0 +1,192 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package policy
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+func queueDepth(t testing.TB) float64 {
+	t.Helper()
+	var m dto.Metric
+	require.NoError(t, dispatchQueueDepth.Write(&m))
+	return m.GetGauge().GetValue()
+}
+
+func TestShard(t *testing.T) {
+	agentID := uuid.Must(uuid.NewV4()).String()
+	n := shard(agentID, 16)
+	assert.GreaterOrEqual(t, n, 0)
+	assert.Less(t, n, 16)
+	assert.Equal(t, n, shard(agentID, 16), "an agent is always dispatched by the same worker")
+	assert.Equal(t, 0, shard(agentID, 1))
+}
+
+func TestDispatchPoolOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pool := newDispatchPool(testlog.SetLogger(t), 4)
+	pool.run(ctx)
+
+	// The revisions of an agent are queued in order to the same worker, each to a new subscription as the agent
+	// checks in again after each delivery.
+	agentID := uuid.Must(uuid.NewV4()).String()
+	var delivered []int64
+	for rev := int64(1); rev <= 10; rev++ {
+		s := NewSub("policy", agentID, rev-1)
+		pp := &ParsedPolicy{Policy: model.Policy{PolicyID: "policy", RevisionIdx: rev}}
+		require.NoError(t, pool.submit(ctx, s, pp))
+		select {
+		case pp := <-s.Output():
+			delivered = append(delivered, pp.Policy.RevisionIdx)
+		case <-time.After(time.Second):
+			t.Fatal("policy was not delivered")
+		}
+	}
+	assert.Equal(t, []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, delivered)
+
+	cancel()
+	pool.wait()
+}
+
+func TestDispatchPoolBackpressure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The workers are not running, so the queue fills up.
+	pool := newDispatchPool(testlog.SetLogger(t), 1)
+	depth := queueDepth(t)
+	pp := &ParsedPolicy{}
+	for i := 0; i < dispatchQueuePerWorker; i++ {
+		require.NoError(t, pool.submit(ctx, NewSub("policy", fmt.Sprintf("agent-%d", i), 0), pp))
+	}
+	assert.Equal(t, depth+dispatchQueuePerWorker, queueDepth(t))
+
+	// The next dispatch blocks instead of being dropped.
+	s := NewSub("policy", "blocked", 0)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- pool.submit(ctx, s, pp)
+	}()
+	select {
+	case err := <-errCh:
+		t.Fatalf("submit did not block on a full queue: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	wctx, wcancel := context.WithCancel(context.Background())
+	pool.run(wctx)
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("submit still blocked once the workers are running")
+	}
+	select {
+	case <-s.Output():
+	case <-time.After(time.Second):
+		t.Fatal("blocked dispatch was not delivered")
+	}
+	assert.Eventually(t, func() bool { return queueDepth(t) == depth }, time.Second, time.Millisecond)
+
+	wcancel()
+	pool.wait()
+}
+
+func TestDispatchSharesParsedPolicy(t *testing.T) {
+	for _, pool := range []bool{false, true} {
+		t.Run(fmt.Sprintf("pool %t", pool), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			m := NewMonitor(ftesting.NewMockBulk(), nil, config.ServerLimits{}).(*monitorT)
+			m.log = testlog.SetLogger(t)
+			m.limit = rate.NewLimiter(rate.Inf, 1)
+			pp := &ParsedPolicy{Policy: model.Policy{PolicyID: "policy", RevisionIdx: 2}}
+			m.policies["policy"] = policyT{pp: pp, head: makeHead()}
+			if pool {
+				m.pool = newDispatchPool(m.log, 4)
+				m.pool.run(ctx)
+			}
+
+			subs := make([]Subscription, 10)
+			for i := range subs {
+				s, err := m.Subscribe(fmt.Sprintf("agent-%d", i), "policy", 1)
+				require.NoError(t, err)
+				subs[i] = s
+			}
+			m.dispatchPending(ctx)
+
+			// The subscriptions all get the policy parsed once for the revision.
+			for _, s := range subs {
+				select {
+				case got := <-s.Output():
+					assert.Same(t, pp, got)
+				case <-time.After(time.Second):
+					t.Fatal("policy was not delivered")
+				}
+			}
+		})
+	}
+}
+
+// benchmarkDispatchPending dispatches a policy change to n subscribers, pool selects whether the dispatch pool is used.
+func benchmarkDispatchPending(b *testing.B, n int, pool bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := NewMonitor(ftesting.NewMockBulk(), nil, config.ServerLimits{}).(*monitorT)
+	m.log = zerolog.Nop()
+	m.limit = rate.NewLimiter(rate.Inf, 1)
+	m.policies["policy"] = policyT{
+		pp:   &ParsedPolicy{Policy: model.Policy{PolicyID: "policy", RevisionIdx: 2}},
+		head: makeHead(),
+	}
+	if pool {
+		m.pool = newDispatchPool(m.log, m.workers)
+		m.pool.run(ctx)
+	}
+
+	subs := make([]Subscription, n)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for j := range subs {
+			s, err := m.Subscribe(fmt.Sprintf("agent-%d", j), "policy", 1)
+			if err != nil {
+				b.Fatal(err)
+			}
+			subs[j] = s
+		}
+		b.StartTimer()
+
+		m.dispatchPending(ctx)
+		for _, s := range subs {
+			<-s.Output()
+		}
+	}
+}
+
+func BenchmarkDispatchPending_Inline_50k(b *testing.B) { benchmarkDispatchPending(b, 50000, false) }
+func BenchmarkDispatchPending_Pool_50k(b *testing.B)   { benchmarkDispatchPending(b, 50000, true) }
@@ -7,6 +7,8 @@ package policy
 import (
 	"context"
 	"errors"
+	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
@@ -19,8 +21,10 @@ import (
 	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
 	"github.com/elastic/fleet-server/v7/internal/pkg/es"
 	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger/errlog"
 	"github.com/elastic/fleet-server/v7/internal/pkg/model"
 	"github.com/elastic/fleet-server/v7/internal/pkg/monitor"
+	"github.com/elastic/fleet-server/v7/internal/pkg/signing"
 )
 
 const cloudPolicyID = "policy-elastic-agent-on-cloud"
@@ -34,10 +38,15 @@ Policy rollout scheduling should...
 3) adapt to subscribers that drop offline.
 4) attempt to deliver the latest policy to each subscriber at the time of delivery.
 5) prioritize delivery to agents that supervise fleet-servers.
+6) prioritize delivery to newly enrolled agents waiting for their first policy.
 
 This implementation addresses the above issues by queuing subscription requests per
 policy, and moving requests to the pending queue when the requirement is met; ie.
-the policy is updateable.
+the policy is updateable. Subscriptions of agents without a policy revision are moved
+to the first queue instead, which is dispatched before the pending queue.
+
+Dispatch is paced by a token bucket, either the policy limit or the agent rollout rate,
+so a policy change reaching many agents is rolled out over a window instead of at once.
 
 If the subscription is unsubscribed (ie. the agent drops offline), this implementation
 will remove the subscription request from its current location in either the waiting
@@ -62,12 +71,16 @@ type Monitor interface {
 
 	// Unsubscribe removes the current subscription.
 	Unsubscribe(sub Subscription) error
+
+	// Parse parses the policy like the revisions the monitor dispatches, its secrets are read with bulker.
+	Parse(ctx context.Context, bulker bulk.Bulk, policy model.Policy) (*ParsedPolicy, error)
 }
 
 type policyFetcher func(ctx context.Context, bulker bulk.Bulk, opt ...dl.Option) ([]model.Policy, error)
 
 type policyT struct {
-	pp   ParsedPolicy
+	// pp is the latest revision of the policy, it's shared by all the subscriptions it's dispatched to and never modified.
+	pp   *ParsedPolicy
 	head *subT
 }
 
@@ -83,16 +96,73 @@ type monitorT struct {
 
 	policies map[string]policyT
 	pendingQ *subT
+	firstQ   *subT
 
 	policyF       policyFetcher
 	policiesIndex string
 	limit         *rate.Limiter
+	clock         clock
+
+	// wildcardNamespaces keeps the output permissions of the policies unrestricted.
+	wildcardNamespaces bool
+
+	// verifier verifies the signature of the policies before they are dispatched, nil when it's disabled.
+	verifier *signing.Verifier
+
+	// workers is the size of the dispatch pool started by Run, the policies are delivered inline without it.
+	workers int
+	pool    *dispatchPool
 
 	startCh chan struct{}
 }
 
+// clock is the time source used to pace the dispatch.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// MonitorOption is an option of the policy monitor.
+type MonitorOption func(*monitorT)
+
+// WithWildcardNamespaces keeps the index privileges of the output API keys as the policies declare them instead of
+// restricting them to the namespaces of each policy.
+func WithWildcardNamespaces(enabled bool) MonitorOption {
+	return func(m *monitorT) {
+		m.wildcardNamespaces = enabled
+	}
+}
+
+// WithRolloutRate paces the policy dispatch to cfg.Rate agents per second in bursts of up to cfg.Burst agents
+// instead of using the policy limit. A zero rate keeps the policy limit.
+func WithRolloutRate(cfg config.RolloutRate) MonitorOption {
+	return func(m *monitorT) {
+		if cfg.Rate <= 0 {
+			return
+		}
+		m.limit = rate.NewLimiter(rate.Limit(cfg.Rate), max(cfg.Burst, 1))
+	}
+}
+
+// WithSignatureVerifier refuses to dispatch the policies that v does not accept.
+func WithSignatureVerifier(v *signing.Verifier) MonitorOption {
+	return func(m *monitorT) {
+		m.verifier = v
+	}
+}
+
 // NewMonitor creates the policy monitor for subscribing agents.
-func NewMonitor(bulker bulk.Bulk, monitor monitor.Monitor, cfg config.ServerLimits) Monitor {
+func NewMonitor(bulker bulk.Bulk, monitor monitor.Monitor, cfg config.ServerLimits, opts ...MonitorOption) Monitor {
 	burst := cfg.PolicyLimit.Burst
 	interval := rate.Every(cfg.PolicyLimit.Interval)
 	if cfg.PolicyLimit.Burst <= 0 {
@@ -105,18 +175,29 @@ func NewMonitor(bulker bulk.Bulk, monitor monitor.Monitor, cfg config.ServerLimi
 			interval = rate.Every(time.Nanosecond) // set minimal spin rate
 		}
 	}
-	return &monitorT{
+	workers := cfg.PolicyDispatchWorkers
+	if workers <= 0 {
+		workers = defaultDispatchWorkers()
+	}
+	m := &monitorT{
 		bulker:        bulker,
 		monitor:       monitor,
 		kickCh:        make(chan struct{}, 1),
 		deployCh:      make(chan struct{}, 1),
 		policies:      make(map[string]policyT),
 		pendingQ:      makeHead(),
+		firstQ:        makeHead(),
 		limit:         rate.NewLimiter(interval, burst),
+		clock:         realClock{},
 		policyF:       dl.QueryLatestPolicies,
 		policiesIndex: dl.FleetPolicies,
+		workers:       workers,
 		startCh:       make(chan struct{}),
 	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
 }
 
 // endTrans is a convenience function to end the passed transaction if it's not nil
@@ -132,11 +213,20 @@ func (m *monitorT) Run(ctx context.Context) error {
 	m.log.Info().
 		Int("burst", m.limit.Burst()).
 		Any("event_rate", m.limit.Limit()). // Limit() returns an alias type for float64
+		Int("dispatch_workers", m.workers).
 		Msg("run policy monitor")
 
 	s := m.monitor.Subscribe()
 	defer m.monitor.Unsubscribe(s)
 
+	pctx, pcancel := context.WithCancel(ctx)
+	m.pool = newDispatchPool(m.log, m.workers)
+	m.pool.run(pctx)
+	defer func() {
+		pcancel()
+		m.pool.wait()
+	}()
+
 	close(m.startCh)
 
 	var iCtx context.Context
@@ -225,68 +315,118 @@ func (m *monitorT) waitStart(ctx context.Context) error {
 	return nil
 }
 
-// dispatchPending will dispatch all pending policy changes to the subscriptions in the queue.
+// dispatchPending will dispatch all pending policy changes to the subscriptions in the queues.
 // dispatches are rate limited by the monitor's limiter.
 func (m *monitorT) dispatchPending(ctx context.Context) {
 	span, ctx := apm.StartSpan(ctx, "dispatch pending", "dispatch")
 	defer span.End()
-	m.mut.Lock()
-	defer m.mut.Unlock()
 
-	ts := time.Now()
+	ts := m.clock.Now()
 	nQueued := 0
 
-	s := m.pendingQ.popFront()
-	if s == nil {
-		return
-	}
-
-	for s != nil {
+	for !m.isQueueEmpty() {
 		// Use a rate.Limiter to control how fast policies are passed to the checkin handler.
 		// This is done to avoid all responses to agents on the same policy from being written at once.
 		// If too many (checkin) responses are written concurrently memory usage may explode due to allocating gzip writers.
-		err := m.limit.Wait(ctx)
-		if err != nil {
+		// The lock is not held while waiting, so agents subscribing for their first policy meanwhile are dispatched next.
+		if err := m.wait(ctx); err != nil {
 			m.log.Warn().Err(err).Msg("Policy limit error")
 			return
 		}
-		// Lookup the latest policy for this subscription
-		policy, ok := m.policies[s.policyID]
-		if !ok {
-			m.log.Warn().
-				Str(logger.PolicyID, s.policyID).
-				Msg("logic error: policy missing on dispatch")
+		if !m.dispatchNext(ctx) {
 			return
 		}
-
-		select {
-		case <-ctx.Done():
-			m.log.Debug().Err(ctx.Err()).Msg("context termination detected in policy dispatch")
-			return
-		case s.ch <- &policy.pp:
-			m.log.Debug().
-				Str(logger.PolicyID, s.policyID).
-				Int64("subscription_revision_idx", s.revIdx).
-				Int64(logger.RevisionIdx, s.revIdx).
-				Msg("dispatch policy change")
-		default:
-			// Should never block on a channel; we created a channel of size one.
-			// A block here indicates a logic error somewheres.
-			m.log.Error().
-				Str(logger.PolicyID, s.policyID).
-				Str(logger.AgentID, s.agentID).
-				Msg("logic error: should never block on policy channel")
-			return
-		}
-		s = m.pendingQ.popFront()
 		nQueued += 1
 	}
 
-	dur := time.Since(ts)
+	dur := m.clock.Now().Sub(ts)
 	m.log.Debug().Dur("event.duration", dur).Int("nSubs", nQueued).
 		Msg("policy monitor dispatch complete")
 }
 
+func (m *monitorT) isQueueEmpty() bool {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.firstQ.isEmpty() && m.pendingQ.isEmpty()
+}
+
+// wait blocks until the limiter allows the next dispatch.
+func (m *monitorT) wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	now := m.clock.Now()
+	r := m.limit.ReserveN(now, 1)
+	if !r.OK() {
+		return errors.New("policy limit burst exceeded")
+	}
+	delay := r.DelayFrom(now)
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		r.CancelAt(m.clock.Now())
+		return ctx.Err()
+	case <-m.clock.After(delay):
+		return nil
+	}
+}
+
+// dispatchNext sends the latest policy to the next queued subscription, or queues it to the dispatch pool if it's running.
+// It returns false if the queues are empty or the dispatch has to stop.
+func (m *monitorT) dispatchNext(ctx context.Context) bool {
+	m.mut.Lock()
+	s := m.firstQ.popFront()
+	if s == nil {
+		s = m.pendingQ.popFront()
+	}
+	if s == nil {
+		// The subscriptions were removed while waiting.
+		m.mut.Unlock()
+		return false
+	}
+
+	// Lookup the latest policy for this subscription
+	policy, ok := m.policies[s.policyID]
+	m.mut.Unlock()
+	if !ok {
+		m.log.Warn().
+			Str(logger.PolicyID, s.policyID).
+			Msg("logic error: policy missing on dispatch")
+		return false
+	}
+
+	if ctx.Err() != nil {
+		m.log.Debug().Err(ctx.Err()).Msg("context termination detected in policy dispatch")
+		return false
+	}
+	if m.pool == nil {
+		return deliver(m.log, s, policy.pp)
+	}
+	// Blocks while the queue of the worker is full, this applies backpressure to the dispatch.
+	if err := m.pool.submit(ctx, s, policy.pp); err != nil {
+		m.log.Debug().Err(err).Msg("context termination detected in policy dispatch")
+		return false
+	}
+	return true
+}
+
+// schedule queues the subscription for dispatch, the lock must be held.
+func (m *monitorT) schedule(s *subT) {
+	switch {
+	case s.policyID == cloudPolicyID:
+		// HACK: if update is for cloud agent, put on front of queue
+		// not at the end for immediate delivery.
+		m.firstQ.pushFront(s)
+	case s.revIdx == 0:
+		// The agent is waiting for its first policy.
+		m.firstQ.pushBack(s)
+	default:
+		m.pendingQ.pushBack(s)
+	}
+}
+
 func (m *monitorT) loadPolicies(ctx context.Context) error {
 	span, ctx := apm.StartSpan(ctx, "Load policies", "load")
 	defer span.End()
@@ -330,9 +470,28 @@ func (m *monitorT) processPolicies(ctx context.Context, policies []model.Policy)
 
 	latest := m.groupByLatest(policies)
 	for _, policy := range latest {
-		pp, err := NewParsedPolicy(ctx, m.bulker, policy)
+		if !m.hasAdvanced(&policy) {
+			m.log.Debug().
+				Str(logger.PolicyID, policy.PolicyID).
+				Int64(logger.RevisionIdx, policy.RevisionIdx).
+				Int64("coordinator_idx", policy.CoordinatorIdx).
+				Msg("policy has not advanced, skip update")
+			continue
+		}
+		pp, err := m.Parse(ctx, m.bulker, policy)
 		if err != nil {
-			return err
+			// A policy that can not be parsed, such as one referencing a missing secret, does not stop the monitor.
+			// The subscriptions keep the previous revision, the policy is parsed again when it's next updated or loaded.
+			m.log.Error().
+				Err(err).
+				Str(logger.PolicyID, policy.PolicyID).
+				Int64(logger.RevisionIdx, policy.RevisionIdx).
+				Msg("skip policy update")
+			errlog.Report(errlog.SubsystemMonitor, "policy", err, map[string]string{
+				logger.PolicyID:    policy.PolicyID,
+				logger.RevisionIdx: strconv.FormatInt(policy.RevisionIdx, 10),
+			})
+			continue
 		}
 
 		m.updatePolicy(ctx, pp)
@@ -340,6 +499,24 @@ func (m *monitorT) processPolicies(ctx context.Context, policies []model.Policy)
 	return nil
 }
 
+// Parse verifies the signature of the policy, resolves its secrets with bulker and restricts its output permissions
+// to its namespaces, unless the monitor keeps them unrestricted.
+func (m *monitorT) Parse(ctx context.Context, bulker bulk.Bulk, policy model.Policy) (*ParsedPolicy, error) {
+	if err := m.verifier.VerifyPolicy(&policy); err != nil {
+		return nil, fmt.Errorf("policy signature verification failed: %w", err)
+	}
+	pp, err := NewParsedPolicy(ctx, bulker, policy)
+	if err != nil {
+		return nil, fmt.Errorf("fail to parse policy: %w", err)
+	}
+	if !m.wildcardNamespaces {
+		if err := pp.restrictNamespaces(); err != nil {
+			return nil, fmt.Errorf("fail to restrict policy output permissions: %w", err)
+		}
+	}
+	return pp, nil
+}
+
 func groupByLatest(policies []model.Policy) map[string]model.Policy {
 	latest := make(map[string]model.Policy)
 	for _, policy := range policies {
@@ -359,6 +536,23 @@ func (m *monitorT) groupByLatest(policies []model.Policy) map[string]model.Polic
 	return groupByLatest(policies)
 }
 
+// hasAdvanced returns true if the policy is newer than the one tracked for its policy ID.
+// Policies that have not been loaded yet, including the ones only known by a subscription, have always advanced.
+func (m *monitorT) hasAdvanced(policy *model.Policy) bool {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	p, ok := m.policies[policy.PolicyID]
+	if !ok || p.pp.Policy.PolicyID == "" {
+		return true
+	}
+	curr := &p.pp.Policy
+	if policy.RevisionIdx != curr.RevisionIdx {
+		return policy.RevisionIdx > curr.RevisionIdx
+	}
+	return policy.CoordinatorIdx > curr.CoordinatorIdx
+}
+
 func (m *monitorT) updatePolicy(ctx context.Context, pp *ParsedPolicy) bool {
 	newPolicy := pp.Policy
 
@@ -378,7 +572,7 @@ func (m *monitorT) updatePolicy(ctx context.Context, pp *ParsedPolicy) bool {
 	p, ok := m.policies[newPolicy.PolicyID]
 	if !ok {
 		p = policyT{
-			pp:   *pp,
+			pp:   pp,
 			head: makeHead(),
 		}
 		m.policies[newPolicy.PolicyID] = p
@@ -390,7 +584,7 @@ func (m *monitorT) updatePolicy(ctx context.Context, pp *ParsedPolicy) bool {
 	oldPolicy := p.pp.Policy
 
 	// Update the policy in our data structure
-	p.pp = *pp
+	p.pp = pp
 	m.policies[newPolicy.PolicyID] = p
 	zlog.Debug().Str(logger.PolicyID, newPolicy.PolicyID).Msg("Update policy revision")
 
@@ -405,14 +599,8 @@ func (m *monitorT) updatePolicy(ctx context.Context, pp *ParsedPolicy) bool {
 			// Unlink the target node from the list
 			iter.Unlink()
 
-			// Push the node onto the pendingQ
-			// HACK: if update is for cloud agent, put on front of queue
-			// not at the end for immediate delivery.
-			if newPolicy.PolicyID == cloudPolicyID {
-				m.pendingQ.pushFront(sub)
-			} else {
-				m.pendingQ.pushBack(sub)
-			}
+			// Push the node onto the dispatch queues
+			m.schedule(sub)
 
 			zlog.Debug().
 				Str(logger.AgentID, sub.agentID).
@@ -474,13 +662,13 @@ func (m *monitorT) Subscribe(agentID string, policyID string, revisionIdx int64)
 			Str(logger.PolicyID, policyID).
 			Str(logger.AgentID, s.agentID).
 			Msg("force load on unknown policyId")
-		p = policyT{head: makeHead()}
+		p = policyT{pp: &ParsedPolicy{}, head: makeHead()}
 		p.head.pushBack(s)
 		m.policies[policyID] = p
 		m.kickLoad()
 	case s.isUpdate(&p.pp.Policy):
-		empty := m.pendingQ.isEmpty()
-		m.pendingQ.pushBack(s)
+		empty := m.firstQ.isEmpty() && m.pendingQ.isEmpty()
+		m.schedule(s)
 		m.log.Debug().
 			Str(logger.AgentID, s.agentID).
 			Int64(logger.RevisionIdx, (&p.pp.Policy).RevisionIdx).
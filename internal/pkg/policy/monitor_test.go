@@ -8,6 +8,7 @@ package policy
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"sync"
 	"testing"
@@ -27,6 +28,7 @@ import (
 	"github.com/elastic/fleet-server/v7/internal/pkg/es"
 	"github.com/elastic/fleet-server/v7/internal/pkg/model"
 	mmock "github.com/elastic/fleet-server/v7/internal/pkg/monitor/mock"
+	"github.com/elastic/fleet-server/v7/internal/pkg/signing"
 	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
 	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
 )
@@ -43,6 +45,7 @@ func TestNewMonitor(t *testing.T) {
 	tests := []struct {
 		name  string
 		cfg   config.ServerLimits
+		opts  []MonitorOption
 		burst int
 		rate  float64
 	}{{
@@ -60,11 +63,29 @@ func TestNewMonitor(t *testing.T) {
 		cfg:   config.ServerLimits{PolicyThrottle: time.Second},
 		burst: 1,
 		rate:  1,
+	}, {
+		name:  "rollout rate",
+		cfg:   config.ServerLimits{PolicyLimit: config.Limit{Burst: 2, Interval: time.Second}},
+		opts:  []MonitorOption{WithRolloutRate(config.RolloutRate{Rate: 100, Burst: 50})},
+		burst: 50,
+		rate:  100,
+	}, {
+		name:  "rollout rate without burst",
+		cfg:   config.ServerLimits{},
+		opts:  []MonitorOption{WithRolloutRate(config.RolloutRate{Rate: 10})},
+		burst: 1,
+		rate:  10,
+	}, {
+		name:  "zero rollout rate",
+		cfg:   config.ServerLimits{PolicyLimit: config.Limit{Burst: 2, Interval: time.Second}},
+		opts:  []MonitorOption{WithRolloutRate(config.RolloutRate{Burst: 50})},
+		burst: 2,
+		rate:  1,
 	}}
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			M := NewMonitor(nil, nil, tc.cfg)
+			M := NewMonitor(nil, nil, tc.cfg, tc.opts...)
 			m, ok := M.(*monitorT)
 			require.True(t, ok, "Expected to be able to cast Monitor as monitorT")
 			assert.Equal(t, tc.burst, m.limit.Burst())
@@ -320,6 +341,115 @@ func runTestMonitor_NewPolicyExists(t *testing.T, delay time.Duration) {
 	require.False(t, timedout, "never got policy update; timed out after 500ms")
 }
 
+func TestMonitor_OnlyAdvancedPolicies(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = testlog.SetLogger(t).WithContext(ctx)
+
+	chHitT := make(chan []es.HitT, 1)
+	defer close(chHitT)
+	ms := mmock.NewMockSubscription()
+	ms.On("Output").Return((<-chan []es.HitT)(chHitT))
+	mm := mmock.NewMockMonitor()
+	mm.On("Subscribe").Return(ms).Once()
+	mm.On("Unsubscribe", mock.Anything).Return().Once()
+	bulker := ftesting.NewMockBulk()
+
+	monitor := NewMonitor(bulker, mm, config.ServerLimits{})
+	pm := monitor.(*monitorT)
+
+	newPolicy := func(policyID string, seqNo, revIdx int64) model.Policy {
+		return model.Policy{
+			ESDocument: model.ESDocument{
+				Id:      xid.New().String(),
+				Version: 1,
+				SeqNo:   seqNo,
+			},
+			PolicyID:    policyID,
+			Data:        policyDataDefault,
+			RevisionIdx: revIdx,
+		}
+	}
+	toHit := func(policy model.Policy) es.HitT {
+		data, err := json.Marshal(&policy)
+		require.NoError(t, err)
+		return es.HitT{
+			ID:      policy.Id,
+			SeqNo:   policy.SeqNo,
+			Version: policy.Version,
+			Source:  data,
+		}
+	}
+	waitPolicy := func(s Subscription, d time.Duration) *ParsedPolicy {
+		tm := time.NewTimer(d)
+		defer tm.Stop()
+		select {
+		case pp := <-s.Output():
+			return pp
+		case <-tm.C:
+			return nil
+		}
+	}
+
+	policyA := newPolicy(uuid.Must(uuid.NewV4()).String(), 1, 1)
+	policyB := newPolicy(uuid.Must(uuid.NewV4()).String(), 2, 1)
+	pm.policyF = func(ctx context.Context, bulker bulk.Bulk, opt ...dl.Option) ([]model.Policy, error) {
+		return []model.Policy{policyA, policyB}, nil
+	}
+
+	var merr error
+	var mwg sync.WaitGroup
+	mwg.Add(1)
+	go func() {
+		defer mwg.Done()
+		merr = monitor.Run(ctx)
+	}()
+	require.NoError(t, pm.waitStart(ctx))
+
+	// A subscription on an unknown policy gets the initial dispatch once the policies are loaded
+	sA, err := monitor.Subscribe(uuid.Must(uuid.NewV4()).String(), policyA.PolicyID, 0)
+	require.NoError(t, err)
+	pp := waitPolicy(sA, 2*time.Second)
+	require.NotNil(t, pp, "never got initial policy")
+	require.Equal(t, int64(1), pp.Policy.RevisionIdx)
+	require.NoError(t, monitor.Unsubscribe(sA))
+
+	sA, err = monitor.Subscribe(uuid.Must(uuid.NewV4()).String(), policyA.PolicyID, 1)
+	require.NoError(t, err)
+	defer monitor.Unsubscribe(sA) //nolint:errcheck // test case
+	sB, err := monitor.Subscribe(uuid.Must(uuid.NewV4()).String(), policyB.PolicyID, 1)
+	require.NoError(t, err)
+	defer monitor.Unsubscribe(sB) //nolint:errcheck // test case
+
+	// Bump policy A; policy B is written again without a new revision
+	policyA2 := newPolicy(policyA.PolicyID, 3, 2)
+	chHitT <- []es.HitT{toHit(policyA2), toHit(newPolicy(policyB.PolicyID, 4, 1))}
+
+	pp = waitPolicy(sA, 2*time.Second)
+	require.NotNil(t, pp, "never got policy A update")
+	require.Empty(t, cmp.Diff(policyA2, pp.Policy))
+	require.Nil(t, waitPolicy(sB, 500*time.Millisecond), "got policy B update when it did not advance")
+
+	// An older revision does not replace the tracked policy
+	chHitT <- []es.HitT{toHit(newPolicy(policyA.PolicyID, 5, 1))}
+	require.Eventually(t, func() bool {
+		return len(chHitT) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	mwg.Wait()
+	if merr != nil && merr != context.Canceled {
+		t.Fatal(merr)
+	}
+
+	pm.mut.Lock()
+	defer pm.mut.Unlock()
+	assert.Equal(t, int64(3), pm.policies[policyA.PolicyID].pp.Policy.SeqNo)
+	assert.Equal(t, int64(2), pm.policies[policyB.PolicyID].pp.Policy.SeqNo)
+	ms.AssertExpectations(t)
+	mm.AssertExpectations(t)
+}
+
 func Test_Monitor_Limit_Delay(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -447,3 +577,322 @@ LOOP:
 	ms.AssertExpectations(t)
 	mm.AssertExpectations(t)
 }
+
+// fakeClock is a clock that only moves forward when advanced.
+type fakeClock struct {
+	mut     sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = waiters
+}
+
+func (c *fakeClock) waiting() int {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return len(c.waiters)
+}
+
+// newRolloutMonitor returns a monitor using a fake clock that tracks revision 2 of policyID.
+func newRolloutMonitor(t *testing.T, policyID string, rollout config.RolloutRate) (*monitorT, *fakeClock) {
+	t.Helper()
+	m := NewMonitor(ftesting.NewMockBulk(), nil, config.ServerLimits{}, WithRolloutRate(rollout)).(*monitorT)
+	m.log = testlog.SetLogger(t)
+	clk := &fakeClock{now: time.Now()}
+	m.clock = clk
+	m.policies[policyID] = policyT{
+		pp: &ParsedPolicy{
+			Policy: model.Policy{PolicyID: policyID, RevisionIdx: 2, Data: policyDataDefault},
+		},
+		head: makeHead(),
+	}
+	return m, clk
+}
+
+func isDispatched(s Subscription) bool {
+	select {
+	case <-s.Output():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestMonitor_RolloutRatePacing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	policyID := uuid.Must(uuid.NewV4()).String()
+	m, clk := newRolloutMonitor(t, policyID, config.RolloutRate{Rate: 10, Burst: 2})
+
+	subs := make([]Subscription, 5)
+	for i := range subs {
+		s, err := m.Subscribe(uuid.Must(uuid.NewV4()).String(), policyID, 1)
+		require.NoError(t, err)
+		subs[i] = s
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.dispatchPending(ctx)
+	}()
+
+	// The burst is dispatched at once.
+	require.Eventually(t, func() bool { return clk.waiting() == 1 }, time.Second, time.Millisecond)
+	assert.True(t, isDispatched(subs[0]))
+	assert.True(t, isDispatched(subs[1]))
+
+	// The remaining subscriptions are dispatched once every 100ms.
+	for _, s := range subs[2:] {
+		clk.Advance(99 * time.Millisecond)
+		assert.Equal(t, 1, clk.waiting())
+		assert.False(t, isDispatched(s), "expected no dispatch before the next token")
+
+		clk.Advance(time.Millisecond)
+		require.Eventually(t, func() bool {
+			select {
+			case <-done:
+				return true
+			default:
+				return clk.waiting() == 1
+			}
+		}, time.Second, time.Millisecond)
+		assert.True(t, isDispatched(s))
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("dispatch did not complete")
+	}
+}
+
+func TestMonitor_RolloutRateFirstPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	policyID := uuid.Must(uuid.NewV4()).String()
+	m, clk := newRolloutMonitor(t, policyID, config.RolloutRate{Rate: 1, Burst: 1})
+
+	subs := make([]Subscription, 3)
+	for i := range subs {
+		s, err := m.Subscribe(uuid.Must(uuid.NewV4()).String(), policyID, 1)
+		require.NoError(t, err)
+		subs[i] = s
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.dispatchPending(ctx)
+	}()
+
+	require.Eventually(t, func() bool { return clk.waiting() == 1 }, time.Second, time.Millisecond)
+	assert.True(t, isDispatched(subs[0]))
+
+	// An agent enrolled during the rollout is waiting for its first policy.
+	first, err := m.Subscribe(uuid.Must(uuid.NewV4()).String(), policyID, 0)
+	require.NoError(t, err)
+
+	for _, s := range []Subscription{first, subs[1], subs[2]} {
+		clk.Advance(time.Second)
+		require.Eventually(t, func() bool {
+			select {
+			case <-done:
+				return true
+			default:
+				return clk.waiting() == 1
+			}
+		}, time.Second, time.Millisecond)
+		assert.True(t, isDispatched(s))
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("dispatch did not complete")
+	}
+}
+
+func TestMonitor_PolicyMissingSecret(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = testlog.SetLogger(t).WithContext(ctx)
+
+	chHitT := make(chan []es.HitT, 1)
+	defer close(chHitT)
+	ms := mmock.NewMockSubscription()
+	ms.On("Output").Return((<-chan []es.HitT)(chHitT))
+	mm := mmock.NewMockMonitor()
+	mm.On("Subscribe").Return(ms).Once()
+	mm.On("Unsubscribe", mock.Anything).Return().Once()
+	bulker := ftesting.NewMockBulk()
+
+	monitor := NewMonitor(bulker, mm, config.ServerLimits{})
+	pm := monitor.(*monitorT)
+	pm.policyF = func(ctx context.Context, bulker bulk.Bulk, opt ...dl.Option) ([]model.Policy, error) {
+		return []model.Policy{}, nil
+	}
+
+	var merr error
+	var mwg sync.WaitGroup
+	mwg.Add(1)
+	go func() {
+		defer mwg.Done()
+		merr = monitor.Run(ctx)
+	}()
+	require.NoError(t, pm.waitStart(ctx))
+
+	agentID := uuid.Must(uuid.NewV4()).String()
+	policyID := uuid.Must(uuid.NewV4()).String()
+	s, err := monitor.Subscribe(agentID, policyID, 0)
+	defer monitor.Unsubscribe(s)
+	require.NoError(t, err)
+
+	sendPolicy := func(revIdx int64, secretID string) {
+		policy := model.Policy{
+			ESDocument: model.ESDocument{Id: xid.New().String(), Version: 1, SeqNo: revIdx},
+			PolicyID:   policyID,
+			Data: &model.PolicyData{
+				Outputs:          policyDataDefault.Outputs,
+				Inputs:           []map[string]interface{}{{"id": "input1", "password": "$co.elastic.secret{" + secretID + "}"}},
+				SecretReferences: []model.SecretReferencesItems{{ID: secretID}},
+			},
+			RevisionIdx: revIdx,
+		}
+		policyData, err := json.Marshal(&policy)
+		require.NoError(t, err)
+		chHitT <- []es.HitT{{ID: policy.Id, SeqNo: revIdx, Version: 1, Source: policyData}}
+	}
+
+	// The revision with a missing secret is skipped, the monitor keeps running and dispatches the next revision.
+	sendPolicy(1, "missing-1")
+	sendPolicy(2, "password")
+
+	select {
+	case pp := <-s.Output():
+		assert.Equal(t, int64(2), pp.Policy.RevisionIdx)
+		assert.Equal(t, "password_value", pp.Inputs[0]["password"])
+	case <-time.After(2 * time.Second):
+		t.Fatal("never got policy update; timed out after 2s")
+	}
+
+	cancel()
+	mwg.Wait()
+	if merr != nil && merr != context.Canceled {
+		t.Fatal(merr)
+	}
+}
+
+func TestMonitor_PolicySignature(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = testlog.SetLogger(t).WithContext(ctx)
+
+	chHitT := make(chan []es.HitT, 1)
+	defer close(chHitT)
+	ms := mmock.NewMockSubscription()
+	ms.On("Output").Return((<-chan []es.HitT)(chHitT))
+	mm := mmock.NewMockMonitor()
+	mm.On("Subscribe").Return(ms).Once()
+	mm.On("Unsubscribe", mock.Anything).Return().Once()
+	bulker := ftesting.NewMockBulk()
+
+	v := signing.NewVerifier(&config.Signing{Verify: true, PublicKey: ftesting.SigningPublicKey})
+	monitor := NewMonitor(bulker, mm, config.ServerLimits{}, WithSignatureVerifier(v))
+	pm := monitor.(*monitorT)
+	pm.policyF = func(ctx context.Context, bulker bulk.Bulk, opt ...dl.Option) ([]model.Policy, error) {
+		return []model.Policy{}, nil
+	}
+
+	var merr error
+	var mwg sync.WaitGroup
+	mwg.Add(1)
+	go func() {
+		defer mwg.Done()
+		merr = monitor.Run(ctx)
+	}()
+	require.NoError(t, pm.waitStart(ctx))
+
+	agentID := uuid.Must(uuid.NewV4()).String()
+	s, err := monitor.Subscribe(agentID, "policy-1", 0)
+	defer monitor.Unsubscribe(s)
+	require.NoError(t, err)
+
+	sendPolicy := func(revIdx int64, id string, signed *model.Signed) {
+		policy := model.Policy{
+			ESDocument: model.ESDocument{Id: xid.New().String(), Version: 1, SeqNo: revIdx},
+			PolicyID:   "policy-1",
+			Data: &model.PolicyData{
+				ID:      id,
+				Agent:   json.RawMessage(`{"protection":{"enabled":true,"uninstall_token_hash":"","signing_key":""}}`),
+				Outputs: policyDataDefault.Outputs,
+				Signed:  signed,
+			},
+			RevisionIdx: revIdx,
+		}
+		policyData, err := json.Marshal(&policy)
+		require.NoError(t, err)
+		chHitT <- []es.HitT{{ID: policy.Id, SeqNo: revIdx, Version: 1, Source: policyData}}
+	}
+
+	// The tampered, the unsigned and the revision with the signed block of another policy are skipped, the next
+	// signed revision is dispatched.
+	tampered := ftesting.SignedPolicy()
+	tampered.Data = base64.StdEncoding.EncodeToString([]byte(`{"id":"policy-1","agent":{"protection":{"enabled":false}}}`))
+	sendPolicy(1, "policy-1", tampered)
+	sendPolicy(2, "policy-1", nil)
+	sendPolicy(3, "policy-2", ftesting.SignedPolicy())
+	sendPolicy(4, "policy-1", ftesting.SignedPolicy())
+
+	select {
+	case pp := <-s.Output():
+		assert.Equal(t, int64(4), pp.Policy.RevisionIdx)
+		assert.Equal(t, ftesting.SignedPolicy(), pp.Policy.Data.Signed)
+	case <-time.After(2 * time.Second):
+		t.Fatal("never got policy update; timed out after 2s")
+	}
+
+	cancel()
+	mwg.Wait()
+	if merr != nil && merr != context.Canceled {
+		t.Fatal(merr)
+	}
+}
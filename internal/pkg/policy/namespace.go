@@ -0,0 +1,163 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	"github.com/elastic/fleet-server/v7/internal/pkg/smap"
+)
+
+const defaultNamespace = "default"
+
+// dataStreamTypes are the types of the data streams the agents write to, the index patterns
+// of these types are restricted to the namespaces of the policy.
+var dataStreamTypes = []string{"logs", "metrics", "traces", "synthetics", "profiling"}
+
+// restrictNamespaces restricts the index privileges of the output roles to the namespaces the policy declares.
+// A pattern with a wildcard namespace, such as logs-* or logs-nginx.access-*, is replaced by one pattern for each
+// namespace, so an agent can not write into the data streams of another policy.
+// The roles are left unchanged if the policy declares no namespace.
+func (pp *ParsedPolicy) restrictNamespaces() error {
+	namespaces := policyNamespaces(pp.Policy.Data)
+	if len(namespaces) == 0 {
+		return nil
+	}
+
+	for name, role := range pp.Roles {
+		restricted, err := restrictRoleNamespaces(role, namespaces)
+		if err != nil {
+			return fmt.Errorf("unable to restrict the permissions of output %s: %w", name, err)
+		}
+		pp.Roles[name] = restricted
+	}
+	for name, output := range pp.Outputs {
+		if role, ok := pp.Roles[name]; ok {
+			output.Role = &role
+			pp.Outputs[name] = output
+		}
+	}
+	return nil
+}
+
+// policyNamespaces returns the sorted namespaces of the policy inputs and of the agent monitoring.
+func policyNamespaces(data *model.PolicyData) []string {
+	if data == nil {
+		return nil
+	}
+	var namespaces []string
+	add := func(m map[string]interface{}) {
+		ns := defaultNamespace
+		if ds, ok := m["data_stream"].(map[string]interface{}); ok {
+			if s, ok := ds["namespace"].(string); ok && s != "" {
+				ns = s
+			}
+		}
+		if !slices.Contains(namespaces, ns) {
+			namespaces = append(namespaces, ns)
+		}
+	}
+
+	for _, input := range data.Inputs {
+		add(input)
+	}
+
+	var agent struct {
+		Monitoring struct {
+			Enabled   bool   `json:"enabled"`
+			Namespace string `json:"namespace"`
+		} `json:"monitoring"`
+	}
+	if len(data.Agent) > 0 && json.Unmarshal(data.Agent, &agent) == nil && agent.Monitoring.Enabled {
+		add(map[string]interface{}{
+			"data_stream": map[string]interface{}{"namespace": agent.Monitoring.Namespace},
+		})
+	}
+
+	slices.Sort(namespaces)
+	return namespaces
+}
+
+// restrictRoleNamespaces returns the role with the data stream patterns of its index privileges restricted to the namespaces.
+func restrictRoleNamespaces(role RoleT, namespaces []string) (RoleT, error) {
+	descriptors, err := smap.Parse(role.Raw)
+	if err != nil {
+		return RoleT{}, err
+	}
+
+	for _, v := range descriptors {
+		descriptor, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		indices, ok := descriptor["indices"].([]interface{})
+		if !ok {
+			continue
+		}
+		for _, idx := range indices {
+			index, ok := idx.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			names, ok := index["names"].([]interface{})
+			if !ok {
+				continue
+			}
+			restricted := make([]interface{}, 0, len(names))
+			for _, n := range names {
+				name, ok := n.(string)
+				if !ok {
+					restricted = append(restricted, n)
+					continue
+				}
+				for _, r := range restrictPattern(name, namespaces) {
+					if !slices.Contains(restricted, interface{}(r)) {
+						restricted = append(restricted, r)
+					}
+				}
+			}
+			index["names"] = restricted
+		}
+	}
+
+	var r RoleT
+	if r.Sha2, err = descriptors.Hash(); err != nil {
+		return RoleT{}, err
+	}
+	if r.Raw, err = json.Marshal(descriptors); err != nil {
+		return RoleT{}, err
+	}
+	return r, nil
+}
+
+// restrictPattern returns the patterns matching the data streams of the index pattern in the namespaces.
+// Patterns that are not data stream patterns with a wildcard namespace are returned as is.
+func restrictPattern(pattern string, namespaces []string) []string {
+	parts := strings.Split(pattern, "-")
+	if !slices.Contains(dataStreamTypes, parts[0]) {
+		return []string{pattern}
+	}
+
+	var prefix string
+	switch {
+	case len(parts) == 2 && parts[1] == "*":
+		// logs-* matches any dataset in any namespace
+		prefix = parts[0] + "-*-"
+	case len(parts) == 3 && parts[2] == "*":
+		prefix = parts[0] + "-" + parts[1] + "-"
+	default:
+		return []string{pattern}
+	}
+
+	patterns := make([]string, 0, len(namespaces))
+	for _, ns := range namespaces {
+		patterns = append(patterns, prefix+ns)
+	}
+	return patterns
+}
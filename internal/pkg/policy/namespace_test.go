@@ -0,0 +1,90 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package policy
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+)
+
+func TestParsedPolicyRestrictNamespaces(t *testing.T) {
+	const fallbackPerms = `{"default":{"_fallback":{"cluster":["monitor"],"indices":[{"names":["logs-*","metrics-*","traces-*",".logs-endpoint.diagnostic.collection-*"],"privileges":["auto_configure","create_doc"]}]}}}`
+
+	tests := []struct {
+		name     string
+		perms    string
+		agent    string
+		inputs   string
+		expected string
+	}{{
+		name:     "fallback permissions",
+		perms:    fallbackPerms,
+		inputs:   `[{"type":"logfile","data_stream":{"namespace":"dmz"}}]`,
+		expected: `{"_fallback":{"cluster":["monitor"],"indices":[{"names":["logs-*-dmz","metrics-*-dmz","traces-*-dmz",".logs-endpoint.diagnostic.collection-*"],"privileges":["auto_configure","create_doc"]}]}}`,
+	}, {
+		name:     "input and monitoring namespaces",
+		perms:    fallbackPerms,
+		agent:    `{"monitoring":{"enabled":true,"namespace":"ops","logs":true,"metrics":true}}`,
+		inputs:   `[{"type":"logfile","data_stream":{"namespace":"dmz"}},{"type":"system/metrics"}]`,
+		expected: `{"_fallback":{"cluster":["monitor"],"indices":[{"names":["logs-*-default","logs-*-dmz","logs-*-ops","metrics-*-default","metrics-*-dmz","metrics-*-ops","traces-*-default","traces-*-dmz","traces-*-ops",".logs-endpoint.diagnostic.collection-*"],"privileges":["auto_configure","create_doc"]}]}}`,
+	}, {
+		name:     "integration permissions",
+		perms:    `{"default":{"nginx":{"indices":[{"names":["logs-nginx.access-*","logs-nginx.error-corp","metrics-nginx.stubstatus-*"],"privileges":["auto_configure","create_doc"]}]}}}`,
+		agent:    `{"monitoring":{"enabled":false}}`,
+		inputs:   `[{"type":"nginx/metrics","data_stream":{"namespace":"corp"}}]`,
+		expected: `{"nginx":{"indices":[{"names":["logs-nginx.access-corp","logs-nginx.error-corp","metrics-nginx.stubstatus-corp"],"privileges":["auto_configure","create_doc"]}]}}`,
+	}, {
+		name:     "no namespace",
+		perms:    fallbackPerms,
+		expected: `{"_fallback":{"cluster":["monitor"],"indices":[{"names":["logs-*","metrics-*","traces-*",".logs-endpoint.diagnostic.collection-*"],"privileges":["auto_configure","create_doc"]}]}}`,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			data := &model.PolicyData{
+				OutputPermissions: json.RawMessage(tc.perms),
+				Outputs:           map[string]map[string]interface{}{"default": {"type": OutputTypeElasticsearch}},
+			}
+			if tc.agent != "" {
+				data.Agent = json.RawMessage(tc.agent)
+			}
+			if tc.inputs != "" {
+				require.NoError(t, json.Unmarshal([]byte(tc.inputs), &data.Inputs))
+			}
+			roles, err := parsePerms(data.OutputPermissions)
+			require.NoError(t, err)
+			outputs, err := constructPolicyOutputs(data.Outputs, roles)
+			require.NoError(t, err)
+			pp := &ParsedPolicy{Policy: model.Policy{Data: data}, Roles: roles, Outputs: outputs}
+
+			require.NoError(t, pp.restrictNamespaces())
+			assert.JSONEq(t, tc.expected, string(pp.Roles["default"].Raw))
+			require.NotNil(t, pp.Outputs["default"].Role)
+			assert.Equal(t, pp.Roles["default"], *pp.Outputs["default"].Role)
+		})
+	}
+
+	t.Run("namespace change changes the permissions hash", func(t *testing.T) {
+		roles, err := parsePerms(json.RawMessage(fallbackPerms))
+		require.NoError(t, err)
+		dmz, err := restrictRoleNamespaces(roles["default"], []string{"dmz"})
+		require.NoError(t, err)
+		corp, err := restrictRoleNamespaces(roles["default"], []string{"corp"})
+		require.NoError(t, err)
+		again, err := restrictRoleNamespaces(roles["default"], []string{"dmz"})
+		require.NoError(t, err)
+
+		assert.NotEqual(t, roles["default"].Sha2, dmz.Sha2)
+		assert.NotEqual(t, dmz.Sha2, corp.Sha2)
+		assert.Equal(t, dmz.Sha2, again.Sha2)
+	})
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
 	"github.com/elastic/fleet-server/v7/internal/pkg/model"
 	"github.com/elastic/fleet-server/v7/internal/pkg/smap"
+	"github.com/rs/zerolog"
 	"go.elastic.co/apm/v2"
 )
 
@@ -52,6 +53,13 @@ type ParsedPolicy struct {
 	Links   apm.SpanLink
 }
 
+// MarshalZerologObject logs the parsed policy without the values of its inputs and outputs, they hold resolved secret values.
+func (pp ParsedPolicy) MarshalZerologObject(e *zerolog.Event) {
+	e.Object("policy", pp.Policy).
+		Str("default_output", pp.Default.Name).
+		Int("inputs", len(pp.Inputs))
+}
+
 func NewParsedPolicy(ctx context.Context, bulker bulk.Bulk, p model.Policy) (*ParsedPolicy, error) {
 	var err error
 	// Interpret the output permissions if available
@@ -7,13 +7,18 @@
 package policy
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"testing"
 
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
 	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
 )
 
 func TestNewParsedPolicy(t *testing.T) {
@@ -89,3 +94,51 @@ func TestNewParsedPolicyRemoteES(t *testing.T) {
 	// Validate that default was found
 	require.Equal(t, "remote", pp.Default.Name)
 }
+
+func TestNewParsedPolicySecrets(t *testing.T) {
+	newPolicy := func(inputSecret, outputSecret string) model.Policy {
+		return model.Policy{
+			PolicyID:    "policy",
+			RevisionIdx: 2,
+			Data: &model.PolicyData{
+				Outputs: map[string]map[string]interface{}{
+					"default": {
+						"type":    "elasticsearch",
+						"secrets": map[string]interface{}{"service_token": map[string]interface{}{"id": outputSecret}},
+					},
+				},
+				Inputs:           []map[string]interface{}{{"id": "input1", "password": "$co.elastic.secret{" + inputSecret + "}"}},
+				SecretReferences: []model.SecretReferencesItems{{ID: inputSecret}},
+			},
+		}
+	}
+
+	t.Run("resolved values are not logged", func(t *testing.T) {
+		pp, err := NewParsedPolicy(context.Background(), ftesting.NewMockBulk(), newPolicy("password", "token"))
+		require.NoError(t, err)
+		require.Equal(t, "password_value", pp.Inputs[0]["password"])
+		require.Equal(t, "token_value", pp.Policy.Data.Outputs["default"]["service_token"])
+
+		var logs bytes.Buffer
+		log := zerolog.New(&logs)
+		log.Debug().Interface("policy", pp).Msg("interface")
+		log.Debug().Interface("policy", *pp).Msg("value")
+		log.Debug().Interface("data", pp.Policy.Data).Msg("data")
+		log.Debug().Object("policy", pp).Msg("object")
+
+		assert.Contains(t, logs.String(), `"policy_id":"policy"`)
+		assert.Contains(t, logs.String(), `"outputs":["default"]`)
+		assert.NotContains(t, logs.String(), "password_value")
+		assert.NotContains(t, logs.String(), "token_value")
+	})
+
+	t.Run("missing input secret", func(t *testing.T) {
+		_, err := NewParsedPolicy(context.Background(), ftesting.NewMockBulk(), newPolicy("missing-1", "token"))
+		assert.ErrorIs(t, err, bulk.ErrSecretNotFound)
+	})
+
+	t.Run("missing output secret", func(t *testing.T) {
+		_, err := NewParsedPolicy(context.Background(), ftesting.NewMockBulk(), newPolicy("password", "missing-1"))
+		assert.ErrorIs(t, err, bulk.ErrSecretNotFound)
+	})
+}
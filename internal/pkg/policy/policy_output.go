@@ -31,6 +31,10 @@ const (
 	OutputTypeKafka               = "kafka"
 )
 
+// PreviewAPIKey is the api_key of the outputs for which Prepare would create a new API key, in a policy prepared
+// with Preview.
+const PreviewAPIKey = "<preview: created on dispatch>"
+
 var (
 	ErrNoOutputPerms    = errors.New("output permission sections not found")
 	ErrFailInjectAPIKey = errors.New("fail inject api key")
@@ -82,6 +86,45 @@ func (p *Output) Prepare(ctx context.Context, zlog zerolog.Logger, bulker bulk.B
 	return nil
 }
 
+// Preview prepares the output p like Prepare, without creating, updating or retiring any API key nor updating the
+// agent. The output gets the current API key of the agent, or PreviewAPIKey if Prepare would create a new API key, in
+// which case Preview returns true.
+//
+// The configuration of a remote elasticsearch output is not compared to the one of its current API key, a key that
+// Prepare would create again because the remote output changed is previewed as the current key.
+func (p *Output) Preview(agent *model.Agent, outputMap map[string]map[string]interface{}) (bool, error) {
+	switch p.Type {
+	case OutputTypeElasticsearch, OutputTypeRemoteElasticsearch:
+	case OutputTypeLogstash, OutputTypeKafka:
+		return false, nil
+	default:
+		return false, fmt.Errorf("encountered unexpected output type while preparing outputs: %s", p.Type)
+	}
+	if p.Role == nil {
+		return false, ErrNoOutputPerms
+	}
+	if _, ok := outputMap[p.Name]; !ok {
+		return false, ErrFailInjectAPIKey
+	}
+
+	if p.Type == OutputTypeRemoteElasticsearch {
+		asElasticsearchOutput(outputMap[p.Name])
+	}
+	if output, ok := agent.Outputs[p.Name]; ok && output.APIKey != "" {
+		outputMap[p.Name]["api_key"] = output.APIKey
+		return false, nil
+	}
+	outputMap[p.Name]["api_key"] = PreviewAPIKey
+	return true, nil
+}
+
+// asElasticsearchOutput sends a remote elasticsearch output as an elasticsearch output, the agent doesn't recognize
+// remote_elasticsearch, and removes its service token.
+func asElasticsearchOutput(output map[string]interface{}) {
+	output[FieldOutputType] = OutputTypeElasticsearch
+	delete(output, FieldOutputServiceToken)
+}
+
 func (p *Output) prepareElasticsearch(
 	ctx context.Context,
 	zlog zerolog.Logger,
@@ -277,10 +320,7 @@ func (p *Output) prepareElasticsearch(
 				}
 			}
 
-			// replace type remote_elasticsearch with elasticsearch as agent doesn't recognize remote_elasticsearch
-			outputMap[p.Name][FieldOutputType] = OutputTypeElasticsearch
-			// remove the service token from the agent policy sent to the agent
-			delete(outputMap[p.Name], FieldOutputServiceToken)
+			asElasticsearchOutput(outputMap[p.Name])
 			return nil
 		} else if p.Type == OutputTypeRemoteElasticsearch {
 			doc := model.OutputHealth{
@@ -343,11 +383,7 @@ func (p *Output) prepareElasticsearch(
 	}
 
 	if p.Type == OutputTypeRemoteElasticsearch {
-
-		// replace type remote_elasticsearch with elasticsearch as agent doesn't recognize remote_elasticsearch
-		outputMap[p.Name][FieldOutputType] = OutputTypeElasticsearch
-		// remove the service token from the agent policy sent to the agent
-		delete(outputMap[p.Name], FieldOutputServiceToken)
+		asElasticsearchOutput(outputMap[p.Name])
 	}
 
 	// Always insert the `api_key` as part of the output block, this is required
@@ -557,3 +557,55 @@ func TestPolicyRemoteESOutputPrepare(t *testing.T) {
 		bulker.AssertExpectations(t)
 	})
 }
+
+func TestPolicyOutputPreview(t *testing.T) {
+	role := &RoleT{Sha2: "new-hash", Raw: TestPayload}
+	apiKey := bulk.APIKey{ID: "test_id_existing", Key: "existing-key"}
+	policyMap := func(typ string) map[string]map[string]interface{} {
+		return map[string]map[string]interface{}{
+			"test output": {
+				"hosts":         []interface{}{"http://localhost"},
+				"service_token": "serviceToken1",
+				"type":          typ,
+			},
+		}
+	}
+
+	t.Run("existing key", func(t *testing.T) {
+		// The permissions changed, Prepare would update the roles of the key and send it unchanged.
+		agent := &model.Agent{Outputs: map[string]*model.PolicyOutput{
+			"test output": {APIKey: apiKey.Agent(), APIKeyID: apiKey.ID, PermissionsHash: "old-hash"},
+		}}
+		outputs := policyMap(OutputTypeElasticsearch)
+		minted, err := (&Output{Type: OutputTypeElasticsearch, Name: "test output", Role: role}).Preview(agent, outputs)
+		require.NoError(t, err)
+		assert.False(t, minted)
+		assert.Equal(t, apiKey.Agent(), outputs["test output"]["api_key"])
+		assert.Equal(t, "old-hash", agent.Outputs["test output"].PermissionsHash, "the agent is not updated")
+	})
+
+	t.Run("new key", func(t *testing.T) {
+		agent := &model.Agent{}
+		outputs := policyMap(OutputTypeRemoteElasticsearch)
+		minted, err := (&Output{Type: OutputTypeRemoteElasticsearch, Name: "test output", Role: role}).Preview(agent, outputs)
+		require.NoError(t, err)
+		assert.True(t, minted)
+		assert.Equal(t, PreviewAPIKey, outputs["test output"]["api_key"])
+		assert.Equal(t, OutputTypeElasticsearch, outputs["test output"]["type"])
+		assert.NotContains(t, outputs["test output"], "service_token")
+		assert.Empty(t, agent.Outputs, "the agent is not updated")
+	})
+
+	t.Run("logstash", func(t *testing.T) {
+		outputs := map[string]map[string]interface{}{"test output": {"type": OutputTypeLogstash}}
+		minted, err := (&Output{Type: OutputTypeLogstash, Name: "test output"}).Preview(&model.Agent{}, outputs)
+		require.NoError(t, err)
+		assert.False(t, minted)
+		assert.NotContains(t, outputs["test output"], "api_key")
+	})
+
+	t.Run("no role", func(t *testing.T) {
+		_, err := (&Output{Type: OutputTypeElasticsearch, Name: "test output"}).Preview(&model.Agent{}, policyMap(OutputTypeElasticsearch))
+		assert.ErrorIs(t, err, ErrNoOutputPerms)
+	})
+}
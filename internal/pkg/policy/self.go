@@ -39,6 +39,9 @@ type SelfMonitor interface {
 	Run(ctx context.Context) error
 	// State gets current state of monitor.
 	State() client.UnitState
+	// PolicyReady returns true while the policy of the fleet-server exists with a fleet-server input and
+	// a revision, agents are only enrolled while it is ready.
+	PolicyReady() bool
 }
 
 type selfMonitorT struct {
@@ -51,6 +54,7 @@ type selfMonitorT struct {
 
 	policyID string
 	state    client.UnitState
+	ready    bool
 	reporter state.Reporter
 
 	policy *model.Policy
@@ -59,15 +63,39 @@ type selfMonitorT struct {
 	policiesIndex    string
 	enrollmentTokenF enrollmentTokenFetcher
 	checkTime        time.Duration
+	health           *state.ESHealth
 
 	startCh chan struct{}
 }
 
+type selfMonitorOpts struct {
+	health *state.ESHealth
+}
+
+// SelfMonitorOpt is an option of the self monitors.
+type SelfMonitorOpt func(*selfMonitorOpts)
+
+// WithESHealth degrades the healthy state of the self monitor while the requests to Elasticsearch fail.
+func WithESHealth(health *state.ESHealth) SelfMonitorOpt {
+	return func(o *selfMonitorOpts) {
+		o.health = health
+	}
+}
+
+func parseSelfMonitorOpts(opts ...SelfMonitorOpt) selfMonitorOpts {
+	var o selfMonitorOpts
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
 // NewSelfMonitor creates the self policy monitor.
 //
 // Ensures that the policy that this Fleet Server attached to exists and that it
 // has a Fleet Server input defined.
-func NewSelfMonitor(fleet config.Fleet, bulker bulk.Bulk, monitor monitor.Monitor, policyID string, reporter state.Reporter) SelfMonitor {
+func NewSelfMonitor(fleet config.Fleet, bulker bulk.Bulk, monitor monitor.Monitor, policyID string, reporter state.Reporter, opts ...SelfMonitorOpt) SelfMonitor {
+	o := parseSelfMonitorOpts(opts...)
 	return &selfMonitorT{
 		fleet:            fleet,
 		bulker:           bulker,
@@ -79,6 +107,7 @@ func NewSelfMonitor(fleet config.Fleet, bulker bulk.Bulk, monitor monitor.Monito
 		policiesIndex:    dl.FleetPolicies,
 		enrollmentTokenF: findEnrollmentAPIKeys,
 		checkTime:        DefaultCheckTime,
+		health:           o.health,
 		startCh:          make(chan struct{}),
 	}
 }
@@ -111,6 +140,12 @@ LOOP:
 			}
 			cT.Reset(m.checkTime)
 			m.log.Trace().Msg(state.String())
+		case <-m.health.Changed():
+			state, err := m.updateState(ctx)
+			if err != nil {
+				return err
+			}
+			m.log.Trace().Msg(state.String())
 		case hits := <-s.Output():
 			policies := make([]model.Policy, len(hits))
 			for i, hit := range hits {
@@ -136,6 +171,12 @@ func (m *selfMonitorT) State() client.UnitState {
 	return m.state
 }
 
+func (m *selfMonitorT) PolicyReady() bool {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.ready
+}
+
 func (m *selfMonitorT) waitStart(ctx context.Context) error { //nolint:unused // not sure if this is used in tests
 	select {
 	case <-ctx.Done():
@@ -158,6 +199,8 @@ func (m *selfMonitorT) process(ctx context.Context) (client.UnitState, error) {
 		}
 		m.log.Debug().Str("index", m.policiesIndex).Msg(es.ErrIndexNotFound.Error())
 	}
+	// The latest revisions of all the policies are fetched, the policy was deleted if it is not among them.
+	m.policy = nil
 	if len(policies) == 0 {
 		return m.updateState(ctx)
 	}
@@ -191,6 +234,8 @@ func (m *selfMonitorT) updateState(ctx context.Context) (client.UnitState, error
 	m.mut.Lock()
 	defer m.mut.Unlock()
 
+	m.updateReady()
+
 	if m.policy == nil {
 		// no policy found
 		m.state = client.UnitStateStarting
@@ -241,15 +286,30 @@ func (m *selfMonitorT) updateState(ctx context.Context) (client.UnitState, error
 			"enrollment_token": tokens[0].APIKey,
 		}
 	}
-	m.state = state
+	message := fmt.Sprintf("Running on policy with Fleet Server integration: %s%s", m.policyID, extendMsg)
 	if m.policyID == "" {
-		m.reporter.UpdateState(state, fmt.Sprintf("Running on default policy with Fleet Server integration%s", extendMsg), payload) //nolint:errcheck // not clear what to do in failure cases
-	} else {
-		m.reporter.UpdateState(state, fmt.Sprintf("Running on policy with Fleet Server integration: %s%s", m.policyID, extendMsg), payload) //nolint:errcheck // not clear what to do in failure cases
+		message = fmt.Sprintf("Running on default policy with Fleet Server integration%s", extendMsg)
 	}
+	state, message = m.health.Apply(state, message)
+	m.state = state
+	m.reporter.UpdateState(state, message, payload) //nolint:errcheck // not clear what to do in failure cases
 	return state, nil
 }
 
+// updateReady updates whether the policy is ready for the agents to enroll, m.mut must be held.
+func (m *selfMonitorT) updateReady() {
+	ready := m.policy != nil && m.policy.RevisionIdx >= 1 && m.policy.Data != nil && HasFleetServerInput(m.policy.Data.Inputs)
+	if ready == m.ready {
+		return
+	}
+	m.ready = ready
+	if ready {
+		m.log.Info().Str(logger.PolicyID, m.policy.PolicyID).Int64("revision_idx", m.policy.RevisionIdx).Msg("fleet-server policy is ready, accepting enrollments")
+	} else {
+		m.log.Warn().Str(logger.PolicyID, m.policyID).Msg("fleet-server policy is not ready, rejecting enrollments")
+	}
+}
+
 func isOutputCfgOutdated(ctx context.Context, bulker bulk.Bulk, zlog zerolog.Logger, outputName string) bool {
 	policy, err := dl.QueryOutputFromPolicy(ctx, bulker, outputName)
 	if err != nil || policy == nil {
@@ -19,6 +19,7 @@ import (
 	"github.com/elastic/elastic-agent-client/v7/pkg/client"
 	"github.com/gofrs/uuid"
 	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
@@ -619,6 +620,131 @@ func TestSelfMonitor_SpecificPolicy_Degraded(t *testing.T) {
 	}
 }
 
+func TestSelfMonitor_PolicyReady(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = testlog.SetLogger(t).WithContext(ctx)
+
+	cfg := config.Fleet{
+		Agent: config.Agent{
+			ID: "agent-id",
+		},
+	}
+	reporter := &FakeReporter{}
+	policyID := uuid.Must(uuid.NewV4()).String()
+
+	chHitT := make(chan []es.HitT, 1)
+	defer close(chHitT)
+	ms := mmock.NewMockSubscription()
+	ms.On("Output").Return((<-chan []es.HitT)(chHitT))
+	mm := mmock.NewMockMonitor()
+	mm.On("Subscribe").Return(ms).Once()
+	mm.On("Unsubscribe", mock.Anything).Return().Once()
+	bulker := ftesting.NewMockBulk()
+	bulker.On("GetBulkerMap").Return(make(map[string]bulk.Bulk))
+
+	monitor := NewSelfMonitor(cfg, bulker, mm, policyID, reporter)
+	sm := monitor.(*selfMonitorT)
+	sm.checkTime = 100 * time.Millisecond
+
+	var policyLock sync.Mutex
+	var policyResult []model.Policy
+	setPolicies := func(policies ...model.Policy) {
+		policyLock.Lock()
+		defer policyLock.Unlock()
+		policyResult = policies
+	}
+	sm.policyF = func(ctx context.Context, bulker bulk.Bulk, opt ...dl.Option) ([]model.Policy, error) {
+		policyLock.Lock()
+		defer policyLock.Unlock()
+		return policyResult, nil
+	}
+
+	var merr error
+	var mwg sync.WaitGroup
+	mwg.Add(1)
+	go func() {
+		defer mwg.Done()
+		merr = monitor.Run(ctx)
+	}()
+	if err := sm.waitStart(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	waitReady := func(ready bool) {
+		ftesting.Retry(t, ctx, func(ctx context.Context) error {
+			if monitor.PolicyReady() != ready {
+				return fmt.Errorf("policy ready should be %t", ready)
+			}
+			return nil
+		}, ftesting.RetryCount(20))
+	}
+	newPolicy := func(revisionIdx int64) model.Policy {
+		return model.Policy{
+			ESDocument: model.ESDocument{
+				Id:      xid.New().String(),
+				Version: 1,
+				SeqNo:   revisionIdx,
+			},
+			PolicyID:    policyID,
+			Data:        &model.PolicyData{Inputs: []map[string]interface{}{{"type": "fleet-server"}}},
+			RevisionIdx: revisionIdx,
+		}
+	}
+	hit := func(policy model.Policy) []es.HitT {
+		p, err := json.Marshal(&policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []es.HitT{{ID: policy.Id, SeqNo: policy.SeqNo, Version: 1, Source: p}}
+	}
+
+	// not ready before the policy arrives
+	waitReady(false)
+
+	// not ready without a revision
+	policy := newPolicy(0)
+	setPolicies(policy)
+	chHitT <- hit(policy)
+	ftesting.Retry(t, ctx, func(ctx context.Context) error {
+		if state, _, _ := reporter.Current(); state != client.UnitStateHealthy {
+			return fmt.Errorf("should be reported as healthy; instead its %s", state)
+		}
+		return nil
+	}, ftesting.RetryCount(20))
+	assert.False(t, monitor.PolicyReady())
+
+	// ready once the first revision arrives
+	policy = newPolicy(1)
+	setPolicies(policy)
+	chHitT <- hit(policy)
+	waitReady(true)
+
+	// not ready once the policy is deleted
+	setPolicies()
+	waitReady(false)
+	ftesting.Retry(t, ctx, func(ctx context.Context) error {
+		state, msg, _ := reporter.Current()
+		if state != client.UnitStateStarting {
+			return fmt.Errorf("should be reported as starting; instead its %s", state)
+		}
+		if msg != fmt.Sprintf("Waiting on policy with Fleet Server integration: %s", policyID) {
+			return fmt.Errorf("should be waiting on the policy")
+		}
+		return nil
+	}, ftesting.RetryCount(20))
+
+	// ready again once it is back
+	setPolicies(policy)
+	waitReady(true)
+
+	cancel()
+	mwg.Wait()
+	if merr != nil && merr != context.Canceled {
+		t.Fatal(merr)
+	}
+}
+
 type FakeReporter struct {
 	lock    sync.Mutex
 	state   client.UnitState
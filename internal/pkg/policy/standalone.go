@@ -33,12 +33,14 @@ type standAloneSelfMonitorT struct {
 	policiesIndex string
 	checkTime     time.Duration
 	checkTimeout  time.Duration
+	health        *state.ESHealth
 }
 
 // NewStandAloneSelfMonitor creates the self policy monitor for an stand-alone Fleet Server.
 //
 // Checks that this Fleet Server has access to the policies index.
-func NewStandAloneSelfMonitor(bulker bulk.Bulk, reporter state.Reporter) *standAloneSelfMonitorT {
+func NewStandAloneSelfMonitor(bulker bulk.Bulk, reporter state.Reporter, opts ...SelfMonitorOpt) *standAloneSelfMonitorT {
+	o := parseSelfMonitorOpts(opts...)
 	return &standAloneSelfMonitorT{
 		bulker:        bulker,
 		state:         client.UnitStateStarting,
@@ -47,6 +49,7 @@ func NewStandAloneSelfMonitor(bulker bulk.Bulk, reporter state.Reporter) *standA
 		policiesIndex: dl.FleetPolicies,
 		checkTime:     DefaultCheckTime,
 		checkTimeout:  DefaultCheckTimeout,
+		health:        o.health,
 	}
 }
 
@@ -63,6 +66,7 @@ func (m *standAloneSelfMonitorT) Run(ctx context.Context) error {
 		case <-ctx.Done():
 			return nil
 		case <-ticker.C:
+		case <-m.health.Changed():
 		}
 	}
 }
@@ -81,6 +85,11 @@ func (m *standAloneSelfMonitorT) State() client.UnitState {
 	return m.state
 }
 
+// PolicyReady always returns true, a stand-alone fleet-server does not run on a policy.
+func (m *standAloneSelfMonitorT) PolicyReady() bool {
+	return true
+}
+
 func (m *standAloneSelfMonitorT) check(ctx context.Context) {
 	ctx, cancel := context.WithTimeout(ctx, m.checkTimeout)
 	defer cancel()
@@ -112,6 +121,7 @@ func (m *standAloneSelfMonitorT) check(ctx context.Context) {
 		message = fmt.Sprintf("Failed to request policies: %s", err)
 	}
 
+	state, message = m.health.Apply(state, message)
 	if current != state {
 		m.updateState(state, message)
 	}
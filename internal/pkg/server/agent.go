@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -16,6 +17,7 @@ import (
 	"github.com/elastic/fleet-server/v7/internal/pkg/build"
 	"github.com/elastic/fleet-server/v7/internal/pkg/config"
 	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger/errlog"
 	"github.com/elastic/fleet-server/v7/internal/pkg/reload"
 	"github.com/elastic/fleet-server/v7/internal/pkg/sleep"
 	"github.com/elastic/fleet-server/v7/internal/pkg/state"
@@ -68,6 +70,9 @@ type Agent struct {
 
 	outputCheckCanceller context.CancelFunc
 	chReconfigure        chan struct{}
+
+	// lastMerged is the last configuration merged from the units, the changes of the next one are logged.
+	lastMerged *config.Merged
 }
 
 // NewAgent returns an Agent that will gather connection information from the passed reader.
@@ -139,6 +144,14 @@ func (a *Agent) Run(ctx context.Context) error {
 		}
 		return cfg.Output.Elasticsearch.TLS.DiagCerts()()
 	})
+	a.agent.RegisterDiagnosticHook("fleet-server recent errors", "fleet-server's last errors of each subsystem", "fleet-server-errors.json", "application/json", func() []byte {
+		p, err := errlog.Dump()
+		if err != nil {
+			log.Error().Err(err).Msg("Diagnostics hook failure recent errors unable to marshal json.")
+			return nil
+		}
+		return p
+	})
 	a.agent.RegisterOptionalDiagnosticHook("CONN", "fleet-server output request diag", "fleet-server output request trace diagnostics", "fleet-server-output-request.txt", "text/plain", func() []byte {
 		if a.srv == nil {
 			log.Warn().Msg("Diagnostics hook failure fleet-server is nil.")
@@ -529,12 +542,25 @@ func (a *Agent) configFromUnits(ctx context.Context) (*config.Config, error) {
 
 	}
 
-	cliCfg := ucfg.MustNewFrom(a.cliCfg, config.DefaultOptions...)
-	err = cliCfg.Merge(cfgData, config.DefaultOptions...)
+	envCfg, err := config.EnvSource(os.Environ())
 	if err != nil {
 		return nil, err
 	}
-	return config.FromConfig(cliCfg)
+	merged, err := config.MergeSources(config.Sources{
+		File:   a.cliCfg,
+		Env:    envCfg,
+		Policy: cfgData,
+	})
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := merged.Config()
+	if err != nil {
+		return nil, err
+	}
+	merged.LogDiff(ctx, a.lastMerged)
+	a.lastMerged = merged
+	return cfg, nil
 }
 
 // apmConfigToInstrumentation transforms the passed APMConfig into the Instrumentation config that is used by fleet-server.
@@ -575,6 +601,7 @@ func injectMissingOutputAttributes(ctx context.Context, outMap, bootstrap map[st
 		"proxy_url",
 		"proxy_disable",
 		"proxy_headers",
+		"no_proxy",
 	}
 	// keys that will appear under the "ssl" key
 	bootstrapSSLKeys := []string{
@@ -585,6 +612,12 @@ func injectMissingOutputAttributes(ctx context.Context, outMap, bootstrap map[st
 		"key",
 	}
 
+	// fleet-server authenticates with the service token from bootstrap, the credentials issued for the agent in the policy are not used.
+	if _, ok := bootstrap["service_token"]; ok {
+		removeOutputCredentials(outMap)
+	} else if _, ok := bootstrap["service_token_path"]; ok {
+		removeOutputCredentials(outMap)
+	}
 	injectKeys(bootstrapKeys, outMap, bootstrap)
 
 	// flags used to delete verification_mode: none if it is part of bootstrap and injected when output provides a CA of some sort.
@@ -629,6 +662,13 @@ func injectMissingOutputAttributes(ctx context.Context, outMap, bootstrap map[st
 	outMap["ssl"] = outputSSL
 }
 
+// removeOutputCredentials removes the credentials that are mutually exclusive with a service token from outMap.
+func removeOutputCredentials(outMap map[string]interface{}) {
+	for _, key := range []string{"username", "password", "api_key"} {
+		delete(outMap, key)
+	}
+}
+
 // injectKeys will inject any key in the passed list that exists in src but is missing from dst.
 func injectKeys(keys []string, dst, src map[string]interface{}) {
 	for _, key := range keys {
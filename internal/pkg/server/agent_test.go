@@ -14,6 +14,7 @@ import (
 	"github.com/elastic/elastic-agent-client/v7/pkg/client"
 	"github.com/elastic/elastic-agent-client/v7/pkg/proto"
 	"github.com/elastic/fleet-server/v7/internal/pkg/build"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
 	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
 	"github.com/elastic/fleet-server/v7/version"
 	"github.com/elastic/go-ucfg"
@@ -198,7 +199,7 @@ func Test_Agent_configFromUnits(t *testing.T) {
 		require.NoError(t, err)
 		require.Len(t, cfg.Inputs, 1)
 		assert.Equal(t, "fleet-server", cfg.Inputs[0].Type)
-		assert.Equal(t, "0.0.0.0", cfg.Inputs[0].Server.Host)
+		assert.Equal(t, config.BindHosts{"0.0.0.0"}, cfg.Inputs[0].Server.Host)
 		assert.Equal(t, 29*time.Minute, cfg.Inputs[0].Server.Timeouts.Write)
 		assert.Equal(t, time.Minute, cfg.Inputs[0].Server.Timeouts.CheckinLongPoll)
 		assert.Equal(t, 1000, cfg.Inputs[0].Server.Limits.MaxAgents)
@@ -305,7 +306,7 @@ func Test_Agent_configFromUnits(t *testing.T) {
 		require.Len(t, cfg.Inputs, 1)
 		assert.Equal(t, "fleet-server", cfg.Inputs[0].Type)
 		assert.Equal(t, "test-policy", cfg.Inputs[0].Policy.ID)
-		assert.Equal(t, "0.0.0.0", cfg.Inputs[0].Server.Host)
+		assert.Equal(t, config.BindHosts{"0.0.0.0"}, cfg.Inputs[0].Server.Host)
 		assert.True(t, cfg.Inputs[0].Server.Instrumentation.Enabled)
 		assert.False(t, cfg.Inputs[0].Server.Instrumentation.TLS.SkipVerify)
 		assert.Equal(t, "/path/to/ca.crt", cfg.Inputs[0].Server.Instrumentation.TLS.ServerCA)
@@ -364,7 +365,7 @@ func Test_Agent_configFromUnits(t *testing.T) {
 		require.NoError(t, err)
 		require.Len(t, cfg.Inputs, 1)
 		assert.Equal(t, "fleet-server", cfg.Inputs[0].Type)
-		assert.Equal(t, "0.0.0.0", cfg.Inputs[0].Server.Host)
+		assert.Equal(t, config.BindHosts{"0.0.0.0"}, cfg.Inputs[0].Server.Host)
 		assert.True(t, cfg.Inputs[0].Server.Instrumentation.Enabled)
 		assert.False(t, cfg.Inputs[0].Server.Instrumentation.TLS.SkipVerify)
 		assert.Empty(t, cfg.Inputs[0].Server.Instrumentation.TLS.ServerCA)
@@ -438,7 +439,7 @@ func Test_Agent_configFromUnits(t *testing.T) {
 		require.NoError(t, err)
 		require.Len(t, cfg.Inputs, 1)
 		assert.Equal(t, "fleet-server", cfg.Inputs[0].Type)
-		assert.Equal(t, "0.0.0.0", cfg.Inputs[0].Server.Host)
+		assert.Equal(t, config.BindHosts{"0.0.0.0"}, cfg.Inputs[0].Server.Host)
 		assert.True(t, cfg.Inputs[0].Server.Instrumentation.Enabled)
 		assert.False(t, cfg.Inputs[0].Server.Instrumentation.TLS.SkipVerify)
 		assert.Equal(t, "/path/to/ca.crt", cfg.Inputs[0].Server.Instrumentation.TLS.ServerCA)
@@ -490,7 +491,7 @@ func Test_Agent_configFromUnits(t *testing.T) {
 		require.NoError(t, err)
 		require.Len(t, cfg.Inputs, 1)
 		assert.Equal(t, "fleet-server", cfg.Inputs[0].Type)
-		assert.Equal(t, "0.0.0.0", cfg.Inputs[0].Server.Host)
+		assert.Equal(t, config.BindHosts{"0.0.0.0"}, cfg.Inputs[0].Server.Host)
 		assert.False(t, cfg.Inputs[0].Server.Instrumentation.Enabled)
 		assert.Equal(t, "test-token", cfg.Output.Elasticsearch.ServiceToken)
 	})
@@ -544,7 +545,7 @@ func Test_Agent_configFromUnits(t *testing.T) {
 		require.NoError(t, err)
 		require.Len(t, cfg.Inputs, 1)
 		assert.Equal(t, "fleet-server", cfg.Inputs[0].Type)
-		assert.Equal(t, "0.0.0.0", cfg.Inputs[0].Server.Host)
+		assert.Equal(t, config.BindHosts{"0.0.0.0"}, cfg.Inputs[0].Server.Host)
 		assert.True(t, cfg.Inputs[0].Server.Instrumentation.Enabled)
 		assert.False(t, cfg.Inputs[0].Server.Instrumentation.TLS.SkipVerify)
 		assert.Equal(t, "/path/to/cert.crt", cfg.Inputs[0].Server.Instrumentation.TLS.ServerCertificate)
@@ -739,6 +740,21 @@ func TestInjectMissingOutputAttributes(t *testing.T) {
 				"verification_mode": "none",
 			},
 		},
+	}, {
+		name: "input has credentials",
+		input: map[string]interface{}{
+			"api_key":  "agent:key",
+			"username": "elastic",
+			"password": "changeme",
+		},
+		expect: map[string]interface{}{
+			"protocol":      "https",
+			"hosts":         []interface{}{"localhost:9200"},
+			"service_token": "token",
+			"ssl": map[string]interface{}{
+				"verification_mode": "full",
+			},
+		},
 	}}
 	bootstrap := map[string]interface{}{
 		"protocol":      "https",
@@ -0,0 +1,90 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+)
+
+const defaultAutoLimitsInterval = 5 * time.Minute
+
+// autoLimits counts the active agents and reports the count when it moves to a different limits tier.
+//
+// A tier change is only reported once the count is observed in the new tier twice in a row,
+// so a count going back and forth around a tier boundary does not reconfigure the server each time.
+type autoLimits struct {
+	count    func(ctx context.Context) (int, error)
+	interval time.Duration
+	outCh    chan<- int
+
+	current   config.AgentRange
+	candidate *config.AgentRange
+}
+
+func newAutoLimits(count func(ctx context.Context) (int, error), current config.AgentRange, interval time.Duration, outCh chan<- int) *autoLimits {
+	if interval <= 0 {
+		interval = defaultAutoLimitsInterval
+	}
+	return &autoLimits{
+		count:    count,
+		interval: interval,
+		outCh:    outCh,
+		current:  current,
+	}
+}
+
+// Run counts the active agents at each interval until the context is cancelled.
+func (a *autoLimits) Run(ctx context.Context) error {
+	tick := time.NewTicker(a.interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
+		}
+
+		agents, err := a.count(ctx)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Unable to count active agents, keeping the current limits")
+			continue
+		}
+		if !a.observe(agents) {
+			continue
+		}
+		zerolog.Ctx(ctx).Info().
+			Int("active_agents", agents).
+			Int("agents_min", a.current.Min).
+			Int("agents_max", a.current.Max).
+			Msg("Active agents moved to a different limits tier")
+		select {
+		case a.outCh <- agents:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// observe records the number of active agents and returns true if the limits tier changed.
+func (a *autoLimits) observe(agents int) bool {
+	tier := config.LimitsTier(agents)
+	switch {
+	case tier == a.current:
+		a.candidate = nil
+		return false
+	case a.candidate != nil && *a.candidate == tier:
+		a.current = tier
+		a.candidate = nil
+		return true
+	default:
+		a.candidate = &tier
+		return false
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+// fakeCounter returns the counts in order, then keeps returning the last one.
+type fakeCounter struct {
+	mu     sync.Mutex
+	counts []int
+	err    error
+}
+
+func (c *fakeCounter) count(context.Context) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		err := c.err
+		c.err = nil
+		return 0, err
+	}
+	n := c.counts[0]
+	if len(c.counts) > 1 {
+		c.counts = c.counts[1:]
+	}
+	return n, nil
+}
+
+func Test_autoLimits_observe(t *testing.T) {
+	a := newAutoLimits(nil, config.LimitsTier(100), time.Minute, nil)
+
+	steps := []struct {
+		agents  int
+		changed bool
+	}{
+		{100, false},
+		{3000, false},
+		{100, false}, // back in the current tier, the candidate is dropped
+		{3000, false},
+		{3000, true},
+		{3000, false},
+		{12000, false},
+		{25000, false}, // a different tier than the candidate
+		{25000, true},
+		{0, false},
+		{0, true},
+	}
+	for i, step := range steps {
+		assert.Equalf(t, step.changed, a.observe(step.agents), "step %d: %d agents", i, step.agents)
+	}
+	assert.Equal(t, config.LimitsTier(0), a.current)
+}
+
+func Test_autoLimits_Run(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = testlog.SetLogger(t).WithContext(ctx)
+
+	counter := &fakeCounter{
+		counts: []int{100, 3000, 3000, 3000, 12000, 12000},
+		err:    errors.New("count failed"),
+	}
+	outCh := make(chan int)
+	a := newAutoLimits(counter.count, config.LimitsTier(100), time.Millisecond, outCh)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- a.Run(ctx)
+	}()
+
+	for _, expected := range []int{3000, 12000} {
+		select {
+		case agents := <-outCh:
+			assert.Equal(t, expected, agents)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected a tier change to %d agents", expected)
+		}
+	}
+
+	// The count stays in the same tier, so no other change is reported.
+	select {
+	case agents := <-outCh:
+		t.Fatalf("unexpected tier change to %d agents", agents)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	require.ErrorIs(t, <-errCh, context.Canceled)
+}
@@ -0,0 +1,275 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+)
+
+const (
+	bootstrapPolicyID = "fleet-server-policy"
+	bootstrapKeyName  = "Default (fleet-server bootstrap)"
+
+	// bootstrapLease is how long an incomplete bootstrap belongs to the server that started it, another server
+	// resumes it after.
+	bootstrapLease = 5 * time.Minute
+)
+
+// ErrBootstrapRefused is returned when the bootstrap is enabled against a cluster whose policies or enrollment keys are
+// managed by Kibana, or while another server bootstraps the cluster.
+var ErrBootstrapRefused = errors.New("bootstrap refused")
+
+// bootstrapEnrollRoles are the role descriptors of an enrollment key, they grant no privileges.
+var bootstrapEnrollRoles = []byte(`{"fleet-apikey-enroll":{"cluster":[],"index":[],"applications":[{"application":"fleet","privileges":["no-privileges"],"resources":["*"]}]}}`)
+
+// bootstrap sets up a cluster without Kibana for a standalone fleet-server. On the first start, a policy with the
+// fleet-server integration and an enrollment key for it are created, the enrollment token is written to out and the
+// bootstrap is recorded as completed so that it never runs again.
+//
+// The bootstrap is recorded as started before any document is created, this record is the lease of the server that
+// creates them. An incomplete bootstrap is resumed by the next start of the same server, or by any server once the
+// lease expired: the documents already created are kept, and an API key recorded without its enrollment key is
+// invalidated and created again.
+//
+// The bootstrap is refused when the cluster has policies or enrollment keys it did not create, or when another server
+// holds the lease.
+func bootstrap(ctx context.Context, bulker bulk.Bulk, cfg *config.Config, server model.ServerMetadata, out io.Writer) error {
+	zlog := zerolog.Ctx(ctx)
+
+	rec, err := dl.ReadBootstrap(ctx, bulker)
+	if err != nil {
+		return fmt.Errorf("failed to read bootstrap: %w", err)
+	}
+	if rec != nil && rec.Completed() {
+		zlog.Info().
+			Str(logger.PolicyID, rec.PolicyID).
+			Str(logger.EnrollAPIKeyID, rec.EnrollmentAPIKeyID).
+			Msg("Cluster already bootstrapped, skipping bootstrap")
+		return nil
+	}
+
+	now := time.Now().UTC()
+	if rec == nil {
+		rec, err = startBootstrap(ctx, bulker, server, now)
+	} else {
+		rec, err = resumeBootstrap(ctx, bulker, rec, server, now)
+	}
+	if err != nil {
+		return err
+	}
+
+	policy, err := bootstrapPolicy(cfg, now)
+	if err != nil {
+		return err
+	}
+	if err := createBootstrapPolicy(ctx, bulker, policy); err != nil {
+		return err
+	}
+	token, rec, err := createBootstrapEnrollmentKey(ctx, bulker, rec)
+	if err != nil {
+		return err
+	}
+
+	done := rec.Bootstrap
+	done.Status = dl.BootstrapCompleted
+	done.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	if _, err := dl.UpdateBootstrap(ctx, bulker, rec, done); err != nil {
+		return bootstrapWriteError("failed to record bootstrap", err)
+	}
+
+	// The token is only shown once, it is not written to the logs.
+	fmt.Fprintf(out, "Fleet Server bootstrap enrollment token: %s\n", token)
+	zlog.Info().
+		Str(logger.PolicyID, bootstrapPolicyID).
+		Str(logger.EnrollAPIKeyID, done.EnrollmentAPIKeyID).
+		Msg("Cluster bootstrapped, the enrollment token is printed to stdout")
+	return nil
+}
+
+// startBootstrap takes the lease of a cluster that was never bootstrapped.
+func startBootstrap(ctx context.Context, bulker bulk.Bulk, server model.ServerMetadata, now time.Time) (*dl.BootstrapRecord, error) {
+	for _, index := range []string{dl.FleetPolicies, dl.FleetEnrollmentAPIKeys} {
+		found, err := dl.HasDocuments(ctx, bulker, index)
+		if err != nil {
+			return nil, fmt.Errorf("failed to search %s: %w", index, err)
+		}
+		if found {
+			return nil, fmt.Errorf("%w: %s has documents managed by Kibana", ErrBootstrapRefused, index)
+		}
+	}
+
+	err := dl.CreateBootstrap(ctx, bulker, model.Bootstrap{
+		PolicyID:  bootstrapPolicyID,
+		Server:    &server,
+		Status:    dl.BootstrapStarted,
+		Timestamp: now.Format(time.RFC3339),
+	})
+	if err != nil {
+		return nil, bootstrapWriteError("failed to record bootstrap", err)
+	}
+	rec, err := dl.ReadBootstrap(ctx, bulker)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bootstrap: %w", err)
+	}
+	if rec == nil {
+		return nil, bootstrapWriteError("failed to record bootstrap", es.ErrElasticVersionConflict)
+	}
+	return rec, nil
+}
+
+// resumeBootstrap takes over the lease of an incomplete bootstrap, if it was started by the same server or the lease
+// expired.
+func resumeBootstrap(ctx context.Context, bulker bulk.Bulk, rec *dl.BootstrapRecord, server model.ServerMetadata, now time.Time) (*dl.BootstrapRecord, error) {
+	var startedBy string
+	if rec.Server != nil {
+		startedBy = rec.Server.ID
+	}
+	updated, err := time.Parse(time.RFC3339, rec.Timestamp)
+	if (server.ID == "" || startedBy != server.ID) && err == nil && now.Sub(updated) < bootstrapLease {
+		return nil, fmt.Errorf("%w: the cluster is being bootstrapped by fleet-server %q since %s", ErrBootstrapRefused, startedBy, rec.Timestamp)
+	}
+
+	zerolog.Ctx(ctx).Info().
+		Str(logger.PolicyID, rec.PolicyID).
+		Str(logger.EnrollAPIKeyID, rec.EnrollmentAPIKeyID).
+		Str("started_by", startedBy).
+		Msg("Resuming incomplete bootstrap")
+	lease := rec.Bootstrap
+	lease.Server = &server
+	lease.Timestamp = now.Format(time.RFC3339)
+	rec, err = dl.UpdateBootstrap(ctx, bulker, rec, lease)
+	if err != nil {
+		return nil, bootstrapWriteError("failed to record bootstrap", err)
+	}
+	return rec, nil
+}
+
+// createBootstrapPolicy creates the bootstrap policy, unless an incomplete bootstrap created it.
+func createBootstrapPolicy(ctx context.Context, bulker bulk.Bulk, policy model.Policy) error {
+	_, err := dl.FindLatestPolicy(ctx, bulker, policy.PolicyID)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, dl.ErrNotFound) {
+		return fmt.Errorf("failed to read bootstrap policy: %w", err)
+	}
+	if _, err := dl.CreatePolicy(ctx, bulker, policy); err != nil {
+		return fmt.Errorf("failed to create bootstrap policy: %w", err)
+	}
+	return nil
+}
+
+// createBootstrapEnrollmentKey creates the enrollment key of the bootstrap policy and returns its token. The API key is
+// recorded in the bootstrap before its enrollment key is created, so that an incomplete bootstrap reuses the
+// enrollment key or invalidates the API key whose token was lost.
+func createBootstrapEnrollmentKey(ctx context.Context, bulker bulk.Bulk, rec *dl.BootstrapRecord) (string, *dl.BootstrapRecord, error) {
+	if id := rec.EnrollmentAPIKeyID; id != "" {
+		keys, err := dl.FindEnrollmentAPIKeys(ctx, bulker, dl.QueryEnrollmentAPIKeyByID, dl.FieldAPIKeyID, id)
+		if err != nil && !errors.Is(err, es.ErrIndexNotFound) {
+			return "", nil, fmt.Errorf("failed to read bootstrap enrollment key: %w", err)
+		}
+		if len(keys) > 0 {
+			return keys[0].APIKey, rec, nil
+		}
+		if err := bulker.APIKeyInvalidate(ctx, id); err != nil {
+			return "", nil, fmt.Errorf("failed to invalidate bootstrap API key %s: %w", id, err)
+		}
+	}
+
+	key, err := bulker.APIKeyCreate(ctx, bootstrapKeyName, "", bootstrapEnrollRoles, map[string]interface{}{
+		"managed_by": "fleet",
+		"managed":    true,
+		"type":       "enroll",
+		"policy_id":  bootstrapPolicyID,
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create bootstrap enrollment API key: %w", err)
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	lease := rec.Bootstrap
+	lease.EnrollmentAPIKeyID = key.ID
+	lease.Timestamp = now
+	rec, err = dl.UpdateBootstrap(ctx, bulker, rec, lease)
+	if err != nil {
+		bulker.APIKeyInvalidateAsync(key.ID)
+		return "", nil, bootstrapWriteError("failed to record bootstrap enrollment API key", err)
+	}
+
+	if _, err := dl.CreateEnrollmentAPIKey(ctx, bulker, model.EnrollmentAPIKey{
+		APIKey:    key.Token(),
+		APIKeyID:  key.ID,
+		Active:    true,
+		CreatedAt: now,
+		Name:      bootstrapKeyName,
+		PolicyID:  bootstrapPolicyID,
+	}); err != nil {
+		return "", nil, fmt.Errorf("failed to create bootstrap enrollment key: %w", err)
+	}
+	return key.Token(), rec, nil
+}
+
+// bootstrapWriteError refuses the bootstrap when another server wrote the bootstrap document in between.
+func bootstrapWriteError(msg string, err error) error {
+	if errors.Is(err, es.ErrElasticVersionConflict) {
+		return fmt.Errorf("%w: the cluster is being bootstrapped by another fleet-server", ErrBootstrapRefused)
+	}
+	return fmt.Errorf("%s: %w", msg, err)
+}
+
+// bootstrapPolicy returns the first revision of the bootstrap policy, it runs the fleet-server integration and sends
+// the data to the Elasticsearch output of the fleet-server.
+func bootstrapPolicy(cfg *config.Config, now time.Time) (model.Policy, error) {
+	esCfg, err := cfg.Output.Elasticsearch.ToESConfig(false)
+	if err != nil {
+		return model.Policy{}, fmt.Errorf("failed to read output hosts: %w", err)
+	}
+	return model.Policy{
+		CoordinatorIdx:     1,
+		DefaultFleetServer: true,
+		PolicyID:           bootstrapPolicyID,
+		RevisionIdx:        1,
+		Timestamp:          now.Format(time.RFC3339),
+		Data: &model.PolicyData{
+			ID:       bootstrapPolicyID,
+			Revision: 1,
+			Inputs: []map[string]interface{}{{
+				"id":         "fleet_server-bootstrap",
+				"name":       "fleet_server-1",
+				"type":       "fleet-server",
+				"revision":   1,
+				"use_output": "default",
+				"data_stream": map[string]interface{}{
+					"namespace": "default",
+				},
+				"meta": map[string]interface{}{
+					"package": map[string]interface{}{
+						"name": "fleet_server",
+					},
+				},
+			}},
+			Outputs: map[string]map[string]interface{}{
+				"default": {
+					"type":  "elasticsearch",
+					"hosts": esCfg.Addresses,
+				},
+			},
+			OutputPermissions: json.RawMessage(`{"default":{"_elastic_agent_checks":{"cluster":["monitor"]}}}`),
+		},
+	}, nil
+}
@@ -0,0 +1,165 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build integration
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/build"
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	"github.com/elastic/fleet-server/v7/internal/pkg/state"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+// lockedBuffer is the stdout of a server running in another goroutine.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func Test_Agent_Bootstrap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = testlog.SetLogger(t).WithContext(ctx)
+
+	cfg, err := config.LoadFile("../testing/fleet-server-testing.yml")
+	require.NoError(t, err)
+	logger.Init(cfg, "fleet-server") //nolint:errcheck // test logging setup
+
+	// The bootstrap runs against a cluster without policies nor enrollment keys.
+	bulker := ftesting.SetupBulk(ctx, t)
+	ftesting.CleanIndex(ctx, t, bulker, dl.FleetPolicies)
+	ftesting.CleanIndex(ctx, t, bulker, dl.FleetEnrollmentAPIKeys)
+	deleteBootstrap := func() {
+		err := bulker.Delete(context.Background(), dl.FleetServers, "fleet-server-bootstrap", bulk.WithRefresh())
+		if err != nil && !errors.Is(err, es.ErrElasticNotFound) && !errors.Is(err, es.ErrIndexNotFound) {
+			t.Errorf("unable to delete the bootstrap document: %v", err)
+		}
+	}
+	deleteBootstrap()
+	t.Cleanup(deleteBootstrap)
+
+	port, err := ftesting.FreePort()
+	require.NoError(t, err)
+	srvcfg := &config.Server{}
+	srvcfg.InitDefaults()
+	srvcfg.Host = config.BindHosts{localhost}
+	srvcfg.Port = port
+	cfg.Inputs[0].Server = *srvcfg
+	cfg.Fleet.Bootstrap.Enabled = true
+
+	srv, err := NewFleet(build.Info{Version: serverVersion}, state.NewLog(), true)
+	require.NoError(t, err)
+	var out lockedBuffer
+	srv.bootstrapOut = &out
+
+	g, gCtx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		return srv.Run(gCtx, cfg)
+	})
+	tsrv := &tserver{cfg: cfg, g: g, srv: srv, bulker: bulker}
+	require.NoError(t, tsrv.waitServerUp(ctx, testWaitServerUp))
+
+	// The printed token enrolls an agent in the bootstrap policy.
+	line := strings.TrimSpace(out.String())
+	require.True(t, strings.HasPrefix(line, "Fleet Server bootstrap enrollment token: "), "unexpected output %q", line)
+	tsrv.enrollKey = strings.TrimPrefix(line, "Fleet Server bootstrap enrollment token: ")
+	agentID, _ := EnrollAgent(t, ctx, tsrv, enrollBody)
+	agent, err := dl.FindAgent(ctx, bulker, dl.QueryAgentByID, dl.FieldID, agentID)
+	require.NoError(t, err)
+	assert.Equal(t, bootstrapPolicyID, agent.PolicyID)
+
+	// The bootstrap never runs again.
+	var again bytes.Buffer
+	require.NoError(t, bootstrap(ctx, bulker, cfg, model.ServerMetadata{ID: "fleet-server-2", Version: serverVersion}, &again))
+	assert.Empty(t, again.String())
+
+	cancel()
+	require.NoError(t, tsrv.waitExit())
+}
+
+func Test_Bootstrap_Concurrent(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	cfg := &config.Config{}
+	cfg.Output.Elasticsearch.InitDefaults()
+
+	bulker := ftesting.SetupBulk(ctx, t)
+	ftesting.CleanIndex(ctx, t, bulker, dl.FleetPolicies)
+	ftesting.CleanIndex(ctx, t, bulker, dl.FleetEnrollmentAPIKeys)
+	deleteBootstrap := func() {
+		err := bulker.Delete(context.Background(), dl.FleetServers, "fleet-server-bootstrap", bulk.WithRefresh())
+		if err != nil && !errors.Is(err, es.ErrElasticNotFound) && !errors.Is(err, es.ErrIndexNotFound) {
+			t.Errorf("unable to delete the bootstrap document: %v", err)
+		}
+	}
+	deleteBootstrap()
+	t.Cleanup(deleteBootstrap)
+
+	// Only one of the servers bootstraps the cluster, the other one creates nothing.
+	var outs [2]bytes.Buffer
+	var errs [2]error
+	var wg sync.WaitGroup
+	for i := range outs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			server := model.ServerMetadata{ID: "fleet-server-" + strconv.Itoa(i), Version: serverVersion}
+			errs[i] = bootstrap(ctx, bulker, cfg, server, &outs[i])
+		}(i)
+	}
+	wg.Wait()
+
+	winner := 0
+	if errs[0] != nil {
+		winner = 1
+	}
+	require.NoError(t, errs[winner])
+	assert.ErrorIs(t, errs[1-winner], ErrBootstrapRefused)
+	assert.NotEmpty(t, outs[winner].String())
+	assert.Empty(t, outs[1-winner].String())
+
+	policies, err := dl.QueryLatestPolicies(ctx, bulker)
+	require.NoError(t, err)
+	assert.Len(t, policies, 1)
+	keys, err := dl.FindEnrollmentAPIKeys(ctx, bulker, dl.QueryEnrollmentAPIKeyByPolicyID, dl.FieldPolicyID, bootstrapPolicyID)
+	require.NoError(t, err)
+	assert.Len(t, keys, 1)
+
+	rec, err := dl.ReadBootstrap(ctx, bulker)
+	require.NoError(t, err)
+	require.NotNil(t, rec)
+	assert.True(t, rec.Completed())
+	assert.Equal(t, keys[0].APIKeyID, rec.EnrollmentAPIKeyID)
+}
@@ -0,0 +1,259 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+// bootstrapBulk is a fake bulker that keeps the documents written by the bootstrap, the searches return every document
+// of the index. The API keys are mocked.
+type bootstrapBulk struct {
+	*ftesting.MockBulk
+
+	docs     map[string][][]byte
+	seqNo    int64
+	conflict bool
+}
+
+func newBootstrapBulk() *bootstrapBulk {
+	return &bootstrapBulk{MockBulk: ftesting.NewMockBulk(), docs: make(map[string][][]byte)}
+}
+
+func (b *bootstrapBulk) ReadRaw(_ context.Context, index, id string, _ ...bulk.Opt) (*bulk.MgetResponseItem, error) {
+	if index != dl.FleetServers || len(b.docs[index]) == 0 {
+		return nil, es.ErrElasticNotFound
+	}
+	return &bulk.MgetResponseItem{DocumentID: id, SeqNo: b.seqNo, PrimaryTerm: 1, Found: true, Source: b.docs[index][0]}, nil
+}
+
+func (b *bootstrapBulk) Create(_ context.Context, index, id string, body []byte, _ ...bulk.Opt) (string, error) {
+	if index == dl.FleetServers && (b.conflict || len(b.docs[index]) > 0) {
+		return "", es.ErrElasticVersionConflict
+	}
+	b.docs[index] = append(b.docs[index], body)
+	b.seqNo++
+	return id, nil
+}
+
+func (b *bootstrapBulk) Index(_ context.Context, index, id string, body []byte, _ ...bulk.Opt) (string, error) {
+	if b.conflict {
+		return "", es.ErrElasticVersionConflict
+	}
+	b.docs[index] = [][]byte{body}
+	b.seqNo++
+	return id, nil
+}
+
+func (b *bootstrapBulk) Search(_ context.Context, index string, _ []byte, _ ...bulk.Opt) (*es.ResultT, error) {
+	res := &es.ResultT{}
+	for i, doc := range b.docs[index] {
+		res.Hits = append(res.Hits, es.HitT{ID: index + "-" + string(rune('a'+i)), Source: doc})
+	}
+	return res, nil
+}
+
+func (b *bootstrapBulk) put(t *testing.T, index string, doc interface{}) {
+	t.Helper()
+	data, err := json.Marshal(doc)
+	require.NoError(t, err)
+	b.docs[index] = append(b.docs[index], data)
+	b.seqNo++
+}
+
+func (b *bootstrapBulk) bootstrapDoc(t *testing.T) model.Bootstrap {
+	t.Helper()
+	require.Len(t, b.docs[dl.FleetServers], 1)
+	var doc model.Bootstrap
+	require.NoError(t, json.Unmarshal(b.docs[dl.FleetServers][0], &doc))
+	return doc
+}
+
+func TestBootstrap(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	cfg := &config.Config{}
+	cfg.Output.Elasticsearch.InitDefaults()
+	server := model.ServerMetadata{ID: "server-1", Version: "8.16.0"}
+	key := &bulk.APIKey{ID: "key-1", Key: "secret"}
+	enrollMeta := mock.MatchedBy(func(meta map[string]interface{}) bool {
+		return meta["type"] == "enroll" && meta["policy_id"] == bootstrapPolicyID
+	})
+
+	t.Run("first start", func(t *testing.T) {
+		fb := newBootstrapBulk()
+		fb.On("APIKeyCreate", mock.Anything, mock.Anything, "", mock.Anything, enrollMeta).Return(key, nil).Once()
+
+		var out bytes.Buffer
+		require.NoError(t, bootstrap(ctx, fb, cfg, server, &out))
+		fb.AssertExpectations(t)
+
+		require.Len(t, fb.docs[dl.FleetPolicies], 1)
+		var policy model.Policy
+		require.NoError(t, json.Unmarshal(fb.docs[dl.FleetPolicies][0], &policy))
+		assert.Equal(t, bootstrapPolicyID, policy.PolicyID)
+		assert.True(t, policy.DefaultFleetServer)
+		require.NotNil(t, policy.Data)
+		require.Len(t, policy.Data.Inputs, 1)
+		assert.Equal(t, "fleet-server", policy.Data.Inputs[0]["type"])
+		assert.Equal(t, []interface{}{"http://localhost:9200"}, policy.Data.Outputs["default"]["hosts"])
+
+		require.Len(t, fb.docs[dl.FleetEnrollmentAPIKeys], 1)
+		var enrollKey model.EnrollmentAPIKey
+		require.NoError(t, json.Unmarshal(fb.docs[dl.FleetEnrollmentAPIKeys][0], &enrollKey))
+		assert.Equal(t, key.Token(), enrollKey.APIKey)
+		assert.Equal(t, key.ID, enrollKey.APIKeyID)
+		assert.Equal(t, bootstrapPolicyID, enrollKey.PolicyID)
+		assert.True(t, enrollKey.Active)
+
+		doc := fb.bootstrapDoc(t)
+		assert.Equal(t, dl.BootstrapCompleted, doc.Status)
+		assert.Equal(t, bootstrapPolicyID, doc.PolicyID)
+		assert.Equal(t, key.ID, doc.EnrollmentAPIKeyID)
+		assert.Equal(t, server, *doc.Server)
+
+		assert.Equal(t, "Fleet Server bootstrap enrollment token: "+key.Token()+"\n", out.String())
+	})
+
+	t.Run("already bootstrapped", func(t *testing.T) {
+		for _, status := range []string{dl.BootstrapCompleted, ""} {
+			fb := newBootstrapBulk()
+			fb.put(t, dl.FleetServers, model.Bootstrap{EnrollmentAPIKeyID: key.ID, PolicyID: bootstrapPolicyID, Server: &server, Status: status})
+
+			var out bytes.Buffer
+			require.NoError(t, bootstrap(ctx, fb, cfg, server, &out))
+			fb.AssertNotCalled(t, "APIKeyCreate", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+			assert.Empty(t, fb.docs[dl.FleetPolicies])
+			assert.Empty(t, out.String())
+		}
+	})
+
+	t.Run("kibana managed cluster", func(t *testing.T) {
+		fb := newBootstrapBulk()
+		fb.put(t, dl.FleetEnrollmentAPIKeys, model.EnrollmentAPIKey{APIKeyID: "kibana"})
+
+		var out bytes.Buffer
+		err := bootstrap(ctx, fb, cfg, server, &out)
+		assert.ErrorIs(t, err, ErrBootstrapRefused)
+		assert.ErrorContains(t, err, dl.FleetEnrollmentAPIKeys)
+		assert.Empty(t, fb.docs[dl.FleetServers])
+		assert.Empty(t, fb.docs[dl.FleetPolicies])
+		assert.Empty(t, out.String())
+	})
+
+	t.Run("concurrent bootstrap", func(t *testing.T) {
+		fb := newBootstrapBulk()
+		fb.conflict = true
+
+		var out bytes.Buffer
+		err := bootstrap(ctx, fb, cfg, server, &out)
+		assert.ErrorIs(t, err, ErrBootstrapRefused)
+		assert.Empty(t, fb.docs[dl.FleetPolicies], "expected the loser not to create a policy")
+		fb.AssertNotCalled(t, "APIKeyCreate", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+		assert.Empty(t, out.String())
+	})
+
+	t.Run("bootstrap started by another server", func(t *testing.T) {
+		fb := newBootstrapBulk()
+		fb.put(t, dl.FleetServers, model.Bootstrap{
+			PolicyID:  bootstrapPolicyID,
+			Server:    &model.ServerMetadata{ID: "server-2"},
+			Status:    dl.BootstrapStarted,
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+		})
+
+		var out bytes.Buffer
+		err := bootstrap(ctx, fb, cfg, server, &out)
+		assert.ErrorIs(t, err, ErrBootstrapRefused)
+		assert.ErrorContains(t, err, "server-2")
+		assert.Empty(t, fb.docs[dl.FleetPolicies])
+		fb.AssertNotCalled(t, "APIKeyCreate", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+		assert.Equal(t, "server-2", fb.bootstrapDoc(t).Server.ID)
+	})
+
+	t.Run("retry after failed API key creation", func(t *testing.T) {
+		fb := newBootstrapBulk()
+		fb.On("APIKeyCreate", mock.Anything, mock.Anything, "", mock.Anything, enrollMeta).Return((*bulk.APIKey)(nil), errors.New("security exception")).Once()
+
+		var out bytes.Buffer
+		err := bootstrap(ctx, fb, cfg, server, &out)
+		require.ErrorContains(t, err, "security exception")
+		assert.Len(t, fb.docs[dl.FleetPolicies], 1)
+		assert.Equal(t, dl.BootstrapStarted, fb.bootstrapDoc(t).Status)
+		assert.Empty(t, out.String())
+
+		// The next start resumes the bootstrap, the policy is not created again.
+		fb.On("APIKeyCreate", mock.Anything, mock.Anything, "", mock.Anything, enrollMeta).Return(key, nil).Once()
+		require.NoError(t, bootstrap(ctx, fb, cfg, server, &out))
+		fb.AssertExpectations(t)
+		assert.Len(t, fb.docs[dl.FleetPolicies], 1)
+		assert.Len(t, fb.docs[dl.FleetEnrollmentAPIKeys], 1)
+		doc := fb.bootstrapDoc(t)
+		assert.Equal(t, dl.BootstrapCompleted, doc.Status)
+		assert.Equal(t, key.ID, doc.EnrollmentAPIKeyID)
+		assert.Equal(t, "Fleet Server bootstrap enrollment token: "+key.Token()+"\n", out.String())
+	})
+
+	t.Run("resume after lost enrollment key", func(t *testing.T) {
+		fb := newBootstrapBulk()
+		fb.put(t, dl.FleetPolicies, model.Policy{PolicyID: bootstrapPolicyID, RevisionIdx: 1})
+		fb.put(t, dl.FleetServers, model.Bootstrap{
+			EnrollmentAPIKeyID: "lost-key",
+			PolicyID:           bootstrapPolicyID,
+			Server:             &model.ServerMetadata{ID: "server-2"},
+			Status:             dl.BootstrapStarted,
+			Timestamp:          time.Now().Add(-bootstrapLease - time.Minute).UTC().Format(time.RFC3339),
+		})
+		fb.On("APIKeyInvalidate", mock.Anything, []string{"lost-key"}).Return(nil).Once()
+		fb.On("APIKeyCreate", mock.Anything, mock.Anything, "", mock.Anything, enrollMeta).Return(key, nil).Once()
+
+		var out bytes.Buffer
+		require.NoError(t, bootstrap(ctx, fb, cfg, server, &out))
+		fb.AssertExpectations(t)
+		assert.Len(t, fb.docs[dl.FleetPolicies], 1)
+		assert.Len(t, fb.docs[dl.FleetEnrollmentAPIKeys], 1)
+		doc := fb.bootstrapDoc(t)
+		assert.Equal(t, dl.BootstrapCompleted, doc.Status)
+		assert.Equal(t, key.ID, doc.EnrollmentAPIKeyID)
+		assert.Equal(t, server, *doc.Server)
+		assert.Equal(t, "Fleet Server bootstrap enrollment token: "+key.Token()+"\n", out.String())
+	})
+
+	t.Run("resume after created enrollment key", func(t *testing.T) {
+		fb := newBootstrapBulk()
+		fb.put(t, dl.FleetPolicies, model.Policy{PolicyID: bootstrapPolicyID, RevisionIdx: 1})
+		fb.put(t, dl.FleetEnrollmentAPIKeys, model.EnrollmentAPIKey{APIKey: key.Token(), APIKeyID: key.ID, Active: true, PolicyID: bootstrapPolicyID})
+		fb.put(t, dl.FleetServers, model.Bootstrap{
+			EnrollmentAPIKeyID: key.ID,
+			PolicyID:           bootstrapPolicyID,
+			Server:             &server,
+			Status:             dl.BootstrapStarted,
+			Timestamp:          time.Now().UTC().Format(time.RFC3339),
+		})
+
+		var out bytes.Buffer
+		require.NoError(t, bootstrap(ctx, fb, cfg, server, &out))
+		fb.AssertNotCalled(t, "APIKeyCreate", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+		assert.Len(t, fb.docs[dl.FleetEnrollmentAPIKeys], 1)
+		assert.Equal(t, dl.BootstrapCompleted, fb.bootstrapDoc(t).Status)
+		assert.Equal(t, "Fleet Server bootstrap enrollment token: "+key.Token()+"\n", out.String())
+	})
+}
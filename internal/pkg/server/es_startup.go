@@ -0,0 +1,79 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/elastic/elastic-agent-client/v7/pkg/client"
+	"github.com/rs/zerolog"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/sleep"
+	"github.com/elastic/fleet-server/v7/internal/pkg/state"
+)
+
+const (
+	esStartupRetry    = time.Second
+	esStartupMaxRetry = 30 * time.Second
+)
+
+// waitForElasticsearch calls ping until Elasticsearch answers, so that fleet-server does not fail when it starts
+// before Elasticsearch. The ping is retried with a growing delay, starting at retry. The state is reported starting
+// after the first failure and degraded after the next ones, until Elasticsearch answers.
+//
+// It fails without retrying when Elasticsearch rejects the credentials, and when Elasticsearch is still unreachable
+// after timeout. A timeout of 0 retries until the context is cancelled.
+func waitForElasticsearch(ctx context.Context, ping func(context.Context) error, reporter state.Reporter, timeout, retry time.Duration) error {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for attempt := 1; ; attempt++ {
+		err := ping(ctx)
+		if err == nil {
+			if attempt > 1 {
+				zerolog.Ctx(ctx).Info().Int("attempts", attempt).Msg("Elasticsearch is reachable")
+				reporter.UpdateState(client.UnitStateStarting, "Starting", nil) //nolint:errcheck // unclear on what should we do if updating the status fails?
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if isESCredentialsError(err) {
+			return fmt.Errorf("elasticsearch rejected the credentials: %w", err)
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return fmt.Errorf("elasticsearch is unreachable after %s: %w", timeout, err)
+		}
+
+		zerolog.Ctx(ctx).Warn().Err(err).Int("attempt", attempt).Dur("retry_in", retry).Msg("Elasticsearch is unreachable")
+		status := client.UnitStateDegraded
+		if attempt == 1 {
+			status = client.UnitStateStarting
+		}
+		reporter.UpdateState(status, fmt.Sprintf("Waiting for Elasticsearch: %v", err), nil) //nolint:errcheck // unclear on what should we do if updating the status fails?
+
+		wait := retry
+		if !deadline.IsZero() {
+			wait = min(wait, time.Until(deadline))
+		}
+		if err := sleep.WithContext(ctx, wait); err != nil {
+			return err
+		}
+		retry = min(retry*2, esStartupMaxRetry)
+	}
+}
+
+// isESCredentialsError returns true if Elasticsearch answered, and rejected the credentials of fleet-server.
+func isESCredentialsError(err error) bool {
+	var esErr *es.ErrElastic
+	return errors.As(err, &esErr) && (esErr.Status == http.StatusUnauthorized || esErr.Status == http.StatusForbidden)
+}
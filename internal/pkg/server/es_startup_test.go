@@ -0,0 +1,125 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elastic/elastic-agent-client/v7/pkg/client"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+// flakyTransport fails the first requests as if Elasticsearch was not started, then answers with status.
+type flakyTransport struct {
+	failures int
+	status   int
+	calls    int
+}
+
+func (t *flakyTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	t.calls++
+	if t.calls <= t.failures {
+		return nil, errors.New("dial tcp 127.0.0.1:9200: connect: connection refused")
+	}
+	body := `{"version":{"number":"8.16.0"}}`
+	if t.status != http.StatusOK {
+		body = `{"error":{"type":"security_exception","reason":"unable to authenticate"},"status":401}`
+	}
+	return &http.Response{
+		StatusCode: t.status,
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Header: http.Header{
+			"X-Elastic-Product": []string{"Elasticsearch"},
+			"Content-Type":      []string{"application/json"},
+		},
+	}, nil
+}
+
+type stateUpdate struct {
+	state client.UnitState
+	msg   string
+}
+
+type recordReporter []stateUpdate
+
+func (r *recordReporter) UpdateState(state client.UnitState, msg string, _ map[string]interface{}) error {
+	*r = append(*r, stateUpdate{state, msg})
+	return nil
+}
+
+func esPing(t *testing.T, tr http.RoundTripper) func(context.Context) error {
+	t.Helper()
+	cli, err := elasticsearch.NewClient(elasticsearch.Config{Transport: tr, DisableRetry: true})
+	require.NoError(t, err)
+	return func(ctx context.Context) error {
+		_, err := es.FetchESVersion(ctx, cli)
+		return err
+	}
+}
+
+func TestWaitForElasticsearch(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	const refused = "Waiting for Elasticsearch: dial tcp 127.0.0.1:9200: connect: connection refused"
+
+	t.Run("retries until reachable", func(t *testing.T) {
+		tr := &flakyTransport{failures: 3, status: http.StatusOK}
+		var reporter recordReporter
+		require.NoError(t, waitForElasticsearch(ctx, esPing(t, tr), &reporter, 0, time.Millisecond))
+		assert.Equal(t, 4, tr.calls)
+		assert.Equal(t, recordReporter{
+			{client.UnitStateStarting, refused},
+			{client.UnitStateDegraded, refused},
+			{client.UnitStateDegraded, refused},
+			{client.UnitStateStarting, "Starting"},
+		}, reporter)
+	})
+
+	t.Run("reachable", func(t *testing.T) {
+		tr := &flakyTransport{status: http.StatusOK}
+		var reporter recordReporter
+		require.NoError(t, waitForElasticsearch(ctx, esPing(t, tr), &reporter, 0, time.Millisecond))
+		assert.Equal(t, 1, tr.calls)
+		assert.Empty(t, reporter)
+	})
+
+	t.Run("invalid credentials", func(t *testing.T) {
+		tr := &flakyTransport{failures: 1, status: http.StatusUnauthorized}
+		var reporter recordReporter
+		err := waitForElasticsearch(ctx, esPing(t, tr), &reporter, 0, time.Millisecond)
+		assert.ErrorContains(t, err, "elasticsearch rejected the credentials")
+		assert.Equal(t, 2, tr.calls)
+	})
+
+	t.Run("startup timeout", func(t *testing.T) {
+		tr := &flakyTransport{failures: 1 << 30, status: http.StatusOK}
+		var reporter recordReporter
+		err := waitForElasticsearch(ctx, esPing(t, tr), &reporter, 50*time.Millisecond, time.Millisecond)
+		assert.ErrorContains(t, err, "elasticsearch is unreachable after 50ms")
+		assert.Greater(t, tr.calls, 1)
+	})
+
+	t.Run("stops when cancelled", func(t *testing.T) {
+		cctx, cancel := context.WithCancel(ctx)
+		tr := &flakyTransport{failures: 1 << 30, status: http.StatusOK}
+		var reporter recordReporter
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+		}()
+		err := waitForElasticsearch(cctx, esPing(t, tr), &reporter, 0, time.Hour)
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
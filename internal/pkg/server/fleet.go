@@ -8,6 +8,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"reflect"
 	"runtime/debug"
@@ -28,10 +29,13 @@ import (
 	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
 	"github.com/elastic/fleet-server/v7/internal/pkg/es"
 	"github.com/elastic/fleet-server/v7/internal/pkg/gc"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger/errlog"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
 	"github.com/elastic/fleet-server/v7/internal/pkg/monitor"
 	"github.com/elastic/fleet-server/v7/internal/pkg/policy"
 	"github.com/elastic/fleet-server/v7/internal/pkg/profile"
 	"github.com/elastic/fleet-server/v7/internal/pkg/scheduler"
+	"github.com/elastic/fleet-server/v7/internal/pkg/signing"
 	"github.com/elastic/fleet-server/v7/internal/pkg/state"
 	"github.com/elastic/fleet-server/v7/internal/pkg/ver"
 
@@ -55,6 +59,25 @@ type Fleet struct {
 	// Used for diagnostics reporting
 	l   sync.RWMutex
 	cfg *config.Config
+	// API servers, action dispatcher and status handler of the running configuration, used to reload limits.
+	srvs []limitsReloader
+	// st is the status handler of the running configuration, it reports the reloaded cache settings.
+	st *api.StatusT
+	// et is the enroller of the running configuration, it applies the reloaded enroll concurrency.
+	et *api.EnrollerT
+
+	// autoLimitsCh receives the number of active agents when it moves to a different limits tier.
+	autoLimitsCh chan int
+	// activeAgents is the last number of active agents received on autoLimitsCh, -1 until one is received.
+	activeAgents int
+
+	// bootstrapOut receives the enrollment token created by the bootstrap.
+	bootstrapOut io.Writer
+}
+
+// limitsReloader is implemented by the API servers and the action dispatcher to apply limits without a restart.
+type limitsReloader interface {
+	ReloadLimits(cfg *config.ServerLimits)
 }
 
 // NewFleet creates the actual fleet server service.
@@ -70,6 +93,10 @@ func NewFleet(bi build.Info, reporter state.Reporter, standAlone bool) (*Fleet,
 		verCon:     verCon,
 		cfgCh:      make(chan *config.Config, 1),
 		reporter:   reporter,
+
+		autoLimitsCh: make(chan int, 1),
+		activeAgents: -1,
+		bootstrapOut: os.Stdout,
 	}, nil
 }
 
@@ -86,7 +113,7 @@ func (f *Fleet) GetConfig() *config.Config {
 // Run runs the fleet server
 func (f *Fleet) Run(ctx context.Context, initCfg *config.Config) error {
 	log := zerolog.Ctx(ctx)
-	err := initCfg.LoadServerLimits()
+	err := f.loadServerLimits(initCfg)
 	if err != nil {
 		return fmt.Errorf("encountered error while loading server limits: %w", err)
 	}
@@ -115,6 +142,9 @@ func (f *Fleet) Run(ctx context.Context, initCfg *config.Config) error {
 			err := g.Wait()
 			if err != nil {
 				log.Error().Err(err).Msg("error encountered while stopping server")
+				if !errors.Is(err, context.Canceled) {
+					errlog.Report(errlog.SubsystemCoordinator, "stop", err, nil)
+				}
 			}
 		}
 	}
@@ -150,10 +180,14 @@ LOOP:
 			f.reporter.UpdateState(client.UnitStateStarting, "Starting", nil) //nolint:errcheck // unclear on what should we do if updating the status fails?
 		}
 
-		err := newCfg.LoadServerLimits()
+		err := f.loadServerLimits(newCfg)
 		if err != nil {
 			return fmt.Errorf("encountered error while loading server limits: %w", err)
 		}
+		err = newCfg.LoadServiceTokens()
+		if err != nil {
+			return fmt.Errorf("encountered error while loading service tokens: %w", err)
+		}
 
 		// Create or recreate cache
 		if configCacheChanged(curCfg, newCfg) {
@@ -164,6 +198,7 @@ LOOP:
 			if err != nil {
 				return err
 			}
+			f.reloadCache(cacheCfg)
 		}
 
 		// Start or restart profiler
@@ -197,6 +232,9 @@ LOOP:
 			srvEg, srvCancel = start(ctx, func(ctx context.Context, cfg *config.Config) error {
 				return f.runServer(ctx, cfg)
 			}, newCfg, ech)
+		} else if configChangedLimits(curCfg, newCfg) {
+			log.Info().Msg("reloading server limits on configuration change")
+			f.reloadLimits(&newCfg.Inputs[0].Server)
 		}
 
 		curCfg = newCfg
@@ -207,9 +245,15 @@ LOOP:
 		select {
 		case newCfg = <-f.cfgCh:
 			log.Info().Msg("Server configuration update")
+		case agents := <-f.autoLimitsCh:
+			// Load the limits of the new tier on a copy, so the running configuration is not modified.
+			f.activeAgents = agents
+			newCfg = curCfg.Copy()
+			log.Info().Int("active_agents", agents).Msg("Reconfigure limits for the number of active agents")
 		case err := <-ech:
 			f.reporter.UpdateState(client.UnitStateFailed, fmt.Sprintf("Error - %s", err), nil) //nolint:errcheck // unclear on what should we do if updating the status fails?
 			log.Error().Err(err).Msg("Fleet Server failed")
+			errlog.Report(errlog.SubsystemCoordinator, "run", err, nil)
 			return err
 		case <-ctx.Done():
 			f.reporter.UpdateState(client.UnitStateStopping, "Stopping", nil) //nolint:errcheck // unclear on what should we do if updating the status fails?
@@ -262,11 +306,13 @@ func configChangedServer(log zerolog.Logger, curCfg, newCfg *config.Config) bool
 		zlog.Info().
 			Interface("old", curCfg.Redact()).
 			Msg("fleet configuration has changed")
-	case !reflect.DeepEqual(curCfg.Output, newCfg.Output):
+	// The connection pool settings of a limits tier are not compared, a tier change must not restart the server.
+	// The pool of the new tier is used the next time the server is started.
+	case !reflect.DeepEqual(curCfg.CopyOutputNoLimits(), newCfg.CopyOutputNoLimits()):
 		zlog.Info().
 			Interface("old", curCfg.Redact()).
 			Msg("output configuration has changed")
-	case !reflect.DeepEqual(curCfg.Inputs[0].Server, newCfg.Inputs[0].Server):
+	case !reflect.DeepEqual(curCfg.Inputs[0].Server.CopyNoReloadableLimits(), newCfg.Inputs[0].Server.CopyNoReloadableLimits()):
 		zlog.Info().
 			Interface("old", curCfg.Redact()).
 			Msg("server configuration has changed")
@@ -277,6 +323,45 @@ func configChangedServer(log zerolog.Logger, curCfg, newCfg *config.Config) bool
 	return changed
 }
 
+// configChangedLimits returns true if the limits that can be applied to a running server have changed.
+func configChangedLimits(curCfg, newCfg *config.Config) bool {
+	if curCfg == nil {
+		return false
+	}
+	return !reflect.DeepEqual(curCfg.Inputs[0].Server.Limits, newCfg.Inputs[0].Server.Limits) ||
+		curCfg.Inputs[0].Server.Enroll.MaxConcurrency != newCfg.Inputs[0].Server.Enroll.MaxConcurrency
+}
+
+// loadServerLimits loads the limits of cfg.
+// When fleet.agent.limits.auto is enabled and the active agents were counted, the tier for the active agents is used.
+func (f *Fleet) loadServerLimits(cfg *config.Config) error {
+	if !cfg.Fleet.Agent.Limits.Auto || f.activeAgents < 0 {
+		return cfg.LoadServerLimits()
+	}
+	return cfg.LoadServerLimitsForAgents(f.activeAgents)
+}
+
+// reloadCache reports the cache settings in the status responses of the running configuration.
+func (f *Fleet) reloadCache(cfg config.Cache) {
+	f.l.RLock()
+	defer f.l.RUnlock()
+	if f.st != nil {
+		f.st.ReloadCache(cfg)
+	}
+}
+
+// reloadLimits applies the limits to all running API servers and the enroll concurrency to the enroller.
+func (f *Fleet) reloadLimits(cfg *config.Server) {
+	f.l.RLock()
+	defer f.l.RUnlock()
+	for _, srv := range f.srvs {
+		srv.ReloadLimits(&cfg.Limits)
+	}
+	if f.et != nil {
+		f.et.ReloadEnroll(&cfg.Enroll)
+	}
+}
+
 func safeWait(g *errgroup.Group, to time.Duration) error {
 	var err error
 	waitCh := make(chan error)
@@ -337,7 +422,7 @@ func initRuntime(cfg *config.Config) {
 
 }
 
-func (f *Fleet) initBulker(ctx context.Context, tracer *apm.Tracer, cfg *config.Config) (*bulk.Bulker, error) {
+func (f *Fleet) initBulker(ctx context.Context, tracer *apm.Tracer, cfg *config.Config, esHealth *state.ESHealth) (*bulk.Bulker, error) {
 	es, err := es.NewClient(ctx, cfg, false, elasticsearchOptions(
 		cfg.Inputs[0].Server.Instrumentation.Enabled, f.bi,
 	)...)
@@ -346,11 +431,34 @@ func (f *Fleet) initBulker(ctx context.Context, tracer *apm.Tracer, cfg *config.
 	}
 
 	bulkOpts := bulk.BulkOptsFromCfg(cfg)
-	bulkOpts = append(bulkOpts, bulk.WithBi(f.bi))
+	bulkOpts = append(bulkOpts, bulk.WithBi(f.bi), bulk.WithFlushObserver(esHealth.Observe))
 	blk := bulk.NewBulker(es, tracer, bulkOpts...)
 	return blk, nil
 }
 
+// initMonitoringBulker creates the bulker of the monitoring output, it returns nil if there is none.
+// The bulker has its own queues and retry policy, so that it is isolated from the primary output.
+func (f *Fleet) initMonitoringBulker(ctx context.Context, tracer *apm.Tracer, cfg *config.Config) (*bulk.Bulker, error) {
+	if cfg.Output.Monitoring == nil {
+		return nil, nil
+	}
+	output := &cfg.Output.Monitoring.Elasticsearch
+	es, err := es.NewOutputClient(ctx, output, false, elasticsearchOptions(
+		cfg.Inputs[0].Server.Instrumentation.Enabled, f.bi,
+	)...)
+	if err != nil {
+		return nil, err
+	}
+
+	bulkOpts := bulk.BulkOptsFromCfg(cfg)
+	bulkOpts = append(bulkOpts,
+		bulk.WithBulkRetry(output.BulkRetry),
+		bulk.WithAPIKeyMaxRequestSize(output.MaxContentLength),
+		bulk.WithBi(f.bi),
+	)
+	return bulk.NewBulker(es, tracer, bulkOpts...), nil
+}
+
 func (f *Fleet) runServer(ctx context.Context, cfg *config.Config) (err error) {
 	initRuntime(cfg)
 
@@ -377,8 +485,11 @@ func (f *Fleet) runServer(ctx context.Context, cfg *config.Config) (err error) {
 	bulkCtx, bulkCancel := context.WithCancel(context.Background())
 	defer bulkCancel()
 
+	// The health of the requests to the primary output degrades the reported state.
+	esHealth := state.NewESHealth(cfg.Inputs[0].Server.HealthCheck)
+
 	// Create the bulker subsystem
-	bulker, err := f.initBulker(bulkCtx, tracer, cfg)
+	bulker, err := f.initBulker(bulkCtx, tracer, cfg, esHealth)
 	if err != nil {
 		return err
 	}
@@ -396,6 +507,19 @@ func (f *Fleet) runServer(ctx context.Context, cfg *config.Config) (err error) {
 		errCh <- runFunc()
 	}()
 
+	// The monitoring output is optional and best effort, its bulker and mirror run with the
+	// orphaned context of the bulker, and their failures never tear down the server.
+	var mirror *bulk.Mirror
+	monitoringBulker, err := f.initMonitoringBulker(bulkCtx, tracer, cfg)
+	if err != nil {
+		return err
+	}
+	if monitoringBulker != nil {
+		mirror = bulk.NewMirror(monitoringBulker, 0)
+		go loggedRunFunc(bulkCtx, "Monitoring bulker", monitoringBulker.Run)() //nolint:errcheck // logged by loggedRunFunc
+		go loggedRunFunc(bulkCtx, "Monitoring mirror", mirror.Run)()           //nolint:errcheck // logged by loggedRunFunc
+	}
+
 	// Wrap context with an error group context to manage the lifecycle
 	// of the subsystems.  An error from any subsystem, or if the
 	// parent context is cancelled, will cancel the group.
@@ -425,16 +549,25 @@ func (f *Fleet) runServer(ctx context.Context, cfg *config.Config) (err error) {
 		}()
 	}
 
-	if err = f.runSubsystems(ctx, cfg, g, bulker, tracer); err != nil {
+	if err = f.runSubsystems(ctx, cfg, g, bulker, mirror, tracer, esHealth); err != nil {
 		return err
 	}
 
 	return g.Wait()
 }
 
-func (f *Fleet) runSubsystems(ctx context.Context, cfg *config.Config, g *errgroup.Group, bulker bulk.Bulk, tracer *apm.Tracer) (err error) {
+func (f *Fleet) runSubsystems(ctx context.Context, cfg *config.Config, g *errgroup.Group, bulker bulk.Bulk, mirror *bulk.Mirror, tracer *apm.Tracer, esHealth *state.ESHealth) (err error) {
 	esCli := bulker.Client()
 
+	// Nothing is served before Elasticsearch is reachable, it may start after fleet-server.
+	err = waitForElasticsearch(ctx, func(ctx context.Context) error {
+		_, err := es.FetchESVersion(ctx, esCli)
+		return err
+	}, f.reporter, cfg.Output.Elasticsearch.StartupTimeout, esStartupRetry)
+	if err != nil {
+		return err
+	}
+
 	// Version check is not performed in standalone mode because it is expected that
 	// standalone Fleet Server may be running with older versions of Elasticsearch.
 	if !f.standAlone {
@@ -461,9 +594,51 @@ func (f *Fleet) runSubsystems(ctx context.Context, cfg *config.Config, g *errgro
 		}
 	}
 
+	// The bootstrap runs before anything is served, so that the agents can enroll with the printed token.
+	if cfg.Fleet.Bootstrap.Enabled {
+		if !f.standAlone {
+			zerolog.Ctx(ctx).Warn().Msg("Ignoring fleet.bootstrap.enabled, it is only supported by a standalone Fleet Server")
+		} else if err = bootstrap(ctx, bulker, cfg, model.ServerMetadata{
+			ID:      cfg.Fleet.Agent.ID,
+			Version: f.bi.Version,
+		}, f.bootstrapOut); err != nil {
+			return fmt.Errorf("failed to bootstrap: %w", err)
+		}
+	}
+
+	// The index migrations run in both modes, a standalone fleet-server may not have a Kibana to set up the indices.
+	// They run in the background, a failure degrades the server until they are applied.
+	g.Go(loggedRunFunc(ctx, "Index migrations", func(ctx context.Context) error {
+		return runIndexMigrations(ctx, func(ctx context.Context) error {
+			return dl.MigrateIndices(ctx, bulker, model.ServerMetadata{
+				ID:      cfg.Fleet.Agent.ID,
+				Version: f.bi.Version,
+			})
+		}, esHealth, time.Second)
+	}))
+
+	// The bulk checkin is created before the GC, which judges the inactive agents with the checkins it has not written yet.
+	bc := checkin.NewBulk(bulker,
+		checkin.WithFlushMaxPendingBytes(cfg.Inputs[0].Server.Bulk.Checkin.FlushMaxPendingBytes),
+		checkin.WithStatusWriteInterval(cfg.Inputs[0].Server.Bulk.Checkin.StatusWriteInterval),
+		checkin.WithMirror(mirror),
+		checkin.WithSpool(cfg.Inputs[0].Server.Bulk.Checkin.SpoolPath, cfg.Inputs[0].Server.Bulk.Checkin.SpoolMaxSize),
+	)
+
 	// Run scheduler for periodic GC/cleanup
 	gcCfg := cfg.Inputs[0].Server.GC
-	sched, err := scheduler.New(gc.Schedules(bulker, gcCfg.ScheduleInterval, gcCfg.CleanupAfterExpiredInterval))
+	sched, err := scheduler.New(gc.Schedules(bulker, model.ServerMetadata{
+		ID:      cfg.Fleet.Agent.ID,
+		Version: f.bi.Version,
+	}, gcCfg.ScheduleInterval, gcCfg.CleanupAfterExpiredInterval, gcCfg.SweepAfterExpired, gcCfg.OutputKeyGrace, api.InvalidateAPIKeys, gc.InactiveAgents{
+		InactivityTimeout: cfg.Fleet.Agent.InactivityTimeout,
+		CleanupAfter:      cfg.Fleet.Agent.CleanupAfter,
+		UnenrollTimeout:   cfg.Fleet.Agent.CleanupUnenrollTimeout,
+		Delete:            cfg.Fleet.Agent.CleanupDelete,
+		DryRun:            cfg.Fleet.Agent.CleanupDryRun,
+		Concurrency:       cfg.Fleet.Agent.CleanupConcurrency,
+		LastSeen:          bc.LastSeen,
+	}))
 	if err != nil {
 		return fmt.Errorf("failed to create elasticsearch GC: %w", err)
 	}
@@ -477,28 +652,61 @@ func (f *Fleet) runSubsystems(ctx context.Context, cfg *config.Config, g *errgro
 		return err
 	}
 
+	// The index monitors resume from their stored checkpoints after a restart.
+	var monitorOpts []monitor.Option
+	if maxReplay := cfg.Inputs[0].Monitor.ReplayMaxDocs; maxReplay > 0 {
+		checkpoints := dl.NewMonitorCheckpoints(bulker, model.ServerMetadata{
+			ID:      cfg.Fleet.Agent.ID,
+			Version: f.bi.Version,
+		})
+		monitorOpts = []monitor.Option{monitor.WithCheckpointStore(checkpoints, maxReplay)}
+	}
+
 	// Policy index monitor
-	pim, err := monitor.New(dl.FleetPolicies, esCli, monCli,
+	pim, err := monitor.New(dl.FleetPolicies, esCli, monCli, append(monitorOpts,
 		monitor.WithFetchSize(cfg.Inputs[0].Monitor.FetchSize),
 		monitor.WithPollTimeout(cfg.Inputs[0].Monitor.PollTimeout),
 		monitor.WithAPMTracer(tracer),
 		monitor.WithDebounceTime(cfg.Inputs[0].Monitor.PolicyDebounceTime),
-	)
+		monitor.WithHealthObserver(esHealth.Observe),
+	)...)
 	if err != nil {
 		return err
 	}
 	g.Go(loggedRunFunc(ctx, "Policy index monitor", pim.Run))
 
 	// Policy monitor
-	pm := policy.NewMonitor(bulker, pim, cfg.Inputs[0].Server.Limits)
+	pm := policy.NewMonitor(bulker, pim, cfg.Inputs[0].Server.Limits,
+		policy.WithRolloutRate(cfg.Fleet.Agent.RolloutRate),
+		policy.WithWildcardNamespaces(cfg.Inputs[0].Server.OutputPermissions.WildcardNamespaces),
+		policy.WithSignatureVerifier(signing.NewVerifier(&cfg.Inputs[0].Server.Signing)),
+	)
 	g.Go(loggedRunFunc(ctx, "Policy monitor", pm.Run))
 
+	// Limits tier selection from the number of active agents
+	if cfg.Fleet.Agent.Limits.Auto && cfg.Inputs[0].Server.Limits.MaxAgents == 0 {
+		al := newAutoLimits(func(ctx context.Context) (int, error) {
+			n, err := dl.CountActiveAgents(ctx, bulker)
+			return int(n), err
+		}, cfg.Inputs[0].Server.Limits.Agents, cfg.Fleet.Agent.Limits.Interval, f.autoLimitsCh)
+		g.Go(loggedRunFunc(ctx, "Auto limits", al.Run))
+	}
+
+	if smCfg := cfg.Inputs[0].Server.SelfMetrics; smCfg.Enabled {
+		g.Go(loggedRunFunc(ctx, "Self metrics", api.NewSelfMetricsReporter(&smCfg, bulker, cfg.Fleet.Agent.ID).Run))
+	}
+
 	// Policy self monitor
+	reporter := f.reporter
+	if mirror != nil {
+		// The mirror goes first as it never fails, so that it is not skipped by a failing reporter.
+		reporter = state.NewChained(state.NewMirror(mirror, cfg.Fleet.Agent.ID), f.reporter)
+	}
 	var sm policy.SelfMonitor
 	if f.standAlone {
-		sm = policy.NewStandAloneSelfMonitor(bulker, f.reporter)
+		sm = policy.NewStandAloneSelfMonitor(bulker, reporter, policy.WithESHealth(esHealth))
 	} else {
-		sm = policy.NewSelfMonitor(cfg.Fleet, bulker, pim, cfg.Inputs[0].Policy.ID, f.reporter)
+		sm = policy.NewSelfMonitor(cfg.Fleet, bulker, pim, cfg.Inputs[0].Policy.ID, reporter, policy.WithESHealth(esHealth))
 	}
 	g.Go(loggedRunFunc(ctx, "Policy self monitor", sm.Run))
 
@@ -507,12 +715,18 @@ func (f *Fleet) runSubsystems(ctx context.Context, cfg *config.Config, g *errgro
 	var ad *action.Dispatcher
 	var tr *action.TokenResolver
 
-	am, err = monitor.NewSimple(dl.FleetActions, esCli, monCli,
+	amOpts := append(monitorOpts,
 		monitor.WithExpiration(true),
 		monitor.WithFetchSize(cfg.Inputs[0].Monitor.FetchSize),
 		monitor.WithPollTimeout(cfg.Inputs[0].Monitor.PollTimeout),
 		monitor.WithAPMTracer(tracer),
+		monitor.WithHealthObserver(esHealth.Observe),
 	)
+	lowLatency := cfg.Inputs[0].Monitor.LowLatency
+	if lowLatency.Enabled {
+		amOpts = append(amOpts, monitor.WithLowLatency(lowLatency.PollInterval))
+	}
+	am, err = monitor.NewSimple(dl.FleetActions, esCli, monCli, amOpts...)
 	if err != nil {
 		return err
 	}
@@ -525,8 +739,16 @@ func (f *Fleet) runSubsystems(ctx context.Context, cfg *config.Config, g *errgro
 		return err
 	}
 
-	bc := checkin.NewBulk(bulker)
-	g.Go(loggedRunFunc(ctx, "Bulk checkin", bc.Run))
+	// The bulk checkin is stopped once the HTTP servers are drained,
+	// so that the checkins of the in-flight requests are flushed before exiting.
+	var srvWg sync.WaitGroup
+	bcCtx, bcCancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer func() {
+		if err != nil {
+			bcCancel()
+		}
+	}()
+	g.Go(loggedRunFunc(bcCtx, "Bulk checkin", bc.Run))
 
 	ct := api.NewCheckinT(f.verCon, &cfg.Inputs[0].Server, f.cache, bc, pm, am, ad, tr, bulker)
 	et, err := api.NewEnrollerT(f.verCon, &cfg.Inputs[0].Server, bulker, f.cache)
@@ -536,17 +758,53 @@ func (f *Fleet) runSubsystems(ctx context.Context, cfg *config.Config, g *errgro
 
 	at := api.NewArtifactT(&cfg.Inputs[0].Server, bulker, f.cache)
 	ack := api.NewAckT(&cfg.Inputs[0].Server, bulker, f.cache)
-	st := api.NewStatusT(&cfg.Inputs[0].Server, bulker, f.cache)
+	st := api.NewStatusT(&cfg.Inputs[0].Server, bulker, f.cache, api.WithCacheConfig(cfg.Inputs[0].Cache))
 	ut := api.NewUploadT(&cfg.Inputs[0].Server, bulker, monCli, f.cache) // uses no-retry client for bufferless chunk upload
 	ft := api.NewFileDeliveryT(&cfg.Inputs[0].Server, bulker, monCli, f.cache)
 	pt := api.NewPGPRetrieverT(&cfg.Inputs[0].Server, bulker, f.cache)
-
-	for _, endpoint := range (&cfg.Inputs[0].Server).BindEndpoints() {
-		apiServer := api.NewServer(endpoint, &cfg.Inputs[0].Server, ct, et, at, ack, st, sm, f.bi, ut, ft, pt, bulker, tracer)
+	var aatOpts []api.AgentActionsOpt
+	if lowLatency.Enabled {
+		aatOpts = append(aatOpts, api.WithActionMonitorNudge(am, lowLatency.ActionTypes))
+	}
+	aat := api.NewAgentActionsT(&cfg.Inputs[0].Server, bulker, aatOpts...)
+	art := api.NewActionResultT(&cfg.Inputs[0].Server, bulker)
+	ppt := api.NewPolicyPreviewT(&cfg.Inputs[0].Server, bulker, pm)
+
+	// The listeners share the endpoint limits, the internal listener is the second endpoint when it is served.
+	srvs := make([]limitsReloader, 0, 4)
+	limiter := api.Limiter(&cfg.Inputs[0].Server.Limits)
+	for i, addrs := range (&cfg.Inputs[0].Server).BindEndpoints() {
+		srvOpts := []api.ServerOpt{api.WithLimiter(limiter)}
+		if i > 0 {
+			srvOpts = append(srvOpts, api.WithInternalListener())
+		}
+		apiServer := api.NewServer(addrs, &cfg.Inputs[0].Server, ct, et, at, ack, st, sm, f.bi, ut, ft, pt, aat, art, ppt, bulker, tracer, srvOpts...)
+		srvs = append(srvs, apiServer)
+		srvWg.Add(1)
 		g.Go(loggedRunFunc(ctx, "Http server", func(ctx context.Context) error {
+			defer srvWg.Done()
 			return apiServer.Run(ctx)
 		}))
 	}
+	if adminCfg := cfg.Inputs[0].Server.Admin; adminCfg.Enabled {
+		if c, ok := f.cache.(api.AdminCache); ok {
+			g.Go(loggedRunFunc(ctx, "Admin server", api.NewAdminServer(adminCfg.SocketPath, c).Run))
+		} else {
+			zerolog.Ctx(ctx).Warn().Msg("admin endpoint is enabled but the cache does not support it")
+		}
+	}
+	go func() {
+		<-ctx.Done()
+		srvWg.Wait()
+		bcCancel()
+	}()
+	// The action dispatcher applies the action limit, and the status handler reports the limits applied to the servers.
+	srvs = append(srvs, ad, st)
+	f.l.Lock()
+	f.srvs = srvs
+	f.st = st
+	f.et = et
+	f.l.Unlock()
 
 	return err
 }
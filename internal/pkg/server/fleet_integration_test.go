@@ -194,7 +194,7 @@ func startTestServer(t *testing.T, ctx context.Context, policyD model.PolicyData
 	srvcfg := &config.Server{}
 	srvcfg.InitDefaults()
 	srvcfg.Timeouts.CheckinMaxPoll = 2 * time.Minute // set to a short value for tests
-	srvcfg.Host = localhost
+	srvcfg.Host = config.BindHosts{localhost}
 	srvcfg.Port = port
 	cfg.Inputs[0].Server = *srvcfg
 	t.Logf("Test fleet server port=%d", port)
@@ -360,7 +360,7 @@ func TestServerConfigErrorReload(t *testing.T) {
 	srvcfg := &config.Server{}
 	srvcfg.InitDefaults()
 	srvcfg.Timeouts.CheckinMaxPoll = 2 * time.Minute // set to a short value for tests
-	srvcfg.Host = localhost
+	srvcfg.Host = config.BindHosts{localhost}
 	srvcfg.Port = port
 	cfg.Inputs[0].Server = *srvcfg
 	newCfg.Inputs[0].Server = *srvcfg
@@ -700,6 +700,82 @@ func Test_SmokeTest_Agent_Calls(t *testing.T) {
 	require.Falsef(t, ok, "expected response to have no errors attribute, errors are present: %+v", ackObj)
 }
 
+func Test_SmokeTest_AgentActions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Start test server
+	srv, err := startTestServer(t, ctx, policyData)
+	require.NoError(t, err)
+	ctx = testlog.SetLogger(t).WithContext(ctx)
+
+	cli := cleanhttp.DefaultClient()
+
+	t.Log("Enroll an agent")
+	agentID, key := EnrollAgent(t, ctx, srv, enrollBody)
+
+	t.Log("Add an action with an unknown agent")
+	body := `{"type": "SETTINGS", "agents": ["unknown-agent"], "data": {"log_level": "debug"}}`
+	req, err := http.NewRequestWithContext(ctx, "POST", srv.baseURL()+"/api/fleet/agents/"+agentID+"/actions", strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+srv.cfg.Output.Elasticsearch.ServiceToken)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := cli.Do(req)
+	require.NoError(t, err)
+	p, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	require.Contains(t, string(p), "unknown-agent")
+
+	// The action has no expiration, it is dispatched until the default expiration.
+	t.Log("Add an action for the agent without an expiration")
+	body = `{"type": "SETTINGS", "data": {"log_level": "debug"}}`
+	req, err = http.NewRequestWithContext(ctx, "POST", srv.baseURL()+"/api/fleet/agents/"+agentID+"/actions", strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+srv.cfg.Output.Elasticsearch.ServiceToken)
+	req.Header.Set("Content-Type", "application/json")
+	res, err = cli.Do(req)
+	require.NoError(t, err)
+	p, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	var actionResp api.ActionResponse
+	err = json.Unmarshal(p, &actionResp)
+	require.NoError(t, err)
+	require.NotEmpty(t, actionResp.ActionId)
+	require.Equal(t, []string{agentID}, actionResp.Agents)
+
+	t.Log("Checkin and expect the added action")
+	req, err = http.NewRequestWithContext(ctx, "POST", srv.baseURL()+"/api/fleet/agents/"+agentID+"/checkin", strings.NewReader(checkinBody))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "ApiKey "+key)
+	req.Header.Set("User-Agent", "elastic agent "+serverVersion)
+	req.Header.Set("Content-Type", "application/json")
+	res, err = cli.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var checkinResponse api.CheckinResponse
+	err = json.NewDecoder(res.Body).Decode(&checkinResponse)
+	res.Body.Close()
+	require.NoError(t, err)
+	require.NotNil(t, checkinResponse.Actions)
+
+	var found *api.Action
+	for i, action := range *checkinResponse.Actions {
+		if action.Id == actionResp.ActionId {
+			found = &(*checkinResponse.Actions)[i]
+		}
+	}
+	require.NotNil(t, found, "expected added action in checkin response")
+	require.Equal(t, api.SETTINGS, found.Type)
+	require.Equal(t, agentID, found.AgentId)
+	require.NotNil(t, found.Expiration, "expected the added action to expire after the default expiration")
+	expiration, err := time.Parse(time.RFC3339, *found.Expiration)
+	require.NoError(t, err)
+	require.True(t, expiration.After(time.Now()))
+}
+
 func EnrollAgent(t *testing.T, ctx context.Context, srv *tserver, enrollBody string) (string, string) {
 	req, err := http.NewRequestWithContext(ctx, "POST", srv.baseURL()+"/api/fleet/agents/enroll", strings.NewReader(enrollBody))
 	require.NoError(t, err)
@@ -735,6 +811,40 @@ func EnrollAgent(t *testing.T, ctx context.Context, srv *tserver, enrollBody str
 	return agentID.(string), key
 }
 
+func Test_Agent_Enroll_Consistency(t *testing.T) {
+	for _, consistency := range []string{config.EnrollConsistencyWaitFor, config.EnrollConsistencyRealtimeGet} {
+		t.Run(consistency, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			srv, err := startTestServer(t, ctx, policyData, func(cfg *config.Config) error {
+				cfg.Inputs[0].Server.Enroll.Consistency = consistency
+				return nil
+			})
+			require.NoError(t, err)
+			ctx = testlog.SetLogger(t).WithContext(ctx)
+
+			cli := cleanhttp.DefaultClient()
+			// Each agent checks in right after its enrollment, its document must be found every time.
+			for i := 0; i < 100; i++ {
+				agentID, key := EnrollAgent(t, ctx, srv, enrollBody)
+
+				req, err := http.NewRequestWithContext(ctx, "POST", srv.baseURL()+"/api/fleet/agents/"+agentID+"/checkin", strings.NewReader(checkinBody))
+				require.NoError(t, err)
+				req.Header.Set("Authorization", "ApiKey "+key)
+				req.Header.Set("User-Agent", "elastic agent "+serverVersion)
+				req.Header.Set("Content-Type", "application/json")
+				res, err := cli.Do(req)
+				require.NoError(t, err)
+				res.Body.Close()
+				require.Equalf(t, http.StatusOK, res.StatusCode, "checkin %d of agent %s", i, agentID)
+			}
+			cancel()
+			require.NoError(t, srv.waitExit())
+		})
+	}
+}
+
 func Test_Agent_Enrollment_Id(t *testing.T) {
 	enrollBodyWEnrollmentID := `{
 	    "type": "PERMANENT",
@@ -841,6 +951,88 @@ func Test_Agent_Enrollment_Id_Invalidated_API_key(t *testing.T) {
 	}
 }
 
+func Test_Agent_Replace(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Start test server
+	srv, err := startTestServer(t, ctx, policyData)
+	require.NoError(t, err)
+	ctx = testlog.SetLogger(t).WithContext(ctx)
+
+	u, err := uuid.NewV4()
+	require.NoError(t, err)
+	agentID := u.String()
+	enrollBodyWReplaceToken := func(token, tag string) string {
+		return `{
+	    "type": "PERMANENT",
+	    "shared_id": "",
+	    "id": "` + agentID + `",
+	    "replace_token": "` + token + `",
+	    "metadata": {
+		"user_provided": {},
+		"local": {},
+		"tags": ["` + tag + `"]
+	    }
+	}`
+	}
+	defer func() {
+		if err := srv.bulker.Delete(ctx, dl.FleetAgents, agentID); err != nil {
+			t.Log("could not clean up agent")
+		}
+	}()
+
+	t.Log("Enroll the agent with a replace token")
+	firstAgentID, firstKey := EnrollAgent(t, ctx, srv, enrollBodyWReplaceToken("secret", "first"))
+	require.Equal(t, agentID, firstAgentID)
+	first, err := dl.FindAgent(ctx, srv.bulker, dl.QueryAgentByID, dl.FieldID, agentID)
+	require.NoError(t, err)
+
+	t.Run("token mismatch", func(t *testing.T) {
+		ctx := testlog.SetLogger(t).WithContext(ctx)
+		req, err := http.NewRequestWithContext(ctx, "POST", srv.baseURL()+"/api/fleet/agents/enroll", strings.NewReader(enrollBodyWReplaceToken("wrong", "mismatch")))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "ApiKey "+srv.enrollKey)
+		req.Header.Set("User-Agent", "elastic agent "+serverVersion)
+		req.Header.Set("Content-Type", "application/json")
+
+		res, err := cleanhttp.DefaultClient().Do(req)
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, http.StatusForbidden, res.StatusCode)
+
+		agent, err := dl.FindAgent(ctx, srv.bulker, dl.QueryAgentByID, dl.FieldID, agentID)
+		require.NoError(t, err)
+		require.Equal(t, first.AccessAPIKeyID, agent.AccessAPIKeyID)
+		require.Equal(t, first.Tags, agent.Tags)
+	})
+
+	t.Run("matching token", func(t *testing.T) {
+		ctx := testlog.SetLogger(t).WithContext(ctx)
+		secondAgentID, secondKey := EnrollAgent(t, ctx, srv, enrollBodyWReplaceToken("secret", "second"))
+		require.Equal(t, agentID, secondAgentID)
+		require.NotEqual(t, firstKey, secondKey)
+
+		agent, err := dl.FindAgent(ctx, srv.bulker, dl.QueryAgentByID, dl.FieldID, agentID)
+		require.NoError(t, err)
+		require.NotEqual(t, first.AccessAPIKeyID, agent.AccessAPIKeyID)
+		require.Equal(t, first.PolicyID, agent.PolicyID)
+		require.Equal(t, []string{"first", "second"}, agent.Tags)
+
+		// the access key of the replaced agent can no longer be used
+		req, err := http.NewRequestWithContext(ctx, "POST", srv.baseURL()+"/api/fleet/agents/"+agentID+"/checkin", strings.NewReader(checkinBody))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "ApiKey "+firstKey)
+		req.Header.Set("User-Agent", "elastic agent "+serverVersion)
+		req.Header.Set("Content-Type", "application/json")
+
+		res, err := cleanhttp.DefaultClient().Do(req)
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Contains(t, []int{http.StatusUnauthorized, http.StatusForbidden}, res.StatusCode)
+	})
+}
+
 func Test_Agent_Auth_errors(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -1048,6 +1240,120 @@ func Test_Agent_request_errors(t *testing.T) {
 	})
 }
 
+func Test_Agent_CheckinDrain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Start test server with its own context so that it can be stopped while the test goes on.
+	srvCtx, srvCancel := context.WithCancel(ctx)
+	defer srvCancel()
+	srv, err := startTestServer(t, srvCtx, policyData)
+	require.NoError(t, err)
+	ctx = testlog.SetLogger(t).WithContext(ctx)
+
+	cli := cleanhttp.DefaultClient()
+
+	t.Log("Enroll an agent")
+	req, err := http.NewRequestWithContext(ctx, "POST", srv.baseURL()+"/api/fleet/agents/enroll", strings.NewReader(enrollBody))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "ApiKey "+srv.enrollKey)
+	req.Header.Set("User-Agent", "elastic agent "+serverVersion)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := cli.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var enrollResponse api.EnrollResponse
+	err = json.NewDecoder(res.Body).Decode(&enrollResponse)
+	res.Body.Close()
+	require.NoError(t, err)
+	agentID := enrollResponse.Item.Id
+	apiKey := enrollResponse.Item.AccessApiKey
+
+	checkin := func(body string) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", srv.baseURL()+"/api/fleet/agents/"+agentID+"/checkin", strings.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "ApiKey "+apiKey)
+		req.Header.Set("User-Agent", "elastic agent "+serverVersion)
+		req.Header.Set("Content-Type", "application/json")
+		return cli.Do(req)
+	}
+
+	// The first checkin returns the policy change right away, ack it so the next checkin is parked.
+	res, err = checkin(checkinBody)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var checkinResponse api.CheckinResponse
+	err = json.NewDecoder(res.Body).Decode(&checkinResponse)
+	res.Body.Close()
+	require.NoError(t, err)
+
+	events := make([]api.AckRequest_Events_Item, 0, len(*checkinResponse.Actions))
+	for _, action := range *checkinResponse.Actions {
+		ev := api.AckRequest_Events_Item{}
+		err := ev.FromGenericEvent(api.GenericEvent{
+			ActionId: action.Id,
+			AgentId:  agentID,
+			Message:  "test-message",
+			Type:     api.ACTIONRESULT,
+			Subtype:  api.ACKNOWLEDGED,
+		})
+		require.NoError(t, err)
+		events = append(events, ev)
+	}
+	p, err := json.Marshal(api.AckRequest{Events: events})
+	require.NoError(t, err)
+	req, err = http.NewRequestWithContext(ctx, "POST", srv.baseURL()+"/api/fleet/agents/"+agentID+"/acks", bytes.NewBuffer(p))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "ApiKey "+apiKey)
+	req.Header.Set("User-Agent", "elastic agent "+serverVersion)
+	req.Header.Set("Content-Type", "application/json")
+	res, err = cli.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	type result struct {
+		res *http.Response
+		err error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		res, err := checkin(fmt.Sprintf(`{
+		    "ack_token": "%s",
+		    "status": "online",
+		    "message": "checkin ok",
+		    "poll_timeout": "3m"
+		}`, *checkinResponse.AckToken))
+		resCh <- result{res, err}
+	}()
+
+	// Give the checkin time to be parked before stopping the server, as a SIGTERM would.
+	time.Sleep(3 * time.Second)
+	start := time.Now()
+	srvCancel()
+
+	var r result
+	select {
+	case r = <-resCh:
+	case <-time.After(30 * time.Second):
+		require.FailNow(t, "parked checkin did not return when the server stopped")
+	}
+	require.NoError(t, r.err, "the parked checkin must complete before the server exits")
+	defer r.res.Body.Close()
+	require.Equal(t, http.StatusOK, r.res.StatusCode)
+	err = json.NewDecoder(r.res.Body).Decode(&checkinResponse)
+	require.NoError(t, err)
+	require.NotNil(t, checkinResponse.AckToken)
+	t.Logf("parked checkin returned %s after the server was stopped", time.Since(start))
+
+	err = srv.g.Wait()
+	if err != nil && !errors.Is(err, context.Canceled) {
+		require.NoError(t, err)
+	}
+}
+
 func Test_SmokeTest_CheckinPollTimeout(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -7,10 +7,12 @@ package server
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/config"
 	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_configChangedServer(t *testing.T) {
@@ -117,6 +119,59 @@ func Test_configChangedServer(t *testing.T) {
 	}
 }
 
+func Test_configChangedLimits(t *testing.T) {
+	newCfg := func(fn func(*config.ServerLimits)) *config.Config {
+		cfg := &config.Config{Inputs: []config.Input{config.Input{}}}
+		cfg.Inputs[0].Server.Limits.CheckinLimit = config.Limit{Interval: time.Millisecond, Burst: 1000, MaxBody: 1024}
+		cfg.Inputs[0].Server.Limits.MaxConnections = 100
+		cfg.Inputs[0].Server.Limits.MaxHeaderByteSize = 8192
+		fn(&cfg.Inputs[0].Server.Limits)
+		return cfg
+	}
+	testcases := []struct {
+		name          string
+		fn            func(*config.ServerLimits)
+		serverChanged bool
+		limitsChanged bool
+	}{{
+		name: "no changes",
+		fn:   func(*config.ServerLimits) {},
+	}, {
+		name:          "checkin burst",
+		fn:            func(l *config.ServerLimits) { l.CheckinLimit.Burst = 10 },
+		limitsChanged: true,
+	}, {
+		name:          "max connections",
+		fn:            func(l *config.ServerLimits) { l.MaxConnections = 10 },
+		limitsChanged: true,
+	}, {
+		name:          "max body",
+		fn:            func(l *config.ServerLimits) { l.CheckinLimit.MaxBody = 10 },
+		serverChanged: true,
+		limitsChanged: true,
+	}, {
+		name:          "max header size",
+		fn:            func(l *config.ServerLimits) { l.MaxHeaderByteSize = 1024 },
+		serverChanged: true,
+		limitsChanged: true,
+	}, {
+		name:          "policy limit",
+		fn:            func(l *config.ServerLimits) { l.PolicyLimit.Burst = 10 },
+		serverChanged: true,
+		limitsChanged: true,
+	}}
+
+	cfg := newCfg(func(*config.ServerLimits) {})
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			log := testlog.SetLogger(t)
+			updated := newCfg(tc.fn)
+			assert.Equal(t, tc.serverChanged, configChangedServer(log, cfg, updated))
+			assert.Equal(t, tc.limitsChanged, configChangedLimits(cfg, updated))
+		})
+	}
+}
+
 func Test_initTracer(t *testing.T) {
 	testcases := []struct {
 		name                 string
@@ -159,3 +214,28 @@ func Test_initTracer(t *testing.T) {
 		})
 	}
 }
+
+func Test_configChangedLimitsEnroll(t *testing.T) {
+	log := testlog.SetLogger(t)
+	cfg := &config.Config{Inputs: []config.Input{config.Input{}}}
+	require.NoError(t, cfg.LoadServerLimitsForAgents(100))
+
+	// The enroll concurrency is reloaded without restarting the server.
+	updated := cfg.Copy()
+	updated.Inputs[0].Server.Enroll.MaxConcurrency = 1
+	assert.False(t, configChangedServer(log, cfg, updated))
+	assert.True(t, configChangedLimits(cfg, updated))
+}
+
+func Test_configChangedLimitsTier(t *testing.T) {
+	log := testlog.SetLogger(t)
+	cfg := &config.Config{Inputs: []config.Input{config.Input{}}}
+	require.NoError(t, cfg.LoadServerLimitsForAgents(100))
+
+	// The limits of another tier are reloaded without restarting the server.
+	updated := cfg.Copy()
+	require.NoError(t, updated.LoadServerLimitsForAgents(15000))
+	require.NotEqual(t, cfg.Inputs[0].Server.Limits.ActionLimit, updated.Inputs[0].Server.Limits.ActionLimit)
+	assert.False(t, configChangedServer(log, cfg, updated))
+	assert.True(t, configChangedLimits(cfg, updated))
+}
@@ -0,0 +1,44 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/sleep"
+	"github.com/elastic/fleet-server/v7/internal/pkg/state"
+)
+
+const (
+	indexMigrationsCondition = "index_migrations"
+	indexMigrationsMaxRetry  = 5 * time.Minute
+)
+
+// runIndexMigrations applies the index migrations until they succeed or the context is cancelled.
+// A failure does not stop the server, it is reported degraded and the migrations are retried with a
+// growing delay, starting at retry.
+func runIndexMigrations(ctx context.Context, migrate func(context.Context) error, health *state.ESHealth, retry time.Duration) error {
+	for {
+		err := migrate(ctx)
+		if err == nil {
+			health.Recover(indexMigrationsCondition)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		zerolog.Ctx(ctx).Warn().Err(err).Dur("retry_in", retry).Msg("Index migrations failed")
+		health.Degrade(indexMigrationsCondition, fmt.Sprintf("index migrations failed: %v", err))
+		if err := sleep.WithContext(ctx, retry); err != nil {
+			return err
+		}
+		retry = min(retry*2, indexMigrationsMaxRetry)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/elastic/elastic-agent-client/v7/pkg/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/state"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+func TestRunIndexMigrations(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	health := state.NewESHealth(config.HealthCheck{Window: time.Minute, MinRequests: 1})
+
+	t.Run("retries until applied", func(t *testing.T) {
+		var calls int
+		migrate := func(context.Context) error {
+			calls++
+			if calls < 3 {
+				s, msg := health.State()
+				if calls > 1 {
+					assert.Equal(t, client.UnitStateDegraded, s)
+					assert.Equal(t, "index migrations failed: mapping conflict", msg)
+				}
+				return errors.New("mapping conflict")
+			}
+			return nil
+		}
+
+		require.NoError(t, runIndexMigrations(ctx, migrate, health, time.Millisecond))
+		assert.Equal(t, 3, calls)
+		s, _ := health.State()
+		assert.Equal(t, client.UnitStateHealthy, s)
+	})
+
+	t.Run("stops when cancelled", func(t *testing.T) {
+		cctx, cancel := context.WithCancel(ctx)
+		migrate := func(context.Context) error {
+			cancel()
+			return errors.New("unreachable")
+		}
+
+		err := runIndexMigrations(cctx, migrate, health, time.Hour)
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
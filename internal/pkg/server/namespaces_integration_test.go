@@ -63,6 +63,13 @@ func AgentCheckin(t *testing.T, ctx context.Context, srv *tserver, agentID, key
 }
 
 func AgentAck(t *testing.T, ctx context.Context, srv *tserver, actionID, agentID, key string) {
+	status := agentAckStatus(t, ctx, srv, actionID, agentID, key)
+	require.Equal(t, http.StatusOK, status)
+	t.Log("Ack successful, verify body")
+}
+
+// agentAckStatus acks the action for the agent and returns the status of the ack event.
+func agentAckStatus(t *testing.T, ctx context.Context, srv *tserver, actionID, agentID, key string) int {
 	t.Logf("Fake an ack for action %s for agent %s", actionID, agentID)
 	body := fmt.Sprintf(`{
 	    "events": [{
@@ -81,9 +88,7 @@ func AgentAck(t *testing.T, ctx context.Context, srv *tserver, actionID, agentID
 	res, err := cli.Do(req)
 	require.NoError(t, err)
 	defer res.Body.Close()
-
-	require.Equal(t, http.StatusOK, res.StatusCode)
-	t.Log("Ack successful, verify body")
+	return res.StatusCode
 }
 
 type GetAgentResponse struct {
@@ -257,3 +262,100 @@ func Test_Agent_Namespace_test1(t *testing.T) {
 	t.Log("Check action results has the correct namespace")
 	CheckActionResultsNamespace(t, ctx, srv, actionID, "test1")
 }
+
+// enrollInNamespace creates a policy and an enrollment key in the namespace and enrolls an agent with it.
+func enrollInNamespace(t *testing.T, ctx context.Context, srv *tserver, namespace string) (string, string) {
+	policyID := uuid.Must(uuid.NewV4()).String()
+	_, err := dl.CreatePolicy(ctx, srv.bulker, model.Policy{
+		PolicyID:    policyID,
+		Namespaces:  []string{namespace},
+		RevisionIdx: 1,
+		Data: &model.PolicyData{
+			Outputs: map[string]map[string]interface{}{
+				"default": {
+					"type": "elasticsearch",
+				},
+			},
+			OutputPermissions: json.RawMessage(`{"default": {} }`),
+			Inputs:            []map[string]interface{}{},
+			Agent:             json.RawMessage(`{"monitoring": {"use_output":"default"}}`),
+		},
+	})
+	require.NoError(t, err)
+
+	key, err := apikey.Create(ctx, srv.bulker.Client(), namespace, "", "true", []byte(`{
+	    "fleet-apikey-enroll": {
+		"cluster": [],
+		"index": [],
+		"applications": [{
+		    "application": "fleet",
+		    "privileges": ["no-privileges"],
+		    "resources": ["*"]
+		}]
+	    }
+	}`), map[string]interface{}{
+		"managed_by": "fleet",
+		"managed":    true,
+		"type":       "enroll",
+		"policy_id":  policyID,
+	})
+	require.NoError(t, err)
+	_, err = dl.CreateEnrollmentAPIKey(ctx, srv.bulker, model.EnrollmentAPIKey{
+		Name:       "Test" + namespace,
+		Namespaces: []string{namespace},
+		APIKey:     key.Key,
+		APIKeyID:   key.ID,
+		PolicyID:   policyID,
+		Active:     true,
+	})
+	require.NoError(t, err)
+
+	srv.enrollKey = key.Token()
+	agentID, agentKey := EnrollAgent(t, ctx, srv, enrollBody)
+	AssertAgentDocContainNamespace(t, ctx, srv, agentID, namespace)
+	t.Cleanup(func() {
+		if err := srv.bulker.Delete(context.Background(), dl.FleetAgents, agentID); err != nil {
+			t.Log("could not clean up agent")
+		}
+	})
+
+	// The first checkin delivers the policy
+	policyActionID := AgentCheckin(t, ctx, srv, agentID, agentKey)
+	AgentAck(t, ctx, srv, policyActionID, agentID, agentKey)
+	return agentID, agentKey
+}
+
+func Test_Agent_Namespace_Isolation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv, err := startTestServer(t, ctx, policyData)
+	require.NoError(t, err)
+
+	agentA, keyA := enrollInNamespace(t, ctx, srv, "space-a")
+	agentB, keyB := enrollInNamespace(t, ctx, srv, "space-b")
+
+	t.Log("Create a SETTINGS action in each namespace addressed to both agents")
+	actionIDs := map[string]string{}
+	for _, ns := range []string{"space-a", "space-b"} {
+		actionID := uuid.Must(uuid.NewV4()).String()
+		CreateActionDocument(t, ctx, srv, model.Action{
+			Agents:     []string{agentA, agentB},
+			Expiration: time.Now().Add(time.Hour).Format(time.RFC3339),
+			ActionID:   actionID,
+			Namespaces: []string{ns},
+			Type:       "SETTINGS",
+			Data:       []byte(`{"log_level": "debug"}`),
+		})
+		actionIDs[ns] = actionID
+	}
+
+	t.Log("Each agent only receives the action of its namespace")
+	require.Equal(t, actionIDs["space-a"], AgentCheckin(t, ctx, srv, agentA, keyA))
+	require.Equal(t, actionIDs["space-b"], AgentCheckin(t, ctx, srv, agentB, keyB))
+
+	t.Log("An agent can not ack the action of another namespace")
+	require.Equal(t, http.StatusForbidden, agentAckStatus(t, ctx, srv, actionIDs["space-b"], agentA, keyA))
+	AgentAck(t, ctx, srv, actionIDs["space-a"], agentA, keyA)
+	CheckActionResultsNamespace(t, ctx, srv, actionIDs["space-a"], "space-a")
+}
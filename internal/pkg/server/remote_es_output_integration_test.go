@@ -264,8 +264,8 @@ func Test_Agent_Remote_ES_Output(t *testing.T) {
 }
 
 func verifyRemoteAPIKey(t *testing.T, ctx context.Context, apiKeyID string, invalidated bool) {
-	// need to wait a bit before querying the api key
-	time.Sleep(time.Second)
+	// need to wait a bit before querying the api key, invalidations are queued and sent every second
+	time.Sleep(2 * time.Second)
 
 	requestURL := fmt.Sprintf("https://elastic:changeme@%s/_security/api_key?id=%s", remoteESHost, apiKeyID)
 
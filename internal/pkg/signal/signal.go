@@ -40,3 +40,26 @@ func HandleInterrupt(ctx context.Context) context.Context {
 
 	return ctx
 }
+
+// HandleReload calls reloadFn every time the process receives a SIGHUP until the context is cancelled.
+func HandleReload(ctx context.Context, reloadFn func(context.Context)) {
+	log := zerolog.Ctx(ctx)
+
+	log.Debug().Msg("Install signal handler for SIGHUP")
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case sig := <-sigs:
+				log.Info().Str("sig", sig.String()).Msg("On signal, reloading configuration")
+				reloadFn(ctx)
+			case <-ctx.Done():
+				log.Debug().Msg("Reload signal handler close")
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,219 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+// Package signing verifies the signatures Fleet attaches to the policies and the actions.
+//
+// The signed data is the base64 encoded JSON the signature was computed over, the signature is the base64 encoded
+// ASN.1 ECDSA signature of the SHA-256 hash of the data. The signed block is dispatched to the agents as it is, they
+// verify it again.
+//
+// A valid signature only proves that Fleet signed the data, the fields of the signed data are also compared with the
+// dispatched policy or action so that a signed block cannot be copied onto another payload.
+package signing
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+)
+
+var (
+	ErrUnsigned         = errors.New("payload is not signed")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrSignedMismatch   = errors.New("signed data does not match the payload")
+)
+
+// Kinds of the verified payloads.
+const (
+	KindPolicy = "policy"
+	KindAction = "action"
+)
+
+var rejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "signing",
+	Name:      "rejected_total",
+	Help:      "Number of policies and actions not dispatched because their signature did not validate.",
+}, []string{"kind"})
+
+// MetricsCollectors returns the prometheus collectors of the signature verification.
+func MetricsCollectors() []prometheus.Collector {
+	return []prometheus.Collector{rejected}
+}
+
+// Verifier verifies the signed block of the policies and the actions with the public key of Fleet.
+// A nil Verifier accepts all the payloads, signed or not.
+type Verifier struct {
+	key *ecdsa.PublicKey
+	err error
+}
+
+// NewVerifier returns the verifier configured by cfg, or nil if the verification is disabled.
+// The configuration validation rejects invalid public keys, a verifier created with one rejects all the payloads.
+func NewVerifier(cfg *config.Signing) *Verifier {
+	if !cfg.Verify {
+		return nil
+	}
+	key, err := cfg.ECDSAPublicKey()
+	if err != nil {
+		err = fmt.Errorf("invalid public_key: %w", err)
+	}
+	return &Verifier{key: key, err: err}
+}
+
+// VerifyPolicy verifies the signature of the policy, and that the signed data is the data of the policy.
+func (v *Verifier) VerifyPolicy(p *model.Policy) error {
+	if v == nil {
+		return nil
+	}
+	var s *model.Signed
+	if p.Data != nil {
+		s = p.Data.Signed
+	}
+	return v.verify(KindPolicy, s, func(data []byte) error {
+		return matchPolicy(data, p)
+	})
+}
+
+// VerifyAction verifies the signature of the action, and that the signed data is the data of the action.
+func (v *Verifier) VerifyAction(a *model.Action) error {
+	if v == nil {
+		return nil
+	}
+	return v.verify(KindAction, a.Signed, func(data []byte) error {
+		return matchAction(data, a)
+	})
+}
+
+func (v *Verifier) verify(kind string, s *model.Signed, match func([]byte) error) error {
+	data, err := v.check(s)
+	if err == nil {
+		err = match(data)
+	}
+	if err != nil {
+		rejected.WithLabelValues(kind).Inc()
+	}
+	return err
+}
+
+// check verifies the signature of the signed block, it returns the decoded signed data.
+func (v *Verifier) check(s *model.Signed) ([]byte, error) {
+	if v.err != nil {
+		return nil, v.err
+	}
+	if s == nil || (s.Data == "" && s.Signature == "") {
+		return nil, ErrUnsigned
+	}
+	data, err := base64.StdEncoding.DecodeString(s.Data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: data is not base64 encoded: %w", ErrInvalidSignature, err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(s.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature is not base64 encoded: %w", ErrInvalidSignature, err)
+	}
+	hash := sha256.Sum256(data)
+	if !ecdsa.VerifyASN1(v.key, hash[:], sig) {
+		return nil, ErrInvalidSignature
+	}
+	return data, nil
+}
+
+// matchPolicy returns an error if the signed data is not the data of the policy. Fleet signs the policy id and the
+// agent protection settings, the revision is compared when it is signed.
+func matchPolicy(data []byte, p *model.Policy) error {
+	var signed struct {
+		ID       string `json:"id"`
+		Revision *int64 `json:"revision"`
+		Agent    struct {
+			Protection json.RawMessage `json:"protection"`
+		} `json:"agent"`
+	}
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return fmt.Errorf("%w: %w", ErrSignedMismatch, err)
+	}
+	if signed.ID != p.PolicyID || (p.Data != nil && signed.ID != p.Data.ID) {
+		return fmt.Errorf("%w: id", ErrSignedMismatch)
+	}
+	if signed.Revision != nil && *signed.Revision != p.RevisionIdx {
+		return fmt.Errorf("%w: revision", ErrSignedMismatch)
+	}
+	var agent struct {
+		Protection json.RawMessage `json:"protection"`
+	}
+	if p.Data != nil && len(p.Data.Agent) > 0 {
+		if err := json.Unmarshal(p.Data.Agent, &agent); err != nil {
+			return fmt.Errorf("%w: agent: %w", ErrSignedMismatch, err)
+		}
+	}
+	if !jsonEqual(signed.Agent.Protection, agent.Protection) {
+		return fmt.Errorf("%w: agent.protection", ErrSignedMismatch)
+	}
+	return nil
+}
+
+// matchAction returns an error if the signed data is not the data of the action. The fields that are not signed
+// must not be set in the action either.
+func matchAction(data []byte, a *model.Action) error {
+	var signed struct {
+		ActionID   string          `json:"action_id"`
+		Type       string          `json:"type"`
+		Agents     []string        `json:"agents"`
+		Data       json.RawMessage `json:"data"`
+		Expiration string          `json:"expiration"`
+	}
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return fmt.Errorf("%w: %w", ErrSignedMismatch, err)
+	}
+	switch {
+	case signed.ActionID != a.ActionID:
+		return fmt.Errorf("%w: action_id", ErrSignedMismatch)
+	case signed.Type != a.Type:
+		return fmt.Errorf("%w: type", ErrSignedMismatch)
+	case !slices.Equal(signed.Agents, a.Agents):
+		return fmt.Errorf("%w: agents", ErrSignedMismatch)
+	case !jsonEqual(signed.Data, a.Data):
+		return fmt.Errorf("%w: data", ErrSignedMismatch)
+	case !timeEqual(signed.Expiration, a.Expiration):
+		return fmt.Errorf("%w: expiration", ErrSignedMismatch)
+	}
+	return nil
+}
+
+// jsonEqual returns true if a and b encode the same value, a missing value equals null.
+func jsonEqual(a, b json.RawMessage) bool {
+	var va, vb interface{}
+	if len(bytes.TrimSpace(a)) > 0 {
+		if err := json.Unmarshal(a, &va); err != nil {
+			return false
+		}
+	}
+	if len(bytes.TrimSpace(b)) > 0 {
+		if err := json.Unmarshal(b, &vb); err != nil {
+			return false
+		}
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// timeEqual returns true if a and b are the same time, in any RFC3339 format, or the same string.
+func timeEqual(a, b string) bool {
+	if a == b {
+		return true
+	}
+	ta, errA := time.Parse(time.RFC3339Nano, a)
+	tb, errB := time.Parse(time.RFC3339Nano, b)
+	return errA == nil && errB == nil && ta.Equal(tb)
+}
@@ -0,0 +1,156 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package signing
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+)
+
+// signedPolicy returns the policy policy-1 that ftesting.SignedPolicy is the signed block of.
+func signedPolicy(signed *model.Signed) *model.Policy {
+	return &model.Policy{
+		PolicyID: "policy-1",
+		Data: &model.PolicyData{
+			ID:     "policy-1",
+			Agent:  json.RawMessage(`{"monitoring":{"enabled":true},"protection":{"enabled":true,"uninstall_token_hash":"","signing_key":""}}`),
+			Signed: signed,
+		},
+	}
+}
+
+// signedAction returns the action action-1 that ftesting.SignedAction is the signed block of.
+func signedAction(signed *model.Signed) *model.Action {
+	return &model.Action{
+		ActionID:  "action-1",
+		Type:      "UNENROLL",
+		Agents:    []string{"agent-1"},
+		Timestamp: "2024-07-01T12:00:00.000Z",
+		Signed:    signed,
+	}
+}
+
+func TestVerifier(t *testing.T) {
+	tampered := ftesting.SignedPolicy()
+	tampered.Data = base64.StdEncoding.EncodeToString([]byte(`{"id":"policy-1","agent":{"protection":{"enabled":false}}}`))
+	swapped := ftesting.SignedAction()
+	swapped.Signature = ftesting.SignedPolicy().Signature
+
+	tests := []struct {
+		name   string
+		verify bool
+		signed *model.Signed
+		// action is the signed block of the action when it differs from the one of the policy.
+		action *model.Signed
+		err    error
+	}{
+		{name: "valid", verify: true, signed: ftesting.SignedPolicy(), action: ftesting.SignedAction()},
+		{name: "tampered data", verify: true, signed: tampered, err: ErrInvalidSignature},
+		{name: "signature of another payload", verify: true, signed: swapped, err: ErrInvalidSignature},
+		{name: "data not base64", verify: true, signed: &model.Signed{Data: "{}", Signature: ftesting.SignedPolicy().Signature}, err: ErrInvalidSignature},
+		{name: "unsigned", verify: true, err: ErrUnsigned},
+		{name: "empty signed block", verify: true, signed: &model.Signed{}, err: ErrUnsigned},
+		{name: "disabled unsigned"},
+		{name: "disabled tampered", signed: tampered},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			v := NewVerifier(&config.Signing{Verify: tc.verify, PublicKey: ftesting.SigningPublicKey})
+			policies := testutil.ToFloat64(rejected.WithLabelValues(KindPolicy))
+			actions := testutil.ToFloat64(rejected.WithLabelValues(KindAction))
+
+			errPolicy := v.VerifyPolicy(signedPolicy(tc.signed))
+			action := tc.signed
+			if tc.action != nil {
+				action = tc.action
+			}
+			errAction := v.VerifyAction(signedAction(action))
+			if tc.err == nil {
+				assert.NoError(t, errPolicy)
+				assert.NoError(t, errAction)
+				assert.Equal(t, policies, testutil.ToFloat64(rejected.WithLabelValues(KindPolicy)))
+				assert.Equal(t, actions, testutil.ToFloat64(rejected.WithLabelValues(KindAction)))
+				return
+			}
+			assert.ErrorIs(t, errPolicy, tc.err)
+			assert.ErrorIs(t, errAction, tc.err)
+			assert.Equal(t, policies+1, testutil.ToFloat64(rejected.WithLabelValues(KindPolicy)))
+			assert.Equal(t, actions+1, testutil.ToFloat64(rejected.WithLabelValues(KindAction)))
+		})
+	}
+}
+
+func TestVerifierAction(t *testing.T) {
+	v := NewVerifier(&config.Signing{Verify: true, PublicKey: ftesting.SigningPublicKey})
+	require.NotNil(t, v)
+	assert.NoError(t, v.VerifyAction(signedAction(ftesting.SignedAction())))
+	assert.ErrorIs(t, v.VerifyPolicy(&model.Policy{}), ErrUnsigned, "policy without data")
+}
+
+func TestVerifierSignedMismatch(t *testing.T) {
+	v := NewVerifier(&config.Signing{Verify: true, PublicKey: ftesting.SigningPublicKey})
+	require.NotNil(t, v)
+
+	// The valid signed blocks are copied onto other payloads.
+	actions := map[string]func(*model.Action){
+		"other action":   func(a *model.Action) { a.ActionID = "action-2" },
+		"forged type":    func(a *model.Action) { a.Type = "UPGRADE" },
+		"other agents":   func(a *model.Action) { a.Agents = []string{"agent-1", "agent-2"} },
+		"added data":     func(a *model.Action) { a.Data = json.RawMessage(`{"version":"8.1.0"}`) },
+		"added deadline": func(a *model.Action) { a.Expiration = "2024-07-02T12:00:00Z" },
+	}
+	for name, change := range actions {
+		t.Run("action "+name, func(t *testing.T) {
+			action := signedAction(ftesting.SignedAction())
+			change(action)
+			assert.ErrorIs(t, v.VerifyAction(action), ErrSignedMismatch)
+		})
+	}
+	policies := map[string]func(*model.Policy){
+		"other policy": func(p *model.Policy) {
+			p.PolicyID = "policy-2"
+			p.Data.ID = "policy-2"
+		},
+		"other data id": func(p *model.Policy) { p.Data.ID = "policy-2" },
+		"protection disabled": func(p *model.Policy) {
+			p.Data.Agent = json.RawMessage(`{"protection":{"enabled":false,"uninstall_token_hash":"","signing_key":""}}`)
+		},
+		"no agent": func(p *model.Policy) { p.Data.Agent = nil },
+	}
+	for name, change := range policies {
+		t.Run("policy "+name, func(t *testing.T) {
+			policy := signedPolicy(ftesting.SignedPolicy())
+			change(policy)
+			assert.ErrorIs(t, v.VerifyPolicy(policy), ErrSignedMismatch)
+		})
+	}
+
+	t.Run("action expiration format", func(t *testing.T) {
+		data := json.RawMessage(`{"action_id":"action-1","type":"UNENROLL","agents":["agent-1"],"expiration":"2024-07-02T12:00:00.000Z"}`)
+		assert.NoError(t, matchAction(data, &model.Action{ActionID: "action-1", Type: "UNENROLL", Agents: []string{"agent-1"}, Expiration: "2024-07-02T12:00:00Z"}))
+	})
+	t.Run("policy revision", func(t *testing.T) {
+		data := json.RawMessage(`{"id":"policy-1","revision":3}`)
+		assert.NoError(t, matchPolicy(data, &model.Policy{PolicyID: "policy-1", RevisionIdx: 3, Data: &model.PolicyData{ID: "policy-1"}}))
+		assert.ErrorIs(t, matchPolicy(data, &model.Policy{PolicyID: "policy-1", RevisionIdx: 4, Data: &model.PolicyData{ID: "policy-1"}}), ErrSignedMismatch)
+	})
+}
+
+func TestVerifierInvalidKey(t *testing.T) {
+	v := NewVerifier(&config.Signing{Verify: true, PublicKey: "not a key"})
+	require.NotNil(t, v)
+	assert.ErrorContains(t, v.VerifyPolicy(&model.Policy{Data: &model.PolicyData{Signed: ftesting.SignedPolicy()}}), "invalid public_key")
+}
@@ -0,0 +1,218 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/elastic-agent-client/v7/pkg/client"
+	"github.com/rs/zerolog"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+)
+
+// healthBuckets is the number of buckets the window of ESHealth is split in.
+const healthBuckets = 10
+
+// ESHealth evaluates the health of fleet-server from the outcome of its recent requests to Elasticsearch.
+//
+// The outcomes are counted in buckets covering the configured window, the oldest bucket is dropped as the
+// window slides. The server is degraded while the rate of failed requests in the window exceeds the error
+// threshold, and healthy again once the failures age out of the window or are outweighed by successes.
+type ESHealth struct {
+	mu        sync.Mutex
+	cfg       config.HealthCheck
+	bucketDur time.Duration
+	buckets   [healthBuckets]healthBucket
+	degraded  bool
+	message   string
+	changed   chan struct{}
+
+	// conditions are the reasons, by name, the server is degraded regardless of the error rate.
+	conditions map[string]string
+
+	now func() time.Time
+}
+
+type healthBucket struct {
+	start  time.Time
+	total  int
+	failed int
+}
+
+// NewESHealth creates an ESHealth, healthy until enough requests failed.
+func NewESHealth(cfg config.HealthCheck) *ESHealth {
+	return &ESHealth{
+		cfg:       cfg,
+		bucketDur: max(cfg.Window/healthBuckets, time.Millisecond),
+		changed:   make(chan struct{}, 1),
+		now:       time.Now,
+	}
+}
+
+// Observe records the outcome of a request to Elasticsearch, a nil err is a success.
+// The requests that Elasticsearch answered with a client error are successes, the cancelled ones are not counted.
+func (h *ESHealth) Observe(err error) {
+	if h == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	failed := isESFailure(err)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := h.now()
+	b := h.bucket(now)
+	b.total++
+	if failed {
+		b.failed++
+	}
+	h.evaluate(now)
+}
+
+// State returns client.UnitStateDegraded and the reason while the error rate exceeds the threshold,
+// client.UnitStateHealthy otherwise.
+func (h *ESHealth) State() (client.UnitState, string) {
+	if h == nil {
+		return client.UnitStateHealthy, ""
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.evaluate(h.now())
+	var reasons []string
+	if h.degraded {
+		reasons = append(reasons, h.message)
+	}
+	names := make([]string, 0, len(h.conditions))
+	for name := range h.conditions {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		reasons = append(reasons, h.conditions[name])
+	}
+	if len(reasons) > 0 {
+		return client.UnitStateDegraded, strings.Join(reasons, "; ")
+	}
+	return client.UnitStateHealthy, ""
+}
+
+// Degrade reports the server degraded for the reason until Recover is called with the same name,
+// whatever the error rate of the requests.
+func (h *ESHealth) Degrade(name, reason string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if r, ok := h.conditions[name]; ok && r == reason {
+		return
+	}
+	if h.conditions == nil {
+		h.conditions = make(map[string]string)
+	}
+	h.conditions[name] = reason
+	h.notify()
+}
+
+// Recover removes the reason the server was degraded for by Degrade.
+func (h *ESHealth) Recover(name string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.conditions[name]; !ok {
+		return
+	}
+	delete(h.conditions, name)
+	h.notify()
+}
+
+// Apply degrades a healthy state while Elasticsearch is failing, the reason is appended to message.
+// Any other state is returned unchanged.
+func (h *ESHealth) Apply(state client.UnitState, message string) (client.UnitState, string) {
+	if state != client.UnitStateHealthy {
+		return state, message
+	}
+	esState, reason := h.State()
+	if esState == client.UnitStateHealthy {
+		return state, message
+	}
+	return esState, fmt.Sprintf("%s; %s", message, reason)
+}
+
+// Changed returns a channel that receives when the health changes, it never receives for a nil ESHealth.
+func (h *ESHealth) Changed() <-chan struct{} {
+	if h == nil {
+		return nil
+	}
+	return h.changed
+}
+
+// bucket returns the bucket of now, it is reset if it was last used in a previous window.
+func (h *ESHealth) bucket(now time.Time) *healthBucket {
+	start := now.Truncate(h.bucketDur)
+	b := &h.buckets[(start.UnixNano()/int64(h.bucketDur))%healthBuckets]
+	if !b.start.Equal(start) {
+		*b = healthBucket{start: start}
+	}
+	return b
+}
+
+// evaluate updates the health from the buckets in the window ending at now.
+func (h *ESHealth) evaluate(now time.Time) {
+	var total, failed int
+	for _, b := range h.buckets {
+		if now.Sub(b.start) < h.cfg.Window {
+			total += b.total
+			failed += b.failed
+		}
+	}
+	degraded := total > 0 && total >= h.cfg.MinRequests && float64(failed)/float64(total) > h.cfg.ErrorThreshold
+	if degraded {
+		h.message = fmt.Sprintf("%d of %d Elasticsearch requests failed in the last %s", failed, total, h.cfg.Window)
+	}
+	if degraded == h.degraded {
+		return
+	}
+	h.degraded = degraded
+
+	log := zerolog.Ctx(context.TODO())
+	if degraded {
+		log.Warn().Int("failed", failed).Int("total", total).Msg("Elasticsearch error rate exceeds the health check threshold, reporting degraded state")
+	} else {
+		log.Info().Int("failed", failed).Int("total", total).Msg("Elasticsearch error rate recovered, reporting healthy state")
+	}
+	h.notify()
+}
+
+// notify signals a change of the health without blocking.
+func (h *ESHealth) notify() {
+	select {
+	case h.changed <- struct{}{}:
+	default:
+	}
+}
+
+// isESFailure returns true if err means Elasticsearch could not serve the request: it was unreachable,
+// overloaded, or failed with a server error.
+func isESFailure(err error) bool {
+	if err == nil || errors.Is(err, es.ErrIndexNotFound) {
+		return false
+	}
+	var esErr *es.ErrElastic
+	if errors.As(err, &esErr) {
+		return esErr.Status >= http.StatusInternalServerError || esErr.Status == http.StatusTooManyRequests
+	}
+	return true
+}
@@ -0,0 +1,191 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/elastic/elastic-agent-client/v7/pkg/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+)
+
+var errUnreachable = errors.New("dial tcp: connection refused")
+
+func newTestESHealth(now *time.Time) *ESHealth {
+	h := NewESHealth(config.HealthCheck{
+		Window:         time.Minute,
+		ErrorThreshold: 0.5,
+		MinRequests:    4,
+	})
+	h.now = func() time.Time { return *now }
+	return h
+}
+
+// observe records n outcomes of err, one per second.
+func observe(h *ESHealth, now *time.Time, n int, err error) {
+	for i := 0; i < n; i++ {
+		h.Observe(err)
+		*now = now.Add(time.Second)
+	}
+}
+
+func changed(h *ESHealth) bool {
+	select {
+	case <-h.Changed():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestESHealth(t *testing.T) {
+	t.Run("degrades above the threshold", func(t *testing.T) {
+		now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+		h := newTestESHealth(&now)
+
+		observe(h, &now, 5, nil)
+		observe(h, &now, 5, errUnreachable)
+		state, _ := h.State()
+		assert.Equal(t, client.UnitStateHealthy, state, "an error rate at the threshold is healthy")
+		assert.False(t, changed(h))
+
+		observe(h, &now, 1, errUnreachable)
+		state, msg := h.State()
+		assert.Equal(t, client.UnitStateDegraded, state)
+		assert.Equal(t, "6 of 11 Elasticsearch requests failed in the last 1m0s", msg)
+		assert.True(t, changed(h))
+	})
+
+	t.Run("recovers with successes", func(t *testing.T) {
+		now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+		h := newTestESHealth(&now)
+
+		observe(h, &now, 10, errUnreachable)
+		state, _ := h.State()
+		require.Equal(t, client.UnitStateDegraded, state)
+		require.True(t, changed(h))
+
+		observe(h, &now, 9, nil)
+		state, _ = h.State()
+		assert.Equal(t, client.UnitStateDegraded, state)
+		observe(h, &now, 1, nil)
+		state, _ = h.State()
+		assert.Equal(t, client.UnitStateHealthy, state)
+		assert.True(t, changed(h))
+	})
+
+	t.Run("recovers once the failures leave the window", func(t *testing.T) {
+		now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+		h := newTestESHealth(&now)
+
+		observe(h, &now, 10, errUnreachable)
+		state, _ := h.State()
+		require.Equal(t, client.UnitStateDegraded, state)
+
+		now = now.Add(30 * time.Second)
+		state, _ = h.State()
+		assert.Equal(t, client.UnitStateDegraded, state, "the failures are still in the window")
+
+		now = now.Add(time.Minute)
+		state, _ = h.State()
+		assert.Equal(t, client.UnitStateHealthy, state)
+	})
+
+	t.Run("needs min requests", func(t *testing.T) {
+		now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+		h := newTestESHealth(&now)
+
+		observe(h, &now, 3, errUnreachable)
+		state, _ := h.State()
+		assert.Equal(t, client.UnitStateHealthy, state)
+
+		observe(h, &now, 1, errUnreachable)
+		state, _ = h.State()
+		assert.Equal(t, client.UnitStateDegraded, state)
+	})
+
+	t.Run("client errors are not failures", func(t *testing.T) {
+		now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+		h := newTestESHealth(&now)
+
+		observe(h, &now, 5, &es.ErrElastic{Status: 409, Type: "version_conflict_engine_exception"})
+		observe(h, &now, 5, fmt.Errorf("search: %w", es.ErrIndexNotFound))
+		observe(h, &now, 5, context.Canceled)
+		state, _ := h.State()
+		assert.Equal(t, client.UnitStateHealthy, state)
+
+		observe(h, &now, 6, &es.ErrElastic{Status: 429})
+		observe(h, &now, 5, &es.ErrElastic{Status: 503})
+		state, msg := h.State()
+		assert.Equal(t, client.UnitStateDegraded, state)
+		assert.Equal(t, "11 of 21 Elasticsearch requests failed in the last 1m0s", msg, "cancelled requests are not counted")
+	})
+}
+
+func TestESHealthApply(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	h := newTestESHealth(&now)
+
+	state, msg := h.Apply(client.UnitStateHealthy, "Running")
+	assert.Equal(t, client.UnitStateHealthy, state)
+	assert.Equal(t, "Running", msg)
+
+	observe(h, &now, 4, errUnreachable)
+	state, msg = h.Apply(client.UnitStateHealthy, "Running")
+	assert.Equal(t, client.UnitStateDegraded, state)
+	assert.Equal(t, "Running; 4 of 4 Elasticsearch requests failed in the last 1m0s", msg)
+
+	state, msg = h.Apply(client.UnitStateStarting, "Waiting on policy")
+	assert.Equal(t, client.UnitStateStarting, state, "only a healthy state is degraded")
+	assert.Equal(t, "Waiting on policy", msg)
+
+	var disabled *ESHealth
+	disabled.Observe(errUnreachable)
+	state, _ = disabled.Apply(client.UnitStateHealthy, "Running")
+	assert.Equal(t, client.UnitStateHealthy, state)
+	assert.Nil(t, disabled.Changed())
+}
+
+func TestESHealthDegrade(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	h := newTestESHealth(&now)
+
+	h.Degrade("migrations", "index migrations failed")
+	assert.True(t, changed(h))
+	state, msg := h.State()
+	assert.Equal(t, client.UnitStateDegraded, state)
+	assert.Equal(t, "index migrations failed", msg)
+
+	h.Degrade("migrations", "index migrations failed")
+	assert.False(t, changed(h), "the same reason is not a change")
+
+	observe(h, &now, 4, errUnreachable)
+	state, msg = h.Apply(client.UnitStateHealthy, "Running")
+	assert.Equal(t, client.UnitStateDegraded, state)
+	assert.Equal(t, "Running; 4 of 4 Elasticsearch requests failed in the last 1m0s; index migrations failed", msg)
+
+	now = now.Add(time.Minute)
+	h.Recover("migrations")
+	assert.True(t, changed(h))
+	h.Recover("migrations")
+	assert.False(t, changed(h), "recovering twice is not a change")
+	state, _ = h.State()
+	assert.Equal(t, client.UnitStateHealthy, state)
+
+	var disabled *ESHealth
+	disabled.Degrade("migrations", "index migrations failed")
+	state, _ = disabled.State()
+	assert.Equal(t, client.UnitStateHealthy, state)
+}
@@ -0,0 +1,63 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/elastic/elastic-agent-client/v7/pkg/client"
+	"github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+)
+
+// Mirror writes the state to the fleet-server status data stream of the secondary output of a mirror.
+type Mirror struct {
+	mirror  *bulk.Mirror
+	agentID string
+}
+
+// NewMirror creates a Mirror for the fleet-server run by the agent with agentID.
+func NewMirror(mirror *bulk.Mirror, agentID string) *Mirror {
+	return &Mirror{
+		mirror:  mirror,
+		agentID: agentID,
+	}
+}
+
+// UpdateState queues the state to be written, it never fails.
+func (m *Mirror) UpdateState(state client.UnitState, message string, _ map[string]interface{}) error {
+	ctx := context.TODO()
+	body, err := json.Marshal(map[string]interface{}{
+		"@timestamp": time.Now().UTC().Format(time.RFC3339),
+		"data_stream": map[string]string{
+			"dataset":   "fleet_server.status",
+			"type":      "logs",
+			"namespace": "default",
+		},
+		"agent":   map[string]string{"id": m.agentID},
+		"state":   state.String(),
+		"message": message,
+	})
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to mirror state")
+		return nil
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to mirror state")
+		return nil
+	}
+	m.mirror.MCreate(ctx, []bulk.MultiOp{{
+		ID:    id.String(),
+		Index: dl.FleetServerStatus,
+		Body:  body,
+	}})
+	return nil
+}
@@ -6,6 +6,8 @@ package testing
 
 import (
 	"context"
+	"fmt"
+	"strings"
 
 	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/rs/zerolog"
@@ -75,6 +77,11 @@ func (m *MockBulk) MDelete(ctx context.Context, ops []bulk.MultiOp, opts ...bulk
 	return args.Get(0).([]bulk.BulkIndexerResponseItem), args.Error(1)
 }
 
+func (m *MockBulk) MRead(ctx context.Context, index string, ids []string, opts ...bulk.Opt) ([]bulk.MReadResult, error) {
+	args := m.Called(ctx, index, ids, opts)
+	return args.Get(0).([]bulk.MReadResult), args.Error(1)
+}
+
 func (m *MockBulk) Search(ctx context.Context, index string, body []byte, opts ...bulk.Opt) (*es.ResultT, error) {
 	args := m.Called(ctx, index, body, opts)
 	return args.Get(0).(*es.ResultT), args.Error(1)
@@ -108,9 +115,13 @@ func (m *MockBulk) CancelFn() context.CancelFunc {
 	return args.Get(0).(context.CancelFunc)
 }
 
+// ReadSecrets returns the value <id>_value for each secret, secrets with an ID prefixed with missing are not found.
 func (m *MockBulk) ReadSecrets(ctx context.Context, secretIds []string) (map[string]string, error) {
 	result := make(map[string]string)
 	for _, id := range secretIds {
+		if strings.HasPrefix(id, "missing") {
+			return nil, fmt.Errorf("%w: %s", bulk.ErrSecretNotFound, id)
+		}
 		result[id] = id + "_value"
 	}
 	return result, nil
@@ -131,11 +142,20 @@ func (m *MockBulk) APIKeyAuth(ctx context.Context, key bulk.APIKey) (*bulk.Secur
 	return args.Get(0).(*bulk.SecurityInfo), args.Error(1)
 }
 
+func (m *MockBulk) ServiceTokenAuth(ctx context.Context, token string) (*bulk.SecurityInfo, error) {
+	args := m.Called(ctx, token)
+	return args.Get(0).(*bulk.SecurityInfo), args.Error(1)
+}
+
 func (m *MockBulk) APIKeyInvalidate(ctx context.Context, ids ...string) error {
 	args := m.Called(ctx, ids)
 	return args.Error(0)
 }
 
+func (m *MockBulk) APIKeyInvalidateAsync(ids ...string) {
+	m.Called(ids)
+}
+
 func (m *MockBulk) APIKeyUpdate(ctx context.Context, id, outputPolicyHash string, roles []byte) error {
 	args := m.Called(ctx, id)
 	return args.Error(0)
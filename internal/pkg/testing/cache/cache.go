@@ -5,6 +5,9 @@
 package cache
 
 import (
+	"io"
+	"time"
+
 	corecache "github.com/elastic/fleet-server/v7/internal/pkg/cache"
 	"github.com/elastic/fleet-server/v7/internal/pkg/config"
 	"github.com/elastic/fleet-server/v7/internal/pkg/file"
@@ -34,6 +37,16 @@ func (m *MockCache) GetAction(id string) (model.Action, bool) {
 	return args.Get(0).(model.Action), args.Bool(1)
 }
 
+func (m *MockCache) SetActionResults(agentID string, acked map[string]bool, ttl time.Duration) {
+	m.Called(agentID, acked, ttl)
+}
+
+func (m *MockCache) GetActionResults(agentID string) (map[string]bool, bool) {
+	args := m.Called(agentID)
+	acked, _ := args.Get(0).(map[string]bool)
+	return acked, args.Bool(1)
+}
+
 func (m *MockCache) SetAPIKey(key corecache.APIKey, enabled bool) {
 	m.Called(key, enabled)
 }
@@ -43,8 +56,21 @@ func (m *MockCache) ValidAPIKey(key corecache.APIKey) bool {
 	return args.Bool(0)
 }
 
-func (m *MockCache) SetEnrollmentAPIKey(id string, key model.EnrollmentAPIKey, cost int64) {
-	m.Called(id, key, cost)
+func (m *MockCache) DeleteAPIKey(id string) {
+	m.Called(id)
+}
+
+func (m *MockCache) SetUnauthorizedAPIKey(key corecache.APIKey) {
+	m.Called(key)
+}
+
+func (m *MockCache) UnauthorizedAPIKey(key corecache.APIKey) bool {
+	args := m.Called(key)
+	return args.Bool(0)
+}
+
+func (m *MockCache) SetEnrollmentAPIKey(id string, key model.EnrollmentAPIKey) {
+	m.Called(id, key)
 }
 
 func (m *MockCache) GetEnrollmentAPIKey(id string) (model.EnrollmentAPIKey, bool) {
@@ -52,13 +78,28 @@ func (m *MockCache) GetEnrollmentAPIKey(id string) (model.EnrollmentAPIKey, bool
 	return args.Get(0).(model.EnrollmentAPIKey), args.Bool(1)
 }
 
+func (m *MockCache) DeleteEnrollmentAPIKey(id string) {
+	m.Called(id)
+}
+
 func (m *MockCache) SetArtifact(artifact model.Artifact) {
 	m.Called(artifact)
 }
 
-func (m *MockCache) GetArtifact(ident, sha2 string) (model.Artifact, bool) {
+// LoadArtifact reads the body from r, the call is only recorded, with the body that was read, if r succeeds.
+func (m *MockCache) LoadArtifact(artifact model.Artifact, r io.Reader) (corecache.Artifact, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return corecache.Artifact{}, err
+	}
+	artifact.Body = body
+	m.Called(artifact)
+	return corecache.Artifact{Artifact: artifact}, nil
+}
+
+func (m *MockCache) GetArtifact(ident, sha2 string) (corecache.Artifact, bool, bool) {
 	args := m.Called(ident, sha2)
-	return args.Get(0).(model.Artifact), args.Bool(1)
+	return args.Get(0).(corecache.Artifact), args.Bool(1), args.Bool(2)
 }
 
 func (m *MockCache) SetUpload(id string, info file.Info) {
@@ -114,8 +114,14 @@ func GenCert(t *testing.T, ca tls.Certificate) tls.Certificate {
 	t.Helper()
 	ts := time.Now().UTC()
 
+	// A random serial number tells apart the certificates generated by a test, for example when they are rotated.
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("fail to generate serial number: %v", err)
+	}
+
 	cert := &x509.Certificate{
-		SerialNumber: big.NewInt(2000),
+		SerialNumber: serial,
 
 		// Subject Alternative Name fields
 		IPAddresses: []net.IP{{127, 0, 0, 1}, {0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
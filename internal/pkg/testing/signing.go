@@ -0,0 +1,28 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package testing
+
+import "github.com/elastic/fleet-server/v7/internal/pkg/model"
+
+// SigningPublicKey is the base64 encoded PKIX DER ECDSA P-256 public key SignedPolicy and SignedAction are signed with.
+const SigningPublicKey = "MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEdVNHj79XPe3l+uBYBzzpnaOfhjlKt197we8bkDo2pmmObM3iPY9Z57P0ha1qAxaknOg+rcrAG8Z+33v0/nSu6g=="
+
+// SignedPolicy is the signed block of the policy policy-1, the data is
+// {"id":"policy-1","agent":{"protection":{"enabled":true,"uninstall_token_hash":"","signing_key":""}}}.
+func SignedPolicy() *model.Signed {
+	return &model.Signed{
+		Data:      "eyJpZCI6InBvbGljeS0xIiwiYWdlbnQiOnsicHJvdGVjdGlvbiI6eyJlbmFibGVkIjp0cnVlLCJ1bmluc3RhbGxfdG9rZW5faGFzaCI6IiIsInNpZ25pbmdfa2V5IjoiIn19fQ==",
+		Signature: "MEYCIQC3w5zPcM27iYpi7T4Pv5X6boOs6aA1nCYay6YcYYM7PgIhAL2VVk4tPH7qDWtemIzQaUKDWoox/7gWBKx7XA/X+VRx",
+	}
+}
+
+// SignedAction is the signed block of the action action-1, the data is
+// {"action_id":"action-1","type":"UNENROLL","agents":["agent-1"],"@timestamp":"2024-07-01T12:00:00.000Z"}.
+func SignedAction() *model.Signed {
+	return &model.Signed{
+		Data:      "eyJhY3Rpb25faWQiOiJhY3Rpb24tMSIsInR5cGUiOiJVTkVOUk9MTCIsImFnZW50cyI6WyJhZ2VudC0xIl0sIkB0aW1lc3RhbXAiOiIyMDI0LTA3LTAxVDEyOjAwOjAwLjAwMFoifQ==",
+		Signature: "MEYCIQCKnwDggJIIjWSiC57l3uV1n5KkuQmGc/HpSDCgDKzh6AIhALihhHPx5uMJvgleteaN47zMLLVN6Va51tar1lZ2VUyw",
+	}
+}
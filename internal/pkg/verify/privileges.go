@@ -0,0 +1,157 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package verify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+)
+
+// fleetIndicesPattern matches the system indices fleet-server reads and writes.
+const fleetIndicesPattern = ".fleet-*"
+
+// requiredClusterPrivileges are needed to check the Elasticsearch version and to manage the API keys of the agents.
+var requiredClusterPrivileges = []string{"monitor", "manage_own_api_key"}
+
+// requiredIndexPrivileges are needed on fleetIndicesPattern.
+var requiredIndexPrivileges = []string{"read", "write"}
+
+// requiredIndices are created by the Fleet setup in Kibana, fleet-server can not run without them.
+var requiredIndices = []string{dl.FleetPolicies, dl.FleetEnrollmentAPIKeys}
+
+type hasPrivilegesRequest struct {
+	Cluster []string               `json:"cluster"`
+	Index   []indexPrivilegesCheck `json:"index"`
+}
+
+type indexPrivilegesCheck struct {
+	Names                  []string `json:"names"`
+	Privileges             []string `json:"privileges"`
+	AllowRestrictedIndices bool     `json:"allow_restricted_indices"`
+}
+
+type hasPrivilegesResponse struct {
+	Username     string                     `json:"username"`
+	HasAll       bool                       `json:"has_all_requested"`
+	Cluster      map[string]bool            `json:"cluster"`
+	Index        map[string]map[string]bool `json:"index"`
+	ErrorMessage json.RawMessage            `json:"error,omitempty"`
+}
+
+func checkPrivileges(ctx context.Context, r *Report, esCli *elasticsearch.Client) error {
+	resp, err := hasPrivileges(ctx, esCli)
+	if err != nil {
+		r.fail(CheckPrivileges, esHint(err, "check that Elasticsearch is reachable"), err)
+		return err
+	}
+
+	missing := missingPrivileges(resp)
+	if len(missing) > 0 {
+		err := fmt.Errorf("%s is missing privileges: %s", resp.Username, strings.Join(missing, "; "))
+		r.fail(CheckPrivileges, "use a service token of the elastic/fleet-server service account", err)
+		return err
+	}
+	r.pass(CheckPrivileges, "%s has the required privileges", resp.Username)
+	return nil
+}
+
+func hasPrivileges(ctx context.Context, esCli *elasticsearch.Client) (*hasPrivilegesResponse, error) {
+	body, err := json.Marshal(hasPrivilegesRequest{
+		Cluster: requiredClusterPrivileges,
+		Index: []indexPrivilegesCheck{{
+			Names:                  []string{fleetIndicesPattern},
+			Privileges:             requiredIndexPrivileges,
+			AllowRestrictedIndices: true,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req := esapi.SecurityHasPrivilegesRequest{Body: bytes.NewReader(body)}
+	res, err := req.Do(ctx, esCli)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var resp hasPrivilegesResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("decode has privileges response: %w", err)
+	}
+	if err := es.TranslateError(res.StatusCode, resp.ErrorMessage); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// missingPrivileges returns the required privileges that are not granted, sorted.
+func missingPrivileges(resp *hasPrivilegesResponse) []string {
+	if resp.HasAll {
+		return nil
+	}
+	var missing []string
+	for _, priv := range requiredClusterPrivileges {
+		if !resp.Cluster[priv] {
+			missing = append(missing, "cluster "+priv)
+		}
+	}
+	for _, priv := range requiredIndexPrivileges {
+		if !resp.Index[fleetIndicesPattern][priv] {
+			missing = append(missing, fmt.Sprintf("index %s on %s", priv, fleetIndicesPattern))
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+func checkIndices(ctx context.Context, r *Report, esCli *elasticsearch.Client) {
+	var missing []string
+	for _, index := range requiredIndices {
+		exists, err := indexExists(ctx, esCli, index)
+		if err != nil {
+			r.fail(CheckIndices, esHint(err, "check that Elasticsearch is reachable"), fmt.Errorf("index %s: %w", index, err))
+			return
+		}
+		if !exists {
+			missing = append(missing, index)
+		}
+	}
+	if len(missing) > 0 {
+		r.fail(CheckIndices, "set up Fleet in Kibana and add a policy with the Fleet Server integration",
+			fmt.Errorf("missing fleet indices: %s", strings.Join(missing, ", ")))
+		return
+	}
+	r.pass(CheckIndices, "fleet indices exist: %s", strings.Join(requiredIndices, ", "))
+}
+
+func indexExists(ctx context.Context, esCli *elasticsearch.Client, index string) (bool, error) {
+	req := esapi.IndicesExistsRequest{Index: []string{index}}
+	res, err := req.Do(ctx, esCli)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, es.TranslateError(res.StatusCode, nil)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+// Package verify checks that a fleet-server configuration is usable before the server is started with it.
+package verify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/elastic/elastic-agent-libs/transport/tlscommon"
+	"github.com/elastic/go-elasticsearch/v8"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/build"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/ver"
+)
+
+// Status is the outcome of a check.
+type Status string
+
+const (
+	StatusPass Status = "pass"
+	StatusFail Status = "fail"
+	// StatusSkip is reported for the checks that depend on a check that failed.
+	StatusSkip Status = "skip"
+)
+
+// Check names.
+const (
+	CheckConfig        = "config"
+	CheckServerTLS     = "server_tls"
+	CheckElasticsearch = "elasticsearch"
+	CheckPrivileges    = "privileges"
+	CheckIndices       = "indices"
+)
+
+// Result is the outcome of a single check, Hint tells the operator how to fix a failure.
+type Result struct {
+	Name    string `json:"name"`
+	Status  Status `json:"status"`
+	Message string `json:"message"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+// Report holds the results of all checks in the order they ran.
+type Report struct {
+	Passed bool     `json:"passed"`
+	Checks []Result `json:"checks"`
+}
+
+func (r *Report) pass(name, format string, args ...interface{}) {
+	r.Checks = append(r.Checks, Result{Name: name, Status: StatusPass, Message: fmt.Sprintf(format, args...)})
+}
+
+func (r *Report) fail(name, hint string, err error) {
+	r.Passed = false
+	r.Checks = append(r.Checks, Result{Name: name, Status: StatusFail, Message: err.Error(), Hint: hint})
+}
+
+func (r *Report) skip(names ...string) {
+	for _, name := range names {
+		r.Checks = append(r.Checks, Result{Name: name, Status: StatusSkip, Message: "skipped, a previous check failed"})
+	}
+}
+
+// Write prints the report as one line per check, followed by the hint of the failed checks.
+func (r *Report) Write(w io.Writer) error {
+	var b strings.Builder
+	for _, res := range r.Checks {
+		fmt.Fprintf(&b, "%-4s  %-13s  %s\n", strings.ToUpper(string(res.Status)), res.Name, res.Message)
+		if res.Hint != "" {
+			fmt.Fprintf(&b, "%-4s  %-13s  hint: %s\n", "", "", res.Hint)
+		}
+	}
+	if r.Passed {
+		b.WriteString("\nAll checks passed.\n")
+	} else {
+		b.WriteString("\nVerification failed.\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteJSON prints the report as a JSON document.
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// Run loads the configuration with load, then checks the TLS material of the server, the connection to
+// Elasticsearch, the privileges of the configured credentials and the fleet indices.
+// The checks that depend on a failed check are skipped.
+func Run(ctx context.Context, bi build.Info, load func() (*config.Config, error)) *Report {
+	r := &Report{Passed: true}
+
+	cfg, err := load()
+	if err != nil {
+		r.fail(CheckConfig, "fix the configuration file or the -E overrides", err)
+		r.skip(CheckServerTLS, CheckElasticsearch, CheckPrivileges, CheckIndices)
+		return r
+	}
+	r.pass(CheckConfig, "configuration loaded")
+
+	checkServerTLS(r, cfg)
+
+	esCli, err := checkElasticsearch(ctx, r, bi, cfg)
+	if err != nil {
+		r.skip(CheckPrivileges, CheckIndices)
+		return r
+	}
+	if err := checkPrivileges(ctx, r, esCli); err != nil {
+		r.skip(CheckIndices)
+		return r
+	}
+	checkIndices(ctx, r, esCli)
+	return r
+}
+
+func checkServerTLS(r *Report, cfg *config.Config) {
+	if len(cfg.Inputs) == 0 {
+		r.pass(CheckServerTLS, "no server input configured")
+		return
+	}
+	tlsCfg := cfg.Inputs[0].Server.TLS
+	if tlsCfg == nil || !tlsCfg.IsEnabled() {
+		r.pass(CheckServerTLS, "TLS is disabled")
+		return
+	}
+	if _, err := tlscommon.LoadTLSServerConfig(tlsCfg); err != nil {
+		r.fail(CheckServerTLS, "check the certificate, key and certificate_authorities under inputs.server.ssl", err)
+		return
+	}
+	r.pass(CheckServerTLS, "certificate and key loaded")
+}
+
+func checkElasticsearch(ctx context.Context, r *Report, bi build.Info, cfg *config.Config) (*elasticsearch.Client, error) {
+	esCli, err := es.NewClient(ctx, cfg, false, es.WithUserAgent(build.ServiceName, bi))
+	if err != nil {
+		r.fail(CheckElasticsearch, "check the hosts and ssl settings under output.elasticsearch", err)
+		return nil, err
+	}
+	esVersion, err := ver.CheckCompatibility(ctx, esCli, bi.Version)
+	if err != nil {
+		hint := esHint(err, "check that Elasticsearch is reachable at output.elasticsearch.hosts with the configured ssl settings")
+		if esVersion != "" {
+			hint = fmt.Sprintf("upgrade Elasticsearch to at least the version of fleet-server %s", bi.Version)
+			err = fmt.Errorf("Elasticsearch %s: %w", esVersion, err)
+		}
+		r.fail(CheckElasticsearch, hint, err)
+		return nil, err
+	}
+	r.pass(CheckElasticsearch, "connected to Elasticsearch %s", esVersion)
+	return esCli, nil
+}
+
+// esHint returns the hint for a failed Elasticsearch request, hint if the failure is not specific.
+func esHint(err error, hint string) string {
+	var esErr *es.ErrElastic
+	if errors.As(err, &esErr) && esErr.Status == http.StatusUnauthorized {
+		return "check output.elasticsearch.service_token, the token may be invalid or revoked"
+	}
+	return hint
+}
@@ -0,0 +1,62 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build integration
+
+package verify
+
+import (
+	"context"
+	"testing"
+
+	"github.com/elastic/go-ucfg/yaml"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/build"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+	"github.com/elastic/fleet-server/v7/version"
+)
+
+func loadConfig(token string) func() (*config.Config, error) {
+	return func() (*config.Config, error) {
+		c, err := yaml.NewConfig([]byte(`
+output:
+  elasticsearch:
+    hosts: '${ELASTICSEARCH_HOSTS:localhost:9200}'
+    service_token: '`+token+`'
+`), config.DefaultOptions...)
+		if err != nil {
+			return nil, err
+		}
+		return config.FromConfig(c)
+	}
+}
+
+func checkStatus(r *Report, name string) Status {
+	for _, res := range r.Checks {
+		if res.Name == name {
+			return res.Status
+		}
+	}
+	return ""
+}
+
+func TestRunIntegration(t *testing.T) {
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	bi := build.Info{Version: version.DefaultVersion}
+
+	t.Run("service token", func(t *testing.T) {
+		r := Run(ctx, bi, loadConfig("${ELASTICSEARCH_SERVICE_TOKEN}"))
+		assert.Equal(t, StatusPass, checkStatus(r, CheckConfig), r.Checks)
+		assert.Equal(t, StatusPass, checkStatus(r, CheckElasticsearch), r.Checks)
+		assert.Equal(t, StatusPass, checkStatus(r, CheckPrivileges), r.Checks)
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		r := Run(ctx, bi, loadConfig("invalid"))
+		assert.False(t, r.Passed)
+		assert.Equal(t, StatusFail, checkStatus(r, CheckElasticsearch), r.Checks)
+	})
+}
@@ -0,0 +1,189 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+
+package verify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/build"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	testlog "github.com/elastic/fleet-server/v7/internal/pkg/testing/log"
+)
+
+// fakeES answers the requests of the checks.
+type fakeES struct {
+	version    string
+	authorized bool
+	privileges hasPrivilegesResponse
+	indices    map[string]bool
+}
+
+func newFakeES() *fakeES {
+	return &fakeES{
+		version:    "8.15.0",
+		authorized: true,
+		privileges: hasPrivilegesResponse{
+			Username: "elastic/fleet-server",
+			HasAll:   true,
+			Cluster:  map[string]bool{"monitor": true, "manage_own_api_key": true},
+			Index:    map[string]map[string]bool{fleetIndicesPattern: {"read": true, "write": true}},
+		},
+		indices: map[string]bool{dl.FleetPolicies: true, dl.FleetEnrollmentAPIKeys: true},
+	}
+}
+
+func (f *fakeES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+	if !f.authorized {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":{"type":"security_exception","reason":"unable to authenticate with provided credentials"},"status":401}`)
+		return
+	}
+	switch {
+	case r.URL.Path == "/":
+		fmt.Fprintf(w, `{"version":{"number":%q}}`, f.version)
+	case r.URL.Path == "/_security/user/_has_privileges":
+		_ = json.NewEncoder(w).Encode(f.privileges)
+	case r.Method == http.MethodHead:
+		if !f.indices[r.URL.Path[1:]] {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func runAgainst(t *testing.T, f *fakeES) *Report {
+	t.Helper()
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	ctx := testlog.SetLogger(t).WithContext(context.Background())
+	return Run(ctx, build.Info{Version: "8.15.0"}, func() (*config.Config, error) {
+		return &config.Config{
+			Output: config.Output{
+				Elasticsearch: config.Elasticsearch{
+					Protocol: "http",
+					Hosts:    []string{srv.URL},
+				},
+			},
+		}, nil
+	})
+}
+
+func statuses(r *Report) map[string]Status {
+	m := make(map[string]Status, len(r.Checks))
+	for _, res := range r.Checks {
+		m[res.Name] = res.Status
+	}
+	return m
+}
+
+func TestRun(t *testing.T) {
+	t.Run("all checks pass", func(t *testing.T) {
+		r := runAgainst(t, newFakeES())
+		assert.True(t, r.Passed)
+		assert.Equal(t, map[string]Status{
+			CheckConfig:        StatusPass,
+			CheckServerTLS:     StatusPass,
+			CheckElasticsearch: StatusPass,
+			CheckPrivileges:    StatusPass,
+			CheckIndices:       StatusPass,
+		}, statuses(r))
+	})
+
+	t.Run("config error", func(t *testing.T) {
+		ctx := testlog.SetLogger(t).WithContext(context.Background())
+		r := Run(ctx, build.Info{Version: "8.15.0"}, func() (*config.Config, error) {
+			return nil, errors.New("missing field accessing 'output.elasticsearch.hosts'")
+		})
+		assert.False(t, r.Passed)
+		require.Len(t, r.Checks, 5)
+		assert.Equal(t, StatusFail, r.Checks[0].Status)
+		for _, res := range r.Checks[1:] {
+			assert.Equal(t, StatusSkip, res.Status, res.Name)
+		}
+	})
+
+	t.Run("incompatible version", func(t *testing.T) {
+		f := newFakeES()
+		f.version = "8.14.0"
+		r := runAgainst(t, f)
+		assert.False(t, r.Passed)
+		require.Len(t, r.Checks, 5)
+		assert.Equal(t, StatusFail, r.Checks[2].Status)
+		assert.Contains(t, r.Checks[2].Message, "Elasticsearch 8.14.0")
+		assert.Contains(t, r.Checks[2].Hint, "upgrade Elasticsearch")
+		assert.Equal(t, StatusSkip, statuses(r)[CheckPrivileges])
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		f := newFakeES()
+		f.authorized = false
+		r := runAgainst(t, f)
+		assert.False(t, r.Passed)
+		assert.Equal(t, StatusFail, r.Checks[2].Status)
+		assert.Contains(t, r.Checks[2].Hint, "service_token")
+	})
+
+	t.Run("missing privileges", func(t *testing.T) {
+		f := newFakeES()
+		f.privileges.HasAll = false
+		f.privileges.Cluster["manage_own_api_key"] = false
+		f.privileges.Index[fleetIndicesPattern]["write"] = false
+		r := runAgainst(t, f)
+		assert.False(t, r.Passed)
+		require.Len(t, r.Checks, 5)
+		assert.Equal(t, StatusFail, r.Checks[3].Status)
+		assert.Equal(t, "elastic/fleet-server is missing privileges: cluster manage_own_api_key; index write on .fleet-*", r.Checks[3].Message)
+		assert.Equal(t, StatusSkip, r.Checks[4].Status)
+	})
+
+	t.Run("missing indices", func(t *testing.T) {
+		f := newFakeES()
+		delete(f.indices, dl.FleetPolicies)
+		r := runAgainst(t, f)
+		assert.False(t, r.Passed)
+		assert.Equal(t, StatusFail, r.Checks[4].Status)
+		assert.Equal(t, "missing fleet indices: .fleet-policies", r.Checks[4].Message)
+	})
+}
+
+func TestReportWrite(t *testing.T) {
+	r := &Report{Passed: true}
+	r.pass(CheckConfig, "configuration loaded")
+	r.fail(CheckElasticsearch, "check the hosts", errors.New("connection refused"))
+	r.skip(CheckPrivileges)
+
+	var buf bytes.Buffer
+	require.NoError(t, r.Write(&buf))
+	assert.Equal(t, `PASS  config         configuration loaded
+FAIL  elasticsearch  connection refused
+                     hint: check the hosts
+SKIP  privileges     skipped, a previous check failed
+
+Verification failed.
+`, buf.String())
+
+	buf.Reset()
+	require.NoError(t, r.WriteJSON(&buf))
+	var decoded Report
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, *r, decoded)
+}
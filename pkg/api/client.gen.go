@@ -1140,6 +1140,7 @@ type AgentEnrollResponse struct {
 	JSON400      *BadRequest
 	JSON401      *KeyNotEnabled
 	JSON408      *Deadline
+	JSON413      *BodyTooLarge
 	JSON500      *InternalServerError
 	JSON503      *Unavailable
 }
@@ -1169,6 +1170,7 @@ type AgentAcksResponse struct {
 	JSON403      *Forbidden
 	JSON404      *AgentNotFound
 	JSON408      *Deadline
+	JSON413      *BodyTooLarge
 	JSON500      *InternalServerError
 	JSON503      *Unavailable
 }
@@ -1198,6 +1200,7 @@ type AgentCheckinResponse struct {
 	JSON403      *Forbidden
 	JSON404      *AgentNotFound
 	JSON408      *Deadline
+	JSON413      *BodyTooLarge
 	JSON500      *InternalServerError
 	JSON503      *Unavailable
 }
@@ -1280,6 +1283,7 @@ type UploadBeginResponse struct {
 	JSON401      *KeyNotEnabled
 	JSON403      *Forbidden
 	JSON408      *Deadline
+	JSON413      *BodyTooLarge
 	JSON500      *InternalServerError
 	JSON503      *Unavailable
 }
@@ -1310,6 +1314,7 @@ type UploadCompleteResponse struct {
 	JSON401 *KeyNotEnabled
 	JSON403 *Forbidden
 	JSON408 *Deadline
+	JSON413 *BodyTooLarge
 	JSON500 *InternalServerError
 	JSON503 *Unavailable
 }
@@ -1337,6 +1342,7 @@ type UploadChunkResponse struct {
 	JSON401      *KeyNotEnabled
 	JSON403      *Forbidden
 	JSON408      *Deadline
+	JSON413      *BodyTooLarge
 	JSON500      *InternalServerError
 	JSON503      *Unavailable
 }
@@ -1586,6 +1592,13 @@ func ParseAgentEnrollResponse(rsp *http.Response) (*AgentEnrollResponse, error)
 		}
 		response.JSON408 = &dest
 
+	case strings.Contains(rsp.Header.Get("Content-Type"), "json") && rsp.StatusCode == 413:
+		var dest BodyTooLarge
+		if err := json.Unmarshal(bodyBytes, &dest); err != nil {
+			return nil, err
+		}
+		response.JSON413 = &dest
+
 	case strings.Contains(rsp.Header.Get("Content-Type"), "json") && rsp.StatusCode == 500:
 		var dest InternalServerError
 		if err := json.Unmarshal(bodyBytes, &dest); err != nil {
@@ -1661,6 +1674,13 @@ func ParseAgentAcksResponse(rsp *http.Response) (*AgentAcksResponse, error) {
 		}
 		response.JSON408 = &dest
 
+	case strings.Contains(rsp.Header.Get("Content-Type"), "json") && rsp.StatusCode == 413:
+		var dest BodyTooLarge
+		if err := json.Unmarshal(bodyBytes, &dest); err != nil {
+			return nil, err
+		}
+		response.JSON413 = &dest
+
 	case strings.Contains(rsp.Header.Get("Content-Type"), "json") && rsp.StatusCode == 500:
 		var dest InternalServerError
 		if err := json.Unmarshal(bodyBytes, &dest); err != nil {
@@ -1736,6 +1756,13 @@ func ParseAgentCheckinResponse(rsp *http.Response) (*AgentCheckinResponse, error
 		}
 		response.JSON408 = &dest
 
+	case strings.Contains(rsp.Header.Get("Content-Type"), "json") && rsp.StatusCode == 413:
+		var dest BodyTooLarge
+		if err := json.Unmarshal(bodyBytes, &dest); err != nil {
+			return nil, err
+		}
+		response.JSON413 = &dest
+
 	case strings.Contains(rsp.Header.Get("Content-Type"), "json") && rsp.StatusCode == 500:
 		var dest InternalServerError
 		if err := json.Unmarshal(bodyBytes, &dest); err != nil {
@@ -1926,6 +1953,13 @@ func ParseUploadBeginResponse(rsp *http.Response) (*UploadBeginResponse, error)
 		}
 		response.JSON408 = &dest
 
+	case strings.Contains(rsp.Header.Get("Content-Type"), "json") && rsp.StatusCode == 413:
+		var dest BodyTooLarge
+		if err := json.Unmarshal(bodyBytes, &dest); err != nil {
+			return nil, err
+		}
+		response.JSON413 = &dest
+
 	case strings.Contains(rsp.Header.Get("Content-Type"), "json") && rsp.StatusCode == 500:
 		var dest InternalServerError
 		if err := json.Unmarshal(bodyBytes, &dest); err != nil {
@@ -1996,6 +2030,13 @@ func ParseUploadCompleteResponse(rsp *http.Response) (*UploadCompleteResponse, e
 		}
 		response.JSON408 = &dest
 
+	case strings.Contains(rsp.Header.Get("Content-Type"), "json") && rsp.StatusCode == 413:
+		var dest BodyTooLarge
+		if err := json.Unmarshal(bodyBytes, &dest); err != nil {
+			return nil, err
+		}
+		response.JSON413 = &dest
+
 	case strings.Contains(rsp.Header.Get("Content-Type"), "json") && rsp.StatusCode == 500:
 		var dest InternalServerError
 		if err := json.Unmarshal(bodyBytes, &dest); err != nil {
@@ -2057,6 +2098,13 @@ func ParseUploadChunkResponse(rsp *http.Response) (*UploadChunkResponse, error)
 		}
 		response.JSON408 = &dest
 
+	case strings.Contains(rsp.Header.Get("Content-Type"), "json") && rsp.StatusCode == 413:
+		var dest BodyTooLarge
+		if err := json.Unmarshal(bodyBytes, &dest); err != nil {
+			return nil, err
+		}
+		response.JSON413 = &dest
+
 	case strings.Contains(rsp.Header.Get("Content-Type"), "json") && rsp.StatusCode == 500:
 		var dest InternalServerError
 		if err := json.Unmarshal(bodyBytes, &dest); err != nil {
@@ -287,6 +287,11 @@ type CheckinRequest struct {
 	// Status The agent state, inferred from agent control protocol states.
 	Status CheckinRequestStatus `json:"status"`
 
+	// Tags An optional list of tags that replaces the tags of the agent record if it differs.
+	// The actions intended for any of the tags are delivered to the agent from then on.
+	// More than 32 tags, or a tag longer than 256 characters, is rejected with a 400.
+	Tags *[]string `json:"tags,omitempty"`
+
 	// UpgradeDetails Additional details describing the status of an UPGRADE action delivered by the client (agent) on checkin.
 	UpgradeDetails *UpgradeDetails `json:"upgrade_details,omitempty"`
 }
@@ -311,6 +316,10 @@ type DiagnosticsEvent struct {
 	// ActionId The action ID.
 	ActionId string `json:"action_id"`
 
+	// ActionResponse An optional payload with the output of the action, such as the output of a response action.
+	// It is stored in the action result, a payload larger than server.action_results.max_response_size is truncated.
+	ActionResponse json.RawMessage `json:"action_response,omitempty"`
+
 	// AgentId The ID of the agent that executed the action.
 	AgentId string `json:"agent_id"`
 	Data    *struct {
@@ -359,6 +368,7 @@ type EnrollMetadata struct {
 
 	// Tags User provided tags for the agent.
 	// fleet-server will pass the tags to the agent record on enrollment.
+	// More than 32 tags, or a tag longer than 256 characters, is rejected with a 400.
 	Tags []string `json:"tags"`
 
 	// UserProvided An embedded JSON object that holds user-provided meta-data values.
@@ -377,9 +387,16 @@ type EnrollRequest struct {
 	// The existing agent with a matching enrollment_id will be deleted if it never checked in. The new agent will be enrolled with the enrollment_id.
 	EnrollmentId *string `json:"enrollment_id,omitempty"`
 
+	// Id The ID the agent should be enrolled with.
+	// If an agent with the ID exists, the request must have a matching replace_token. The existing agent is then replaced, its API keys are invalidated and its tags and policy are kept.
+	Id *string `json:"id,omitempty"`
+
 	// Metadata Metadata associated with the agent that is enrolling to fleet.
 	Metadata EnrollMetadata `json:"metadata"`
 
+	// ReplaceToken The token that allows the agent enrolled with the id to be replaced by a later enrollment with the same id.
+	ReplaceToken *string `json:"replace_token,omitempty"`
+
 	// SharedId The shared ID of the agent.
 	// To support pre-existing installs.
 	//
@@ -468,9 +485,20 @@ type EnrollResponseItem struct {
 
 // Error Error processing request.
 type Error struct {
+	// Code Machine-readable error code, the code of an error is stable across releases.
+	// One of ErrBadRequest, ErrUnauthorized, ErrInvalidToken, ErrForbidden, ErrAgentNotFound, ErrAgentInactive,
+	// ErrNotFound, ErrEnrollmentTokenExpired, ErrEnrollmentTokenExhausted, ErrTooManyRequests, ErrBodyTooLarge,
+	// ErrRequestTimeout, ErrRequestCanceled, ErrUnsupportedVersion, ErrAgentVersionUnsupported, ErrUploadRejected,
+	// ErrTLSRequired, ErrServiceUnavailable, ErrInternal.
+	Code *string `json:"code,omitempty"`
+
 	// Error Error type.
 	Error string `json:"error"`
 
+	// Hint (optional) How the agent recovers from the error.
+	// The hint is reenroll when the agent is inactive or its record was deleted, the agent must enroll again.
+	Hint *string `json:"hint,omitempty"`
+
 	// Message (optional) Error message.
 	Message *string `json:"message,omitempty"`
 
@@ -499,6 +527,10 @@ type GenericEvent struct {
 	// ActionId The action ID.
 	ActionId string `json:"action_id"`
 
+	// ActionResponse An optional payload with the output of the action, such as the output of a response action.
+	// It is stored in the action result, a payload larger than server.action_results.max_response_size is truncated.
+	ActionResponse json.RawMessage `json:"action_response,omitempty"`
+
 	// AgentId The ID of the agent that executed the action.
 	AgentId string `json:"agent_id"`
 
@@ -614,6 +646,12 @@ type PolicyData struct {
 
 // StatusAPIResponse Status response information.
 type StatusAPIResponse struct {
+	// Limits Effective runtime limits included in the response to an authorized status request.
+	Limits *StatusResponseLimits `json:"limits,omitempty"`
+
+	// Message Reason of the status, such as "draining" while the server is shutting down.
+	Message *string `json:"message,omitempty"`
+
 	// Name Service name.
 	Name string `json:"name"`
 
@@ -629,6 +667,57 @@ type StatusAPIResponse struct {
 // Unit state is defined in the elastic-agent-client specification.
 type StatusResponseStatus string
 
+// StatusResponseAgentLimits The agent range of the limits tier that fleet-server selected.
+type StatusResponseAgentLimits struct {
+	// Max Maximum number of agents for the tier.
+	Max int `json:"max"`
+
+	// Min Minimum number of agents for the tier.
+	Min int `json:"min"`
+}
+
+// StatusResponseCacheLimits The effective cache limits.
+type StatusResponseCacheLimits struct {
+	// MaxCost Maximum cost of the cache in bytes.
+	MaxCost int64 `json:"max_cost"`
+
+	// NumCounters Number of keys to track frequency of.
+	NumCounters int64 `json:"num_counters"`
+}
+
+// StatusResponseEndpointLimit The effective limits of an endpoint.
+type StatusResponseEndpointLimit struct {
+	// Burst Number of requests that may be made in a burst.
+	Burst int `json:"burst"`
+
+	// Interval Interval between requests as a duration, for example "10ms".
+	Interval string `json:"interval"`
+
+	// Max Maximum number of concurrent requests.
+	Max int64 `json:"max"`
+
+	// MaxBodyByteSize Maximum request body size in bytes.
+	MaxBodyByteSize int64 `json:"max_body_byte_size"`
+}
+
+// StatusResponseLimits Effective runtime limits included in the response to an authorized status request.
+type StatusResponseLimits struct {
+	// Agents The agent range of the limits tier that fleet-server selected.
+	Agents StatusResponseAgentLimits `json:"agents"`
+
+	// Cache The effective cache limits.
+	Cache StatusResponseCacheLimits `json:"cache"`
+
+	// Endpoints Endpoint limits keyed by their configuration name.
+	Endpoints map[string]StatusResponseEndpointLimit `json:"endpoints"`
+
+	// MaxConnections Maximum number of connections fleet-server accepts.
+	MaxConnections int `json:"max_connections"`
+
+	// PolicyThrottle Policy throttle as a duration.
+	PolicyThrottle string `json:"policy_throttle"`
+}
+
 // StatusResponseVersion Version information included in the response to an authorized status request.
 type StatusResponseVersion struct {
 	// BuildHash The commit that the fleet-server was built from.
@@ -646,6 +735,10 @@ type UpgradeEvent struct {
 	// ActionId The action ID.
 	ActionId string `json:"action_id"`
 
+	// ActionResponse An optional payload with the output of the action, such as the output of a response action.
+	// It is stored in the action result, a payload larger than server.action_results.max_response_size is truncated.
+	ActionResponse json.RawMessage `json:"action_response,omitempty"`
+
 	// AgentId The ID of the agent that executed the action.
 	AgentId string `json:"agent_id"`
 
@@ -818,6 +911,9 @@ type AgentNotFound = Error
 // BadRequest Error processing request.
 type BadRequest = Error
 
+// BodyTooLarge Error processing request.
+type BodyTooLarge = Error
+
 // Deadline Error processing request.
 type Deadline = Error
 
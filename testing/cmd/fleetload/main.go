@@ -0,0 +1,84 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+// fleetload enrolls synthetic agents against a running fleet-server and runs their checkin loops,
+// then prints the request counts and latency percentiles of each endpoint.
+//
+//	go run ./cmd/fleetload -url https://localhost:8220 -token <enrollment token> -agents 1000 -duration 10m
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/elastic/fleet-server/testing/fleetload"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	var (
+		cfg      fleetload.Config
+		duration time.Duration
+		caPath   string
+		insecure bool
+	)
+	flag.StringVar(&cfg.URL, "url", "https://localhost:8220", "fleet-server url")
+	flag.StringVar(&cfg.EnrollmentToken, "token", os.Getenv("FLEET_ENROLLMENT_TOKEN"), "enrollment token, defaults to $FLEET_ENROLLMENT_TOKEN")
+	flag.IntVar(&cfg.Agents, "agents", 10, "number of simulated agents")
+	flag.IntVar(&cfg.Checkins, "checkins", 0, "number of checkins of each agent, 0 checks in until the duration is over")
+	flag.DurationVar(&cfg.PollTimeout, "poll-timeout", 0, "poll_timeout sent with the checkins, 0 uses the fleet-server default")
+	flag.DurationVar(&cfg.Interval, "interval", 0, "time between two checkins of an agent")
+	flag.BoolVar(&cfg.Ack, "ack", true, "ack the actions the agents receive")
+	flag.IntVar(&cfg.Concurrency, "concurrency", 100, "max number of agents that enroll at the same time")
+	flag.StringVar(&cfg.Version, "version", "", "agent version, defaults to the fleet-server version")
+	flag.DurationVar(&duration, "duration", 5*time.Minute, "duration of the load test, 0 runs until the checkins are made or the test is interrupted")
+	flag.StringVar(&caPath, "ca", "", "path of the CA that signed the fleet-server certificate")
+	flag.BoolVar(&insecure, "insecure", false, "skip the verification of the fleet-server certificate")
+	flag.Parse()
+
+	tlsCfg := &tls.Config{InsecureSkipVerify: insecure} //nolint:gosec // the load test may target a server with a self signed certificate
+	if caPath != "" {
+		pem, err := os.ReadFile(caPath)
+		if err != nil {
+			return fmt.Errorf("unable to read CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in %s", caPath)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+	// Each agent keeps a connection open during its long poll.
+	transport.MaxIdleConnsPerHost = cfg.Agents
+	cfg.Client = &http.Client{Transport: transport}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, duration)
+		defer cancel()
+	}
+
+	report, err := fleetload.Run(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	return report.Print(os.Stdout)
+}
@@ -17,6 +17,7 @@ import (
 	"time"
 
 	"github.com/elastic/fleet-server/testing/e2e/api_version"
+	"github.com/elastic/fleet-server/testing/fleetload"
 
 	"github.com/stretchr/testify/suite"
 )
@@ -32,6 +33,33 @@ func (suite *StandAloneCurrentAPI) SetupSuite() {
 	suite.SetKey(suite.key)
 }
 
+// TestFleetLoad runs the load test with a few agents.
+func (suite *StandAloneCurrentAPI) TestFleetLoad() {
+	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Minute)
+	defer cancel()
+
+	// The first checkin returns the policy change, the second one long polls.
+	report, err := fleetload.Run(ctx, fleetload.Config{
+		URL:             suite.endpoint,
+		EnrollmentToken: suite.key,
+		Agents:          3,
+		Checkins:        2,
+		PollTimeout:     3 * time.Minute,
+		Ack:             true,
+		Client:          suite.Client,
+	})
+	suite.Require().NoError(err)
+
+	suite.Require().Equal(3, report.Endpoint(fleetload.EndpointEnroll).Requests)
+	suite.Require().Equal(6, report.Endpoint(fleetload.EndpointCheckin).Requests)
+	suite.Require().GreaterOrEqual(report.Endpoint(fleetload.EndpointAck).Requests, 3)
+	for _, endpoint := range []string{fleetload.EndpointEnroll, fleetload.EndpointCheckin, fleetload.EndpointAck} {
+		stats := report.Endpoint(endpoint)
+		suite.Require().Zerof(stats.Errors, "%s errors", endpoint)
+		suite.Require().Positivef(stats.Percentile(50), "%s latency", endpoint)
+	}
+}
+
 type StandAlone20230601API struct {
 	StandAloneAPIBase
 	api_version.ClientAPITester20230601
@@ -0,0 +1,236 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+// Package fleetload simulates agents against a running fleet-server to measure its capacity.
+// The requests are made with the generated client of the fleet-server API so a change of the
+// schema breaks the load test at compile time.
+package fleetload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/elastic/fleet-server/pkg/api"
+	"github.com/elastic/fleet-server/v7/version"
+)
+
+const (
+	EndpointEnroll  = "enroll"
+	EndpointCheckin = "checkin"
+	EndpointAck     = "ack"
+)
+
+const enrollMetadataTpl = `{"elastic":{"agent":{"version":"%s"}}}`
+
+// Config is the configuration of a load test.
+type Config struct {
+	// URL is the address of the fleet-server.
+	URL string
+	// EnrollmentToken is the enrollment API key the agents enroll with.
+	EnrollmentToken string
+	// Agents is the number of simulated agents.
+	Agents int
+	// Checkins is the number of checkins each agent makes, 0 checks in until the context is done.
+	Checkins int
+	// PollTimeout is the poll_timeout that is sent with each checkin, fleet-server uses its default if it is 0.
+	PollTimeout time.Duration
+	// Interval is the time an agent waits between two checkins.
+	Interval time.Duration
+	// Ack makes the agents ack the actions they receive.
+	Ack bool
+	// Concurrency is the max number of agents that enroll at the same time, 0 enrolls them all at once.
+	Concurrency int
+	// Version is the version the agents report, defaults to the fleet-server version.
+	Version string
+	// Client is the HTTP client used for the requests.
+	Client *http.Client
+}
+
+// Run enrolls the agents and runs their checkin loops until each agent has made its checkins, or
+// the context is done. The returned report holds the results of all the requests that were made.
+func Run(ctx context.Context, cfg Config) (*Report, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("fleet-server url is required")
+	}
+	if cfg.EnrollmentToken == "" {
+		return nil, errors.New("enrollment token is required")
+	}
+	if cfg.Agents <= 0 {
+		return nil, errors.New("agents must be greater than 0")
+	}
+	if cfg.Version == "" {
+		cfg.Version = version.DefaultVersion
+	}
+	httpClient := cfg.Client
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	client, err := api.NewClientWithResponses(cfg.URL, api.WithHTTPClient(httpClient))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create client: %w", err)
+	}
+
+	report := newReport()
+	concurrency := cfg.Concurrency
+	if concurrency <= 0 {
+		concurrency = cfg.Agents
+	}
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < cfg.Agents; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a := &agent{cfg: cfg, client: client, report: report}
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			err := a.enroll(ctx)
+			<-sem
+			if err != nil {
+				return
+			}
+			a.run(ctx)
+		}()
+	}
+	wg.Wait()
+	report.Elapsed = time.Since(start)
+	return report, nil
+}
+
+// agent is a simulated agent.
+type agent struct {
+	cfg    Config
+	client *api.ClientWithResponses
+	report *Report
+
+	id       string
+	apiKey   string
+	ackToken *string
+}
+
+func (a *agent) userAgent() string {
+	return "elastic agent " + a.cfg.Version
+}
+
+func (a *agent) auth(key string) api.RequestEditorFn {
+	return func(_ context.Context, req *http.Request) error {
+		req.Header.Set("Authorization", "ApiKey "+key)
+		return nil
+	}
+}
+
+func (a *agent) enroll(ctx context.Context) error {
+	start := time.Now()
+	resp, err := a.client.AgentEnrollWithResponse(ctx,
+		&api.AgentEnrollParams{UserAgent: a.userAgent()},
+		api.AgentEnrollJSONRequestBody{
+			Metadata: api.EnrollMetadata{
+				Local: json.RawMessage(fmt.Sprintf(enrollMetadataTpl, a.cfg.Version)),
+			},
+			Type: api.PERMANENT,
+		},
+		a.auth(a.cfg.EnrollmentToken),
+	)
+	if err == nil && resp.JSON200 == nil {
+		err = fmt.Errorf("unexpected enroll status %d", resp.StatusCode())
+	}
+	a.report.record(EndpointEnroll, time.Since(start), err)
+	if err != nil {
+		return err
+	}
+	a.id = resp.JSON200.Item.Id
+	a.apiKey = resp.JSON200.Item.AccessApiKey
+	return nil
+}
+
+// run checks in until the agent made its checkins or the context is done.
+func (a *agent) run(ctx context.Context) {
+	for n := 0; a.cfg.Checkins == 0 || n < a.cfg.Checkins; n++ {
+		if n > 0 && a.cfg.Interval > 0 {
+			select {
+			case <-time.After(a.cfg.Interval):
+			case <-ctx.Done():
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		actions, err := a.checkin(ctx)
+		if err != nil || !a.cfg.Ack || len(actions) == 0 {
+			continue
+		}
+		_ = a.ack(ctx, actions)
+	}
+}
+
+func (a *agent) checkin(ctx context.Context) ([]api.Action, error) {
+	body := api.AgentCheckinJSONRequestBody{
+		AckToken: a.ackToken,
+		Status:   api.CheckinRequestStatusOnline,
+		Message:  "fleetload checkin",
+	}
+	if a.cfg.PollTimeout > 0 {
+		pollTimeout := a.cfg.PollTimeout.String()
+		body.PollTimeout = &pollTimeout
+	}
+
+	start := time.Now()
+	resp, err := a.client.AgentCheckinWithResponse(ctx, a.id, &api.AgentCheckinParams{UserAgent: a.userAgent()}, body, a.auth(a.apiKey))
+	if err == nil && resp.JSON200 == nil {
+		err = fmt.Errorf("unexpected checkin status %d", resp.StatusCode())
+	}
+	if errors.Is(err, context.Canceled) {
+		// A long poll interrupted at the end of the test is not an error.
+		return nil, err
+	}
+	a.report.record(EndpointCheckin, time.Since(start), err)
+	if err != nil {
+		return nil, err
+	}
+	if resp.JSON200.AckToken != nil {
+		a.ackToken = resp.JSON200.AckToken
+	}
+	if resp.JSON200.Actions == nil {
+		return nil, nil
+	}
+	return *resp.JSON200.Actions, nil
+}
+
+func (a *agent) ack(ctx context.Context, actions []api.Action) error {
+	events := make([]api.AckRequest_Events_Item, 0, len(actions))
+	for _, action := range actions {
+		event := api.AckRequest_Events_Item{}
+		if err := event.FromGenericEvent(api.GenericEvent{
+			ActionId: action.Id,
+			AgentId:  a.id,
+		}); err != nil {
+			return err
+		}
+		events = append(events, event)
+	}
+
+	start := time.Now()
+	resp, err := a.client.AgentAcksWithResponse(ctx, a.id, &api.AgentAcksParams{}, api.AgentAcksJSONRequestBody{Events: events}, a.auth(a.apiKey))
+	if err == nil {
+		switch {
+		case resp.JSON200 == nil:
+			err = fmt.Errorf("unexpected ack status %d", resp.StatusCode())
+		case resp.JSON200.Errors:
+			err = errors.New("ack response has errors")
+		}
+	}
+	a.report.record(EndpointAck, time.Since(start), err)
+	return err
+}
@@ -0,0 +1,92 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package fleetload
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Report holds the results of the requests made during a load test.
+type Report struct {
+	// Elapsed is the duration of the load test.
+	Elapsed time.Duration
+
+	mx        sync.Mutex
+	endpoints map[string]*EndpointStats
+}
+
+// EndpointStats are the results of the requests made to an endpoint.
+type EndpointStats struct {
+	Requests  int
+	Errors    int
+	latencies []time.Duration
+}
+
+func newReport() *Report {
+	return &Report{endpoints: make(map[string]*EndpointStats)}
+}
+
+func (r *Report) record(endpoint string, latency time.Duration, err error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	stats, ok := r.endpoints[endpoint]
+	if !ok {
+		stats = &EndpointStats{}
+		r.endpoints[endpoint] = stats
+	}
+	stats.Requests++
+	if err != nil {
+		stats.Errors++
+		return
+	}
+	stats.latencies = append(stats.latencies, latency)
+}
+
+// Endpoint returns the results of the requests made to the endpoint.
+func (r *Report) Endpoint(endpoint string) EndpointStats {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	stats, ok := r.endpoints[endpoint]
+	if !ok {
+		return EndpointStats{}
+	}
+	return EndpointStats{
+		Requests:  stats.Requests,
+		Errors:    stats.Errors,
+		latencies: slices.Clone(stats.latencies),
+	}
+}
+
+// Percentile returns the latency of the successful requests at the percentile p, from 0 to 100.
+func (s EndpointStats) Percentile(p float64) time.Duration {
+	if len(s.latencies) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(s.latencies)
+	slices.Sort(sorted)
+	i := int(p / 100 * float64(len(sorted)-1))
+	return sorted[min(max(i, 0), len(sorted)-1)]
+}
+
+// Print writes the request counts and latency percentiles of each endpoint.
+func (r *Report) Print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "ENDPOINT\tREQUESTS\tERRORS\tP50\tP90\tP99\tMAX\n")
+	for _, endpoint := range []string{EndpointEnroll, EndpointCheckin, EndpointAck} {
+		stats := r.Endpoint(endpoint)
+		if stats.Requests == 0 {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\t%s\n", endpoint, stats.Requests, stats.Errors,
+			stats.Percentile(50), stats.Percentile(90), stats.Percentile(99), stats.Percentile(100))
+	}
+	fmt.Fprintf(tw, "\nelapsed: %s\n", r.Elapsed.Round(time.Millisecond))
+	return tw.Flush()
+}